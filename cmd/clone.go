@@ -0,0 +1,122 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdClone() *cli.Command {
+	return &cli.Command{
+		Name:      "clone",
+		Action:    clone,
+		Category:  "TOOL",
+		Usage:     "Clone a file or directory without copying the underlying data",
+		ArgsUsage: "SRC DST",
+		Description: `
+This command makes a copy of a file or a directory by cloning its metadata only,
+the new files share the same data blocks with the source ones until either of them is modified.
+Both SRC and DST must be inside the same JuiceFS volume, and DST must not exist.
+
+Examples:
+# Clone a file
+$ juicefs clone /mnt/jfs/file1 /mnt/jfs/file2
+
+# Clone a directory
+$ juicefs clone /mnt/jfs/dir1 /mnt/jfs/dir2
+
+# Clone with the original owner, mode and times preserved
+$ juicefs clone -p /mnt/jfs/file1 /mnt/jfs/file2`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "preserve",
+				Aliases: []string{"p"},
+				Usage:   "preserve the uid, gid, mode and times of the source files",
+			},
+		},
+	}
+}
+
+func clone(ctx *cli.Context) error {
+	setup(ctx, 2)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	srcPath, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	srcIno, err := utils.GetFileInode(srcPath)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", srcPath, err)
+	}
+	dst, err := filepath.Abs(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(1), err)
+	}
+	if _, err = os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("lstat %s: %s", dst, err)
+	}
+	dstParent := filepath.Dir(dst)
+	dstName := filepath.Base(dst)
+	dstParentIno, err := utils.GetFileInode(dstParent)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", dstParent, err)
+	}
+	f := openController(dstParent)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", dst)
+	}
+	defer f.Close()
+
+	var cmode uint8
+	if ctx.Bool("preserve") {
+		cmode |= meta.CloneModePreserveAttr
+	}
+	wb := utils.NewBuffer(8 + 8 + 8 + 1 + uint32(len(dstName)) + 1 + 2)
+	wb.Put32(meta.Clone)
+	wb.Put32(8 + 8 + 1 + uint32(len(dstName)) + 1 + 2)
+	wb.Put64(srcIno)
+	wb.Put64(dstParentIno)
+	wb.Put8(uint8(len(dstName)))
+	wb.Put([]byte(dstName))
+	wb.Put8(cmode)
+	wb.Put16(uint16(utils.GetUmask()))
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	var errs = make([]byte, 1)
+	n, err := f.Read(errs)
+	if err != nil || n != 1 {
+		logger.Fatalf("read message: %d %s", n, err)
+	}
+	if errs[0] != 0 {
+		return fmt.Errorf("clone %s to %s: %s", srcPath, dst, syscall.Errno(errs[0]))
+	}
+	return nil
+}
@@ -22,8 +22,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/urfave/cli/v2"
 )
@@ -48,6 +53,30 @@ $ juicefs conifg redis://localhost --inode 10000000 --capacity 1048576
 # Change maximum days before files in trash are deleted
 $ juicefs conifg redis://localhost --trash-days 7
 
+# Enable POSIX ACL
+$ juicefs config redis://localhost --enable-acl
+
+# Keep the change log for 3 days, so the changes can be watched
+$ juicefs config redis://localhost --changelog-days 3
+
+# Invalidate the caches of other clients once the files are changed
+$ juicefs config redis://localhost --cache-invalidation
+
+# Store the data of files no larger than 4 KiB in the metadata engine
+$ juicefs config redis://localhost --inline-size 4096
+
+# Pack small slices into objects of 16 MiB
+$ juicefs config redis://localhost --pack-size 16384
+
+# Share the blocks with the same content between files
+$ juicefs config redis://localhost --dedup
+
+# Mirror all the data into a bucket in another region
+$ juicefs config redis://localhost --replica-storage s3 --replica-bucket https://mybucket.s3.us-west-1.amazonaws.com
+
+# Rotate the encrypt key, the data keys of existing objects are encrypted again with the new key
+$ juicefs config redis://localhost --rotate-encrypt-key new-key.pem
+
 # Limit client version that is allowed to connect
 $ juicefs config redis://localhost --min-client-version 1.0.0 --max-client-version 1.1.0`,
 		Flags: []cli.Flag{
@@ -71,10 +100,54 @@ $ juicefs config redis://localhost --min-client-version 1.0.0 --max-client-versi
 				Name:  "secret-key",
 				Usage: "secret key for object storage",
 			},
+			&cli.StringFlag{
+				Name:  "replica-storage",
+				Usage: "object storage type of the replica (e.g. s3, gcs, oss, cos)",
+			},
+			&cli.StringFlag{
+				Name:  "replica-bucket",
+				Usage: "the bucket URL of object storage to keep a copy of data (empty means no replica)",
+			},
+			&cli.StringFlag{
+				Name:  "replica-access-key",
+				Usage: "access key for object storage of the replica",
+			},
+			&cli.StringFlag{
+				Name:  "replica-secret-key",
+				Usage: "secret key for object storage of the replica",
+			},
+			&cli.StringFlag{
+				Name:  "rotate-encrypt-key",
+				Usage: "a path to new RSA private key (PEM) to encrypt the data keys, the old one is kept to read existing data",
+			},
 			&cli.IntFlag{
 				Name:  "trash-days",
 				Usage: "number of days after which removed files will be permanently deleted",
 			},
+			&cli.BoolFlag{
+				Name:  "enable-acl",
+				Usage: "enable POSIX ACL (it can not be disabled once enabled)",
+			},
+			&cli.IntFlag{
+				Name:  "changelog-days",
+				Usage: "number of days to keep the change log for watchers (0 means disabled)",
+			},
+			&cli.BoolFlag{
+				Name:  "cache-invalidation",
+				Usage: "invalidate the caches of other clients once the files are changed",
+			},
+			&cli.IntFlag{
+				Name:  "inline-size",
+				Usage: "store the data of files no larger than this (in bytes) in the metadata engine (it can not be disabled once enabled)",
+			},
+			&cli.IntFlag{
+				Name:  "pack-size",
+				Usage: "pack small slices into objects of this size (in KiB) (it can not be disabled once enabled)",
+			},
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Usage: "share the blocks with the same content between files (it can not be disabled once enabled)",
+			},
 			&cli.StringFlag{
 				Name:  "min-client-version",
 				Usage: "minimum client version allowed to connect",
@@ -110,6 +183,170 @@ func userConfirmed() bool {
 	return false
 }
 
+// configReplica updates the replica of the volume, it returns true if a new replica is added.
+func configReplica(ctx *cli.Context, format *meta.Format, msg *strings.Builder) (bool, error) {
+	if !ctx.IsSet("replica-storage") && !ctx.IsSet("replica-bucket") && !ctx.IsSet("replica-access-key") && !ctx.IsSet("replica-secret-key") {
+		return false, nil
+	}
+	if err := format.Decrypt(); err != nil {
+		return false, fmt.Errorf("format decrypt: %s", err)
+	}
+	old := format.Replica
+	if ctx.IsSet("replica-bucket") && ctx.String("replica-bucket") == "" {
+		if old != nil {
+			msg.WriteString(fmt.Sprintf("%s: %s -> none\n", "replica-bucket", old.Bucket))
+			format.Replica = nil
+		}
+		return false, nil
+	}
+	replica := meta.Replica{Storage: "file"}
+	if old != nil {
+		replica = *old
+	} else if !ctx.IsSet("replica-bucket") {
+		return false, fmt.Errorf("bucket of the replica is required")
+	}
+	if ctx.IsSet("replica-storage") {
+		replica.Storage = ctx.String("replica-storage")
+	}
+	if ctx.IsSet("replica-bucket") {
+		replica.Bucket = ctx.String("replica-bucket")
+		if replica.Storage == "file" {
+			if p, err := filepath.Abs(replica.Bucket); err == nil {
+				replica.Bucket = p + "/"
+			} else {
+				return false, fmt.Errorf("failed to get absolute path of %s: %s", replica.Bucket, err)
+			}
+		}
+	}
+	if ctx.IsSet("replica-access-key") {
+		replica.AccessKey = ctx.String("replica-access-key")
+	}
+	if old == nil {
+		old = &meta.Replica{}
+	}
+	if replica.Storage != old.Storage {
+		msg.WriteString(fmt.Sprintf("%s: %s -> %s\n", "replica-storage", old.Storage, replica.Storage))
+	}
+	if replica.Bucket != old.Bucket {
+		msg.WriteString(fmt.Sprintf("%s: %s -> %s\n", "replica-bucket", old.Bucket, replica.Bucket))
+	}
+	if replica.AccessKey != old.AccessKey {
+		msg.WriteString(fmt.Sprintf("%s: %s -> %s\n", "replica-access-key", old.AccessKey, replica.AccessKey))
+	}
+	if ctx.IsSet("replica-secret-key") { // always update
+		msg.WriteString(fmt.Sprintf("%s: updated\n", "replica-secret-key"))
+		replica.SecretKey = ctx.String("replica-secret-key")
+	}
+	format.Replica = &replica
+	return replica.Storage != old.Storage || replica.Bucket != old.Bucket, nil
+}
+
+// configEncryptKey rotates the encrypt key of the volume, it returns true if the key is changed.
+func configEncryptKey(ctx *cli.Context, format *meta.Format, msg *strings.Builder) (bool, error) {
+	if !ctx.IsSet("rotate-encrypt-key") {
+		return false, nil
+	}
+	if err := format.Decrypt(); err != nil {
+		return false, fmt.Errorf("format decrypt: %s", err)
+	}
+	if format.KeyProvider != "" {
+		return false, fmt.Errorf("the volume key wrapped by %s can not be rotated", format.KeyProvider)
+	}
+	if format.EncryptKey == "" {
+		return false, fmt.Errorf("the volume is not encrypted")
+	}
+	keyPath := ctx.String("rotate-encrypt-key")
+	pem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return false, fmt.Errorf("load RSA key from %s: %s", keyPath, err)
+	}
+	passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
+	newKey, err := object.ParseRsaPrivateKeyFromPem(string(pem), passphrase)
+	if err != nil {
+		return false, fmt.Errorf("parse RSA key from %s: %s", keyPath, err)
+	}
+	used := append([]meta.OldEncryptKey{{Version: format.EncryptKeyVersion, Key: format.EncryptKey}}, format.OldEncryptKeys...)
+	for i, k := range used {
+		key, err := object.ParseRsaPrivateKeyFromPem(k.Key, passphrase)
+		if err != nil {
+			return false, fmt.Errorf("load private key of version %d: %s", k.Version, err)
+		}
+		if key.PublicKey.Equal(&newKey.PublicKey) {
+			if i == 0 {
+				return false, nil // resume the re-encryption of data keys
+			}
+			return false, fmt.Errorf("the key of version %d can not be used again", k.Version)
+		}
+	}
+	msg.WriteString(fmt.Sprintf("%s: version %d -> %d\n", "encrypt-key", format.EncryptKeyVersion, format.EncryptKeyVersion+1))
+	format.OldEncryptKeys = append(format.OldEncryptKeys, used[0])
+	format.EncryptKeyVersion++
+	format.EncryptKey = string(pem)
+	return true, nil
+}
+
+// rewrapKeys encrypts the data keys of all the objects (including the ones in tiers) again with the current
+// encrypt key. The objects done already are skipped, so it can be resumed by running again.
+func rewrapKeys(format meta.Format) error {
+	blob, err := createStorage(format)
+	if err != nil {
+		return fmt.Errorf("object storage: %s", err)
+	}
+	stores := []object.ObjectStorage{blob}
+	for _, t := range format.Tiers {
+		if blob, err = createTierStorage(format, t.Id); err != nil {
+			return fmt.Errorf("tier %d: %s", t.Id, err)
+		}
+		stores = append(stores, blob)
+	}
+
+	progress := utils.NewProgress(false, false)
+	scanned := progress.AddCountSpinner("Scanned objects")
+	rewrapped := progress.AddCountSpinner("Rewrapped objects")
+	var failed int64
+	for _, store := range stores {
+		logger.Infof("Encrypt the data keys of objects in %s with key version %d", store, format.EncryptKeyVersion)
+		objs, err := osync.ListAll(store, "", "")
+		if err != nil {
+			return fmt.Errorf("list objects in %s: %s", store, err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for obj := range objs {
+					if obj == nil {
+						logger.Errorf("List objects in %s failed", store)
+						atomic.AddInt64(&failed, 1)
+						break
+					}
+					if obj.IsDir() {
+						continue
+					}
+					if done, err := object.Rewrap(store, obj.Key()); err != nil {
+						logger.Warnf("Rewrap %s: %s", obj.Key(), err)
+						atomic.AddInt64(&failed, 1)
+					} else if done {
+						rewrapped.Increment()
+					}
+					scanned.Increment()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	scanned.Done()
+	rewrapped.Done()
+	progress.Done()
+	if failed > 0 {
+		return fmt.Errorf("%d objects failed to be rewrapped, run it again to retry them", failed)
+	}
+	logger.Infof("The data keys of all %d objects are encrypted with key version %d (%d rewrapped)",
+		scanned.Current(), format.EncryptKeyVersion, rewrapped.Current())
+	return nil
+}
+
 func config(ctx *cli.Context) error {
 	setup(ctx, 1)
 	removePassword(ctx.Args().Get(0))
@@ -125,8 +362,17 @@ func config(ctx *cli.Context) error {
 		return nil
 	}
 
-	var quota, storage, trash, clientVer bool
+	var quota, storage, trash, clientVer, enableACL, enableInline, enablePack, enableDedup bool
 	var msg strings.Builder
+	addReplica, err := configReplica(ctx, format, &msg)
+	if err != nil {
+		return err
+	}
+	rotateKey, err := configEncryptKey(ctx, format, &msg)
+	if err != nil {
+		return err
+	}
+	storage = msg.Len() > 0
 	for _, flag := range ctx.LocalFlagNames() {
 		switch flag {
 		case "capacity":
@@ -174,6 +420,64 @@ func config(ctx *cli.Context) error {
 				format.TrashDays = new
 				trash = true
 			}
+		case "changelog-days":
+			if new := ctx.Int(flag); new != format.ChangelogDays {
+				if new < 0 {
+					return fmt.Errorf("Invalid changelog days: %d", new)
+				}
+				msg.WriteString(fmt.Sprintf("%s: %d -> %d\n", flag, format.ChangelogDays, new))
+				format.ChangelogDays = new
+			}
+		case "cache-invalidation":
+			if new := ctx.Bool(flag); new != format.CacheInvalidation {
+				msg.WriteString(fmt.Sprintf("%s: %t -> %t\n", flag, format.CacheInvalidation, new))
+				format.CacheInvalidation = new
+			}
+		case "enable-acl":
+			if new := ctx.Bool(flag); new != format.EnableACL {
+				if !new {
+					return fmt.Errorf("ACL can not be disabled once enabled")
+				}
+				msg.WriteString(fmt.Sprintf("%s: %t -> %t\n", flag, format.EnableACL, new))
+				format.EnableACL = new
+				enableACL = true
+			}
+		case "inline-size":
+			if new := ctx.Int(flag); new != format.InlineSize {
+				if err := meta.ValidInlineSize(new); err != nil {
+					return err
+				}
+				if new == 0 {
+					return fmt.Errorf("inline data can not be disabled once enabled")
+				}
+				msg.WriteString(fmt.Sprintf("%s: %d -> %d\n", flag, format.InlineSize, new))
+				enableInline = format.InlineSize == 0
+				format.InlineSize = new
+			}
+		case "pack-size":
+			if new := ctx.Int(flag); new != format.PackSize {
+				if err := meta.ValidPackSize(new); err != nil {
+					return err
+				}
+				if new == 0 {
+					return fmt.Errorf("packing can not be disabled once enabled")
+				}
+				if format.EncryptKey != "" || format.KeyProvider != "" {
+					return fmt.Errorf("packing can not be used together with encryption")
+				}
+				msg.WriteString(fmt.Sprintf("%s: %d -> %d\n", flag, format.PackSize, new))
+				enablePack = format.PackSize == 0
+				format.PackSize = new
+			}
+		case "dedup":
+			if new := ctx.Bool(flag); new != format.Dedup {
+				if !new {
+					return fmt.Errorf("deduplication can not be disabled once enabled")
+				}
+				msg.WriteString(fmt.Sprintf("%s: %t -> %t\n", flag, format.Dedup, new))
+				format.Dedup = new
+				enableDedup = true
+			}
 		case "min-client-version":
 			if new := ctx.String(flag); new != format.MinClientVersion {
 				if version.Parse(new) == nil {
@@ -194,7 +498,13 @@ func config(ctx *cli.Context) error {
 			}
 		}
 	}
+	if old := format.MinClientVersion; format.UpdateClientVersion() {
+		msg.WriteString(fmt.Sprintf("%s: %s -> %s\n", "min-client-version", old, format.MinClientVersion))
+	}
 	if msg.Len() == 0 {
+		if ctx.IsSet("rotate-encrypt-key") { // the key is rotated already
+			return rewrapKeys(*format)
+		}
 		fmt.Println("Nothing changed.")
 		return nil
 	}
@@ -228,6 +538,42 @@ func config(ctx *cli.Context) error {
 				return fmt.Errorf("Aborted.")
 			}
 		}
+		if enableACL {
+			warn("Clients of older versions will be rejected since they ignore ACLs, and those mounted before this change will not enforce ACLs until they are remounted.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
+		if enableInline {
+			warn("Clients of older versions can not read the data stored inline, they should be upgraded first.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
+		if enablePack {
+			warn("Clients of older versions can not read the packed slices, they should be upgraded first. Clients mounted before this change will not pack slices until they are remounted.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
+		if addReplica {
+			warn("The existing data is not copied into the replica, run \"juicefs fsck --replica --repair\" to copy it. Clients of older versions will be rejected since they do not write into the replica, and those mounted before this change will not write into it until they are remounted.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
+		if enableDedup {
+			warn("Clients of older versions can not read the shared blocks and may delete them, they should be upgraded first. Clients mounted before this change will not share blocks until they are remounted.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
+		if rotateKey {
+			warn("Clients of older versions can not read the data encrypted with the new key, they should be upgraded first. The data keys of all the objects will be encrypted again with the new key, run the same command to resume it if it's interrupted.")
+			if !userConfirmed() {
+				return fmt.Errorf("Aborted.")
+			}
+		}
 		if clientVer && format.CheckVersion() != nil {
 			warn("Clients with the same version of this will be rejected after modification.")
 			if !userConfirmed() {
@@ -242,5 +588,8 @@ func config(ctx *cli.Context) error {
 	if err = m.Init(*format, false); err == nil {
 		fmt.Println(msg.String()[:msg.Len()-1])
 	}
+	if err == nil && ctx.IsSet("rotate-encrypt-key") {
+		err = rewrapKeys(*format)
+	}
 	return err
 }
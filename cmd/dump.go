@@ -29,12 +29,13 @@ func cmdDump() *cli.Command {
 		Name:      "dump",
 		Action:    dump,
 		Category:  "ADMIN",
-		Usage:     "Dump metadata into a JSON file",
+		Usage:     "Dump metadata into a JSON or binary file",
 		ArgsUsage: "META-URL [FILE]",
 		Description: `
 Dump metadata of the volume in JSON format so users are able to see its content in an easy way.
 Output of this command can be loaded later into an empty database, serving as a method to backup
-metadata or to change metadata engine.
+metadata or to change metadata engine. For large volumes, the compact binary format (optionally
+compressed by zstd) is much smaller and faster to dump and load, the format is detected by load.
 
 Examples:
 $ juicefs dump redis://localhost meta-dump
@@ -42,23 +43,34 @@ $ juicefs dump redis://localhost meta-dump
 # Dump only a subtree of the volume
 $ juicefs dump redis://localhost sub-meta-dump --subdir /dir/in/jfs
 
+# Dump in binary format compressed by zstd
+$ juicefs dump redis://localhost meta-dump.bin --format binary-zstd
+
 Details: https://juicefs.com/docs/community/metadata_dump_load`,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "subdir",
 				Usage: "only dump a sub-directory",
 			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "format of the dumped file (json, binary, binary-zstd)",
+			},
 		},
 	}
 }
 
 func dump(ctx *cli.Context) error {
 	setup(ctx, 1)
+	format, err := meta.ParseDumpFormat(ctx.String("format"))
+	if err != nil {
+		return err
+	}
 	var fp io.WriteCloser
 	if ctx.Args().Len() == 1 {
 		fp = os.Stdout
 	} else {
-		var err error
 		fp, err = os.OpenFile(ctx.Args().Get(1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
 			return err
@@ -70,7 +82,7 @@ func dump(ctx *cli.Context) error {
 	if _, err := m.Load(true); err != nil {
 		return err
 	}
-	if err := m.DumpMeta(fp, 1); err != nil {
+	if err := m.DumpMeta(fp, 1, format); err != nil {
 		return err
 	}
 	logger.Infof("Dump metadata into %s succeed", ctx.Args().Get(1))
@@ -22,6 +22,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/urfave/cli/v2"
 )
 
@@ -148,6 +149,19 @@ func clientFlags() []cli.Flag {
 			Value: time.Hour,
 			Usage: "interval to automatically backup metadata in the object storage (0 means disable backup)",
 		},
+		&cli.StringFlag{
+			Name:  "backup-meta-format",
+			Value: "json",
+			Usage: "format of the metadata backups (json, binary, binary-zstd)",
+		},
+		&cli.StringFlag{
+			Name:  "tier-migrate",
+			Usage: "move the files not modified for a while into a tier every hour (e.g. cold:90d)",
+		},
+		&cli.Int64Flag{
+			Name:  "scrub-bwlimit",
+			Usage: "verify all the data of the volume in background with this bandwidth limit in Mbps (0 means disabled)",
+		},
 
 		&cli.BoolFlag{
 			Name:  "read-only",
@@ -162,6 +176,11 @@ func clientFlags() []cli.Flag {
 			Value: 0.0,
 			Usage: "open files cache timeout in seconds (0 means disable this feature)",
 		},
+		&cli.StringFlag{
+			Name:  "atime-mode",
+			Value: meta.NoAtime,
+			Usage: "when to update the access time of files and directories (noatime, relatime, strictatime)",
+		},
 		&cli.StringFlag{
 			Name:  "subdir",
 			Usage: "mount a sub-directory as root",
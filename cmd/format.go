@@ -18,7 +18,9 @@ package main
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"math/rand"
@@ -88,6 +90,12 @@ $ juicefs format sqlite3://myjfs.db myjfs --inode 1000000 --capacity 102400
 # Create a volume with "trash" disabled
 $ juicefs format sqlite3://myjfs.db myjfs --trash-days 0
 
+# Create a volume with erasure code 4+2 in 6 buckets (mybucket0 to mybucket5)
+$ juicefs format redis://localhost myjfs --storage s3 --bucket https://mybucket%d.s3.us-east-2.amazonaws.com --data-shards 4 --parity-shards 2
+
+# Create a volume with all the data mirrored into another bucket
+$ juicefs format redis://localhost myjfs --storage s3 --bucket https://mybucket.s3.us-east-2.amazonaws.com --replica-storage s3 --replica-bucket https://mybucket.s3.us-west-1.amazonaws.com
+
 Details: https://juicefs.com/docs/community/quick_start_guide`,
 		Flags: []cli.Flag{
 			&cli.IntFlag{
@@ -115,6 +123,16 @@ Details: https://juicefs.com/docs/community/quick_start_guide`,
 				Value: 0,
 				Usage: "store the blocks into N buckets by hash of key",
 			},
+			&cli.IntFlag{
+				Name:  "data-shards",
+				Value: 0,
+				Usage: "split each block into N data shards for erasure code, which are stored in different buckets together with parity shards",
+			},
+			&cli.IntFlag{
+				Name:  "parity-shards",
+				Value: 0,
+				Usage: "number of parity shards for erasure code, the blocks can be read with any N of the shards (0 means disabled)",
+			},
 			&cli.StringFlag{
 				Name:  "storage",
 				Value: "file",
@@ -133,15 +151,67 @@ Details: https://juicefs.com/docs/community/quick_start_guide`,
 				Name:  "secret-key",
 				Usage: "secret key for object storage (env SECRET_KEY)",
 			},
+			&cli.StringFlag{
+				Name:  "replica-storage",
+				Value: "file",
+				Usage: "object storage type of the replica (e.g. s3, gcs, oss, cos)",
+			},
+			&cli.StringFlag{
+				Name:  "replica-bucket",
+				Usage: "the bucket URL of object storage to keep a copy of data",
+			},
+			&cli.StringFlag{
+				Name:  "replica-access-key",
+				Usage: "access key for object storage of the replica",
+			},
+			&cli.StringFlag{
+				Name:  "replica-secret-key",
+				Usage: "secret key for object storage of the replica",
+			},
 			&cli.StringFlag{
 				Name:  "encrypt-rsa-key",
 				Usage: "a path to RSA private key (PEM)",
 			},
+			&cli.StringFlag{
+				Name:  "encrypt-key-provider",
+				Usage: "URI of the key provider wrapping the volume key to encrypt data (file:///path/to/keystore, env://NAME or vault://HOST:PORT/MOUNT/KEY)",
+			},
 			&cli.IntFlag{
 				Name:  "trash-days",
 				Value: 1,
 				Usage: "number of days after which removed files will be permanently deleted",
 			},
+			&cli.BoolFlag{
+				Name:  "enable-acl",
+				Usage: "enable POSIX ACL",
+			},
+			&cli.IntFlag{
+				Name:  "changelog-days",
+				Value: 0,
+				Usage: "number of days to keep the change log for watchers (0 means disabled)",
+			},
+			&cli.BoolFlag{
+				Name:  "cache-invalidation",
+				Usage: "invalidate the caches of other clients once the files are changed",
+			},
+			&cli.IntFlag{
+				Name:  "inline-size",
+				Value: 0,
+				Usage: "store the data of files no larger than this (in bytes) in the metadata engine (0 means disabled)",
+			},
+			&cli.IntFlag{
+				Name:  "pack-size",
+				Value: 0,
+				Usage: "pack small slices into objects of this size (in KiB) (0 means disabled)",
+			},
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Usage: "share the blocks with the same content between files",
+			},
+			&cli.BoolFlag{
+				Name:  "block-checksum",
+				Usage: "append a checksum to every block and verify it on read (can not be changed after format)",
+			},
 			&cli.BoolFlag{
 				Name:  "force",
 				Usage: "overwrite existing format",
@@ -194,7 +264,9 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 		}
 		object.GetHttpClient().Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: tlsSkipVerify}
 	}
-	if format.Shards > 1 {
+	if format.ParityShards > 0 {
+		blob, err = object.NewErasure(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.DataShards, format.ParityShards)
+	} else if format.Shards > 1 {
 		blob, err = object.NewSharded(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.Shards)
 	} else {
 		blob, err = object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey)
@@ -203,19 +275,129 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 		return nil, err
 	}
 	blob = object.WithPrefix(blob, format.Name+"/")
+	if format.Replica != nil {
+		format.EncryptKey, format.KeyProvider = "", "" // the data is encrypted before replicated
+		replica, err := createReplicaStorage(format)
+		if err != nil {
+			return nil, fmt.Errorf("replica: %s", err)
+		}
+		blob = object.NewReplicated(blob, replica, replicaTimeout)
+	}
 
-	if format.EncryptKey != "" {
-		passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
-		privKey, err := object.ParseRsaPrivateKeyFromPem(format.EncryptKey, passphrase)
+	if format.EncryptKey != "" || format.KeyProvider != "" {
+		keys, err := loadEncryptKeys(format)
 		if err != nil {
-			return nil, fmt.Errorf("load private key: %s", err)
+			return nil, err
 		}
-		encryptor := object.NewAESEncryptor(object.NewRSAEncryptor(privKey))
+		encryptor := object.NewAESEncryptor(object.NewKeyRing(format.EncryptKeyVersion, keys))
 		blob = object.NewEncrypted(blob, encryptor)
 	}
 	return blob, nil
 }
 
+// wrapVolumeKey generates a random volume key and wraps it with the key provider.
+func wrapVolumeKey(uri string) (string, string) {
+	if strings.HasPrefix(uri, "file://") {
+		p, err := filepath.Abs(strings.TrimPrefix(uri, "file://"))
+		if err != nil {
+			logger.Fatalf("Failed to get absolute path of %s: %s", uri, err)
+		}
+		uri = "file://" + p
+	}
+	provider, err := object.NewKeyProvider(uri)
+	if err != nil {
+		logger.Fatalf("key provider: %s", err)
+	}
+	key := make([]byte, 32)
+	if _, err = io.ReadFull(crand.Reader, key); err != nil {
+		logger.Fatalf("generate volume key: %s", err)
+	}
+	wrapped, err := provider.WrapKey(key)
+	if err != nil {
+		logger.Fatalf("wrap volume key with %s: %s", provider, err)
+	}
+	return uri, base64.StdEncoding.EncodeToString(wrapped)
+}
+
+// unwrapVolumeKey unwraps the volume key with the key provider, it's never stored in the clear.
+func unwrapVolumeKey(format *meta.Format) (object.Encryptor, error) {
+	provider, err := object.NewKeyProvider(format.KeyProvider)
+	if err != nil {
+		return nil, fmt.Errorf("key provider: %s", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(format.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode wrapped key: %s", err)
+	}
+	key, err := provider.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap volume key with %s: %s", provider, err)
+	}
+	return object.NewGCMEncryptor(key)
+}
+
+// loadEncryptKeys parses the current and old encrypt keys of the volume by version.
+func loadEncryptKeys(format meta.Format) (map[int]object.Encryptor, error) {
+	if format.KeyProvider != "" {
+		enc, err := unwrapVolumeKey(&format)
+		if err != nil {
+			return nil, err
+		}
+		return map[int]object.Encryptor{format.EncryptKeyVersion: enc}, nil
+	}
+	if err := format.Decrypt(); err != nil {
+		return nil, fmt.Errorf("format decrypt: %s", err)
+	}
+	passphrase := os.Getenv("JFS_RSA_PASSPHRASE")
+	keys := make(map[int]object.Encryptor)
+	privKey, err := object.ParseRsaPrivateKeyFromPem(format.EncryptKey, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("load private key: %s", err)
+	}
+	keys[format.EncryptKeyVersion] = object.NewRSAEncryptor(privKey)
+	for _, k := range format.OldEncryptKeys {
+		if privKey, err = object.ParseRsaPrivateKeyFromPem(k.Key, passphrase); err != nil {
+			return nil, fmt.Errorf("load private key of version %d: %s", k.Version, err)
+		}
+		keys[k.Version] = object.NewRSAEncryptor(privKey)
+	}
+	return keys, nil
+}
+
+// watchEncryptKeys makes the encrypted storage use the keys rotated after it's created.
+func watchEncryptKeys(m meta.Meta, blob object.ObjectStorage) {
+	ring := object.KeyRingOf(blob)
+	if ring == nil {
+		return
+	}
+	ring.SetReload(func(current int) (int, map[int]object.Encryptor, error) {
+		format, err := m.Load(false)
+		if err != nil || format.EncryptKeyVersion == current {
+			return current, nil, err
+		}
+		keys, err := loadEncryptKeys(*format)
+		return format.EncryptKeyVersion, keys, err
+	})
+}
+
+// the reads fall back to the replica if the primary storage doesn't respond in time
+const replicaTimeout = time.Second * 10
+
+// createReplicaStorage creates the object storage of the replica, with the same prefix and encryption as the volume.
+func createReplicaStorage(format meta.Format) (object.ObjectStorage, error) {
+	if err := format.Decrypt(); err != nil {
+		return nil, fmt.Errorf("format decrypt: %s", err)
+	}
+	if format.Replica == nil {
+		return nil, fmt.Errorf("no replica in volume %s", format.Name)
+	}
+	r := format.Replica
+	format.Storage, format.Bucket, format.AccessKey, format.SecretKey = r.Storage, r.Bucket, r.AccessKey, r.SecretKey
+	format.Shards, format.DataShards, format.ParityShards = 0, 0, 0
+	format.Replica = nil
+	return createStorage(format)
+}
+
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
 func randSeq(n int) string {
@@ -296,6 +478,23 @@ func format(c *cli.Context) error {
 	if v := c.Int("trash-days"); v < 0 {
 		logger.Fatalf("Invalid trash days: %d", v)
 	}
+	if v := c.Int("changelog-days"); v < 0 {
+		logger.Fatalf("Invalid changelog days: %d", v)
+	}
+	if err := meta.ValidInlineSize(c.Int("inline-size")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if err := meta.ValidPackSize(c.Int("pack-size")); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	if d, p := c.Int("data-shards"), c.Int("parity-shards"); d > 0 || p > 0 {
+		if d <= 0 || p <= 0 || d+p > 256 {
+			logger.Fatalf("Invalid erasure code: %d+%d", d, p)
+		}
+		if c.Int("shards") > 1 {
+			logger.Fatalf("Erasure code can not be used together with shards")
+		}
+	}
 
 	loadEncrypt := func(keyPath string) string {
 		if keyPath == "" {
@@ -312,20 +511,29 @@ func format(c *cli.Context) error {
 	if format, _ = m.Load(false); format == nil {
 		create = true
 		format = &meta.Format{
-			Name:        name,
-			UUID:        uuid.New().String(),
-			Storage:     c.String("storage"),
-			Bucket:      c.String("bucket"),
-			AccessKey:   c.String("access-key"),
-			SecretKey:   c.String("secret-key"),
-			EncryptKey:  loadEncrypt(c.String("encrypt-rsa-key")),
-			Shards:      c.Int("shards"),
-			Capacity:    c.Uint64("capacity") << 30,
-			Inodes:      c.Uint64("inodes"),
-			BlockSize:   fixObjectSize(c.Int("block-size")),
-			Compression: c.String("compress"),
-			TrashDays:   c.Int("trash-days"),
-			MetaVersion: 1,
+			Name:              name,
+			UUID:              uuid.New().String(),
+			Storage:           c.String("storage"),
+			Bucket:            c.String("bucket"),
+			AccessKey:         c.String("access-key"),
+			SecretKey:         c.String("secret-key"),
+			EncryptKey:        loadEncrypt(c.String("encrypt-rsa-key")),
+			Shards:            c.Int("shards"),
+			DataShards:        c.Int("data-shards"),
+			ParityShards:      c.Int("parity-shards"),
+			Capacity:          c.Uint64("capacity") << 30,
+			Inodes:            c.Uint64("inodes"),
+			BlockSize:         fixObjectSize(c.Int("block-size")),
+			Compression:       c.String("compress"),
+			TrashDays:         c.Int("trash-days"),
+			EnableACL:         c.Bool("enable-acl"),
+			ChangelogDays:     c.Int("changelog-days"),
+			CacheInvalidation: c.Bool("cache-invalidation"),
+			InlineSize:        c.Int("inline-size"),
+			PackSize:          c.Int("pack-size"),
+			Dedup:             c.Bool("dedup"),
+			BlockChecksum:     c.Bool("block-checksum"),
+			MetaVersion:       1,
 		}
 		if format.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
 			format.AccessKey = os.Getenv("ACCESS_KEY")
@@ -335,6 +543,27 @@ func format(c *cli.Context) error {
 			format.SecretKey = os.Getenv("SECRET_KEY")
 			_ = os.Unsetenv("SECRET_KEY")
 		}
+		if bucket := c.String("replica-bucket"); bucket != "" {
+			format.Replica = &meta.Replica{
+				Storage:   c.String("replica-storage"),
+				Bucket:    bucket,
+				AccessKey: c.String("replica-access-key"),
+				SecretKey: c.String("replica-secret-key"),
+			}
+			if format.Replica.Storage == "file" {
+				if p, err := filepath.Abs(bucket); err == nil {
+					format.Replica.Bucket = p + "/"
+				} else {
+					logger.Fatalf("Failed to get absolute path of %s: %s", bucket, err)
+				}
+			}
+		}
+		if provider := c.String("encrypt-key-provider"); provider != "" {
+			if format.EncryptKey != "" {
+				logger.Fatalf("--encrypt-rsa-key and --encrypt-key-provider can not be used together")
+			}
+			format.KeyProvider, format.WrappedKey = wrapVolumeKey(provider)
+		}
 	} else {
 		if c.Bool("no-update") {
 			return nil
@@ -355,6 +584,28 @@ func format(c *cli.Context) error {
 				format.KeyEncrypted = false
 			case "trash-days":
 				format.TrashDays = c.Int(flag)
+			case "changelog-days":
+				format.ChangelogDays = c.Int(flag)
+			case "cache-invalidation":
+				format.CacheInvalidation = c.Bool(flag)
+			case "inline-size":
+				if v := c.Int(flag); v > 0 {
+					format.InlineSize = v
+				} else if format.InlineSize > 0 {
+					logger.Warnf("Flag %s is ignored since inline data can not be disabled once enabled", flag)
+				}
+			case "pack-size":
+				if v := c.Int(flag); v > 0 {
+					format.PackSize = v
+				} else if format.PackSize > 0 {
+					logger.Warnf("Flag %s is ignored since packing can not be disabled once enabled", flag)
+				}
+			case "dedup":
+				if c.Bool(flag) {
+					format.Dedup = true
+				} else if format.Dedup {
+					logger.Warnf("Flag %s is ignored since deduplication can not be disabled once enabled", flag)
+				}
 			case "block-size":
 				format.BlockSize = fixObjectSize(c.Int(flag))
 			case "compress":
@@ -363,17 +614,31 @@ func format(c *cli.Context) error {
 				format.Shards = c.Int(flag)
 			case "storage":
 				format.Storage = c.String(flag)
-			case "encrypt-rsa-key":
+			case "enable-acl":
+				if c.Bool(flag) {
+					format.EnableACL = true
+				} else if format.EnableACL {
+					logger.Warnf("Flag %s is ignored since ACL can not be disabled once enabled", flag)
+				}
+			case "encrypt-rsa-key", "encrypt-key-provider", "data-shards", "parity-shards", "block-checksum":
 				logger.Warnf("Flag %s is ignored since it cannot be updated", flag)
 			}
 		}
 	}
+	if format.PackSize > 0 && (format.EncryptKey != "" || format.KeyProvider != "") {
+		// the encrypted objects are decrypted as a whole, so every ranged read of a pack would download all of it
+		logger.Fatalf("Packing can not be used together with encryption")
+	}
 	if format.Storage == "file" {
-		if p, err := filepath.Abs(format.Bucket); err == nil {
-			format.Bucket = p + "/"
-		} else {
-			logger.Fatalf("Failed to get absolute path of %s: %s", format.Bucket, err)
+		buckets := strings.Split(format.Bucket, ",") // the shards of erasure code
+		for i, b := range buckets {
+			if p, err := filepath.Abs(b); err == nil {
+				buckets[i] = p + "/"
+			} else {
+				logger.Fatalf("Failed to get absolute path of %s: %s", b, err)
+			}
 		}
+		format.Bucket = strings.Join(buckets, ",")
 	}
 
 	blob, err := createStorage(*format)
@@ -406,6 +671,7 @@ func format(c *cli.Context) error {
 		}
 	}
 
+	format.UpdateClientVersion()
 	if err = format.Encrypt(); err != nil {
 		logger.Fatalf("Format encrypt: %s", err)
 	}
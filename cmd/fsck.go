@@ -19,6 +19,7 @@ package main
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,10 +41,52 @@ func cmdFsck() *cli.Command {
 		ArgsUsage: "META-URL",
 		Description: `
 It scans all objects in data storage and slices in metadata, comparing them to see if there is any
-lost object or broken file.
+lost object or broken file. With --dir-stats, it checks the statistics of directories instead, which
+are used by "juicefs info" to summarize a directory quickly. With --check-meta, it checks the integrity
+of metadata instead: nlink of nodes, entries pointing to missing nodes, orphan nodes, data beyond the
+length of files, references of slices and the counters of used space and inodes. The orphan nodes are
+moved into /lost+found when repairing. If erasure code is used, the shards of objects are checked, and
+the lost ones are rebuilt when repairing. With --replica, it compares the objects in the primary storage
+and the replica instead, and copies the missing or different ones when repairing. It should be run when
+no client is writing the volume.
 
 Examples:
-$ juicefs fsck redis://localhost`,
+$ juicefs fsck redis://localhost
+
+# Check the statistics of all directories under /dir1
+$ juicefs fsck redis://localhost --dir-stats --path /dir1
+
+# Recalculate the broken statistics of all directories
+$ juicefs fsck redis://localhost --dir-stats --repair
+
+# Check and repair the metadata of the whole volume
+$ juicefs fsck redis://localhost --check-meta --repair
+
+# Copy the objects missing in the replica or the primary storage
+$ juicefs fsck redis://localhost --replica --repair`,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "dir-stats",
+				Usage: "check the statistics of directories instead of objects",
+			},
+			&cli.BoolFlag{
+				Name:  "check-meta",
+				Usage: "check the integrity of metadata instead of objects",
+			},
+			&cli.BoolFlag{
+				Name:  "replica",
+				Usage: "compare the objects in the primary storage and the replica instead",
+			},
+			&cli.StringFlag{
+				Name:  "path",
+				Value: "/",
+				Usage: "full path of the directory to check statistics or metadata within the volume",
+			},
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "recalculate the statistics of directories if they are missing or broken, repair the broken metadata, copy the objects missing in the replica, or rebuild the lost shards of objects",
+			},
+		},
 	}
 }
 
@@ -55,6 +98,15 @@ func fsck(ctx *cli.Context) error {
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
+	if ctx.Bool("dir-stats") {
+		return m.CheckDirStats(meta.NewContext(0, 0, []uint32{0}), ctx.String("path"), ctx.Bool("repair"))
+	}
+	if ctx.Bool("check-meta") {
+		return m.CheckMeta(meta.NewContext(0, 0, []uint32{0}), ctx.String("path"), ctx.Bool("repair"))
+	}
+	if ctx.Bool("replica") {
+		return checkReplica(format, ctx.Bool("repair"))
+	}
 
 	chunkConf := chunk.Config{
 		BlockSize: format.BlockSize * 1024,
@@ -72,6 +124,59 @@ func fsck(ctx *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+
+	// Check the shards of objects if erasure code is used
+	progress := utils.NewProgress(false, false)
+	var checkShards func(key string) bool
+	if format.ParityShards > 0 {
+		raw := *format
+		raw.EncryptKey, raw.KeyProvider = "", ""
+		raw.Replica = nil
+		ec, err := createStorage(raw)
+		if err != nil {
+			logger.Fatalf("object storage: %s", err)
+		}
+		lostSpin := progress.AddCountSpinner("Lost shards")
+		repair := ctx.Bool("repair")
+		checkShards = func(key string) bool {
+			missing, err := object.RepairShards(ec, key, repair)
+			if err != nil {
+				logger.Errorf("Can't rebuild object %s: %s", key, err)
+				return false
+			}
+			if len(missing) > 0 {
+				logger.Warnf("Shards %v of object %s are lost", missing, key)
+				lostSpin.IncrBy(len(missing))
+			}
+			return true
+		}
+		defer func() {
+			if n := lostSpin.Current(); n > 0 && !repair {
+				logger.Warnf("%d shards are lost, run with --repair to rebuild them", n)
+			}
+		}()
+	}
+
+	// Find all packs in object storage
+	packs := make(map[string]bool)
+	if format.PackSize > 0 {
+		pobjs, err := osync.ListAll(object.WithPrefix(blob, "packs/"), "", "")
+		if err != nil {
+			logger.Fatalf("list all packs: %s", err)
+		}
+		for obj := range pobjs {
+			if obj == nil {
+				break // failed listing
+			}
+			if !obj.IsDir() {
+				if checkShards != nil && !checkShards("packs/"+obj.Key()) {
+					continue
+				}
+				parts := strings.Split(obj.Key(), "/")
+				packs[parts[len(parts)-1]] = true
+			}
+		}
+	}
 	blob = object.WithPrefix(blob, "chunks/")
 	objs, err := osync.ListAll(blob, "", "")
 	if err != nil {
@@ -79,9 +184,9 @@ func fsck(ctx *cli.Context) error {
 	}
 
 	// Find all blocks in object storage
-	progress := utils.NewProgress(false, false)
 	blockDSpin := progress.AddDoubleSpinner("Found blocks")
 	var blocks = make(map[string]int64)
+	var broken = make(map[string]bool) // objects without enough shards
 	for obj := range objs {
 		if obj == nil {
 			break // failed listing
@@ -96,6 +201,10 @@ func fsck(ctx *cli.Context) error {
 			continue
 		}
 		name := parts[2]
+		if checkShards != nil && !checkShards("chunks/"+obj.Key()) {
+			broken[name] = true
+			continue
+		}
 		blocks[name] = obj.Size()
 		blockDSpin.IncrInt64(obj.Size())
 	}
@@ -115,6 +224,28 @@ func fsck(ctx *cli.Context) error {
 	}
 	sliceCSpin.Done()
 
+	// Find the objects of shared blocks
+	shared := make(map[string]string)
+	if format.Dedup {
+		st := m.ListDedupBlocks(c, func(hash []byte, owner *meta.Block, refs []meta.Block) {
+			for _, b := range refs {
+				shared[fmt.Sprintf("%d_%d", b.Chunkid, b.Indx)] = fmt.Sprintf("%d_%d_%d", owner.Chunkid, owner.Indx, owner.Size)
+			}
+		})
+		if st != 0 {
+			logger.Fatalf("list shared blocks: %s", st)
+		}
+	}
+
+	// Find the slices in tiers, which are checked in the storages of them
+	tiers := make(map[uint64]uint8)
+	tierStores := make(map[uint8]object.ObjectStorage)
+	if len(format.Tiers) > 0 {
+		if st := m.ListSliceTiers(c, func(chunkid uint64, tier uint8) { tiers[chunkid] = tier }); st != 0 {
+			logger.Fatalf("list slices in tiers: %s", st)
+		}
+	}
+
 	// Scan all slices to find lost blocks
 	sliceCBar := progress.AddCountBar("Scanned slices", sliceCSpin.Current())
 	sliceBSpin := progress.AddByteSpinner("Scanned slices")
@@ -122,6 +253,23 @@ func fsck(ctx *cli.Context) error {
 	brokens := make(map[meta.Ino]string)
 	for inode, ss := range slices {
 		for _, s := range ss {
+			var ps meta.PackedSlice
+			if format.PackSize > 0 && int(s.Size) <= chunkConf.BlockSize/16 && m.GetPacked(c, s.Chunkid, &ps) == 0 {
+				if !packs[strconv.FormatUint(ps.Pack, 10)] {
+					if _, ok := brokens[inode]; !ok {
+						if p, st := meta.GetPath(m, meta.Background, inode); st == 0 {
+							brokens[inode] = p
+						} else {
+							brokens[inode] = st.Error()
+						}
+					}
+					logger.Errorf("can't find pack %d of slice %d for file %s", ps.Pack, s.Chunkid, brokens[inode])
+					lostDSpin.IncrInt64(int64(s.Size))
+				}
+				sliceCBar.Increment()
+				sliceBSpin.IncrInt64(int64(s.Size))
+				continue
+			}
 			n := (s.Size - 1) / uint32(chunkConf.BlockSize)
 			for i := uint32(0); i <= n; i++ {
 				sz := chunkConf.BlockSize
@@ -129,19 +277,28 @@ func fsck(ctx *cli.Context) error {
 					sz = int(s.Size) - int(i)*chunkConf.BlockSize
 				}
 				key := fmt.Sprintf("%d_%d_%d", s.Chunkid, i, sz)
-				if _, ok := blocks[key]; !ok {
-					if _, err := blob.Head(key); err != nil {
-						if _, ok := brokens[inode]; !ok {
-							if p, st := meta.GetPath(m, meta.Background, inode); st == 0 {
-								brokens[inode] = p
-							} else {
-								logger.Warnf("getpath of inode %d: %s", inode, st)
-								brokens[inode] = st.Error()
-							}
+				if okey, ok := shared[fmt.Sprintf("%d_%d", s.Chunkid, i)]; ok {
+					key = okey
+				}
+				var err error
+				if tier, ok := tiers[s.Chunkid]; ok {
+					err = headTierBlock(format, tierStores, tier, s.Chunkid, i, sz)
+				} else if broken[key] {
+					err = fmt.Errorf("not enough shards")
+				} else if _, ok := blocks[key]; !ok {
+					_, err = blob.Head(key)
+				}
+				if err != nil {
+					if _, ok := brokens[inode]; !ok {
+						if p, st := meta.GetPath(m, meta.Background, inode); st == 0 {
+							brokens[inode] = p
+						} else {
+							logger.Warnf("getpath of inode %d: %s", inode, st)
+							brokens[inode] = st.Error()
 						}
-						logger.Errorf("can't find block %s for file %s: %s", key, brokens[inode], err)
-						lostDSpin.IncrInt64(int64(sz))
 					}
+					logger.Errorf("can't find block %s for file %s: %s", key, brokens[inode], err)
+					lostDSpin.IncrInt64(int64(sz))
 				}
 			}
 			sliceCBar.Increment()
@@ -166,3 +323,103 @@ func fsck(ctx *cli.Context) error {
 
 	return nil
 }
+
+// checkReplica compares the objects (as they are stored) in the primary storage and the replica, the missing
+// ones are copied from the other side, and the different ones are copied from the primary storage.
+func checkReplica(format *meta.Format, repair bool) error {
+	if format.Replica == nil {
+		return fmt.Errorf("no replica in volume %s", format.Name)
+	}
+	raw := *format
+	raw.EncryptKey, raw.KeyProvider = "", ""
+	replica, err := createReplicaStorage(raw)
+	if err != nil {
+		return fmt.Errorf("replica: %s", err)
+	}
+	raw.Replica = nil
+	primary, err := createStorage(raw)
+	if err != nil {
+		return fmt.Errorf("object storage: %s", err)
+	}
+	logger.Infof("Compare objects in %s and %s", primary, replica)
+	pobjs, err := osync.ListAll(primary, "", "")
+	if err != nil {
+		return fmt.Errorf("list objects in %s: %s", primary, err)
+	}
+	robjs, err := osync.ListAll(replica, "", "")
+	if err != nil {
+		return fmt.Errorf("list objects in %s: %s", replica, err)
+	}
+
+	progress := utils.NewProgress(false, false)
+	scanned := progress.AddCountSpinner("Scanned objects")
+	diverged := progress.AddDoubleSpinner("Diverged objects")
+	repaired := progress.AddCountSpinner("Repaired objects")
+	var failed int
+	check := func(src, dst object.ObjectStorage, o object.Object, reason string) {
+		logger.Warnf("Object %s is %s", o.Key(), reason)
+		diverged.IncrInt64(o.Size())
+		if !repair {
+			return
+		}
+		if err := copyObject(src, dst, o.Key()); err != nil {
+			logger.Errorf("Copy %s from %s to %s: %s", o.Key(), src, dst, err)
+			failed++
+		} else {
+			repaired.Increment()
+		}
+	}
+	next := func(objs <-chan object.Object) object.Object {
+		for o := range objs {
+			if o == nil {
+				logger.Fatalf("List objects failed")
+			}
+			if !o.IsDir() {
+				return o
+			}
+		}
+		return nil
+	}
+	p, r := next(pobjs), next(robjs)
+	for p != nil || r != nil {
+		scanned.Increment()
+		switch {
+		case r == nil || p != nil && p.Key() < r.Key():
+			check(primary, replica, p, "missing in the replica")
+			p = next(pobjs)
+		case p == nil || r.Key() < p.Key():
+			check(replica, primary, r, "missing in the primary storage")
+			r = next(robjs)
+		default:
+			if p.Size() != r.Size() {
+				check(primary, replica, p, fmt.Sprintf("different in the replica (%d != %d bytes)", r.Size(), p.Size()))
+			}
+			p, r = next(pobjs), next(robjs)
+		}
+	}
+	scanned.Done()
+	diverged.Done()
+	repaired.Done()
+	progress.Done()
+	if dc, db := diverged.Current(); dc > 0 {
+		if !repair {
+			return fmt.Errorf("%d objects (%d bytes) are diverged, run with --repair to copy them", dc, db)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d diverged objects failed to copy", failed, dc)
+		}
+		logger.Infof("Copied %d diverged objects (%d bytes)", dc, db)
+	} else {
+		logger.Infof("The replica is consistent with the primary storage (%d objects)", scanned.Current())
+	}
+	return nil
+}
+
+func copyObject(src, dst object.ObjectStorage, key string) error {
+	in, err := src.Get(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return dst.Put(key, in)
+}
@@ -191,6 +191,7 @@ func initForSvc(c *cli.Context, mp string, metaUrl string) (meta.Meta, chunk.Chu
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	watchEncryptKeys(metaCli, blob)
 
 	store := chunk.NewCachedStore(blob, *chunkConf, registerer)
 	registerMetaMsg(metaCli, store, chunkConf)
@@ -206,7 +207,7 @@ func initForSvc(c *cli.Context, mp string, metaUrl string) (meta.Meta, chunk.Chu
 	vfsConf.EntryTimeout = time.Millisecond * time.Duration(c.Float64("entry-cache")*1000)
 	vfsConf.DirEntryTimeout = time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000)
 
-	initBackgroundTasks(c, vfsConf, metaConf, metaCli, blob, registerer, registry)
+	initBackgroundTasks(c, vfsConf, metaConf, metaCli, blob, store, registerer, registry)
 
 	return metaCli, store, vfsConf
 }
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -41,8 +42,8 @@ func cmdGC() *cli.Command {
 		Usage:     "Garbage collector of objects in data storage",
 		ArgsUsage: "META-URL",
 		Description: `
-It scans all objects in data storage and slices in metadata, comparing them to see if there is any
-leaked object. It can also actively trigger compaction of slices.
+It scans all objects in data storage (including the storages of tiers) and slices in metadata, comparing
+them to see if there is any leaked object. It can also actively trigger compaction of slices.
 Use this command if you find that data storage takes more than expected.
 
 Examples:
@@ -78,6 +79,11 @@ type dChunk struct {
 	length  uint32
 }
 
+type dObject struct {
+	blob object.ObjectStorage
+	key  string
+}
+
 func gc(ctx *cli.Context) error {
 	setup(ctx, 1)
 	removePassword(ctx.Args().Get(0))
@@ -100,6 +106,8 @@ func gc(ctx *cli.Context) error {
 		MaxUpload:  20,
 		BufferSize: 300 << 20,
 		CacheDir:   "memory",
+		PackSize:   format.PackSize << 10,
+		Checksum:   format.BlockChecksum,
 	}
 
 	blob, err := createStorage(*format)
@@ -108,6 +116,18 @@ func gc(ctx *cli.Context) error {
 	}
 	logger.Infof("Data use %s", blob)
 	store := chunk.NewCachedStore(blob, chunkConf, nil)
+	store.SetPackIndex(vfs.NewPackIndex(m))
+	store.SetDedupIndex(vfs.NewDedupIndex(m))
+	setupTiers(m, store)
+	m.OnMsg(meta.DeletePack, func(args ...interface{}) error {
+		return store.RemovePack(args[0].(uint64))
+	})
+	m.OnMsg(meta.DeleteBlock, func(args ...interface{}) error {
+		return store.RemoveBlock(args[0].(uint64), args[1].(uint32), args[2].(uint32))
+	})
+	m.OnMsg(meta.CompactPack, func(args ...interface{}) error {
+		return vfs.Repack(store, args[0].(uint64), args[1].([]meta.PackedSlice), args[2].(*meta.Pack))
+	})
 
 	// Scan all chunks first and do compaction if necessary
 	progress := utils.NewProgress(false, false)
@@ -135,6 +155,11 @@ func gc(ctx *cli.Context) error {
 		} else {
 			logger.Errorf("compact all chunks: %s", st)
 		}
+		if format.PackSize > 0 {
+			if st := m.CompactPacks(meta.Background); st != 0 {
+				logger.Errorf("compact packs: %s", st)
+			}
+		}
 	} else {
 		m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
 			return nil // ignore compaction
@@ -188,19 +213,59 @@ func gc(ctx *cli.Context) error {
 	sliceCSpin.Done()
 
 	// Scan all objects to find leaked ones
+	pblob := object.WithPrefix(blob, "packs/")
 	blob = object.WithPrefix(blob, "chunks/")
 	objs, err := osync.ListAll(blob, "", "")
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
+	// the shared blocks are kept until all the slices using them are deleted
+	owners := make(map[string]bool)
+	shared := make(map[string]bool)
+	if format.Dedup {
+		var ds meta.DedupStat
+		st := m.ListDedupBlocks(c, func(hash []byte, owner *meta.Block, refs []meta.Block) {
+			owners[fmt.Sprintf("%d_%d", owner.Chunkid, owner.Indx)] = true
+			for _, b := range refs {
+				if b.Chunkid != owner.Chunkid || b.Indx != owner.Indx {
+					shared[fmt.Sprintf("%d_%d", b.Chunkid, b.Indx)] = true
+				}
+			}
+			ds.Blocks++
+			ds.Size += uint64(owner.Size)
+			ds.Refs += uint64(len(refs))
+			ds.Logical += uint64(owner.Size) * uint64(len(refs))
+		})
+		if st != 0 {
+			logger.Fatalf("list shared blocks: %s", st)
+		}
+		logger.Infof("%d blocks (%d bytes) are shared by %d blocks (%d bytes), dedup ratio: %.2f",
+			ds.Blocks, ds.Size, ds.Refs, ds.Logical, ds.Ratio())
+	}
+	// the objects of the slices in tiers are valid only in the storage of their tiers
+	tiers := make(map[uint64]uint8)
+	if len(format.Tiers) > 0 {
+		if st := m.ListSliceTiers(c, func(chunkid uint64, tier uint8) { tiers[chunkid] = tier }); st != 0 {
+			logger.Fatalf("list slice tiers: %s", st)
+		}
+	}
 	keys := make(map[uint64]uint32)
 	var total int64
 	var totalBytes uint64
 	for _, ss := range slices {
 		for _, s := range ss {
 			keys[s.Chunkid] = s.Size
-			total += int64(int(s.Size-1)/chunkConf.BlockSize) + 1 // s.Size should be > 0
 			totalBytes += uint64(s.Size)
+			var ps meta.PackedSlice
+			if format.PackSize > 0 && int(s.Size) <= chunkConf.BlockSize/16 && m.GetPacked(c, s.Chunkid, &ps) == 0 {
+				continue // no object for packed slice
+			}
+			n := int(s.Size-1)/chunkConf.BlockSize + 1 // s.Size should be > 0
+			for i := 0; i < n; i++ {
+				if !shared[fmt.Sprintf("%d_%d", s.Chunkid, i)] { // no object for the block using a shared one
+					total++
+				}
+			}
 		}
 	}
 	if progress.Quiet {
@@ -222,74 +287,165 @@ func gc(ctx *cli.Context) error {
 		}
 	}
 
-	var leakedObj = make(chan string, 10240)
+	var leakedObj = make(chan *dObject, 10240)
 	for i := 0; i < ctx.Int("threads"); i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for key := range leakedObj {
-				if err := blob.Delete(key); err != nil {
-					logger.Warnf("delete %s: %s", key, err)
+			for o := range leakedObj {
+				if err := o.blob.Delete(o.key); err != nil {
+					logger.Warnf("delete %s: %s", o.key, err)
 				}
 			}
 		}()
 	}
 
-	foundLeaked := func(obj object.Object) {
+	foundLeaked := func(blob object.ObjectStorage, obj object.Object) {
 		bar.IncrTotal(1)
 		leaked.IncrInt64(obj.Size())
 		if delete {
-			leakedObj <- obj.Key()
+			leakedObj <- &dObject{blob, obj.Key()}
 		}
 	}
 
-	for obj := range objs {
-		if obj == nil {
-			break // failed listing
+	scan := func(tier uint8, blob object.ObjectStorage, objs <-chan object.Object) {
+		for obj := range objs {
+			if obj == nil {
+				break // failed listing
+			}
+			if obj.IsDir() {
+				continue
+			}
+			if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
+				logger.Debugf("ignore new block: %s %s", obj.Key(), obj.Mtime())
+				bar.Increment()
+				skipped.IncrInt64(obj.Size())
+				continue
+			}
+
+			logger.Debugf("found block %s", obj.Key())
+			parts := strings.Split(obj.Key(), "/")
+			if len(parts) != 3 {
+				continue
+			}
+			name := parts[2]
+			parts = strings.Split(name, "_")
+			if len(parts) != 3 {
+				continue
+			}
+			bar.Increment()
+			cid, _ := strconv.Atoi(parts[0])
+			indx, _ := strconv.Atoi(parts[1])
+			size := keys[uint64(cid)]
+			if tiers[uint64(cid)] != tier {
+				size = 0 // the slice is in another tier
+			}
+			if size == 0 {
+				if tier == 0 && owners[parts[0]+"_"+parts[1]] {
+					valid.IncrInt64(obj.Size()) // shared by other slices
+					continue
+				}
+				logger.Debugf("find leaked object: %s, size: %d", obj.Key(), obj.Size())
+				foundLeaked(blob, obj)
+				continue
+			}
+			csize, _ := strconv.Atoi(parts[2])
+			if csize == chunkConf.BlockSize {
+				if (indx+1)*csize > int(size) {
+					logger.Warnf("size of slice %d is larger than expected: %d > %d", cid, indx*chunkConf.BlockSize+csize, size)
+					foundLeaked(blob, obj)
+				} else {
+					valid.IncrInt64(obj.Size())
+				}
+			} else {
+				if indx*chunkConf.BlockSize+csize != int(size) {
+					logger.Warnf("size of slice %d is %d, but expect %d", cid, indx*chunkConf.BlockSize+csize, size)
+					foundLeaked(blob, obj)
+				} else {
+					valid.IncrInt64(obj.Size())
+				}
+			}
 		}
-		if obj.IsDir() {
-			continue
+	}
+	scan(0, blob, objs)
+	for _, t := range format.Tiers {
+		tblob, err := createTierStorage(*format, t.Id)
+		if err != nil {
+			logger.Fatalf("object storage of tier %d: %s", t.Id, err)
 		}
-		if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
-			logger.Debugf("ignore new block: %s %s", obj.Key(), obj.Mtime())
-			bar.Increment()
-			skipped.IncrInt64(obj.Size())
-			continue
+		tblob = object.WithPrefix(tblob, "chunks/")
+		tobjs, err := osync.ListAll(tblob, "", "")
+		if err != nil {
+			logger.Fatalf("list all blocks in tier %d: %s", t.Id, err)
 		}
+		scan(t.Id, tblob, tobjs)
+	}
 
-		logger.Debugf("found block %s", obj.Key())
-		parts := strings.Split(obj.Key(), "/")
-		if len(parts) != 3 {
-			continue
+	// Scan all packs to find the ones not used
+	if format.PackSize > 0 {
+		var packs []*meta.Pack
+		if st := m.ListPacks(c, &packs); st != 0 {
+			logger.Fatalf("list all packs: %s", st)
 		}
-		name := parts[2]
-		parts = strings.Split(name, "_")
-		if len(parts) != 3 {
-			continue
+		used := make(map[string]bool, len(packs))
+		for _, p := range packs {
+			used[strconv.FormatUint(p.Id, 10)] = true
 		}
-		bar.Increment()
-		cid, _ := strconv.Atoi(parts[0])
-		size := keys[uint64(cid)]
-		if size == 0 {
-			logger.Debugf("find leaked object: %s, size: %d", obj.Key(), obj.Size())
-			foundLeaked(obj)
-			continue
+		pobjs, err := osync.ListAll(pblob, "", "")
+		if err != nil {
+			logger.Fatalf("list all packs: %s", err)
 		}
-		indx, _ := strconv.Atoi(parts[1])
-		csize, _ := strconv.Atoi(parts[2])
-		if csize == chunkConf.BlockSize {
-			if (indx+1)*csize > int(size) {
-				logger.Warnf("size of slice %d is larger than expected: %d > %d", cid, indx*chunkConf.BlockSize+csize, size)
-				foundLeaked(obj)
-			} else {
+		uploaded := make(map[uint64]bool) // the packs uploaded before maxMtime
+		for obj := range pobjs {
+			if obj == nil {
+				break // failed listing
+			}
+			if obj.IsDir() {
+				continue
+			}
+			bar.IncrTotal(1)
+			bar.Increment()
+			if obj.Mtime().After(maxMtime) || obj.Mtime().Unix() == 0 {
+				logger.Debugf("ignore new pack: %s %s", obj.Key(), obj.Mtime())
+				skipped.IncrInt64(obj.Size())
+				continue
+			}
+			parts := strings.Split(obj.Key(), "/")
+			if id, err := strconv.ParseUint(parts[len(parts)-1], 10, 64); err == nil {
+				uploaded[id] = true
+			}
+			if used[parts[len(parts)-1]] {
 				valid.IncrInt64(obj.Size())
+				continue
 			}
-		} else {
-			if indx*chunkConf.BlockSize+csize != int(size) {
-				logger.Warnf("size of slice %d is %d, but expect %d", cid, indx*chunkConf.BlockSize+csize, size)
-				foundLeaked(obj)
+			logger.Debugf("find leaked pack: %s, size: %d", obj.Key(), obj.Size())
+			leaked.IncrInt64(obj.Size())
+			if delete {
+				if err := pblob.Delete(obj.Key()); err != nil {
+					logger.Warnf("delete %s: %s", obj.Key(), err)
+				}
+			}
+		}
+
+		// the slices recorded in packs but not used by any file are left by the clients crashed before writing them
+		var orphans []uint64
+		if st := m.ListPacked(c, func(s *meta.PackedSlice) {
+			if uploaded[s.Pack] && keys[s.Chunkid] == 0 {
+				orphans = append(orphans, s.Chunkid)
+			}
+		}); st != 0 {
+			logger.Fatalf("list packed slices: %s", st)
+		}
+		if len(orphans) > 0 {
+			logger.Infof("found %d packed slices not used by any file", len(orphans))
+			if !delete {
+				logger.Infof("Please add `--delete` to remove them")
 			} else {
-				valid.IncrInt64(obj.Size())
+				for _, id := range orphans {
+					if st := m.RemovePacked(c, id); st != 0 {
+						logger.Warnf("remove packed slice %d: %s", id, st)
+					}
+				}
 			}
 		}
 	}
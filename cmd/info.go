@@ -55,7 +55,7 @@ $ juicefs info -i 100`,
 			&cli.BoolFlag{
 				Name:    "recursive",
 				Aliases: []string{"r"},
-				Usage:   "get summary of directories recursively (NOTE: it may take a long time for huge trees)",
+				Usage:   "get summary of directories recursively (NOTE: it may take a long time for huge trees without directory statistics)",
 			},
 		},
 	}
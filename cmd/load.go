@@ -32,7 +32,8 @@ func cmdLoad() *cli.Command {
 		Usage:     "Load metadata from a previously dumped JSON file",
 		ArgsUsage: "META-URL [FILE]",
 		Description: `
-Load metadata into an empty metadata engine.
+Load metadata into an empty metadata engine. The dump is loaded as a stream in batches, if it's
+interrupted, load the same file again to resume it.
 
 WARNING: Do NOT use new engine and the old one at the same time, otherwise it will probably break
 consistency of the volume.
@@ -51,9 +51,14 @@ func Main(args []string) error {
 		Commands: []*cli.Command{
 			cmdFormat(),
 			cmdConfig(),
+			cmdQuota(),
+			cmdTier(),
+			cmdSnapshot(),
+			cmdRestore(),
 			cmdDestroy(),
 			cmdGC(),
 			cmdFsck(),
+			cmdScrub(),
 			cmdDump(),
 			cmdLoad(),
 			cmdStatus(),
@@ -67,6 +72,8 @@ func Main(args []string) error {
 			cmdBench(),
 			cmdWarmup(),
 			cmdRmr(),
+			cmdClone(),
+			cmdWatch(),
 			cmdSync(),
 		},
 	}
@@ -216,6 +223,16 @@ func reorderOptions(app *cli.App, args []string) []string {
 
 	newArgs = append(newArgs, cmdName)
 	args, others = others[1:], nil
+	if len(args) > 0 {
+		for _, sub := range cmd.Subcommands {
+			if sub.HasName(args[0]) {
+				// the options follow the subcommand
+				newArgs = append(newArgs, args[0])
+				args, cmd = args[1:], sub
+				break
+			}
+		}
+	}
 	// -h is valid for all the commands
 	cmdFlags := append(cmd.Flags, cli.HelpFlag)
 	for i := 0; i < len(args); i++ {
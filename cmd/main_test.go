@@ -43,6 +43,16 @@ func TestArgsOrder(t *testing.T) {
 						Name: "k2",
 					},
 				},
+				Subcommands: []*cli.Command{
+					{
+						Name: "sub",
+						Flags: []cli.Flag{
+							&cli.Int64Flag{
+								Name: "k3",
+							},
+						},
+					},
+				},
 			},
 		},
 	}
@@ -52,6 +62,8 @@ func TestArgsOrder(t *testing.T) {
 		{"test", "--v", "cmd", "-k2", "v2", "a", "b"},
 		{"test", "cmd", "a", "-k2=v", "--h"},
 		{"test", "cmd", "-k2=v", "--h", "a"},
+		{"test", "cmd", "sub", "a", "--k3", "v3"},
+		{"test", "cmd", "sub", "--k3", "v3", "a"},
 	}
 	for i := 0; i < len(cases); i += 2 {
 		oreded := reorderOptions(app, cases[i])
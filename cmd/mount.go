@@ -215,11 +215,12 @@ func daemonRun(c *cli.Context, addr string, vfsConf *vfs.Config, m meta.Meta) {
 
 func getVfsConf(c *cli.Context, metaConf *meta.Config, format *meta.Format, chunkConf *chunk.Config) *vfs.Config {
 	return &vfs.Config{
-		Meta:       metaConf,
-		Format:     format,
-		Version:    version.Version(),
-		Chunk:      chunkConf,
-		BackupMeta: c.Duration("backup-meta"),
+		Meta:         metaConf,
+		Format:       format,
+		Version:      version.Version(),
+		Chunk:        chunkConf,
+		BackupMeta:   c.Duration("backup-meta"),
+		BackupFormat: c.String("backup-meta-format"),
 	}
 }
 
@@ -230,6 +231,18 @@ func registerMetaMsg(m meta.Meta, store chunk.ChunkStore, chunkConf *chunk.Confi
 	m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
 		return vfs.Compact(*chunkConf, store, args[0].([]meta.Slice), args[1].(uint64))
 	})
+	m.OnMsg(meta.DeletePack, func(args ...interface{}) error {
+		return store.RemovePack(args[0].(uint64))
+	})
+	m.OnMsg(meta.CompactPack, func(args ...interface{}) error {
+		return vfs.Repack(store, args[0].(uint64), args[1].([]meta.PackedSlice), args[2].(*meta.Pack))
+	})
+	m.OnMsg(meta.DeleteBlock, func(args ...interface{}) error {
+		return store.RemoveBlock(args[0].(uint64), args[1].(uint32), args[2].(uint32))
+	})
+	store.SetPackIndex(vfs.NewPackIndex(m))
+	store.SetDedupIndex(vfs.NewDedupIndex(m))
+	setupTiers(m, store)
 }
 
 func prepareMp(mp string) {
@@ -253,6 +266,9 @@ func prepareMp(mp string) {
 }
 
 func getMetaConf(c *cli.Context, mp string, readOnly bool) *meta.Config {
+	if err := meta.ValidAtimeMode(c.String("atime-mode")); err != nil {
+		logger.Fatalf("%s", err)
+	}
 	return &meta.Config{
 		Retries:    10,
 		Strict:     true,
@@ -262,6 +278,7 @@ func getMetaConf(c *cli.Context, mp string, readOnly bool) *meta.Config {
 		MountPoint: mp,
 		Subdir:     c.String("subdir"),
 		MaxDeletes: c.Int("max-deletes"),
+		AtimeMode:  c.String("atime-mode"),
 	}
 }
 
@@ -295,6 +312,9 @@ func getChunkConf(c *cli.Context, format *meta.Format) *chunk.Config {
 		CacheMode:      os.FileMode(0600),
 		CacheFullBlock: !c.Bool("cache-partial-only"),
 		AutoCreate:     true,
+		PackSize:       format.PackSize << 10,
+		Dedup:          format.Dedup,
+		Checksum:       format.BlockChecksum,
 	}
 
 	if chunkConf.CacheDir != "memory" {
@@ -307,13 +327,32 @@ func getChunkConf(c *cli.Context, format *meta.Format) *chunk.Config {
 	return chunkConf
 }
 
-func initBackgroundTasks(c *cli.Context, vfsConf *vfs.Config, metaConf *meta.Config, m meta.Meta, blob object.ObjectStorage, registerer prometheus.Registerer, registry *prometheus.Registry) {
+func initBackgroundTasks(c *cli.Context, vfsConf *vfs.Config, metaConf *meta.Config, m meta.Meta, blob object.ObjectStorage, store chunk.ChunkStore, registerer prometheus.Registerer, registry *prometheus.Registry) {
 	metricsAddr := exposeMetrics(c, m, registerer, registry)
 	if c.IsSet("consul") {
 		metric.RegisterToConsul(c.String("consul"), metricsAddr, vfsConf.Meta.MountPoint)
 	}
 	if !metaConf.ReadOnly && !metaConf.NoBGJob && vfsConf.BackupMeta > 0 {
-		go vfs.Backup(m, blob, vfsConf.BackupMeta)
+		format, err := meta.ParseDumpFormat(vfsConf.BackupFormat)
+		if err != nil {
+			logger.Fatalf("Invalid backup format: %s", err)
+		}
+		go vfs.Backup(m, blob, vfsConf.BackupMeta, format)
+	}
+	if !metaConf.ReadOnly && !metaConf.NoBGJob && c.IsSet("tier-migrate") {
+		conf, err := parseTierMigrate(vfsConf.Format, c.String("tier-migrate"))
+		if err != nil {
+			logger.Fatalf("Invalid tier migration: %s", err)
+		}
+		go vfs.MigrateTiers(m, store, vfsConf.Chunk.BlockSize, conf)
+	}
+	if !metaConf.NoBGJob && c.Int64("scrub-bwlimit") > 0 {
+		conf := vfs.ScrubConfig{Threads: 1}
+		if dir := vfsConf.Chunk.CacheDir; dir != "memory" {
+			conf.Checkpoint = filepath.Join(utils.SplitDir(dir)[0], "scrub.json")
+		}
+		scrubStore := newScrubStore(m, vfsConf.Format, blob, c.Int64("scrub-bwlimit"))
+		go vfs.ScrubVolume(m, scrubStore, vfsConf.Chunk.BlockSize, conf)
 	}
 	if !c.Bool("no-usage-report") {
 		go usage.ReportUsage(m, version.Version())
@@ -348,6 +387,7 @@ func mount(c *cli.Context) error {
 	chunkConf.UploadDelay = c.Duration("upload-delay")
 
 	blob, store := newStore(format, chunkConf, registerer)
+	watchEncryptKeys(metaCli, blob)
 	registerMetaMsg(metaCli, store, chunkConf)
 
 	vfsConf := getVfsConf(c, metaConf, format, chunkConf)
@@ -366,7 +406,7 @@ func mount(c *cli.Context) error {
 
 	installHandler(mp)
 	v := vfs.NewVFS(vfsConf, metaCli, store, registerer, registry)
-	initBackgroundTasks(c, vfsConf, metaConf, metaCli, blob, registerer, registry)
+	initBackgroundTasks(c, vfsConf, metaConf, metaCli, blob, store, registerer, registry)
 	mount_main(v, c)
 	return metaCli.CloseSession()
 }
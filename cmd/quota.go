@@ -0,0 +1,289 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdQuota() *cli.Command {
+	return &cli.Command{
+		Name:            "quota",
+		Category:        "ADMIN",
+		Usage:           "Manage quotas of directories, users and groups",
+		ArgsUsage:       "META-URL",
+		HideHelpCommand: true,
+		Description: `
+Examples:
+# Limit the space of a directory to 10 GiB and the number of inodes to 100000
+$ juicefs quota set redis://localhost --path /dir1 --capacity 10 --inodes 100000
+
+# Limit the space used by the files of user 1000 to 100 GiB
+$ juicefs quota set redis://localhost --uid 1000 --capacity 100
+
+# Show the quota and usage of a directory
+$ juicefs quota get redis://localhost --path /dir1
+
+# List all quotas
+$ juicefs quota list redis://localhost
+
+# Remove the quota of group 100
+$ juicefs quota delete redis://localhost --gid 100
+
+# Recalculate the usage of all quotas and fix the broken ones
+$ juicefs quota check redis://localhost --repair`,
+		Subcommands: []*cli.Command{
+			{
+				Name:      "set",
+				Usage:     "Set quota of a directory, user or group",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags: append(quotaTargetFlags(),
+					&cli.Uint64Flag{
+						Name:  "capacity",
+						Usage: "hard quota limiting the usage of space in GiB",
+					},
+					&cli.Uint64Flag{
+						Name:  "inodes",
+						Usage: "hard quota limiting the number of inodes",
+					},
+				),
+			},
+			{
+				Name:      "get",
+				Usage:     "Get quota and usage of a directory, user or group",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags:     quotaTargetFlags(),
+			},
+			{
+				Name:      "delete",
+				Aliases:   []string{"del"},
+				Usage:     "Delete quota of a directory, user or group",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags:     quotaTargetFlags(),
+			},
+			{
+				Name:      "list",
+				Aliases:   []string{"ls"},
+				Usage:     "List all quotas",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+			},
+			{
+				Name:      "check",
+				Usage:     "Check the usage of quotas (default: all quotas)",
+				ArgsUsage: "META-URL",
+				Action:    quota,
+				Flags: append(quotaTargetFlags(),
+					&cli.BoolFlag{
+						Name:  "repair",
+						Usage: "repair the usage if it's inconsistent",
+					},
+				),
+			},
+		},
+	}
+}
+
+func quotaTargetFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "full path of the directory within the volume",
+		},
+		&cli.StringFlag{
+			Name:  "uid",
+			Usage: "id of the user",
+		},
+		&cli.StringFlag{
+			Name:  "gid",
+			Usage: "id of the group",
+		},
+	}
+}
+
+// quotaTarget returns the type and target of the quota specified in flags.
+func quotaTarget(ctx *cli.Context) (qtype uint8, target string, err error) {
+	var n int
+	for _, flag := range []string{"path", "uid", "gid"} {
+		if !ctx.IsSet(flag) {
+			continue
+		}
+		n++
+		target = ctx.String(flag)
+		switch flag {
+		case "path":
+			qtype = meta.DirQuota
+		case "uid":
+			qtype = meta.UserQuota
+		case "gid":
+			qtype = meta.GroupQuota
+		}
+	}
+	if n > 1 {
+		err = fmt.Errorf("only one of --path, --uid and --gid can be specified")
+	}
+	return
+}
+
+// quotaName is the name of a quota in the output.
+func quotaName(qtype uint8, target string) string {
+	switch qtype {
+	case meta.UserQuota:
+		return "uid:" + target
+	case meta.GroupQuota:
+		return "gid:" + target
+	default:
+		return target
+	}
+}
+
+func quota(ctx *cli.Context) error {
+	setup(ctx, 1)
+	qtype, target, err := quotaTarget(ctx)
+	if err != nil {
+		return err
+	}
+	switch ctx.Command.Name {
+	case "set", "get", "delete":
+		if target == "" {
+			return fmt.Errorf("one of --path, --uid and --gid is required")
+		}
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(true); err != nil {
+		return err
+	}
+
+	var c = meta.NewContext(0, 0, []uint32{0})
+	qs := make(map[string]*meta.Quota)
+	result := make(map[string]*meta.Quota)
+	switch ctx.Command.Name {
+	case "set":
+		q := &meta.Quota{MaxSpace: -1, MaxInodes: -1} // -1 means no change
+		for _, flag := range ctx.LocalFlagNames() {
+			switch flag {
+			case "capacity":
+				q.MaxSpace = int64(ctx.Uint64(flag)) << 30
+			case "inodes":
+				q.MaxInodes = int64(ctx.Uint64(flag))
+			}
+		}
+		if q.MaxSpace < 0 && q.MaxInodes < 0 {
+			return fmt.Errorf("at least one of --capacity and --inodes should be specified")
+		}
+		qs[target] = q
+		err = m.HandleQuota(c, meta.QuotaSet, qtype, target, qs, false)
+	case "get":
+		err = m.HandleQuota(c, meta.QuotaGet, qtype, target, qs, false)
+	case "delete":
+		return m.HandleQuota(c, meta.QuotaDel, qtype, target, nil, false)
+	case "list":
+		for _, t := range []uint8{meta.DirQuota, meta.UserQuota, meta.GroupQuota} {
+			qs = make(map[string]*meta.Quota)
+			if err = m.HandleQuota(c, meta.QuotaList, t, "", qs, false); err != nil {
+				return err
+			}
+			for k, q := range qs {
+				result[quotaName(t, k)] = q
+			}
+		}
+		printQuotas(result)
+		return nil
+	case "check":
+		if target != "" {
+			err = m.HandleQuota(c, meta.QuotaCheck, qtype, target, qs, ctx.Bool("repair"))
+			break
+		}
+		var total, failed int
+		for _, t := range []uint8{meta.DirQuota, meta.UserQuota, meta.GroupQuota} {
+			all := make(map[string]*meta.Quota)
+			if err = m.HandleQuota(c, meta.QuotaList, t, "", all, false); err != nil {
+				return err
+			}
+			qs = make(map[string]*meta.Quota)
+			for k := range all {
+				total++
+				if e := m.HandleQuota(c, meta.QuotaCheck, t, k, qs, ctx.Bool("repair")); e != nil {
+					logger.Errorf("check quota of %s: %s", quotaName(t, k), e)
+					failed++
+				}
+			}
+			for k, q := range qs {
+				result[quotaName(t, k)] = q
+			}
+		}
+		printQuotas(result)
+		if failed > 0 {
+			return fmt.Errorf("%d of %d quotas are broken", failed, total)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown quota command: %s", ctx.Command.Name)
+	}
+	for k, q := range qs {
+		result[quotaName(qtype, k)] = q
+	}
+	printQuotas(result)
+	return err
+}
+
+func printQuotas(qs map[string]*meta.Quota) {
+	if len(qs) == 0 {
+		return
+	}
+	names := make([]string, 0, len(qs))
+	for n := range qs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-30s %12s %12s %6s %12s %12s %6s\n", "TARGET", "SIZE", "USED", "USE%", "INODES", "IUSED", "IUSE%")
+	for _, n := range names {
+		q := qs[n]
+		size, inodes := "unlimited", "unlimited"
+		var usage, iusage string
+		if q.MaxSpace > 0 {
+			size = humanizeBytes(q.MaxSpace)
+			usage = fmt.Sprintf("%d%%", q.UsedSpace*100/q.MaxSpace)
+		}
+		if q.MaxInodes > 0 {
+			inodes = fmt.Sprintf("%d", q.MaxInodes)
+			iusage = fmt.Sprintf("%d%%", q.UsedInodes*100/q.MaxInodes)
+		}
+		fmt.Printf("%-30s %12s %12s %6s %12s %12d %6s\n", n, size, humanizeBytes(q.UsedSpace), usage, inodes, q.UsedInodes, iusage)
+	}
+}
+
+func humanizeBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	v, i := float64(n), 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
@@ -0,0 +1,139 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdRestore() *cli.Command {
+	return &cli.Command{
+		Name:      "restore",
+		Action:    restore,
+		Category:  "ADMIN",
+		Usage:     "Restore files from trash to their original locations",
+		ArgsUsage: "META-URL [PATTERN]",
+		Description: `
+The deleted files are kept in the trash for the days set by "juicefs format --trash-days". This command
+moves them back to where they were, the directories removed together are restored too. PATTERN is matched
+with the original paths of the entries (and all their parent directories), or their names if there is no
+"/" in it. If a name is used already, the entry is restored with a suffix ".restored-INODE".
+
+Examples:
+# List the entries deleted in the last 2 hours
+$ juicefs restore redis://localhost --since 2h --list
+
+# Restore the directory /dir1 and everything under it
+$ juicefs restore redis://localhost /dir1
+
+# Restore all the JPEG files deleted since 2022-08-01 10:00 into /recovered
+$ juicefs restore redis://localhost "*.jpg" --since "2022-08-01 10:00" --to /recovered`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "only the entries deleted since this time, which is a duration (like 2h) or a local time (like \"2006-01-02 15:04\")",
+			},
+			&cli.StringFlag{
+				Name:  "to",
+				Usage: "restore the entries into this directory instead of their original locations",
+			},
+			&cli.BoolFlag{
+				Name:  "list",
+				Usage: "only list the entries which can be restored",
+			},
+		},
+	}
+}
+
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+func restore(ctx *cli.Context) error {
+	setup(ctx, 1)
+	if ctx.Args().Len() > 2 {
+		return fmt.Errorf("too many arguments: %v", ctx.Args().Slice())
+	}
+	pattern := ctx.Args().Get(1)
+	if pattern == "" && !ctx.IsSet("since") {
+		return fmt.Errorf("PATTERN or --since is required")
+	}
+	var since time.Time
+	if ctx.IsSet("since") {
+		var err error
+		if since, err = parseSince(ctx.String("since")); err != nil {
+			return err
+		}
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(true); err != nil {
+		return err
+	}
+
+	c := meta.NewContext(0, 0, []uint32{0})
+	entries, err := m.ListTrash(c, pattern, since)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		logger.Infof("No entry in trash is matched")
+		return nil
+	}
+	if !ctx.Bool("list") {
+		err = m.RestoreTrash(c, entries, ctx.String("to"))
+	}
+	printTrashEntries(entries, !ctx.Bool("list"))
+	return err
+}
+
+func printTrashEntries(entries []*meta.TrashEntry, restored bool) {
+	if restored {
+		fmt.Printf("%-16s %-50s %s\n", "DELETED", "PATH", "RESTORED")
+	} else {
+		fmt.Printf("%-16s %-50s %12s %s\n", "DELETED", "PATH", "SIZE", "TRASH")
+	}
+	for _, e := range entries {
+		p := e.Path
+		if p == "" {
+			p = fmt.Sprintf("?/%s", e.Name)
+		}
+		if e.Attr.Typ == meta.TypeDirectory {
+			p += "/"
+		}
+		deleted := e.Time.Local().Format("2006-01-02 15:04")
+		if !restored {
+			fmt.Printf("%-16s %-50s %12s %s\n", deleted, p, humanizeBytes(int64(e.Attr.Length)), e.Trash)
+		} else if e.Restored != "" {
+			fmt.Printf("%-16s %-50s %s\n", deleted, p, e.Restored)
+		} else {
+			fmt.Printf("%-16s %-50s %s\n", deleted, p, "(failed)")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdScrub() *cli.Command {
+	return &cli.Command{
+		Name:      "scrub",
+		Action:    scrub,
+		Category:  "ADMIN",
+		Usage:     "Verify all the data of a volume",
+		ArgsUsage: "META-URL",
+		Description: `
+It reads all the blocks used by files from the object storage, so the blocks which are lost or can't be
+decrypted, decompressed or verified by the checksums are found, and the damaged files are reported. The
+progress can be saved into a checkpoint file, so an interrupted scrub is resumed from there when it's
+run again with the same checkpoint. Use "--scrub-bwlimit" of mount to scrub the volume in background.
+
+Examples:
+$ juicefs scrub redis://localhost
+
+# Limit the bandwidth and resume from the checkpoint if it's interrupted
+$ juicefs scrub redis://localhost --bwlimit 100 --checkpoint /var/lib/jfs-scrub.json`,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:    "threads",
+				Aliases: []string{"p"},
+				Value:   10,
+				Usage:   "number of concurrent threads",
+			},
+			&cli.Int64Flag{
+				Name:  "bwlimit",
+				Usage: "bandwidth limit in Mbps for download (0 means unlimited)",
+			},
+			&cli.StringFlag{
+				Name:  "checkpoint",
+				Usage: "file to save the progress, which is removed once finished",
+			},
+		},
+	}
+}
+
+// newScrubStore creates a store without cache to read the data of the volume.
+func newScrubStore(m meta.Meta, format *meta.Format, blob object.ObjectStorage, bwlimit int64) chunk.ChunkStore {
+	chunkConf := chunk.Config{
+		BlockSize:     format.BlockSize * 1024,
+		Compress:      format.Compression,
+		GetTimeout:    time.Second * 60,
+		PutTimeout:    time.Second * 60,
+		MaxUpload:     1,
+		BufferSize:    300 << 20,
+		CacheDir:      "memory",
+		PackSize:      format.PackSize << 10,
+		Checksum:      format.BlockChecksum,
+		DownloadLimit: bwlimit * 1e6 / 8,
+	}
+	store := chunk.NewCachedStore(blob, chunkConf, nil)
+	store.SetPackIndex(vfs.NewPackIndex(m))
+	store.SetDedupIndex(vfs.NewDedupIndex(m))
+	setupTiers(m, store)
+	return store
+}
+
+func scrub(ctx *cli.Context) error {
+	setup(ctx, 1)
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load(true)
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	blob, err := createStorage(*format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	conf := vfs.ScrubConfig{Threads: ctx.Int("threads"), Checkpoint: ctx.String("checkpoint")}
+	store := newScrubStore(m, format, blob, ctx.Int64("bwlimit"))
+
+	progress := utils.NewProgress(false, false)
+	scrubbed := progress.AddDoubleSpinner("Scrubbed slices")
+	sc := vfs.NewScrubber(m, store, format.BlockSize*1024, conf)
+	sc.OnSlice = scrubbed.IncrInt64
+	err = sc.Run()
+	scrubbed.Done()
+	progress.Done()
+	logger.Infof("Scrub: %s", &sc.ScrubStat)
+	if damaged := sc.DamagedFiles(); len(damaged) > 0 {
+		paths := make([]string, 0, len(damaged))
+		for _, p := range damaged {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		fmt.Printf("%d files are damaged:\n", len(paths))
+		for _, p := range paths {
+			fmt.Println(p)
+		}
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdSnapshot() *cli.Command {
+	return &cli.Command{
+		Name:            "snapshot",
+		Category:        "ADMIN",
+		Usage:           "Manage read-only snapshots of directories",
+		ArgsUsage:       "META-URL",
+		HideHelpCommand: true,
+		Description: `
+A snapshot is a read-only copy of a directory at some point in time, which shares the data
+with the source directory, so no data is copied. All the snapshots can be browsed under the
+hidden directory ".snapshots" in the root of the volume.
+
+Examples:
+# Take a snapshot of /dir1 named "daily"
+$ juicefs snapshot create redis://localhost /dir1 daily
+
+# List all snapshots
+$ juicefs snapshot list redis://localhost
+
+# Restore snapshot "daily" as a new directory /dir1-restored
+$ juicefs snapshot restore redis://localhost daily /dir1-restored
+
+# Remove snapshot "daily"
+$ juicefs snapshot delete redis://localhost daily`,
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "Take a snapshot of a directory",
+				ArgsUsage: "META-URL PATH NAME",
+				Action:    snapshot,
+			},
+			{
+				Name:      "list",
+				Aliases:   []string{"ls"},
+				Usage:     "List all snapshots",
+				ArgsUsage: "META-URL",
+				Action:    snapshot,
+			},
+			{
+				Name:      "delete",
+				Aliases:   []string{"del"},
+				Usage:     "Remove a snapshot",
+				ArgsUsage: "META-URL NAME",
+				Action:    snapshot,
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore a snapshot as a new directory",
+				ArgsUsage: "META-URL NAME PATH",
+				Action:    snapshot,
+			},
+		},
+	}
+}
+
+func snapshot(ctx *cli.Context) error {
+	var cmd uint8
+	var name, dpath string
+	switch ctx.Command.Name {
+	case "create":
+		setup(ctx, 3)
+		cmd, dpath, name = meta.SnapshotCreate, ctx.Args().Get(1), ctx.Args().Get(2)
+	case "list":
+		setup(ctx, 1)
+		cmd = meta.SnapshotList
+	case "delete":
+		setup(ctx, 2)
+		cmd, name = meta.SnapshotDel, ctx.Args().Get(1)
+	case "restore":
+		setup(ctx, 3)
+		cmd, name, dpath = meta.SnapshotRestore, ctx.Args().Get(1), ctx.Args().Get(2)
+	default:
+		return fmt.Errorf("unknown snapshot command: %s", ctx.Command.Name)
+	}
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(true); err != nil {
+		return err
+	}
+
+	var c = meta.NewContext(0, 0, []uint32{0})
+	snapshots := make(map[string]*meta.Snapshot)
+	if err := m.HandleSnapshot(c, cmd, name, dpath, snapshots); err != nil {
+		return err
+	}
+	printSnapshots(snapshots)
+	return nil
+}
+
+func printSnapshots(ss map[string]*meta.Snapshot) {
+	if len(ss) == 0 {
+		return
+	}
+	names := make([]string, 0, len(ss))
+	for n := range ss {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-30s %20s %12s %12s %12s\n", "NAME", "CREATED", "SIZE", "FILES", "DIRS")
+	for _, n := range names {
+		s := ss[n]
+		created := time.Unix(s.Time, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%-30s %20s %12s %12d %12d\n", n, created, humanizeBytes(int64(s.Size)), s.Files, s.Dirs)
+	}
+}
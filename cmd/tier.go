@@ -0,0 +1,413 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdTier() *cli.Command {
+	return &cli.Command{
+		Name:            "tier",
+		Category:        "ADMIN",
+		Usage:           "Manage storage tiers of a volume",
+		ArgsUsage:       "META-URL",
+		HideHelpCommand: true,
+		Description: `
+The data of a volume can be placed in additional object storages (tiers) besides the primary one. The tier
+of new data in a file is chosen by the extended attribute "user.juicefs.tier" of the file or its nearest
+ancestor directory, or the patterns of tiers matching the name of a new file. A name not in the tiers
+chooses the primary storage.
+
+Examples:
+# Add a tier for the log files
+$ juicefs tier add redis://localhost --id 2 --name cold --storage s3 --bucket https://mybucket.s3.us-east-2.amazonaws.com --pattern '*.log'
+
+# Place the new data in a directory into the tier
+$ setfattr -n user.juicefs.tier -v cold /mnt/jfs/archive
+
+# List all tiers
+$ juicefs tier list redis://localhost
+
+# Move the files not modified in 90 days under a directory into the tier
+$ juicefs tier migrate redis://localhost /archive --to cold --older-than 90d
+
+# Remove a tier without any data in it
+$ juicefs tier remove redis://localhost cold`,
+		Subcommands: []*cli.Command{
+			{
+				Name:      "add",
+				Usage:     "Add a storage tier",
+				ArgsUsage: "META-URL",
+				Action:    tierAdd,
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:     "id",
+						Required: true,
+						Usage:    "id of the tier (1-255)",
+					},
+					&cli.StringFlag{
+						Name:     "name",
+						Required: true,
+						Usage:    "name of the tier",
+					},
+					&cli.StringFlag{
+						Name:  "storage",
+						Value: "file",
+						Usage: "object storage type (e.g. s3, gcs, oss, cos)",
+					},
+					&cli.StringFlag{
+						Name:     "bucket",
+						Required: true,
+						Usage:    "the bucket URL of object storage to store data",
+					},
+					&cli.StringFlag{
+						Name:  "access-key",
+						Usage: "access key for object storage (env ACCESS_KEY)",
+					},
+					&cli.StringFlag{
+						Name:  "secret-key",
+						Usage: "secret key for object storage (env SECRET_KEY)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "pattern",
+						Usage: "place the new files with names matching the pattern in this tier (e.g. *.log)",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "skip sanity check",
+					},
+				},
+			},
+			{
+				Name:      "list",
+				Aliases:   []string{"ls"},
+				Usage:     "List all tiers",
+				ArgsUsage: "META-URL",
+				Action:    tierList,
+			},
+			{
+				Name:      "migrate",
+				Usage:     "Move the data of existing files into a tier",
+				ArgsUsage: "META-URL PATH",
+				Action:    tierMigrate,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "to",
+						Required: true,
+						Usage:    "name of the target tier (primary for the primary storage)",
+					},
+					&cli.StringFlag{
+						Name:  "older-than",
+						Usage: "only migrate the files not modified for this long (e.g. 90d, 12h)",
+					},
+					&cli.IntFlag{
+						Name:    "threads",
+						Aliases: []string{"p"},
+						Value:   10,
+						Usage:   "number of concurrent threads",
+					},
+					&cli.Int64Flag{
+						Name:  "bwlimit",
+						Usage: "bandwidth limit in Mbps for both download and upload (0 means unlimited)",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only show the amount of data to be migrated",
+					},
+				},
+			},
+			{
+				Name:      "remove",
+				Aliases:   []string{"rm"},
+				Usage:     "Remove a tier without any data in it",
+				ArgsUsage: "META-URL NAME",
+				Action:    tierRemove,
+			},
+		},
+	}
+}
+
+// createTierStorage creates the object storage of a tier, with the same prefix and encryption as the volume.
+func createTierStorage(format meta.Format, tier uint8) (object.ObjectStorage, error) {
+	if err := format.Decrypt(); err != nil {
+		return nil, fmt.Errorf("format decrypt: %s", err)
+	}
+	for _, t := range format.Tiers {
+		if t.Id == tier {
+			format.Storage, format.Bucket, format.AccessKey, format.SecretKey = t.Storage, t.Bucket, t.AccessKey, t.SecretKey
+			format.Shards, format.DataShards, format.ParityShards = 0, 0, 0
+			format.Replica = nil // the data in tiers is not replicated
+			return createStorage(format)
+		}
+	}
+	return nil, fmt.Errorf("tier %d is not found", tier)
+}
+
+// setupTiers makes the store able to access the data in tiers, including the ones added after it's started.
+func setupTiers(m meta.Meta, store chunk.ChunkStore) {
+	store.SetTiers(vfs.NewTierIndex(m), func(tier uint8) (object.ObjectStorage, error) {
+		format, err := m.Load(false)
+		if err != nil {
+			return nil, err
+		}
+		blob, err := createTierStorage(*format, tier)
+		if err == nil {
+			logger.Infof("Data of tier %d use %s", tier, blob)
+			watchEncryptKeys(m, blob)
+		}
+		return blob, err
+	})
+}
+
+// headTierBlock checks whether a block of the slice exists in the storage of the tier.
+func headTierBlock(format *meta.Format, stores map[uint8]object.ObjectStorage, tier uint8, chunkid uint64, indx uint32, size int) error {
+	store, ok := stores[tier]
+	if !ok {
+		var err error
+		if store, err = createTierStorage(*format, tier); err != nil {
+			return err
+		}
+		stores[tier] = store
+	}
+	key := fmt.Sprintf("chunks/%v/%v/%v_%v_%v", chunkid/1000/1000, chunkid/1000, chunkid, indx, size)
+	if format.Partitions > 1 {
+		key = fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", chunkid%256, chunkid/1000/1000, chunkid, indx, size)
+	}
+	_, err := store.Head(key)
+	return err
+}
+
+func openTiers(ctx *cli.Context, args int) (meta.Meta, *meta.Format, error) {
+	setup(ctx, args)
+	removePassword(ctx.Args().Get(0))
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load(true)
+	return m, format, err
+}
+
+func tierAdd(ctx *cli.Context) error {
+	m, format, err := openTiers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	if err = format.Decrypt(); err != nil {
+		return fmt.Errorf("format decrypt: %s", err)
+	}
+	tier := meta.Tier{
+		Id:        uint8(ctx.Uint("id")),
+		Name:      ctx.String("name"),
+		Storage:   ctx.String("storage"),
+		Bucket:    ctx.String("bucket"),
+		AccessKey: ctx.String("access-key"),
+		SecretKey: ctx.String("secret-key"),
+		Patterns:  ctx.StringSlice("pattern"),
+	}
+	if tier.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
+		tier.AccessKey = os.Getenv("ACCESS_KEY")
+		_ = os.Unsetenv("ACCESS_KEY")
+	}
+	if tier.SecretKey == "" && os.Getenv("SECRET_KEY") != "" {
+		tier.SecretKey = os.Getenv("SECRET_KEY")
+		_ = os.Unsetenv("SECRET_KEY")
+	}
+	if ctx.Uint("id") > 255 {
+		return fmt.Errorf("invalid id of tier: %d", ctx.Uint("id"))
+	}
+	tiers := append(format.Tiers, tier)
+	if err = meta.ValidTiers(tiers); err != nil {
+		return err
+	}
+	format.Tiers = tiers
+	if !ctx.Bool("force") {
+		blob, err := createTierStorage(*format, tier.Id)
+		if err != nil {
+			return err
+		}
+		if err = test(blob); err != nil {
+			return err
+		}
+	}
+	format.UpdateClientVersion()
+	if err = format.Encrypt(); err != nil {
+		logger.Fatalf("Format encrypt: %s", err)
+	}
+	if err = m.Init(*format, false); err == nil {
+		fmt.Printf("Tier %d (%s) is added, it will be used by the clients in a minute.\n", tier.Id, tier.Name)
+	}
+	return err
+}
+
+// countTiers returns the number of slices in each tier.
+func countTiers(m meta.Meta) (map[uint8]int, error) {
+	counts := make(map[uint8]int)
+	if st := m.ListSliceTiers(meta.Background, func(chunkid uint64, tier uint8) {
+		counts[tier]++
+	}); st != 0 {
+		return nil, st
+	}
+	return counts, nil
+}
+
+func tierList(ctx *cli.Context) error {
+	m, format, err := openTiers(ctx, 1)
+	if err != nil {
+		return err
+	}
+	counts, err := countTiers(m)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-4s %-16s %-10s %-50s %10s %s\n", "ID", "NAME", "STORAGE", "BUCKET", "SLICES", "PATTERNS")
+	for _, t := range format.Tiers {
+		fmt.Printf("%-4d %-16s %-10s %-50s %10d %s\n", t.Id, t.Name, t.Storage, t.Bucket, counts[t.Id], strings.Join(t.Patterns, ","))
+	}
+	return nil
+}
+
+// parseAge parses a duration like 90d, or the ones accepted by time.ParseDuration.
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 32); err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// targetTier returns the id of the tier with the name, primary is the primary storage.
+func targetTier(format *meta.Format, name string) (uint8, error) {
+	if t := format.FindTier(name); t != nil {
+		return t.Id, nil
+	}
+	if name == "primary" {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("tier %s is not found", name)
+}
+
+// parseTierMigrate parses the background migration like cold:90d.
+func parseTierMigrate(format *meta.Format, s string) (vfs.MigrateConfig, error) {
+	conf := vfs.MigrateConfig{Threads: 1}
+	ps := strings.SplitN(s, ":", 2)
+	if len(ps) != 2 {
+		return conf, fmt.Errorf("%q is not in the form of NAME:AGE", s)
+	}
+	var err error
+	if conf.To, err = targetTier(format, ps[0]); err != nil {
+		return conf, err
+	}
+	conf.OlderThan, err = parseAge(ps[1])
+	return conf, err
+}
+
+func tierMigrate(ctx *cli.Context) error {
+	m, format, err := openTiers(ctx, 2)
+	if err != nil {
+		return err
+	}
+	conf := vfs.MigrateConfig{Threads: ctx.Int("threads"), DryRun: ctx.Bool("dry-run")}
+	if conf.To, err = targetTier(format, ctx.String("to")); err != nil {
+		return err
+	}
+	if conf.OlderThan, err = parseAge(ctx.String("older-than")); err != nil {
+		return err
+	}
+	blob, err := createStorage(*format)
+	if err != nil {
+		return fmt.Errorf("object storage: %s", err)
+	}
+	chunkConf := chunk.Config{
+		BlockSize:     format.BlockSize * 1024,
+		Compress:      format.Compression,
+		GetTimeout:    time.Second * 60,
+		PutTimeout:    time.Second * 60,
+		MaxUpload:     conf.Threads,
+		BufferSize:    300 << 20,
+		CacheDir:      "memory",
+		UploadLimit:   ctx.Int64("bwlimit") * 1e6 / 8,
+		DownloadLimit: ctx.Int64("bwlimit") * 1e6 / 8,
+	}
+	store := chunk.NewCachedStore(blob, chunkConf, nil)
+	setupTiers(m, store)
+
+	progress := utils.NewProgress(false, false)
+	scanned := progress.AddCountSpinner("Scanned files")
+	name := "Migrated slices"
+	if conf.DryRun {
+		name = "Slices to migrate"
+	}
+	migrated := progress.AddDoubleSpinner(name)
+	mg := vfs.NewMigrator(m, store, chunkConf.BlockSize, conf)
+	mg.OnScan = scanned.Increment
+	mg.OnMigrate = migrated.IncrInt64
+	err = mg.Run(ctx.Args().Get(1))
+	scanned.Done()
+	migrated.Done()
+	progress.Done()
+	logger.Infof("Migrate into tier %s: %s", ctx.String("to"), &mg.MigrateStat)
+	return err
+}
+
+func tierRemove(ctx *cli.Context) error {
+	m, format, err := openTiers(ctx, 2)
+	if err != nil {
+		return err
+	}
+	name := ctx.Args().Get(1)
+	t := format.FindTier(name)
+	if t == nil {
+		return fmt.Errorf("tier %s is not found", name)
+	}
+	counts, err := countTiers(m)
+	if err != nil {
+		return err
+	}
+	if n := counts[t.Id]; n > 0 {
+		return fmt.Errorf("there are %d slices in tier %s, move them out before removing it", n, name)
+	}
+	id := t.Id
+	tiers := make([]meta.Tier, 0, len(format.Tiers))
+	for _, t := range format.Tiers {
+		if t.Id != id {
+			tiers = append(tiers, t)
+		}
+	}
+	format.Tiers = tiers
+	if err = m.Init(*format, false); err == nil {
+		fmt.Printf("Tier %d (%s) is removed.\n", id, name)
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cmdWatch() *cli.Command {
+	return &cli.Command{
+		Name:      "watch",
+		Action:    watch,
+		Category:  "INSPECTOR",
+		Usage:     "Watch the changes of files under a directory",
+		ArgsUsage: "PATH",
+		Description: `
+It prints the changes of the entries under a directory as JSON lines, including create, write, rename,
+unlink, setattr and xattr changes. The change log should be enabled by "juicefs config --changelog-days".
+The "id" of a change can be used as the cursor to continue watching after it.
+
+Examples:
+# Watch the changes from now on
+$ juicefs watch /mnt/jfs/dir
+
+# Watch the changes after the change 1000
+$ juicefs watch /mnt/jfs/dir --cursor 1000`,
+		Flags: []cli.Flag{
+			&cli.Uint64Flag{
+				Name:  "cursor",
+				Usage: "print the changes after this one (default: from now on)",
+			},
+			&cli.UintFlag{
+				Name:  "limit",
+				Value: 1000,
+				Usage: "max number of changes read at a time",
+			},
+		},
+	}
+}
+
+func watch(ctx *cli.Context) error {
+	setup(ctx, 1)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	d, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		logger.Fatalf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	inode, err := utils.GetFileInode(d)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", d, err)
+	}
+	var latest uint8 = 1
+	cursor := ctx.Uint64("cursor")
+	if ctx.IsSet("cursor") {
+		latest = 0
+	}
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	for {
+		// the messages and replies are kept by the handle, so open a new one for each round
+		f := openController(d)
+		if f == nil {
+			return fmt.Errorf("%s is not inside JuiceFS", d)
+		}
+		wb := utils.NewBuffer(8 + 25)
+		wb.Put32(meta.Watch)
+		wb.Put32(25)
+		wb.Put64(inode)
+		wb.Put64(cursor)
+		wb.Put8(latest)
+		wb.Put32(uint32(ctx.Uint("limit")))
+		wb.Put32(10000) // wait for at most 10 seconds
+		if _, err = f.Write(wb.Bytes()); err != nil {
+			logger.Fatalf("write message: %s", err)
+		}
+		data := make([]byte, 4)
+		if n, err := io.ReadFull(f, data); err != nil {
+			if n == 1 && data[0] == byte(syscall.EINVAL&0xff) {
+				logger.Fatalf("watch is not supported, please upgrade and mount again")
+			}
+			logger.Fatalf("read size: %d %s", n, err)
+		}
+		data = make([]byte, utils.ReadBuffer(data).Get32())
+		if _, err = io.ReadFull(f, data); err != nil {
+			logger.Fatalf("read changes: %s", err)
+		}
+		_ = f.Close()
+		r := utils.ReadBuffer(data)
+		if st := syscall.Errno(r.Get8()); st == syscall.ENOTSUP {
+			return fmt.Errorf("change log is not enabled, please enable it by \"juicefs config --changelog-days\"")
+		} else if st != 0 {
+			return fmt.Errorf("watch %s: %s", d, st)
+		}
+		cursor, latest = r.Get64(), 0
+		dec := json.NewDecoder(bytes.NewReader(r.Get(r.Left())))
+		for dec.More() {
+			var c meta.Change
+			if err = dec.Decode(&c); err != nil {
+				logger.Fatalf("decode change: %s", err)
+			}
+			if c.Path != "" {
+				c.Path = filepath.Join(d, c.Path)
+			}
+			if c.DstPath != "" {
+				c.DstPath = filepath.Join(d, c.DstPath)
+			}
+			_ = enc.Encode(&c)
+		}
+		_ = out.Flush()
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package acl implements POSIX access control lists (POSIX.1e draft 17).
+package acl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+const (
+	TypeAccess  uint8 = 1 // access ACL of a file or directory
+	TypeDefault uint8 = 2 // default ACL of a directory, inherited by new entries in it
+)
+
+const (
+	// XattrAccess is the name of extended attribute for access ACL used by Linux.
+	XattrAccess = "system.posix_acl_access"
+	// XattrDefault is the name of extended attribute for default ACL used by Linux.
+	XattrDefault = "system.posix_acl_default"
+)
+
+// None means the mask entry is absent.
+const None uint16 = 0xFFFF
+
+// Entry is a named user or group entry.
+type Entry struct {
+	Id   uint32 `json:"id"`
+	Perm uint16 `json:"perm"`
+}
+
+type Entries []Entry
+
+func (es Entries) sort() {
+	sort.Slice(es, func(i, j int) bool { return es[i].Id < es[j].Id })
+}
+
+func (es Entries) find(id uint32) (uint16, bool) {
+	for _, e := range es {
+		if e.Id == id {
+			return e.Perm, true
+		}
+	}
+	return 0, false
+}
+
+// Rule is an ACL with the permissions (rwx bits) of owner, owning group, mask, others
+// and named users and groups.
+type Rule struct {
+	Owner       uint16  `json:"owner"`
+	Group       uint16  `json:"group"`
+	Mask        uint16  `json:"mask"`
+	Other       uint16  `json:"other"`
+	NamedUsers  Entries `json:"users,omitempty"`
+	NamedGroups Entries `json:"groups,omitempty"`
+}
+
+// FromMode returns the minimal ACL equivalent to the mode.
+func FromMode(mode uint16) *Rule {
+	return &Rule{
+		Owner: (mode >> 6) & 7,
+		Group: (mode >> 3) & 7,
+		Mask:  None,
+		Other: mode & 7,
+	}
+}
+
+func (r *Rule) Dup() *Rule {
+	d := *r
+	d.NamedUsers = append(Entries(nil), r.NamedUsers...)
+	d.NamedGroups = append(Entries(nil), r.NamedGroups...)
+	return &d
+}
+
+// IsMinimal returns whether the ACL can be represented by the mode bits.
+func (r *Rule) IsMinimal() bool {
+	return len(r.NamedUsers) == 0 && len(r.NamedGroups) == 0 && r.Mask == None
+}
+
+// IsValid returns whether the ACL is well-formed.
+func (r *Rule) IsValid() bool {
+	if r.Owner > 7 || r.Group > 7 || r.Other > 7 || r.Mask > 7 && r.Mask != None {
+		return false
+	}
+	for _, es := range []Entries{r.NamedUsers, r.NamedGroups} {
+		seen := make(map[uint32]bool)
+		for _, e := range es {
+			if e.Perm > 7 || seen[e.Id] {
+				return false
+			}
+			seen[e.Id] = true
+		}
+	}
+	return r.Mask != None || len(r.NamedUsers) == 0 && len(r.NamedGroups) == 0
+}
+
+// GetMode returns the permission bits of the mode, the group class is represented by the mask if present.
+func (r *Rule) GetMode() uint16 {
+	group := r.Group
+	if r.Mask != None {
+		group = r.Mask
+	}
+	return r.Owner<<6 | group<<3 | r.Other
+}
+
+// SetMode updates the ACL with the permission bits of the mode, as chmod does.
+func (r *Rule) SetMode(mode uint16) {
+	r.Owner = (mode >> 6) & 7
+	if r.Mask != None {
+		r.Mask = (mode >> 3) & 7
+	} else {
+		r.Group = (mode >> 3) & 7
+	}
+	r.Other = mode & 7
+}
+
+// ChildRule returns the access ACL of a new file or directory created with mode under a
+// directory whose default ACL is r.
+func (r *Rule) ChildRule(mode uint16) *Rule {
+	c := r.Dup()
+	c.Owner &= (mode >> 6) & 7
+	if c.Mask != None {
+		c.Mask &= (mode >> 3) & 7
+	} else {
+		c.Group &= (mode >> 3) & 7
+	}
+	c.Other &= mode & 7
+	return c
+}
+
+// CanAccess checks whether a user with uid and gids is allowed to access a file (owned by fuid and fgid)
+// with all the permissions in mmask.
+func (r *Rule) CanAccess(uid uint32, gids []uint32, fuid, fgid uint32, mmask uint8) bool {
+	want := uint16(mmask) & 7
+	if uid == fuid {
+		return r.Owner&want == want
+	}
+	mask := r.Mask
+	if mask == None {
+		mask = 7
+	}
+	if perm, ok := r.NamedUsers.find(uid); ok {
+		return perm&mask&want == want
+	}
+	var matched bool
+	for _, gid := range gids {
+		if gid == fgid {
+			if r.Group&mask&want == want {
+				return true
+			}
+			matched = true
+		}
+		if perm, ok := r.NamedGroups.find(gid); ok {
+			if perm&mask&want == want {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+	return r.Other&want == want
+}
+
+// Encode serializes the ACL to be stored in meta engines.
+func (r *Rule) Encode() []byte {
+	w := utils.NewBuffer(uint32(16 + 6*(len(r.NamedUsers)+len(r.NamedGroups))))
+	w.Put16(r.Owner)
+	w.Put16(r.Group)
+	w.Put16(r.Mask)
+	w.Put16(r.Other)
+	for _, es := range []Entries{r.NamedUsers, r.NamedGroups} {
+		w.Put32(uint32(len(es)))
+		for _, e := range es {
+			w.Put32(e.Id)
+			w.Put16(e.Perm)
+		}
+	}
+	return w.Bytes()
+}
+
+// Decode parses an ACL serialized by Encode.
+func Decode(buf []byte) (*Rule, error) {
+	if len(buf) < 16 {
+		return nil, fmt.Errorf("invalid ACL length: %d", len(buf))
+	}
+	rb := utils.FromBuffer(buf)
+	r := &Rule{Owner: rb.Get16(), Group: rb.Get16(), Mask: rb.Get16(), Other: rb.Get16()}
+	for _, es := range []*Entries{&r.NamedUsers, &r.NamedGroups} {
+		if rb.Left() < 4 {
+			return nil, fmt.Errorf("invalid ACL length: %d", len(buf))
+		}
+		n := int(rb.Get32())
+		if rb.Left() < 6*n {
+			return nil, fmt.Errorf("invalid ACL length: %d", len(buf))
+		}
+		for i := 0; i < n; i++ {
+			*es = append(*es, Entry{rb.Get32(), rb.Get16()})
+		}
+	}
+	return r, nil
+}
+
+// tags of ACL entries in extended attributes, see linux/posix_acl.h
+const (
+	xattrVersion = 2
+	tagUserObj   = 0x01
+	tagUser      = 0x02
+	tagGroupObj  = 0x04
+	tagGroup     = 0x08
+	tagMask      = 0x10
+	tagOther     = 0x20
+	undefinedId  = 0xFFFFFFFF
+)
+
+// EncodeXattr serializes the ACL into the format of Linux extended attributes (little endian).
+func (r *Rule) EncodeXattr() []byte {
+	n := 3 + len(r.NamedUsers) + len(r.NamedGroups)
+	if r.Mask != None {
+		n++
+	}
+	buf := make([]byte, 4+8*n)
+	binary.LittleEndian.PutUint32(buf, xattrVersion)
+	off := 4
+	put := func(tag, perm uint16, id uint32) {
+		binary.LittleEndian.PutUint16(buf[off:], tag)
+		binary.LittleEndian.PutUint16(buf[off+2:], perm)
+		binary.LittleEndian.PutUint32(buf[off+4:], id)
+		off += 8
+	}
+	users := append(Entries(nil), r.NamedUsers...)
+	users.sort()
+	groups := append(Entries(nil), r.NamedGroups...)
+	groups.sort()
+	put(tagUserObj, r.Owner, undefinedId)
+	for _, e := range users {
+		put(tagUser, e.Perm, e.Id)
+	}
+	put(tagGroupObj, r.Group, undefinedId)
+	for _, e := range groups {
+		put(tagGroup, e.Perm, e.Id)
+	}
+	if r.Mask != None {
+		put(tagMask, r.Mask, undefinedId)
+	}
+	put(tagOther, r.Other, undefinedId)
+	return buf
+}
+
+// DecodeXattr parses an ACL in the format of Linux extended attributes.
+func DecodeXattr(buf []byte) (*Rule, error) {
+	if len(buf) < 4 || (len(buf)-4)%8 != 0 {
+		return nil, fmt.Errorf("invalid ACL length: %d", len(buf))
+	}
+	if v := binary.LittleEndian.Uint32(buf); v != xattrVersion {
+		return nil, fmt.Errorf("unsupported ACL version: %d", v)
+	}
+	r := &Rule{Mask: None}
+	var seen uint16
+	for off := 4; off < len(buf); off += 8 {
+		tag := binary.LittleEndian.Uint16(buf[off:])
+		perm := binary.LittleEndian.Uint16(buf[off+2:])
+		id := binary.LittleEndian.Uint32(buf[off+4:])
+		if perm > 7 {
+			return nil, fmt.Errorf("invalid permission %o of tag %d", perm, tag)
+		}
+		if tag != tagUser && tag != tagGroup {
+			if seen&tag != 0 {
+				return nil, fmt.Errorf("duplicated tag %d", tag)
+			}
+		}
+		seen |= tag
+		switch tag {
+		case tagUserObj:
+			r.Owner = perm
+		case tagUser:
+			r.NamedUsers = append(r.NamedUsers, Entry{id, perm})
+		case tagGroupObj:
+			r.Group = perm
+		case tagGroup:
+			r.NamedGroups = append(r.NamedGroups, Entry{id, perm})
+		case tagMask:
+			r.Mask = perm
+		case tagOther:
+			r.Other = perm
+		default:
+			return nil, fmt.Errorf("invalid tag %d", tag)
+		}
+	}
+	if seen&(tagUserObj|tagGroupObj|tagOther) != tagUserObj|tagGroupObj|tagOther {
+		return nil, fmt.Errorf("missing entries of owner, group or others")
+	}
+	if !r.IsValid() {
+		return nil, fmt.Errorf("invalid ACL: %+v", r)
+	}
+	r.NamedUsers.sort()
+	r.NamedGroups.sort()
+	return r, nil
+}
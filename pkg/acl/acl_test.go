@@ -0,0 +1,137 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package acl
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	r := &Rule{
+		Owner:       7,
+		Group:       5,
+		Mask:        7,
+		Other:       0,
+		NamedUsers:  Entries{{1001, 6}, {1000, 7}},
+		NamedGroups: Entries{{2000, 4}},
+	}
+	d, err := Decode(r.Encode())
+	if err != nil || !reflect.DeepEqual(d, r) {
+		t.Fatalf("decode %+v: %+v %s", r, d, err)
+	}
+	if _, err = Decode(r.Encode()[:20]); err == nil {
+		t.Fatalf("decode a truncated ACL should fail")
+	}
+
+	buf := r.EncodeXattr()
+	if len(buf) != 4+8*7 {
+		t.Fatalf("xattr length %d", len(buf))
+	}
+	if binary.LittleEndian.Uint16(buf[12:]) != tagUser || binary.LittleEndian.Uint32(buf[16:]) != 1000 {
+		t.Fatalf("named users should be sorted: %v", buf)
+	}
+	if d, err = DecodeXattr(buf); err != nil {
+		t.Fatalf("decode xattr: %s", err)
+	}
+	r.NamedUsers.sort()
+	if !reflect.DeepEqual(d, r) {
+		t.Fatalf("expect %+v, but got %+v", r, d)
+	}
+
+	m := FromMode(0751)
+	if d, err = DecodeXattr(m.EncodeXattr()); err != nil || !reflect.DeepEqual(d, m) || !d.IsMinimal() {
+		t.Fatalf("decode minimal ACL %+v: %+v %s", m, d, err)
+	}
+	if d.GetMode() != 0751 {
+		t.Fatalf("mode %o != %o", d.GetMode(), 0751)
+	}
+
+	bad := &Rule{Owner: 7, Mask: None, NamedUsers: Entries{{1000, 7}}} // no mask
+	if _, err = DecodeXattr(bad.EncodeXattr()); err == nil {
+		t.Fatalf("named entries without mask should be invalid")
+	}
+	if _, err = DecodeXattr(buf[:len(buf)-8]); err == nil {
+		t.Fatalf("ACL without others should be invalid")
+	}
+	binary.LittleEndian.PutUint32(buf, 1)
+	if _, err = DecodeXattr(buf); err == nil {
+		t.Fatalf("version 1 should be unsupported")
+	}
+}
+
+func TestMode(t *testing.T) {
+	r := &Rule{Owner: 7, Group: 4, Mask: 6, Other: 5, NamedUsers: Entries{{1000, 7}}}
+	if r.GetMode() != 0765 {
+		t.Fatalf("mode %o != %o", r.GetMode(), 0765)
+	}
+	r.SetMode(0510)
+	if r.Owner != 5 || r.Group != 4 || r.Mask != 1 || r.Other != 0 {
+		t.Fatalf("chmod: %+v", r)
+	}
+
+	def := &Rule{Owner: 7, Group: 5, Mask: 7, Other: 5, NamedGroups: Entries{{2000, 7}}}
+	c := def.ChildRule(0644)
+	if c.Owner != 6 || c.Group != 5 || c.Mask != 4 || c.Other != 4 || c.NamedGroups[0].Perm != 7 {
+		t.Fatalf("child: %+v", c)
+	}
+	if def.Mask != 7 {
+		t.Fatalf("default ACL should not be changed: %+v", def)
+	}
+	c = FromMode(0777).ChildRule(0750)
+	if c.GetMode() != 0750 || !c.IsMinimal() {
+		t.Fatalf("minimal child: %+v", c)
+	}
+}
+
+func TestCanAccess(t *testing.T) {
+	r := &Rule{
+		Owner:       6,
+		Group:       4,
+		Mask:        6,
+		Other:       0,
+		NamedUsers:  Entries{{1001, 7}, {1002, 0}},
+		NamedGroups: Entries{{2001, 2}},
+	}
+	cases := []struct {
+		uid   uint32
+		gids  []uint32
+		mmask uint8
+		ok    bool
+	}{
+		{1000, []uint32{1000}, 6, true},  // owner
+		{1000, []uint32{1000}, 1, false}, // owner
+		{1001, []uint32{3000}, 6, true},  // named user
+		{1001, []uint32{3000}, 1, false}, // named user, masked
+		{1002, []uint32{2000}, 4, false}, // named user wins over group
+		{1003, []uint32{2000}, 4, true},  // owning group
+		{1003, []uint32{2000}, 2, false}, // owning group
+		{1003, []uint32{2000, 2001}, 2, true},
+		{1003, []uint32{2001}, 4, false}, // matched group but no permission, not fallback to others
+		{1003, []uint32{3000}, 4, false}, // others
+	}
+	for i, c := range cases {
+		if ok := r.CanAccess(c.uid, c.gids, 1000, 2000, c.mmask); ok != c.ok {
+			t.Fatalf("case %d: access %+v: %t", i, c, ok)
+		}
+	}
+	r.Other = 4
+	if !r.CanAccess(1003, []uint32{3000}, 1000, 2000, 4) {
+		t.Fatalf("others should be able to read")
+	}
+}
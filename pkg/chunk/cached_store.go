@@ -111,13 +111,15 @@ var (
 
 // chunk for read only
 type rChunk struct {
-	id     uint64
-	length int
-	store  *cachedStore
+	id        uint64
+	length    int
+	store     *cachedStore
+	tier      uint8
+	tierFound bool
 }
 
 func chunkForRead(id uint64, length int, store *cachedStore) *rChunk {
-	return &rChunk{id, length, store}
+	return &rChunk{id: id, length: length, store: store}
 }
 
 func (c *rChunk) blockSize(indx int) int {
@@ -128,11 +130,15 @@ func (c *rChunk) blockSize(indx int) int {
 	return bsize
 }
 
-func (c *rChunk) key(indx int) string {
-	if c.store.conf.Partitions > 1 {
-		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", c.id%256, c.id/1000/1000, c.id, indx, c.blockSize(indx))
+func (store *cachedStore) blockKey(id uint64, indx, size int) string {
+	if store.conf.Partitions > 1 {
+		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", id%256, id/1000/1000, id, indx, size)
 	}
-	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", c.id/1000/1000, c.id/1000, c.id, indx, c.blockSize(indx))
+	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", id/1000/1000, id/1000, id, indx, size)
+}
+
+func (c *rChunk) key(indx int) string {
+	return c.store.blockKey(c.id, indx, c.blockSize(indx))
 }
 
 func (c *rChunk) index(off int) int {
@@ -207,25 +213,28 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 	cacheMiss.Add(1)
 	cacheMissBytes.Add(float64(len(p)))
 
-	if c.store.seekable && boff > 0 && len(p) <= blockSize/4 {
+	if c.store.seekable && boff > 0 && len(p) <= blockSize/4 && !c.store.packable(c.length) && !c.store.conf.Checksum {
 		if c.store.downLimit != nil {
 			c.store.downLimit.Wait(int64(len(p)))
 		}
 		// partial read
+		okey := c.objKey(indx)
 		st := time.Now()
-		in, err := c.store.storage.Get(key, int64(boff), int64(len(p)))
+		in, err := c.store.storage.Get(okey, int64(boff), int64(len(p)))
 		if err == nil {
 			n, err = io.ReadFull(in, p)
 			_ = in.Close()
 		}
 		used := time.Since(st)
-		logger.Debugf("GET %s RANGE(%d,%d) (%s, %.3fs)", key, boff, len(p), err, used.Seconds())
+		logger.Debugf("GET %s RANGE(%d,%d) (%s, %.3fs)", okey, boff, len(p), err, used.Seconds())
 		if used > SlowRequest {
-			logger.Infof("slow request: GET %s (%v, %.3fs)", key, err, used.Seconds())
+			logger.Infof("slow request: GET %s (%v, %.3fs)", okey, err, used.Seconds())
 		}
 		objectDataBytes.WithLabelValues("GET").Add(float64(n))
 		objectReqsHistogram.WithLabelValues("GET").Observe(used.Seconds())
-		c.store.fetcher.fetch(key)
+		if okey == key {
+			c.store.fetcher.fetch(key) // the shared block is cached by the whole read
+		}
 		if err == nil {
 			return n, nil
 		} else {
@@ -243,7 +252,7 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 		tmp.Acquire()
 		err := utils.WithTimeout(func() error {
 			defer tmp.Release()
-			return c.store.load(key, tmp, c.store.shouldCache(blockSize), false)
+			return c.load(indx, tmp, c.store.shouldCache(blockSize), false)
 		}, c.store.conf.GetTimeout)
 		return tmp, err
 	})
@@ -259,8 +268,15 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 
 func (c *rChunk) delete(indx int) error {
 	key := c.key(indx)
+	if tier := c.getTier(); tier > 0 {
+		key = tierKey(tier, key)
+	}
+	return c.store.delete(key)
+}
+
+func (store *cachedStore) delete(key string) error {
 	st := time.Now()
-	err := c.store.storage.Delete(key)
+	err := store.storage.Delete(key)
 	used := time.Since(st)
 	logger.Debugf("DELETE %v (%v, %.3fs)", key, err, used.Seconds())
 	if used > SlowRequest {
@@ -334,7 +350,7 @@ type wChunk struct {
 
 func chunkForWrite(id uint64, store *cachedStore) *wChunk {
 	return &wChunk{
-		rChunk: rChunk{id, 0, store},
+		rChunk: rChunk{id: id, store: store},
 		pages:  make([][]*Page, chunkSize/store.conf.BlockSize),
 		errors: make(chan error, chunkSize/store.conf.BlockSize),
 	}
@@ -389,15 +405,15 @@ func (c *wChunk) WriteAt(p []byte, off int64) (n int, err error) {
 	return n, nil
 }
 
-func (c *wChunk) put(key string, p *Page) error {
-	if c.store.upLimit != nil {
-		c.store.upLimit.Wait(int64(len(p.Data)))
+func (store *cachedStore) put(key string, p *Page) error {
+	if store.upLimit != nil {
+		store.upLimit.Wait(int64(len(p.Data)))
 	}
 	p.Acquire()
 	return utils.WithTimeout(func() error {
 		defer p.Release()
 		st := time.Now()
-		err := c.store.storage.Put(key, bytes.NewReader(p.Data))
+		err := store.storage.Put(key, bytes.NewReader(p.Data))
 		used := time.Since(st)
 		logger.Debugf("PUT %s (%s, %.3fs)", key, err, used.Seconds())
 		if used > SlowRequest {
@@ -409,12 +425,12 @@ func (c *wChunk) put(key string, p *Page) error {
 			objectReqErrors.Add(1)
 		}
 		return err
-	}, c.store.conf.PutTimeout)
+	}, store.conf.PutTimeout)
 }
 
-func (c *wChunk) syncUpload(key string, block *Page) {
+func (c *wChunk) syncUpload(key string, block *Page, indx int, hash []byte) {
 	blen := len(block.Data)
-	bufSize := c.store.compressor.CompressBound(blen)
+	bufSize := c.store.compressor.CompressBound(blen) + c.store.trailerSize()
 	var buf *Page
 	if bufSize > blen {
 		buf = NewOffPage(bufSize)
@@ -427,12 +443,15 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 		logger.Fatalf("compress chunk %v: %s", c.id, err)
 		return
 	}
-	buf.Data = buf.Data[:n]
+	buf.Data = c.store.seal(buf.Data, n, block.Data)
 	if blen < c.store.conf.BlockSize {
 		// block will be freed after written into disk
 		c.store.bcache.cache(key, block, false)
 	}
 	block.Release()
+	if c.tier > 0 {
+		key = tierKey(c.tier, key)
+	}
 
 	c.store.currentUpload <- true
 	defer func() {
@@ -442,8 +461,11 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 
 	try := 0
 	for try <= 10 && c.uploadError == nil {
-		err = c.put(key, buf)
+		err = c.store.put(key, buf)
 		if err == nil {
+			if hash != nil {
+				c.addBlock(indx, hash)
+			}
 			c.errors <- nil
 			return
 		}
@@ -492,7 +514,7 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 		}
 
 		block = NewOffPage(blockSize)
-		_, err = io.ReadFull(f, block.Data)
+		err = c.store.readStaging(f, block)
 		_ = f.Close()
 		if err != nil {
 			logger.Errorf("read stagging file %s: %s", stagingPath, err)
@@ -500,7 +522,7 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 			return
 		}
 	}
-	bufSize := c.store.compressor.CompressBound(blockSize)
+	bufSize := c.store.compressor.CompressBound(blockSize) + c.store.trailerSize()
 	var buf *Page
 	if bufSize > blockSize {
 		buf = NewOffPage(bufSize)
@@ -513,12 +535,12 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 		logger.Fatalf("compress chunk %v: %s", c.id, err)
 		return
 	}
-	buf.Data = buf.Data[:n]
+	buf.Data = c.store.seal(buf.Data, n, block.Data)
 	block.Release()
 
 	try := 0
 	for c.uploadError == nil {
-		err = c.put(key, buf)
+		err = c.store.put(key, buf)
 		if err == nil {
 			break
 		}
@@ -555,11 +577,23 @@ func (c *wChunk) upload(indx int) {
 				logger.Fatalf("block length does not match: %v != %v", off, blen)
 			}
 		}
+		if c.tier > 0 {
+			c.syncUpload(key, block, indx, nil)
+			return
+		}
+		var hash []byte
+		if c.store.dedupWrites() {
+			var shared bool
+			if hash, shared = c.dedup(indx, key, block); shared {
+				c.errors <- nil
+				return
+			}
+		}
 		if c.store.conf.Writeback {
 			stagingPath, err := c.store.bcache.stage(key, block.Data, c.store.shouldCache(blen))
 			if err != nil {
 				logger.Warnf("write %s to disk: %s, upload it directly", stagingPath, err)
-				c.syncUpload(key, block)
+				c.syncUpload(key, block, indx, hash)
 			} else {
 				c.errors <- nil
 				if c.store.conf.UploadDelay == 0 {
@@ -572,7 +606,7 @@ func (c *wChunk) upload(indx int) {
 				}
 			}
 		} else {
-			c.syncUpload(key, block)
+			c.syncUpload(key, block, indx, hash)
 		}
 	}()
 }
@@ -607,17 +641,30 @@ func (c *wChunk) Finish(length int) error {
 	if c.length != length {
 		return fmt.Errorf("Length mismatch: %v != %v", c.length, length)
 	}
+	if c.uploaded == 0 && c.pendings == 0 && c.tier == 0 && c.store.packer != nil && c.store.packable(length) {
+		err := c.store.packer.pack(c)
+		if err == nil {
+			return nil
+		}
+		logger.Warnf("pack slice %d: %s, upload it directly", c.id, err)
+	}
 
 	n := (length-1)/c.store.conf.BlockSize + 1
 	if err := c.FlushTo(n * c.store.conf.BlockSize); err != nil {
 		return err
 	}
-	for i := 0; i < c.pendings; i++ {
+	for ; c.pendings > 0; c.pendings-- {
 		if err := <-c.errors; err != nil {
+			c.pendings--
 			c.uploadError = err
 			return err
 		}
 	}
+	if c.tier > 0 {
+		if err := c.store.tierIndex.SetTier(c.id, c.tier); err != nil {
+			return fmt.Errorf("set tier of slice %d: %s", c.id, err)
+		}
+	}
 	return nil
 }
 
@@ -628,6 +675,22 @@ func (c *wChunk) Abort() {
 		}
 		c.pages[i] = nil
 	}
+	if c.store.dedupWrites() && c.tier == 0 {
+		// the uploaded blocks could be shared by others, remove the references instead
+		for ; c.pendings > 0; c.pendings-- {
+			<-c.errors
+		}
+		size := c.uploaded
+		if size > c.length {
+			size = c.length
+		}
+		if size > 0 {
+			if err := c.store.dedupIndex.DerefSlice(c.id, uint32(size)); err != nil {
+				logger.Warnf("remove references of slice %d: %s", c.id, err)
+			}
+		}
+		return
+	}
 	// delete uploaded blocks
 	c.length = c.uploaded
 	_ = c.Remove()
@@ -654,6 +717,9 @@ type Config struct {
 	BufferSize     int
 	Readahead      int
 	Prefetch       int
+	PackSize       int  // pack small slices into objects of this size
+	Dedup          bool // share the blocks with the same content
+	Checksum       bool // verify the blocks with the checksums appended to them
 }
 
 type cachedStore struct {
@@ -669,6 +735,12 @@ type cachedStore struct {
 	seekable      bool
 	upLimit       *ratelimit.Bucket
 	downLimit     *ratelimit.Bucket
+	index         PackIndex
+	packer        *packer
+	packed        map[uint64]*PackedSlice // the cached locations of slices, nil if not packed
+	packedMu      sync.Mutex
+	dedupIndex    DedupIndex
+	tierIndex     TierIndex
 }
 
 func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bool) (err error) {
@@ -678,11 +750,31 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 			err = fmt.Errorf("recovered from %s", e)
 		}
 	}()
+	for try := 0; try < 2; try++ {
+		if err = store.fetch(key, page); !isChecksumError(err) {
+			break
+		}
+		checksumErrors.WithLabelValues("object").Add(1)
+		logger.Warnf("GET %s: %s (tried %d)", key, err, try+1)
+		err = fmt.Errorf("get %s: %s", key, err)
+	}
+	if err != nil {
+		return err
+	}
+	if cache {
+		store.bcache.cache(key, page, forceCache)
+	}
+	return nil
+}
+
+// fetch reads a block from the object storage, and verifies it if the checksum is enabled.
+func (store *cachedStore) fetch(key string, page *Page) (err error) {
+	trailer := store.trailerSize()
 	needed := store.compressor.CompressBound(len(page.Data))
 	compressed := needed > len(page.Data)
 	// we don't know the actual size for compressed block
 	if store.downLimit != nil && !compressed {
-		store.downLimit.Wait(int64(len(page.Data)))
+		store.downLimit.Wait(int64(len(page.Data) + trailer))
 	}
 	err = errors.New("Not downloaded")
 	var in io.ReadCloser
@@ -702,8 +794,8 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 	var n int
 	var buf []byte
 	if err == nil {
-		if compressed {
-			c := NewOffPage(needed)
+		if compressed || trailer > 0 {
+			c := NewOffPage(needed + trailer)
 			defer c.Release()
 			buf = c.Data
 		} else {
@@ -729,15 +821,25 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 		objectReqErrors.Add(1)
 		return fmt.Errorf("get %s: %s", key, err)
 	}
+	var sum []byte
+	if trailer > 0 {
+		if n < trailer {
+			return fmt.Errorf("read %s fully: no checksum (%d bytes)", key, n)
+		}
+		n -= trailer
+		sum = buf[n : n+trailer]
+	}
 	if compressed {
 		n, err = store.compressor.Decompress(page.Data, buf[:n])
+	} else if trailer > 0 {
+		n = copy(page.Data, buf[:n])
 	}
 	if err != nil || n < len(page.Data) {
 		return fmt.Errorf("read %s fully: %s (%d < %d) after %s (tried %d)", key, err, n, len(page.Data),
 			used, tried)
 	}
-	if cache {
-		store.bcache.cache(key, page, forceCache)
+	if sum != nil {
+		return verifyBlock(page.Data, sum)
 	}
 	return nil
 }
@@ -837,6 +939,7 @@ func initMetrics(store *cachedStore, registerer prometheus.Registerer) {
 	_ = registerer.Register(objectDataBytes)
 	_ = registerer.Register(stageBlocks)
 	_ = registerer.Register(stageBlockBytes)
+	_ = registerer.Register(checksumErrors)
 }
 
 func (store *cachedStore) shouldCache(size int) bool {
@@ -863,22 +966,23 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 		}
 		blockSize := parseObjOrigSize(key)
 		block := NewOffPage(blockSize)
-		_, err = io.ReadFull(f, block.Data)
+		err = store.readStaging(f, block)
 		_ = f.Close()
 		if err != nil {
 			block.Release()
 			logger.Errorf("read %s: %s", stagingPath, err)
 			return
 		}
-		buf := NewOffPage(store.compressor.CompressBound(blockSize))
+		buf := NewOffPage(store.compressor.CompressBound(blockSize) + store.trailerSize())
 		defer buf.Release()
 		n, err := store.compressor.Compress(buf.Data, block.Data)
-		block.Release()
 		if err != nil {
+			block.Release()
 			logger.Errorf("compress chunk %s: %s", stagingPath, err)
 			return
 		}
-		compressed := buf.Data[:n]
+		compressed := store.seal(buf.Data, n, block.Data)
+		block.Release()
 		try := 0
 		for {
 			if store.upLimit != nil {
@@ -943,7 +1047,7 @@ func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 	r := chunkForRead(chunkid, int(length), store)
 	keys := r.keys()
 	var err error
-	for _, k := range keys {
+	for i, k := range keys {
 		f, e := store.bcache.load(k)
 		if e == nil { // already cached
 			_ = f.Close()
@@ -956,7 +1060,7 @@ func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 		}
 		p := NewOffPage(size)
 		defer p.Release()
-		if e := store.load(k, p, true, true); e != nil {
+		if e := r.load(i, p, true, true); e != nil {
 			logger.Warnf("Failed to load key: %s %s", k, e)
 			err = e
 		}
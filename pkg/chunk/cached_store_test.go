@@ -20,13 +20,18 @@ package chunk
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func forgeChunk(store ChunkStore, chunkid uint64, size int) error {
@@ -243,6 +248,389 @@ func TestFillCache(t *testing.T) {
 	}
 }
 
+type memPackIndex struct {
+	sync.Mutex
+	next   uint64
+	packs  map[uint64]uint32
+	slices map[uint64]PackedSlice
+	finds  int
+}
+
+func (m *memPackIndex) NewPack() (uint64, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.next++
+	return 1000 + m.next, nil
+}
+
+func (m *memPackIndex) AddPack(pack uint64, size uint32, slices []PackedSlice) error {
+	m.Lock()
+	defer m.Unlock()
+	m.packs[pack] = size
+	for _, s := range slices {
+		s.Pack = pack
+		m.slices[s.Chunkid] = s
+	}
+	return nil
+}
+
+func (m *memPackIndex) FindPacked(chunkid uint64) (*PackedSlice, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.finds++
+	if s, ok := m.slices[chunkid]; ok {
+		return &s, nil
+	}
+	return nil, nil
+}
+
+func TestStorePack(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.Compress = "lz4"
+	conf.PackSize = 64 << 10
+	store := NewCachedStore(mem, conf, nil)
+	index := &memPackIndex{packs: make(map[uint64]uint32), slices: make(map[uint64]PackedSlice)}
+	store.SetPackIndex(index)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(chunkid uint64) {
+			defer wg.Done()
+			if err := forgeChunk(store, chunkid, 1000*int(chunkid)); err != nil {
+				t.Errorf("write chunk %d: %s", chunkid, err)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+	if err := forgeChunk(store, 11, conf.BlockSize/2); err != nil { // too large to be packed
+		t.Fatalf("write chunk 11: %s", err)
+	}
+	defer store.Remove(11, conf.BlockSize/2)
+	if len(index.slices) != 10 || len(index.packs) == 0 || len(index.packs) > 2 {
+		t.Fatalf("expect 10 slices in 1 or 2 packs, but got %d slices in %d packs", len(index.slices), len(index.packs))
+	}
+	if objs, _ := mem.List("chunks/", "", 100); len(objs) != 1 {
+		t.Fatalf("expect 1 chunk object, but got %d", len(objs))
+	}
+	read := func(chunkid uint64) {
+		size := 1000 * int(chunkid)
+		p := NewPage(make([]byte, size))
+		if n, err := store.NewReader(chunkid, size).ReadAt(context.Background(), p, 0); err != nil || n != size {
+			t.Fatalf("read chunk %d: %d %s", chunkid, n, err)
+		}
+		if !bytes.Equal(p.Data, bytes.Repeat([]byte{0x41}, size)) {
+			t.Fatalf("data of chunk %d is not expected", chunkid)
+		}
+	}
+	for i := 1; i <= 10; i++ {
+		read(uint64(i))
+	}
+	if index.finds != 0 {
+		t.Fatalf("the locations of packed slices should be cached, but looked up %d times", index.finds)
+	}
+
+	// move some of them into a new pack
+	old := index.slices[3].Pack
+	var slices []PackedSlice
+	for _, s := range index.slices {
+		if s.Pack == old && s.Chunkid%2 == 1 {
+			slices = append(slices, s)
+		}
+	}
+	size, err := store.Repack(old, slices, 2000)
+	if err != nil {
+		t.Fatalf("repack %d: %s", old, err)
+	}
+	var total uint32
+	for _, s := range slices {
+		if s.Pack != 2000 || s.Off != total {
+			t.Fatalf("slice %d is not moved: %+v", s.Chunkid, s)
+		}
+		total += s.Len
+		index.slices[s.Chunkid] = s
+	}
+	if size != total {
+		t.Fatalf("size of new pack %d != %d", size, total)
+	}
+	if err = store.RemovePack(old); err != nil {
+		t.Fatalf("remove pack %d: %s", old, err)
+	}
+	for _, s := range slices {
+		read(s.Chunkid)
+	}
+	if index.finds != len(slices) {
+		t.Fatalf("the moved slices should be looked up once, but got %d lookups for %d slices", index.finds, len(slices))
+	}
+}
+
+type memDedupIndex struct {
+	sync.Mutex
+	blocks map[string]Block
+	refs   map[Block]string
+}
+
+func (m *memDedupIndex) RefBlock(hash []byte, b Block) (*Block, error) {
+	m.Lock()
+	defer m.Unlock()
+	owner, ok := m.blocks[string(hash)]
+	if !ok {
+		return nil, nil
+	}
+	m.refs[Block{Chunkid: b.Chunkid, Indx: b.Indx}] = string(hash)
+	return &owner, nil
+}
+
+func (m *memDedupIndex) AddBlock(hash []byte, b Block) error {
+	m.Lock()
+	defer m.Unlock()
+	m.blocks[string(hash)] = b
+	m.refs[Block{Chunkid: b.Chunkid, Indx: b.Indx}] = string(hash)
+	return nil
+}
+
+func (m *memDedupIndex) FindBlock(chunkid uint64, indx uint32) (*Block, error) {
+	m.Lock()
+	defer m.Unlock()
+	if h, ok := m.refs[Block{Chunkid: chunkid, Indx: indx}]; ok {
+		owner := m.blocks[h]
+		return &owner, nil
+	}
+	return nil, nil
+}
+
+func (m *memDedupIndex) DerefSlice(chunkid uint64, size uint32) error {
+	m.Lock()
+	defer m.Unlock()
+	for indx := uint32(0); indx*uint32(defaultConf.BlockSize) < size; indx++ {
+		b := Block{Chunkid: chunkid, Indx: indx}
+		if h, ok := m.refs[b]; ok {
+			delete(m.refs, b)
+			if m.countRefs(h) == 0 {
+				delete(m.blocks, h)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memDedupIndex) countRefs(hash string) int {
+	var n int
+	for _, h := range m.refs {
+		if h == hash {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStoreDedup(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.Dedup = true
+	store := NewCachedStore(mem, conf, nil)
+	index := &memDedupIndex{blocks: make(map[string]Block), refs: make(map[Block]string)}
+	store.SetDedupIndex(index)
+
+	bsize := conf.BlockSize
+	if err := forgeChunk(store, 1, bsize); err != nil {
+		t.Fatalf("write chunk 1: %s", err)
+	}
+	if err := forgeChunk(store, 2, bsize+bsize/2); err != nil {
+		t.Fatalf("write chunk 2: %s", err)
+	}
+	if objs, _ := mem.List("chunks/", "", 100); len(objs) != 2 {
+		t.Fatalf("expect 2 objects, but got %d", len(objs))
+	}
+	p := NewPage(make([]byte, bsize+bsize/2))
+	if n, err := store.NewReader(2, len(p.Data)).ReadAt(context.Background(), p, 0); err != nil || n != len(p.Data) {
+		t.Fatalf("read chunk 2: %d %s", n, err)
+	}
+	if !bytes.Equal(p.Data, bytes.Repeat([]byte{0x41}, len(p.Data))) {
+		t.Fatalf("data of chunk 2 is not expected")
+	}
+
+	// the references taken by an aborted writer are released
+	w := store.NewWriter(3)
+	if _, err := w.WriteAt(append(bytes.Repeat([]byte{0x41}, bsize), bytes.Repeat([]byte{0x42}, bsize)...), 0); err != nil {
+		t.Fatalf("write chunk 3: %s", err)
+	}
+	_ = w.FlushTo(bsize * 2)
+	w.Abort()
+	ha, hb := sha256.Sum256(bytes.Repeat([]byte{0x41}, bsize)), sha256.Sum256(bytes.Repeat([]byte{0x42}, bsize))
+	index.Lock()
+	if n := index.countRefs(string(ha[:])); n != 2 {
+		t.Fatalf("expect 2 references to the shared block, but got %d", n)
+	}
+	if n := index.countRefs(string(hb[:])); n != 0 {
+		t.Fatalf("expect no reference to the block of aborted chunk, but got %d", n)
+	}
+	index.Unlock()
+
+	// the first block of chunk 2 is read from chunk 1
+	if err := store.RemoveBlock(1, 0, uint32(bsize)); err != nil {
+		t.Fatalf("remove block 1_0: %s", err)
+	}
+	p = NewPage(make([]byte, bsize))
+	if _, err := store.NewReader(2, bsize+bsize/2).ReadAt(context.Background(), p, 0); err == nil {
+		t.Fatalf("read chunk 2 should fail without the shared block")
+	}
+	_ = store.Remove(2, bsize+bsize/2)
+}
+
+type memTierIndex struct {
+	sync.Mutex
+	tiers map[uint64]uint8
+}
+
+func (m *memTierIndex) SetTier(chunkid uint64, tier uint8) error {
+	m.Lock()
+	defer m.Unlock()
+	m.tiers[chunkid] = tier
+	return nil
+}
+
+func (m *memTierIndex) FindTier(chunkid uint64) (uint8, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.tiers[chunkid], nil
+}
+
+func TestStoreTier(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	cold, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.PackSize = 1 << 20
+	store := NewCachedStore(mem, conf, nil)
+	store.SetPackIndex(&memPackIndex{packs: make(map[uint64]uint32), slices: make(map[uint64]PackedSlice)})
+	index := &memTierIndex{tiers: make(map[uint64]uint8)}
+	store.SetTiers(index, func(tier uint8) (object.ObjectStorage, error) {
+		if tier != 2 {
+			return nil, fmt.Errorf("unknown tier %d", tier)
+		}
+		return cold, nil
+	})
+
+	w := store.NewWriter(1)
+	w.SetTier(2)
+	if _, err := w.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("write chunk 1: %s", err)
+	}
+	if err := w.Finish(5); err != nil {
+		t.Fatalf("finish chunk 1: %s", err)
+	}
+	if tier, _ := index.FindTier(1); tier != 2 {
+		t.Fatalf("tier of chunk 1: %d", tier)
+	}
+	if objs, _ := cold.List("", "", 100); len(objs) != 1 || objs[0].Key() != "chunks/0/0/1_0_5" {
+		t.Fatalf("objects in tier: %+v", objs)
+	}
+	if objs, _ := mem.List("", "", 100); len(objs) != 0 {
+		t.Fatalf("expect no objects in the primary storage, but got %d", len(objs))
+	}
+	p := NewPage(make([]byte, 5))
+	if n, err := store.NewReader(1, 5).ReadAt(context.Background(), p, 0); err != nil || n != 5 || string(p.Data) != "hello" {
+		t.Fatalf("read chunk 1: %d %s %s", n, err, p.Data)
+	}
+	if err := store.Remove(1, 5); err != nil {
+		t.Fatalf("remove chunk 1: %s", err)
+	}
+	if objs, _ := cold.List("", "", 100); len(objs) != 0 {
+		t.Fatalf("expect no objects in tier, but got %d", len(objs))
+	}
+
+}
+
+func TestStoreChecksum(t *testing.T) {
+	for _, algr := range []string{"none", "lz4"} {
+		mem, _ := object.CreateStorage("mem", "", "", "")
+		conf := defaultConf
+		conf.Compress = algr
+		conf.Checksum = true
+		conf.CacheDir = t.TempDir()
+		testStore(t, NewCachedStore(mem, conf, nil))
+	}
+
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.Checksum = true
+	conf.CacheDir = t.TempDir()
+	conf.CacheSize = 10
+	store := NewCachedStore(mem, conf, nil)
+	data := bytes.Repeat([]byte("hello"), 200)
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		t.Fatalf("write chunk 1: %s", err)
+	}
+	if err := w.Finish(len(data)); err != nil {
+		t.Fatalf("finish chunk 1: %s", err)
+	}
+	key := "chunks/0/0/1_0_1000"
+	path := filepath.Join(conf.CacheDir, cacheDir, key)
+	var cached []byte
+	for i := 0; i < 100 && len(cached) == 0; i++ {
+		time.Sleep(time.Millisecond * 10) // waiting for flush
+		cached, _ = os.ReadFile(path)
+	}
+	if len(cached) != len(data)+checksumSize {
+		t.Fatalf("cached block %s: %d bytes", path, len(cached))
+	}
+	read := func() (string, error) {
+		p := NewPage(make([]byte, len(data)))
+		n, err := store.NewReader(1, len(data)).ReadAt(context.Background(), p, 0)
+		return string(p.Data[:n]), err
+	}
+
+	// the broken cached block is evicted and read again from the object storage
+	cached[10] ^= 0xff
+	if err := os.WriteFile(path, cached, 0600); err != nil {
+		t.Fatalf("write cached block: %s", err)
+	}
+	before := testutil.ToFloat64(checksumErrors.WithLabelValues("cache"))
+	if d, err := read(); err != nil || d != string(data) {
+		t.Fatalf("read chunk 1 with broken cache: %s", err)
+	}
+	if n := testutil.ToFloat64(checksumErrors.WithLabelValues("cache")); n != before+1 {
+		t.Fatalf("checksum errors of cache: %f", n-before)
+	}
+
+	// the broken object can not be read
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	store.(*cachedStore).bcache.remove(key)
+	in, _ := mem.Get(key, 0, -1)
+	obj, _ := io.ReadAll(in)
+	obj[0] ^= 0xff
+	_ = mem.Put(key, bytes.NewReader(obj))
+	before = testutil.ToFloat64(checksumErrors.WithLabelValues("object"))
+	if _, err := read(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("read chunk 1 with broken object: %v", err)
+	}
+	if n := testutil.ToFloat64(checksumErrors.WithLabelValues("object")); n != before+2 {
+		t.Fatalf("checksum errors of object: %f", n-before)
+	}
+
+	// packed slices
+	conf.CacheSize = 0
+	conf.PackSize = 1 << 20
+	store = NewCachedStore(mem, conf, nil)
+	index := &memPackIndex{packs: make(map[uint64]uint32), slices: make(map[uint64]PackedSlice)}
+	store.SetPackIndex(index)
+	if err := forgeChunk(store, 2, 100); err != nil {
+		t.Fatalf("forge chunk 2: %s", err)
+	}
+	if s, _ := index.FindPacked(2); s == nil || s.Len != 100+checksumSize {
+		t.Fatalf("packed slice 2: %+v", s)
+	}
+	p := NewPage(make([]byte, 100))
+	if n, err := store.NewReader(2, 100).ReadAt(context.Background(), p, 0); err != nil || n != 100 || p.Data[99] != 0x41 {
+		t.Fatalf("read packed chunk 2: %d %s", n, err)
+	}
+}
+
 func BenchmarkCachedRead(b *testing.B) {
 	blob, _ := object.CreateStorage("mem", "", "", "")
 	config := defaultConf
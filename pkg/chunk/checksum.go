@@ -0,0 +1,116 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// When Config.Checksum is enabled, the CRC32C of every block is calculated once it's written, and appended
+// as a trailer after the (compressed) data of the object, the cached file and the staging file. The trailer
+// is verified on every read, the broken cached copies are evicted and the blocks are fetched again from the
+// object storage. The packed slices carry the trailers too, so they are verified as normal blocks.
+
+const checksumSize = 4
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var checksumErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "block_checksum_errors",
+	Help: "number of blocks failed to pass the checksum",
+}, []string{"source"})
+
+type checksumError struct {
+	expected, actual uint32
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expect %08x, got %08x", e.expected, e.actual)
+}
+
+func isChecksumError(err error) bool {
+	_, ok := err.(*checksumError)
+	return ok
+}
+
+func blockChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32c)
+}
+
+// trailerSize returns the size of trailer after every block.
+func (store *cachedStore) trailerSize() int {
+	if store.conf.Checksum {
+		return checksumSize
+	}
+	return 0
+}
+
+// trailerSize returns the size of the checksum appended to the cached blocks, which is counted in the usage.
+func (cache *cacheStore) trailerSize() int {
+	if cache.checksum {
+		return checksumSize
+	}
+	return 0
+}
+
+// seal appends the checksum of the block after the first n bytes of buf, which should have enough space.
+func (store *cachedStore) seal(buf []byte, n int, block []byte) []byte {
+	if !store.conf.Checksum {
+		return buf[:n]
+	}
+	binary.BigEndian.PutUint32(buf[n:n+checksumSize], blockChecksum(block))
+	return buf[:n+checksumSize]
+}
+
+// verifyBlock checks the block against the trailer.
+func verifyBlock(block, trailer []byte) error {
+	expected := binary.BigEndian.Uint32(trailer)
+	if actual := blockChecksum(block); actual != expected {
+		return &checksumError{expected, actual}
+	}
+	return nil
+}
+
+// readVerified reads the block with the trailer from r, and verifies it.
+func readVerified(r io.Reader, block []byte) error {
+	if _, err := io.ReadFull(r, block); err != nil {
+		return err
+	}
+	var trailer [checksumSize]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return fmt.Errorf("read checksum: %s", err)
+	}
+	return verifyBlock(block, trailer[:])
+}
+
+// readStaging reads a block from the staging file.
+func (store *cachedStore) readStaging(r io.Reader, block *Page) error {
+	if !store.conf.Checksum {
+		_, err := io.ReadFull(r, block.Data)
+		return err
+	}
+	err := readVerified(r, block.Data)
+	if isChecksumError(err) {
+		checksumErrors.WithLabelValues("staging").Add(1)
+	}
+	return err
+}
@@ -19,6 +19,8 @@ package chunk
 import (
 	"context"
 	"io"
+
+	"github.com/juicedata/juicefs/pkg/object"
 )
 
 type Reader interface {
@@ -29,15 +31,61 @@ type Writer interface {
 	io.WriterAt
 	ID() uint64
 	SetID(chunkid uint64)
+	SetTier(tier uint8)
 	FlushTo(offset int) error
 	Finish(length int) error
 	Abort()
 }
 
+// PackedSlice is the location of a slice in a pack.
+type PackedSlice struct {
+	Chunkid uint64
+	Pack    uint64
+	Off     uint32
+	Len     uint32
+}
+
+// PackIndex records the slices packed into shared objects.
+type PackIndex interface {
+	NewPack() (uint64, error)
+	AddPack(pack uint64, size uint32, slices []PackedSlice) error
+	FindPacked(chunkid uint64) (*PackedSlice, error) // nil if it's not packed
+}
+
+// Block is a block of a slice.
+type Block struct {
+	Chunkid uint64
+	Indx    uint32
+	Size    uint32
+}
+
+// DedupIndex records the blocks shared by slices.
+type DedupIndex interface {
+	RefBlock(hash []byte, b Block) (*Block, error) // nil if there is no block with the same hash
+	AddBlock(hash []byte, b Block) error
+	FindBlock(chunkid uint64, indx uint32) (*Block, error) // nil if it's not shared
+	DerefSlice(chunkid uint64, size uint32) error          // remove the references from the blocks of a slice
+}
+
+// TierIndex records the tiers of slices not in the primary storage.
+type TierIndex interface {
+	SetTier(chunkid uint64, tier uint8) error
+	FindTier(chunkid uint64) (uint8, error) // 0 if it's in the primary storage
+}
+
 type ChunkStore interface {
 	NewReader(chunkid uint64, length int) Reader
 	NewWriter(chunkid uint64) Writer
 	Remove(chunkid uint64, length int) error
 	FillCache(chunkid uint64, length uint32) error
 	UsedMemory() int64
+	SetPackIndex(index PackIndex)
+	Repack(old uint64, slices []PackedSlice, pack uint64) (uint32, error)
+	RemovePack(pack uint64) error
+	SetDedupIndex(index DedupIndex)
+	RemoveBlock(chunkid uint64, indx uint32, size uint32) error
+	SetTiers(index TierIndex, open func(tier uint8) (object.ObjectStorage, error))
+	SliceTier(chunkid uint64) (uint8, error)
+	CopySlice(chunkid uint64, length int, from, to uint8) error
+	RemoveSlice(chunkid uint64, length int, tier uint8) error
 }
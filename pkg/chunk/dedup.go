@@ -0,0 +1,97 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"crypto/sha256"
+)
+
+// The blocks with the same content can be shared by slices when Config.Dedup is set. A block is hashed
+// (sha256) before uploading, and it's referenced in the DedupIndex instead of uploaded again if a block
+// with the same hash is found, or recorded in the index after uploaded. The shared blocks are read from
+// the object of the first one, and they are cached as their own. Deduplication works on the fixed block
+// boundaries, and it's not used in writeback mode.
+
+func (store *cachedStore) dedupWrites() bool {
+	return store.dedupIndex != nil && store.conf.Dedup && !store.conf.Writeback
+}
+
+// dedup references the block with the same content, it returns the hash of the block if it's not shared.
+func (c *wChunk) dedup(indx int, key string, block *Page) ([]byte, bool) {
+	sum := sha256.Sum256(block.Data)
+	b := Block{Chunkid: c.id, Indx: uint32(indx), Size: uint32(len(block.Data))}
+	owner, err := c.store.dedupIndex.RefBlock(sum[:], b)
+	if err != nil {
+		logger.Warnf("find block with the same content as %s: %s", key, err)
+		return nil, false
+	}
+	if owner == nil {
+		return sum[:], false
+	}
+	logger.Debugf("block %s is shared with %d_%d_%d", key, owner.Chunkid, owner.Indx, owner.Size)
+	c.store.bcache.cache(key, block, false)
+	block.Release()
+	return nil, true
+}
+
+// addBlock records an uploaded block, so it can be shared by others.
+func (c *wChunk) addBlock(indx int, hash []byte) {
+	b := Block{Chunkid: c.id, Indx: uint32(indx), Size: uint32(c.blockSize(indx))}
+	if err := c.store.dedupIndex.AddBlock(hash, b); err != nil {
+		logger.Debugf("add block %d_%d_%d: %s", b.Chunkid, b.Indx, b.Size, err)
+	}
+}
+
+// objKey returns the key of the object storing a block, which could be shared with other slices.
+func (c *rChunk) objKey(indx int) string {
+	key := c.key(indx)
+	if tier := c.getTier(); tier > 0 {
+		return tierKey(tier, key)
+	}
+	if c.store.dedupIndex == nil {
+		return key
+	}
+	b, err := c.store.dedupIndex.FindBlock(c.id, uint32(indx))
+	if err != nil {
+		logger.Warnf("find shared block of %s: %s", key, err)
+		return key
+	}
+	if b == nil || b.Chunkid == c.id && int(b.Indx) == indx {
+		return key
+	}
+	return c.store.blockKey(b.Chunkid, int(b.Indx), int(b.Size))
+}
+
+func (store *cachedStore) SetDedupIndex(index DedupIndex) {
+	store.dedupIndex = index
+	if store.conf.Dedup && store.conf.Writeback {
+		logger.Warnf("deduplication is disabled in writeback mode")
+	}
+}
+
+func (store *cachedStore) RemoveBlock(chunkid uint64, indx uint32, size uint32) error {
+	key := store.blockKey(chunkid, int(indx), int(size))
+	store.pendingMutex.Lock()
+	delete(store.pendingKeys, key)
+	store.pendingMutex.Unlock()
+	store.bcache.remove(key)
+	c := rChunk{id: chunkid, store: store}
+	if tier := c.getTier(); tier > 0 {
+		key = tierKey(tier, key) // the blocks in tiers are not shared
+	}
+	return store.delete(key)
+}
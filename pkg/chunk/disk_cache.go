@@ -17,7 +17,9 @@
 package chunk
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"math"
@@ -62,6 +64,7 @@ type cacheStore struct {
 	keys     map[string]cacheItem
 	scanned  bool
 	full     bool
+	checksum bool
 	uploader func(key, path string)
 }
 
@@ -80,6 +83,7 @@ func newCacheStore(dir string, cacheSize int64, pendingPages int, config *Config
 		keys:      make(map[string]cacheItem),
 		pending:   make(chan pendingFile, pendingPages),
 		pages:     make(map[string]*Page),
+		checksum:  config.Checksum,
 		uploader:  uploader,
 	}
 	c.createDir(c.dir)
@@ -191,6 +195,15 @@ func (cache *cacheStore) flushPage(path string, data []byte) (err error) {
 		_ = f.Close()
 		return
 	}
+	if cache.checksum {
+		var trailer [checksumSize]byte
+		binary.BigEndian.PutUint32(trailer[:], blockChecksum(data))
+		if _, err = f.Write(trailer[:]); err != nil {
+			logger.Warnf("Write checksum to cache file %s failed: %s", tmp, err)
+			_ = f.Close()
+			return
+		}
+	}
 	if err = f.Close(); err != nil {
 		logger.Warnf("Close cache file %s failed: %s", tmp, err)
 		return
@@ -250,15 +263,47 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 		return nil, errors.New("not cached")
 	}
 	cache.Unlock()
-	f, err := os.Open(cache.cachePath(key))
+	path := cache.cachePath(key)
+	f, err := os.Open(path)
+	var r ReadCloser = f
+	var broken bool
+	if err == nil && cache.checksum {
+		r, err = cache.verify(key, f)
+		broken = err != nil
+	}
 	cache.Lock()
 	if err == nil {
 		if it, ok := cache.keys[key]; ok {
 			// update atime
 			cache.keys[key] = cacheItem{it.size, uint32(time.Now().Unix())}
 		}
+	} else if broken {
+		if it := cache.keys[key]; it.atime > 0 && it.size > 0 {
+			cache.used -= int64(it.size + 4096)
+			delete(cache.keys, key)
+		}
+		cache.Unlock()
+		_ = os.Remove(path)
+		cache.Lock()
+	}
+	return r, err
+}
+
+// verify reads the whole cached block and checks it against the trailer.
+func (cache *cacheStore) verify(key string, f *os.File) (ReadCloser, error) {
+	defer f.Close()
+	size := parseObjOrigSize(key)
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid key %s", key)
+	}
+	p := NewOffPage(size)
+	defer p.Release()
+	if err := readVerified(f, p.Data); err != nil {
+		checksumErrors.WithLabelValues("cache").Add(1)
+		logger.Warnf("Verify cached block %s: %s, evict it", f.Name(), err)
+		return nil, err
 	}
-	return f, err
+	return NewPageReader(p), nil
 }
 
 func (cache *cacheStore) cachePath(key string) string {
@@ -275,7 +320,7 @@ func (cache *cacheStore) flush() {
 		w := <-cache.pending
 		path := cache.cachePath(w.key)
 		if cache.capacity > 0 && cache.flushPage(path, w.page.Data) == nil {
-			cache.add(w.key, int32(len(w.page.Data)), uint32(time.Now().Unix()))
+			cache.add(w.key, int32(len(w.page.Data)+cache.trailerSize()), uint32(time.Now().Unix()))
 		}
 		cache.Lock()
 		delete(cache.pages, w.key)
@@ -321,7 +366,7 @@ func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string,
 			path := cache.cachePath(key)
 			cache.createDir(filepath.Dir(path))
 			if err := os.Link(stagingPath, path); err == nil {
-				cache.add(key, -int32(len(data)), uint32(time.Now().Unix()))
+				cache.add(key, -int32(len(data)+cache.trailerSize()), uint32(time.Now().Unix()))
 			} else {
 				logger.Warnf("link %s to %s failed: %s", stagingPath, path, err)
 			}
@@ -331,7 +376,7 @@ func (cache *cacheStore) stage(key string, data []byte, keepCache bool) (string,
 }
 
 func (cache *cacheStore) uploaded(key string, size int) {
-	cache.add(key, int32(size), 0)
+	cache.add(key, int32(size+cache.trailerSize()), 0)
 }
 
 // locked
@@ -51,6 +51,29 @@ func TestExpand(t *testing.T) {
 	}
 }
 
+func TestCacheUsage(t *testing.T) {
+	conf := defaultConf
+	conf.Checksum = true
+	s := newCacheStore(filepath.Join(t.TempDir(), "diskCache"), 1<<30, 1, &conf, nil)
+	key := "chunks/0/0/1_0_1024"
+	s.cache(key, NewPage(make([]byte, 1024)), true)
+	time.Sleep(time.Millisecond * 100)
+	fi, err := os.Stat(s.cachePath(key))
+	if err != nil {
+		t.Fatalf("stat cached block: %s", err)
+	}
+	if fi.Size() != 1024+checksumSize {
+		t.Fatalf("size of cached block should be %d, but got %d", 1024+checksumSize, fi.Size())
+	}
+	if _, used := s.stats(); used != fi.Size()+4096 {
+		t.Fatalf("used space should be %d, but got %d", fi.Size()+4096, used)
+	}
+	s.remove(key)
+	if _, used := s.stats(); used != 0 {
+		t.Fatalf("used space should be 0 after removed, but got %d", used)
+	}
+}
+
 func BenchmarkLoadCached(b *testing.B) {
 	dir := b.TempDir()
 	s := newCacheStore(filepath.Join(dir, "diskCache"), 1<<30, 1, &defaultConf, nil)
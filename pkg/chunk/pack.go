@@ -0,0 +1,324 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Small slices (no larger than 1/16 of the block size) can be packed into shared objects when Config.PackSize
+// is set. The slices finished by concurrent writers are compressed separately and appended into a pending
+// pack, which is uploaded once it's full or after a short delay, then the slices in it are recorded in the
+// PackIndex before the writers return. The packed slices are read with ranged GETs of the pack, and they
+// are cached as normal blocks. The locations of slices (or whether they are packed) are cached in memory to
+// save the lookups of PackIndex, and they are looked up again if the pack can't be read (compacted).
+
+const packDelay = time.Millisecond * 100 // the max time to wait for other slices
+const maxPackedCache = 100000            // the max number of slices with locations cached
+
+func packKey(id uint64) string {
+	return fmt.Sprintf("packs/%v/%v/%v", id/1000/1000, id/1000, id)
+}
+
+// packable returns true if a slice of the length could be packed.
+func (store *cachedStore) packable(length int) bool {
+	return store.index != nil && length > 0 && length <= store.conf.BlockSize/16
+}
+
+type pendingPack struct {
+	buf    []byte
+	slices []PackedSlice
+	done   chan struct{}
+	err    error
+}
+
+type packer struct {
+	sync.Mutex
+	store   *cachedStore
+	pending *pendingPack
+}
+
+// pack writes the data of a slice into a pack, and waits until it's uploaded and recorded.
+func (p *packer) pack(c *wChunk) error {
+	block := NewOffPage(c.length)
+	defer block.Release()
+	var off int
+	for _, b := range c.pages[0] {
+		off += copy(block.Data[off:], b.Data)
+	}
+	if off != c.length {
+		return fmt.Errorf("block length does not match: %v != %v", off, c.length)
+	}
+	buf := make([]byte, c.store.compressor.CompressBound(c.length)+c.store.trailerSize())
+	n, err := c.store.compressor.Compress(buf, block.Data)
+	if err != nil {
+		return fmt.Errorf("compress chunk %v: %s", c.id, err)
+	}
+	buf = c.store.seal(buf, n, block.Data)
+
+	p.Lock()
+	pp := p.pending
+	if pp == nil {
+		pp = &pendingPack{done: make(chan struct{})}
+		p.pending = pp
+		time.AfterFunc(packDelay, func() { p.flush(pp) })
+	}
+	pp.slices = append(pp.slices, PackedSlice{Chunkid: c.id, Off: uint32(len(pp.buf)), Len: uint32(len(buf))})
+	pp.buf = append(pp.buf, buf...)
+	full := len(pp.buf) >= c.store.conf.PackSize
+	p.Unlock()
+	if full {
+		go p.flush(pp)
+	}
+	<-pp.done
+	if pp.err != nil {
+		return pp.err
+	}
+
+	for _, b := range c.pages[0] {
+		freePage(b)
+	}
+	c.pages[0] = nil
+	c.store.bcache.cache(c.key(0), block, false)
+	return nil
+}
+
+func (p *packer) flush(pp *pendingPack) {
+	p.Lock()
+	if p.pending != pp {
+		p.Unlock()
+		return
+	}
+	p.pending = nil
+	p.Unlock()
+	pp.err = p.upload(pp)
+	close(pp.done)
+}
+
+func (p *packer) upload(pp *pendingPack) error {
+	store := p.store
+	id, err := store.index.NewPack()
+	if err != nil {
+		return fmt.Errorf("new pack: %s", err)
+	}
+	key := packKey(id)
+	store.currentUpload <- true
+	defer func() { <-store.currentUpload }()
+	try := 0
+	for {
+		if err = store.put(key, NewPage(pp.buf)); err == nil || try >= 3 {
+			break
+		}
+		try++
+		logger.Warnf("upload %s: %s (try %d)", key, err, try)
+		time.Sleep(time.Second * time.Duration(try*try))
+	}
+	if err != nil {
+		return fmt.Errorf("upload pack %s: %s (after %d tries)", key, err, try)
+	}
+	if err = store.index.AddPack(id, uint32(len(pp.buf)), pp.slices); err != nil {
+		_ = store.storage.Delete(key)
+		return fmt.Errorf("add pack %d: %s", id, err)
+	}
+	for i := range pp.slices {
+		s := pp.slices[i]
+		s.Pack = id
+		store.cachePacked(s.Chunkid, &s)
+	}
+	logger.Debugf("packed %d slices into %s (%d bytes)", len(pp.slices), key, len(pp.buf))
+	return nil
+}
+
+// findPacked returns the location of a slice (nil if it's not packed) from the cache, or PackIndex if it's
+// not cached or refresh is true.
+func (store *cachedStore) findPacked(chunkid uint64, refresh bool) (*PackedSlice, error) {
+	store.packedMu.Lock()
+	s, ok := store.packed[chunkid]
+	store.packedMu.Unlock()
+	if ok && !refresh {
+		return s, nil
+	}
+	s, err := store.index.FindPacked(chunkid)
+	if err != nil {
+		return nil, err
+	}
+	store.cachePacked(chunkid, s)
+	return s, nil
+}
+
+func (store *cachedStore) cachePacked(chunkid uint64, s *PackedSlice) {
+	store.packedMu.Lock()
+	defer store.packedMu.Unlock()
+	if len(store.packed) >= maxPackedCache {
+		for k := range store.packed { // evict some of them randomly
+			delete(store.packed, k)
+			if len(store.packed) < maxPackedCache*3/4 {
+				break
+			}
+		}
+	}
+	store.packed[chunkid] = s
+}
+
+// loadPacked reads a packed slice from the pack.
+func (store *cachedStore) loadPacked(s *PackedSlice, page *Page) error {
+	key := packKey(s.Pack)
+	if store.downLimit != nil {
+		store.downLimit.Wait(int64(s.Len))
+	}
+	buf := page.Data
+	trailer := store.trailerSize()
+	compressed := int(s.Len) != len(page.Data)+trailer || store.compressor.CompressBound(len(page.Data)) > len(page.Data)
+	if compressed || trailer > 0 {
+		c := NewOffPage(int(s.Len))
+		defer c.Release()
+		buf = c.Data
+	}
+	start := time.Now()
+	in, err := store.storage.Get(key, int64(s.Off), int64(s.Len))
+	var n int
+	if err == nil {
+		n, err = io.ReadFull(in, buf)
+		_ = in.Close()
+	}
+	used := time.Since(start)
+	logger.Debugf("GET %s RANGE(%d,%d) (%s, %.3fs)", key, s.Off, s.Len, err, used.Seconds())
+	if used > SlowRequest {
+		logger.Infof("slow request: GET %s (%v, %.3fs)", key, err, used.Seconds())
+	}
+	objectDataBytes.WithLabelValues("GET").Add(float64(n))
+	objectReqsHistogram.WithLabelValues("GET").Observe(used.Seconds())
+	if err != nil {
+		objectReqErrors.Add(1)
+		return fmt.Errorf("get %s: %s", key, err)
+	}
+	var sum []byte
+	if trailer > 0 {
+		if n < trailer {
+			return fmt.Errorf("read slice %d from %s: no checksum (%d bytes)", s.Chunkid, key, n)
+		}
+		n -= trailer
+		sum = buf[n:]
+	}
+	if compressed {
+		n, err = store.compressor.Decompress(page.Data, buf[:n])
+	} else if trailer > 0 {
+		n = copy(page.Data, buf[:n])
+	}
+	if err != nil || n < len(page.Data) {
+		return fmt.Errorf("read slice %d from %s: %s (%d < %d)", s.Chunkid, key, err, n, len(page.Data))
+	}
+	if sum != nil {
+		if err = verifyBlock(page.Data, sum); err != nil {
+			checksumErrors.WithLabelValues("object").Add(1)
+			return fmt.Errorf("read slice %d from %s: %s", s.Chunkid, key, err)
+		}
+	}
+	return nil
+}
+
+// load reads a block from the object storage, or the pack if the slice is packed.
+func (c *rChunk) load(indx int, page *Page, cache bool, forceCache bool) error {
+	key := c.key(indx)
+	if c.store.packable(c.length) {
+		for try := 0; ; try++ {
+			s, err := c.store.findPacked(c.id, try > 0)
+			if err != nil {
+				return fmt.Errorf("find packed slice %d: %s", c.id, err)
+			}
+			if s == nil {
+				break
+			}
+			if err = c.store.loadPacked(s, page); err != nil {
+				if try > 0 {
+					return err
+				}
+				// the pack could be compacted, find it again
+				logger.Debugf("load packed slice %d: %s", c.id, err)
+				continue
+			}
+			if cache {
+				c.store.bcache.cache(key, page, forceCache)
+			}
+			return nil
+		}
+	}
+	if okey := c.objKey(indx); okey != key {
+		// the block is shared, cache it as its own
+		if err := c.store.load(okey, page, false, false); err != nil {
+			return err
+		}
+		if cache {
+			c.store.bcache.cache(key, page, forceCache)
+		}
+		return nil
+	}
+	return c.store.load(key, page, cache, forceCache)
+}
+
+func (store *cachedStore) SetPackIndex(index PackIndex) {
+	store.index = index
+	store.packed = make(map[uint64]*PackedSlice)
+	if store.conf.PackSize > 0 && !store.conf.Writeback {
+		store.packer = &packer{store: store}
+	}
+}
+
+// Repack writes the slices in the old pack into a new one, and updates the locations of them.
+func (store *cachedStore) Repack(old uint64, slices []PackedSlice, pack uint64) (uint32, error) {
+	key := packKey(old)
+	in, err := store.storage.Get(key, 0, -1)
+	if err != nil {
+		return 0, fmt.Errorf("get %s: %s", key, err)
+	}
+	data, err := ioutil.ReadAll(in)
+	_ = in.Close()
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %s", key, err)
+	}
+	var buf []byte
+	for i := range slices {
+		s := &slices[i]
+		if int(s.Off)+int(s.Len) > len(data) {
+			return 0, fmt.Errorf("slice %d is out of %s: %d+%d > %d", s.Chunkid, key, s.Off, s.Len, len(data))
+		}
+		d := data[s.Off : s.Off+s.Len]
+		s.Pack, s.Off = pack, uint32(len(buf))
+		buf = append(buf, d...)
+	}
+	if err = store.put(packKey(pack), NewPage(buf)); err != nil {
+		return 0, err
+	}
+	return uint32(len(buf)), nil
+}
+
+func (store *cachedStore) RemovePack(pack uint64) error {
+	key := packKey(pack)
+	st := time.Now()
+	err := store.storage.Delete(key)
+	used := time.Since(st)
+	logger.Debugf("DELETE %v (%v, %.3fs)", key, err, used.Seconds())
+	objectReqsHistogram.WithLabelValues("DELETE").Observe(used.Seconds())
+	if err != nil {
+		objectReqErrors.Add(1)
+	}
+	return err
+}
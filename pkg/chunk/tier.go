@@ -0,0 +1,198 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// The slices can be written into other storages (tiers) than the primary one. The blocks of a slice in tier N
+// are addressed as "tiers/N/" + key, which is stored as key in the storage of the tier, and the tier of them is
+// recorded in TierIndex when the slice is finished. They are cached with the same key as the ones in the primary
+// storage. The slices in tiers are not packed, deduplicated or staged in writeback mode.
+
+const tierPrefix = "tiers/"
+
+func tierKey(tier uint8, key string) string {
+	return tierPrefix + strconv.Itoa(int(tier)) + "/" + key
+}
+
+// parseTierKey returns the tier of a key and the key in the storage of the tier.
+func parseTierKey(key string) (uint8, string) {
+	if !strings.HasPrefix(key, tierPrefix) {
+		return 0, key
+	}
+	p := strings.IndexByte(key[len(tierPrefix):], '/')
+	if p < 0 {
+		return 0, key
+	}
+	tier, err := strconv.ParseUint(key[len(tierPrefix):len(tierPrefix)+p], 10, 8)
+	if err != nil {
+		return 0, key
+	}
+	return uint8(tier), key[len(tierPrefix)+p+1:]
+}
+
+// tieredStorage sends the requests of tier keys to the storage of the tier.
+type tieredStorage struct {
+	object.ObjectStorage
+	sync.Mutex
+	open   func(tier uint8) (object.ObjectStorage, error)
+	stores map[uint8]object.ObjectStorage
+}
+
+func (s *tieredStorage) tier(key string) (object.ObjectStorage, string, error) {
+	tier, k := parseTierKey(key)
+	if tier == 0 {
+		return s.ObjectStorage, key, nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if store, ok := s.stores[tier]; ok {
+		return store, k, nil
+	}
+	store, err := s.open(tier)
+	if err != nil {
+		return nil, "", fmt.Errorf("open storage of tier %d: %s", tier, err)
+	}
+	s.stores[tier] = store
+	return store, k, nil
+}
+
+func (s *tieredStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	store, k, err := s.tier(key)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(k, off, limit)
+}
+
+func (s *tieredStorage) Put(key string, in io.Reader) error {
+	store, k, err := s.tier(key)
+	if err != nil {
+		return err
+	}
+	return store.Put(k, in)
+}
+
+func (s *tieredStorage) Delete(key string) error {
+	store, k, err := s.tier(key)
+	if err != nil {
+		return err
+	}
+	return store.Delete(k)
+}
+
+func (s *tieredStorage) Head(key string) (object.Object, error) {
+	store, k, err := s.tier(key)
+	if err != nil {
+		return nil, err
+	}
+	return store.Head(k)
+}
+
+// getTier returns the tier of the slice, which is looked up once.
+func (c *rChunk) getTier() uint8 {
+	if c.tierFound || c.store.tierIndex == nil {
+		return c.tier
+	}
+	tier, err := c.store.tierIndex.FindTier(c.id)
+	if err != nil {
+		logger.Warnf("find tier of slice %d: %s", c.id, err)
+		return 0
+	}
+	c.tier, c.tierFound = tier, true
+	return tier
+}
+
+func (c *wChunk) SetTier(tier uint8) {
+	if tier > 0 && c.store.tierIndex == nil {
+		logger.Warnf("tier %d is not available, write slice %d into the primary storage", tier, c.id)
+		tier = 0
+	}
+	c.tier, c.tierFound = tier, true
+}
+
+func (store *cachedStore) SliceTier(chunkid uint64) (uint8, error) {
+	if store.tierIndex == nil {
+		return 0, nil
+	}
+	return store.tierIndex.FindTier(chunkid)
+}
+
+// CopySlice copies the objects of a slice from one tier into another, the data is not decompressed.
+func (store *cachedStore) CopySlice(chunkid uint64, length int, from, to uint8) error {
+	r := chunkForRead(chunkid, length, store)
+	for _, key := range r.keys() {
+		src, dst := key, key
+		if from > 0 {
+			src = tierKey(from, key)
+		}
+		if to > 0 {
+			dst = tierKey(to, key)
+		}
+		in, err := store.storage.Get(src, 0, -1)
+		if err != nil {
+			return fmt.Errorf("get %s: %s", src, err)
+		}
+		data, err := ioutil.ReadAll(in)
+		_ = in.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %s", src, err)
+		}
+		if store.downLimit != nil {
+			store.downLimit.Wait(int64(len(data)))
+		}
+		objectDataBytes.WithLabelValues("GET").Add(float64(len(data)))
+		if err = store.put(dst, NewPage(data)); err != nil {
+			return fmt.Errorf("put %s: %s", dst, err)
+		}
+	}
+	return nil
+}
+
+// RemoveSlice deletes the objects of a slice in the tier, the cached blocks are kept.
+func (store *cachedStore) RemoveSlice(chunkid uint64, length int, tier uint8) error {
+	r := chunkForRead(chunkid, length, store)
+	var err error
+	for _, key := range r.keys() {
+		if tier > 0 {
+			key = tierKey(tier, key)
+		}
+		if e := store.delete(key); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// SetTiers sets the index of slices in tiers, and the function to open the storage of a tier.
+func (store *cachedStore) SetTiers(index TierIndex, open func(tier uint8) (object.ObjectStorage, error)) {
+	store.tierIndex = index
+	store.storage = &tieredStorage{
+		ObjectStorage: store.storage,
+		open:          open,
+		stores:        make(map[uint8]object.ObjectStorage),
+	}
+}
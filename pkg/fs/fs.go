@@ -31,6 +31,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
@@ -136,6 +137,8 @@ type FileSystem struct {
 	entries map[Ino]map[string]*entryCache
 	attrs   map[Ino]*attrCache
 
+	watchers meta.WatcherPool
+
 	logBuffer chan string
 }
 
@@ -552,6 +555,9 @@ func (fs *FileSystem) CopyFileRange(ctx meta.Context, src string, soff uint64, d
 		return
 	}
 	err = fs.m.CopyFileRange(ctx, sfi.inode, soff, dfi.inode, doff, size, 0, &written)
+	if err == syscall.ENOTSUP && fs.writer.Promote(ctx, sfi.inode) == 0 && fs.writer.Promote(ctx, dfi.inode) == 0 {
+		err = fs.m.CopyFileRange(ctx, sfi.inode, soff, dfi.inode, doff, size, 0, &written)
+	}
 	return
 }
 
@@ -619,6 +625,71 @@ func (fs *FileSystem) RemoveXattr(ctx meta.Context, p string, name string) (err
 	return
 }
 
+func (fs *FileSystem) SetFacl(ctx meta.Context, p string, aclType uint8, rule *acl.Rule) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.SetFacl").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { fs.log(l, "SetFacl (%s,%d,%+v): %s", p, aclType, rule, errstr(err)) }()
+	fi, err := fs.resolve(ctx, p, true)
+	if err != 0 {
+		return
+	}
+	err = fs.m.SetFacl(ctx, fi.inode, aclType, rule)
+	return
+}
+
+func (fs *FileSystem) GetFacl(ctx meta.Context, p string, aclType uint8, rule *acl.Rule) (err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.GetFacl").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { fs.log(l, "GetFacl (%s,%d): (%+v,%s)", p, aclType, rule, errstr(err)) }()
+	fi, err := fs.resolve(ctx, p, true)
+	if err != 0 {
+		return
+	}
+	err = fs.m.GetFacl(ctx, fi.inode, aclType, rule)
+	return
+}
+
+// LastChange returns the id of the latest change on the volume, which is the cursor to watch the changes from now on.
+func (fs *FileSystem) LastChange(ctx meta.Context) (uint64, syscall.Errno) {
+	id, err := fs.m.LastChange(ctx)
+	if err != nil {
+		logger.Warnf("get the last change: %s", err)
+		return 0, syscall.EIO
+	}
+	return id, 0
+}
+
+// Watch returns at most limit changes under the directory p after the cursor, it waits for at most timeout
+// if there is no change. The paths in the changes are absolute ones in the volume, and the cursor for the
+// next call is returned.
+func (fs *FileSystem) Watch(ctx meta.Context, p string, cursor uint64, limit int, timeout time.Duration) (changes []*meta.Change, next uint64, err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.Watch").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { fs.log(l, "Watch (%s,%d): (%d,%d,%s)", p, cursor, len(changes), next, errstr(err)) }()
+	fi, err := fs.resolve(ctx, p, true)
+	if err != 0 {
+		return nil, cursor, err
+	}
+	if !fi.IsDir() {
+		return nil, cursor, syscall.ENOTDIR
+	}
+	if err = fs.m.Access(ctx, fi.inode, mMaskR, fi.attr); err != 0 {
+		return nil, cursor, err
+	}
+	w := fs.watchers.Get(fs.m, fi.inode, cursor)
+	changes, err = w.Next(ctx, limit, timeout)
+	fs.watchers.Put(fi.inode, w)
+	for _, c := range changes {
+		if c.Path != "" {
+			c.Path = path.Join(p, c.Path)
+		}
+		if c.DstPath != "" {
+			c.DstPath = path.Join(p, c.DstPath)
+		}
+	}
+	return changes, w.Cursor(), err
+}
+
 func (fs *FileSystem) lookup(ctx meta.Context, parent Ino, name string, inode *Ino, attr *Attr) (err syscall.Errno) {
 	now := time.Now()
 	if fs.conf.DirEntryTimeout > 0 || fs.conf.EntryTimeout > 0 {
@@ -19,11 +19,14 @@ package fs
 import (
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/vfs"
@@ -177,12 +180,17 @@ func (h *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//
 	// Get, when applied to collection, will return the same as PROPFIND method.
 	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, h.Handler.Prefix) {
-		info, err := h.Handler.FileSystem.Stat(context.TODO(), strings.TrimPrefix(r.URL.Path, h.Handler.Prefix))
+		name := strings.TrimPrefix(r.URL.Path, h.Handler.Prefix)
+		info, err := h.Handler.FileSystem.Stat(context.TODO(), name)
 		if err == nil && info.IsDir() {
 			if h.disallowList {
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
+			if _, ok := r.URL.Query()["watch"]; ok {
+				h.serveWatch(w, r, name)
+				return
+			}
 			r.Method = "PROPFIND"
 			if r.Header.Get("Depth") == "" {
 				r.Header.Add("Depth", "1")
@@ -192,6 +200,72 @@ func (h *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.Handler.ServeHTTP(w, r)
 }
 
+type watchResult struct {
+	Cursor  uint64         `json:"cursor"`
+	Changes []*meta.Change `json:"changes"`
+}
+
+// serveWatch returns the changes under a directory after the cursor (or from now on if it's not specified),
+// the request is held until there are some changes or it times out:
+//
+//	GET /dir?watch&cursor=N&limit=N&timeout=30s
+func (h *indexHandler) serveWatch(w http.ResponseWriter, r *http.Request, name string) {
+	hfs := h.Handler.FileSystem.(*webdavFS)
+	q := r.URL.Query()
+	var cursor uint64
+	var err error
+	if v := q.Get("cursor"); v != "" {
+		if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid cursor: "+v, http.StatusBadRequest)
+			return
+		}
+	} else {
+		var eno syscall.Errno
+		if cursor, eno = hfs.fs.LastChange(hfs.ctx); eno != 0 {
+			http.Error(w, eno.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	limit := 1000
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	timeout := time.Second * 30
+	if v := q.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			http.Error(w, "invalid timeout: "+v, http.StatusBadRequest)
+			return
+		}
+		if timeout > time.Minute*5 {
+			timeout = time.Minute * 5
+		}
+	}
+	changes, next, eno := hfs.fs.Watch(hfs.ctx, name, cursor, limit, timeout)
+	switch eno {
+	case 0:
+	case syscall.ENOENT:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	case syscall.EACCES, syscall.EPERM:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	case syscall.ENOTSUP:
+		http.Error(w, "change log is not enabled", http.StatusNotImplemented)
+		return
+	default:
+		http.Error(w, eno.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = []*meta.Change{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&watchResult{next, changes})
+}
+
 func StartHTTPServer(fs *FileSystem, addr string, gzipEnabled bool, disallowList bool) {
 	ctx := meta.NewContext(uint32(os.Getpid()), uint32(os.Getuid()), []uint32{uint32(os.Getgid())})
 	hfs := &webdavFS{ctx, fs}
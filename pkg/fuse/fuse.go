@@ -413,6 +413,19 @@ func (fs *fileSystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fus
 	return 0
 }
 
+// kernelCache invalidates the caches in kernel by notifications, which are not supported before INIT.
+type kernelCache struct {
+	srv *fuse.Server
+}
+
+func (k *kernelCache) InvalidateEntry(parent Ino, name string) syscall.Errno {
+	return syscall.Errno(k.srv.EntryNotify(uint64(parent), name))
+}
+
+func (k *kernelCache) InvalidateInode(inode Ino, off, length int64) syscall.Errno {
+	return syscall.Errno(k.srv.InodeNotify(uint64(inode), off, length))
+}
+
 // Serve starts a server to serve requests from FUSE.
 func Serve(v *vfs.VFS, options string, xattrs bool) error {
 	if err := syscall.Setpriority(syscall.PRIO_PROCESS, os.Getpid(), -19); err != nil {
@@ -428,7 +441,9 @@ func Serve(v *vfs.VFS, options string, xattrs bool) error {
 	opt.SingleThreaded = false
 	opt.MaxBackground = 50
 	opt.EnableLocks = true
-	opt.DisableXAttrs = !xattrs
+	// ACLs are accessed by the kernel via xattr
+	opt.DisableXAttrs = !xattrs && !conf.Format.EnableACL
+	opt.EnableAcl = conf.Format.EnableACL
 	opt.IgnoreSecurityLabels = true
 	opt.MaxWrite = 1 << 20
 	opt.MaxReadAhead = 1 << 20
@@ -456,6 +471,7 @@ func Serve(v *vfs.VFS, options string, xattrs bool) error {
 	if err != nil {
 		return fmt.Errorf("fuse: %s", err)
 	}
+	v.SetKernelCache(&kernelCache{fssrv})
 
 	fssrv.Serve()
 	return nil
@@ -0,0 +1,169 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/acl"
+)
+
+// The owner, mask and other entries of an access ACL always follow the mode bits of the node,
+// so chmod only changes the mode, and the stored ones are overwritten when it's loaded.
+
+func aclFlag(aclType uint8) uint8 {
+	if aclType == acl.TypeDefault {
+		return FlagDefaultACL
+	}
+	return FlagAccessACL
+}
+
+func validACLType(aclType uint8) bool {
+	return aclType == acl.TypeAccess || aclType == acl.TypeDefault
+}
+
+// getFacl returns the ACL of a node with the given attributes.
+func (m *baseMeta) getFacl(ctx Context, inode Ino, aclType uint8, attr *Attr) (*acl.Rule, syscall.Errno) {
+	if attr.Flags&aclFlag(aclType) == 0 {
+		return nil, ENOATTR
+	}
+	rule, err := m.en.doGetFacl(ctx, inode, aclType)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if rule == nil {
+		return nil, ENOATTR
+	}
+	if aclType == acl.TypeAccess {
+		rule.SetMode(attr.Mode)
+	}
+	return rule, 0
+}
+
+func (m *baseMeta) GetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno {
+	if !validACLType(aclType) {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	r, st := m.getFacl(ctx, inode, aclType, &attr)
+	if st == 0 {
+		*rule = *r
+	}
+	return st
+}
+
+func (m *baseMeta) SetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno {
+	if !validACLType(aclType) || rule != nil && !rule.IsValid() {
+		return syscall.EINVAL
+	}
+	if m.conf.ReadOnly || isSnapshot(inode) {
+		return syscall.EROFS
+	}
+	if !m.fmt.EnableACL {
+		return syscall.ENOTSUP
+	}
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
+	st := m.en.doSetFacl(ctx, inode, aclType, rule)
+	if st == 0 {
+		m.recordAttrChange(ctx, ChangeSetAttr, inode)
+	}
+	return st
+}
+
+// prepareFacl checks the permission and updates the attributes of a node for its new ACL,
+// it returns the ACL to be stored, or nil if the stored one should be removed.
+func prepareFacl(ctx Context, attr *Attr, aclType uint8, rule *acl.Rule) (*acl.Rule, syscall.Errno) {
+	if attr.Typ == TypeSymlink {
+		return nil, syscall.ENOTSUP
+	}
+	if ctx.Uid() != 0 && ctx.Uid() != attr.Uid {
+		return nil, syscall.EPERM
+	}
+	if aclType == acl.TypeDefault {
+		if attr.Typ != TypeDirectory {
+			if rule != nil {
+				return nil, syscall.EACCES
+			}
+			return nil, 0
+		}
+	} else if rule != nil {
+		attr.Mode = attr.Mode&07000 | rule.GetMode()
+		if ctx.Uid() != 0 && !inGroup(ctx, attr.Gid) {
+			attr.Mode &= 05777 // same as chmod
+		}
+		if rule.IsMinimal() {
+			rule = nil
+		}
+	}
+	if rule != nil {
+		attr.Flags |= aclFlag(aclType)
+	} else {
+		attr.Flags &^= aclFlag(aclType)
+	}
+	now := time.Now()
+	attr.Ctime = now.Unix()
+	attr.Ctimensec = uint32(now.Nanosecond())
+	return rule, 0
+}
+
+// inheritFacl returns the mode, flags and ACLs (nil if not needed) of a new node created with mode
+// under a directory whose default ACL is def, the umask is not applied in this case.
+func inheritFacl(def *acl.Rule, _type uint8, mode uint16) (uint16, uint8, *acl.Rule, *acl.Rule) {
+	var flags uint8
+	access := def.ChildRule(mode)
+	mode = mode&07000 | access.GetMode()
+	if access.IsMinimal() {
+		access = nil
+	} else {
+		flags |= FlagAccessACL
+	}
+	var dflt *acl.Rule
+	if _type == TypeDirectory {
+		dflt = def
+		flags |= FlagDefaultACL
+	}
+	return mode, flags, access, dflt
+}
+
+func inGroup(ctx Context, gid uint32) bool {
+	for _, g := range ctx.Gids() {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFacl returns the flags of a node loaded from the dumped entry.
+func loadFacl(e *DumpedEntry) uint8 {
+	var flags uint8
+	if e.AccessACL != nil {
+		flags |= FlagAccessACL
+	}
+	if e.DefaultACL != nil {
+		flags |= FlagDefaultACL
+	}
+	return flags
+}
@@ -0,0 +1,135 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"time"
+)
+
+// The access time of files and directories is updated by Read and Readdir according to Config.AtimeMode.
+// The updates are buffered in memory and flushed in batches every second, so a node is written at most once
+// per second no matter how many times it's read, and the older access time never overwrites a newer one.
+// With relatime, the access time is only updated if it's not later than mtime or ctime, or it's older
+// than one day, like Linux does, so reading a file again and again updates it once a day at most.
+
+const (
+	NoAtime     = "noatime"     // never update the access time
+	RelAtime    = "relatime"    // update the access time if it's earlier than mtime/ctime, or older than one day
+	StrictAtime = "strictatime" // always update the access time
+
+	relAtimeInterval = time.Hour * 24
+	atimeBatch       = 100 // the max number of nodes updated in a transaction
+)
+
+// ValidAtimeMode returns an error if the mode is not supported.
+func ValidAtimeMode(mode string) error {
+	switch mode {
+	case "", NoAtime, RelAtime, StrictAtime:
+		return nil
+	default:
+		return fmt.Errorf("invalid atime mode %q, should be one of %s, %s and %s", mode, NoAtime, RelAtime, StrictAtime)
+	}
+}
+
+func unixNano(sec int64, nsec uint32) int64 {
+	return sec*1e9 + int64(nsec)
+}
+
+// atimeNeedsUpdate returns true if the access time should be updated with relatime.
+func atimeNeedsUpdate(attr *Attr, now time.Time) bool {
+	atime := unixNano(attr.Atime, attr.Atimensec)
+	return atime <= unixNano(attr.Mtime, attr.Mtimensec) || atime <= unixNano(attr.Ctime, attr.Ctimensec) ||
+		now.UnixNano()-atime >= int64(relAtimeInterval)
+}
+
+// touchAtime updates the access time of a node which is read, attr is the current attributes of it if known.
+func (m *baseMeta) touchAtime(ctx Context, inode Ino, attr *Attr) {
+	mode := m.conf.AtimeMode
+	if mode == "" || mode == NoAtime || m.conf.ReadOnly || isSnapshot(inode) || inode == SnapshotInode {
+		return
+	}
+	now := time.Now()
+	m.atimeMu.Lock()
+	if _, ok := m.atimes[inode]; ok {
+		if mode == StrictAtime {
+			m.atimes[inode] = now.UnixNano()
+		}
+		m.atimeMu.Unlock()
+		return
+	}
+	m.atimeMu.Unlock()
+
+	if mode == RelAtime {
+		var a Attr
+		if attr == nil {
+			if !m.of.Cached(inode, &a) {
+				if st := m.en.doGetAttr(ctx, inode, &a); st != 0 {
+					return
+				}
+			}
+			attr = &a
+		}
+		if !atimeNeedsUpdate(attr, now) {
+			return
+		}
+	}
+	m.atimeMu.Lock()
+	if len(m.atimes) < maxPending {
+		m.atimes[inode] = now.UnixNano()
+	}
+	m.atimeMu.Unlock()
+	m.of.UpdateAtime(inode, now)
+}
+
+func (m *baseMeta) flushAtimes() {
+	for {
+		time.Sleep(time.Second)
+		m.syncAtimes()
+	}
+}
+
+// syncAtimes writes the buffered access time into the meta engine.
+func (m *baseMeta) syncAtimes() {
+	m.atimeMu.Lock()
+	atimes := m.atimes
+	m.atimes = make(map[Ino]int64)
+	m.atimeMu.Unlock()
+	batch := make(map[Ino]int64)
+	flush := func() {
+		if err := m.en.doFlushAtimes(batch); err != nil {
+			logger.Warnf("update atime of %d nodes: %s", len(batch), err)
+			m.atimeMu.Lock()
+			for inode, ts := range batch {
+				if cur, ok := m.atimes[inode]; !ok || cur < ts {
+					m.atimes[inode] = ts
+				}
+			}
+			m.atimeMu.Unlock()
+		}
+		batch = make(map[Ino]int64)
+	}
+	for inode, ts := range atimes {
+		batch[inode] = ts
+		if len(batch) >= atimeBatch {
+			flush()
+		}
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+}
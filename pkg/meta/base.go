@@ -27,6 +27,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -56,6 +57,43 @@ type engine interface {
 	doCleanupSlices()
 	doDeleteSlice(chunkid uint64, size uint32) error
 
+	// Record a pack and the slices in it.
+	doAddPack(pack *Pack, slices []PackedSlice) error
+	// Get the location of a packed slice, ENOENT if it's not packed.
+	doGetPacked(chunkid uint64, s *PackedSlice) syscall.Errno
+	// Remove a packed slice and its reference, ENOENT if it's not packed. It returns the id of the pack
+	// if nothing in it is alive, which is removed too.
+	doDeletePacked(chunkid uint64, size uint32) (uint64, error)
+	doListPacks() ([]*Pack, error)
+	// Iterate all the packed slices.
+	doListPacked(fn func(s *PackedSlice)) error
+	// Move the slices which are still in the old pack into the new one (if any), update the live bytes of the
+	// new pack and record it if it's not empty, then remove the old pack.
+	doRepack(old uint64, pack *Pack, slices []PackedSlice) error
+
+	// Add a reference to the shared block with the hash, ENOENT if there is none.
+	doRefBlock(hash []byte, b *Block, owner *Block) syscall.Errno
+	// Record a block as the shared one of the hash with a reference from itself, EEXIST if there is one.
+	doAddBlock(hash []byte, b *Block) syscall.Errno
+	// Get the shared block used by a block of slice, ENOENT if it's not shared.
+	doFindBlock(chunkid uint64, indx uint32, owner *Block) syscall.Errno
+	// Remove the references from the blocks of a slice and the reference of the slice, it returns the blocks
+	// to be deleted, which are the ones not shared or the shared ones without any reference.
+	doDerefSlice(chunkid uint64, size uint32, blocks []Block) ([]Block, error)
+	// Iterate all the shared blocks with the number of references.
+	doListDedup(fn func(hash []byte, owner *Block, refs uint32)) error
+	// Iterate all the references to the shared blocks.
+	doListBlockRefs(fn func(b *Block, hash []byte)) error
+	// Record a shared block with the references to it.
+	doSetDedup(hash []byte, owner *Block, refs []Block) error
+
+	// Record the tier of a slice, or remove the record if tier is 0.
+	doSetSliceTier(chunkid uint64, tier uint8) error
+	// Get the tier of a slice, 0 if it's not recorded.
+	doGetSliceTier(chunkid uint64) (uint8, error)
+	// Iterate all the slices not in the primary storage.
+	doListSliceTiers(fn func(chunkid uint64, tier uint8)) error
+
 	doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno
 	doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno
@@ -65,8 +103,71 @@ type engine interface {
 	doReadlink(ctx Context, inode Ino) ([]byte, error)
 	doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno
 	doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno
+	// Clone a single node (without its children) as name under parent with inode ino, sharing the slices of
+	// the source, attr is filled with the attributes of the new node.
+	doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string, ino Ino, attr *Attr, cmode uint8, cumask uint16) syscall.Errno
+	// Create the root node of all snapshots if it does not exist.
+	doInitSnapshotRoot() error
 	doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
 	doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	// Get the access or default ACL of an inode, nil if not set.
+	doGetFacl(ctx Context, inode Ino, aclType uint8) (*acl.Rule, error)
+	// Set the ACL of an inode and update its attributes, the ACL is removed if rule is nil.
+	doSetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno
+
+	// Get the quota of a directory (inode), user (uid) or group (gid), nil if not set.
+	doGetQuota(qtype uint8, key uint64) (*Quota, error)
+	// Set the limits of a quota, and its usage if usage is true.
+	doSetQuota(qtype uint8, key uint64, quota *Quota, usage bool) error
+	doDelQuota(qtype uint8, key uint64) error
+	doLoadQuotas(qtype uint8) (map[uint64]*Quota, error)
+	// Increase the usage by newSpace and newInodes of the quotas.
+	doFlushQuotas(qtype uint8, quotas map[uint64]*Quota) error
+
+	// Get the statistics of a directory, nil if it's not maintained.
+	doGetDirStat(inode Ino) (*dirStat, error)
+	// Overwrite the statistics of directories.
+	doSetDirStats(stats map[Ino]*dirStat) error
+	// Add the changes to the statistics of directories, the ones not maintained are skipped.
+	doFlushDirStats(stats map[Ino]*dirStat) error
+
+	// Check that the volume is empty, or return the number of entries loaded before if it was interrupted.
+	doLoadStart() (uint64, error)
+	// Write a batch of loaded entries, the edges and slice references of them, and the checkpoint.
+	doLoadEntries(batch *loadBatch) error
+	// Write the setting and counters, fix the nlink of hard links and remove the checkpoint.
+	doLoadFinish(dm *DumpedMeta, cs *DumpedCounters, nlinks map[Ino]uint32) error
+
+	// Append the changes into the change log, the ids of them are allocated from the counter nextChange.
+	doAppendChanges(changes []*Change) error
+	// Read the changes with id in (from, from+limit].
+	doReadChanges(from uint64, limit int) ([]*Change, error)
+	// Remove the changes with id in (from, to], and set the counter trimmedChange to to.
+	doDeleteChanges(from, to uint64) error
+
+	// Publish a message of invalidations to all the clients.
+	doPublishInvalidations(msg []byte) error
+	// Call handler with the messages published after it's called, until it fails or the cache invalidation is disabled.
+	doSubscribeInvalidations(handler func(msg []byte)) error
+
+	// Scan all the nodes, entries, chunks and references of slices.
+	doScanMeta(v *metaVisitor) error
+	// Add or overwrite an entry, or remove it if inode is 0, the nodes are not touched.
+	doSetEntry(parent Ino, name string, inode Ino, typ uint8) error
+	// Set the nlink of a node, and its parent if parent is not 0.
+	doSetNlink(inode Ino, nlink uint32, parent Ino) error
+	// Append a slice into a chunk, the references of it are not touched.
+	doAppendSlice(inode Ino, indx uint32, buf []byte) error
+	// Set the number of references of a slice, the data of it will be removed if refs is 0.
+	doSetSliceRefs(chunkid uint64, size uint32, refs int64) error
+
+	// doSetTrashPath records the original parent and path of an entry in trash, the record is removed if path is empty.
+	doSetTrashPath(inode Ino, parent Ino, path string) error
+	// doGetTrashPath returns the recorded parent and path of an entry in trash, or an empty path if it's not recorded.
+	doGetTrashPath(inode Ino) (Ino, string, error)
+
+	// doFlushAtimes updates the access time (in nanoseconds) of nodes, if it's later than the current one.
+	doFlushAtimes(atimes map[Ino]int64) error
 }
 
 type baseMeta struct {
@@ -89,9 +190,36 @@ type baseMeta struct {
 	usedInodes   int64
 	umounting    bool
 
-	freeMu     sync.Mutex
-	freeInodes freeID
-	freeChunks freeID
+	freeMu        sync.Mutex
+	freeInodes    freeID
+	freeChunks    freeID
+	freeSnapshots freeID
+
+	quotaMu     sync.RWMutex
+	dirQuotas   map[uint64]*Quota
+	dirParents  map[Ino]Ino
+	userQuotas  map[uint64]*Quota
+	groupQuotas map[uint64]*Quota
+
+	dirStatsMu sync.Mutex
+	dirStats   map[Ino]*dirStat // changes not flushed yet
+	flushMu    sync.Mutex       // held while flushing the changes of statistics
+
+	changesMu   sync.Mutex
+	changes     []*Change    // changes not appended into the change log yet
+	writing     map[Ino]bool // files with a pending write change
+	appendingMu sync.Mutex   // held while appending the changes, to keep them in order
+
+	invalMu       sync.Mutex
+	invalidations []*Change    // changes not published yet
+	invalWriting  map[Ino]bool // files with a pending write invalidation
+	invalReady    chan struct{}
+
+	dirPathsMu sync.Mutex
+	dirPaths   map[Ino]*cachedDir // the parents and names of directories, to record the paths of entries in trash
+
+	atimeMu sync.Mutex
+	atimes  map[Ino]int64 // access time (in nanoseconds) not flushed yet
 
 	en engine
 }
@@ -111,6 +239,16 @@ func newBaseMeta(conf *Config) baseMeta {
 		msgCallbacks: &msgCallbacks{
 			callbacks: make(map[uint32]MsgCallback),
 		},
+		dirQuotas:    make(map[uint64]*Quota),
+		dirParents:   make(map[Ino]Ino),
+		userQuotas:   make(map[uint64]*Quota),
+		groupQuotas:  make(map[uint64]*Quota),
+		dirStats:     make(map[Ino]*dirStat),
+		writing:      make(map[Ino]bool),
+		invalWriting: make(map[Ino]bool),
+		invalReady:   make(chan struct{}, 1),
+		dirPaths:     make(map[Ino]*cachedDir),
+		atimes:       make(map[Ino]int64),
 	}
 }
 
@@ -152,6 +290,9 @@ func (m *baseMeta) Load(checkVersion bool) (*Format, error) {
 	if err = json.Unmarshal(body, &m.fmt); err != nil {
 		return nil, fmt.Errorf("json: %s", err)
 	}
+	var tiers struct{ Tiers []Tier }
+	_ = json.Unmarshal(body, &tiers)
+	m.fmt.Tiers = tiers.Tiers // the tiers could be removed
 	if checkVersion {
 		if err = m.fmt.CheckVersion(); err != nil {
 			return nil, fmt.Errorf("check version: %s", err)
@@ -162,6 +303,8 @@ func (m *baseMeta) Load(checkVersion bool) (*Format, error) {
 
 func (m *baseMeta) NewSession() error {
 	go m.refreshUsage()
+	go m.refreshQuotas()
+	go m.subscribeInvalidations()
 	if m.conf.ReadOnly {
 		return nil
 	}
@@ -183,10 +326,17 @@ func (m *baseMeta) NewSession() error {
 	logger.Infof("create session %d OK", m.sid)
 
 	go m.refreshSession()
+	go m.flushQuotas()
+	go m.flushDirStats()
+	go m.flushAtimes()
+	go m.flushChanges()
+	go m.publishInvalidations()
 	if !m.conf.NoBGJob {
 		go m.cleanupDeletedFiles()
 		go m.cleanupSlices()
 		go m.cleanupTrash()
+		go m.cleanupChanges()
+		go m.compactPacks()
 	}
 	return nil
 }
@@ -233,6 +383,8 @@ func (m *baseMeta) CloseSession() error {
 	m.Lock()
 	m.umounting = true
 	m.Unlock()
+	m.syncAtimes()
+	m.syncChanges()
 	logger.Infof("close session %d: %s", m.sid, m.en.doCleanStaleSession(m.sid))
 	return nil
 }
@@ -253,13 +405,6 @@ func (m *baseMeta) refreshUsage() {
 	}
 }
 
-func (m *baseMeta) checkQuota(size, inodes int64) bool {
-	if size > 0 && m.fmt.Capacity > 0 && atomic.LoadInt64(&m.usedSpace)+atomic.LoadInt64(&m.newSpace)+size > int64(m.fmt.Capacity) {
-		return true
-	}
-	return inodes > 0 && m.fmt.Inodes > 0 && atomic.LoadInt64(&m.usedInodes)+atomic.LoadInt64(&m.newInodes)+inodes > int64(m.fmt.Inodes)
-}
-
 func (m *baseMeta) updateStats(space int64, inodes int64) {
 	atomic.AddInt64(&m.newSpace, space)
 	atomic.AddInt64(&m.newInodes, inodes)
@@ -267,6 +412,7 @@ func (m *baseMeta) updateStats(space int64, inodes int64) {
 
 func (m *baseMeta) flushStats() {
 	for {
+		m.flushMu.Lock()
 		newSpace := atomic.SwapInt64(&m.newSpace, 0)
 		if newSpace != 0 {
 			if _, err := m.en.incrCounter(usedSpace, newSpace); err != nil {
@@ -281,6 +427,7 @@ func (m *baseMeta) flushStats() {
 				m.updateStats(0, newInodes)
 			}
 		}
+		m.flushMu.Unlock()
 		time.Sleep(time.Second)
 	}
 }
@@ -366,6 +513,9 @@ func (m *baseMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *ui
 			*iavail *= 2
 		}
 	}
+	if m.root != 1 {
+		m.statRootQuota(totalspace, availspace, iused, iavail)
+	}
 	return 0
 }
 
@@ -418,6 +568,13 @@ func (m *baseMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr
 		*inode = TrashInode
 		return 0
 	}
+	if parent == 1 && name == SnapshotName {
+		if st := m.GetAttr(ctx, SnapshotInode, attr); st != 0 {
+			return st
+		}
+		*inode = SnapshotInode
+		return 0
+	}
 	st := m.en.doLookup(ctx, parent, name, inode, attr)
 	if st == syscall.ENOENT && m.conf.CaseInsensi {
 		if e := m.resolveCase(ctx, parent, name); e != nil {
@@ -520,6 +677,18 @@ func (m *baseMeta) Access(ctx Context, inode Ino, mmask uint8, attr *Attr) sysca
 			return err
 		}
 	}
+	if attr.Flags&FlagAccessACL != 0 {
+		rule, st := m.getFacl(ctx, m.checkRoot(inode), acl.TypeAccess, attr)
+		if st == 0 {
+			if !rule.CanAccess(ctx.Uid(), ctx.Gids(), attr.Uid, attr.Gid, mmask) {
+				logger.Debugf("Access inode %d %o, ACL %+v, request mode %o", inode, attr.Mode, rule, mmask)
+				return syscall.EACCES
+			}
+			return 0
+		} else if st != ENOATTR {
+			return st
+		}
+	}
 	mode := accessMode(attr, ctx.Uid(), ctx.Gids())
 	if mode&mmask != mmask {
 		logger.Debugf("Access inode %d %o, mode %o, request mode %o", inode, attr.Mode, mode, mmask)
@@ -576,22 +745,53 @@ func (m *baseMeta) nextInode() (Ino, error) {
 	return Ino(n), nil
 }
 
+// nextSnapshotInode allocates an inode for the nodes in snapshots.
+func (m *baseMeta) nextSnapshotInode() (Ino, error) {
+	m.freeMu.Lock()
+	defer m.freeMu.Unlock()
+	if m.freeSnapshots.next >= m.freeSnapshots.maxid {
+		v, err := m.en.incrCounter("nextSnapshot", inodeBatch)
+		if err != nil {
+			return 0, err
+		}
+		m.freeSnapshots.next = uint64(v) - inodeBatch
+		m.freeSnapshots.maxid = uint64(v)
+	}
+	n := m.freeSnapshots.next
+	m.freeSnapshots.next++
+	return snapshotInodeBase + Ino(n), nil
+}
+
 func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
 	if isTrash(parent) {
 		return syscall.EPERM
 	}
-	if parent == 1 && name == TrashName {
+	if parent == 1 && (name == TrashName || name == SnapshotName) {
 		return syscall.EPERM
 	}
-	if m.conf.ReadOnly {
+	if m.conf.ReadOnly || isSnapshot(parent) {
 		return syscall.EROFS
 	}
 
 	defer timeit(time.Now())
-	if m.checkQuota(4<<10, 1) {
-		return syscall.ENOSPC
+	parent = m.checkRoot(parent)
+	if st := m.checkQuota(ctx, 4<<10, 1, ctx.Uid(), ctx.Gid(), parent); st != 0 {
+		return st
+	}
+	if inode == nil {
+		inode = new(Ino)
+	}
+	if attr == nil {
+		attr = &Attr{}
 	}
-	return m.en.doMknod(ctx, m.checkRoot(parent), name, _type, mode, cumask, rdev, path, inode, attr)
+	st := m.en.doMknod(ctx, parent, name, _type, mode, cumask, rdev, path, inode, attr)
+	if st == 0 {
+		m.updateDirQuota(ctx, parent, align4K(0), 1)
+		m.updateOwnerQuota(attr.Uid, attr.Gid, align4K(0), 1)
+		m.addDirStat(ctx, parent, nodeStat(attr))
+		m.recordChange(&Change{Op: createOp(_type), Inode: *inode, Parent: parent, Name: name})
+	}
+	return st
 }
 
 func (m *baseMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
@@ -620,17 +820,26 @@ func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr)
 	if isTrash(parent) {
 		return syscall.EPERM
 	}
-	if parent == 1 && name == TrashName {
+	if parent == 1 && (name == TrashName || name == SnapshotName) {
 		return syscall.EPERM
 	}
-	if m.conf.ReadOnly {
+	if m.conf.ReadOnly || isSnapshot(parent) || isSnapshot(inode) {
 		return syscall.EROFS
 	}
 
 	defer timeit(time.Now())
 	parent = m.checkRoot(parent)
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return m.en.doLink(ctx, inode, parent, name, attr)
+	if attr == nil {
+		attr = &Attr{}
+	}
+	st := m.en.doLink(ctx, inode, parent, name, attr)
+	if st == 0 {
+		m.updateDirQuota(ctx, parent, align4K(attr.Length), 1)
+		m.addDirStat(ctx, parent, nodeStat(attr))
+		m.recordChange(&Change{Op: ChangeLink, Inode: inode, Parent: parent, Name: name})
+	}
+	return st
 }
 
 func (m *baseMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
@@ -652,15 +861,27 @@ func (m *baseMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno
 }
 
 func (m *baseMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
-	if parent == 1 && name == TrashName || isTrash(parent) && ctx.Uid() != 0 {
+	if parent == 1 && (name == TrashName || name == SnapshotName) || isTrash(parent) && ctx.Uid() != 0 {
 		return syscall.EPERM
 	}
-	if m.conf.ReadOnly {
+	if m.conf.ReadOnly || isSnapshot(parent) {
 		return syscall.EROFS
 	}
 
 	defer timeit(time.Now())
-	return m.en.doUnlink(ctx, m.checkRoot(parent), name)
+	parent = m.checkRoot(parent)
+	var inode Ino
+	if m.changelogEnabled() || m.toTrash(parent) {
+		_ = m.en.doLookup(ctx, parent, name, &inode, &Attr{})
+	}
+	st := m.en.doUnlink(ctx, parent, name)
+	if st == 0 {
+		m.recordChange(&Change{Op: ChangeUnlink, Inode: inode, Parent: parent, Name: name})
+		if inode > 0 && m.toTrash(parent) {
+			m.recordTrash(ctx, parent, name, inode)
+		}
+	}
+	return st
 }
 
 func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
@@ -670,25 +891,49 @@ func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	if name == ".." {
 		return syscall.ENOTEMPTY
 	}
-	if parent == 1 && name == TrashName || parent == TrashInode || isTrash(parent) && ctx.Uid() != 0 {
+	if parent == 1 && (name == TrashName || name == SnapshotName) || parent == TrashInode || isTrash(parent) && ctx.Uid() != 0 {
 		return syscall.EPERM
 	}
-	if m.conf.ReadOnly {
+	if m.conf.ReadOnly || isSnapshot(parent) {
 		return syscall.EROFS
 	}
 
 	defer timeit(time.Now())
-	return m.en.doRmdir(ctx, m.checkRoot(parent), name)
+	parent = m.checkRoot(parent)
+	var inode Ino
+	var attr Attr
+	if m.hasQuotas(DirQuota) || m.hasOwnerQuotas() || m.changelogEnabled() || m.toTrash(parent) {
+		_ = m.en.doLookup(ctx, parent, name, &inode, &attr)
+	}
+	st := m.en.doRmdir(ctx, parent, name)
+	if st == 0 {
+		m.recordChange(&Change{Op: ChangeRmdir, Inode: inode, Parent: parent, Name: name})
+		m.forgetDir(inode)
+		if inode > 0 && m.toTrash(parent) {
+			m.recordTrash(ctx, parent, name, inode)
+		}
+		m.updateDirQuota(ctx, parent, -align4K(0), -1)
+		m.updateDirStat(ctx, parent, 0, -align4K(0), 0, -1)
+		if inode > 0 && !m.toTrash(parent) {
+			m.updateOwnerQuota(attr.Uid, attr.Gid, -align4K(0), -1)
+		}
+		if inode > 0 && m.getQuota(DirQuota, uint64(inode)) != nil {
+			if err := m.en.doDelQuota(DirQuota, uint64(inode)); err != nil {
+				logger.Warnf("remove quota of directory %d: %s", inode, err)
+			}
+		}
+	}
+	return st
 }
 
-func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
-	if parentSrc == 1 && nameSrc == TrashName || parentDst == 1 && nameDst == TrashName {
+func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) (st syscall.Errno) {
+	if parentSrc == 1 && (nameSrc == TrashName || nameSrc == SnapshotName) || parentDst == 1 && (nameDst == TrashName || nameDst == SnapshotName) {
 		return syscall.EPERM
 	}
 	if isTrash(parentDst) || isTrash(parentSrc) && ctx.Uid() != 0 {
 		return syscall.EPERM
 	}
-	if m.conf.ReadOnly {
+	if m.conf.ReadOnly || isSnapshot(parentSrc) || isSnapshot(parentDst) {
 		return syscall.EROFS
 	}
 	switch flags {
@@ -700,11 +945,110 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	}
 
 	defer timeit(time.Now())
-	return m.en.doRename(ctx, m.checkRoot(parentSrc), nameSrc, m.checkRoot(parentDst), nameDst, flags, inode, attr)
+	parentSrc, parentDst = m.checkRoot(parentSrc), m.checkRoot(parentDst)
+	if inode == nil {
+		inode = new(Ino)
+	}
+	if attr == nil {
+		attr = new(Attr)
+	}
+	var sino, dino Ino
+	var sattr, dattr Attr
+	if parentSrc != parentDst {
+		_ = m.en.doLookup(ctx, parentSrc, nameSrc, &sino, &sattr)
+	}
+	if flags != RenameNoReplace && (parentSrc != parentDst || nameSrc != nameDst) {
+		_ = m.en.doLookup(ctx, parentDst, nameDst, &dino, &dattr)
+	}
+	defer func() {
+		if st != 0 {
+			return
+		}
+		m.recordChange(&Change{Op: ChangeRename, Inode: *inode, Parent: parentSrc, Name: nameSrc, DstParent: parentDst, DstName: nameDst})
+		if flags == RenameExchange && dino > 0 {
+			m.recordChange(&Change{Op: ChangeRename, Inode: dino, Parent: parentDst, Name: nameDst, DstParent: parentSrc, DstName: nameSrc})
+		}
+		if attr.Typ == TypeDirectory || dattr.Typ == TypeDirectory {
+			m.forgetDir(0) // the cached paths under it are changed
+		}
+		if dino > 0 && flags != RenameExchange && m.toTrash(parentDst) {
+			m.recordTrash(ctx, parentDst, nameDst, dino)
+		}
+		// the statistics of the entries are moved between the parents, and the cached parents of directories are updated
+		if sino > 0 {
+			m.moveEntryStat(ctx, sino, &sattr, parentSrc, parentDst)
+			if sattr.Typ == TypeDirectory {
+				m.quotaMu.Lock()
+				m.dirParents[sino] = parentDst
+				m.quotaMu.Unlock()
+			}
+		}
+		if dino == 0 {
+			return
+		}
+		if flags == RenameExchange {
+			m.moveEntryStat(ctx, dino, &dattr, parentDst, parentSrc)
+			if dattr.Typ == TypeDirectory && parentSrc != parentDst {
+				m.quotaMu.Lock()
+				m.dirParents[dino] = parentSrc
+				m.quotaMu.Unlock()
+			}
+		} else {
+			// the overwritten node is removed
+			m.addDirStat(ctx, parentDst, nodeStat(&dattr).neg())
+			if !m.toTrash(parentDst) && (dattr.Typ == TypeDirectory || dattr.Nlink <= 1) {
+				m.updateOwnerQuota(dattr.Uid, dattr.Gid, -align4K(dattr.Length), -1)
+			}
+		}
+	}()
+	quotaSrc, quotaDst := m.quotaDirs(ctx, parentSrc), m.quotaDirs(ctx, parentDst)
+	if len(quotaSrc) == 0 && len(quotaDst) == 0 {
+		return m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr)
+	}
+
+	// the usage of the entries should be moved between the directories with quota
+	var dstIno Ino
+	var dstAttr *Attr
+	var srcSpace, srcInodes, dstSpace, dstInodes int64
+	moved := !equalInodes(quotaSrc, quotaDst)
+	if moved {
+		if _, _, srcSpace, srcInodes, st = m.entryUsage(ctx, parentSrc, nameSrc); st != 0 {
+			return st
+		}
+	}
+	if dstIno, dstAttr, dstSpace, dstInodes, st = m.entryUsage(ctx, parentDst, nameDst); st != 0 && st != syscall.ENOENT {
+		return st
+	}
+	if moved {
+		if m.checkDirQuota(diffInodes(quotaDst, quotaSrc), srcSpace, srcInodes) {
+			return syscall.EDQUOT
+		}
+		if flags == RenameExchange && m.checkDirQuota(diffInodes(quotaSrc, quotaDst), dstSpace, dstInodes) {
+			return syscall.EDQUOT
+		}
+	}
+	if st = m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr); st != 0 {
+		return st
+	}
+	if moved {
+		m.updateDirQuota(ctx, parentSrc, -srcSpace, -srcInodes)
+		m.updateDirQuota(ctx, parentDst, srcSpace, srcInodes)
+	}
+	if dstIno > 0 {
+		if flags == RenameExchange {
+			if moved {
+				m.updateDirQuota(ctx, parentDst, -dstSpace, -dstInodes)
+				m.updateDirQuota(ctx, parentSrc, dstSpace, dstInodes)
+			}
+		} else if dstAttr.Typ == TypeDirectory || dstAttr.Nlink <= 1 {
+			m.updateDirQuota(ctx, parentDst, -dstSpace, -dstInodes)
+		}
+	}
+	return 0
 }
 
 func (m *baseMeta) Open(ctx Context, inode Ino, flags uint32, attr *Attr) syscall.Errno {
-	if m.conf.ReadOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+	if (m.conf.ReadOnly || isSnapshot(inode)) && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
 		return syscall.EROFS
 	}
 	if m.conf.OpenCache > 0 && m.of.OpenCheck(inode, attr) {
@@ -778,11 +1122,15 @@ func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 		Name:  []byte(".."),
 		Attr:  &Attr{Typ: TypeDirectory},
 	})
-	return m.en.doReaddir(ctx, inode, plus, entries)
+	st := m.en.doReaddir(ctx, inode, plus, entries)
+	if st == 0 {
+		m.touchAtime(ctx, inode, &attr)
+	}
+	return st
 }
 
 func (m *baseMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
-	if m.conf.ReadOnly {
+	if m.conf.ReadOnly || isSnapshot(inode) {
 		return syscall.EROFS
 	}
 	if name == "" {
@@ -790,11 +1138,16 @@ func (m *baseMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, f
 	}
 
 	defer timeit(time.Now())
-	return m.en.doSetXattr(ctx, m.checkRoot(inode), name, value, flags)
+	inode = m.checkRoot(inode)
+	st := m.en.doSetXattr(ctx, inode, name, value, flags)
+	if st == 0 {
+		m.recordAttrChange(ctx, ChangeSetXattr, inode)
+	}
+	return st
 }
 
 func (m *baseMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
-	if m.conf.ReadOnly {
+	if m.conf.ReadOnly || isSnapshot(inode) {
 		return syscall.EROFS
 	}
 	if name == "" {
@@ -802,7 +1155,12 @@ func (m *baseMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errn
 	}
 
 	defer timeit(time.Now())
-	return m.en.doRemoveXattr(ctx, m.checkRoot(inode), name)
+	inode = m.checkRoot(inode)
+	st := m.en.doRemoveXattr(ctx, inode, name)
+	if st == 0 {
+		m.recordAttrChange(ctx, ChangeRemoveXattr, inode)
+	}
+	return st
 }
 
 func (m *baseMeta) fileDeleted(opened bool, inode Ino, length uint64) {
@@ -821,6 +1179,13 @@ func (m *baseMeta) deleteSlice(chunkid uint64, size uint32) {
 	}
 	m.deleting <- 1
 	defer func() { <-m.deleting }()
+	if m.deletePacked(chunkid, size) {
+		return
+	}
+	if m.fmt.Dedup {
+		m.deleteDedup(chunkid, size)
+		return
+	}
 	err := m.newMsg(DeleteChunk, chunkid, size)
 	if err != nil {
 		logger.Warnf("delete chunk %d (%d bytes): %s", chunkid, size, err)
@@ -828,19 +1193,21 @@ func (m *baseMeta) deleteSlice(chunkid uint64, size uint32) {
 		err := m.en.doDeleteSlice(chunkid, size)
 		if err != nil {
 			logger.Errorf("delete slice %d: %s", chunkid, err)
+		} else {
+			m.deleteSliceTier(chunkid)
 		}
 	}
 }
 
 func (m *baseMeta) toTrash(parent Ino) bool {
-	return m.fmt.TrashDays > 0 && !isTrash(parent)
+	return m.fmt.TrashDays > 0 && !isTrash(parent) && !isSnapshot(parent)
 }
 
 func (m *baseMeta) checkTrash(parent Ino, trash *Ino) syscall.Errno {
 	if !m.toTrash(parent) {
 		return 0
 	}
-	name := time.Now().UTC().Format("2006-01-02-15")
+	name := time.Now().UTC().Format(trashHourFormat)
 	m.Lock()
 	defer m.Unlock()
 	if name == m.subTrash.name {
@@ -905,26 +1272,35 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 
 	edge := now.Add(-time.Duration(24*m.fmt.TrashDays+1) * time.Hour)
 	for _, e := range entries {
-		ts, err := time.Parse("2006-01-02-15", string(e.Name))
+		ts, err := time.Parse(trashHourFormat, string(e.Name))
 		if err != nil {
 			logger.Warnf("bad entry as a subTrash: %s", e.Name)
 			continue
 		}
 		if ts.Before(edge) || force {
+			var plus uint8
+			if m.hasOwnerQuotas() {
+				plus = 1 // the owners of directories are needed
+			}
 			var subEntries []*Entry
-			if st = m.en.doReaddir(ctx, e.Inode, 0, &subEntries); st != 0 {
+			if st = m.en.doReaddir(ctx, e.Inode, plus, &subEntries); st != 0 {
 				logger.Warnf("readdir subTrash %d: %s", e.Inode, st)
 				continue
 			}
 			rmdir := true
 			for _, se := range subEntries {
 				if se.Attr.Typ == TypeDirectory {
-					st = m.en.doRmdir(ctx, e.Inode, string(se.Name))
+					if st = m.en.doRmdir(ctx, e.Inode, string(se.Name)); st == 0 {
+						m.updateOwnerQuota(se.Attr.Uid, se.Attr.Gid, -align4K(0), -1)
+					}
 				} else {
 					st = m.en.doUnlink(ctx, e.Inode, string(se.Name))
 				}
 				if st == 0 {
 					count++
+					if err = m.en.doSetTrashPath(se.Inode, 0, ""); err != nil {
+						logger.Warnf("remove the path of %d: %s", se.Inode, err)
+					}
 				} else {
 					logger.Warnf("delete from trash %s/%s: %s", e.Name, se.Name, st)
 					rmdir = false
@@ -937,6 +1313,12 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 			if rmdir {
 				if st = m.en.doRmdir(ctx, TrashInode, string(e.Name)); st != 0 {
 					logger.Warnf("rmdir subTrash %s: %s", e.Name, st)
+				} else {
+					m.Lock()
+					if m.subTrash.inode == e.Inode {
+						m.subTrash = internalNode{}
+					}
+					m.Unlock()
 				}
 			}
 		} else {
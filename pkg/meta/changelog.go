@@ -0,0 +1,467 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// The change log is an ordered list of the mutations on a volume, it's enabled by Format.ChangelogDays.
+// The changes are buffered in the client and appended in batches, each one gets an id from the counter
+// nextChange in the same transaction, so the ids are continuous and increasing in the order of commit.
+// A reader keeps the id of the last change it has seen as the cursor, and reads the ones after it.
+// The changes older than ChangelogDays are removed by the background job, and the largest id removed
+// is kept in the counter trimmedChange.
+
+const (
+	changeCounter  = "nextChange"
+	trimmedChanges = "trimmedChange"
+	changeBatch    = 1000   // the max number of changes read at a time
+	maxPending     = 100000 // the max number of changes buffered in the client
+)
+
+type ChangeOp uint8
+
+const (
+	ChangeCreate ChangeOp = iota + 1
+	ChangeMkdir
+	ChangeSymlink
+	ChangeLink
+	ChangeUnlink
+	ChangeRmdir
+	ChangeRename
+	ChangeWrite // the data of a file is written (committed), including fallocate and copy_file_range
+	ChangeTruncate
+	ChangeSetAttr
+	ChangeSetXattr
+	ChangeRemoveXattr
+)
+
+var changeOpNames = []string{"", "create", "mkdir", "symlink", "link", "unlink", "rmdir", "rename",
+	"write", "truncate", "setattr", "setxattr", "removexattr"}
+
+func (op ChangeOp) String() string {
+	if int(op) < len(changeOpNames) && op > 0 {
+		return changeOpNames[op]
+	}
+	return fmt.Sprintf("op-%d", op)
+}
+
+func (op ChangeOp) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+func (op *ChangeOp) UnmarshalText(text []byte) error {
+	for i, name := range changeOpNames {
+		if i > 0 && name == string(text) {
+			*op = ChangeOp(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown change %q", text)
+}
+
+// Change is a mutation of an entry, Parent and Name are the entry changed (the source of a rename),
+// the parent of a file with hard links is the one it was created in.
+type Change struct {
+	Id        uint64   `json:"id"`
+	Time      int64    `json:"time"` // in milliseconds
+	Op        ChangeOp `json:"op"`
+	Inode     Ino      `json:"inode"`
+	Parent    Ino      `json:"parent,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	DstParent Ino      `json:"dst_parent,omitempty"`
+	DstName   string   `json:"dst_name,omitempty"`
+	// resolved by Watcher, relative to the directory watched
+	Path    string `json:"path,omitempty"`
+	DstPath string `json:"dst_path,omitempty"`
+}
+
+func (c *Change) marshal() []byte {
+	w := utils.NewBuffer(uint32(45 + len(c.Name) + len(c.DstName)))
+	w.Put64(c.Id)
+	w.Put64(uint64(c.Time))
+	w.Put8(uint8(c.Op))
+	w.Put64(uint64(c.Inode))
+	w.Put64(uint64(c.Parent))
+	w.Put64(uint64(c.DstParent))
+	w.Put16(uint16(len(c.Name)))
+	w.Put([]byte(c.Name))
+	w.Put16(uint16(len(c.DstName)))
+	w.Put([]byte(c.DstName))
+	return w.Bytes()
+}
+
+func (c *Change) unmarshal(buf []byte) error {
+	if len(buf) < 45 {
+		return fmt.Errorf("invalid change: %v", buf)
+	}
+	rb := utils.ReadBuffer(buf)
+	c.Id = rb.Get64()
+	c.Time = int64(rb.Get64())
+	c.Op = ChangeOp(rb.Get8())
+	c.Inode = Ino(rb.Get64())
+	c.Parent = Ino(rb.Get64())
+	c.DstParent = Ino(rb.Get64())
+	c.Name = string(rb.Get(int(rb.Get16())))
+	c.DstName = string(rb.Get(int(rb.Get16())))
+	return nil
+}
+
+func (m *baseMeta) changelogEnabled() bool {
+	return m.fmt.ChangelogDays > 0
+}
+
+// recordChange buffers a change to be appended into the change log (the ones in trash or snapshots are
+// ignored) and published to other clients to invalidate their caches.
+func (m *baseMeta) recordChange(c *Change) {
+	c.Time = time.Now().UnixNano() / 1e6
+	if m.invalidationEnabled() {
+		ic := *c
+		m.publishInvalidation(&ic)
+	}
+	if !m.changelogEnabled() || isTrash(c.Parent) || isSnapshot(c.Inode) || c.Parent == SnapshotInode ||
+		isTrash(c.DstParent) {
+		return
+	}
+	m.changesMu.Lock()
+	defer m.changesMu.Unlock()
+	if c.Op == ChangeWrite {
+		if m.writing[c.Inode] {
+			return // merged into the previous one
+		}
+		m.writing[c.Inode] = true
+	} else {
+		delete(m.writing, c.Inode)
+	}
+	if len(m.changes) >= maxPending {
+		logger.Warnf("Too many changes are not flushed, drop change %+v", *c)
+		return
+	}
+	m.changes = append(m.changes, c)
+}
+
+func (m *baseMeta) flushChanges() {
+	for {
+		time.Sleep(time.Millisecond * 100)
+		m.syncChanges()
+	}
+}
+
+// syncChanges appends the buffered changes into the change log.
+func (m *baseMeta) syncChanges() {
+	m.appendingMu.Lock()
+	defer m.appendingMu.Unlock()
+	m.changesMu.Lock()
+	changes := m.changes
+	m.changes = nil
+	m.writing = make(map[Ino]bool)
+	m.changesMu.Unlock()
+	for len(changes) > 0 {
+		n := len(changes)
+		if n > changeBatch {
+			n = changeBatch
+		}
+		if err := m.en.doAppendChanges(changes[:n]); err != nil {
+			logger.Warnf("append %d changes: %s", len(changes), err)
+			m.changesMu.Lock()
+			m.changes = append(changes, m.changes...)
+			m.changesMu.Unlock()
+			return
+		}
+		changes = changes[n:]
+	}
+}
+
+// LastChange returns the id of the latest change in the change log, which is the cursor to watch the changes from now on.
+func (m *baseMeta) LastChange(ctx Context) (uint64, error) {
+	v, err := m.en.getCounter(changeCounter)
+	return uint64(v), err
+}
+
+// ReadChanges returns at most limit changes after the cursor in the order of their ids, the removed ones are skipped.
+func (m *baseMeta) ReadChanges(ctx Context, cursor uint64, limit int) ([]*Change, error) {
+	if limit <= 0 || limit > changeBatch {
+		limit = changeBatch
+	}
+	trimmed, err := m.en.getCounter(trimmedChanges)
+	if err != nil {
+		return nil, err
+	}
+	if cursor < uint64(trimmed) {
+		cursor = uint64(trimmed)
+	}
+	return m.en.doReadChanges(cursor, limit)
+}
+
+func (m *baseMeta) cleanupChanges() {
+	for {
+		utils.SleepWithJitter(time.Hour)
+		if ok, err := m.en.setIfSmall("lastCleanupChanges", time.Now().Unix(), int64(time.Hour.Seconds())*9/10); err != nil {
+			logger.Warnf("checking counter lastCleanupChanges: %s", err)
+		} else if ok {
+			m.doCleanupChanges()
+		}
+	}
+}
+
+// doCleanupChanges removes the changes older than ChangelogDays, or all of them if the change log is disabled.
+func (m *baseMeta) doCleanupChanges() {
+	trimmed, err := m.en.getCounter(trimmedChanges)
+	if err != nil {
+		logger.Warnf("get counter %s: %s", trimmedChanges, err)
+		return
+	}
+	edge := time.Now().Add(-time.Duration(m.fmt.ChangelogDays)*time.Hour*24).UnixNano() / 1e6
+	var upto = uint64(trimmed)
+	for cursor := upto; ; cursor += changeBatch {
+		changes, err := m.en.doReadChanges(cursor, changeBatch)
+		if err != nil {
+			logger.Warnf("read changes after %d: %s", cursor, err)
+			break
+		}
+		for _, c := range changes {
+			if m.changelogEnabled() && c.Time >= edge {
+				break
+			}
+			upto = c.Id
+		}
+		if len(changes) < changeBatch || upto < cursor+changeBatch {
+			break
+		}
+	}
+	if upto > uint64(trimmed) {
+		if err = m.en.doDeleteChanges(uint64(trimmed), upto); err != nil {
+			logger.Warnf("remove changes up to %d: %s", upto, err)
+		} else {
+			logger.Debugf("removed %d changes", upto-uint64(trimmed))
+		}
+	}
+}
+
+// createOp returns the change of creating a node of typ.
+func createOp(typ uint8) ChangeOp {
+	switch typ {
+	case TypeDirectory:
+		return ChangeMkdir
+	case TypeSymlink:
+		return ChangeSymlink
+	default:
+		return ChangeCreate
+	}
+}
+
+// recordAttrChange records a change of the attributes (or data) of a node.
+func (m *baseMeta) recordAttrChange(ctx Context, op ChangeOp, inode Ino) {
+	var attr Attr
+	if m.changelogEnabled() { // the parent is needed by the change log only
+		if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+			logger.Warnf("getattr of inode %d: %s", inode, st)
+			return
+		}
+	}
+	m.recordChange(&Change{Op: op, Inode: inode, Parent: attr.Parent})
+}
+
+const maxWatchedNodes = 1000000
+
+type watchedNode struct {
+	parent Ino
+	name   string
+}
+
+// Watcher reads the changes of the entries under a directory, and resolves the paths of them.
+type Watcher struct {
+	m      *baseMeta
+	root   Ino
+	cursor uint64
+	nodes  map[Ino]*watchedNode // the parent and name of the nodes seen
+}
+
+// NewWatcher returns a watcher of the changes under root, starting after the cursor.
+func (m *baseMeta) NewWatcher(root Ino, cursor uint64) *Watcher {
+	return &Watcher{m: m, root: m.checkRoot(root), cursor: cursor, nodes: make(map[Ino]*watchedNode)}
+}
+
+// Cursor returns the id of the last change read by the watcher.
+func (w *Watcher) Cursor() uint64 {
+	return w.cursor
+}
+
+// lookup finds the parent and name of a node, and caches all the entries in the same parent.
+func (w *Watcher) lookup(ctx Context, inode, parent Ino) (*watchedNode, syscall.Errno) {
+	if n, ok := w.nodes[inode]; ok {
+		return n, 0
+	}
+	if parent == 0 {
+		var attr Attr
+		if st := w.m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+			return nil, st
+		}
+		parent = attr.Parent
+	}
+	var entries []*Entry
+	if st := w.m.en.doReaddir(ctx, parent, 0, &entries); st != 0 {
+		return nil, st
+	}
+	if len(w.nodes)+len(entries) > maxWatchedNodes {
+		w.nodes = make(map[Ino]*watchedNode)
+	}
+	for _, e := range entries {
+		w.nodes[e.Inode] = &watchedNode{parent, string(e.Name)}
+	}
+	if n, ok := w.nodes[inode]; ok {
+		return n, 0
+	}
+	return nil, syscall.ENOENT
+}
+
+// dirPath returns the path of a directory relative to the root, or false if it's not under the root.
+func (w *Watcher) dirPath(ctx Context, inode Ino) (string, bool) {
+	var names []string
+	for i := 0; inode != w.root; i++ {
+		if inode <= 1 || isTrash(inode) || inode == SnapshotInode || i > 1000 {
+			return "", false
+		}
+		n, st := w.lookup(ctx, inode, 0)
+		if st != 0 {
+			logger.Debugf("lookup directory %d: %s", inode, st)
+			return "", false
+		}
+		names = append(names, n.name)
+		inode = n.parent
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return "/" + strings.Join(names, "/"), true
+}
+
+// entryPath returns the path of an entry relative to the root, or false if it's not under the root.
+func (w *Watcher) entryPath(ctx Context, parent Ino, name string) (string, bool) {
+	p, ok := w.dirPath(ctx, parent)
+	return path.Join(p, name), ok
+}
+
+// resolve fills the paths of a change, and returns false if none of them is under the root.
+func (w *Watcher) resolve(ctx Context, c *Change) bool {
+	var ok, dok bool
+	if c.Name != "" {
+		c.Path, ok = w.entryPath(ctx, c.Parent, c.Name)
+	} else if c.Inode == w.root {
+		c.Path, ok = "/", true
+	} else if n, st := w.lookup(ctx, c.Inode, c.Parent); st == 0 {
+		c.Path, ok = w.entryPath(ctx, n.parent, n.name)
+	}
+	if c.DstParent != 0 {
+		c.DstPath, dok = w.entryPath(ctx, c.DstParent, c.DstName)
+	}
+	if !ok {
+		c.Path = ""
+	}
+	if !dok {
+		c.DstPath = ""
+	}
+	return ok || dok
+}
+
+// update keeps the cached nodes up to date after a change.
+func (w *Watcher) update(c *Change) {
+	switch c.Op {
+	case ChangeCreate, ChangeMkdir, ChangeSymlink, ChangeLink:
+		w.nodes[c.Inode] = &watchedNode{c.Parent, c.Name}
+	case ChangeUnlink, ChangeRmdir:
+		if n, ok := w.nodes[c.Inode]; ok && n.parent == c.Parent && n.name == c.Name {
+			delete(w.nodes, c.Inode)
+		}
+	case ChangeRename:
+		w.nodes[c.Inode] = &watchedNode{c.DstParent, c.DstName}
+	}
+}
+
+// Next returns the changes under the directory after the cursor, it waits for at most timeout
+// if there is no such change, and returns an empty list then.
+func (w *Watcher) Next(ctx Context, limit int, timeout time.Duration) ([]*Change, syscall.Errno) {
+	if !w.m.changelogEnabled() {
+		return nil, syscall.ENOTSUP
+	}
+	deadline := time.Now().Add(timeout)
+	var result []*Change
+	for {
+		changes, err := w.m.ReadChanges(ctx, w.cursor, limit)
+		if err != nil {
+			return result, errno(err)
+		}
+		for _, c := range changes {
+			if c.Op == ChangeCreate || c.Op == ChangeMkdir || c.Op == ChangeSymlink || c.Op == ChangeLink {
+				w.update(c)
+			}
+			if w.resolve(ctx, c) {
+				result = append(result, c)
+			}
+			w.update(c) // the source of rename and unlink is resolved before
+			w.cursor = c.Id
+			if limit > 0 && len(result) >= limit {
+				return result, 0
+			}
+		}
+		if len(result) > 0 || !time.Now().Before(deadline) {
+			return result, 0
+		}
+		if len(changes) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, syscall.EINTR
+			case <-time.After(time.Millisecond * 200):
+			}
+		}
+	}
+}
+
+// WatcherPool keeps the idle watchers, so the nodes cached by them can be reused by the next read of the same directory.
+type WatcherPool struct {
+	sync.Mutex
+	idle map[Ino]*Watcher
+}
+
+// Get returns the idle watcher of root at cursor, or a new one.
+func (p *WatcherPool) Get(m Meta, root Ino, cursor uint64) *Watcher {
+	p.Lock()
+	defer p.Unlock()
+	if w, ok := p.idle[root]; ok && w.cursor == cursor {
+		delete(p.idle, root)
+		return w
+	}
+	return m.NewWatcher(root, cursor)
+}
+
+// Put keeps the watcher of root for the next read.
+func (p *WatcherPool) Put(root Ino, w *Watcher) {
+	p.Lock()
+	defer p.Unlock()
+	if p.idle == nil || len(p.idle) >= 100 {
+		p.idle = make(map[Ino]*Watcher)
+	}
+	p.idle[root] = w
+}
@@ -0,0 +1,211 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cloneModeSnapshot clones the nodes into a snapshot, which is used internally.
+const cloneModeSnapshot = 1 << 7
+
+// Clone copies a file or a directory tree by duplicating its metadata only, the cloned files
+// reference the same slices as the source ones, so the data is shared until either one is changed.
+// Hard links in the source are cloned as separated files.
+func (m *baseMeta) Clone(ctx Context, srcIno, dstParentIno Ino, dstName string, cmode uint8, cumask uint16, count, total *uint64) syscall.Errno {
+	if isTrash(dstParentIno) {
+		return syscall.EPERM
+	}
+	if dstParentIno == 1 && dstName == TrashName {
+		return syscall.EPERM
+	}
+	if m.conf.ReadOnly || isSnapshot(dstParentIno) {
+		return syscall.EROFS
+	}
+	if dstName == "" || cmode&cloneModeSnapshot != 0 {
+		return syscall.EINVAL
+	}
+
+	defer timeit(time.Now())
+	srcIno, dstParentIno = m.checkRoot(srcIno), m.checkRoot(dstParentIno)
+	var attr Attr
+	if st := m.GetAttr(ctx, srcIno, &attr); st != 0 {
+		return st
+	}
+	if st := m.Access(ctx, dstParentIno, 3, nil); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		// a directory can not be cloned into itself
+		for ino := dstParentIno; ino > 1 && !isTrash(ino); {
+			if ino == srcIno {
+				return syscall.EINVAL
+			}
+			var pattr Attr
+			if st := m.en.doGetAttr(ctx, ino, &pattr); st != 0 {
+				return st
+			}
+			ino = pattr.Parent
+		}
+	}
+	s, st := m.entryStat(ctx, srcIno, &attr)
+	if st != 0 {
+		return st
+	}
+	if total != nil {
+		*total = uint64(s.files + s.dirs)
+	}
+	if st = m.checkQuota(ctx, s.space, s.files+s.dirs, ctx.Uid(), ctx.Gid(), dstParentIno); st != 0 {
+		return st
+	}
+
+	_, st = m.clone(ctx, srcIno, &attr, dstParentIno, dstName, cmode, cumask, count)
+	return st
+}
+
+// clone clones a node and all the entries under it, the partially cloned tree is removed if it fails.
+func (m *baseMeta) clone(ctx Context, srcIno Ino, attr *Attr, parent Ino, name string, cmode uint8, cumask uint16, count *uint64) (Ino, syscall.Errno) {
+	ino, st := m.cloneNode(ctx, srcIno, attr, parent, name, cmode, cumask, count)
+	if st != 0 || attr.Typ != TypeDirectory {
+		return ino, st
+	}
+	concurrent := make(chan int, 50)
+	if st = m.cloneDir(ctx, srcIno, ino, cmode, cumask, count, concurrent); st != 0 {
+		var e syscall.Errno
+		if cmode&cloneModeSnapshot != 0 {
+			e = m.removeTree(ctx, parent, name, ino, attr, concurrent)
+		} else {
+			e = Remove(m.en.(Meta), ctx, parent, name)
+		}
+		if e != 0 {
+			logger.Warnf("remove partially cloned %s (%d): %s", name, ino, e)
+		}
+	}
+	return ino, st
+}
+
+// cloneNode clones a single node into parent, the attributes of the new node are returned in attr.
+func (m *baseMeta) cloneNode(ctx Context, srcIno Ino, attr *Attr, parent Ino, name string, cmode uint8, cumask uint16, count *uint64) (Ino, syscall.Errno) {
+	var mmask uint8 = 4 // read
+	if attr.Typ == TypeDirectory {
+		mmask |= 1 // list
+	}
+	if attr.Typ != TypeSymlink {
+		if st := m.Access(ctx, srcIno, mmask, attr); st != 0 {
+			return 0, st
+		}
+	}
+	var ino Ino
+	var err error
+	if cmode&cloneModeSnapshot != 0 {
+		ino, err = m.nextSnapshotInode()
+	} else {
+		ino, err = m.nextInode()
+	}
+	if err != nil {
+		return 0, errno(err)
+	}
+	if st := m.en.doCloneEntry(ctx, srcIno, parent, name, ino, attr, cmode, cumask); st != 0 {
+		return 0, st
+	}
+	m.updateDirQuota(ctx, parent, align4K(attr.Length), 1)
+	// the nodes in snapshots are charged to their owners like the clones (and released once removed), so the
+	// usage of owners matches the one recounted from all the nodes, including those in snapshots
+	m.updateOwnerQuota(attr.Uid, attr.Gid, align4K(attr.Length), 1)
+	m.addDirStat(ctx, parent, nodeStat(attr))
+	m.recordChange(&Change{Op: createOp(attr.Typ), Inode: ino, Parent: parent, Name: name})
+	if count != nil {
+		atomic.AddUint64(count, 1)
+	}
+	return ino, 0
+}
+
+// cloneDir clones all the entries under srcIno into the directory dstIno.
+func (m *baseMeta) cloneDir(ctx Context, srcIno, dstIno Ino, cmode uint8, cumask uint16, count *uint64, concurrent chan int) syscall.Errno {
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, srcIno, 1, &entries); st != 0 {
+		return st
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var status syscall.Errno
+	for _, e := range entries {
+		ino, st := m.cloneNode(ctx, e.Inode, e.Attr, dstIno, string(e.Name), cmode, cumask, count)
+		if st != 0 {
+			wg.Wait()
+			return st
+		}
+		if e.Attr.Typ != TypeDirectory {
+			continue
+		}
+		select {
+		case concurrent <- 1:
+			wg.Add(1)
+			go func(src, dst Ino) {
+				defer wg.Done()
+				if st := m.cloneDir(ctx, src, dst, cmode, cumask, count, concurrent); st != 0 {
+					mu.Lock()
+					status = st
+					mu.Unlock()
+				}
+				<-concurrent
+			}(e.Inode, ino)
+		default:
+			if st = m.cloneDir(ctx, e.Inode, ino, cmode, cumask, count, concurrent); st != 0 {
+				wg.Wait()
+				return st
+			}
+		}
+	}
+	wg.Wait()
+	return status
+}
+
+// cloneAttr updates the attributes of the source node for the cloned one under parent (with pattr).
+// The owner, mode and times are reset as a new node created by the caller unless they should be preserved.
+func cloneAttr(ctx Context, attr *Attr, parent Ino, pattr *Attr, cmode uint8, cumask uint16) {
+	now := time.Now()
+	attr.Parent = parent
+	if attr.Typ == TypeDirectory {
+		attr.Nlink = 2
+		pattr.Nlink++
+	} else {
+		attr.Nlink = 1
+	}
+	if cmode&CloneModePreserveAttr == 0 {
+		attr.Uid = ctx.Uid()
+		attr.Gid = ctx.Gid()
+		if pattr.Mode&02000 != 0 {
+			attr.Gid = pattr.Gid
+		}
+		attr.Mode &= ^cumask
+		attr.Atime = now.Unix()
+		attr.Atimensec = uint32(now.Nanosecond())
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+	}
+	attr.Ctime = now.Unix()
+	attr.Ctimensec = uint32(now.Nanosecond())
+	attr.Full = true
+	pattr.Mtime = now.Unix()
+	pattr.Mtimensec = uint32(now.Nanosecond())
+	pattr.Ctime = now.Unix()
+	pattr.Ctimensec = uint32(now.Nanosecond())
+}
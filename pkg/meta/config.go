@@ -40,27 +40,72 @@ type Config struct {
 	MountPoint  string
 	Subdir      string
 	MaxDeletes  int
+	AtimeMode   string // noatime, relatime or strictatime
+}
+
+// Tier is an additional storage of a volume, the primary one (Format.Storage) is tier 0.
+type Tier struct {
+	Id        uint8
+	Name      string
+	Storage   string
+	Bucket    string
+	AccessKey string
+	SecretKey string   `json:",omitempty"`
+	Patterns  []string `json:",omitempty"` // the new files matching any of them are placed in this tier
+}
+
+// Replica is the object storage keeping a copy of all the data of a volume.
+type Replica struct {
+	Storage   string
+	Bucket    string
+	AccessKey string
+	SecretKey string `json:",omitempty"`
+}
+
+func (r *Replica) String() string {
+	return fmt.Sprintf("%s:%s", r.Storage, r.Bucket)
+}
+
+// OldEncryptKey is a rotated encrypt key, which is kept to read the objects encrypted with it.
+type OldEncryptKey struct {
+	Version int
+	Key     string `json:",omitempty"`
 }
 
 type Format struct {
-	Name             string
-	UUID             string
-	Storage          string
-	Bucket           string
-	AccessKey        string
-	SecretKey        string `json:",omitempty"`
-	BlockSize        int
-	Compression      string
-	Shards           int
-	Partitions       int
-	Capacity         uint64
-	Inodes           uint64
-	EncryptKey       string `json:",omitempty"`
-	KeyEncrypted     bool
-	TrashDays        int
-	MetaVersion      int
-	MinClientVersion string
-	MaxClientVersion string
+	Name              string
+	UUID              string
+	Storage           string
+	Bucket            string
+	AccessKey         string
+	SecretKey         string `json:",omitempty"`
+	BlockSize         int
+	Compression       string
+	Shards            int
+	DataShards        int `json:",omitempty"` // erasure code: number of data shards
+	ParityShards      int `json:",omitempty"` // erasure code: number of parity shards
+	Partitions        int
+	Capacity          uint64
+	Inodes            uint64
+	EncryptKey        string          `json:",omitempty"`
+	EncryptKeyVersion int             `json:",omitempty"` // increased every time the encrypt key is rotated
+	OldEncryptKeys    []OldEncryptKey `json:",omitempty"`
+	KeyProvider       string          `json:",omitempty"` // URI of the provider wrapping the volume key
+	WrappedKey        string          `json:",omitempty"` // the volume key wrapped by the provider (base64)
+	KeyEncrypted      bool
+	TrashDays         int
+	EnableACL         bool `json:",omitempty"`
+	ChangelogDays     int  `json:",omitempty"`
+	CacheInvalidation bool `json:",omitempty"`
+	InlineSize        int  `json:",omitempty"`
+	PackSize          int  `json:",omitempty"` // in KiB
+	Dedup             bool `json:",omitempty"`
+	BlockChecksum     bool `json:",omitempty"` // append the checksums to blocks
+	MetaVersion       int
+	MinClientVersion  string
+	MaxClientVersion  string
+	Tiers             []Tier   `json:",omitempty"`
+	Replica           *Replica `json:",omitempty"`
 }
 
 func (f *Format) RemoveSecret() {
@@ -70,6 +115,79 @@ func (f *Format) RemoveSecret() {
 	if f.EncryptKey != "" {
 		f.EncryptKey = "removed"
 	}
+	f.Tiers = append([]Tier(nil), f.Tiers...) // the copies of Format share the tiers
+	for i := range f.Tiers {
+		if f.Tiers[i].SecretKey != "" {
+			f.Tiers[i].SecretKey = "removed"
+		}
+	}
+	if f.Replica != nil && f.Replica.SecretKey != "" {
+		r := *f.Replica
+		r.SecretKey = "removed"
+		f.Replica = &r
+	}
+	f.OldEncryptKeys = append([]OldEncryptKey(nil), f.OldEncryptKeys...)
+	for i := range f.OldEncryptKeys {
+		if f.OldEncryptKeys[i].Key != "" {
+			f.OldEncryptKeys[i].Key = "removed"
+		}
+	}
+}
+
+// storageSecrets returns the secret keys of tiers and replica and the old encrypt keys (copied), which are
+// encrypted together with the ones of volume.
+func (f *Format) storageSecrets() []*string {
+	f.Tiers = append([]Tier(nil), f.Tiers...)
+	var keys []*string
+	for i := range f.Tiers {
+		if f.Tiers[i].SecretKey != "" {
+			keys = append(keys, &f.Tiers[i].SecretKey)
+		}
+	}
+	if f.Replica != nil {
+		r := *f.Replica
+		f.Replica = &r
+		if r.SecretKey != "" {
+			keys = append(keys, &f.Replica.SecretKey)
+		}
+	}
+	f.OldEncryptKeys = append([]OldEncryptKey(nil), f.OldEncryptKeys...)
+	for i := range f.OldEncryptKeys {
+		if f.OldEncryptKeys[i].Key != "" {
+			keys = append(keys, &f.OldEncryptKeys[i].Key)
+		}
+	}
+	return keys
+}
+
+// featureVersion is the minimum version of clients which can handle the data stored by the features below.
+const featureVersion = "1.1.0-A"
+
+// UpdateClientVersion raises MinClientVersion if the volume uses any feature that the older clients can not
+// handle, so they refuse to mount it instead of misreading or corrupting the data. It returns true if the
+// version is changed.
+func (f *Format) UpdateClientVersion() bool {
+	switch {
+	case f.EnableACL: // the ACLs are ignored
+	case f.InlineSize > 0: // the inline files are read as empty ones
+	case f.PackSize > 0: // the packed slices are read from missing objects
+	case f.Dedup: // the shared blocks are read from missing objects, or deleted while still used by others
+	case len(f.Tiers) > 0: // the slices in other tiers are read from missing objects
+	case f.Replica != nil: // the new data is not written into the replica
+	case f.ParityShards > 0: // the shards in multiple buckets can not be read or written
+	case f.BlockChecksum: // the checksums are read as part of the blocks
+	case f.EncryptKeyVersion > 0: // the data encrypted with the old keys can not be read
+	case f.KeyProvider != "": // the data is written in plaintext without the encrypt key
+	default:
+		return false
+	}
+	if f.MinClientVersion != "" {
+		if v := version.Parse(f.MinClientVersion); v != nil && v.Compare(version.Parse(featureVersion)) >= 0 {
+			return false
+		}
+	}
+	f.MinClientVersion = featureVersion
+	return true
 }
 
 func (f *Format) CheckVersion() error {
@@ -99,7 +217,8 @@ func (f *Format) CheckVersion() error {
 }
 
 func (f *Format) Encrypt() error {
-	if f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" {
+	storageKeys := f.storageSecrets()
+	if f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" && len(storageKeys) == 0 {
 		return nil
 	}
 	key := md5.Sum([]byte(f.UUID))
@@ -132,12 +251,19 @@ func (f *Format) Encrypt() error {
 		}
 		f.EncryptKey = encrypt(f.EncryptKey)
 	}
+	for _, k := range storageKeys {
+		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+			return fmt.Errorf("generate nonce for secret key of storage: %s", err)
+		}
+		*k = encrypt(*k)
+	}
 	f.KeyEncrypted = true
 	return nil
 }
 
 func (f *Format) Decrypt() error {
-	if !f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" {
+	storageKeys := f.storageSecrets()
+	if !f.KeyEncrypted || f.SecretKey == "" && f.EncryptKey == "" && len(storageKeys) == 0 {
 		return nil
 	}
 	key := md5.Sum([]byte(f.UUID))
@@ -172,6 +298,11 @@ func (f *Format) Decrypt() error {
 			return err
 		}
 	}
+	for _, k := range storageKeys {
+		if err = decrypt(k); err != nil {
+			return err
+		}
+	}
 	f.KeyEncrypted = false
 	return nil
 }
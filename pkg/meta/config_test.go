@@ -42,3 +42,83 @@ func TestEncrypt(t *testing.T) {
 		t.Fatalf("invalid format: %+v", format)
 	}
 }
+
+func TestEncryptReplica(t *testing.T) {
+	replica := &Replica{Storage: "s3", SecretKey: "replicaSecret"}
+	format := Format{Name: "test", Replica: replica}
+	if err := format.Encrypt(); err != nil {
+		t.Fatalf("Format encrypt: %s", err)
+	}
+	if format.Replica.SecretKey == "replicaSecret" || replica.SecretKey != "replicaSecret" {
+		t.Fatalf("invalid replica: %+v, origin: %+v", format.Replica, replica)
+	}
+	if err := format.Decrypt(); err != nil {
+		t.Fatalf("Format decrypt: %s", err)
+	}
+	if format.Replica.SecretKey != "replicaSecret" {
+		t.Fatalf("invalid replica: %+v", format.Replica)
+	}
+	format.RemoveSecret()
+	if format.Replica.SecretKey != "removed" || replica.SecretKey != "replicaSecret" {
+		t.Fatalf("invalid replica: %+v, origin: %+v", format.Replica, replica)
+	}
+}
+
+func TestEncryptOldKeys(t *testing.T) {
+	old := []OldEncryptKey{{Version: 0, Key: "oldEncrypt"}}
+	format := Format{Name: "test", EncryptKey: "testEncrypt", EncryptKeyVersion: 1, OldEncryptKeys: old}
+	if err := format.Encrypt(); err != nil {
+		t.Fatalf("Format encrypt: %s", err)
+	}
+	if format.OldEncryptKeys[0].Key == "oldEncrypt" || old[0].Key != "oldEncrypt" {
+		t.Fatalf("invalid old keys: %+v, origin: %+v", format.OldEncryptKeys, old)
+	}
+	if err := format.Decrypt(); err != nil {
+		t.Fatalf("Format decrypt: %s", err)
+	}
+	if format.OldEncryptKeys[0].Key != "oldEncrypt" {
+		t.Fatalf("invalid old keys: %+v", format.OldEncryptKeys)
+	}
+	format.RemoveSecret()
+	if format.OldEncryptKeys[0].Key != "removed" || old[0].Key != "oldEncrypt" {
+		t.Fatalf("invalid old keys: %+v, origin: %+v", format.OldEncryptKeys, old)
+	}
+}
+
+func TestUpdateClientVersion(t *testing.T) {
+	format := Format{Name: "test"}
+	if format.UpdateClientVersion() || format.MinClientVersion != "" {
+		t.Fatalf("no feature is used: %s", format.MinClientVersion)
+	}
+	format.EnableACL = true
+	if !format.UpdateClientVersion() || format.MinClientVersion != featureVersion {
+		t.Fatalf("min client version should be %s, but got %s", featureVersion, format.MinClientVersion)
+	}
+	if err := format.CheckVersion(); err != nil {
+		t.Fatalf("current client is rejected: %s", err)
+	}
+	format.MinClientVersion = "1.0.0"
+	if !format.UpdateClientVersion() || format.MinClientVersion != featureVersion {
+		t.Fatalf("min client version should be raised to %s, but got %s", featureVersion, format.MinClientVersion)
+	}
+	format.MinClientVersion = "1.2.0"
+	if format.UpdateClientVersion() || format.MinClientVersion != "1.2.0" {
+		t.Fatalf("min client version should not be lowered: %s", format.MinClientVersion)
+	}
+
+	for _, f := range []Format{
+		{InlineSize: 4096},
+		{PackSize: 1024},
+		{Dedup: true},
+		{Tiers: []Tier{{Id: 1, Name: "cold"}}},
+		{Replica: &Replica{Storage: "file", Bucket: "/tmp/replica/"}},
+		{DataShards: 4, ParityShards: 2},
+		{BlockChecksum: true},
+		{EncryptKeyVersion: 1},
+		{KeyProvider: "env://JFS_PASSPHRASE"},
+	} {
+		if !f.UpdateClientVersion() || f.MinClientVersion != featureVersion {
+			t.Fatalf("min client version of %+v should be %s, but got %s", f, featureVersion, f.MinClientVersion)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"encoding/hex"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// Blocks with the same content are shared by slices when Format.Dedup is enabled. The clients hash the blocks
+// before uploading them, the ones found by RefBlock are referenced instead of uploaded again, and the new ones
+// are recorded by AddBlock once they are uploaded. Every block in the index has a reference from each slice
+// using it (including the one owning the object), and the object is deleted (DeleteBlock) when the last
+// reference is removed together with the slice (or by DerefSlice if the writing is aborted), even if the owner
+// was deleted before.
+
+// Block is a block of a slice.
+type Block struct {
+	Chunkid uint64
+	Indx    uint32
+	Size    uint32 // size of the block
+}
+
+// DedupStat is the statistics of the shared blocks.
+type DedupStat struct {
+	Blocks  uint64 // number of unique blocks
+	Size    uint64 // bytes of unique blocks
+	Refs    uint64 // number of references to them
+	Logical uint64 // bytes used by the references
+}
+
+// Ratio returns the ratio of the logical bytes to the stored ones.
+func (s *DedupStat) Ratio() float64 {
+	if s.Size == 0 {
+		return 1
+	}
+	return float64(s.Logical) / float64(s.Size)
+}
+
+func (m *baseMeta) RefBlock(ctx Context, hash []byte, b *Block, owner *Block) syscall.Errno {
+	defer timeit(time.Now())
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	return m.en.doRefBlock(hash, b, owner)
+}
+
+func (m *baseMeta) AddBlock(ctx Context, hash []byte, b *Block) syscall.Errno {
+	defer timeit(time.Now())
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	return m.en.doAddBlock(hash, b)
+}
+
+func (m *baseMeta) FindBlock(ctx Context, chunkid uint64, indx uint32, owner *Block) syscall.Errno {
+	if !m.fmt.Dedup {
+		return syscall.ENOENT // deduplication can not be disabled once enabled
+	}
+	defer timeit(time.Now())
+	return m.en.doFindBlock(chunkid, indx, owner)
+}
+
+func (m *baseMeta) DerefSlice(ctx Context, chunkid uint64, size uint32) syscall.Errno {
+	defer timeit(time.Now())
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	todel, err := m.en.doDerefSlice(chunkid, size, m.sliceBlocks(chunkid, size))
+	if err != nil {
+		return errno(err)
+	}
+	m.deleteBlocks(todel)
+	return 0
+}
+
+func (m *baseMeta) ListDedupBlocks(ctx Context, fn func(hash []byte, owner *Block, refs []Block)) syscall.Errno {
+	refs := make(map[string][]Block)
+	err := m.en.doListBlockRefs(func(b *Block, hash []byte) {
+		refs[string(hash)] = append(refs[string(hash)], *b)
+	})
+	if err != nil {
+		return errno(err)
+	}
+	return errno(m.en.doListDedup(func(hash []byte, owner *Block, _ uint32) {
+		fn(hash, owner, refs[string(hash)])
+	}))
+}
+
+// GetDedupStat returns the statistics of the shared blocks in the volume.
+func GetDedupStat(m Meta, ctx Context, st *DedupStat) syscall.Errno {
+	return m.ListDedupBlocks(ctx, func(hash []byte, owner *Block, refs []Block) {
+		st.Blocks++
+		st.Size += uint64(owner.Size)
+		st.Refs += uint64(len(refs))
+		st.Logical += uint64(owner.Size) * uint64(len(refs))
+	})
+}
+
+// sliceBlocks returns the blocks of a slice.
+func (m *baseMeta) sliceBlocks(chunkid uint64, size uint32) []Block {
+	bsize := uint32(m.fmt.BlockSize << 10)
+	var blocks []Block
+	for off := uint32(0); off < size; off += bsize {
+		l := size - off
+		if l > bsize {
+			l = bsize
+		}
+		blocks = append(blocks, Block{chunkid, off / bsize, l})
+	}
+	return blocks
+}
+
+// deleteDedup removes the references from the blocks of a slice, and deletes the objects not used anymore.
+func (m *baseMeta) deleteDedup(chunkid uint64, size uint32) {
+	todel, err := m.en.doDerefSlice(chunkid, size, m.sliceBlocks(chunkid, size))
+	if err != nil {
+		logger.Warnf("delete slice %d (%d bytes): %s", chunkid, size, err)
+		return
+	}
+	m.deleteBlocks(todel)
+	m.deleteSliceTier(chunkid)
+}
+
+func (m *baseMeta) deleteBlocks(blocks []Block) {
+	for _, b := range blocks {
+		if err := m.newMsg(DeleteBlock, b.Chunkid, b.Indx, b.Size); err != nil {
+			logger.Warnf("delete block %d_%d_%d: %s", b.Chunkid, b.Indx, b.Size, err) // it will be removed by gc
+		}
+	}
+}
+
+func marshalBlock(b *Block, refs uint32) []byte {
+	w := utils.NewBuffer(20)
+	w.Put64(b.Chunkid)
+	w.Put32(b.Indx)
+	w.Put32(b.Size)
+	w.Put32(refs)
+	return w.Bytes()
+}
+
+func unmarshalBlock(buf []byte, b *Block) (refs uint32) {
+	rb := utils.ReadBuffer(buf)
+	b.Chunkid = rb.Get64()
+	b.Indx = rb.Get32()
+	b.Size = rb.Get32()
+	return rb.Get32()
+}
+
+// derefBlocks returns the blocks to be deleted after removing the references from blocks, which are
+// found by refs (the hash of them, nil if not shared) and owners (the shared block and references of them).
+func derefBlocks(blocks []Block, refs [][]byte, owners map[string]*Block, counts map[string]uint32) []Block {
+	var todel []Block
+	for i, h := range refs {
+		if h == nil {
+			todel = append(todel, blocks[i])
+			continue
+		}
+		owner, ok := owners[string(h)]
+		if !ok {
+			continue
+		}
+		if counts[string(h)] <= 1 {
+			delete(counts, string(h))
+			todel = append(todel, *owner)
+		} else {
+			counts[string(h)]--
+		}
+	}
+	return todel
+}
+
+// dumpDedup returns all the shared blocks with the references.
+func (m *baseMeta) dumpDedup() ([]*DumpedDedupBlock, error) {
+	var blocks []*DumpedDedupBlock
+	st := m.ListDedupBlocks(Background, func(hash []byte, owner *Block, refs []Block) {
+		d := &DumpedDedupBlock{Hash: hex.EncodeToString(hash), Chunkid: owner.Chunkid, Indx: owner.Indx, Size: owner.Size}
+		for _, r := range refs {
+			d.Refs = append(d.Refs, &DumpedBlockRef{r.Chunkid, r.Indx})
+		}
+		blocks = append(blocks, d)
+	})
+	if st != 0 {
+		return nil, st
+	}
+	return blocks, nil
+}
+
+// loadDedup records the dumped shared blocks.
+func (m *baseMeta) loadDedup(blocks []*DumpedDedupBlock) error {
+	for _, d := range blocks {
+		hash, err := hex.DecodeString(d.Hash)
+		if err != nil {
+			return fmt.Errorf("invalid hash of block %d_%d: %s", d.Chunkid, d.Indx, err)
+		}
+		refs := make([]Block, 0, len(d.Refs))
+		for _, r := range d.Refs {
+			refs = append(refs, Block{Chunkid: r.Chunkid, Indx: r.Indx})
+		}
+		if err = m.en.doSetDedup(hash, &Block{d.Chunkid, d.Indx, d.Size}, refs); err != nil {
+			return fmt.Errorf("load block %d_%d: %s", d.Chunkid, d.Indx, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"syscall"
+	"time"
+)
+
+// dirStat is the statistics of all the entries under a directory recursively,
+// the directory itself is not included.
+type dirStat struct {
+	length int64 // total length of files
+	space  int64 // total space of entries, aligned to 4K
+	files  int64 // number of non-directory entries
+	dirs   int64 // number of directories
+}
+
+func (s *dirStat) add(o *dirStat) {
+	s.length += o.length
+	s.space += o.space
+	s.files += o.files
+	s.dirs += o.dirs
+}
+
+func (s *dirStat) neg() *dirStat {
+	return &dirStat{-s.length, -s.space, -s.files, -s.dirs}
+}
+
+// getDirStat returns the statistics of a directory with the local changes not flushed yet,
+// or nil if it's not maintained.
+func (m *baseMeta) getDirStat(inode Ino) (*dirStat, error) {
+	if isTrash(inode) || inode == SnapshotInode {
+		return nil, nil
+	}
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+	s, err := m.en.doGetDirStat(inode)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	m.dirStatsMu.Lock()
+	if d, ok := m.dirStats[inode]; ok {
+		s.add(d)
+	}
+	m.dirStatsMu.Unlock()
+	return s, nil
+}
+
+// subStat returns the statistics of a directory, which is calculated by walking
+// through the directory if it's not maintained.
+func (m *baseMeta) subStat(ctx Context, inode Ino) (*dirStat, syscall.Errno) {
+	if s, err := m.getDirStat(inode); err != nil {
+		return nil, errno(err)
+	} else if s != nil {
+		return s, 0
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+		return nil, st
+	}
+	var s dirStat
+	for _, e := range entries {
+		es, st := m.entryStat(ctx, e.Inode, e.Attr)
+		if st != 0 {
+			return nil, st
+		}
+		s.add(es)
+	}
+	return &s, 0
+}
+
+// nodeStat returns the statistics of a single node, the entries under it are not included.
+func nodeStat(attr *Attr) *dirStat {
+	if attr.Typ == TypeDirectory {
+		return &dirStat{0, align4K(0), 0, 1}
+	}
+	return &dirStat{int64(attr.Length), align4K(attr.Length), 1, 0}
+}
+
+// entryStat returns the statistics of an entry, including itself and all the entries under it.
+func (m *baseMeta) entryStat(ctx Context, inode Ino, attr *Attr) (*dirStat, syscall.Errno) {
+	if attr.Typ != TypeDirectory {
+		return nodeStat(attr), 0
+	}
+	s, st := m.subStat(ctx, inode)
+	if st != 0 {
+		return nil, st
+	}
+	s.add(nodeStat(attr))
+	return s, 0
+}
+
+func (m *baseMeta) hasDirStat(inode Ino) bool {
+	s, err := m.getDirStat(inode)
+	return err == nil && s != nil
+}
+
+// updateDirStat adds the changes to the statistics of parent and all its ancestors.
+// The changes of a file with hard links should be multiplied by the number of links,
+// it's accurate only if all the links are in the same directory.
+func (m *baseMeta) updateDirStat(ctx Context, parent Ino, length, space, files, dirs int64) {
+	m.addDirStat(ctx, parent, &dirStat{length, space, files, dirs})
+}
+
+func (m *baseMeta) addDirStat(ctx Context, parent Ino, s *dirStat) {
+	if *s == (dirStat{}) || parent == 0 || isTrash(parent) || parent == SnapshotInode {
+		return
+	}
+	inodes := m.dirAncestors(ctx, parent)
+	m.dirStatsMu.Lock()
+	defer m.dirStatsMu.Unlock()
+	for _, inode := range inodes {
+		if c, ok := m.dirStats[inode]; ok {
+			c.add(s)
+		} else {
+			c := *s
+			m.dirStats[inode] = &c
+		}
+	}
+}
+
+// moveEntryStat moves the statistics of an entry from src to dst.
+func (m *baseMeta) moveEntryStat(ctx Context, inode Ino, attr *Attr, src, dst Ino) {
+	if src == dst {
+		return
+	}
+	if attr.Typ == TypeDirectory && !m.hasDirStat(inode) && !m.hasDirStat(src) && !m.hasDirStat(dst) {
+		return // don't walk through the directory if none of them is maintained
+	}
+	s, st := m.entryStat(ctx, inode, attr)
+	if st != 0 {
+		logger.Warnf("get statistics of inode %d: %s", inode, st)
+		return
+	}
+	m.addDirStat(ctx, src, s.neg())
+	m.addDirStat(ctx, dst, s)
+}
+
+func (m *baseMeta) flushDirStats() {
+	for {
+		time.Sleep(time.Second)
+		m.syncDirStats()
+	}
+}
+
+// syncDirStats writes the local changes of statistics into the meta engine.
+func (m *baseMeta) syncDirStats() {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+	m.dirStatsMu.Lock()
+	stats := m.dirStats
+	m.dirStats = make(map[Ino]*dirStat)
+	m.dirStatsMu.Unlock()
+	if len(stats) == 0 {
+		return
+	}
+	if err := m.en.doFlushDirStats(stats); err != nil {
+		logger.Warnf("flush stats of %d directories: %s", len(stats), err)
+		m.dirStatsMu.Lock()
+		for inode, s := range stats {
+			if c, ok := m.dirStats[inode]; ok {
+				c.add(s)
+			} else {
+				m.dirStats[inode] = s
+			}
+		}
+		m.dirStatsMu.Unlock()
+	}
+}
+
+// setDirStat overwrites the statistics of a directory, dropping the local changes of it.
+func (m *baseMeta) setDirStat(inode Ino, s *dirStat) error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+	if err := m.en.doSetDirStats(map[Ino]*dirStat{inode: s}); err != nil {
+		return err
+	}
+	m.dirStatsMu.Lock()
+	delete(m.dirStats, inode)
+	m.dirStatsMu.Unlock()
+	return nil
+}
+
+func (m *baseMeta) GetDirStat(ctx Context, inode Ino, summary *Summary) syscall.Errno {
+	defer timeit(time.Now())
+	s, err := m.getDirStat(m.checkRoot(inode))
+	if err != nil {
+		return errno(err)
+	}
+	if s == nil {
+		return syscall.ENOTSUP
+	}
+	summary.Length += uint64(s.length)
+	summary.Size += uint64(s.space)
+	summary.Files += uint64(s.files)
+	summary.Dirs += uint64(s.dirs)
+	return 0
+}
+
+func (m *baseMeta) CheckDirStats(ctx Context, dpath string, repair bool) error {
+	inode, st := m.resolveDir(ctx, dpath)
+	if st != 0 {
+		return fmt.Errorf("resolve %s: %s", dpath, st)
+	}
+	var broken int
+	if _, st = m.checkDirStat(ctx, inode, dpath, repair, &broken); st != 0 {
+		return fmt.Errorf("check %s: %s", dpath, st)
+	}
+	if broken > 0 && !repair {
+		return fmt.Errorf("statistics of %d directories are broken", broken)
+	}
+	return nil
+}
+
+// checkDirStat calculates the statistics of a directory by walking through it, and compares
+// them with the maintained ones. The broken ones are overwritten if repair is true.
+func (m *baseMeta) checkDirStat(ctx Context, inode Ino, dpath string, repair bool, broken *int) (*dirStat, syscall.Errno) {
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+		return nil, st
+	}
+	var s dirStat
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			sub, st := m.checkDirStat(ctx, e.Inode, path.Join(dpath, string(e.Name)), repair, broken)
+			if st != 0 {
+				return nil, st
+			}
+			s.add(sub)
+		}
+		s.add(nodeStat(e.Attr))
+	}
+	cur, err := m.getDirStat(inode)
+	if err != nil {
+		return nil, errno(err)
+	}
+	if cur != nil && *cur == s {
+		return &s, 0
+	}
+	*broken++
+	if cur == nil {
+		logger.Warnf("Statistics of directory %s (%d) are missing", dpath, inode)
+	} else {
+		logger.Warnf("Statistics of directory %s (%d) are broken: %+v, should be %+v", dpath, inode, *cur, s)
+	}
+	if repair {
+		if err = m.setDirStat(inode, &s); err != nil {
+			return nil, errno(err)
+		}
+		logger.Infof("Statistics of directory %s (%d) are repaired", dpath, inode)
+	}
+	return &s, 0
+}
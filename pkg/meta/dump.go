@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/juicedata/juicefs/pkg/acl"
 )
 
 const (
@@ -50,6 +52,36 @@ type DumpedSustained struct {
 	Inodes []Ino  `json:"inodes"`
 }
 
+type DumpedPackedSlice struct {
+	Chunkid uint64 `json:"chunkid"`
+	Off     uint32 `json:"off"`
+	Len     uint32 `json:"len"`
+}
+
+type DumpedPack struct {
+	Id     uint64               `json:"id"`
+	Size   uint32               `json:"size"`
+	Slices []*DumpedPackedSlice `json:"slices"`
+}
+
+type DumpedBlockRef struct {
+	Chunkid uint64 `json:"chunkid"`
+	Indx    uint32 `json:"indx"`
+}
+
+type DumpedDedupBlock struct {
+	Hash    string            `json:"hash"`
+	Chunkid uint64            `json:"chunkid"`
+	Indx    uint32            `json:"indx"`
+	Size    uint32            `json:"size"`
+	Refs    []*DumpedBlockRef `json:"refs"`
+}
+
+type DumpedSliceTier struct {
+	Chunkid uint64 `json:"chunkid"`
+	Tier    uint8  `json:"tier"`
+}
+
 type DumpedAttr struct {
 	Inode     Ino    `json:"inode"`
 	Type      string `json:"type"`
@@ -86,13 +118,16 @@ type DumpedXattr struct {
 }
 
 type DumpedEntry struct {
-	Name    string                  `json:"-"`
-	Parent  Ino                     `json:"-"`
-	Attr    *DumpedAttr             `json:"attr"`
-	Symlink string                  `json:"symlink,omitempty"`
-	Xattrs  []*DumpedXattr          `json:"xattrs,omitempty"`
-	Chunks  []*DumpedChunk          `json:"chunks,omitempty"`
-	Entries map[string]*DumpedEntry `json:"entries,omitempty"`
+	Name       string                  `json:"-"`
+	Parent     Ino                     `json:"-"`
+	Attr       *DumpedAttr             `json:"attr"`
+	Symlink    string                  `json:"symlink,omitempty"`
+	Inline     []byte                  `json:"inline,omitempty"`
+	Xattrs     []*DumpedXattr          `json:"xattrs,omitempty"`
+	AccessACL  *acl.Rule               `json:"posix_acl_access,omitempty"`
+	DefaultACL *acl.Rule               `json:"posix_acl_default,omitempty"`
+	Chunks     []*DumpedChunk          `json:"chunks,omitempty"`
+	Entries    map[string]*DumpedEntry `json:"entries,omitempty"`
 }
 
 func (de *DumpedEntry) writeJSON(bw *bufio.Writer, depth int) error {
@@ -118,6 +153,15 @@ func (de *DumpedEntry) writeJSON(bw *bufio.Writer, depth int) error {
 		}
 		write(fmt.Sprintf(",\n%s\"xattrs\": %s", fieldPrefix, data))
 	}
+	if err = de.writeACLs(write, fieldPrefix); err != nil {
+		return err
+	}
+	if len(de.Inline) > 0 {
+		if data, err = json.Marshal(de.Inline); err != nil {
+			return err
+		}
+		write(fmt.Sprintf(",\n%s\"inline\": %s", fieldPrefix, data))
+	}
 	if len(de.Chunks) == 1 {
 		if data, err = json.Marshal(de.Chunks); err != nil {
 			return err
@@ -160,17 +204,38 @@ func (de *DumpedEntry) writeJsonWithOutEntry(bw *bufio.Writer, depth int) error
 		}
 		write(fmt.Sprintf(",\n%s\"xattrs\": %s", fieldPrefix, data))
 	}
+	if err = de.writeACLs(write, fieldPrefix); err != nil {
+		return err
+	}
 	write(fmt.Sprintf(",\n%s\"entries\": {", fieldPrefix))
 	return nil
 }
 
+func (de *DumpedEntry) writeACLs(write func(s string), fieldPrefix string) error {
+	names := []string{"posix_acl_access", "posix_acl_default"}
+	for i, rule := range []*acl.Rule{de.AccessACL, de.DefaultACL} {
+		if rule == nil {
+			continue
+		}
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		write(fmt.Sprintf(",\n%s\"%s\": %s", fieldPrefix, names[i], data))
+	}
+	return nil
+}
+
 type DumpedMeta struct {
 	Setting   Format
 	Counters  *DumpedCounters
 	Sustained []*DumpedSustained
 	DelFiles  []*DumpedDelFile
-	FSTree    *DumpedEntry `json:",omitempty"`
-	Trash     *DumpedEntry `json:",omitempty"`
+	Packs     []*DumpedPack       `json:",omitempty"`
+	Dedup     []*DumpedDedupBlock `json:",omitempty"`
+	Tiers     []*DumpedSliceTier  `json:",omitempty"`
+	FSTree    *DumpedEntry        `json:",omitempty"`
+	Trash     *DumpedEntry        `json:",omitempty"`
 }
 
 func (dm *DumpedMeta) writeJsonWithOutTree(w io.Writer) (*bufio.Writer, error) {
@@ -188,6 +253,105 @@ func (dm *DumpedMeta) writeJsonWithOutTree(w io.Writer) (*bufio.Writer, error) {
 	return bw, nil
 }
 
+// DumpFormat is the format of the metadata dumped by DumpMeta.
+type DumpFormat uint8
+
+const (
+	DumpJSON       DumpFormat = iota // indented JSON
+	DumpBinary                       // length-prefixed binary records
+	DumpBinaryZstd                   // binary records compressed by zstd
+)
+
+var dumpFormatNames = []string{"json", "binary", "binary-zstd"}
+
+func (f DumpFormat) String() string {
+	if int(f) < len(dumpFormatNames) {
+		return dumpFormatNames[f]
+	}
+	return fmt.Sprintf("DumpFormat(%d)", f)
+}
+
+// ParseDumpFormat returns the DumpFormat of name: json, binary or binary-zstd.
+func ParseDumpFormat(name string) (DumpFormat, error) {
+	for i, n := range dumpFormatNames {
+		if n == name {
+			return DumpFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown dump format %q, should be one of %s", name, strings.Join(dumpFormatNames, ", "))
+}
+
+// dumpWriter writes the dumped entries in the order of a depth-first traversal: the entries under a
+// directory are written between beginDir and endDir of it, depth is the indent level used by JSON.
+type dumpWriter interface {
+	beginDir(e *DumpedEntry, depth int) error
+	writeEntry(e *DumpedEntry, depth int) error
+	endDir(depth int) error
+	finish() error
+}
+
+// newDumpWriter writes the header (everything but the trees) of dm in format, and returns a writer for the trees.
+func newDumpWriter(w io.Writer, dm *DumpedMeta, format DumpFormat) (dumpWriter, error) {
+	switch format {
+	case DumpJSON:
+		bw, err := dm.writeJsonWithOutTree(w)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonDumper{bw: bw, first: []bool{true}}, nil
+	case DumpBinary, DumpBinaryZstd:
+		return newBinaryDumper(w, dm, format == DumpBinaryZstd)
+	default:
+		return nil, fmt.Errorf("unknown dump format %d", format)
+	}
+}
+
+type jsonDumper struct {
+	bw    *bufio.Writer
+	first []bool // whether the next entry is the first one in the directories being written
+}
+
+func (d *jsonDumper) next() error {
+	top := len(d.first) - 1
+	if d.first[top] {
+		d.first[top] = false
+		return nil
+	}
+	_, err := d.bw.WriteString(",")
+	return err
+}
+
+func (d *jsonDumper) beginDir(e *DumpedEntry, depth int) error {
+	if err := d.next(); err != nil {
+		return err
+	}
+	if err := e.writeJsonWithOutEntry(d.bw, depth); err != nil {
+		return err
+	}
+	d.first = append(d.first, true)
+	return nil
+}
+
+func (d *jsonDumper) writeEntry(e *DumpedEntry, depth int) error {
+	if err := d.next(); err != nil {
+		return err
+	}
+	return e.writeJSON(d.bw, depth)
+}
+
+func (d *jsonDumper) endDir(depth int) error {
+	d.first = d.first[:len(d.first)-1]
+	_, err := d.bw.WriteString(fmt.Sprintf("\n%s}\n%s}", strings.Repeat(jsonIndent, depth+1), strings.Repeat(jsonIndent, depth)))
+	return err
+}
+
+func (d *jsonDumper) finish() error {
+	if _, err := d.bw.WriteString("\n}\n"); err != nil {
+		return err
+	}
+	return d.bw.Flush()
+}
+
 func dumpAttr(a *Attr) *DumpedAttr {
 	d := &DumpedAttr{
 		Type:      typeToString(a.Typ),
@@ -227,52 +391,3 @@ func loadAttr(d *DumpedAttr) *Attr {
 		Full:      true,
 	} // Length and Parent not set
 }
-
-func collectEntry(e *DumpedEntry, entries map[Ino]*DumpedEntry, showProgress func(totalIncr, currentIncr int64)) error {
-	typ := typeFromString(e.Attr.Type)
-	inode := e.Attr.Inode
-	if showProgress != nil {
-		if typ == TypeDirectory {
-			showProgress(int64(len(e.Entries)), 1)
-		} else {
-			showProgress(0, 1)
-		}
-	}
-
-	if exist, ok := entries[inode]; ok {
-		attr := e.Attr
-		eattr := exist.Attr
-		if typ != TypeFile || typeFromString(eattr.Type) != TypeFile {
-			return fmt.Errorf("inode conflict: %d", inode)
-		}
-		eattr.Nlink++
-		if eattr.Ctime*1e9+int64(eattr.Ctimensec) < attr.Ctime*1e9+int64(attr.Ctimensec) {
-			attr.Nlink = eattr.Nlink
-			entries[inode] = e
-		}
-		return nil
-	}
-	entries[inode] = e
-
-	if typ == TypeFile {
-		e.Attr.Nlink = 1 // reset
-	} else if typ == TypeDirectory {
-		if inode == 1 || inode == TrashInode { // root or trash inode
-			e.Parent = 1
-		}
-		e.Attr.Nlink = 2
-		for name, child := range e.Entries {
-			child.Name = name
-			child.Parent = inode
-			if typeFromString(child.Attr.Type) == TypeDirectory {
-				e.Attr.Nlink++
-			}
-			if err := collectEntry(child, entries, showProgress); err != nil {
-				return err
-			}
-		}
-	} else if e.Attr.Nlink != 1 { // nlink should be 1 for other types
-		return fmt.Errorf("invalid nlink %d for inode %d type %s", e.Attr.Nlink, inode, e.Attr.Type)
-	}
-	return nil
-}
@@ -0,0 +1,672 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+	"github.com/juicedata/juicefs/pkg/acl"
+)
+
+// The binary dump starts with a header (magic, version and flags), followed by a sequence of records:
+//
+//	type (1 byte) | length of payload (uvarint) | payload
+//
+// The records after the header are compressed as a single zstd stream if the flag is set. The payloads
+// are encoded as protobuf messages, in which unknown fields are ignored (as well as unknown records),
+// so new fields can be added without bumping the version. The entries are written in the same order as
+// JSON: a directory is a dirBegin record, followed by all the entries under it and then a dirEnd record.
+// The last record is end, so a truncated dump can be detected.
+
+var binaryMagic = []byte("JFSDUMP")
+
+const (
+	binaryVersion  = 1
+	binaryFlagZstd = 1 << 0
+	maxRecordSize  = 1 << 30
+)
+
+// types of records
+const (
+	recSetting   = iota + 1 // JSON of Format
+	recCounters             // 1-7: the fields of DumpedCounters
+	recSustained            // 1: sid, 2: inodes (repeated)
+	recDelFile              // 1: inode, 2: length, 3: expire
+	recDirBegin             // an entry (see encodeEntry) of directory
+	recEntry                // an entry other than directory
+	recDirEnd               // empty
+	recEnd                  // empty
+	recPack                 // 1: id, 2: size, 3: slices (repeated, 1: chunkid, 2: off, 3: len)
+	recDedup                // 1: hash, 2: chunkid, 3: indx, 4: size, 5: refs (repeated, 1: chunkid, 2: indx)
+	recSliceTier            // 1: chunkid, 2: tier
+)
+
+// wire types of protobuf
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type pbEncoder struct {
+	buf []byte
+}
+
+func (e *pbEncoder) reset() {
+	e.buf = e.buf[:0]
+}
+
+func (e *pbEncoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *pbEncoder) uint(field int, v uint64) {
+	if v != 0 {
+		e.varint(uint64(field<<3 | wireVarint))
+		e.varint(v)
+	}
+}
+
+func (e *pbEncoder) int(field int, v int64) {
+	e.uint(field, uint64(v<<1)^uint64(v>>63)) // zigzag
+}
+
+func (e *pbEncoder) bytes(field int, v []byte) {
+	e.varint(uint64(field<<3 | wireBytes))
+	e.varint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *pbEncoder) string(field int, v string) {
+	if v != "" {
+		e.bytes(field, []byte(v))
+	}
+}
+
+func (e *pbEncoder) message(field int, encode func(e *pbEncoder)) {
+	var sub pbEncoder
+	encode(&sub)
+	e.bytes(field, sub.buf)
+}
+
+type pbDecoder struct {
+	buf []byte
+}
+
+func (d *pbDecoder) done() bool {
+	return len(d.buf) == 0
+}
+
+func (d *pbDecoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid varint")
+	}
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+// next returns the next field, with the value of varint in v or the content of bytes in data.
+func (d *pbDecoder) next() (field int, v uint64, data []byte, err error) {
+	var key uint64
+	if key, err = d.varint(); err != nil {
+		return
+	}
+	field = int(key >> 3)
+	switch key & 7 {
+	case wireVarint:
+		v, err = d.varint()
+	case wireBytes:
+		if v, err = d.varint(); err == nil {
+			if v > uint64(len(d.buf)) {
+				return 0, 0, nil, fmt.Errorf("invalid length %d of field %d", v, field)
+			}
+			data, d.buf = d.buf[:v], d.buf[v:]
+		}
+	case wireFixed64, wireFixed32:
+		size := 8
+		if key&7 == wireFixed32 {
+			size = 4
+		}
+		if len(d.buf) < size {
+			return 0, 0, nil, fmt.Errorf("invalid fixed field %d", field)
+		}
+		d.buf = d.buf[size:]
+	default:
+		err = fmt.Errorf("unknown wire type %d of field %d", key&7, field)
+	}
+	return
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func encodeEntry(e *pbEncoder, de *DumpedEntry) {
+	a := de.Attr
+	e.string(1, de.Name)
+	e.uint(2, uint64(a.Inode))
+	e.uint(3, uint64(typeFromString(a.Type)))
+	e.uint(4, uint64(a.Mode))
+	e.uint(5, uint64(a.Uid))
+	e.uint(6, uint64(a.Gid))
+	e.int(7, a.Atime)
+	e.int(8, a.Mtime)
+	e.int(9, a.Ctime)
+	e.uint(10, uint64(a.Atimensec))
+	e.uint(11, uint64(a.Mtimensec))
+	e.uint(12, uint64(a.Ctimensec))
+	e.uint(13, uint64(a.Nlink))
+	e.uint(14, a.Length)
+	e.uint(15, uint64(a.Rdev))
+	e.string(16, de.Symlink)
+	for _, x := range de.Xattrs {
+		e.message(17, func(e *pbEncoder) {
+			e.string(1, x.Name)
+			e.string(2, x.Value)
+		})
+	}
+	if de.AccessACL != nil {
+		e.bytes(18, de.AccessACL.Encode())
+	}
+	if de.DefaultACL != nil {
+		e.bytes(19, de.DefaultACL.Encode())
+	}
+	for _, c := range de.Chunks {
+		e.message(20, func(e *pbEncoder) {
+			e.uint(1, uint64(c.Index))
+			for _, s := range c.Slices {
+				e.message(2, func(e *pbEncoder) {
+					e.uint(1, s.Chunkid)
+					e.uint(2, uint64(s.Pos))
+					e.uint(3, uint64(s.Size))
+					e.uint(4, uint64(s.Off))
+					e.uint(5, uint64(s.Len))
+				})
+			}
+		})
+	}
+	if len(de.Inline) > 0 {
+		e.bytes(21, de.Inline)
+	}
+}
+
+func decodeEntry(buf []byte) (*DumpedEntry, error) {
+	a := &DumpedAttr{}
+	de := &DumpedEntry{Attr: a}
+	d := &pbDecoder{buf}
+	for !d.done() {
+		field, v, data, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			de.Name = string(data)
+		case 2:
+			a.Inode = Ino(v)
+		case 3:
+			a.Type = typeToString(uint8(v))
+		case 4:
+			a.Mode = uint16(v)
+		case 5:
+			a.Uid = uint32(v)
+		case 6:
+			a.Gid = uint32(v)
+		case 7:
+			a.Atime = zigzag(v)
+		case 8:
+			a.Mtime = zigzag(v)
+		case 9:
+			a.Ctime = zigzag(v)
+		case 10:
+			a.Atimensec = uint32(v)
+		case 11:
+			a.Mtimensec = uint32(v)
+		case 12:
+			a.Ctimensec = uint32(v)
+		case 13:
+			a.Nlink = uint32(v)
+		case 14:
+			a.Length = v
+		case 15:
+			a.Rdev = uint32(v)
+		case 16:
+			de.Symlink = string(data)
+		case 17:
+			x := &DumpedXattr{}
+			if err = decodeFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					x.Name = string(data)
+				case 2:
+					x.Value = string(data)
+				}
+				return nil
+			}); err != nil {
+				return nil, err
+			}
+			de.Xattrs = append(de.Xattrs, x)
+		case 18:
+			if de.AccessACL, err = acl.Decode(data); err != nil {
+				return nil, err
+			}
+		case 19:
+			if de.DefaultACL, err = acl.Decode(data); err != nil {
+				return nil, err
+			}
+		case 20:
+			c, err := decodeChunk(data)
+			if err != nil {
+				return nil, err
+			}
+			de.Chunks = append(de.Chunks, c)
+		case 21:
+			de.Inline = append([]byte{}, data...)
+		}
+	}
+	return de, nil
+}
+
+func decodeChunk(buf []byte) (*DumpedChunk, error) {
+	c := &DumpedChunk{Slices: []*DumpedSlice{}}
+	err := decodeFields(buf, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			c.Index = uint32(v)
+		case 2:
+			s := &DumpedSlice{}
+			c.Slices = append(c.Slices, s)
+			return decodeFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					s.Chunkid = v
+				case 2:
+					s.Pos = uint32(v)
+				case 3:
+					s.Size = uint32(v)
+				case 4:
+					s.Off = uint32(v)
+				case 5:
+					s.Len = uint32(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return c, err
+}
+
+func decodeFields(buf []byte, handler func(field int, v uint64, data []byte) error) error {
+	d := &pbDecoder{buf}
+	for !d.done() {
+		field, v, data, err := d.next()
+		if err != nil {
+			return err
+		}
+		if err = handler(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type binaryDumper struct {
+	bw  *bufio.Writer // the underlying writer
+	zw  io.WriteCloser
+	w   *bufio.Writer // the writer of records
+	enc pbEncoder
+}
+
+func newBinaryDumper(w io.Writer, dm *DumpedMeta, compress bool) (*binaryDumper, error) {
+	if dm.FSTree != nil || dm.Trash != nil {
+		return nil, fmt.Errorf("invalid dumped meta")
+	}
+	d := &binaryDumper{bw: bufio.NewWriterSize(w, jsonWriteSize)}
+	var flags byte
+	if compress {
+		flags |= binaryFlagZstd
+	}
+	if _, err := d.bw.Write(append(append([]byte{}, binaryMagic...), binaryVersion, flags)); err != nil {
+		return nil, err
+	}
+	d.w = d.bw
+	if compress {
+		d.zw = zstd.NewWriter(d.bw)
+		d.w = bufio.NewWriterSize(d.zw, jsonWriteSize)
+	}
+
+	setting, err := json.Marshal(dm.Setting)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.writeRecord(recSetting, setting); err != nil {
+		return nil, err
+	}
+	if cs := dm.Counters; cs != nil {
+		d.enc.reset()
+		for i, v := range []int64{cs.UsedSpace, cs.UsedInodes, cs.NextInode, cs.NextChunk, cs.NextSession, cs.NextTrash, cs.NextCleanupSlices} {
+			d.enc.int(i+1, v)
+		}
+		if err = d.writeRecord(recCounters, d.enc.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range dm.Sustained {
+		d.enc.reset()
+		d.enc.uint(1, s.Sid)
+		for _, inode := range s.Inodes {
+			d.enc.uint(2, uint64(inode))
+		}
+		if err = d.writeRecord(recSustained, d.enc.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range dm.DelFiles {
+		d.enc.reset()
+		d.enc.uint(1, uint64(f.Inode))
+		d.enc.uint(2, f.Length)
+		d.enc.int(3, f.Expire)
+		if err = d.writeRecord(recDelFile, d.enc.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range dm.Packs {
+		d.enc.reset()
+		d.enc.uint(1, p.Id)
+		d.enc.uint(2, uint64(p.Size))
+		for _, s := range p.Slices {
+			d.enc.message(3, func(e *pbEncoder) {
+				e.uint(1, s.Chunkid)
+				e.uint(2, uint64(s.Off))
+				e.uint(3, uint64(s.Len))
+			})
+		}
+		if err = d.writeRecord(recPack, d.enc.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range dm.Dedup {
+		d.enc.reset()
+		d.enc.string(1, b.Hash)
+		d.enc.uint(2, b.Chunkid)
+		d.enc.uint(3, uint64(b.Indx))
+		d.enc.uint(4, uint64(b.Size))
+		for _, r := range b.Refs {
+			d.enc.message(5, func(e *pbEncoder) {
+				e.uint(1, r.Chunkid)
+				e.uint(2, uint64(r.Indx))
+			})
+		}
+		if err = d.writeRecord(recDedup, d.enc.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range dm.Tiers {
+		d.enc.reset()
+		d.enc.uint(1, t.Chunkid)
+		d.enc.uint(2, uint64(t.Tier))
+		if err = d.writeRecord(recSliceTier, d.enc.buf); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *binaryDumper) writeRecord(typ byte, payload []byte) error {
+	var head [1 + binary.MaxVarintLen64]byte
+	head[0] = typ
+	n := binary.PutUvarint(head[1:], uint64(len(payload)))
+	if _, err := d.w.Write(head[:n+1]); err != nil {
+		return err
+	}
+	_, err := d.w.Write(payload)
+	return err
+}
+
+func (d *binaryDumper) beginDir(e *DumpedEntry, depth int) error {
+	d.enc.reset()
+	encodeEntry(&d.enc, e)
+	return d.writeRecord(recDirBegin, d.enc.buf)
+}
+
+func (d *binaryDumper) writeEntry(e *DumpedEntry, depth int) error {
+	d.enc.reset()
+	encodeEntry(&d.enc, e)
+	return d.writeRecord(recEntry, d.enc.buf)
+}
+
+func (d *binaryDumper) endDir(depth int) error {
+	return d.writeRecord(recDirEnd, nil)
+}
+
+func (d *binaryDumper) finish() error {
+	if err := d.writeRecord(recEnd, nil); err != nil {
+		return err
+	}
+	if d.zw != nil {
+		if err := d.w.Flush(); err != nil {
+			return err
+		}
+		if err := d.zw.Close(); err != nil {
+			return err
+		}
+	}
+	return d.bw.Flush()
+}
+
+// loadBinary parses a binary dump, the header of which is not consumed yet.
+func (l *loader) loadBinary(r *bufio.Reader) error {
+	header := make([]byte, len(binaryMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	version, flags := header[len(binaryMagic)], header[len(binaryMagic)+1]
+	if version != binaryVersion {
+		return fmt.Errorf("unsupported version %d of binary dump", version)
+	}
+	if flags&binaryFlagZstd != 0 {
+		zr := zstd.NewReader(r)
+		defer zr.Close()
+		r = bufio.NewReaderSize(zr, jsonWriteSize)
+	}
+
+	type dir struct {
+		e       *DumpedEntry
+		subdirs uint32
+	}
+	var dirs []*dir // the directories being loaded
+	var buf []byte
+	for {
+		typ, err := r.ReadByte()
+		if err == nil {
+			var size uint64
+			if size, err = binary.ReadUvarint(r); err == nil {
+				if size > maxRecordSize {
+					return fmt.Errorf("record %d is too large: %d", typ, size)
+				}
+				if uint64(cap(buf)) < size {
+					buf = make([]byte, size)
+				}
+				buf = buf[:size]
+				_, err = io.ReadFull(r, buf)
+			}
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("read record: %s (is the dump truncated?)", err)
+		}
+
+		switch typ {
+		case recSetting:
+			err = json.Unmarshal(buf, &l.dm.Setting)
+		case recCounters:
+			var vs [7]int64
+			err = decodeFields(buf, func(field int, v uint64, data []byte) error {
+				if field >= 1 && field <= len(vs) {
+					vs[field-1] = zigzag(v)
+				}
+				return nil
+			})
+			l.dm.Counters = &DumpedCounters{vs[0], vs[1], vs[2], vs[3], vs[4], vs[5], vs[6]}
+		case recSustained:
+			s := &DumpedSustained{}
+			err = decodeFields(buf, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					s.Sid = v
+				case 2:
+					s.Inodes = append(s.Inodes, Ino(v))
+				}
+				return nil
+			})
+			l.dm.Sustained = append(l.dm.Sustained, s)
+		case recDelFile:
+			f := &DumpedDelFile{}
+			err = decodeFields(buf, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					f.Inode = Ino(v)
+				case 2:
+					f.Length = v
+				case 3:
+					f.Expire = zigzag(v)
+				}
+				return nil
+			})
+			l.dm.DelFiles = append(l.dm.DelFiles, f)
+		case recPack:
+			p := &DumpedPack{}
+			err = decodeFields(buf, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					p.Id = v
+				case 2:
+					p.Size = uint32(v)
+				case 3:
+					s := &DumpedPackedSlice{}
+					p.Slices = append(p.Slices, s)
+					return decodeFields(data, func(field int, v uint64, data []byte) error {
+						switch field {
+						case 1:
+							s.Chunkid = v
+						case 2:
+							s.Off = uint32(v)
+						case 3:
+							s.Len = uint32(v)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			l.dm.Packs = append(l.dm.Packs, p)
+		case recDedup:
+			b := &DumpedDedupBlock{}
+			err = decodeFields(buf, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					b.Hash = string(data)
+				case 2:
+					b.Chunkid = v
+				case 3:
+					b.Indx = uint32(v)
+				case 4:
+					b.Size = uint32(v)
+				case 5:
+					r := &DumpedBlockRef{}
+					b.Refs = append(b.Refs, r)
+					return decodeFields(data, func(field int, v uint64, data []byte) error {
+						switch field {
+						case 1:
+							r.Chunkid = v
+						case 2:
+							r.Indx = uint32(v)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			l.dm.Dedup = append(l.dm.Dedup, b)
+		case recSliceTier:
+			t := &DumpedSliceTier{}
+			err = decodeFields(buf, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					t.Chunkid = v
+				case 2:
+					t.Tier = uint8(v)
+				}
+				return nil
+			})
+			l.dm.Tiers = append(l.dm.Tiers, t)
+		case recDirBegin, recEntry:
+			var e *DumpedEntry
+			if e, err = decodeEntry(buf); err != nil {
+				break
+			}
+			if len(dirs) > 0 {
+				e.Parent = dirs[len(dirs)-1].e.Attr.Inode
+			} else if typ == recEntry {
+				return fmt.Errorf("entry %q is not in any directory", e.Name)
+			} else if e.Attr.Inode != TrashInode {
+				e.Attr.Inode = 1 // the root of a sub directory
+			}
+			if typ == recDirBegin {
+				dirs = append(dirs, &dir{e: e})
+				break
+			}
+			t := typeFromString(e.Attr.Type)
+			if t == TypeDirectory {
+				dirs[len(dirs)-1].subdirs++
+			}
+			err = l.add(e, t, 0)
+		case recDirEnd:
+			if len(dirs) == 0 {
+				return fmt.Errorf("unexpected end of directory")
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if len(dirs) > 0 {
+				dirs[len(dirs)-1].subdirs++
+			} else {
+				d.e.Parent = 1 // root or trash
+			}
+			err = l.add(d.e, TypeDirectory, d.subdirs)
+		case recEnd:
+			if len(dirs) > 0 {
+				return fmt.Errorf("directory %q is not ended", dirs[len(dirs)-1].e.Name)
+			}
+			return l.flush()
+		}
+		if err != nil {
+			return fmt.Errorf("load record %d: %s", typ, err)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+)
+
+// CheckMeta loads all the nodes, entries, chunks and references of slices into memory, and checks
+// the consistency between them:
+//   - entries pointing to missing nodes, or under missing directories
+//   - nodes (not deleted) without any entry pointing to them, which are moved into /lost+found
+//   - nlink of nodes, which is the number of entries for files, or 2 plus the number of
+//     sub-directories for directories
+//   - data in chunks beyond the length of files, which is hidden by a zero slice
+//   - references of slices, which should be the number of chunks using them
+//   - the counters of used space and inodes
+//
+// The metadata should not be changed by any client during the check, otherwise some false
+// inconsistencies could be reported. Only the entries and nodes under dpath are checked if it's
+// not the root, while the orphans, slices and counters are only checked for the whole volume.
+
+const lostFoundName = "lost+found"
+
+// metaVisitor is called by doScanMeta with all the records of metadata.
+type metaVisitor struct {
+	node     func(inode Ino, attr *Attr)
+	edge     func(parent Ino, name string, inode Ino, typ uint8)
+	chunk    func(inode Ino, indx uint32, ss []*slice)
+	sliceRef func(chunkid uint64, size uint32, refs int64) // the number of references
+
+	implicitRef bool // set by the engine if the slices without a record are referenced once
+}
+
+type checkedNode struct {
+	typ     uint8
+	nlink   uint32
+	length  uint64
+	links   uint32 // the number of entries pointing to it
+	subdirs uint32
+}
+
+type checkedEntry struct {
+	name  string
+	inode Ino
+	typ   uint8
+}
+
+type checkedSlice struct {
+	id   uint64
+	size uint32
+}
+
+type metaChecker struct {
+	m         *baseMeta
+	ctx       Context
+	repair    bool
+	nodes     map[Ino]*checkedNode
+	entries   map[Ino][]*checkedEntry // by parent
+	tails     map[Ino]map[uint32]uint32
+	used      map[checkedSlice]int64 // the number of chunks using it
+	refs      map[checkedSlice]int64 // the recorded references
+	implicit  bool
+	lostFound Ino
+	broken    int
+	repaired  int
+}
+
+// fix reports an inconsistency, and repairs it by fn if repair is enabled.
+func (c *metaChecker) fix(fn func() error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	c.broken++
+	logger.Warnf("%s", msg)
+	if !c.repair {
+		return nil
+	}
+	if err := fn(); err != nil {
+		return fmt.Errorf("repair (%s): %s", msg, err)
+	}
+	c.repaired++
+	logger.Infof("Repaired: %s", msg)
+	return nil
+}
+
+func (c *metaChecker) scan() error {
+	v := &metaVisitor{
+		node: func(inode Ino, attr *Attr) {
+			c.nodes[inode] = &checkedNode{typ: attr.Typ, nlink: attr.Nlink, length: attr.Length}
+		},
+		edge: func(parent Ino, name string, inode Ino, typ uint8) {
+			c.entries[parent] = append(c.entries[parent], &checkedEntry{name, inode, typ})
+		},
+		chunk: func(inode Ino, indx uint32, ss []*slice) {
+			for _, s := range ss {
+				if s.chunkid > 0 {
+					c.used[checkedSlice{s.chunkid, s.size}]++
+				}
+			}
+			// the end of visible data in this chunk
+			var pos, end uint32
+			for _, s := range buildSlice(ss) {
+				pos += s.Len
+				if s.Chunkid > 0 {
+					end = pos
+				}
+			}
+			if end > 0 {
+				if c.tails[inode] == nil {
+					c.tails[inode] = make(map[uint32]uint32)
+				}
+				c.tails[inode][indx] = end
+			}
+		},
+		sliceRef: func(chunkid uint64, size uint32, refs int64) {
+			c.refs[checkedSlice{chunkid, size}] = refs
+		},
+	}
+	if err := c.m.en.doScanMeta(v); err != nil {
+		return err
+	}
+	c.implicit = v.implicitRef
+	return nil
+}
+
+func (m *baseMeta) CheckMeta(ctx Context, dpath string, repair bool) error {
+	inode, st := m.resolveDir(ctx, dpath)
+	if st != 0 {
+		return fmt.Errorf("resolve %s: %s", dpath, st)
+	}
+	c := &metaChecker{
+		m:       m,
+		ctx:     ctx,
+		repair:  repair,
+		nodes:   make(map[Ino]*checkedNode),
+		entries: make(map[Ino][]*checkedEntry),
+		tails:   make(map[Ino]map[uint32]uint32),
+		used:    make(map[checkedSlice]int64),
+		refs:    make(map[checkedSlice]int64),
+	}
+	if err := c.scan(); err != nil {
+		return fmt.Errorf("scan metadata: %s", err)
+	}
+	var nentry int
+	for _, es := range c.entries {
+		nentry += len(es)
+	}
+	logger.Infof("Scanned %d nodes, %d entries and %d slices", len(c.nodes), nentry, len(c.used))
+
+	var scope map[Ino]bool // the checked nodes, nil for all
+	if inode != 1 {
+		scope = c.walk(inode)
+	}
+	if err := c.checkEntries(scope); err != nil {
+		return err
+	}
+	for parent, es := range c.entries {
+		for _, e := range es {
+			if n := c.nodes[e.inode]; n != nil {
+				n.links++
+				if n.typ == TypeDirectory && c.nodes[parent] != nil {
+					c.nodes[parent].subdirs++
+				}
+			}
+		}
+	}
+	if scope == nil {
+		if err := c.checkOrphans(); err != nil {
+			return err
+		}
+	}
+	if err := c.checkNlinks(scope); err != nil {
+		return err
+	}
+	if err := c.checkTails(scope); err != nil {
+		return err
+	}
+	if scope == nil {
+		if err := c.checkSlices(); err != nil {
+			return err
+		}
+		if err := c.checkCounters(); err != nil {
+			return err
+		}
+	}
+	if c.repaired > 0 {
+		m.syncDirStats()
+		m.syncChanges()
+	}
+	if c.broken > c.repaired {
+		return fmt.Errorf("found %d inconsistencies in metadata", c.broken)
+	}
+	logger.Infof("Found %d inconsistencies in metadata, %d repaired", c.broken, c.repaired)
+	return nil
+}
+
+// walk returns the directory inode and all the nodes under it.
+func (c *metaChecker) walk(inode Ino) map[Ino]bool {
+	scope := map[Ino]bool{inode: true}
+	dirs := []Ino{inode}
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		for _, e := range c.entries[dir] {
+			if !scope[e.inode] {
+				scope[e.inode] = true
+				if n := c.nodes[e.inode]; n != nil && n.typ == TypeDirectory {
+					dirs = append(dirs, e.inode)
+				}
+			}
+		}
+	}
+	return scope
+}
+
+func (c *metaChecker) sortedNodes(scope map[Ino]bool) []Ino {
+	inodes := make([]Ino, 0, len(c.nodes))
+	for inode := range c.nodes {
+		if scope == nil || scope[inode] {
+			inodes = append(inodes, inode)
+		}
+	}
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+	return inodes
+}
+
+func (c *metaChecker) checkEntries(scope map[Ino]bool) error {
+	parents := make([]Ino, 0, len(c.entries))
+	for parent := range c.entries {
+		if scope == nil || scope[parent] {
+			parents = append(parents, parent)
+		}
+	}
+	sort.Slice(parents, func(i, j int) bool { return parents[i] < parents[j] })
+	for _, parent := range parents {
+		pn := c.nodes[parent]
+		var kept []*checkedEntry
+		for _, e := range c.entries[parent] {
+			e := e
+			n := c.nodes[e.inode]
+			var err error
+			if pn == nil || pn.typ != TypeDirectory {
+				err = c.fix(func() error { return c.m.en.doSetEntry(parent, e.name, 0, 0) },
+					"Entry %q (%d) is under %d, which is not an existing directory", e.name, e.inode, parent)
+			} else if n == nil {
+				err = c.fix(func() error { return c.m.en.doSetEntry(parent, e.name, 0, 0) },
+					"Entry %q in directory %d points to a missing node %d", e.name, parent, e.inode)
+			} else {
+				kept = append(kept, e)
+				if e.typ != n.typ {
+					err = c.fix(func() error { return c.m.en.doSetEntry(parent, e.name, e.inode, n.typ) },
+						"Entry %q in directory %d has type %d, but node %d has type %d", e.name, parent, e.typ, e.inode, n.typ)
+					e.typ = n.typ
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		c.entries[parent] = kept // as if they were removed, to find the orphans
+	}
+	return nil
+}
+
+// checkOrphans finds the nodes not deleted but without any entry, and moves them into /lost+found.
+func (c *metaChecker) checkOrphans() error {
+	for _, inode := range c.sortedNodes(nil) {
+		n := c.nodes[inode]
+		if n.links > 0 || n.nlink == 0 || inode == 1 || inode == TrashInode || inode == SnapshotInode {
+			continue
+		}
+		inode := inode
+		err := c.fix(func() error {
+			lf, err := c.getLostFound()
+			if err != nil {
+				return err
+			}
+			name := strconv.FormatUint(uint64(inode), 10)
+			if err = c.m.en.doSetEntry(lf, name, inode, n.typ); err != nil {
+				return err
+			}
+			c.entries[lf] = append(c.entries[lf], &checkedEntry{name, inode, n.typ})
+			n.links++
+			if n.typ == TypeDirectory {
+				// the parent of a directory should be updated too
+				if err = c.m.en.doSetNlink(inode, 2+n.subdirs, lf); err != nil {
+					return err
+				}
+				n.nlink = 2 + n.subdirs
+				ln := c.nodes[lf]
+				if err = c.m.en.doSetNlink(lf, ln.nlink+1, 0); err != nil {
+					return err
+				}
+				ln.nlink++
+				ln.subdirs++
+			}
+			if s, st := c.m.entryStat(c.ctx, inode, &Attr{Typ: n.typ, Length: n.length}); st == 0 {
+				c.m.addDirStat(c.ctx, lf, s)
+			}
+			return nil
+		}, "Node %d (type %d, nlink %d) is not referenced by any entry", inode, n.typ, n.nlink)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getLostFound returns the inode of /lost+found, which is created if not exists.
+func (c *metaChecker) getLostFound() (Ino, error) {
+	if c.lostFound > 0 {
+		return c.lostFound, nil
+	}
+	var inode Ino
+	var attr Attr
+	st := c.m.Mkdir(c.ctx, 1, lostFoundName, 0700, 0, 0, &inode, &attr)
+	if st == syscall.EEXIST {
+		if st = c.m.en.doLookup(c.ctx, 1, lostFoundName, &inode, &attr); st == 0 && attr.Typ != TypeDirectory {
+			st = syscall.ENOTDIR
+		}
+	} else if st == 0 {
+		c.nodes[inode] = &checkedNode{typ: TypeDirectory, nlink: attr.Nlink, length: attr.Length, links: 1}
+		c.entries[1] = append(c.entries[1], &checkedEntry{lostFoundName, inode, TypeDirectory})
+		if root := c.nodes[1]; root != nil {
+			root.nlink++
+			root.subdirs++
+		}
+	}
+	if st != 0 {
+		return 0, fmt.Errorf("mkdir /%s: %s", lostFoundName, st)
+	}
+	if c.nodes[inode] == nil { // created by others during the check
+		c.nodes[inode] = &checkedNode{typ: TypeDirectory, nlink: attr.Nlink, length: attr.Length, links: 1, subdirs: attr.Nlink - 2}
+	}
+	c.lostFound = inode
+	return inode, nil
+}
+
+func (c *metaChecker) checkNlinks(scope map[Ino]bool) error {
+	for _, inode := range c.sortedNodes(scope) {
+		n := c.nodes[inode]
+		if inode == TrashInode || inode == SnapshotInode {
+			continue // the nlink of them is not updated
+		}
+		if n.links == 0 && n.typ != TypeDirectory {
+			continue // deleted or orphan
+		}
+		expected := n.links
+		if n.typ == TypeDirectory {
+			expected = 2 + n.subdirs
+		}
+		if n.nlink == expected {
+			continue
+		}
+		inode := inode
+		err := c.fix(func() error {
+			if err := c.m.en.doSetNlink(inode, expected, 0); err != nil {
+				return err
+			}
+			n.nlink = expected
+			return nil
+		}, "Nlink of node %d is %d, should be %d", inode, n.nlink, expected)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTails finds the data beyond the length of files, which should have been hidden when it's truncated.
+func (c *metaChecker) checkTails(scope map[Ino]bool) error {
+	for _, inode := range c.sortedNodes(scope) {
+		n := c.nodes[inode]
+		if n.typ != TypeFile || n.nlink == 0 || c.tails[inode] == nil {
+			continue
+		}
+		indexes := make([]uint32, 0, len(c.tails[inode]))
+		for indx := range c.tails[inode] {
+			indexes = append(indexes, indx)
+		}
+		sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+		for _, indx := range indexes {
+			start, end := uint64(indx)*ChunkSize, c.tails[inode][indx]
+			if start+uint64(end) <= n.length {
+				continue
+			}
+			var off uint32
+			if n.length > start {
+				off = uint32(n.length - start)
+			}
+			inode, indx := inode, indx
+			err := c.fix(func() error {
+				return c.m.en.doAppendSlice(inode, indx, marshalSlice(off, 0, 0, 0, end-off))
+			}, "Chunk %d of file %d has data up to %d, beyond its length %d", indx, inode, start+uint64(end), n.length)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSlices compares the references of slices with the number of chunks using them.
+func (c *metaChecker) checkSlices() error {
+	all := make([]checkedSlice, 0, len(c.used))
+	for s := range c.used {
+		all = append(all, s)
+	}
+	for s := range c.refs {
+		if _, ok := c.used[s]; !ok {
+			all = append(all, s)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].id < all[j].id || all[i].id == all[j].id && all[i].size < all[j].size
+	})
+	for _, s := range all {
+		used := c.used[s]
+		refs, ok := c.refs[s]
+		if !ok && c.implicit {
+			refs = 1
+		}
+		if refs == used || refs == 0 && used == 0 {
+			continue
+		}
+		s := s
+		err := c.fix(func() error { return c.m.en.doSetSliceRefs(s.id, s.size, used) },
+			"Slice %d (size %d) is used by %d chunks, but has %d references", s.id, s.size, used, refs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCounters compares the counters of used space and inodes with the nodes, including the
+// unlinked ones which are still opened.
+func (c *metaChecker) checkCounters() error {
+	var space, inodes int64
+	for inode, n := range c.nodes {
+		if inode == 1 || inode == TrashInode || inode == SnapshotInode {
+			continue
+		}
+		space += nodeStat(&Attr{Typ: n.typ, Length: n.length}).space
+		inodes++
+	}
+	for _, cnt := range []struct {
+		name     string
+		pending  *int64
+		expected int64
+	}{{usedSpace, &c.m.newSpace, space}, {totalInodes, &c.m.newInodes, inodes}} {
+		c.m.flushMu.Lock() // the pending changes could be taken by flushStats but not added yet
+		cnt := cnt
+		// the changes made by this client (lost+found) may not be flushed yet
+		pending := atomic.SwapInt64(cnt.pending, 0)
+		cur, err := c.m.en.getCounter(cnt.name)
+		if err != nil {
+			atomic.AddInt64(cnt.pending, pending)
+			c.m.flushMu.Unlock()
+			return fmt.Errorf("get counter %s: %s", cnt.name, err)
+		}
+		diff := cnt.expected - cur - pending
+		if diff != 0 {
+			err = c.fix(func() error {
+				_, err := c.m.en.incrCounter(cnt.name, pending+diff)
+				if err == nil {
+					pending = 0
+				}
+				return err
+			}, "Counter %s is %d, should be %d", cnt.name, cur+pending, cnt.expected)
+		}
+		atomic.AddInt64(cnt.pending, pending)
+		c.m.flushMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import "fmt"
+
+// The data of tiny files (no larger than Format.InlineSize) can be stored in the meta engine together with
+// the attributes, so they are read and written without accessing the object storage. A file becomes inline
+// when it's written for the first time (empty and without chunks), then FlagInline is set in its attributes
+// until it's promoted. When a write goes beyond the inline size, the client writes the inline data into
+// object storage together with the new data, and the first slice committed by Write clears the flag and
+// removes the inline data in the same transaction, so the file is readable all the time. The inline data
+// is trimmed by Truncate, while Fallocate and CopyFileRange return ENOTSUP for inline files, the client
+// should promote them and try again.
+
+const MaxInlineSize = 32 << 10 // the max size of data stored inline
+
+// ValidInlineSize returns an error if the size can't be used as the inline size of a volume.
+func ValidInlineSize(size int) error {
+	if size < 0 || size > MaxInlineSize {
+		return fmt.Errorf("invalid inline size %d, should be between 0 and %d", size, MaxInlineSize)
+	}
+	return nil
+}
+
+// writeInline returns the inline data after writing buf into it at off.
+func writeInline(data []byte, off uint64, buf []byte) []byte {
+	if end := off + uint64(len(buf)); end > uint64(len(data)) {
+		data = append(data, make([]byte, end-uint64(len(data)))...)
+	}
+	copy(data[off:], buf)
+	return data
+}
@@ -24,6 +24,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
 )
@@ -41,6 +42,18 @@ const (
 	Info = 1003
 	// FillCache is a message to build cache for target directories/files
 	FillCache = 1004
+	// Clone is a message to clone a file or directory by duplicating its metadata.
+	Clone = 1005
+	// Watch is a message to read the changes under a directory from the change log.
+	Watch = 1006
+	// InvalidateCache is a message to invalidate the caches of a change made by other clients.
+	InvalidateCache = 1007
+	// DeletePack is a message to delete a pack from object store.
+	DeletePack = 1008
+	// CompactPack is a message to move the live slices of a pack into a new one in object store.
+	CompactPack = 1009
+	// DeleteBlock is a message to delete a block (shared or not) from object store.
+	DeleteBlock = 1010
 )
 
 const (
@@ -72,6 +85,53 @@ const (
 	SetAttrMtimeNow
 )
 
+const (
+	// CloneModePreserveAttr keeps the owner, mode and times of the source nodes in the clone.
+	CloneModePreserveAttr = 1 << iota
+)
+
+const (
+	// QuotaSet sets the quota of a directory, user or group.
+	QuotaSet uint8 = iota
+	// QuotaGet gets the quota and usage of a directory, user or group.
+	QuotaGet
+	// QuotaDel removes the quota of a directory, user or group.
+	QuotaDel
+	// QuotaList lists all the quotas of the given type.
+	QuotaList
+	// QuotaCheck recalculates the usage and compares it with the recorded one.
+	QuotaCheck
+)
+
+const (
+	// SnapshotCreate takes a snapshot of a directory.
+	SnapshotCreate uint8 = iota
+	// SnapshotList lists all the snapshots.
+	SnapshotList
+	// SnapshotDel removes a snapshot.
+	SnapshotDel
+	// SnapshotRestore restores a snapshot as a new directory.
+	SnapshotRestore
+)
+
+const (
+	// DirQuota limits a directory and its children, the target is the path of the directory.
+	DirQuota uint8 = iota
+	// UserQuota limits the files owned by a user, the target is the uid.
+	UserQuota
+	// GroupQuota limits the files owned by a group, the target is the gid.
+	GroupQuota
+)
+
+const (
+	// FlagAccessACL marks a node having an extended access ACL.
+	FlagAccessACL = 1 << iota
+	// FlagDefaultACL marks a directory having a default ACL.
+	FlagDefaultACL
+	// FlagInline marks a file whose data is stored inline in the meta engine.
+	FlagInline
+)
+
 const TrashInode = 0x7FFFFFFF10000000 // larger than vfs.minInternalNode
 const TrashName = ".trash"
 
@@ -79,6 +139,19 @@ func isTrash(ino Ino) bool {
 	return ino >= TrashInode
 }
 
+const SnapshotInode = 0x7FFFFFFF0F000000 // larger than vfs.minInternalNode, smaller than TrashInode
+const SnapshotName = ".snapshots"
+
+// The nodes in snapshots are allocated from a separated range below the internal nodes of vfs (.control,
+// .stats and so on), so they can be recognized without any lookup.
+const snapshotInodeBase = 0x7000000000000000
+const snapshotInodeEnd = 0x7FFFFFFF00000000 // vfs.minInternalNode
+
+// isSnapshot returns true if the node is in a snapshot or the root of all the snapshots, which are read-only.
+func isSnapshot(ino Ino) bool {
+	return ino >= snapshotInodeBase && ino < snapshotInodeEnd || ino == SnapshotInode
+}
+
 type internalNode struct {
 	inode Ino
 	name  string
@@ -89,7 +162,7 @@ type MsgCallback func(...interface{}) error
 
 // Attr represents attributes of a node.
 type Attr struct {
-	Flags     uint8  // reserved flags
+	Flags     uint8  // flags of a node, e.g. FlagAccessACL
 	Typ       uint8  // type of a node
 	Mode      uint16 // permission mode
 	Uid       uint32 // owner id
@@ -202,6 +275,24 @@ type Summary struct {
 	Dirs   uint64
 }
 
+// Quota represents the limits and usage of a directory, user or group.
+// A limit of 0 means unlimited.
+type Quota struct {
+	MaxSpace   int64
+	MaxInodes  int64
+	UsedSpace  int64
+	UsedInodes int64
+	newSpace   int64
+	newInodes  int64
+}
+
+// Snapshot represents a read-only copy of a directory taken at some point in time.
+type Snapshot struct {
+	Inode Ino
+	Time  int64 // when the snapshot is taken, in seconds
+	Summary
+}
+
 type SessionInfo struct {
 	Version    string
 	HostName   string
@@ -305,10 +396,19 @@ type Meta interface {
 	NewChunk(ctx Context, chunkid *uint64) syscall.Errno
 	// Write put a slice of data on top of the given chunk.
 	Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno
+	// ReadInline returns the attributes and the data of a file stored inline, or ENODATA if it's not inline.
+	// The data could be shorter than the file, the rest of it is zeros.
+	ReadInline(ctx Context, inode Ino, attr *Attr, data *[]byte) syscall.Errno
+	// WriteInline writes data into a file stored inline, or an empty one which has not been written.
+	// It returns ENODATA if the file has data in chunks, or EFBIG if it would exceed the inline size.
+	WriteInline(ctx Context, inode Ino, off uint64, data []byte) syscall.Errno
 	// InvalidateChunkCache invalidate chunk cache
 	InvalidateChunkCache(ctx Context, inode Ino, indx uint32) syscall.Errno
 	// CopyFileRange copies part of a file to another one.
 	CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno
+	// Clone copies a file or directory as dstName under dstParentIno by duplicating its metadata only,
+	// count is increased for every node cloned, and total is set to the number of nodes to be cloned.
+	Clone(ctx Context, srcIno, dstParentIno Ino, dstName string, cmode uint8, cumask uint16, count, total *uint64) syscall.Errno
 
 	// GetXattr returns the value of extended attribute for given name.
 	GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno
@@ -318,6 +418,10 @@ type Meta interface {
 	SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
 	// RemoveXattr removes the extended attribute of a node.
 	RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	// GetFacl returns the access or default ACL of a node, or ENOATTR if it's not set.
+	GetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno
+	// SetFacl sets the access or default ACL of a node, the ACL is removed if rule is nil.
+	SetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno
 	// Flock tries to put a lock on given file.
 	Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno
 	// Getlk returns the current lock owner for a range on a file.
@@ -329,13 +433,66 @@ type Meta interface {
 	CompactAll(ctx Context, bar *utils.Bar) syscall.Errno
 	// ListSlices returns all slices used by all files.
 	ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno
+	// AddPack records the slices packed into an object, which should be uploaded already.
+	AddPack(ctx Context, pack *Pack, slices []PackedSlice) syscall.Errno
+	// GetPacked returns the location of a packed slice, or ENOENT if it's not packed.
+	GetPacked(ctx Context, chunkid uint64, s *PackedSlice) syscall.Errno
+	// ListPacks returns all the packs.
+	ListPacks(ctx Context, packs *[]*Pack) syscall.Errno
+	// ListPacked iterates all the packed slices.
+	ListPacked(ctx Context, fn func(s *PackedSlice)) syscall.Errno
+	// RemovePacked removes a packed slice which is not used by any file, and the pack once nothing in it is alive.
+	RemovePacked(ctx Context, chunkid uint64) syscall.Errno
+	// CompactPacks rewrites the packs with less than half of the contents alive.
+	CompactPacks(ctx Context) syscall.Errno
+	// RefBlock adds a reference to the block with the same content (hash), or returns ENOENT if there is none.
+	RefBlock(ctx Context, hash []byte, b *Block, owner *Block) syscall.Errno
+	// AddBlock records a block uploaded with the content (hash), or returns EEXIST if there is one already.
+	AddBlock(ctx Context, hash []byte, b *Block) syscall.Errno
+	// FindBlock returns the shared block used by a block of slice, or ENOENT if it's not shared.
+	FindBlock(ctx Context, chunkid uint64, indx uint32, owner *Block) syscall.Errno
+	// DerefSlice removes the references from the blocks of an aborted slice, and deletes the ones not used anymore.
+	DerefSlice(ctx Context, chunkid uint64, size uint32) syscall.Errno
+	// ListDedupBlocks returns all the shared blocks with the references to them.
+	ListDedupBlocks(ctx Context, fn func(hash []byte, owner *Block, refs []Block)) syscall.Errno
+	// SetSliceTier records the storage tier of a slice (0 means the primary storage).
+	SetSliceTier(ctx Context, chunkid uint64, tier uint8) syscall.Errno
+	// GetSliceTier returns the storage tier of a slice.
+	GetSliceTier(ctx Context, chunkid uint64, tier *uint8) syscall.Errno
+	// ListSliceTiers iterates all the slices not in the primary storage.
+	ListSliceTiers(ctx Context, fn func(chunkid uint64, tier uint8)) syscall.Errno
 
 	// OnMsg add a callback for the given message type.
 	OnMsg(mtype uint32, cb MsgCallback)
 
+	// HandleQuota sets, gets, removes, lists or checks the quotas of directories, users or groups.
+	HandleQuota(ctx Context, cmd uint8, qtype uint8, target string, quotas map[string]*Quota, repair bool) error
+	// HandleSnapshot creates, lists, removes or restores the snapshots of directories,
+	// dpath is the source directory to create a snapshot, or the destination to restore it.
+	HandleSnapshot(ctx Context, cmd uint8, name string, dpath string, snapshots map[string]*Snapshot) error
+	// GetDirStat adds the statistics of all the entries under a directory recursively to summary,
+	// it returns ENOTSUP if the statistics of the directory are not maintained.
+	GetDirStat(ctx Context, inode Ino, summary *Summary) syscall.Errno
+	// CheckDirStats checks the statistics of a directory and all its sub-directories, and repairs the broken ones if repair is true.
+	CheckDirStats(ctx Context, dpath string, repair bool) error
+	// CheckMeta checks the consistency of metadata under a directory, and repairs the broken ones if repair is true.
+	CheckMeta(ctx Context, dpath string, repair bool) error
+	// ListTrash returns the entries in trash deleted since the given time, which match the pattern with their original
+	// paths (or any of the parents), or their names if there is no "/" in the pattern.
+	ListTrash(ctx Context, pattern string, since time.Time) ([]*TrashEntry, error)
+	// RestoreTrash moves the entries in trash back to their original locations, or into dst if it's not empty.
+	RestoreTrash(ctx Context, entries []*TrashEntry, dst string) error
+
 	// Dump the tree under root, which may be modified by checkRoot
-	DumpMeta(w io.Writer, root Ino) error
+	DumpMeta(w io.Writer, root Ino, format DumpFormat) error
 	LoadMeta(r io.Reader) error
+
+	// LastChange returns the id of the latest change in the change log.
+	LastChange(ctx Context) (uint64, error)
+	// ReadChanges returns at most limit changes after cursor (the id of the last change read) in the change log.
+	ReadChanges(ctx Context, cursor uint64, limit int) ([]*Change, error)
+	// NewWatcher returns a watcher of the changes under a directory, starting after cursor.
+	NewWatcher(root Ino, cursor uint64) *Watcher
 }
 
 type Creator func(driver, addr string, conf *Config) (Meta, error)
@@ -75,3 +75,24 @@ func Test_setPasswordFromEnv(t *testing.T) {
 		})
 	}
 }
+
+func TestIsSnapshot(t *testing.T) {
+	for _, c := range []struct {
+		ino  Ino
+		want bool
+	}{
+		{1, false},
+		{snapshotInodeBase - 1, false},
+		{snapshotInodeBase, true},
+		{snapshotInodeEnd - 1, true},
+		{snapshotInodeEnd, false},     // vfs.minInternalNode
+		{snapshotInodeEnd + 2, false}, // .control
+		{SnapshotInode, true},
+		{SnapshotInode + 1, false},
+		{TrashInode, false},
+	} {
+		if got := isSnapshot(c.ino); got != c.want {
+			t.Errorf("isSnapshot(%#x) = %v, want %v", uint64(c.ino), got, c.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// If Format.CacheInvalidation is enabled, the changes made by a client are published to all the other
+// clients, so they can invalidate their caches (the kernel caches of entries and attributes, the data
+// cached by readers and the chunks of opened files) without waiting for them to expire. The changes are
+// published in batches as soon as possible, a message is the session id of the publisher followed by the
+// changes, and the messages published by a client itself are ignored.
+//
+// Redis uses pub/sub, the other engines save the messages with continuous ids allocated from the counter
+// nextInvalidation, which are polled by the clients and removed after invalidationTTL.
+
+const (
+	invalidationCounter  = "nextInvalidation"
+	invalidationInterval = time.Millisecond * 100 // the interval to poll the messages
+	invalidationTTL      = time.Minute
+	invalidationBatch    = 1000 // the max number of changes in a message
+)
+
+func (m *baseMeta) invalidationEnabled() bool {
+	return m.fmt.CacheInvalidation
+}
+
+// publishInvalidation buffers a change to be published to other clients.
+func (m *baseMeta) publishInvalidation(c *Change) {
+	m.invalMu.Lock()
+	if c.Op == ChangeWrite {
+		if m.invalWriting[c.Inode] {
+			m.invalMu.Unlock()
+			return // merged into the previous one
+		}
+		m.invalWriting[c.Inode] = true
+	} else {
+		delete(m.invalWriting, c.Inode)
+	}
+	if len(m.invalidations) < maxPending {
+		m.invalidations = append(m.invalidations, c)
+	}
+	m.invalMu.Unlock()
+	select {
+	case m.invalReady <- struct{}{}:
+	default:
+	}
+}
+
+func (m *baseMeta) publishInvalidations() {
+	for range m.invalReady {
+		m.invalMu.Lock()
+		changes := m.invalidations
+		m.invalidations = nil
+		m.invalWriting = make(map[Ino]bool)
+		m.invalMu.Unlock()
+		for len(changes) > 0 {
+			n := len(changes)
+			if n > invalidationBatch {
+				n = invalidationBatch
+			}
+			// the caches of other clients will expire anyway, so the failed ones are not retried
+			if err := m.en.doPublishInvalidations(encodeInvalidations(m.sid, changes[:n])); err != nil {
+				logger.Warnf("publish %d invalidations: %s", n, err)
+			}
+			changes = changes[n:]
+		}
+	}
+}
+
+func encodeInvalidations(sid uint64, changes []*Change) []byte {
+	bufs := make([][]byte, len(changes))
+	size := 8
+	for i, c := range changes {
+		bufs[i] = c.marshal()
+		size += 2 + len(bufs[i])
+	}
+	w := utils.NewBuffer(uint32(size))
+	w.Put64(sid)
+	for _, b := range bufs {
+		w.Put16(uint16(len(b)))
+		w.Put(b)
+	}
+	return w.Bytes()
+}
+
+func decodeInvalidations(msg []byte) (uint64, []*Change, error) {
+	if len(msg) < 8 {
+		return 0, nil, fmt.Errorf("invalid message: %v", msg)
+	}
+	rb := utils.ReadBuffer(msg)
+	sid := rb.Get64()
+	var changes []*Change
+	for rb.HasMore() {
+		if rb.Left() < 2 {
+			return 0, nil, fmt.Errorf("invalid message of session %d", sid)
+		}
+		size := int(rb.Get16())
+		if rb.Left() < size {
+			return 0, nil, fmt.Errorf("invalid message of session %d", sid)
+		}
+		c := &Change{}
+		if err := c.unmarshal(rb.Get(size)); err != nil {
+			return 0, nil, err
+		}
+		changes = append(changes, c)
+	}
+	return sid, changes, nil
+}
+
+func (m *baseMeta) subscribeInvalidations() {
+	for {
+		if m.invalidationEnabled() {
+			if err := m.en.doSubscribeInvalidations(m.handleInvalidations); err != nil {
+				logger.Warnf("subscribe invalidations: %s", err)
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// handleInvalidations invalidates the caches of the changes made by other clients, and sends them to the
+// callback of InvalidateCache, with the root of a sub directory mounted as 1.
+func (m *baseMeta) handleInvalidations(msg []byte) {
+	sid, changes, err := decodeInvalidations(msg)
+	if err != nil {
+		logger.Warnf("decode invalidations: %s", err)
+		return
+	}
+	if sid == m.sid && sid > 0 {
+		return
+	}
+	m.msgCallbacks.Lock()
+	cb := m.msgCallbacks.callbacks[InvalidateCache]
+	m.msgCallbacks.Unlock()
+	for _, c := range changes {
+		for _, inode := range []*Ino{&c.Inode, &c.Parent, &c.DstParent} {
+			if *inode == 0 {
+				continue
+			}
+			m.of.InvalidateChunk(*inode, 0xFFFFFFFF)
+			if *inode == m.root {
+				*inode = 1
+			}
+		}
+		if cb != nil {
+			_ = cb(c)
+		}
+	}
+}
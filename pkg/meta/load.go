@@ -0,0 +1,363 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// The dump is parsed as a stream, and the entries are written in batches once they are complete, so the
+// memory used does not depend on the size of the dump. A directory is complete after all its children,
+// and a hard link is written as a new edge to the node written for the first one.
+//
+// The number of entries written is saved together with each batch, so an interrupted loading can be
+// resumed by loading the same dump again: the entries before the checkpoint are parsed but skipped.
+
+const (
+	loadBatchSlices = 10000
+	loadedEntries   = "loadedEntries" // counter of the checkpoint
+)
+
+var loadBatchEntries = 1000
+
+type loadedSlice struct {
+	id   uint64
+	size uint32
+}
+
+type loadBatch struct {
+	entries []*DumpedEntry // new nodes, together with the edges to them
+	links   []*DumpedEntry // more edges to the hard linked files written before
+	slices  map[loadedSlice]int64
+	nslices int
+	loaded  uint64 // the number of entries written after this batch
+}
+
+func (b *loadBatch) empty() bool {
+	return len(b.entries) == 0 && len(b.links) == 0
+}
+
+func (b *loadBatch) full() bool {
+	return len(b.entries)+len(b.links) >= loadBatchEntries || b.nslices >= loadBatchSlices
+}
+
+type loader struct {
+	m        *baseMeta
+	dec      *json.Decoder // nil for binary dump
+	dm       *DumpedMeta
+	cs       *DumpedCounters
+	checked  uint64 // the number of entries written before (the checkpoint)
+	count    uint64
+	links    map[Ino]uint32 // the number of edges to the hard linked files
+	expected map[Ino]uint32 // the nlink of hard linked files in dump
+	batch    *loadBatch
+	bar      *utils.Bar
+}
+
+func (l *loader) expectDelim(d json.Delim) error {
+	t, err := l.dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != d {
+		return fmt.Errorf("expect %s, but got %v at offset %d", d, t, l.dec.InputOffset())
+	}
+	return nil
+}
+
+// readKey returns the next key of an object, or empty string if the object is closed.
+func (l *loader) readKey() (string, error) {
+	t, err := l.dec.Token()
+	if err != nil {
+		return "", err
+	}
+	switch t := t.(type) {
+	case string:
+		return t, nil
+	case json.Delim:
+		if t == '}' {
+			return "", nil
+		}
+	}
+	return "", fmt.Errorf("unexpected token %v at offset %d", t, l.dec.InputOffset())
+}
+
+func (l *loader) skipValue() error {
+	var v json.RawMessage
+	return l.dec.Decode(&v)
+}
+
+func (l *loader) load() error {
+	if err := l.expectDelim('{'); err != nil {
+		return err
+	}
+	for {
+		key, err := l.readKey()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "":
+			return l.flush()
+		case "Setting":
+			err = l.dec.Decode(&l.dm.Setting)
+		case "Counters":
+			err = l.dec.Decode(&l.dm.Counters)
+		case "Sustained":
+			err = l.dec.Decode(&l.dm.Sustained)
+		case "DelFiles":
+			err = l.dec.Decode(&l.dm.DelFiles)
+		case "Packs":
+			err = l.dec.Decode(&l.dm.Packs)
+		case "Dedup":
+			err = l.dec.Decode(&l.dm.Dedup)
+		case "Tiers":
+			err = l.dec.Decode(&l.dm.Tiers)
+		case "FSTree":
+			_, err = l.loadEntry("", 0)
+		case "Trash":
+			_, err = l.loadEntry("", 0)
+		default:
+			err = l.skipValue()
+		}
+		if err != nil {
+			return fmt.Errorf("load %s: %s", key, err)
+		}
+	}
+}
+
+// loadEntry parses an entry and all the entries under it, and returns the type of it.
+func (l *loader) loadEntry(name string, parent Ino) (uint8, error) {
+	if err := l.expectDelim('{'); err != nil {
+		return 0, err
+	}
+	e := &DumpedEntry{Name: name, Parent: parent}
+	var subdirs uint32
+	for {
+		key, err := l.readKey()
+		if err != nil {
+			return 0, err
+		}
+		if key == "" {
+			break
+		}
+		switch key {
+		case "attr":
+			if err = l.dec.Decode(&e.Attr); err == nil && parent == 0 && e.Attr.Inode != TrashInode {
+				e.Attr.Inode = 1 // the root of a sub directory
+			}
+		case "symlink":
+			err = l.dec.Decode(&e.Symlink)
+		case "inline":
+			err = l.dec.Decode(&e.Inline)
+		case "xattrs":
+			err = l.dec.Decode(&e.Xattrs)
+		case "posix_acl_access":
+			err = l.dec.Decode(&e.AccessACL)
+		case "posix_acl_default":
+			err = l.dec.Decode(&e.DefaultACL)
+		case "chunks":
+			err = l.dec.Decode(&e.Chunks)
+		case "entries":
+			if e.Attr == nil {
+				return 0, fmt.Errorf("attr of %q should be ahead of its entries", name)
+			}
+			if err = l.expectDelim('{'); err != nil {
+				return 0, err
+			}
+			for {
+				var cname string
+				if cname, err = l.readKey(); err != nil || cname == "" {
+					break
+				}
+				var typ uint8
+				if typ, err = l.loadEntry(cname, e.Attr.Inode); err != nil {
+					return 0, err
+				}
+				if typ == TypeDirectory {
+					subdirs++
+				}
+			}
+		default:
+			err = l.skipValue()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("entry %q: %s", name, err)
+		}
+	}
+	if e.Attr == nil {
+		return 0, fmt.Errorf("no attr for entry %q", name)
+	}
+	typ := typeFromString(e.Attr.Type)
+	if parent == 0 {
+		e.Parent = 1 // root or trash
+	}
+	return typ, l.add(e, typ, subdirs)
+}
+
+func (l *loader) add(e *DumpedEntry, typ uint8, subdirs uint32) error {
+	inode := e.Attr.Inode
+	l.count++
+	if l.count > l.checked {
+		l.batch.loaded = l.count
+	} else {
+		l.bar.Increment()
+	}
+	switch typ {
+	case TypeDirectory:
+		e.Attr.Nlink = 2 + subdirs
+	case TypeFile:
+		if e.Attr.Nlink > 1 {
+			if n, ok := l.links[inode]; ok {
+				l.links[inode] = n + 1
+				if l.count > l.checked {
+					l.batch.links = append(l.batch.links, e)
+				}
+				return l.checkBatch()
+			}
+			l.links[inode] = 1
+			l.expected[inode] = e.Attr.Nlink
+		} else {
+			e.Attr.Nlink = 1
+		}
+	default:
+		if e.Attr.Nlink != 1 { // nlink should be 1 for other types
+			return fmt.Errorf("invalid nlink %d for inode %d type %s", e.Attr.Nlink, inode, e.Attr.Type)
+		}
+	}
+
+	cs := l.cs
+	var length uint64
+	switch typ {
+	case TypeFile:
+		length = e.Attr.Length
+	case TypeDirectory:
+		length = 4 << 10
+	case TypeSymlink:
+		length = uint64(len(e.Symlink))
+	}
+	if inode > 1 && inode != TrashInode {
+		cs.UsedSpace += align4K(length)
+		cs.UsedInodes += 1
+	}
+	if inode < TrashInode {
+		if cs.NextInode <= int64(inode) {
+			cs.NextInode = int64(inode) + 1
+		}
+	} else if cs.NextTrash < int64(inode)-TrashInode {
+		cs.NextTrash = int64(inode) - TrashInode
+	}
+	for _, c := range e.Chunks {
+		for _, s := range c.Slices {
+			if cs.NextChunk <= int64(s.Chunkid) {
+				cs.NextChunk = int64(s.Chunkid) + 1
+			}
+			if l.count > l.checked && s.Chunkid > 0 {
+				l.batch.slices[loadedSlice{s.Chunkid, s.Size}]++
+				l.batch.nslices++
+			}
+		}
+	}
+	if l.count > l.checked {
+		l.batch.entries = append(l.batch.entries, e)
+	}
+	return l.checkBatch()
+}
+
+func (l *loader) checkBatch() error {
+	if l.batch.full() {
+		return l.flush()
+	}
+	return nil
+}
+
+func (l *loader) flush() error {
+	b := l.batch
+	if b.empty() {
+		return nil
+	}
+	if err := l.m.en.doLoadEntries(b); err != nil {
+		return err
+	}
+	l.bar.IncrInt64(int64(len(b.entries) + len(b.links)))
+	l.batch = &loadBatch{slices: make(map[loadedSlice]int64)}
+	return nil
+}
+
+// LoadMeta loads the metadata dumped by DumpMeta (in any format) into an empty volume, or resumes the interrupted loading.
+func (m *baseMeta) LoadMeta(r io.Reader) error {
+	checked, err := m.en.doLoadStart()
+	if err != nil {
+		return err
+	}
+	if checked > 0 {
+		logger.Infof("Resume loading after %d entries", checked)
+	}
+
+	progress := utils.NewProgress(false, false)
+	l := &loader{
+		m:        m,
+		dm:       &DumpedMeta{},
+		cs:       &DumpedCounters{NextInode: 2, NextChunk: 1},
+		checked:  checked,
+		links:    make(map[Ino]uint32),
+		expected: make(map[Ino]uint32),
+		batch:    &loadBatch{slices: make(map[loadedSlice]int64)},
+		bar:      progress.AddCountSpinner("Loaded entries"),
+	}
+	br := bufio.NewReaderSize(r, jsonWriteSize)
+	if head, _ := br.Peek(len(binaryMagic)); bytes.Equal(head, binaryMagic) {
+		err = l.loadBinary(br)
+	} else {
+		l.dec = json.NewDecoder(br)
+		err = l.load()
+	}
+	if err != nil {
+		return err
+	}
+	if l.count < checked {
+		return fmt.Errorf("only %d entries found, but %d were loaded before, is it the same file?", l.count, checked)
+	}
+	progress.Done()
+
+	nlinks := make(map[Ino]uint32)
+	for inode, n := range l.links {
+		if n != l.expected[inode] {
+			nlinks[inode] = n
+		}
+	}
+	if l.dm.Counters != nil {
+		logger.Infof("Dumped counters: %+v", *l.dm.Counters)
+	}
+	logger.Infof("Loaded counters: %+v", *l.cs)
+	if err = m.loadPacks(l.dm.Packs); err != nil {
+		return err
+	}
+	if err = m.loadDedup(l.dm.Dedup); err != nil {
+		return err
+	}
+	if err = m.loadSliceTiers(l.dm.Tiers); err != nil {
+		return err
+	}
+	return m.en.doLoadFinish(l.dm, l.cs, nlinks)
+}
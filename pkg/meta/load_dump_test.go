@@ -17,6 +17,7 @@
 package meta
 
 import (
+	"bytes"
 	"os"
 	"os/exec"
 	"path"
@@ -85,7 +86,7 @@ func testDump(t *testing.T, m Meta, root Ino, expect, result string) {
 	if _, err = m.Load(true); err != nil {
 		t.Fatalf("load setting: %s", err)
 	}
-	if err = m.DumpMeta(fp, root); err != nil {
+	if err = m.DumpMeta(fp, root, DumpJSON); err != nil {
 		t.Fatalf("dump meta: %s", err)
 	}
 	cmd := exec.Command("diff", expect, result)
@@ -136,3 +137,79 @@ func TestLoadDump(t *testing.T) {
 		testDump(t, m, 0, sampleFile, "tkv.dump")
 	})
 }
+
+func TestLoadResume(t *testing.T) {
+	old := loadBatchEntries
+	loadBatchEntries = 2
+	defer func() { loadBatchEntries = old }()
+	data, err := os.ReadFile(sampleFile)
+	if err != nil {
+		t.Fatalf("read %s: %s", sampleFile, err)
+	}
+
+	uris := map[string]string{
+		"sqlite3": "sqlite3://" + path.Join(t.TempDir(), "jfs-load-resume-test.db"),
+		"tkv":     "memkv://test/jfs",
+	}
+	for name, uri := range uris {
+		_ = os.Remove(settingPath)
+		m := NewClient(uri, &Config{Retries: 10, Strict: true})
+		if err = m.Reset(); err != nil {
+			t.Fatalf("reset meta: %s", err)
+		}
+		if err = m.LoadMeta(bytes.NewReader(data[:len(data)*2/3])); err == nil {
+			t.Fatalf("load a truncated dump should fail")
+		}
+		var base *baseMeta
+		switch m := m.(type) {
+		case *dbMeta:
+			base = &m.baseMeta
+		case *kvMeta:
+			base = &m.baseMeta
+		}
+		if loaded, err := base.en.doLoadStart(); err != nil || loaded == 0 {
+			t.Fatalf("checkpoint of %s: %d %s", name, loaded, err)
+		}
+		if err = m.LoadMeta(bytes.NewReader(data)); err != nil {
+			t.Fatalf("resume loading: %s", err)
+		}
+		if err = m.LoadMeta(bytes.NewReader(data)); err == nil {
+			t.Fatalf("load into a non-empty volume should fail")
+		}
+		testDump(t, m, 1, sampleFile, name+"_resume.dump")
+	}
+}
+
+func TestLoadDumpBinary(t *testing.T) {
+	uris := map[string]string{
+		"sqlite3": "sqlite3://" + path.Join(t.TempDir(), "jfs-load-dump-binary-test.db"),
+		"tkv":     "memkv://test/jfs",
+	}
+	for name, uri := range uris {
+		for _, format := range []DumpFormat{DumpBinary, DumpBinaryZstd} {
+			_ = os.Remove(settingPath)
+			m := testLoad(t, uri, sampleFile)
+			if _, err := m.Load(true); err != nil {
+				t.Fatalf("load setting: %s", err)
+			}
+			var buf bytes.Buffer
+			if err := m.DumpMeta(&buf, 1, format); err != nil {
+				t.Fatalf("dump %s: %s", format, err)
+			}
+			if err := m.Reset(); err != nil {
+				t.Fatalf("reset meta: %s", err)
+			}
+			data := buf.Bytes()
+			if err := m.LoadMeta(bytes.NewReader(data[:len(data)-1])); err == nil {
+				t.Fatalf("load a truncated %s dump should fail", format)
+			}
+			if err := m.Reset(); err != nil {
+				t.Fatalf("reset meta: %s", err)
+			}
+			if err := m.LoadMeta(bytes.NewReader(data)); err != nil {
+				t.Fatalf("load %s: %s", format, err)
+			}
+			testDump(t, m, 1, sampleFile, name+"_"+format.String()+".dump")
+		}
+	}
+}
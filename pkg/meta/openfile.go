@@ -103,6 +103,27 @@ func (o *openfiles) Check(ino Ino, attr *Attr) bool {
 	return false
 }
 
+// Cached returns the cached attributes of a file even if they are expired.
+func (o *openfiles) Cached(ino Ino, attr *Attr) bool {
+	o.Lock()
+	defer o.Unlock()
+	of, ok := o.files[ino]
+	if ok {
+		*attr = of.attr
+	}
+	return ok
+}
+
+// UpdateAtime updates the access time in the cached attributes.
+func (o *openfiles) UpdateAtime(ino Ino, atime time.Time) {
+	o.Lock()
+	defer o.Unlock()
+	if of, ok := o.files[ino]; ok {
+		of.attr.Atime = atime.Unix()
+		of.attr.Atimensec = uint32(atime.Nanosecond())
+	}
+}
+
 func (o *openfiles) Update(ino Ino, attr *Attr) bool {
 	if attr == nil {
 		panic("attr is nil")
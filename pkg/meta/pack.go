@@ -0,0 +1,261 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// Small slices can be packed into shared objects (packs) by clients when Format.PackSize is set, to reduce the
+// number of objects and requests to the object storage. A pack is uploaded before the slices in it are recorded
+// by AddPack, then they are written into files as usual (the ones left by crashed clients before that are removed
+// by gc with RemovePacked). When a packed slice is not used anymore, it's removed from the pack together with
+// its reference, and the pack is deleted (DeletePack) once nothing in it is alive.
+// The packs with less than half of the contents alive are rewritten by CompactPacks (CompactPack), which moves
+// the live slices into a new pack and deletes the old one.
+
+// Pack is an object holding the data of packed slices.
+type Pack struct {
+	Id   uint64
+	Size uint32 // size of the object
+	Live uint32 // bytes used by the slices alive
+}
+
+// PackedSlice is the location of a slice in a pack.
+type PackedSlice struct {
+	Chunkid uint64
+	Pack    uint64
+	Off     uint32
+	Len     uint32 // length of the data in the pack, which could be compressed
+}
+
+// ValidPackSize returns an error if the size (in KiB) can't be used as the pack size of a volume.
+func ValidPackSize(size int) error {
+	if size < 0 || size > ChunkSize>>10 {
+		return fmt.Errorf("invalid pack size %d, should be between 0 and %d", size, ChunkSize>>10)
+	}
+	return nil
+}
+
+func (m *baseMeta) AddPack(ctx Context, pack *Pack, slices []PackedSlice) syscall.Errno {
+	defer timeit(time.Now())
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	pack.Live = 0
+	for i := range slices {
+		slices[i].Pack = pack.Id
+		pack.Live += slices[i].Len
+	}
+	return errno(m.en.doAddPack(pack, slices))
+}
+
+func (m *baseMeta) GetPacked(ctx Context, chunkid uint64, s *PackedSlice) syscall.Errno {
+	if m.fmt.PackSize == 0 {
+		return syscall.ENOENT // packing can not be disabled once enabled
+	}
+	defer timeit(time.Now())
+	return m.en.doGetPacked(chunkid, s)
+}
+
+func (m *baseMeta) ListPacks(ctx Context, packs *[]*Pack) syscall.Errno {
+	ps, err := m.en.doListPacks()
+	if err != nil {
+		return errno(err)
+	}
+	*packs = ps
+	return 0
+}
+
+func (m *baseMeta) ListPacked(ctx Context, fn func(s *PackedSlice)) syscall.Errno {
+	return errno(m.en.doListPacked(fn))
+}
+
+func (m *baseMeta) RemovePacked(ctx Context, chunkid uint64) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	defer timeit(time.Now())
+	pack, err := m.en.doDeletePacked(chunkid, 0) // there is no reference to it
+	if err != nil {
+		return errno(err)
+	}
+	if pack > 0 {
+		m.deletePack(pack)
+	}
+	return 0
+}
+
+// deletePacked removes a packed slice and its reference, it returns false if the slice is not packed.
+func (m *baseMeta) deletePacked(chunkid uint64, size uint32) bool {
+	if m.fmt.PackSize == 0 || int(size) > m.fmt.BlockSize<<10 {
+		return false
+	}
+	pack, err := m.en.doDeletePacked(chunkid, size)
+	if err == syscall.ENOENT {
+		return false
+	} else if err != nil {
+		logger.Warnf("delete packed slice %d: %s", chunkid, err)
+	} else if pack > 0 {
+		m.deletePack(pack)
+	}
+	return true
+}
+
+func (m *baseMeta) deletePack(pack uint64) {
+	if err := m.newMsg(DeletePack, pack); err != nil {
+		logger.Warnf("delete pack %d: %s", pack, err) // it will be removed by gc
+	}
+}
+
+func (m *baseMeta) compactPacks() {
+	for {
+		utils.SleepWithJitter(time.Hour)
+		if m.fmt.PackSize == 0 {
+			continue
+		}
+		if ok, err := m.en.setIfSmall("nextCompactPacks", time.Now().Unix(), 3600); err != nil {
+			logger.Warnf("checking counter nextCompactPacks: %s", err)
+		} else if ok {
+			if st := m.CompactPacks(Background); st != 0 {
+				logger.Warnf("compact packs: %s", st)
+			}
+		}
+	}
+}
+
+func (m *baseMeta) CompactPacks(ctx Context) syscall.Errno {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	packs, err := m.en.doListPacks()
+	if err != nil {
+		return errno(err)
+	}
+	todo := make(map[uint64][]PackedSlice)
+	for _, p := range packs {
+		if p.Live*2 < p.Size {
+			todo[p.Id] = nil
+		}
+	}
+	if len(todo) == 0 {
+		return 0
+	}
+	err = m.en.doListPacked(func(s *PackedSlice) {
+		if ss, ok := todo[s.Pack]; ok {
+			todo[s.Pack] = append(ss, *s)
+		}
+	})
+	if err != nil {
+		return errno(err)
+	}
+	for old, slices := range todo {
+		if st := m.compactPack(ctx, old, slices); st != 0 {
+			return st
+		}
+	}
+	return 0
+}
+
+// compactPack moves the live slices of a pack into a new one, and deletes the old pack.
+func (m *baseMeta) compactPack(ctx Context, old uint64, slices []PackedSlice) syscall.Errno {
+	var pack Pack
+	if len(slices) > 0 {
+		if st := m.NewChunk(ctx, &pack.Id); st != 0 {
+			return st
+		}
+		// the handler writes the slices into the new pack, and updates the locations of them
+		if err := m.newMsg(CompactPack, old, slices, &pack); err != nil {
+			logger.Warnf("compact pack %d into %d: %s", old, pack.Id, err)
+			return 0
+		}
+	}
+	if err := m.en.doRepack(old, &pack, slices); err != nil {
+		logger.Warnf("update slices of pack %d: %s", old, err)
+		if pack.Id > 0 {
+			m.deletePack(pack.Id)
+		}
+		return errno(err)
+	}
+	logger.Debugf("compact pack %d into %d (%d bytes)", old, pack.Id, pack.Live)
+	if pack.Id > 0 && pack.Live == 0 {
+		m.deletePack(pack.Id) // all of them were deleted
+	}
+	m.deletePack(old)
+	return 0
+}
+
+func marshalPacked(s *PackedSlice) []byte {
+	b := utils.NewBuffer(16)
+	b.Put64(s.Pack)
+	b.Put32(s.Off)
+	b.Put32(s.Len)
+	return b.Bytes()
+}
+
+func unmarshalPacked(chunkid uint64, buf []byte, s *PackedSlice) {
+	rb := utils.ReadBuffer(buf)
+	s.Chunkid = chunkid
+	s.Pack = rb.Get64()
+	s.Off = rb.Get32()
+	s.Len = rb.Get32()
+}
+
+// dumpPacks returns all the packs with the slices in them.
+func (m *baseMeta) dumpPacks() ([]*DumpedPack, error) {
+	packs, err := m.en.doListPacks()
+	if err != nil || len(packs) == 0 {
+		return nil, err
+	}
+	dumped := make(map[uint64]*DumpedPack, len(packs))
+	for _, p := range packs {
+		dumped[p.Id] = &DumpedPack{Id: p.Id, Size: p.Size}
+	}
+	err = m.en.doListPacked(func(s *PackedSlice) {
+		if p, ok := dumped[s.Pack]; ok {
+			p.Slices = append(p.Slices, &DumpedPackedSlice{s.Chunkid, s.Off, s.Len})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	ps := make([]*DumpedPack, 0, len(packs))
+	for _, p := range packs {
+		ps = append(ps, dumped[p.Id])
+	}
+	return ps, nil
+}
+
+// loadPacks records the dumped packs.
+func (m *baseMeta) loadPacks(packs []*DumpedPack) error {
+	for _, p := range packs {
+		pack := &Pack{Id: p.Id, Size: p.Size}
+		slices := make([]PackedSlice, 0, len(p.Slices))
+		for _, s := range p.Slices {
+			slices = append(slices, PackedSlice{Chunkid: s.Chunkid, Pack: p.Id, Off: s.Off, Len: s.Len})
+			pack.Live += s.Len
+		}
+		if err := m.en.doAddPack(pack, slices); err != nil {
+			return fmt.Errorf("load pack %d: %s", p.Id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,608 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// check returns true if the quota will be exceeded after adding space and inodes.
+func (q *Quota) check(space, inodes int64) bool {
+	if space > 0 {
+		max := atomic.LoadInt64(&q.MaxSpace)
+		if max > 0 && atomic.LoadInt64(&q.UsedSpace)+atomic.LoadInt64(&q.newSpace)+space > max {
+			return true
+		}
+	}
+	if inodes > 0 {
+		max := atomic.LoadInt64(&q.MaxInodes)
+		if max > 0 && atomic.LoadInt64(&q.UsedInodes)+atomic.LoadInt64(&q.newInodes)+inodes > max {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Quota) update(space, inodes int64) {
+	atomic.AddInt64(&q.newSpace, space)
+	atomic.AddInt64(&q.newInodes, inodes)
+}
+
+func (m *baseMeta) quotaMap(qtype uint8) map[uint64]*Quota {
+	switch qtype {
+	case UserQuota:
+		return m.userQuotas
+	case GroupQuota:
+		return m.groupQuotas
+	default:
+		return m.dirQuotas
+	}
+}
+
+func (m *baseMeta) getQuota(qtype uint8, key uint64) *Quota {
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	return m.quotaMap(qtype)[key]
+}
+
+func (m *baseMeta) hasQuotas(qtype uint8) bool {
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	return len(m.quotaMap(qtype)) > 0
+}
+
+func (m *baseMeta) hasOwnerQuotas() bool {
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	return len(m.userQuotas) > 0 || len(m.groupQuotas) > 0
+}
+
+func (m *baseMeta) getDirParent(ctx Context, inode Ino) (Ino, syscall.Errno) {
+	m.quotaMu.RLock()
+	parent, ok := m.dirParents[inode]
+	m.quotaMu.RUnlock()
+	if ok {
+		return parent, 0
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return 0, st
+	}
+	if attr.Typ != TypeDirectory {
+		return 0, syscall.ENOTDIR
+	}
+	m.quotaMu.Lock()
+	m.dirParents[inode] = attr.Parent
+	m.quotaMu.Unlock()
+	return attr.Parent, 0
+}
+
+// dirAncestors returns the directory itself and all its ancestors up to the root or the trash.
+func (m *baseMeta) dirAncestors(ctx Context, inode Ino) []Ino {
+	var dirs []Ino
+	for {
+		dirs = append(dirs, inode)
+		if inode <= 1 {
+			break
+		}
+		parent, st := m.getDirParent(ctx, inode)
+		if st != 0 {
+			logger.Warnf("get parent of directory %d: %s", inode, st)
+			break
+		}
+		if parent == inode || isTrash(parent) || parent == SnapshotInode {
+			break
+		}
+		inode = parent
+	}
+	return dirs
+}
+
+// quotaDirs returns the directories with quota from inode up to the root.
+func (m *baseMeta) quotaDirs(ctx Context, inode Ino) []Ino {
+	if inode == 0 || isTrash(inode) || isSnapshot(inode) || !m.hasQuotas(DirQuota) {
+		return nil
+	}
+	var dirs []Ino
+	for _, ino := range m.dirAncestors(ctx, inode) {
+		if m.getQuota(DirQuota, uint64(ino)) != nil {
+			dirs = append(dirs, ino)
+		}
+	}
+	return dirs
+}
+
+func equalInodes(a, b []Ino) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffInodes returns the inodes in a but not in b.
+func diffInodes(a, b []Ino) []Ino {
+	var r []Ino
+	for _, x := range a {
+		var found bool
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r = append(r, x)
+		}
+	}
+	return r
+}
+
+func (m *baseMeta) checkDirQuota(dirs []Ino, space, inodes int64) bool {
+	for _, ino := range dirs {
+		if q := m.getQuota(DirQuota, uint64(ino)); q != nil && q.check(space, inodes) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *baseMeta) checkOwnerQuota(uid, gid uint32, space, inodes int64) bool {
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	if q := m.userQuotas[uint64(uid)]; q != nil && q.check(space, inodes) {
+		return true
+	}
+	if q := m.groupQuotas[uint64(gid)]; q != nil && q.check(space, inodes) {
+		return true
+	}
+	return false
+}
+
+// checkQuota returns ENOSPC if the volume is full, or EDQUOT if the owner (uid and gid)
+// or any directory from parent up to the root has not enough quota left.
+func (m *baseMeta) checkQuota(ctx Context, space, inodes int64, uid, gid uint32, parent Ino) syscall.Errno {
+	if space > 0 && m.fmt.Capacity > 0 && atomic.LoadInt64(&m.usedSpace)+atomic.LoadInt64(&m.newSpace)+space > int64(m.fmt.Capacity) {
+		return syscall.ENOSPC
+	}
+	if inodes > 0 && m.fmt.Inodes > 0 && atomic.LoadInt64(&m.usedInodes)+atomic.LoadInt64(&m.newInodes)+inodes > int64(m.fmt.Inodes) {
+		return syscall.ENOSPC
+	}
+	if space <= 0 && inodes <= 0 {
+		return 0
+	}
+	if m.checkOwnerQuota(uid, gid, space, inodes) || m.checkDirQuota(m.quotaDirs(ctx, parent), space, inodes) {
+		return syscall.EDQUOT
+	}
+	return 0
+}
+
+// updateDirQuota updates the usage of all directories with quota from parent up to the root.
+func (m *baseMeta) updateDirQuota(ctx Context, parent Ino, space, inodes int64) {
+	if space == 0 && inodes == 0 {
+		return
+	}
+	for _, ino := range m.quotaDirs(ctx, parent) {
+		if q := m.getQuota(DirQuota, uint64(ino)); q != nil {
+			q.update(space, inodes)
+		}
+	}
+}
+
+// updateOwnerQuota updates the usage of the user and group owning a node.
+func (m *baseMeta) updateOwnerQuota(uid, gid uint32, space, inodes int64) {
+	if space == 0 && inodes == 0 {
+		return
+	}
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	if q := m.userQuotas[uint64(uid)]; q != nil {
+		q.update(space, inodes)
+	}
+	if q := m.groupQuotas[uint64(gid)]; q != nil {
+		q.update(space, inodes)
+	}
+}
+
+// checkChownQuota returns EDQUOT if the new owner of a node has not enough quota left.
+func (m *baseMeta) checkChownQuota(old, cur *Attr) syscall.Errno {
+	if old.Uid == cur.Uid && old.Gid == cur.Gid {
+		return 0
+	}
+	space := align4K(cur.Length)
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	if old.Uid != cur.Uid {
+		if q := m.userQuotas[uint64(cur.Uid)]; q != nil && q.check(space, 1) {
+			return syscall.EDQUOT
+		}
+	}
+	if old.Gid != cur.Gid {
+		if q := m.groupQuotas[uint64(cur.Gid)]; q != nil && q.check(space, 1) {
+			return syscall.EDQUOT
+		}
+	}
+	return 0
+}
+
+// chownQuota moves the usage of a node from its old owner to the new one.
+func (m *baseMeta) chownQuota(old, cur *Attr) {
+	if old.Uid == cur.Uid && old.Gid == cur.Gid {
+		return
+	}
+	space := align4K(cur.Length)
+	m.updateOwnerQuota(old.Uid, old.Gid, -space, -1)
+	m.updateOwnerQuota(cur.Uid, cur.Gid, space, 1)
+}
+
+func (m *baseMeta) loadQuotas() {
+	var loaded [3]map[uint64]*Quota
+	for _, qtype := range []uint8{DirQuota, UserQuota, GroupQuota} {
+		quotas, err := m.en.doLoadQuotas(qtype)
+		if err != nil {
+			logger.Warnf("load quotas: %s", err)
+			return
+		}
+		loaded[qtype] = quotas
+	}
+	m.quotaMu.Lock()
+	defer m.quotaMu.Unlock()
+	for qtype, quotas := range loaded {
+		cur := m.quotaMap(uint8(qtype))
+		for key, q := range quotas {
+			if c, ok := cur[key]; ok {
+				atomic.StoreInt64(&c.MaxSpace, q.MaxSpace)
+				atomic.StoreInt64(&c.MaxInodes, q.MaxInodes)
+				atomic.StoreInt64(&c.UsedSpace, q.UsedSpace)
+				atomic.StoreInt64(&c.UsedInodes, q.UsedInodes)
+			} else {
+				cur[key] = q
+			}
+		}
+		for key := range cur {
+			if _, ok := quotas[key]; !ok {
+				delete(cur, key)
+			}
+		}
+	}
+	// directories may be moved by other clients
+	m.dirParents = make(map[Ino]Ino)
+}
+
+func (m *baseMeta) flushQuotas() {
+	for {
+		time.Sleep(time.Second * 3)
+		m.syncQuotas()
+	}
+}
+
+// syncQuotas writes the local changes of usage into the meta engine.
+func (m *baseMeta) syncQuotas() {
+	for _, qtype := range []uint8{DirQuota, UserQuota, GroupQuota} {
+		stage := make(map[uint64]*Quota)
+		m.quotaMu.RLock()
+		for key, q := range m.quotaMap(qtype) {
+			newSpace := atomic.SwapInt64(&q.newSpace, 0)
+			newInodes := atomic.SwapInt64(&q.newInodes, 0)
+			if newSpace != 0 || newInodes != 0 {
+				stage[key] = &Quota{newSpace: newSpace, newInodes: newInodes}
+			}
+		}
+		m.quotaMu.RUnlock()
+		if len(stage) == 0 {
+			continue
+		}
+		err := m.en.doFlushQuotas(qtype, stage)
+		if err != nil {
+			logger.Warnf("flush quotas: %s", err)
+		}
+		m.quotaMu.RLock()
+		quotas := m.quotaMap(qtype)
+		for key, q := range stage {
+			cur, ok := quotas[key]
+			if !ok {
+				continue
+			}
+			if err != nil {
+				cur.update(q.newSpace, q.newInodes)
+			} else {
+				atomic.AddInt64(&cur.UsedSpace, q.newSpace)
+				atomic.AddInt64(&cur.UsedInodes, q.newInodes)
+			}
+		}
+		m.quotaMu.RUnlock()
+	}
+}
+
+// statRootQuota overrides the result of StatFS with the quota of the mounted subdir.
+func (m *baseMeta) statRootQuota(totalspace, availspace, iused, iavail *uint64) {
+	q := m.getQuota(DirQuota, uint64(m.root))
+	if q == nil {
+		return
+	}
+	if max := atomic.LoadInt64(&q.MaxSpace); max > 0 {
+		used := atomic.LoadInt64(&q.UsedSpace) + atomic.LoadInt64(&q.newSpace)
+		if used < 0 {
+			used = 0
+		}
+		*totalspace = uint64(max)
+		if *totalspace < uint64(used) {
+			*totalspace = uint64(used)
+		}
+		*availspace = *totalspace - uint64(used)
+	}
+	if max := atomic.LoadInt64(&q.MaxInodes); max > 0 {
+		used := atomic.LoadInt64(&q.UsedInodes) + atomic.LoadInt64(&q.newInodes)
+		if used < 0 {
+			used = 0
+		}
+		*iused = uint64(used)
+		if used > max {
+			*iavail = 0
+		} else {
+			*iavail = uint64(max - used)
+		}
+	}
+}
+
+// entryUsage returns the space and inodes used by an entry, including all its children.
+func (m *baseMeta) entryUsage(ctx Context, parent Ino, name string) (Ino, *Attr, int64, int64, syscall.Errno) {
+	var inode Ino
+	var attr Attr
+	if st := m.en.doLookup(ctx, parent, name, &inode, &attr); st != 0 {
+		return 0, nil, 0, 0, st
+	}
+	space, inodes := align4K(attr.Length), int64(1)
+	if attr.Typ == TypeDirectory {
+		s, i, st := m.dirUsage(ctx, inode)
+		if st != 0 {
+			return 0, nil, 0, 0, st
+		}
+		space += s
+		inodes += i
+	}
+	return inode, &attr, space, inodes, 0
+}
+
+// dirUsage returns the space and inodes used by all the children of a directory.
+func (m *baseMeta) dirUsage(ctx Context, inode Ino) (space, inodes int64, st syscall.Errno) {
+	var entries []*Entry
+	if st = m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+		return
+	}
+	for _, e := range entries {
+		space += align4K(e.Attr.Length)
+		inodes++
+		if e.Attr.Typ == TypeDirectory {
+			s, i, st := m.dirUsage(ctx, e.Inode)
+			if st != 0 {
+				return 0, 0, st
+			}
+			space += s
+			inodes += i
+		}
+	}
+	return
+}
+
+// ownerUsage returns the space and inodes used by a user or group, including the nodes in trash and snapshots.
+func (m *baseMeta) ownerUsage(ctx Context, qtype uint8, id uint32) (space, inodes int64, st syscall.Errno) {
+	visited := make(map[Ino]bool) // hard links
+	var walk func(inode Ino, count bool) syscall.Errno
+	walk = func(inode Ino, count bool) syscall.Errno {
+		var entries []*Entry
+		if st := m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if e.Attr.Typ != TypeDirectory && e.Attr.Nlink > 1 {
+				if visited[e.Inode] {
+					continue
+				}
+				visited[e.Inode] = true
+			}
+			owner := e.Attr.Uid
+			if qtype == GroupQuota {
+				owner = e.Attr.Gid
+			}
+			if count && owner == id {
+				space += align4K(e.Attr.Length)
+				inodes++
+			}
+			if e.Attr.Typ == TypeDirectory {
+				if st := walk(e.Inode, true); st != 0 {
+					return st
+				}
+			}
+		}
+		return 0
+	}
+	if st = walk(1, true); st != 0 {
+		return 0, 0, st
+	}
+	// the sub-directories of trash are created internally and not counted
+	if st = walk(TrashInode, false); st != 0 && st != syscall.ENOENT {
+		return 0, 0, st
+	}
+	if st = walk(SnapshotInode, true); st != 0 && st != syscall.ENOENT {
+		return 0, 0, st
+	}
+	return space, inodes, 0
+}
+
+// quotaUsage calculates the usage of a quota from scratch.
+func (m *baseMeta) quotaUsage(ctx Context, qtype uint8, key uint64) (int64, int64, syscall.Errno) {
+	if qtype == DirQuota {
+		return m.dirUsage(ctx, Ino(key))
+	}
+	return m.ownerUsage(ctx, qtype, uint32(key))
+}
+
+func (m *baseMeta) resolveDir(ctx Context, dpath string) (Ino, syscall.Errno) {
+	var inode Ino = 1
+	var attr Attr
+	for _, name := range strings.Split(dpath, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if st := m.en.doLookup(ctx, inode, name, &inode, &attr); st != 0 {
+			return 0, st
+		}
+		if attr.Typ != TypeDirectory {
+			return 0, syscall.ENOTDIR
+		}
+	}
+	return inode, 0
+}
+
+// resolveQuota returns the key of a quota target, which is a path for directories, or an uid/gid.
+func (m *baseMeta) resolveQuota(ctx Context, qtype uint8, target string) (uint64, error) {
+	switch qtype {
+	case DirQuota:
+		inode, st := m.resolveDir(ctx, target)
+		if st != 0 {
+			return 0, fmt.Errorf("lookup %s: %s", target, st)
+		}
+		return uint64(inode), nil
+	case UserQuota, GroupQuota:
+		id, err := strconv.ParseUint(target, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid id %q: %s", target, err)
+		}
+		return id, nil
+	default:
+		return 0, fmt.Errorf("invalid quota type: %d", qtype)
+	}
+}
+
+func (m *baseMeta) HandleQuota(ctx Context, cmd uint8, qtype uint8, target string, quotas map[string]*Quota, repair bool) error {
+	if cmd == QuotaList {
+		qs, err := m.en.doLoadQuotas(qtype)
+		if err != nil {
+			return err
+		}
+		for key, q := range qs {
+			name := strconv.FormatUint(key, 10)
+			if qtype == DirQuota {
+				p, st := GetPath(m.en.(Meta), ctx, Ino(key))
+				if st != 0 {
+					logger.Warnf("get path of inode %d: %s", key, st)
+					p = fmt.Sprintf("inode:%d", key)
+				}
+				name = p
+			}
+			quotas[name] = q
+		}
+		return nil
+	}
+
+	key, err := m.resolveQuota(ctx, qtype, target)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case QuotaSet:
+		if m.conf.ReadOnly {
+			return syscall.EROFS
+		}
+		q, err := m.en.doGetQuota(qtype, key)
+		if err != nil {
+			return err
+		}
+		var usage bool
+		if q == nil {
+			var st syscall.Errno
+			q = &Quota{}
+			if q.UsedSpace, q.UsedInodes, st = m.quotaUsage(ctx, qtype, key); st != 0 {
+				return fmt.Errorf("calculate usage of %s: %s", target, st)
+			}
+			usage = true
+		}
+		if n := quotas[target]; n != nil {
+			if n.MaxSpace >= 0 {
+				q.MaxSpace = n.MaxSpace
+			}
+			if n.MaxInodes >= 0 {
+				q.MaxInodes = n.MaxInodes
+			}
+		}
+		if err = m.en.doSetQuota(qtype, key, q, usage); err != nil {
+			return err
+		}
+		quotas[target] = q
+	case QuotaGet:
+		q, err := m.en.doGetQuota(qtype, key)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return fmt.Errorf("no quota for %s", target)
+		}
+		quotas[target] = q
+	case QuotaDel:
+		if m.conf.ReadOnly {
+			return syscall.EROFS
+		}
+		return m.en.doDelQuota(qtype, key)
+	case QuotaCheck:
+		q, err := m.en.doGetQuota(qtype, key)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return fmt.Errorf("no quota for %s", target)
+		}
+		space, inodes, st := m.quotaUsage(ctx, qtype, key)
+		if st != 0 {
+			return fmt.Errorf("calculate usage of %s: %s", target, st)
+		}
+		if space != q.UsedSpace || inodes != q.UsedInodes {
+			logger.Warnf("Usage of %s is inconsistent: space %d -> %d, inodes %d -> %d",
+				target, q.UsedSpace, space, q.UsedInodes, inodes)
+			if !repair {
+				return fmt.Errorf("quota of %s is broken", target)
+			}
+			q.UsedSpace, q.UsedInodes = space, inodes
+			if err = m.en.doSetQuota(qtype, key, q, true); err != nil {
+				return err
+			}
+			logger.Infof("Usage of %s is repaired", target)
+		}
+		quotas[target] = q
+	default:
+		return fmt.Errorf("invalid quota command: %d", cmd)
+	}
+	return nil
+}
+
+func (m *baseMeta) refreshQuotas() {
+	for {
+		m.loadQuotas()
+		utils.SleepWithJitter(time.Second * 10)
+	}
+}
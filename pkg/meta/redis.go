@@ -20,9 +20,9 @@
 package meta
 
 import (
-	"bufio"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
@@ -31,6 +31,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
@@ -43,6 +44,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -51,7 +53,9 @@ import (
 	Dir:   d$inode -> {name -> {inode,type}}
 	File:  c$inode_$indx -> [Slice{pos,id,length,off,len}]
 	Symlink: s$inode -> target
+	Inline data: b$inode -> data
 	Xattr: x$inode -> {name -> value}
+	ACL: acl$inode -> {type -> rule}
 	Flock: lockf$inode -> { $sid_$owner -> ltype }
 	POSIX lock: lockp$inode -> { $sid_$owner -> Plock(pid,ltype,start,end) }
 	Sessions: sessions -> [ $sid -> heartbeat ]
@@ -60,6 +64,15 @@ import (
 
 	Removed files: delfiles -> [$inode:$length -> seconds]
 	Slices refs: k$chunkid_$size -> refcount
+	Slices refs while loading: loadingRefs -> {k$chunkid_$size -> refcount}
+	Change log: changelog -> [Change -> id]
+	Paths of entries in trash: trashPaths -> {$inode -> {parent,path}}
+	Packed slices: packed$chunkid -> {pack,off,len}
+	Packs: packs -> {$pack -> size}, packLive -> {$pack -> live bytes}
+	Shared blocks: dedup$hash -> {chunkid,indx,size,refs}
+	References to shared blocks: blockRef$chunkid_$indx -> hash
+	Tiers of slices: sliceTiers -> {$chunkid -> tier}
+	Cache invalidations: published to channel invalidations.$db
 
 	Redis features:
 	  Sorted Set: 1.2+
@@ -197,13 +210,31 @@ func (r *redisMeta) Init(format Format, force bool) error {
 			old.AccessKey = format.AccessKey
 			old.SecretKey = format.SecretKey
 			old.EncryptKey = format.EncryptKey
+			old.EncryptKeyVersion = format.EncryptKeyVersion
+			old.OldEncryptKeys = format.OldEncryptKeys
 			old.KeyEncrypted = format.KeyEncrypted
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.ChangelogDays = format.ChangelogDays
+			old.CacheInvalidation = format.CacheInvalidation
+			if format.EnableACL { // ACL can be enabled but not disabled
+				old.EnableACL = true
+			}
+			if format.InlineSize > 0 { // inline data can be resized but not disabled
+				old.InlineSize = format.InlineSize
+			}
+			if format.PackSize > 0 { // packing can be resized but not disabled
+				old.PackSize = format.PackSize
+			}
+			if format.Dedup { // deduplication can be enabled but not disabled
+				old.Dedup = true
+			}
 			old.MinClientVersion = format.MinClientVersion
 			old.MaxClientVersion = format.MaxClientVersion
-			if format != old {
+			old.Tiers = format.Tiers
+			old.Replica = format.Replica
+			if !reflect.DeepEqual(format, old) {
 				old.RemoveSecret()
 				format.RemoveSecret()
 				return fmt.Errorf("cannot update format from %+v to %+v", old, format)
@@ -241,7 +272,12 @@ func (r *redisMeta) Init(format Format, force bool) error {
 
 	// root inode
 	attr.Mode = 0777
-	return r.rdb.Set(ctx, r.inodeKey(1), r.marshal(attr), 0).Err()
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.inodeKey(1), r.marshal(attr), 0)
+		r.setDirStat(ctx, pipe, 1, &dirStat{})
+		return nil
+	})
+	return err
 }
 
 func (r *redisMeta) Reset() error {
@@ -420,6 +456,10 @@ func (r *redisMeta) symKey(inode Ino) string {
 	return "s" + inode.String()
 }
 
+func (r *redisMeta) inlineKey(inode Ino) string {
+	return "b" + inode.String()
+}
+
 func (r *redisMeta) inodeKey(inode Ino) string {
 	return "i" + inode.String()
 }
@@ -436,10 +476,26 @@ func (r *redisMeta) sliceKey(chunkid uint64, size uint32) string {
 	return "k" + strconv.FormatUint(chunkid, 10) + "_" + strconv.FormatUint(uint64(size), 10)
 }
 
+func (r *redisMeta) packedKey(chunkid uint64) string {
+	return "packed" + strconv.FormatUint(chunkid, 10)
+}
+
+func (r *redisMeta) dedupKey(hash []byte) string {
+	return "dedup" + hex.EncodeToString(hash)
+}
+
+func (r *redisMeta) blockRefKey(chunkid uint64, indx uint32) string {
+	return "blockRef" + strconv.FormatUint(chunkid, 10) + "_" + strconv.FormatUint(uint64(indx), 10)
+}
+
 func (r *redisMeta) xattrKey(inode Ino) string {
 	return "x" + inode.String()
 }
 
+func (r *redisMeta) aclKey(inode Ino) string {
+	return "acl" + inode.String()
+}
+
 func (r *redisMeta) flockKey(inode Ino) string {
 	return "lockf" + inode.String()
 }
@@ -685,6 +741,9 @@ func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 }
 
 func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := r.of.find(inode)
 	if f != nil {
@@ -692,7 +751,9 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	err := r.txn(ctx, func(tx *redis.Tx) error {
 		var t Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
@@ -709,9 +770,23 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 			}
 			return nil
 		}
+		newLength = int64(length) - int64(t.Length)
 		newSpace = align4K(length) - align4K(t.Length)
-		if newSpace > 0 && r.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = t.Parent, t.Uid, t.Gid, t.Nlink
+		if st := r.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
+		}
+		var inline []byte
+		if t.Flags&FlagInline != 0 && length < t.Length {
+			if inline, err = tx.Get(ctx, r.inlineKey(inode)).Bytes(); err != nil && err != redis.Nil {
+				return err
+			}
+			if uint64(len(inline)) > length {
+				inline = inline[:length]
+			}
+			if len(inline) == 0 {
+				t.Flags &^= FlagInline
+			}
 		}
 		var zeroChunks []uint32
 		var left, right = t.Length, length
@@ -754,6 +829,11 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 		t.Ctimensec = uint32(now.Nanosecond())
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&t), 0)
+			if t.Flags&FlagInline != 0 {
+				pipe.Set(ctx, r.inlineKey(inode), inline, 0)
+			} else if inline != nil {
+				pipe.Del(ctx, r.inlineKey(inode))
+			}
 			// zero out from left to right
 			var l = uint32(right - left)
 			if right > (left/ChunkSize+1)*ChunkSize {
@@ -779,11 +859,18 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 	}, r.inodeKey(inode))
 	if err == nil {
 		r.updateStats(newSpace, 0)
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		r.updateOwnerQuota(uid, gid, newSpace, 0)
+		r.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		r.recordChange(&Change{Op: ChangeTruncate, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
 
 func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -806,7 +893,9 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	err := r.txn(ctx, func(tx *redis.Tx) error {
 		var t Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
@@ -820,6 +909,9 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		if t.Typ != TypeFile {
 			return syscall.EPERM
 		}
+		if t.Flags&FlagInline != 0 {
+			return syscall.ENOTSUP
+		}
 		length := t.Length
 		if off+size > t.Length {
 			if mode&fallocKeepSize == 0 {
@@ -828,9 +920,11 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		}
 
 		old := t.Length
+		newLength = int64(length) - int64(old)
 		newSpace = align4K(length) - align4K(old)
-		if newSpace > 0 && r.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = t.Parent, t.Uid, t.Gid, t.Nlink
+		if st := r.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		t.Length = length
 		now := time.Now()
@@ -863,21 +957,30 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 	}, r.inodeKey(inode))
 	if err == nil {
 		r.updateStats(newSpace, 0)
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		r.updateOwnerQuota(uid, gid, newSpace, 0)
+		r.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		r.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
 
 func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	inode = r.checkRoot(inode)
 	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return errno(r.txn(ctx, func(tx *redis.Tx) error {
+	var old Attr
+	err := r.txn(ctx, func(tx *redis.Tx) error {
 		var cur Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
 		}
 		r.parseAttr(a, &cur)
+		old = cur
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -930,6 +1033,9 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			*attr = cur
 			return nil
 		}
+		if st := r.checkChownQuota(&old, &cur); st != 0 {
+			return st
+		}
 		cur.Ctime = now.Unix()
 		cur.Ctimensec = uint32(now.Nanosecond())
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
@@ -940,7 +1046,14 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			*attr = cur
 		}
 		return err
-	}, r.inodeKey(inode)))
+	}, r.inodeKey(inode))
+	if err == nil {
+		r.chownQuota(&old, attr)
+		if *attr != old {
+			r.recordChange(&Change{Op: ChangeSetAttr, Inode: inode, Parent: attr.Parent})
+		}
+	}
+	return errno(err)
 }
 
 func (m *redisMeta) doReadlink(ctx Context, inode Ino) ([]byte, error) {
@@ -995,6 +1108,16 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		var access, dflt *acl.Rule
+		if pattr.Flags&FlagDefaultACL != 0 && _type != TypeSymlink {
+			def, err := r.getFacl(ctx, tx, parent, acl.TypeDefault)
+			if err != nil {
+				return err
+			}
+			if def != nil {
+				attr.Mode, attr.Flags, access, dflt = inheritFacl(def, _type, mode)
+			}
+		}
 
 		buf, err := tx.HGet(ctx, r.entryKey(parent), name).Bytes()
 		if err != nil && err != redis.Nil {
@@ -1056,6 +1179,11 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 			if _type == TypeSymlink {
 				pipe.Set(ctx, r.symKey(ino), path, 0)
 			}
+			if _type == TypeDirectory && parent != TrashInode {
+				r.setDirStat(ctx, pipe, ino, &dirStat{})
+			}
+			r.setFacl(ctx, pipe, ino, acl.TypeAccess, access)
+			r.setFacl(ctx, pipe, ino, acl.TypeDefault, dflt)
 			pipe.IncrBy(ctx, usedSpace, align4K(0))
 			pipe.Incr(ctx, totalInodes)
 			return nil
@@ -1176,6 +1304,7 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 					pipe.Decr(ctx, totalInodes)
 				}
 				pipe.Del(ctx, r.xattrKey(inode))
+				pipe.Del(ctx, r.aclKey(inode))
 			}
 			return nil
 		})
@@ -1188,6 +1317,13 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 		}
 		r.updateStats(newSpace, newInode)
 	}
+	if err == nil && attr.Nlink == 0 {
+		r.updateOwnerQuota(attr.Uid, attr.Gid, -align4K(attr.Length), -1)
+	}
+	if err == nil {
+		r.updateDirStat(ctx, parent, -int64(attr.Length), -align4K(attr.Length), -1, 0)
+		r.updateDirQuota(ctx, parent, -align4K(attr.Length), -1) // every entry (hard link) is counted
+	}
 	return errno(err)
 }
 
@@ -1275,6 +1411,8 @@ func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 			} else {
 				pipe.Del(ctx, r.inodeKey(inode))
 				pipe.Del(ctx, r.xattrKey(inode))
+				pipe.Del(ctx, r.aclKey(inode))
+				r.delDirStat(ctx, pipe, inode)
 				pipe.IncrBy(ctx, usedSpace, -align4K(0))
 				pipe.Decr(ctx, totalInodes)
 			}
@@ -1479,6 +1617,8 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 						} else {
 							if dtyp == TypeSymlink {
 								pipe.Del(ctx, r.symKey(dino))
+							} else if dtyp == TypeDirectory {
+								r.delDirStat(ctx, pipe, dino)
 							}
 							pipe.Del(ctx, r.inodeKey(dino))
 							newSpace, newInode = -align4K(0), -1
@@ -1486,6 +1626,7 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 							pipe.Decr(ctx, totalInodes)
 						}
 						pipe.Del(ctx, r.xattrKey(dino))
+						pipe.Del(ctx, r.aclKey(dino))
 					}
 				}
 			}
@@ -1755,6 +1896,7 @@ func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) s
 	}
 	if cs, ok := r.of.ReadChunk(inode, indx); ok {
 		*chunks = cs
+		r.touchAtime(ctx, inode, nil)
 		return 0
 	}
 	defer timeit(time.Now())
@@ -1768,10 +1910,14 @@ func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) s
 	if !r.conf.ReadOnly && (len(vals) >= 5 || len(*chunks) >= 5) {
 		go r.compactChunk(inode, indx, false)
 	}
+	r.touchAtime(ctx, inode, nil)
 	return 0
 }
 
 func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := r.of.find(inode)
 	if f != nil {
@@ -1779,7 +1925,9 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(inode, indx) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	var needCompact bool
 	err := r.txn(ctx, func(tx *redis.Tx) error {
 		var attr Attr
@@ -1793,17 +1941,22 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
 		if newleng > attr.Length {
+			newLength = int64(newleng) - int64(attr.Length)
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if r.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = attr.Parent, attr.Uid, attr.Gid, attr.Nlink
+		if st := r.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
+		// the inline data is written into object storage by the client before this slice
+		inline := attr.Flags&FlagInline != 0
+		attr.Flags &^= FlagInline
 
 		var rpush *redis.IntCmd
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
@@ -1811,6 +1964,9 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 			// most of chunk are used by single inode, so use that as the default (1 == not exists)
 			// pipe.Incr(ctx, r.sliceKey(slice.Chunkid, slice.Size))
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+			if inline {
+				pipe.Del(ctx, r.inlineKey(inode))
+			}
 			if newSpace > 0 {
 				pipe.IncrBy(ctx, usedSpace, newSpace)
 			}
@@ -1826,18 +1982,127 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 			go r.compactChunk(inode, indx, false)
 		}
 		r.updateStats(newSpace, 0)
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		r.updateOwnerQuota(uid, gid, newSpace, 0)
+		r.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		r.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
+	}
+	return errno(err)
+}
+
+func (r *redisMeta) ReadInline(ctx Context, inode Ino, attr *Attr, data *[]byte) syscall.Errno {
+	defer timeit(time.Now())
+	rs, err := r.rdb.MGet(ctx, r.inodeKey(inode), r.inlineKey(inode)).Result()
+	if err != nil {
+		return errno(err)
+	}
+	if rs[0] == nil {
+		return syscall.ENOENT
+	}
+	var a Attr
+	r.parseAttr([]byte(rs[0].(string)), &a)
+	if a.Flags&FlagInline == 0 {
+		return syscall.ENODATA
+	}
+	if attr != nil {
+		*attr = a
+	}
+	*data = nil
+	if rs[1] != nil {
+		*data = []byte(rs[1].(string))
+	}
+	return 0
+}
+
+func (r *redisMeta) WriteInline(ctx Context, inode Ino, off uint64, data []byte) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
+	if off+uint64(len(data)) > uint64(r.fmt.InlineSize) {
+		return syscall.EFBIG
+	}
+	defer timeit(time.Now())
+	f := r.of.find(inode)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+	}
+	defer func() { r.of.InvalidateChunk(inode, 0) }()
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
+	err := r.txn(ctx, func(tx *redis.Tx) error {
+		var attr Attr
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		r.parseAttr(a, &attr)
+		if attr.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		var inline []byte
+		if attr.Flags&FlagInline != 0 {
+			if inline, err = tx.Get(ctx, r.inlineKey(inode)).Bytes(); err != nil && err != redis.Nil {
+				return err
+			}
+		} else if attr.Length > 0 {
+			return syscall.ENODATA
+		} else if n, err := tx.Exists(ctx, r.chunkKey(inode, 0)).Result(); err != nil {
+			return err
+		} else if n > 0 {
+			return syscall.ENODATA
+		}
+		inline = writeInline(inline, off, data)
+		if newleng := off + uint64(len(data)); newleng > attr.Length {
+			newLength = int64(newleng) - int64(attr.Length)
+			newSpace = align4K(newleng) - align4K(attr.Length)
+			attr.Length = newleng
+		}
+		parent, uid, gid, nlink = attr.Parent, attr.Uid, attr.Gid, attr.Nlink
+		if st := r.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Flags |= FlagInline
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inlineKey(inode), inline, 0)
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+			if newSpace > 0 {
+				pipe.IncrBy(ctx, usedSpace, newSpace)
+			}
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode))
+	if err == nil {
+		r.updateStats(newSpace, 0)
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		r.updateOwnerQuota(uid, gid, newSpace, 0)
+		r.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		r.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
 
 func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if isSnapshot(fout) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := r.of.find(fout)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	defer func() { r.of.InvalidateChunk(fout, 0xFFFFFFFF) }()
 	err := r.txn(ctx, func(tx *redis.Tx) error {
 		rs, err := tx.MGet(ctx, r.inodeKey(fin), r.inodeKey(fout)).Result()
@@ -1864,14 +2129,19 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if sattr.Flags&FlagInline != 0 || attr.Flags&FlagInline != 0 {
+			return syscall.ENOTSUP
+		}
 
 		newleng := offOut + size
 		if newleng > attr.Length {
+			newLength = int64(newleng) - int64(attr.Length)
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if r.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = attr.Parent, attr.Uid, attr.Gid, attr.Nlink
+		if st := r.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
@@ -1947,10 +2217,120 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 	}, r.inodeKey(fout), r.inodeKey(fin))
 	if err == nil {
 		r.updateStats(newSpace, 0)
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		r.updateOwnerQuota(uid, gid, newSpace, 0)
+		r.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		r.recordChange(&Change{Op: ChangeWrite, Inode: fout, Parent: parent})
+	}
+	return errno(err)
+}
+
+func (r *redisMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string, ino Ino, attr *Attr, cmode uint8, cumask uint16) syscall.Errno {
+	err := r.txn(ctx, func(tx *redis.Tx) error {
+		rs, err := tx.MGet(ctx, r.inodeKey(srcIno), r.inodeKey(parent)).Result()
+		if err != nil {
+			return err
+		}
+		if rs[0] == nil || rs[1] == nil {
+			return redis.Nil
+		}
+		var pattr Attr
+		r.parseAttr([]byte(rs[0].(string)), attr)
+		r.parseAttr([]byte(rs[1].(string)), &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if exist, err := tx.HExists(ctx, r.entryKey(parent), name).Result(); err != nil {
+			return err
+		} else if exist {
+			return syscall.EEXIST
+		}
+		cloneAttr(ctx, attr, parent, &pattr, cmode, cumask)
+		var inline []byte
+		if attr.Typ == TypeFile && attr.Flags&FlagInline != 0 {
+			if inline, err = tx.Get(ctx, r.inlineKey(srcIno)).Bytes(); err != nil && err != redis.Nil {
+				return err
+			}
+		}
+
+		p := tx.Pipeline()
+		if attr.Typ == TypeFile {
+			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+				p.LRange(ctx, r.chunkKey(srcIno, indx), 0, -1)
+			}
+		} else if attr.Typ == TypeSymlink {
+			p.Get(ctx, r.symKey(srcIno))
+		}
+		xattrs := p.HGetAll(ctx, r.xattrKey(srcIno))
+		acls := p.HGetAll(ctx, r.aclKey(srcIno))
+		cmds, err := p.Exec(ctx)
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(attr.Typ, ino))
+			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
+			pipe.Set(ctx, r.inodeKey(ino), r.marshal(attr), 0)
+			switch attr.Typ {
+			case TypeFile:
+				for indx, cmd := range cmds[:len(cmds)-2] {
+					vals := cmd.(*redis.StringSliceCmd).Val()
+					if len(vals) == 0 {
+						continue
+					}
+					args := make([]interface{}, len(vals))
+					for i, v := range vals {
+						args[i] = v
+					}
+					pipe.RPush(ctx, r.chunkKey(ino, uint32(indx)), args...)
+					for _, s := range readSlices(vals) {
+						if s.chunkid > 0 {
+							pipe.HIncrBy(ctx, sliceRefs, r.sliceKey(s.chunkid, s.size), 1)
+						}
+					}
+				}
+				if inline != nil {
+					pipe.Set(ctx, r.inlineKey(ino), inline, 0)
+				}
+			case TypeSymlink:
+				pipe.Set(ctx, r.symKey(ino), cmds[0].(*redis.StringCmd).Val(), 0)
+			case TypeDirectory:
+				r.setDirStat(ctx, pipe, ino, &dirStat{})
+			}
+			if vals := xattrs.Val(); len(vals) > 0 {
+				pipe.HSet(ctx, r.xattrKey(ino), vals)
+			}
+			if vals := acls.Val(); len(vals) > 0 {
+				pipe.HSet(ctx, r.aclKey(ino), vals)
+			}
+			pipe.IncrBy(ctx, usedSpace, align4K(attr.Length))
+			pipe.Incr(ctx, totalInodes)
+			return nil
+		})
+		return err
+	}, r.inodeKey(srcIno), r.inodeKey(parent), r.entryKey(parent))
+	if err == nil {
+		r.updateStats(align4K(attr.Length), 1)
 	}
 	return errno(err)
 }
 
+func (r *redisMeta) doInitSnapshotRoot() error {
+	now := time.Now().Unix()
+	attr := &Attr{
+		Typ:    TypeDirectory,
+		Mode:   0555,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Nlink:  2,
+		Length: 4 << 10,
+		Parent: 1,
+	}
+	return r.rdb.SetNX(Background, r.inodeKey(SnapshotInode), r.marshal(attr), 0).Err()
+}
+
 // For now only deleted files
 func (r *redisMeta) cleanupLegacies() {
 	for {
@@ -2222,6 +2602,7 @@ func (r *redisMeta) doDeleteFileData_(inode Ino, length uint64, tracking string)
 			}
 		}
 	}
+	_ = r.rdb.Del(ctx, r.inlineKey(inode))
 	if tracking == "" {
 		tracking = inode.String() + ":" + strconv.FormatInt(int64(length), 10)
 	}
@@ -2383,6 +2764,7 @@ func (r *redisMeta) cleanupLeakedInodes(delete bool) {
 	var cursor uint64
 	var err error
 	var foundInodes = make(map[Ino]struct{})
+	foundInodes[SnapshotInode] = struct{}{} // not referenced by any entry
 	cutoff := time.Now().Add(time.Hour * -1)
 	for {
 		keys, cursor, err = r.rdb.Scan(ctx, cursor, "d*", 1000).Result()
@@ -2556,68 +2938,967 @@ func (r *redisMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.E
 	}
 }
 
-func (r *redisMeta) checkServerConfig() {
-	rawInfo, err := r.rdb.Info(Background).Result()
-	if err != nil {
-		logger.Warnf("parse info: %s", err)
-		return
-	}
-	_, err = checkRedisInfo(rawInfo)
-	if err != nil {
-		logger.Warnf("parse info: %s", err)
+func (r *redisMeta) getFacl(ctx Context, c redis.Cmdable, inode Ino, aclType uint8) (*acl.Rule, error) {
+	buf, err := c.HGet(ctx, r.aclKey(inode), strconv.Itoa(int(aclType))).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
+	return acl.Decode(buf)
+}
 
-	start := time.Now()
-	_ = r.rdb.Ping(Background)
-	logger.Infof("Ping redis: %s", time.Since(start))
+// setFacl sets the ACL of an inode, or removes it if rule is nil.
+func (r *redisMeta) setFacl(ctx Context, pipe redis.Pipeliner, inode Ino, aclType uint8, rule *acl.Rule) {
+	if rule != nil {
+		pipe.HSet(ctx, r.aclKey(inode), strconv.Itoa(int(aclType)), rule.Encode())
+	} else {
+		pipe.HDel(ctx, r.aclKey(inode), strconv.Itoa(int(aclType)))
+	}
 }
 
-func (m *redisMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
-	ctx := Background
-	e := &DumpedEntry{}
-	return e, m.txn(ctx, func(tx *redis.Tx) error {
-		a, err := tx.Get(ctx, m.inodeKey(inode)).Bytes()
-		if err != nil {
-			if err != redis.Nil {
-				return err
-			}
-			logger.Warnf("The entry of the inode was not found. inode: %v", inode)
-		}
-		attr := &Attr{Typ: typ, Nlink: 1}
-		m.parseAttr(a, attr)
-		e.Attr = dumpAttr(attr)
-		e.Attr.Inode = inode
+func (r *redisMeta) doGetFacl(ctx Context, inode Ino, aclType uint8) (*acl.Rule, error) {
+	return r.getFacl(ctx, r.rdb, inode, aclType)
+}
 
-		keys, err := tx.HGetAll(ctx, m.xattrKey(inode)).Result()
+func (r *redisMeta) doSetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno {
+	return errno(r.txn(ctx, func(tx *redis.Tx) error {
+		var attr Attr
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
 		}
-		if len(keys) > 0 {
-			xattrs := make([]*DumpedXattr, 0, len(keys))
-			for k, v := range keys {
-				xattrs = append(xattrs, &DumpedXattr{k, v})
-			}
-			sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
-			e.Xattrs = xattrs
+		r.parseAttr(a, &attr)
+		stored, st := prepareFacl(ctx, &attr, aclType, rule)
+		if st != 0 {
+			return st
 		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+			r.setFacl(ctx, pipe, inode, aclType, stored)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode)))
+}
 
-		if attr.Typ == TypeFile {
-			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
-				vals, err := tx.LRange(ctx, m.chunkKey(inode, indx), 0, 1000000).Result()
-				if err != nil {
-					return err
-				}
-				ss := readSlices(vals)
-				slices := make([]*DumpedSlice, 0, len(ss))
-				for _, s := range ss {
-					slices = append(slices, &DumpedSlice{Chunkid: s.chunkid, Pos: s.pos, Size: s.size, Off: s.off, Len: s.len})
-				}
-				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
+// dumpFacl fills the ACLs of a dumped entry with the fields of its ACL hash.
+func (r *redisMeta) dumpFacl(inode Ino, vals map[string]string, e *DumpedEntry) {
+	for aclType, rule := range map[uint8]**acl.Rule{acl.TypeAccess: &e.AccessACL, acl.TypeDefault: &e.DefaultACL} {
+		if v, ok := vals[strconv.Itoa(int(aclType))]; ok {
+			var err error
+			if *rule, err = acl.Decode([]byte(v)); err != nil {
+				logger.Warnf("Corrupt ACL of inode %d: %s", inode, err)
 			}
-		} else if attr.Typ == TypeSymlink {
-			if e.Symlink, err = tx.Get(ctx, m.symKey(inode)).Result(); err != nil {
-				if err != redis.Nil {
-					return err
+		}
+	}
+}
+
+func (r *redisMeta) packQuota(space, inodes int64) []byte {
+	wb := utils.NewBuffer(16)
+	wb.Put64(uint64(space))
+	wb.Put64(uint64(inodes))
+	return wb.Bytes()
+}
+
+func (r *redisMeta) parseQuota(buf []byte) (space, inodes int64) {
+	if len(buf) != 16 {
+		logger.Errorf("invalid quota value: %v", buf)
+		return
+	}
+	rb := utils.FromBuffer(buf)
+	return int64(rb.Get64()), int64(rb.Get64())
+}
+
+// quotaKeys returns the keys of limits, used space and used inodes of a type of quotas.
+func (r *redisMeta) quotaKeys(qtype uint8) (string, string, string) {
+	switch qtype {
+	case UserQuota:
+		return userQuotaKey, userUsedSpaceKey, userUsedInodesKey
+	case GroupQuota:
+		return groupQuotaKey, groupUsedSpaceKey, groupUsedInodesKey
+	default:
+		return dirQuotaKey, dirUsedSpaceKey, dirUsedInodesKey
+	}
+}
+
+func (r *redisMeta) doGetQuota(qtype uint8, key uint64) (*Quota, error) {
+	ctx := Background
+	quotaKey, spaceKey, inodesKey := r.quotaKeys(qtype)
+	field := strconv.FormatUint(key, 10)
+	buf, err := r.rdb.HGet(ctx, quotaKey, field).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	q := &Quota{}
+	q.MaxSpace, q.MaxInodes = r.parseQuota(buf)
+	if q.UsedSpace, err = r.rdb.HGet(ctx, spaceKey, field).Int64(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if q.UsedInodes, err = r.rdb.HGet(ctx, inodesKey, field).Int64(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (r *redisMeta) doSetQuota(qtype uint8, key uint64, quota *Quota, usage bool) error {
+	ctx := Background
+	quotaKey, spaceKey, inodesKey := r.quotaKeys(qtype)
+	field := strconv.FormatUint(key, 10)
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, quotaKey, field, r.packQuota(quota.MaxSpace, quota.MaxInodes))
+		if usage {
+			pipe.HSet(ctx, spaceKey, field, quota.UsedSpace)
+			pipe.HSet(ctx, inodesKey, field, quota.UsedInodes)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doDelQuota(qtype uint8, key uint64) error {
+	ctx := Background
+	quotaKey, spaceKey, inodesKey := r.quotaKeys(qtype)
+	field := strconv.FormatUint(key, 10)
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, quotaKey, field)
+		pipe.HDel(ctx, spaceKey, field)
+		pipe.HDel(ctx, inodesKey, field)
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doLoadQuotas(qtype uint8) (map[uint64]*Quota, error) {
+	ctx := Background
+	quotaKey, spaceKey, inodesKey := r.quotaKeys(qtype)
+	quotas := make(map[uint64]*Quota)
+	vals, err := r.rdb.HGetAll(ctx, quotaKey).Result()
+	if err != nil || len(vals) == 0 {
+		return quotas, err
+	}
+	spaces, err := r.rdb.HGetAll(ctx, spaceKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	inodes, err := r.rdb.HGetAll(ctx, inodesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range vals {
+		key, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			logger.Errorf("invalid key of %s: %s", quotaKey, k)
+			continue
+		}
+		q := &Quota{}
+		q.MaxSpace, q.MaxInodes = r.parseQuota([]byte(v))
+		q.UsedSpace, _ = strconv.ParseInt(spaces[k], 10, 64)
+		q.UsedInodes, _ = strconv.ParseInt(inodes[k], 10, 64)
+		quotas[key] = q
+	}
+	return quotas, nil
+}
+
+func (r *redisMeta) doFlushQuotas(qtype uint8, quotas map[uint64]*Quota) error {
+	ctx := Background
+	_, spaceKey, inodesKey := r.quotaKeys(qtype)
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, q := range quotas {
+			field := strconv.FormatUint(key, 10)
+			if q.newSpace != 0 {
+				pipe.HIncrBy(ctx, spaceKey, field, q.newSpace)
+			}
+			if q.newInodes != 0 {
+				pipe.HIncrBy(ctx, inodesKey, field, q.newInodes)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// dirStatKeys are the hashes of length, space, files and dirs of directories.
+var dirStatKeys = [4]string{dirLengthKey, dirSpaceKey, dirFilesKey, dirDirsKey}
+
+func (r *redisMeta) setDirStat(ctx Context, pipe redis.Pipeliner, inode Ino, s *dirStat) {
+	field := inode.String()
+	for i, v := range [4]int64{s.length, s.space, s.files, s.dirs} {
+		pipe.HSet(ctx, dirStatKeys[i], field, v)
+	}
+}
+
+func (r *redisMeta) delDirStat(ctx Context, pipe redis.Pipeliner, inode Ino) {
+	for _, key := range dirStatKeys {
+		pipe.HDel(ctx, key, inode.String())
+	}
+}
+
+func (r *redisMeta) doGetDirStat(inode Ino) (*dirStat, error) {
+	ctx := Background
+	var cmds [4]*redis.StringCmd
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range dirStatKeys {
+			cmds[i] = pipe.HGet(ctx, key, inode.String())
+		}
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var vals [4]int64
+	for i, cmd := range cmds {
+		if vals[i], err = cmd.Int64(); err != nil {
+			return nil, err
+		}
+	}
+	return &dirStat{vals[0], vals[1], vals[2], vals[3]}, nil
+}
+
+func (r *redisMeta) doSetDirStats(stats map[Ino]*dirStat) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for inode, s := range stats {
+			r.setDirStat(ctx, pipe, inode, s)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doFlushDirStats(stats map[Ino]*dirStat) error {
+	ctx := Background
+	inodes := make([]Ino, 0, len(stats))
+	fields := make([]string, 0, len(stats))
+	for inode := range stats {
+		inodes = append(inodes, inode)
+		fields = append(fields, inode.String())
+	}
+	// HINCRBY creates the missing ones, so skip the directories which are not maintained, and watch
+	// the stats in case any of them is removed (or created) by others before the deltas are applied
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.HMGet(ctx, dirDirsKey, fields...).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, inode := range inodes {
+				if exists[i] == nil {
+					continue
+				}
+				s := stats[inode]
+				for j, v := range [4]int64{s.length, s.space, s.files, s.dirs} {
+					if v != 0 {
+						pipe.HIncrBy(ctx, dirStatKeys[j], fields[i], v)
+					}
+				}
+			}
+			return nil
+		})
+		return err
+	}, dirStatKeys[:]...)
+}
+
+func (r *redisMeta) doAppendChanges(changes []*Change) error {
+	ctx := Background
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		last, err := tx.Get(ctx, changeCounter).Uint64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		members := make([]*redis.Z, len(changes))
+		for i, c := range changes {
+			c.Id = last + uint64(i) + 1
+			members[i] = &redis.Z{Score: float64(c.Id), Member: c.marshal()}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.IncrBy(ctx, changeCounter, int64(len(changes)))
+			pipe.ZAdd(ctx, changelogKey, members...)
+			return nil
+		})
+		return err
+	}, changeCounter)
+}
+
+func (r *redisMeta) doReadChanges(from uint64, limit int) ([]*Change, error) {
+	rng := &redis.ZRangeBy{Min: "(" + strconv.FormatUint(from, 10), Max: strconv.FormatUint(from+uint64(limit), 10)}
+	vals, err := r.rdb.ZRangeByScore(Background, changelogKey, rng).Result()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]*Change, len(vals))
+	for i, v := range vals {
+		changes[i] = &Change{}
+		if err = changes[i].unmarshal([]byte(v)); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func (r *redisMeta) doDeleteChanges(from, to uint64) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, changelogKey, "("+strconv.FormatUint(from, 10), strconv.FormatUint(to, 10))
+		pipe.Set(ctx, trimmedChanges, to, 0)
+		return nil
+	})
+	return err
+}
+
+// the channels are shared by all the databases of a server
+func (r *redisMeta) invalidationChannel() string {
+	return fmt.Sprintf("invalidations.%d", r.rdb.Options().DB)
+}
+
+func (r *redisMeta) doPublishInvalidations(msg []byte) error {
+	return r.rdb.Publish(Background, r.invalidationChannel(), msg).Err()
+}
+
+func (r *redisMeta) doSubscribeInvalidations(handler func(msg []byte)) error {
+	ctx := Background
+	ps := r.rdb.Subscribe(ctx, r.invalidationChannel())
+	defer ps.Close()
+	for r.invalidationEnabled() {
+		msg, err := ps.ReceiveTimeout(ctx, time.Second)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			return err
+		}
+		if m, ok := msg.(*redis.Message); ok {
+			handler([]byte(m.Payload))
+		}
+	}
+	return nil
+}
+
+// scan calls f with the keys matching pattern in batches.
+func (r *redisMeta) scan(ctx Context, pattern string, f func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, c, err := r.rdb.Scan(ctx, cursor, pattern, 10000).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = f(keys); err != nil {
+				return err
+			}
+		}
+		if c == 0 {
+			return nil
+		}
+		cursor = c
+	}
+}
+
+func (r *redisMeta) doScanMeta(v *metaVisitor) error {
+	ctx := Background
+	v.implicitRef = true
+	err := r.scan(ctx, "i*", func(keys []string) error {
+		values, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			inode, err := strconv.ParseUint(keys[i][1:], 10, 64)
+			if err != nil || value == nil {
+				continue
+			}
+			var attr Attr
+			r.parseAttr([]byte(value.(string)), &attr)
+			v.node(Ino(inode), &attr)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan nodes: %s", err)
+	}
+	err = r.scan(ctx, "d*", func(keys []string) error {
+		for _, key := range keys {
+			parent, err := strconv.ParseUint(key[1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			var cursor uint64
+			for {
+				kvs, c, err := r.rdb.HScan(ctx, key, cursor, "*", 10000).Result()
+				if err != nil {
+					return err
+				}
+				for i := 0; i+1 < len(kvs); i += 2 {
+					typ, inode := r.parseEntry([]byte(kvs[i+1]))
+					v.edge(Ino(parent), kvs[i], inode, typ)
+				}
+				if c == 0 {
+					break
+				}
+				cursor = c
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan entries: %s", err)
+	}
+	err = r.scan(ctx, "c*_*", func(keys []string) error {
+		p := r.rdb.Pipeline()
+		for _, key := range keys {
+			_ = p.LRange(ctx, key, 0, -1)
+		}
+		cmds, err := p.Exec(ctx)
+		if err != nil {
+			return err
+		}
+		for i, cmd := range cmds {
+			var inode uint64
+			var indx uint32
+			if n, err := fmt.Sscanf(keys[i], "c%d_%d", &inode, &indx); err != nil || n != 2 {
+				continue
+			}
+			v.chunk(Ino(inode), indx, readSlices(cmd.(*redis.StringSliceCmd).Val()))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan chunks: %s", err)
+	}
+	var cursor uint64
+	for {
+		kvs, c, err := r.rdb.HScan(ctx, sliceRefs, cursor, "*", 10000).Result()
+		if err != nil {
+			return fmt.Errorf("scan slices: %s", err)
+		}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			var chunkid uint64
+			var size uint32
+			if n, err := fmt.Sscanf(kvs[i], "k%d_%d", &chunkid, &size); err != nil || n != 2 {
+				continue
+			}
+			if refs, err := strconv.ParseInt(kvs[i+1], 10, 64); err == nil {
+				v.sliceRef(chunkid, size, refs+1)
+			}
+		}
+		if c == 0 {
+			return nil
+		}
+		cursor = c
+	}
+}
+
+func (r *redisMeta) doSetEntry(parent Ino, name string, inode Ino, typ uint8) error {
+	if inode == 0 {
+		return r.rdb.HDel(Background, r.entryKey(parent), name).Err()
+	}
+	return r.rdb.HSet(Background, r.entryKey(parent), name, r.packEntry(typ, inode)).Err()
+}
+
+func (r *redisMeta) doSetNlink(inode Ino, nlink uint32, parent Ino) error {
+	ctx := Background
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		var attr Attr
+		r.parseAttr(a, &attr)
+		attr.Nlink = nlink
+		if parent > 0 {
+			attr.Parent = parent
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode))
+}
+
+func (r *redisMeta) doAppendSlice(inode Ino, indx uint32, buf []byte) error {
+	return r.rdb.RPush(Background, r.chunkKey(inode, indx), buf).Err()
+}
+
+func (r *redisMeta) doSetSliceRefs(chunkid uint64, size uint32, refs int64) error {
+	if refs == 1 {
+		return r.rdb.HDel(Background, sliceRefs, r.sliceKey(chunkid, size)).Err()
+	}
+	return r.rdb.HSet(Background, sliceRefs, r.sliceKey(chunkid, size), refs-1).Err()
+}
+
+func (r *redisMeta) doSetTrashPath(inode Ino, parent Ino, path string) error {
+	if path == "" {
+		return r.rdb.HDel(Background, trashPathsKey, inode.String()).Err()
+	}
+	return r.rdb.HSet(Background, trashPathsKey, inode.String(), marshalTrashPath(parent, path)).Err()
+}
+
+func (r *redisMeta) doGetTrashPath(inode Ino) (Ino, string, error) {
+	buf, err := r.rdb.HGet(Background, trashPathsKey, inode.String()).Bytes()
+	if err == redis.Nil {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	parent, path := unmarshalTrashPath(buf)
+	return parent, path, nil
+}
+
+func (r *redisMeta) doFlushAtimes(atimes map[Ino]int64) error {
+	ctx := Background
+	keys := make([]string, 0, len(atimes))
+	inodes := make([]Ino, 0, len(atimes))
+	for inode := range atimes {
+		keys = append(keys, r.inodeKey(inode))
+		inodes = append(inodes, inode)
+	}
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		rs, err := tx.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, v := range rs {
+				if v == nil {
+					continue
+				}
+				var attr Attr
+				r.parseAttr([]byte(v.(string)), &attr)
+				ts := atimes[inodes[i]]
+				if unixNano(attr.Atime, attr.Atimensec) >= ts {
+					continue
+				}
+				attr.Atime, attr.Atimensec = ts/1e9, uint32(ts%1e9)
+				pipe.Set(ctx, keys[i], r.marshal(&attr), 0)
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+}
+
+func (r *redisMeta) doAddPack(pack *Pack, slices []PackedSlice) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range slices {
+			pipe.Set(ctx, r.packedKey(slices[i].Chunkid), marshalPacked(&slices[i]), 0)
+		}
+		pipe.HSet(ctx, packsKey, pack.Id, pack.Size)
+		pipe.HSet(ctx, packLiveKey, pack.Id, pack.Live)
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doGetPacked(chunkid uint64, s *PackedSlice) syscall.Errno {
+	buf, err := r.rdb.Get(Background, r.packedKey(chunkid)).Bytes()
+	if err == redis.Nil {
+		return syscall.ENOENT
+	} else if err != nil {
+		return errno(err)
+	}
+	unmarshalPacked(chunkid, buf, s)
+	return 0
+}
+
+func (r *redisMeta) doDeletePacked(chunkid uint64, size uint32) (uint64, error) {
+	ctx := Background
+	key := r.packedKey(chunkid)
+	var s PackedSlice
+	var live *redis.IntCmd
+	err := r.txn(ctx, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return syscall.ENOENT
+		} else if err != nil {
+			return err
+		}
+		unmarshalPacked(chunkid, buf, &s)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.HDel(ctx, sliceRefs, r.sliceKey(chunkid, size))
+			live = pipe.HIncrBy(ctx, packLiveKey, strconv.FormatUint(s.Pack, 10), -int64(s.Len))
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil || live.Val() > 0 {
+		return 0, err
+	}
+	field := strconv.FormatUint(s.Pack, 10)
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, packsKey, field)
+		pipe.HDel(ctx, packLiveKey, field)
+		return nil
+	})
+	return s.Pack, err
+}
+
+func (r *redisMeta) doListPacks() ([]*Pack, error) {
+	ctx := Background
+	sizes, err := r.rdb.HGetAll(ctx, packsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	lives, err := r.rdb.HGetAll(ctx, packLiveKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	packs := make([]*Pack, 0, len(sizes))
+	for k, v := range sizes {
+		id, _ := strconv.ParseUint(k, 10, 64)
+		size, _ := strconv.ParseUint(v, 10, 32)
+		live, _ := strconv.ParseInt(lives[k], 10, 64)
+		if live < 0 {
+			live = 0
+		}
+		packs = append(packs, &Pack{Id: id, Size: uint32(size), Live: uint32(live)})
+	}
+	return packs, nil
+}
+
+func (r *redisMeta) doListPacked(fn func(s *PackedSlice)) error {
+	ctx := Background
+	return r.scan(ctx, "packed*", func(keys []string) error {
+		values, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			chunkid, err := strconv.ParseUint(keys[i][len("packed"):], 10, 64)
+			if err != nil || v == nil {
+				continue
+			}
+			var s PackedSlice
+			unmarshalPacked(chunkid, []byte(v.(string)), &s)
+			fn(&s)
+		}
+		return nil
+	})
+}
+
+func (r *redisMeta) doRepack(old uint64, pack *Pack, slices []PackedSlice) error {
+	ctx := Background
+	keys := make([]string, 0, len(slices)+1)
+	for i := range slices {
+		keys = append(keys, r.packedKey(slices[i].Chunkid))
+	}
+	if len(keys) == 0 {
+		keys = append(keys, packLiveKey)
+	}
+	field := strconv.FormatUint(old, 10)
+	return r.txn(ctx, func(tx *redis.Tx) error {
+		pack.Live = 0
+		var moved []int
+		if len(slices) > 0 {
+			values, err := tx.MGet(ctx, keys...).Result()
+			if err != nil {
+				return err
+			}
+			for i, v := range values {
+				var cur PackedSlice
+				if v != nil {
+					unmarshalPacked(slices[i].Chunkid, []byte(v.(string)), &cur)
+				}
+				if cur.Pack == old {
+					moved = append(moved, i)
+					pack.Live += slices[i].Len
+				}
+			}
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, i := range moved {
+				pipe.Set(ctx, keys[i], marshalPacked(&slices[i]), 0)
+			}
+			if pack.Live > 0 {
+				pipe.HSet(ctx, packsKey, pack.Id, pack.Size)
+				pipe.HSet(ctx, packLiveKey, pack.Id, pack.Live)
+			}
+			pipe.HDel(ctx, packsKey, field)
+			pipe.HDel(ctx, packLiveKey, field)
+			return nil
+		})
+		return err
+	}, keys...)
+}
+
+func (r *redisMeta) doRefBlock(hash []byte, b *Block, owner *Block) syscall.Errno {
+	ctx := Background
+	key := r.dedupKey(hash)
+	return errno(r.txn(ctx, func(tx *redis.Tx) error {
+		buf, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return syscall.ENOENT
+		} else if err != nil {
+			return err
+		}
+		refs := unmarshalBlock(buf, owner)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, marshalBlock(owner, refs+1), 0)
+			pipe.Set(ctx, r.blockRefKey(b.Chunkid, b.Indx), hash, 0)
+			return nil
+		})
+		return err
+	}, key))
+}
+
+func (r *redisMeta) doAddBlock(hash []byte, b *Block) syscall.Errno {
+	ctx := Background
+	key := r.dedupKey(hash)
+	return errno(r.txn(ctx, func(tx *redis.Tx) error {
+		if n, err := tx.Exists(ctx, key).Result(); err != nil {
+			return err
+		} else if n > 0 {
+			return syscall.EEXIST
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, marshalBlock(b, 1), 0)
+			pipe.Set(ctx, r.blockRefKey(b.Chunkid, b.Indx), hash, 0)
+			return nil
+		})
+		return err
+	}, key))
+}
+
+func (r *redisMeta) doFindBlock(chunkid uint64, indx uint32, owner *Block) syscall.Errno {
+	ctx := Background
+	hash, err := r.rdb.Get(ctx, r.blockRefKey(chunkid, indx)).Bytes()
+	if err == redis.Nil {
+		return syscall.ENOENT
+	} else if err != nil {
+		return errno(err)
+	}
+	buf, err := r.rdb.Get(ctx, r.dedupKey(hash)).Bytes()
+	if err == redis.Nil {
+		return syscall.ENOENT
+	} else if err != nil {
+		return errno(err)
+	}
+	unmarshalBlock(buf, owner)
+	return 0
+}
+
+func (r *redisMeta) doDerefSlice(chunkid uint64, size uint32, blocks []Block) ([]Block, error) {
+	ctx := Background
+	keys := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		keys = append(keys, r.blockRefKey(b.Chunkid, b.Indx))
+	}
+	if len(keys) == 0 {
+		return nil, r.rdb.HDel(ctx, sliceRefs, r.sliceKey(chunkid, size)).Err()
+	}
+	var todel []Block
+	err := r.txn(ctx, func(tx *redis.Tx) error {
+		values, err := tx.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		refs := make([][]byte, len(values))
+		var dkeys []string
+		var hashes [][]byte
+		for i, v := range values {
+			if v != nil {
+				refs[i] = []byte(v.(string))
+				dkeys = append(dkeys, r.dedupKey(refs[i]))
+				hashes = append(hashes, refs[i])
+			}
+		}
+		owners := make(map[string]*Block)
+		counts := make(map[string]uint32)
+		if len(dkeys) > 0 {
+			if err = tx.Watch(ctx, dkeys...).Err(); err != nil {
+				return err
+			}
+			vals, err := tx.MGet(ctx, dkeys...).Result()
+			if err != nil {
+				return err
+			}
+			for i, v := range vals {
+				if v != nil {
+					var owner Block
+					counts[string(hashes[i])] = unmarshalBlock([]byte(v.(string)), &owner)
+					owners[string(hashes[i])] = &owner
+				}
+			}
+		}
+		todel = derefBlocks(blocks, refs, owners, counts)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for h, owner := range owners {
+				if n, ok := counts[h]; ok {
+					pipe.Set(ctx, r.dedupKey([]byte(h)), marshalBlock(owner, n), 0)
+				} else {
+					pipe.Del(ctx, r.dedupKey([]byte(h)))
+				}
+			}
+			pipe.Del(ctx, keys...)
+			pipe.HDel(ctx, sliceRefs, r.sliceKey(chunkid, size))
+			return nil
+		})
+		return err
+	}, keys...)
+	return todel, err
+}
+
+func (r *redisMeta) doListDedup(fn func(hash []byte, owner *Block, refs uint32)) error {
+	ctx := Background
+	return r.scan(ctx, "dedup*", func(keys []string) error {
+		values, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			hash, err := hex.DecodeString(keys[i][len("dedup"):])
+			if err != nil || v == nil {
+				continue
+			}
+			var owner Block
+			refs := unmarshalBlock([]byte(v.(string)), &owner)
+			fn(hash, &owner, refs)
+		}
+		return nil
+	})
+}
+
+func (r *redisMeta) doListBlockRefs(fn func(b *Block, hash []byte)) error {
+	ctx := Background
+	return r.scan(ctx, "blockRef*", func(keys []string) error {
+		values, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			ps := strings.Split(keys[i][len("blockRef"):], "_")
+			if len(ps) != 2 || v == nil {
+				continue
+			}
+			chunkid, _ := strconv.ParseUint(ps[0], 10, 64)
+			indx, _ := strconv.ParseUint(ps[1], 10, 32)
+			fn(&Block{Chunkid: chunkid, Indx: uint32(indx)}, []byte(v.(string)))
+		}
+		return nil
+	})
+}
+
+func (r *redisMeta) doSetDedup(hash []byte, owner *Block, refs []Block) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.dedupKey(hash), marshalBlock(owner, uint32(len(refs))), 0)
+		for _, b := range refs {
+			pipe.Set(ctx, r.blockRefKey(b.Chunkid, b.Indx), hash, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doSetSliceTier(chunkid uint64, tier uint8) error {
+	ctx := Background
+	if tier == 0 {
+		return r.rdb.HDel(ctx, sliceTiersKey, strconv.FormatUint(chunkid, 10)).Err()
+	}
+	return r.rdb.HSet(ctx, sliceTiersKey, chunkid, tier).Err()
+}
+
+func (r *redisMeta) doGetSliceTier(chunkid uint64) (uint8, error) {
+	tier, err := r.rdb.HGet(Background, sliceTiersKey, strconv.FormatUint(chunkid, 10)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return uint8(tier), err
+}
+
+func (r *redisMeta) doListSliceTiers(fn func(chunkid uint64, tier uint8)) error {
+	tiers, err := r.rdb.HGetAll(Background, sliceTiersKey).Result()
+	if err != nil {
+		return err
+	}
+	for k, v := range tiers {
+		chunkid, _ := strconv.ParseUint(k, 10, 64)
+		tier, _ := strconv.ParseUint(v, 10, 8)
+		fn(chunkid, uint8(tier))
+	}
+	return nil
+}
+
+func (r *redisMeta) checkServerConfig() {
+	rawInfo, err := r.rdb.Info(Background).Result()
+	if err != nil {
+		logger.Warnf("parse info: %s", err)
+		return
+	}
+	_, err = checkRedisInfo(rawInfo)
+	if err != nil {
+		logger.Warnf("parse info: %s", err)
+	}
+
+	start := time.Now()
+	_ = r.rdb.Ping(Background)
+	logger.Infof("Ping redis: %s", time.Since(start))
+}
+
+func (m *redisMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
+	ctx := Background
+	e := &DumpedEntry{}
+	return e, m.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, m.inodeKey(inode)).Bytes()
+		if err != nil {
+			if err != redis.Nil {
+				return err
+			}
+			logger.Warnf("The entry of the inode was not found. inode: %v", inode)
+		}
+		attr := &Attr{Typ: typ, Nlink: 1}
+		m.parseAttr(a, attr)
+		e.Attr = dumpAttr(attr)
+		e.Attr.Inode = inode
+
+		keys, err := tx.HGetAll(ctx, m.xattrKey(inode)).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			xattrs := make([]*DumpedXattr, 0, len(keys))
+			for k, v := range keys {
+				xattrs = append(xattrs, &DumpedXattr{k, v})
+			}
+			sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+			e.Xattrs = xattrs
+		}
+		if attr.Flags&(FlagAccessACL|FlagDefaultACL) != 0 {
+			vals, err := tx.HGetAll(ctx, m.aclKey(inode)).Result()
+			if err != nil {
+				return err
+			}
+			m.dumpFacl(inode, vals, e)
+		}
+
+		if attr.Typ == TypeFile {
+			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+				vals, err := tx.LRange(ctx, m.chunkKey(inode, indx), 0, 1000000).Result()
+				if err != nil {
+					return err
+				}
+				ss := readSlices(vals)
+				slices := make([]*DumpedSlice, 0, len(ss))
+				for _, s := range ss {
+					slices = append(slices, &DumpedSlice{Chunkid: s.chunkid, Pos: s.pos, Size: s.size, Off: s.off, Len: s.len})
+				}
+				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
+			}
+			if attr.Flags&FlagInline != 0 {
+				if e.Inline, err = tx.Get(ctx, m.inlineKey(inode)).Bytes(); err != nil && err != redis.Nil {
+					return err
+				}
+			}
+		} else if attr.Typ == TypeSymlink {
+			if e.Symlink, err = tx.Get(ctx, m.symKey(inode)).Result(); err != nil {
+				if err != redis.Nil {
+					return err
 				}
 				logger.Warnf("The symlink of inode %d is not found", inode)
 			}
@@ -2648,6 +3929,9 @@ func (m *redisMeta) dumpEntryFast(inode Ino, typ uint8) *DumpedEntry {
 		sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
 		e.Xattrs = xattrs
 	}
+	if attr.Flags&(FlagAccessACL|FlagDefaultACL) != 0 {
+		m.dumpFacl(inode, m.snap.hashMap[m.aclKey(inode)], e)
+	}
 
 	if attr.Typ == TypeFile {
 		for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
@@ -2659,6 +3943,9 @@ func (m *redisMeta) dumpEntryFast(inode Ino, typ uint8) *DumpedEntry {
 			}
 			e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
 		}
+		if attr.Flags&FlagInline != 0 {
+			e.Inline = []byte(m.snap.stringMap[m.inlineKey(inode)])
+		}
 	} else if attr.Typ == TypeSymlink {
 		if m.snap.stringMap[m.symKey(inode)] == "" {
 			logger.Warnf("The symlink of inode %d is not found", inode)
@@ -2668,12 +3955,7 @@ func (m *redisMeta) dumpEntryFast(inode Ino, typ uint8) *DumpedEntry {
 	return e
 }
 
-func (m *redisMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth int, showProgress func(totalIncr, currentIncr int64)) error {
-	bwWrite := func(s string) {
-		if _, err := bw.WriteString(s); err != nil {
-			panic(err)
-		}
-	}
+func (m *redisMeta) dumpDir(inode Ino, tree *DumpedEntry, dw dumpWriter, depth int, showProgress func(totalIncr, currentIncr int64)) error {
 	var err error
 	var dirs map[string]string
 	if m.snap != nil {
@@ -2688,7 +3970,7 @@ func (m *redisMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, dept
 	if showProgress != nil {
 		showProgress(int64(len(dirs)), 0)
 	}
-	if err = tree.writeJsonWithOutEntry(bw, depth); err != nil {
+	if err = dw.beginDir(tree, depth); err != nil {
 		return err
 	}
 	var sortedName []string
@@ -2696,7 +3978,7 @@ func (m *redisMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, dept
 		sortedName = append(sortedName, name)
 	}
 	sort.Slice(sortedName, func(i, j int) bool { return sortedName[i] < sortedName[j] })
-	for idx, name := range sortedName {
+	for _, name := range sortedName {
 		typ, inode := m.parseEntry([]byte(dirs[name]))
 		var entry *DumpedEntry
 		if m.snap != nil {
@@ -2713,26 +3995,22 @@ func (m *redisMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, dept
 
 		entry.Name = name
 		if typ == TypeDirectory {
-			err = m.dumpDir(inode, entry, bw, depth+2, showProgress)
+			err = m.dumpDir(inode, entry, dw, depth+2, showProgress)
 		} else {
-			err = entry.writeJSON(bw, depth+2)
+			err = dw.writeEntry(entry, depth+2)
 		}
 		if err != nil {
 			return err
 		}
-		if idx != len(sortedName)-1 {
-			bwWrite(",")
-		}
 		if showProgress != nil {
 			showProgress(0, 1)
 		}
 	}
-	bwWrite(fmt.Sprintf("\n%s}\n%s}", strings.Repeat(jsonIndent, depth+1), strings.Repeat(jsonIndent, depth)))
-	return nil
+	return dw.endDir(depth)
 }
 
 type redisSnap struct {
-	stringMap map[string]string            //i* s*
+	stringMap map[string]string            //i* s* b*
 	listMap   map[string][]string          //c*
 	hashMap   map[string]map[string]string //d*(included delfiles) x*
 }
@@ -2804,11 +4082,13 @@ func (m *redisMeta) makeSnap(bar *utils.Bar) error {
 	}
 
 	typeMap := map[string]func(keys []string) error{
-		"c*": listType,
-		"i*": stringType,
-		"s*": stringType,
-		"d*": hashType,
-		"x*": hashType,
+		"c*":   listType,
+		"i*":   stringType,
+		"s*":   stringType,
+		"b*":   stringType,
+		"d*":   hashType,
+		"x*":   hashType,
+		"acl*": hashType,
 	}
 
 	scanner := func(match string, handlerKey func(keys []string) error) error {
@@ -2839,7 +4119,7 @@ func (m *redisMeta) makeSnap(bar *utils.Bar) error {
 	return nil
 }
 
-func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
+func (m *redisMeta) DumpMeta(w io.Writer, root Ino, format DumpFormat) (err error) {
 	defer func() {
 		if p := recover(); p != nil {
 			if e, ok := p.(error); ok {
@@ -2934,11 +4214,20 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		Sustained: sessions,
 		DelFiles:  dels,
 	}
+	if dm.Packs, err = m.dumpPacks(); err != nil {
+		return err
+	}
+	if dm.Dedup, err = m.dumpDedup(); err != nil {
+		return err
+	}
+	if dm.Tiers, err = m.dumpSliceTiers(); err != nil {
+		return err
+	}
 	if dm.Setting.SecretKey != "" {
 		dm.Setting.SecretKey = "removed"
 		logger.Warnf("Secret key is removed for the sake of safety")
 	}
-	bw, err := dm.writeJsonWithOutTree(w)
+	dw, err := newDumpWriter(w, dm, format)
 	if err != nil {
 		return err
 	}
@@ -2954,200 +4243,168 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		bar.IncrTotal(totalIncr)
 		bar.IncrInt64(currentIncr)
 	}
-	if err = m.dumpDir(root, tree, bw, 1, showProgress); err != nil {
+	if err = m.dumpDir(root, tree, dw, 1, showProgress); err != nil {
 		return err
 	}
 	if trash != nil {
-		if _, err = bw.WriteString(","); err != nil {
-			return err
-		}
-		if err = m.dumpDir(TrashInode, trash, bw, 1, showProgress); err != nil {
+		if err = m.dumpDir(TrashInode, trash, dw, 1, showProgress); err != nil {
 			return err
 		}
 	}
-	if _, err = bw.WriteString("\n}\n"); err != nil {
+	if err = dw.finish(); err != nil {
 		return err
 	}
 	progress.Done()
 	m.snap = nil
+	return nil
+}
 
-	return bw.Flush()
+func (m *redisMeta) doLoadStart() (uint64, error) {
+	ctx := Background
+	dbsize, err := m.rdb.DBSize(ctx).Result()
+	if err != nil {
+		return 0, err
+	}
+	if dbsize == 0 {
+		return 0, m.rdb.Set(ctx, loadedEntries, 0, 0).Err()
+	}
+	if n, err := m.rdb.Exists(ctx, "setting").Result(); err != nil || n > 0 {
+		return 0, fmt.Errorf("Database %s is not empty", m.Name())
+	}
+	loaded, err := m.rdb.Get(ctx, loadedEntries).Uint64()
+	if err != nil {
+		return 0, fmt.Errorf("Database %s is not empty", m.Name())
+	}
+	return loaded, nil
 }
 
-func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]int) error {
-	inode := e.Attr.Inode
-	logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
+func (m *redisMeta) doLoadEntries(b *loadBatch) error {
 	ctx := Background
-	attr := loadAttr(e.Attr)
-	attr.Parent = e.Parent
-	p := m.rdb.Pipeline()
-	if attr.Typ == TypeFile {
-		attr.Length = e.Attr.Length
-		for _, c := range e.Chunks {
-			if len(c.Slices) == 0 {
-				continue
+	_, err := m.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for _, e := range b.entries {
+			inode := e.Attr.Inode
+			logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
+			attr := loadAttr(e.Attr)
+			attr.Parent = e.Parent
+			switch attr.Typ {
+			case TypeFile:
+				attr.Length = e.Attr.Length
+				for _, c := range e.Chunks {
+					if len(c.Slices) == 0 {
+						continue
+					}
+					slices := make([]string, 0, len(c.Slices))
+					for _, s := range c.Slices {
+						slices = append(slices, string(marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)))
+					}
+					p.RPush(ctx, m.chunkKey(inode, c.Index), slices)
+				}
+				if len(e.Inline) > 0 {
+					p.Set(ctx, m.inlineKey(inode), e.Inline, 0)
+				}
+			case TypeDirectory:
+				attr.Length = 4 << 10
+			case TypeSymlink:
+				attr.Length = uint64(len(e.Symlink))
+				p.Set(ctx, m.symKey(inode), e.Symlink, 0)
 			}
-			slices := make([]string, 0, len(c.Slices))
-			for _, s := range c.Slices {
-				slices = append(slices, string(marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)))
-				m.Lock()
-				refs[m.sliceKey(s.Chunkid, s.Size)]++
-				m.Unlock()
-				if cs.NextChunk < int64(s.Chunkid) {
-					cs.NextChunk = int64(s.Chunkid)
+			if len(e.Xattrs) > 0 {
+				xattrs := make(map[string]interface{})
+				for _, x := range e.Xattrs {
+					xattrs[x.Name] = x.Value
 				}
+				p.HSet(ctx, m.xattrKey(inode), xattrs)
 			}
-			p.RPush(ctx, m.chunkKey(inode, c.Index), slices)
-		}
-	} else if attr.Typ == TypeDirectory {
-		attr.Length = 4 << 10
-		if len(e.Entries) > 0 {
-			dentries := make(map[string]interface{})
-			for _, c := range e.Entries {
-				dentries[c.Name] = m.packEntry(typeFromString(c.Attr.Type), c.Attr.Inode)
+			if attr.Flags = loadFacl(e); attr.Flags != 0 {
+				m.setFacl(ctx, p, inode, acl.TypeAccess, e.AccessACL)
+				m.setFacl(ctx, p, inode, acl.TypeDefault, e.DefaultACL)
+			}
+			if attr.Typ == TypeFile && len(e.Inline) > 0 {
+				attr.Flags |= FlagInline
+			}
+			p.Set(ctx, m.inodeKey(inode), m.marshal(attr), 0)
+			if inode != 1 && inode != TrashInode {
+				p.HSet(ctx, m.entryKey(e.Parent), e.Name, m.packEntry(attr.Typ, inode))
 			}
-			p.HSet(ctx, m.entryKey(inode), dentries)
-		}
-	} else if attr.Typ == TypeSymlink {
-		attr.Length = uint64(len(e.Symlink))
-		p.Set(ctx, m.symKey(inode), e.Symlink, 0)
-	}
-	if inode > 1 && inode != TrashInode {
-		cs.UsedSpace += align4K(attr.Length)
-		cs.UsedInodes += 1
-	}
-	if inode < TrashInode {
-		if cs.NextInode < int64(inode) {
-			cs.NextInode = int64(inode)
 		}
-	} else {
-		if cs.NextTrash < int64(inode)-TrashInode {
-			cs.NextTrash = int64(inode) - TrashInode
+		for _, e := range b.links {
+			p.HSet(ctx, m.entryKey(e.Parent), e.Name, m.packEntry(TypeFile, e.Attr.Inode))
 		}
-	}
-
-	if len(e.Xattrs) > 0 {
-		xattrs := make(map[string]interface{})
-		for _, x := range e.Xattrs {
-			xattrs[x.Name] = x.Value
+		for k, v := range b.slices {
+			p.HIncrBy(ctx, loadingRefs, m.sliceKey(k.id, k.size), v)
 		}
-		p.HSet(ctx, m.xattrKey(inode), xattrs)
-	}
-	p.Set(ctx, m.inodeKey(inode), m.marshal(attr), 0)
-	_, err := p.Exec(ctx)
+		p.Set(ctx, loadedEntries, b.loaded, 0)
+		return nil
+	})
 	return err
 }
 
-func (m *redisMeta) LoadMeta(r io.Reader) error {
+func (m *redisMeta) doLoadFinish(dm *DumpedMeta, cs *DumpedCounters, nlinks map[Ino]uint32) error {
 	ctx := Background
-	dbsize, err := m.rdb.DBSize(ctx).Result()
-	if err != nil {
-		return err
-	}
-	if dbsize > 0 {
-		return fmt.Errorf("Database %s is not empty", m.Name())
-	}
-
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err = dec.Decode(dm); err != nil {
-		return err
-	}
 	format, err := json.MarshalIndent(dm.Setting, "", "")
 	if err != nil {
 		return err
 	}
-
-	progress := utils.NewProgress(false, false)
-	bar := progress.AddCountBar("Collected entries", 1) // with root
-	showProgress := func(totalIncr, currentIncr int64) {
-		bar.IncrTotal(totalIncr)
-		bar.IncrInt64(currentIncr)
-	}
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, showProgress); err != nil {
-		return err
-	}
-	if dm.Trash != nil {
-		bar.IncrTotal(1)
-		if err = collectEntry(dm.Trash, entries, showProgress); err != nil {
+	// move the slice references, only the extra ones are kept
+	var cursor uint64
+	for {
+		var kvs []string
+		if kvs, cursor, err = m.rdb.HScan(ctx, loadingRefs, cursor, "*", 1000).Result(); err != nil {
 			return err
 		}
+		if len(kvs) > 0 {
+			_, err = m.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				for i := 0; i < len(kvs); i += 2 {
+					if v, _ := strconv.Atoi(kvs[i+1]); v > 1 {
+						p.HSet(ctx, sliceRefs, kvs[i], v-1)
+					}
+					p.HDel(ctx, loadingRefs, kvs[i])
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			break
+		}
 	}
-	bar.Done()
-
-	counters := &DumpedCounters{}
-	refs := make(map[string]int)
-	bar = progress.AddCountBar("Loaded entries", int64(len(entries)))
-	maxNum := 100
-	pool := make(chan struct{}, maxNum)
-	errCh := make(chan error, 100)
-	done := make(chan struct{}, 1)
-	var wg sync.WaitGroup
-	for _, entry := range entries {
-		select {
-		case err = <-errCh:
+	for inode, n := range nlinks {
+		a, err := m.rdb.Get(ctx, m.inodeKey(inode)).Bytes()
+		if err != nil {
 			return err
-		default:
 		}
-		pool <- struct{}{}
-		wg.Add(1)
-		go func(entry *DumpedEntry) {
-			defer func() {
-				wg.Done()
-				bar.Increment()
-				<-pool
-			}()
-			if err = m.loadEntry(entry, counters, refs); err != nil {
-				errCh <- err
-			}
-		}(entry)
-	}
-
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case err = <-errCh:
-		return err
-	case <-done:
-	}
-	progress.Done()
-	logger.Infof("Dumped counters: %+v", *dm.Counters)
-	logger.Infof("Loaded counters: %+v", *counters)
-
-	p := m.rdb.Pipeline()
-	p.Set(ctx, "setting", format, 0)
-	cs := make(map[string]interface{})
-	cs[usedSpace] = counters.UsedSpace
-	cs[totalInodes] = counters.UsedInodes
-	cs["nextinode"] = counters.NextInode
-	cs["nextchunk"] = counters.NextChunk
-	cs["nextsession"] = counters.NextSession
-	cs["nextTrash"] = counters.NextTrash
-	p.MSet(ctx, cs)
-	if len(dm.DelFiles) > 0 {
-		zs := make([]*redis.Z, 0, len(dm.DelFiles))
-		for _, d := range dm.DelFiles {
-			zs = append(zs, &redis.Z{
-				Score:  float64(d.Expire),
-				Member: m.toDelete(d.Inode, d.Length),
-			})
+		var attr Attr
+		m.parseAttr(a, &attr)
+		attr.Nlink = n
+		if err = m.rdb.Set(ctx, m.inodeKey(inode), m.marshal(&attr), 0).Err(); err != nil {
+			return err
 		}
-		p.ZAdd(ctx, delfiles, zs...)
 	}
-	slices := make(map[string]interface{})
-	for k, v := range refs {
-		if v > 1 {
-			slices[k] = v - 1
+
+	_, err = m.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, "setting", format, 0)
+		counters := make(map[string]interface{})
+		counters[usedSpace] = cs.UsedSpace
+		counters[totalInodes] = cs.UsedInodes
+		counters["nextinode"] = cs.NextInode - 1 // the last one allocated
+		counters["nextchunk"] = cs.NextChunk - 1
+		counters["nextsession"] = cs.NextSession
+		counters["nextTrash"] = cs.NextTrash
+		p.MSet(ctx, counters)
+		if len(dm.DelFiles) > 0 {
+			zs := make([]*redis.Z, 0, len(dm.DelFiles))
+			for _, d := range dm.DelFiles {
+				zs = append(zs, &redis.Z{
+					Score:  float64(d.Expire),
+					Member: m.toDelete(d.Inode, d.Length),
+				})
+			}
+			p.ZAdd(ctx, delfiles, zs...)
 		}
-	}
-	if len(slices) > 0 {
-		p.HSet(ctx, sliceRefs, slices)
-	}
-	_, err = p.Exec(ctx)
+		p.Del(ctx, loadedEntries)
+		return nil
+	})
 	return err
 }
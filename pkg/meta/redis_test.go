@@ -20,7 +20,9 @@ package meta
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"reflect"
 	"runtime"
 	"strconv"
 	"sync"
@@ -28,6 +30,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -60,12 +63,27 @@ func testMeta(t *testing.T, m Meta) {
 	testMetaClient(t, m)
 	testTruncateAndDelete(t, m)
 	testTrash(t, m)
+	testTrashRestore(t, m, base)
 	testRemove(t, m)
 	testStickyBit(t, m)
 	testLocks(t, m)
 	testConcurrentWrite(t, m)
 	testCompaction(t, m)
 	testCopyFileRange(t, m)
+	testAtime(t, m, base)
+	testDirQuota(t, m, base)
+	testOwnerQuota(t, m, base)
+	testDirStat(t, m, base)
+	testACL(t, m, base)
+	testClone(t, m)
+	testSnapshot(t, m)
+	testChangelog(t, m, base)
+	testCacheInvalidation(t, m, base)
+	testInline(t, m, base)
+	testPack(t, m, base)
+	testDedup(t, m, base)
+	testTier(t, m, base)
+	testCheckMeta(t, m, base)
 	testCloseSession(t, m)
 	base.conf.CaseInsensi = true
 	testCaseIncensi(t, m)
@@ -1208,6 +1226,205 @@ func testTrash(t *testing.T, m Meta) {
 	}
 }
 
+func testTrashRestore(t *testing.T, m Meta, base *baseMeta) {
+	if err := m.Init(Format{Name: "test", TrashDays: 1}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	ctx := Background
+	var d1, d2, f1, f2, f3, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "rd", 0755, 022, 0, &d1, attr); st != 0 {
+		t.Fatalf("mkdir rd: %s", st)
+	}
+	if st := m.Mkdir(ctx, d1, "sub", 0755, 022, 0, &d2, attr); st != 0 {
+		t.Fatalf("mkdir rd/sub: %s", st)
+	}
+	if st := m.Create(ctx, d2, "f1", 0644, 022, 0, &f1, attr); st != 0 {
+		t.Fatalf("create rd/sub/f1: %s", st)
+	}
+	if st := m.Create(ctx, d1, "f2", 0644, 022, 0, &f2, attr); st != 0 {
+		t.Fatalf("create rd/f2: %s", st)
+	}
+	if st := m.Create(ctx, 1, "f3", 0644, 022, 0, &f3, attr); st != 0 {
+		t.Fatalf("create f3: %s", st)
+	}
+	// remove the whole tree, and f3
+	for _, e := range []struct {
+		parent Ino
+		name   string
+		dir    bool
+	}{{d2, "f1", false}, {d1, "sub", true}, {d1, "f2", false}, {1, "rd", true}, {1, "f3", false}} {
+		st := m.Unlink(ctx, e.parent, e.name)
+		if e.dir {
+			st = m.Rmdir(ctx, e.parent, e.name)
+		}
+		if st != 0 {
+			t.Fatalf("remove %s in %d: %s", e.name, e.parent, st)
+		}
+	}
+
+	entries, err := m.ListTrash(ctx, "", time.Now().Add(-time.Hour))
+	if err != nil || len(entries) != 5 {
+		t.Fatalf("list trash: %d entries, %v", len(entries), err)
+	}
+	paths := make(map[Ino]string)
+	for _, e := range entries {
+		paths[e.Inode] = e.Path
+	}
+	if paths[f1] != "/rd/sub/f1" || paths[d1] != "/rd" || paths[f3] != "/f3" {
+		t.Fatalf("paths of entries in trash: %v", paths)
+	}
+	if entries, err = m.ListTrash(ctx, "", time.Now().Add(time.Hour)); err != nil || len(entries) != 0 {
+		t.Fatalf("list trash in the future: %d entries, %v", len(entries), err)
+	}
+	if entries, err = m.ListTrash(ctx, "f?", time.Time{}); err != nil || len(entries) != 3 {
+		t.Fatalf("list trash by name: %d entries, %v", len(entries), err)
+	}
+	if _, err = m.ListTrash(ctx, "[", time.Time{}); err == nil {
+		t.Fatalf("list trash with a bad pattern should fail")
+	}
+
+	// restore the tree, which is created again under its original path
+	if entries, err = m.ListTrash(ctx, "/rd", time.Time{}); err != nil || len(entries) != 4 {
+		t.Fatalf("list trash under /rd: %d entries, %v", len(entries), err)
+	}
+	if err = m.RestoreTrash(ctx, entries, ""); err != nil {
+		t.Fatalf("restore /rd: %s", err)
+	}
+	if st := m.Lookup(ctx, 1, "rd", &inode, attr); st != 0 || inode != d1 || attr.Nlink != 3 {
+		t.Fatalf("lookup rd: %s, inode %d, nlink %d", st, inode, attr.Nlink)
+	}
+	if st := m.Lookup(ctx, d1, "sub", &inode, attr); st != 0 || inode != d2 || attr.Parent != d1 {
+		t.Fatalf("lookup rd/sub: %s, inode %d, parent %d", st, inode, attr.Parent)
+	}
+	if st := m.Lookup(ctx, d2, "f1", &inode, attr); st != 0 || inode != f1 || attr.Parent != d2 {
+		t.Fatalf("lookup rd/sub/f1: %s, inode %d, parent %d", st, inode, attr.Parent)
+	}
+	if st := m.Lookup(ctx, d1, "f2", &inode, attr); st != 0 || inode != f2 {
+		t.Fatalf("lookup rd/f2: %s, inode %d", st, inode)
+	}
+
+	// restore f3 into another directory, and with a conflict name
+	if entries, err = m.ListTrash(ctx, "/f3", time.Time{}); err != nil || len(entries) != 1 {
+		t.Fatalf("list trash of /f3: %d entries, %v", len(entries), err)
+	}
+	if err = m.RestoreTrash(ctx, entries, "/rd"); err != nil {
+		t.Fatalf("restore /f3 into /rd: %s", err)
+	}
+	if st := m.Lookup(ctx, d1, "f3", &inode, attr); st != 0 || inode != f3 || entries[0].Restored != "/rd/f3" {
+		t.Fatalf("lookup rd/f3: %s, inode %d, restored as %s", st, inode, entries[0].Restored)
+	}
+	if st := m.Unlink(ctx, d1, "f3"); st != 0 {
+		t.Fatalf("unlink rd/f3: %s", st)
+	}
+	if st := m.Create(ctx, d1, "f3", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create rd/f3: %s", st)
+	}
+	if entries, err = m.ListTrash(ctx, "/rd/f3", time.Time{}); err != nil || len(entries) != 1 {
+		t.Fatalf("list trash of /rd/f3: %d entries, %v", len(entries), err)
+	}
+	if err = m.RestoreTrash(ctx, entries, ""); err != nil {
+		t.Fatalf("restore /rd/f3: %s", err)
+	}
+	name := fmt.Sprintf("f3.restored-%d", f3)
+	if st := m.Lookup(ctx, d1, name, &inode, attr); st != 0 || inode != f3 || entries[0].Restored != "/rd/"+name {
+		t.Fatalf("lookup rd/%s: %s, inode %d, restored as %s", name, st, inode, entries[0].Restored)
+	}
+	if entries, err = m.ListTrash(ctx, "", time.Time{}); err != nil || len(entries) != 0 {
+		t.Fatalf("list trash: %d entries, %v", len(entries), err)
+	}
+	if err = m.RestoreTrash(ctx, entries, "/f3"); err == nil {
+		t.Fatalf("restore into a file should fail")
+	}
+
+	for _, e := range []struct {
+		parent Ino
+		name   string
+	}{{d2, "f1"}, {d1, "f2"}, {d1, "f3"}, {d1, name}} {
+		if st := m.Unlink(ctx, e.parent, e.name); st != 0 {
+			t.Fatalf("unlink %s: %s", e.name, st)
+		}
+	}
+	if st := m.Rmdir(ctx, d1, "sub"); st != 0 {
+		t.Fatalf("rmdir rd/sub: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "rd"); st != 0 {
+		t.Fatalf("rmdir rd: %s", st)
+	}
+	switch bm := m.(type) {
+	case *redisMeta:
+		bm.doCleanupTrash(true)
+	case *dbMeta:
+		bm.doCleanupTrash(true)
+	case *kvMeta:
+		bm.doCleanupTrash(true)
+	}
+	if _, p, err := base.en.doGetTrashPath(f1); err != nil || p != "" {
+		t.Fatalf("path of f1 after cleanup: %q, %v", p, err)
+	}
+}
+
+func testAtime(t *testing.T, m Meta, base *baseMeta) {
+	defer func() { base.conf.AtimeMode = "" }()
+	ctx := Background
+	var inode, dir Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "fatime", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create fatime: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "fatime")
+	if st := m.Mkdir(ctx, 1, "datime", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir datime: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "datime")
+	read := func(inode Ino) int64 {
+		var slices []Slice
+		var entries []*Entry
+		st := m.Read(ctx, inode, 0, &slices)
+		if inode == dir {
+			st = m.Readdir(ctx, inode, 0, &entries)
+		}
+		if st != 0 {
+			t.Fatalf("read %d: %s", inode, st)
+		}
+		base.syncAtimes()
+		if st = m.GetAttr(ctx, inode, attr); st != 0 {
+			t.Fatalf("getattr %d: %s", inode, st)
+		}
+		return unixNano(attr.Atime, attr.Atimensec)
+	}
+	now := time.Now().UnixNano()
+	for _, ino := range []Ino{inode, dir} {
+		base.conf.AtimeMode = NoAtime
+		if atime := read(ino); atime > now {
+			t.Fatalf("atime of %d is updated with noatime: %d > %d", ino, atime, now)
+		}
+		base.conf.AtimeMode = RelAtime
+		atime := read(ino)
+		if atime <= now {
+			t.Fatalf("atime of %d is not updated with relatime: %d <= %d", ino, atime, now)
+		}
+		if atime2 := read(ino); atime2 != atime {
+			t.Fatalf("atime of %d is updated again with relatime: %d != %d", ino, atime2, atime)
+		}
+		base.conf.AtimeMode = StrictAtime
+		time.Sleep(time.Millisecond * 10)
+		if atime2 := read(ino); atime2 <= atime {
+			t.Fatalf("atime of %d is not updated with strictatime: %d <= %d", ino, atime2, atime)
+		}
+	}
+
+	// the older access time is ignored
+	future := time.Now().Unix() + 3600
+	attr.Atime, attr.Atimensec = future, 0
+	if st := m.SetAttr(ctx, inode, SetAttrAtime, 0, attr); st != 0 {
+		t.Fatalf("setattr: %s", st)
+	}
+	if atime := read(inode); atime != future*1e9 {
+		t.Fatalf("atime is overwritten by an older one: %d != %d", atime, future*1e9)
+	}
+}
+
 func testOpenCache(t *testing.T, m Meta) {
 	ctx := Background
 	var inode Ino
@@ -1259,3 +1476,1429 @@ func testReadOnly(t *testing.T, m Meta) {
 		t.Fatalf("open f: %s", st)
 	}
 }
+
+func testDirQuota(t *testing.T, m Meta, base *baseMeta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var parent, inode, dir Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "qdir", 0755, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir qdir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "qdir")
+	if err := m.HandleQuota(ctx, QuotaGet, DirQuota, "/qdir", make(map[string]*Quota), false); err == nil {
+		t.Fatalf("get quota of qdir should fail")
+	}
+	qs := map[string]*Quota{"/qdir": {MaxSpace: 64 << 10, MaxInodes: 2}}
+	if err := m.HandleQuota(ctx, QuotaSet, DirQuota, "/qdir", qs, false); err != nil {
+		t.Fatalf("set quota: %s", err)
+	}
+	base.loadQuotas()
+
+	if st := m.Create(ctx, parent, "f1", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f1: %s", st)
+	}
+	if st := m.Mkdir(ctx, parent, "d1", 0755, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir d1: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f2", 0644, 022, 0, nil, attr); st != syscall.EDQUOT {
+		t.Fatalf("create f2 should fail with EDQUOT: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f2", 0644, 022, 0, nil, attr); st != syscall.EDQUOT {
+		t.Fatalf("create d1/f2 should fail with EDQUOT: %s", st)
+	}
+	var chunkid uint64
+	m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, inode, 0, 0, Slice{chunkid, 1 << 20, 0, 1 << 20}); st != syscall.EDQUOT {
+		t.Fatalf("write 1MB should fail with EDQUOT: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{chunkid, 32 << 10, 0, 32 << 10}); st != 0 {
+		t.Fatalf("write 32KB: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 1<<20, attr); st != syscall.EDQUOT {
+		t.Fatalf("truncate to 1MB should fail with EDQUOT: %s", st)
+	}
+
+	base.syncQuotas()
+	qs = make(map[string]*Quota)
+	if err := m.HandleQuota(ctx, QuotaGet, DirQuota, "/qdir", qs, false); err != nil {
+		t.Fatalf("get quota: %s", err)
+	}
+	if q := qs["/qdir"]; q.MaxSpace != 64<<10 || q.MaxInodes != 2 || q.UsedSpace != 36<<10 || q.UsedInodes != 2 {
+		t.Fatalf("unexpected quota: %+v", q)
+	}
+	if err := m.HandleQuota(ctx, QuotaCheck, DirQuota, "/qdir", qs, false); err != nil {
+		t.Fatalf("check quota: %s", err)
+	}
+
+	base.root = parent
+	var totalspace, availspace, iused, iavail uint64
+	if st := m.StatFS(ctx, &totalspace, &availspace, &iused, &iavail); st != 0 {
+		t.Fatalf("statfs: %s", st)
+	}
+	base.root = 1
+	if totalspace != 64<<10 || availspace != 28<<10 || iused != 2 || iavail != 0 {
+		t.Fatalf("statfs of qdir: %d %d %d %d", totalspace, availspace, iused, iavail)
+	}
+
+	if st := m.Rename(ctx, parent, "d1", 1, "qd1", 0, nil, attr); st != 0 {
+		t.Fatalf("rename d1: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "qd1")
+	if st := m.Unlink(ctx, parent, "f1"); st != 0 {
+		t.Fatalf("unlink f1: %s", st)
+	}
+	base.syncQuotas()
+	qs = make(map[string]*Quota)
+	if err := m.HandleQuota(ctx, QuotaList, DirQuota, "", qs, false); err != nil {
+		t.Fatalf("list quotas: %s", err)
+	}
+	if q := qs["/qdir"]; q == nil || q.UsedSpace != 0 || q.UsedInodes != 0 {
+		t.Fatalf("unexpected quota: %+v", q)
+	}
+	// break the usage and repair it
+	if st := m.Mkdir(ctx, 1, "qd2", 0755, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir qd2: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "qd2", parent, "d2", 0, nil, attr); st != 0 {
+		t.Fatalf("rename qd2: %s", st)
+	}
+	defer m.Rmdir(ctx, parent, "d2")
+	base.syncQuotas()
+	if err := base.en.doSetQuota(DirQuota, uint64(parent), &Quota{MaxSpace: 64 << 10, MaxInodes: 2, UsedSpace: 1 << 20, UsedInodes: 10}, true); err != nil {
+		t.Fatalf("set usage of qdir: %s", err)
+	}
+	if err := m.HandleQuota(ctx, QuotaCheck, DirQuota, "/qdir", qs, false); err == nil {
+		t.Fatalf("check quota should fail")
+	}
+	if err := m.HandleQuota(ctx, QuotaCheck, DirQuota, "/qdir", qs, true); err != nil {
+		t.Fatalf("repair quota: %s", err)
+	}
+	if q := qs["/qdir"]; q.UsedSpace != 4<<10 || q.UsedInodes != 1 {
+		t.Fatalf("unexpected quota after repair: %+v", q)
+	}
+	// every hard link is counted in the usage
+	if st := m.Create(ctx, 1, "qf3", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create qf3: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "qf3")
+	if st := m.Link(ctx, inode, parent, "l3", attr); st != 0 {
+		t.Fatalf("link l3: %s", st)
+	}
+	if st := m.Link(ctx, inode, dir, "l4", attr); st != 0 {
+		t.Fatalf("link d2/l4: %s", st)
+	}
+	base.syncQuotas()
+	if err := m.HandleQuota(ctx, QuotaCheck, DirQuota, "/qdir", qs, false); err != nil {
+		t.Fatalf("check quota with hard links: %s", err)
+	}
+	if q := qs["/qdir"]; q.UsedSpace != 12<<10 || q.UsedInodes != 3 {
+		t.Fatalf("unexpected quota with hard links: %+v", q)
+	}
+	if st := m.Unlink(ctx, parent, "l3"); st != 0 {
+		t.Fatalf("unlink l3: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "l4"); st != 0 {
+		t.Fatalf("unlink d2/l4: %s", st)
+	}
+	base.syncQuotas()
+	if err := m.HandleQuota(ctx, QuotaCheck, DirQuota, "/qdir", qs, false); err != nil {
+		t.Fatalf("check quota after unlink: %s", err)
+	}
+	if q := qs["/qdir"]; q.UsedSpace != 4<<10 || q.UsedInodes != 1 {
+		t.Fatalf("unexpected quota after unlink: %+v", q)
+	}
+
+	if err := m.HandleQuota(ctx, QuotaDel, DirQuota, "/qdir", nil, false); err != nil {
+		t.Fatalf("delete quota: %s", err)
+	}
+	if err := m.HandleQuota(ctx, QuotaGet, DirQuota, "/qdir", qs, false); err == nil {
+		t.Fatalf("get quota of qdir should fail after deleted")
+	}
+	base.loadQuotas()
+}
+
+func testOwnerQuota(t *testing.T, m Meta, base *baseMeta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var parent, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "uqdir", 0777, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir uqdir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "uqdir")
+	qs := map[string]*Quota{"1000": {MaxSpace: 64 << 10, MaxInodes: 2}}
+	if err := m.HandleQuota(ctx, QuotaSet, UserQuota, "1000", qs, false); err != nil {
+		t.Fatalf("set user quota: %s", err)
+	}
+	qs = map[string]*Quota{"2000": {MaxSpace: -1, MaxInodes: 1}}
+	if err := m.HandleQuota(ctx, QuotaSet, GroupQuota, "2000", qs, false); err != nil {
+		t.Fatalf("set group quota: %s", err)
+	}
+	base.loadQuotas()
+
+	uctx := NewContext(100, 1000, []uint32{1000})
+	if st := m.Create(uctx, parent, "f1", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f1: %s", st)
+	}
+	defer m.Unlink(ctx, parent, "f1")
+	if st := m.Create(uctx, parent, "f2", 0644, 022, 0, nil, attr); st != 0 {
+		t.Fatalf("create f2: %s", st)
+	}
+	if st := m.Create(uctx, parent, "f3", 0644, 022, 0, nil, attr); st != syscall.EDQUOT {
+		t.Fatalf("create f3 should fail with EDQUOT: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f3", 0644, 022, 0, nil, attr); st != 0 {
+		t.Fatalf("create f3 by root: %s", st)
+	}
+	defer m.Unlink(ctx, parent, "f3")
+	var chunkid uint64
+	m.NewChunk(ctx, &chunkid)
+	if st := m.Write(uctx, inode, 0, 0, Slice{chunkid, 1 << 20, 0, 1 << 20}); st != syscall.EDQUOT {
+		t.Fatalf("write 1MB should fail with EDQUOT: %s", st)
+	}
+	if st := m.Write(uctx, inode, 0, 0, Slice{chunkid, 32 << 10, 0, 32 << 10}); st != 0 {
+		t.Fatalf("write 32KB: %s", st)
+	}
+	base.syncQuotas()
+	qs = make(map[string]*Quota)
+	if err := m.HandleQuota(ctx, QuotaGet, UserQuota, "1000", qs, false); err != nil {
+		t.Fatalf("get user quota: %s", err)
+	}
+	if q := qs["1000"]; q.UsedSpace != 36<<10 || q.UsedInodes != 2 {
+		t.Fatalf("unexpected user quota: %+v", q)
+	}
+
+	// chown moves the usage to the new owner
+	attr.Gid = 2000
+	if st := m.SetAttr(ctx, inode, SetAttrGID, 0, attr); st != 0 {
+		t.Fatalf("chgrp f1: %s", st)
+	}
+	var inode2 Ino
+	if st := m.Lookup(ctx, parent, "f2", &inode2, attr); st != 0 {
+		t.Fatalf("lookup f2: %s", st)
+	}
+	attr.Gid = 2000
+	if st := m.SetAttr(ctx, inode2, SetAttrGID, 0, attr); st != syscall.EDQUOT {
+		t.Fatalf("chgrp f2 should fail with EDQUOT: %s", st)
+	}
+	attr.Uid = 0
+	if st := m.SetAttr(ctx, inode, SetAttrUID, 0, attr); st != 0 {
+		t.Fatalf("chown f1: %s", st)
+	}
+	if st := m.Unlink(ctx, parent, "f2"); st != 0 {
+		t.Fatalf("unlink f2: %s", st)
+	}
+	base.syncQuotas()
+	qs = make(map[string]*Quota)
+	if err := m.HandleQuota(ctx, QuotaList, UserQuota, "", qs, false); err != nil {
+		t.Fatalf("list user quotas: %s", err)
+	}
+	if q := qs["1000"]; q == nil || q.UsedSpace != 0 || q.UsedInodes != 0 {
+		t.Fatalf("unexpected user quota: %+v", q)
+	}
+	if err := m.HandleQuota(ctx, QuotaCheck, UserQuota, "1000", qs, false); err != nil {
+		t.Fatalf("check user quota: %s", err)
+	}
+	if err := m.HandleQuota(ctx, QuotaCheck, GroupQuota, "2000", qs, false); err != nil {
+		t.Fatalf("check group quota: %s", err)
+	}
+	if q := qs["2000"]; q.UsedSpace != 32<<10 || q.UsedInodes != 1 {
+		t.Fatalf("unexpected group quota: %+v", q)
+	}
+
+	if err := m.HandleQuota(ctx, QuotaDel, UserQuota, "1000", nil, false); err != nil {
+		t.Fatalf("delete user quota: %s", err)
+	}
+	if err := m.HandleQuota(ctx, QuotaDel, GroupQuota, "2000", nil, false); err != nil {
+		t.Fatalf("delete group quota: %s", err)
+	}
+	if err := m.HandleQuota(ctx, QuotaGet, UserQuota, "1000", qs, false); err == nil {
+		t.Fatalf("get user quota should fail after deleted")
+	}
+	base.loadQuotas()
+}
+
+func testDirStat(t *testing.T, m Meta, base *baseMeta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var parent, sub, other, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "statdir", 0777, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir statdir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "statdir")
+	checkStat := func(inode Ino, expected Summary) {
+		var s Summary
+		if st := m.GetDirStat(ctx, inode, &s); st != 0 {
+			t.Fatalf("get stat of %d: %s", inode, st)
+		}
+		if s != expected {
+			t.Fatalf("stat of %d: expect %+v, but got %+v", inode, expected, s)
+		}
+	}
+	checkStat(parent, Summary{})
+
+	if st := m.Mkdir(ctx, parent, "sub", 0777, 0, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir sub: %s", st)
+	}
+	if st := m.Create(ctx, sub, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var chunkid uint64
+	m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, inode, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	checkStat(sub, Summary{Length: 100, Size: 4096, Files: 1})
+	checkStat(parent, Summary{Length: 100, Size: 8192, Files: 1, Dirs: 1})
+	base.syncDirStats()
+	checkStat(parent, Summary{Length: 100, Size: 8192, Files: 1, Dirs: 1})
+
+	if st := m.Truncate(ctx, inode, 0, 5000, attr); st != 0 {
+		t.Fatalf("truncate f: %s", st)
+	}
+	if st := m.Link(ctx, inode, parent, "l", attr); st != 0 {
+		t.Fatalf("link f: %s", st)
+	}
+	checkStat(parent, Summary{Length: 10000, Size: 20480, Files: 2, Dirs: 1})
+	var summary Summary
+	if st := GetSummary(m, ctx, parent, &summary, true); st != 0 {
+		t.Fatalf("summary of statdir: %s", st)
+	}
+	if summary != (Summary{Length: 10000, Size: 24576, Files: 2, Dirs: 2}) {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	// move the directory and the file out of statdir
+	if st := m.Mkdir(ctx, 1, "statother", 0777, 0, 0, &other, attr); st != 0 {
+		t.Fatalf("mkdir statother: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "statother")
+	if st := m.Rename(ctx, parent, "sub", other, "sub", 0, nil, nil); st != 0 {
+		t.Fatalf("rename sub: %s", st)
+	}
+	checkStat(parent, Summary{Length: 5000, Size: 8192, Files: 1})
+	checkStat(other, Summary{Length: 5000, Size: 12288, Files: 1, Dirs: 1})
+	if st := m.Rename(ctx, sub, "f", other, "l", 0, nil, nil); st != 0 {
+		t.Fatalf("rename f: %s", st)
+	}
+	checkStat(sub, Summary{})
+	checkStat(other, Summary{Length: 5000, Size: 12288, Files: 1, Dirs: 1})
+	if st := m.Rename(ctx, parent, "l", other, "l", 0, nil, nil); st != 0 {
+		t.Fatalf("rename l: %s", st)
+	}
+	checkStat(parent, Summary{})
+	checkStat(other, Summary{Length: 5000, Size: 12288, Files: 1, Dirs: 1})
+	if err := m.CheckDirStats(ctx, "/statother", false); err != nil {
+		t.Fatalf("check statother: %s", err)
+	}
+
+	// broken statistics are repaired
+	base.syncDirStats()
+	if err := base.en.doSetDirStats(map[Ino]*dirStat{other: {1, 2, 3, 4}}); err != nil {
+		t.Fatalf("set stat of statother: %s", err)
+	}
+	if err := m.CheckDirStats(ctx, "/statother", false); err == nil {
+		t.Fatalf("check statother should fail")
+	}
+	if err := m.CheckDirStats(ctx, "/statother", true); err != nil {
+		t.Fatalf("repair statother: %s", err)
+	}
+	checkStat(other, Summary{Length: 5000, Size: 12288, Files: 1, Dirs: 1})
+
+	if st := m.Unlink(ctx, other, "l"); st != 0 {
+		t.Fatalf("unlink l: %s", st)
+	}
+	if st := m.Rmdir(ctx, other, "sub"); st != 0 {
+		t.Fatalf("rmdir sub: %s", st)
+	}
+	checkStat(other, Summary{})
+	base.syncDirStats()
+	checkStat(other, Summary{})
+	if st := m.GetDirStat(ctx, sub, &summary); st != syscall.ENOTSUP {
+		t.Fatalf("stat of removed directory should be ENOTSUP: %s", st)
+	}
+}
+
+func testACL(t *testing.T, m Meta, base *baseMeta) {
+	ctx := Background
+	uctx := NewContext(100, 1000, []uint32{1000})
+	var parent, dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "acldir", 0777, 0, 0, &parent, attr); st != 0 {
+		t.Fatalf("mkdir acldir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "acldir")
+	if st := m.Create(uctx, parent, "f", 0640, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	defer m.Unlink(ctx, parent, "f")
+	rule := &acl.Rule{Owner: 6, Group: 4, Mask: 4, Other: 0, NamedUsers: acl.Entries{{Id: 1001, Perm: 6}}}
+	if st := m.SetFacl(uctx, inode, acl.TypeAccess, rule); st != syscall.ENOTSUP {
+		t.Fatalf("setfacl without ACL enabled: %s", st)
+	}
+	base.fmt.EnableACL = true
+	defer func() { base.fmt.EnableACL = false }()
+
+	if st := m.SetFacl(NewContext(100, 1001, []uint32{1000}), inode, acl.TypeAccess, rule); st != syscall.EPERM {
+		t.Fatalf("setfacl by others: %s", st)
+	}
+	if st := m.SetFacl(uctx, inode, acl.TypeAccess, rule); st != 0 {
+		t.Fatalf("setfacl: %s", st)
+	}
+	var got acl.Rule
+	if st := m.GetFacl(uctx, inode, acl.TypeAccess, &got); st != 0 || !reflect.DeepEqual(&got, rule) {
+		t.Fatalf("getfacl: %+v %s", got, st)
+	}
+	if st := m.GetFacl(uctx, inode, acl.TypeDefault, &got); st != ENOATTR {
+		t.Fatalf("getfacl default of file: %s", st)
+	}
+	if st := m.SetFacl(uctx, inode, acl.TypeDefault, rule); st != syscall.EACCES {
+		t.Fatalf("setfacl default of file: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Mode != 0640 || attr.Flags&FlagAccessACL == 0 {
+		t.Fatalf("getattr: mode %o flags %d: %s", attr.Mode, attr.Flags, st)
+	}
+	named := NewContext(100, 1001, []uint32{1001})
+	if st := m.Access(named, inode, 4, nil); st != 0 {
+		t.Fatalf("named user should be able to read: %s", st)
+	}
+	if st := m.Access(named, inode, 2, nil); st != syscall.EACCES {
+		t.Fatalf("named user should not be able to write with mask r--: %s", st)
+	}
+	if st := m.Access(NewContext(100, 1002, []uint32{1002}), inode, 4, nil); st != syscall.EACCES {
+		t.Fatalf("others should not be able to read: %s", st)
+	}
+
+	// chmod changes the mask
+	attr.Mode = 0660
+	if st := m.SetAttr(uctx, inode, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("chmod: %s", st)
+	}
+	if st := m.GetFacl(uctx, inode, acl.TypeAccess, &got); st != 0 || got.Mask != 6 || got.Group != 4 || len(got.NamedUsers) != 1 {
+		t.Fatalf("getfacl after chmod: %+v %s", got, st)
+	}
+	if st := m.Access(named, inode, 2, nil); st != 0 {
+		t.Fatalf("named user should be able to write with mask rw-: %s", st)
+	}
+
+	// default ACL is inherited by new files and directories, umask is ignored
+	if st := m.Mkdir(uctx, parent, "d", 0750, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	defer m.Rmdir(ctx, parent, "d")
+	def := &acl.Rule{Owner: 7, Group: 5, Mask: 7, Other: 0, NamedGroups: acl.Entries{{Id: 2000, Perm: 7}}}
+	if st := m.SetFacl(uctx, dir, acl.TypeDefault, def); st != 0 {
+		t.Fatalf("setfacl default: %s", st)
+	}
+	var child, sub Ino
+	if st := m.Create(uctx, dir, "f", 0666, 022, 0, &child, attr); st != 0 {
+		t.Fatalf("create d/f: %s", st)
+	}
+	defer m.Unlink(ctx, dir, "f")
+	if attr.Mode != 0660 || attr.Flags != FlagAccessACL {
+		t.Fatalf("inherited file: mode %o flags %d", attr.Mode, attr.Flags)
+	}
+	if st := m.GetFacl(uctx, child, acl.TypeAccess, &got); st != 0 || got.Mask != 6 || len(got.NamedGroups) != 1 {
+		t.Fatalf("getfacl of d/f: %+v %s", got, st)
+	}
+	if st := m.Mkdir(uctx, dir, "sub", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir d/sub: %s", st)
+	}
+	defer m.Rmdir(ctx, dir, "sub")
+	if attr.Mode != 0750 || attr.Flags != FlagAccessACL|FlagDefaultACL {
+		t.Fatalf("inherited dir: mode %o flags %d", attr.Mode, attr.Flags)
+	}
+	if st := m.GetFacl(uctx, sub, acl.TypeDefault, &got); st != 0 || !reflect.DeepEqual(&got, def) {
+		t.Fatalf("getfacl default of d/sub: %+v %s", got, st)
+	}
+	group := NewContext(100, 1003, []uint32{2000})
+	if st := m.Access(group, child, 6, nil); st != 0 {
+		t.Fatalf("named group should be able to write d/f: %s", st)
+	}
+
+	// remove ACLs
+	if st := m.SetFacl(uctx, inode, acl.TypeAccess, nil); st != 0 {
+		t.Fatalf("remove ACL: %s", st)
+	}
+	if st := m.GetFacl(uctx, inode, acl.TypeAccess, &got); st != ENOATTR {
+		t.Fatalf("getfacl after removed: %s", st)
+	}
+	if st := m.Access(named, inode, 4, nil); st != syscall.EACCES {
+		t.Fatalf("named user should not be able to read after removed: %s", st)
+	}
+	if st := m.SetFacl(uctx, sub, acl.TypeDefault, nil); st != 0 {
+		t.Fatalf("remove default ACL: %s", st)
+	}
+	if st := m.GetAttr(ctx, sub, attr); st != 0 || attr.Flags != FlagAccessACL {
+		t.Fatalf("flags after default ACL removed: %d %s", attr.Flags, st)
+	}
+	// a minimal ACL only changes the mode
+	if st := m.SetFacl(uctx, sub, acl.TypeAccess, acl.FromMode(0700)); st != 0 {
+		t.Fatalf("setfacl minimal: %s", st)
+	}
+	if st := m.GetAttr(ctx, sub, attr); st != 0 || attr.Mode != 0700 || attr.Flags != 0 {
+		t.Fatalf("attr after minimal ACL: mode %o flags %d %s", attr.Mode, attr.Flags, st)
+	}
+}
+
+func testClone(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	uctx := NewContext(100, 1000, []uint32{1000})
+	var src, sub, file, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "clonesrc", 0777, 0, 0, &src, attr); st != 0 {
+		t.Fatalf("mkdir clonesrc: %s", st)
+	}
+	defer Remove(m, ctx, 1, "clonesrc")
+	if st := m.Create(uctx, src, "f", 0640, 0, 0, &file, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var chunkid uint64
+	m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, file, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	if st := m.SetXattr(ctx, file, "user.k", []byte("v"), XattrCreate); st != 0 {
+		t.Fatalf("setxattr f: %s", st)
+	}
+	if st := m.Symlink(ctx, src, "s", "f", &inode, attr); st != 0 {
+		t.Fatalf("symlink s: %s", st)
+	}
+	if st := m.Mkdir(ctx, src, "sub", 0755, 0, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir sub: %s", st)
+	}
+	if st := m.Create(ctx, sub, "g", 0644, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create g: %s", st)
+	}
+
+	var count, total uint64
+	if st := m.Clone(ctx, src, 1, "clonedst", 0, 022, &count, &total); st != 0 {
+		t.Fatalf("clone clonesrc: %s", st)
+	}
+	defer Remove(m, ctx, 1, "clonedst")
+	if count != 5 || total != 5 {
+		t.Fatalf("cloned %d of %d nodes, expect 5", count, total)
+	}
+	if st := m.Clone(ctx, src, 1, "clonedst", 0, 022, nil, nil); st != syscall.EEXIST {
+		t.Fatalf("clone into existing entry: %s", st)
+	}
+	if st := m.Clone(ctx, src, sub, "loop", 0, 022, nil, nil); st != syscall.EINVAL {
+		t.Fatalf("clone into itself: %s", st)
+	}
+
+	var dst, cfile Ino
+	if st := m.Lookup(ctx, 1, "clonedst", &dst, attr); st != 0 || attr.Typ != TypeDirectory || attr.Nlink != 3 {
+		t.Fatalf("lookup clonedst: nlink %d: %s", attr.Nlink, st)
+	}
+	if st := m.Lookup(ctx, dst, "f", &cfile, attr); st != 0 || cfile == file {
+		t.Fatalf("lookup clonedst/f: %d %s", cfile, st)
+	}
+	if attr.Uid != 0 || attr.Mode != 0640 || attr.Length != 100 || attr.Parent != dst {
+		t.Fatalf("attr of cloned f: %+v", attr)
+	}
+	var chunks []Slice
+	if st := m.Read(ctx, cfile, 0, &chunks); st != 0 || len(chunks) != 1 || chunks[0].Chunkid != chunkid {
+		t.Fatalf("read cloned f: %+v %s", chunks, st)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, cfile, "user.k", &value); st != 0 || string(value) != "v" {
+		t.Fatalf("getxattr of cloned f: %s %s", value, st)
+	}
+	if st := m.Lookup(ctx, dst, "s", &inode, attr); st != 0 {
+		t.Fatalf("lookup clonedst/s: %s", st)
+	}
+	var target []byte
+	if st := m.ReadLink(ctx, inode, &target); st != 0 || string(target) != "f" {
+		t.Fatalf("readlink cloned s: %s %s", target, st)
+	}
+	var csub Ino
+	if st := m.Lookup(ctx, dst, "sub", &csub, attr); st != 0 {
+		t.Fatalf("lookup clonedst/sub: %s", st)
+	}
+	if st := m.Lookup(ctx, csub, "g", &inode, attr); st != 0 {
+		t.Fatalf("lookup clonedst/sub/g: %s", st)
+	}
+	var s1, s2 Summary
+	if st := m.GetDirStat(ctx, src, &s1); st != 0 {
+		t.Fatalf("get stat of clonesrc: %s", st)
+	}
+	if st := m.GetDirStat(ctx, dst, &s2); st != 0 || s1 != s2 {
+		t.Fatalf("stat of clonedst: expect %+v, but got %+v: %s", s1, s2, st)
+	}
+
+	// preserve the attributes of the source
+	if st := m.Clone(ctx, file, 1, "clonefile", CloneModePreserveAttr, 022, nil, nil); st != 0 {
+		t.Fatalf("clone file: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "clonefile")
+	if st := m.Lookup(ctx, 1, "clonefile", &inode, attr); st != 0 || attr.Uid != 1000 || attr.Gid != 1000 || attr.Mode != 0640 {
+		t.Fatalf("attr of preserved clone: %+v %s", attr, st)
+	}
+
+	// the clone and the source are independent
+	var chunkid2 uint64
+	m.NewChunk(ctx, &chunkid2)
+	if st := m.Write(ctx, cfile, 0, 0, Slice{chunkid2, 50, 0, 50}); st != 0 {
+		t.Fatalf("write cloned f: %s", st)
+	}
+	if st := m.Read(ctx, file, 0, &chunks); st != 0 || len(chunks) != 1 || chunks[0].Chunkid != chunkid {
+		t.Fatalf("read source f: %+v %s", chunks, st)
+	}
+	if st := m.Unlink(ctx, src, "f"); st != 0 {
+		t.Fatalf("unlink source f: %s", st)
+	}
+	if st := m.Read(ctx, cfile, 0, &chunks); st != 0 || len(chunks) != 2 || chunks[0].Chunkid != chunkid2 || chunks[1].Chunkid != chunkid {
+		t.Fatalf("read cloned f after source removed: %+v %s", chunks, st)
+	}
+}
+
+func testSnapshot(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	var mu sync.Mutex
+	deleted := make(map[uint64]bool)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		mu.Lock()
+		deleted[args[0].(uint64)] = true
+		mu.Unlock()
+		return nil
+	})
+	isDeleted := func(chunkid uint64) bool {
+		time.Sleep(time.Millisecond * 100) // wait for delete
+		mu.Lock()
+		defer mu.Unlock()
+		return deleted[chunkid]
+	}
+
+	ctx := Background
+	var dir, file, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "snapdir", 0777, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir snapdir: %s", st)
+	}
+	defer Remove(m, ctx, 1, "snapdir")
+	if st := m.Create(ctx, dir, "f", 0644, 022, 0, &file, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var chunkid uint64
+	m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, file, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	m.Close(ctx, file)
+	if st := m.Mkdir(ctx, dir, "sub", 0755, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir sub: %s", st)
+	}
+
+	snapshots := make(map[string]*Snapshot)
+	if err := m.HandleSnapshot(ctx, SnapshotCreate, "s1", "/snapdir", snapshots); err != nil {
+		t.Fatalf("create snapshot: %s", err)
+	}
+	if s := snapshots["s1"]; s == nil || !isSnapshot(s.Inode) || s.Files != 1 || s.Dirs != 1 || s.Length != 100 {
+		t.Fatalf("snapshot s1: %+v", s)
+	}
+	if err := m.HandleSnapshot(ctx, SnapshotCreate, "s1", "/snapdir", snapshots); err == nil {
+		t.Fatalf("create existing snapshot should fail")
+	}
+	if err := m.HandleSnapshot(ctx, SnapshotCreate, "a/b", "/snapdir", snapshots); err == nil {
+		t.Fatalf("create snapshot with invalid name should fail")
+	}
+	snapshots = make(map[string]*Snapshot)
+	if err := m.HandleSnapshot(ctx, SnapshotList, "", "", snapshots); err != nil || len(snapshots) != 1 || snapshots["s1"] == nil {
+		t.Fatalf("list snapshots: %+v %s", snapshots, err)
+	}
+
+	// browse the snapshot
+	var root, snap, sfile Ino
+	if st := m.Lookup(ctx, 1, SnapshotName, &root, attr); st != 0 || root != SnapshotInode {
+		t.Fatalf("lookup %s: %d %s", SnapshotName, root, st)
+	}
+	if st := m.Lookup(ctx, root, "s1", &snap, attr); st != 0 || attr.Typ != TypeDirectory {
+		t.Fatalf("lookup s1: %s", st)
+	}
+	if st := m.Lookup(ctx, snap, "f", &sfile, attr); st != 0 || !isSnapshot(sfile) || attr.Length != 100 {
+		t.Fatalf("lookup s1/f: %d %s", sfile, st)
+	}
+	var chunks []Slice
+	if st := m.Read(ctx, sfile, 0, &chunks); st != 0 || len(chunks) != 1 || chunks[0].Chunkid != chunkid {
+		t.Fatalf("read s1/f: %+v %s", chunks, st)
+	}
+
+	// the snapshot is read-only
+	if st := m.Create(ctx, snap, "g", 0644, 022, 0, &inode, attr); st != syscall.EROFS {
+		t.Fatalf("create in snapshot: %s", st)
+	}
+	if st := m.Unlink(ctx, snap, "f"); st != syscall.EROFS {
+		t.Fatalf("unlink in snapshot: %s", st)
+	}
+	if st := m.Rmdir(ctx, root, "s1"); st != syscall.EROFS {
+		t.Fatalf("rmdir snapshot: %s", st)
+	}
+	if st := m.Rename(ctx, snap, "f", 1, "f", 0, &inode, attr); st != syscall.EROFS {
+		t.Fatalf("rename from snapshot: %s", st)
+	}
+	if st := m.Open(ctx, sfile, syscall.O_RDWR, attr); st != syscall.EROFS {
+		t.Fatalf("open snapshot file for write: %s", st)
+	}
+	if st := m.Write(ctx, sfile, 0, 0, Slice{chunkid, 100, 0, 100}); st != syscall.EROFS {
+		t.Fatalf("write snapshot file: %s", st)
+	}
+	if st := m.Truncate(ctx, sfile, 0, 0, attr); st != syscall.EROFS {
+		t.Fatalf("truncate snapshot file: %s", st)
+	}
+	if st := m.SetAttr(ctx, sfile, SetAttrMode, 0, &Attr{Mode: 0777}); st != syscall.EROFS {
+		t.Fatalf("chmod snapshot file: %s", st)
+	}
+	if st := m.SetXattr(ctx, sfile, "user.k", []byte("v"), XattrCreateOrReplace); st != syscall.EROFS {
+		t.Fatalf("setxattr of snapshot file: %s", st)
+	}
+	if st := m.Link(ctx, sfile, 1, "l", attr); st != syscall.EROFS {
+		t.Fatalf("link snapshot file: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, SnapshotName, 0755, 0, 0, &inode, attr); st != syscall.EPERM {
+		t.Fatalf("mkdir %s: %s", SnapshotName, st)
+	}
+
+	// the slices are kept until the snapshot is removed
+	if st := m.Unlink(ctx, dir, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+	if isDeleted(chunkid) {
+		t.Fatalf("chunk %d used by snapshot is deleted", chunkid)
+	}
+	if st := m.Read(ctx, sfile, 0, &chunks); st != 0 || len(chunks) != 1 || chunks[0].Chunkid != chunkid {
+		t.Fatalf("read s1/f after source removed: %+v %s", chunks, st)
+	}
+
+	if err := m.HandleSnapshot(ctx, SnapshotRestore, "s1", "/snapdir/restored", nil); err != nil {
+		t.Fatalf("restore snapshot: %s", err)
+	}
+	var rdir, rfile Ino
+	if st := m.Lookup(ctx, dir, "restored", &rdir, attr); st != 0 || isSnapshot(rdir) {
+		t.Fatalf("lookup restored: %d %s", rdir, st)
+	}
+	if st := m.Lookup(ctx, rdir, "f", &rfile, attr); st != 0 || isSnapshot(rfile) {
+		t.Fatalf("lookup restored/f: %d %s", rfile, st)
+	}
+	if st := m.Write(ctx, rfile, 0, 100, Slice{0, 0, 0, 100}); st != 0 {
+		t.Fatalf("write restored/f: %s", st)
+	}
+	if err := m.HandleSnapshot(ctx, SnapshotRestore, "s1", "/snapdir/restored", nil); err == nil {
+		t.Fatalf("restore to existing path should fail")
+	}
+
+	if err := m.HandleSnapshot(ctx, SnapshotDel, "s1", "", nil); err != nil {
+		t.Fatalf("delete snapshot: %s", err)
+	}
+	if err := m.HandleSnapshot(ctx, SnapshotDel, "s1", "", nil); err == nil {
+		t.Fatalf("delete removed snapshot should fail")
+	}
+	if st := m.Lookup(ctx, root, "s1", &snap, attr); st != syscall.ENOENT {
+		t.Fatalf("lookup removed snapshot: %s", st)
+	}
+	if isDeleted(chunkid) {
+		t.Fatalf("chunk %d used by restored file is deleted", chunkid)
+	}
+	if st := Remove(m, ctx, dir, "restored"); st != 0 {
+		t.Fatalf("remove restored: %s", st)
+	}
+	if !isDeleted(chunkid) {
+		t.Fatalf("chunk %d is not deleted", chunkid)
+	}
+}
+
+func testChangelog(t *testing.T, m Meta, base *baseMeta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	if _, st := base.NewWatcher(1, 0).Next(ctx, 10, 0); st != syscall.ENOTSUP {
+		t.Fatalf("watch without change log: %s", st)
+	}
+	base.fmt.ChangelogDays = 1
+	defer func() { base.fmt.ChangelogDays = 0 }()
+
+	var dir, sub, inode, other Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "watchdir", 0777, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir watchdir: %s", st)
+	}
+	defer Remove(m, ctx, 1, "watchdir")
+	base.syncChanges()
+	last, err := m.LastChange(ctx)
+	if err != nil || last == 0 {
+		t.Fatalf("last change: %d %s", last, err)
+	}
+	w := m.NewWatcher(dir, last)
+
+	if st := m.Create(ctx, dir, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var chunkid uint64
+	m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, inode, 0, 0, Slice{chunkid, 100, 0, 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	if st := m.Mkdir(ctx, dir, "d", 0777, 0, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "f", sub, "g", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename f: %s", st)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("setattr g: %s", st)
+	}
+	if st := m.SetXattr(ctx, inode, "k", []byte("v"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("setxattr g: %s", st)
+	}
+	if st := m.Create(ctx, 1, "outside", 0644, 022, 0, &other, attr); st != 0 {
+		t.Fatalf("create outside: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "outside"); st != 0 {
+		t.Fatalf("unlink outside: %s", st)
+	}
+	if st := m.Unlink(ctx, sub, "g"); st != 0 {
+		t.Fatalf("unlink g: %s", st)
+	}
+	if st := m.Rmdir(ctx, dir, "d"); st != 0 {
+		t.Fatalf("rmdir d: %s", st)
+	}
+	base.syncChanges()
+
+	changes, err := m.ReadChanges(ctx, last, 100)
+	if err != nil || len(changes) != 10 {
+		t.Fatalf("read changes: %d %s", len(changes), err)
+	}
+	for i, c := range changes {
+		if c.Id != last+uint64(i)+1 {
+			t.Fatalf("change %d: expect id %d, but got %d", i, last+uint64(i)+1, c.Id)
+		}
+	}
+	if l, err := m.LastChange(ctx); err != nil || l != last+10 {
+		t.Fatalf("last change: expect %d, but got %d %s", last+10, l, err)
+	}
+
+	type expected struct {
+		op      ChangeOp
+		path    string
+		dstPath string
+	}
+	expects := []expected{
+		{ChangeCreate, "/f", ""},
+		{ChangeWrite, "/f", ""},
+		{ChangeMkdir, "/d", ""},
+		{ChangeRename, "/f", "/d/g"},
+		{ChangeSetAttr, "/d/g", ""},
+		{ChangeSetXattr, "/d/g", ""},
+		{ChangeUnlink, "/d/g", ""},
+		{ChangeRmdir, "/d", ""},
+	}
+	got, st := w.Next(ctx, 100, 0)
+	if st != 0 || len(got) != len(expects) {
+		t.Fatalf("watch: expect %d changes, but got %d %s", len(expects), len(got), st)
+	}
+	for i, c := range got {
+		if e := expects[i]; c.Op != e.op || c.Path != e.path || c.DstPath != e.dstPath {
+			t.Fatalf("change %d: expect %s %s %s, but got %s %s %s", i, e.op, e.path, e.dstPath, c.Op, c.Path, c.DstPath)
+		}
+	}
+	if w.Cursor() != last+10 {
+		t.Fatalf("cursor: expect %d, but got %d", last+10, w.Cursor())
+	}
+	if got, st = w.Next(ctx, 100, time.Millisecond*300); st != 0 || len(got) != 0 {
+		t.Fatalf("watch: expect no change, but got %d %s", len(got), st)
+	}
+
+	base.doCleanupChanges() // the changes are kept for 1 day
+	if changes, err = m.ReadChanges(ctx, last, 100); err != nil || len(changes) != 10 {
+		t.Fatalf("read changes: %d %s", len(changes), err)
+	}
+	base.fmt.ChangelogDays = 0
+	base.doCleanupChanges()
+	base.fmt.ChangelogDays = 1
+	if changes, err = m.ReadChanges(ctx, 0, 100); err != nil || len(changes) != 0 {
+		t.Fatalf("read changes after cleanup: %d %s", len(changes), err)
+	}
+	if l, err := m.LastChange(ctx); err != nil || l != last+10 {
+		t.Fatalf("last change after cleanup: expect %d, but got %d %s", last+10, l, err)
+	}
+}
+
+func testCacheInvalidation(t *testing.T, m Meta, base *baseMeta) {
+	got := make(chan *Change, 100)
+	m.OnMsg(InvalidateCache, func(args ...interface{}) error {
+		got <- args[0].(*Change)
+		return nil
+	})
+	base.fmt.CacheInvalidation = true
+	defer func() { base.fmt.CacheInvalidation = false }()
+	time.Sleep(time.Millisecond * 1500) // wait for the subscribers
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "invaldir", 0777, 0, 0, &inode, attr); st != 0 { // ignored by itself
+		t.Fatalf("mkdir invaldir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "invaldir")
+	msg := encodeInvalidations(base.sid+1, []*Change{
+		{Op: ChangeRename, Inode: inode, Parent: base.root, Name: "invaldir", DstParent: inode, DstName: "d"},
+		{Op: ChangeWrite, Inode: inode + 1},
+	})
+	if err := base.en.doPublishInvalidations(msg); err != nil {
+		t.Fatalf("publish invalidations: %s", err)
+	}
+	var renamed, written bool
+	timeout := time.After(time.Second * 5)
+	for !renamed || !written { // there may be duplicated ones from multiple sessions
+		select {
+		case c := <-got:
+			switch c.Op {
+			case ChangeRename:
+				if c.Inode != inode || c.Parent != 1 || c.Name != "invaldir" || c.DstParent != inode || c.DstName != "d" {
+					t.Fatalf("invalidation: %+v", *c)
+				}
+				renamed = true
+			case ChangeWrite:
+				if c.Inode != inode+1 {
+					t.Fatalf("invalidation: %+v", *c)
+				}
+				written = true
+			default:
+				t.Fatalf("unexpected invalidation: %+v", *c)
+			}
+		case <-timeout:
+			t.Fatalf("no invalidation is received")
+		}
+	}
+	if _, _, err := decodeInvalidations(msg[:len(msg)-1]); err == nil {
+		t.Fatalf("decode truncated message should fail")
+	}
+}
+
+func testInline(t *testing.T, m Meta, base *baseMeta) {
+	base.fmt.InlineSize = 100
+	defer func() { base.fmt.InlineSize = 0 }()
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "inline", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create inline: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "inline")
+	var data []byte
+	if st := m.ReadInline(ctx, inode, attr, &data); st != syscall.ENODATA {
+		t.Fatalf("read inline of empty file: %s", st)
+	}
+	if st := m.WriteInline(ctx, inode, 10, []byte("hello")); st != 0 {
+		t.Fatalf("write inline: %s", st)
+	}
+	if st := m.WriteInline(ctx, inode, 0, []byte("world")); st != 0 {
+		t.Fatalf("write inline: %s", st)
+	}
+	if st := m.ReadInline(ctx, inode, attr, &data); st != 0 {
+		t.Fatalf("read inline: %s", st)
+	}
+	if string(data) != "world\x00\x00\x00\x00\x00hello" || attr.Length != 15 || attr.Flags&FlagInline == 0 {
+		t.Fatalf("read inline got %q, length %d, flags %d", data, attr.Length, attr.Flags)
+	}
+	if st := m.WriteInline(ctx, inode, 90, make([]byte, 20)); st != syscall.EFBIG {
+		t.Fatalf("write beyond inline size: %s", st)
+	}
+	if st := m.Fallocate(ctx, inode, 0, 0, 200); st != syscall.ENOTSUP {
+		t.Fatalf("fallocate inline file: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 3, attr); st != 0 {
+		t.Fatalf("truncate inline file: %s", st)
+	}
+	if st := m.ReadInline(ctx, inode, attr, &data); st != 0 || string(data) != "wor" || attr.Length != 3 {
+		t.Fatalf("read inline after truncate got %q, length %d: %s", data, attr.Length, st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 50, attr); st != 0 {
+		t.Fatalf("truncate inline file: %s", st)
+	}
+	if st := m.ReadInline(ctx, inode, attr, &data); st != 0 || string(data) != "wor" || attr.Length != 50 {
+		t.Fatalf("read inline after extending got %q, length %d: %s", data, attr.Length, st)
+	}
+
+	// promote it into a slice
+	var chunkid uint64
+	if st := m.NewChunk(ctx, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: chunkid, Size: 50, Len: 50}); st != 0 {
+		t.Fatalf("write slice: %s", st)
+	}
+	if st := m.ReadInline(ctx, inode, attr, &data); st != syscall.ENODATA {
+		t.Fatalf("read inline after promoted: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Flags&FlagInline != 0 || attr.Length != 50 {
+		t.Fatalf("getattr after promoted: flags %d, length %d: %s", attr.Flags, attr.Length, st)
+	}
+	if st := m.WriteInline(ctx, inode, 0, []byte("x")); st != syscall.ENODATA {
+		t.Fatalf("write inline into file with chunks: %s", st)
+	}
+
+	// truncate to zero removes the inline data
+	var inode2 Ino
+	if st := m.Create(ctx, 1, "inline2", 0644, 022, 0, &inode2, attr); st != 0 {
+		t.Fatalf("create inline2: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "inline2")
+	if st := m.WriteInline(ctx, inode2, 0, []byte("abc")); st != 0 {
+		t.Fatalf("write inline: %s", st)
+	}
+	if st := m.Truncate(ctx, inode2, 0, 0, attr); st != 0 || attr.Flags&FlagInline != 0 {
+		t.Fatalf("truncate inline2 to zero: flags %d: %s", attr.Flags, st)
+	}
+	if st := m.ReadInline(ctx, inode2, attr, &data); st != syscall.ENODATA {
+		t.Fatalf("read inline after truncated to zero: %s", st)
+	}
+}
+
+func testCheckMeta(t *testing.T, m Meta, base *baseMeta) {
+	ctx := Background
+	// repair the inconsistencies left by other tests
+	if err := m.CheckMeta(ctx, "/", true); err != nil {
+		t.Fatalf("repair meta: %s", err)
+	}
+	if err := m.CheckMeta(ctx, "/", false); err != nil {
+		t.Fatalf("check meta: %s", err)
+	}
+	var dir, inode, orphan, orphanDir Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "fsckdir", 0777, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir fsckdir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0644, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var id uint64
+	if st := m.NewChunk(ctx, &id); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: id, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	if st := m.Create(ctx, dir, "orphan", 0644, 0, 0, &orphan, attr); st != 0 {
+		t.Fatalf("create orphan: %s", st)
+	}
+	if st := m.Mkdir(ctx, dir, "orphandir", 0755, 0, 0, &orphanDir, attr); st != 0 {
+		t.Fatalf("mkdir orphandir: %s", st)
+	}
+
+	// corrupt the metadata
+	if err := base.en.doSetNlink(inode, 3, 0); err != nil {
+		t.Fatalf("set nlink: %s", err)
+	}
+	if err := base.en.doSetEntry(dir, "dangling", inode+1000000, TypeFile); err != nil {
+		t.Fatalf("add dangling entry: %s", err)
+	}
+	if err := base.en.doSetEntry(dir, "orphan", 0, 0); err != nil {
+		t.Fatalf("remove entry: %s", err)
+	}
+	if err := base.en.doSetEntry(dir, "orphandir", 0, 0); err != nil {
+		t.Fatalf("remove entry: %s", err)
+	}
+	if err := base.en.doAppendSlice(inode, 0, marshalSlice(200, id, 100, 0, 100)); err != nil {
+		t.Fatalf("append slice: %s", err)
+	}
+	if _, err := base.en.incrCounter(usedSpace, 4096); err != nil {
+		t.Fatalf("incr counter: %s", err)
+	}
+
+	if err := m.CheckMeta(ctx, "/fsckdir", false); err == nil {
+		t.Fatalf("check meta of fsckdir should fail")
+	}
+	if err := m.CheckMeta(ctx, "/", true); err != nil {
+		t.Fatalf("repair meta: %s", err)
+	}
+	if err := m.CheckMeta(ctx, "/", false); err != nil {
+		t.Fatalf("check meta after repair: %s", err)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Nlink != 1 {
+		t.Fatalf("nlink of f: %s %d", st, attr.Nlink)
+	}
+	if st := m.Lookup(ctx, dir, "dangling", new(Ino), attr); st != syscall.ENOENT {
+		t.Fatalf("lookup dangling: %s", st)
+	}
+	var lf, found Ino
+	if st := m.Lookup(ctx, 1, "lost+found", &lf, attr); st != 0 {
+		t.Fatalf("lookup lost+found: %s", st)
+	}
+	if st := m.Lookup(ctx, lf, orphan.String(), &found, attr); st != 0 || found != orphan {
+		t.Fatalf("lookup orphan in lost+found: %s %d", st, found)
+	}
+	if st := m.Lookup(ctx, lf, orphanDir.String(), &found, attr); st != 0 || found != orphanDir || attr.Parent != lf {
+		t.Fatalf("lookup orphandir in lost+found: %s %d %+v", st, found, attr)
+	}
+	if st := m.GetAttr(ctx, lf, attr); st != 0 || attr.Nlink != 3 {
+		t.Fatalf("nlink of lost+found: %s %d", st, attr.Nlink)
+	}
+	var slices []Slice
+	if st := m.Read(ctx, inode, 0, &slices); st != 0 {
+		t.Fatalf("read f: %s", st)
+	}
+	var pos uint32
+	for _, s := range slices {
+		if s.Chunkid > 0 && pos >= 100 {
+			t.Fatalf("data beyond the length: %+v", slices)
+		}
+		pos += s.Len
+	}
+
+	var entries []*Entry
+	if st := m.Readdir(ctx, lf, 1, &entries); st != 0 {
+		t.Fatalf("readdir lost+found: %s", st)
+	}
+	for _, e := range entries[2:] { // there may be orphans left by other tests
+		st := m.Unlink(ctx, lf, string(e.Name))
+		if e.Attr.Typ == TypeDirectory {
+			st = m.Rmdir(ctx, lf, string(e.Name))
+		}
+		if st != 0 {
+			t.Fatalf("remove %s: %s", e.Name, st)
+		}
+	}
+	if st := m.Rmdir(ctx, 1, "lost+found"); st != 0 {
+		t.Fatalf("rmdir lost+found: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "fsckdir"); st != 0 {
+		t.Fatalf("rmdir fsckdir: %s", st)
+	}
+	if err := m.CheckMeta(ctx, "/", false); err != nil {
+		t.Fatalf("check meta after cleanup: %s", err)
+	}
+}
+
+func testPack(t *testing.T, m Meta, base *baseMeta) {
+	bsize := base.fmt.BlockSize
+	base.fmt.BlockSize, base.fmt.PackSize = 4096, 1024
+	defer func() { base.fmt.BlockSize, base.fmt.PackSize = bsize, 0 }()
+	ctx := Background
+	var deleted []uint64
+	m.OnMsg(DeletePack, func(args ...interface{}) error {
+		deleted = append(deleted, args[0].(uint64))
+		return nil
+	})
+	var mu sync.Mutex
+	chunks := make(map[uint64]bool)
+	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
+		mu.Lock()
+		chunks[args[0].(uint64)] = true
+		mu.Unlock()
+		return nil
+	})
+	defer m.OnMsg(DeleteChunk, func(args ...interface{}) error { return nil })
+
+	pack := &Pack{Size: 400}
+	if st := m.NewChunk(ctx, &pack.Id); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	slices := make([]PackedSlice, 4)
+	for i := range slices {
+		if st := m.NewChunk(ctx, &slices[i].Chunkid); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		slices[i].Off = uint32(i * 100)
+		slices[i].Len = 100
+	}
+	if st := m.AddPack(ctx, pack, slices); st != 0 || pack.Live != 400 {
+		t.Fatalf("add pack: live %d: %s", pack.Live, st)
+	}
+	var s PackedSlice
+	if st := m.GetPacked(ctx, slices[2].Chunkid, &s); st != 0 || s != slices[2] {
+		t.Fatalf("get packed slice: %+v: %s", s, st)
+	}
+	if st := m.GetPacked(ctx, pack.Id, &s); st != syscall.ENOENT {
+		t.Fatalf("get slice not packed: %s", st)
+	}
+
+	// dump and load
+	dumped, err := base.dumpPacks()
+	if err != nil || len(dumped) != 1 || len(dumped[0].Slices) != 4 {
+		t.Fatalf("dump packs: %+v: %s", dumped, err)
+	}
+
+	// delete 3 of them, then the pack can be compacted
+	for i := 0; i < 3; i++ {
+		base.deleteSlice(slices[i].Chunkid, 100)
+	}
+	if st := m.GetPacked(ctx, slices[0].Chunkid, &s); st != syscall.ENOENT {
+		t.Fatalf("get deleted slice: %s", st)
+	}
+	var packs []*Pack
+	if st := m.ListPacks(ctx, &packs); st != 0 || len(packs) != 1 || packs[0].Live != 100 || packs[0].Size != 400 {
+		t.Fatalf("list packs: %+v: %s", packs, st)
+	}
+	var newPack uint64
+	m.OnMsg(CompactPack, func(args ...interface{}) error {
+		if args[0].(uint64) != pack.Id {
+			t.Fatalf("compact pack %d, expect %d", args[0].(uint64), pack.Id)
+		}
+		ss := args[1].([]PackedSlice)
+		p := args[2].(*Pack)
+		if len(ss) != 1 || ss[0].Chunkid != slices[3].Chunkid {
+			t.Fatalf("slices to compact: %+v", ss)
+		}
+		p.Size = 100
+		newPack = p.Id
+		ss[0].Pack = p.Id
+		ss[0].Off = 0
+		return nil
+	})
+	if st := m.CompactPacks(ctx); st != 0 {
+		t.Fatalf("compact packs: %s", st)
+	}
+	if len(deleted) != 1 || deleted[0] != pack.Id {
+		t.Fatalf("deleted packs: %v", deleted)
+	}
+	if st := m.GetPacked(ctx, slices[3].Chunkid, &s); st != 0 || s.Pack != newPack || s.Off != 0 || s.Len != 100 {
+		t.Fatalf("get compacted slice: %+v: %s", s, st)
+	}
+	if st := m.ListPacks(ctx, &packs); st != 0 || len(packs) != 1 || packs[0].Id != newPack || packs[0].Live != 100 {
+		t.Fatalf("list packs after compaction: %+v: %s", packs, st)
+	}
+	if st := m.CompactPacks(ctx); st != 0 || len(deleted) != 1 {
+		t.Fatalf("compact packs again: %v: %s", deleted, st)
+	}
+
+	// delete the last one, the pack is deleted
+	base.deleteSlice(slices[3].Chunkid, 100)
+	if len(deleted) != 2 || deleted[1] != newPack {
+		t.Fatalf("deleted packs: %v", deleted)
+	}
+	if st := m.ListPacks(ctx, &packs); st != 0 || len(packs) != 0 {
+		t.Fatalf("list packs after deleted: %+v: %s", packs, st)
+	}
+
+	if err = base.loadPacks(dumped); err != nil {
+		t.Fatalf("load packs: %s", err)
+	}
+	if st := m.GetPacked(ctx, slices[1].Chunkid, &s); st != 0 || s != slices[1] {
+		t.Fatalf("get loaded slice: %+v: %s", s, st)
+	}
+	if st := m.ListPacks(ctx, &packs); st != 0 || len(packs) != 1 || packs[0].Live != 400 {
+		t.Fatalf("list loaded packs: %+v: %s", packs, st)
+	}
+	for i := range slices {
+		base.deleteSlice(slices[i].Chunkid, 100)
+	}
+	if len(deleted) != 3 || deleted[2] != pack.Id {
+		t.Fatalf("deleted packs: %v", deleted)
+	}
+
+	// the slices recorded by a crashed client are not used by any file
+	orphan := &Pack{Size: 200}
+	if st := m.NewChunk(ctx, &orphan.Id); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	orphans := make([]PackedSlice, 2)
+	for i := range orphans {
+		if st := m.NewChunk(ctx, &orphans[i].Chunkid); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		orphans[i].Off = uint32(i * 100)
+		orphans[i].Len = 100
+	}
+	if st := m.AddPack(ctx, orphan, orphans); st != 0 {
+		t.Fatalf("add pack: %s", st)
+	}
+	var listed []PackedSlice
+	if st := m.ListPacked(ctx, func(s *PackedSlice) { listed = append(listed, *s) }); st != 0 || len(listed) != 2 {
+		t.Fatalf("list packed slices: %+v: %s", listed, st)
+	}
+	for _, s := range listed {
+		if st := m.RemovePacked(ctx, s.Chunkid); st != 0 {
+			t.Fatalf("remove packed slice %d: %s", s.Chunkid, st)
+		}
+	}
+	if st := m.RemovePacked(ctx, orphans[0].Chunkid); st != syscall.ENOENT {
+		t.Fatalf("remove packed slice again: %s", st)
+	}
+	if len(deleted) != 4 || deleted[3] != orphan.Id {
+		t.Fatalf("deleted packs: %v", deleted)
+	}
+	if st := m.ListPacks(ctx, &packs); st != 0 || len(packs) != 0 {
+		t.Fatalf("list packs after removed: %+v: %s", packs, st)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range slices {
+		if chunks[slices[i].Chunkid] {
+			t.Fatalf("packed slice %d should not be deleted as a chunk", slices[i].Chunkid)
+		}
+	}
+}
+
+func testDedup(t *testing.T, m Meta, base *baseMeta) {
+	bsize := base.fmt.BlockSize
+	base.fmt.BlockSize, base.fmt.Dedup = 4, true
+	defer func() { base.fmt.BlockSize, base.fmt.Dedup = bsize, false }()
+	ctx := Background
+	var mu sync.Mutex
+	var deleted []Block
+	m.OnMsg(DeleteBlock, func(args ...interface{}) error {
+		mu.Lock()
+		deleted = append(deleted, Block{args[0].(uint64), args[1].(uint32), args[2].(uint32)})
+		mu.Unlock()
+		return nil
+	})
+	checkDeleted := func(expected ...Block) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(deleted, expected) && !(len(deleted) == 0 && len(expected) == 0) {
+			t.Fatalf("deleted blocks: %+v, expect %+v", deleted, expected)
+		}
+		deleted = nil
+	}
+	checkStat := func(blocks, refs uint64) {
+		var st DedupStat
+		if s := GetDedupStat(m, ctx, &st); s != 0 || st.Blocks != blocks || st.Refs != refs {
+			t.Fatalf("dedup stat: %+v: %s", st, s)
+		}
+	}
+
+	var s1, s2, s3 uint64
+	for _, id := range []*uint64{&s1, &s2, &s3} {
+		if st := m.NewChunk(ctx, id); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+	}
+	ha, hb := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	var owner Block
+	if st := m.RefBlock(ctx, ha[:], &Block{s1, 0, 4096}, &owner); st != syscall.ENOENT {
+		t.Fatalf("ref new block: %s", st)
+	}
+	if st := m.AddBlock(ctx, ha[:], &Block{s1, 0, 4096}); st != 0 {
+		t.Fatalf("add block: %s", st)
+	}
+	if st := m.AddBlock(ctx, hb[:], &Block{s1, 1, 4096}); st != 0 {
+		t.Fatalf("add block: %s", st)
+	}
+	if st := m.AddBlock(ctx, ha[:], &Block{s2, 0, 4096}); st != syscall.EEXIST {
+		t.Fatalf("add existing block: %s", st)
+	}
+	if st := m.RefBlock(ctx, ha[:], &Block{s2, 0, 4096}, &owner); st != 0 || owner != (Block{s1, 0, 4096}) {
+		t.Fatalf("ref block: %+v: %s", owner, st)
+	}
+	if st := m.FindBlock(ctx, s2, 0, &owner); st != 0 || owner != (Block{s1, 0, 4096}) {
+		t.Fatalf("find shared block: %+v: %s", owner, st)
+	}
+	if st := m.FindBlock(ctx, s1, 1, &owner); st != 0 || owner != (Block{s1, 1, 4096}) {
+		t.Fatalf("find owned block: %+v: %s", owner, st)
+	}
+	if st := m.FindBlock(ctx, s3, 0, &owner); st != syscall.ENOENT {
+		t.Fatalf("find block not shared: %s", st)
+	}
+	checkStat(2, 3)
+	dumped, err := base.dumpDedup()
+	if err != nil || len(dumped) != 2 {
+		t.Fatalf("dump dedup: %+v: %s", dumped, err)
+	}
+
+	// the shared block is kept until the last reference is removed
+	base.deleteSlice(s1, 8192)
+	checkDeleted(Block{s1, 1, 4096})
+	if st := m.FindBlock(ctx, s2, 0, &owner); st != 0 || owner != (Block{s1, 0, 4096}) {
+		t.Fatalf("find block of deleted owner: %+v: %s", owner, st)
+	}
+	checkStat(1, 1)
+	base.deleteSlice(s2, 4096)
+	checkDeleted(Block{s1, 0, 4096})
+	base.deleteSlice(s3, 4096)
+	checkDeleted(Block{s3, 0, 4096})
+	checkStat(0, 0)
+
+	if err = base.loadDedup(dumped); err != nil {
+		t.Fatalf("load dedup: %s", err)
+	}
+	checkStat(2, 3)
+	if st := m.FindBlock(ctx, s2, 0, &owner); st != 0 || owner != (Block{s1, 0, 4096}) {
+		t.Fatalf("find loaded block: %+v: %s", owner, st)
+	}
+	base.deleteSlice(s2, 4096)
+	base.deleteSlice(s1, 8192)
+	checkStat(0, 0)
+	checkDeleted(Block{s1, 0, 4096}, Block{s1, 1, 4096})
+
+	// the references of aborted slices are removed
+	if st := m.AddBlock(ctx, ha[:], &Block{s1, 0, 4096}); st != 0 {
+		t.Fatalf("add block: %s", st)
+	}
+	if st := m.RefBlock(ctx, ha[:], &Block{s2, 0, 4096}, &owner); st != 0 || owner != (Block{s1, 0, 4096}) {
+		t.Fatalf("ref block: %+v: %s", owner, st)
+	}
+	checkStat(1, 2)
+	if st := m.DerefSlice(ctx, s2, 4096); st != 0 {
+		t.Fatalf("deref slice: %s", st)
+	}
+	checkStat(1, 1)
+	checkDeleted()
+	if st := m.DerefSlice(ctx, s1, 4096); st != 0 {
+		t.Fatalf("deref slice: %s", st)
+	}
+	checkStat(0, 0)
+	checkDeleted(Block{s1, 0, 4096})
+}
+
+func testTier(t *testing.T, m Meta, base *baseMeta) {
+	ctx := Background
+	var s1, s2 uint64
+	for _, id := range []*uint64{&s1, &s2} {
+		if st := m.NewChunk(ctx, id); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+	}
+	var tier uint8
+	if st := m.SetSliceTier(ctx, s1, 2); st != 0 {
+		t.Fatalf("set slice tier: %s", st)
+	}
+	if st := m.GetSliceTier(ctx, s1, &tier); st != 0 || tier != 0 {
+		t.Fatalf("get slice tier without tiers: %d: %s", tier, st)
+	}
+	tiers := base.fmt.Tiers
+	base.fmt.Tiers = []Tier{{Id: 2, Name: "cold", Storage: "file", Bucket: "/tmp/cold/"}}
+	defer func() { base.fmt.Tiers = tiers }()
+	if err := ValidTiers(base.fmt.Tiers); err != nil {
+		t.Fatalf("valid tiers: %s", err)
+	}
+	if err := ValidTiers(append(base.fmt.Tiers, Tier{Id: 2, Name: "hot", Storage: "file", Bucket: "/tmp/hot/"})); err == nil {
+		t.Fatalf("tiers with the same id should be invalid")
+	}
+	if st := m.GetSliceTier(ctx, s1, &tier); st != 0 || tier != 2 {
+		t.Fatalf("get slice tier: %d: %s", tier, st)
+	}
+	if st := m.SetSliceTier(ctx, s1, 3); st != 0 {
+		t.Fatalf("update slice tier: %s", st)
+	}
+	if st := m.GetSliceTier(ctx, s2, &tier); st != 0 || tier != 0 {
+		t.Fatalf("get tier of slice in primary storage: %d: %s", tier, st)
+	}
+	dumped, err := base.dumpSliceTiers()
+	if err != nil || len(dumped) != 1 || *dumped[0] != (DumpedSliceTier{s1, 3}) {
+		t.Fatalf("dump slice tiers: %+v: %s", dumped, err)
+	}
+
+	base.deleteSlice(s1, 4096)
+	if st := m.GetSliceTier(ctx, s1, &tier); st != 0 || tier != 0 {
+		t.Fatalf("get tier of deleted slice: %d: %s", tier, st)
+	}
+	if err = base.loadSliceTiers(dumped); err != nil {
+		t.Fatalf("load slice tiers: %s", err)
+	}
+	if st := m.GetSliceTier(ctx, s1, &tier); st != 0 || tier != 3 {
+		t.Fatalf("get loaded slice tier: %d: %s", tier, st)
+	}
+	if st := m.SetSliceTier(ctx, s1, 0); st != 0 {
+		t.Fatalf("reset slice tier: %s", st)
+	}
+	if dumped, err = base.dumpSliceTiers(); err != nil || len(dumped) != 0 {
+		t.Fatalf("dump slice tiers: %+v: %s", dumped, err)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A snapshot is a clone of a directory stored under SnapshotInode, the cloned nodes are allocated
+// from the snapshot range, so they can be browsed but not modified. The slices are shared with the
+// source files by reference counting, so they are kept until all the snapshots using them are removed.
+
+func validSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) <= 255 && !strings.Contains(name, "/")
+}
+
+func (m *baseMeta) snapshotInfo(ctx Context, inode Ino, attr *Attr) *Snapshot {
+	s := &Snapshot{Inode: inode, Time: attr.Ctime}
+	if st := m.GetDirStat(ctx, inode, &s.Summary); st != 0 {
+		logger.Warnf("get stat of snapshot %d: %s", inode, st)
+	}
+	return s
+}
+
+func (m *baseMeta) lookupSnapshot(ctx Context, name string, inode *Ino, attr *Attr) error {
+	if st := m.en.doLookup(ctx, SnapshotInode, name, inode, attr); st != 0 {
+		if st == syscall.ENOENT {
+			return fmt.Errorf("snapshot %s does not exist", name)
+		}
+		return fmt.Errorf("lookup snapshot %s: %s", name, st)
+	}
+	return nil
+}
+
+func (m *baseMeta) HandleSnapshot(ctx Context, cmd uint8, name string, dpath string, snapshots map[string]*Snapshot) error {
+	if cmd == SnapshotList {
+		var entries []*Entry
+		if st := m.en.doReaddir(ctx, SnapshotInode, 1, &entries); st != 0 && st != syscall.ENOENT {
+			return st
+		}
+		for _, e := range entries {
+			snapshots[string(e.Name)] = m.snapshotInfo(ctx, e.Inode, e.Attr)
+		}
+		return nil
+	}
+	if !validSnapshotName(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+
+	var inode Ino
+	var attr Attr
+	switch cmd {
+	case SnapshotCreate:
+		src, st := m.resolveDir(ctx, dpath)
+		if st != 0 {
+			return fmt.Errorf("lookup %s: %s", dpath, st)
+		}
+		if err := m.en.doInitSnapshotRoot(); err != nil {
+			return err
+		}
+		if st = m.en.doGetAttr(ctx, src, &attr); st != 0 {
+			return fmt.Errorf("getattr of %s: %s", dpath, st)
+		}
+		if inode, st = m.clone(ctx, src, &attr, SnapshotInode, name, CloneModePreserveAttr|cloneModeSnapshot, 0, nil); st != 0 {
+			if st == syscall.EEXIST {
+				return fmt.Errorf("snapshot %s already exists", name)
+			}
+			return fmt.Errorf("create snapshot %s of %s: %s", name, dpath, st)
+		}
+		snapshots[name] = m.snapshotInfo(ctx, inode, &attr)
+	case SnapshotDel:
+		if err := m.lookupSnapshot(ctx, name, &inode, &attr); err != nil {
+			return err
+		}
+		if st := m.removeTree(ctx, SnapshotInode, name, inode, &attr, make(chan int, 50)); st != 0 {
+			return fmt.Errorf("remove snapshot %s: %s", name, st)
+		}
+	case SnapshotRestore:
+		if err := m.lookupSnapshot(ctx, name, &inode, &attr); err != nil {
+			return err
+		}
+		dpath = path.Clean("/" + dpath)
+		dstName := path.Base(dpath)
+		if dpath == "/" {
+			return fmt.Errorf("invalid destination %s", dpath)
+		}
+		parent, st := m.resolveDir(ctx, path.Dir(dpath))
+		if st != 0 {
+			return fmt.Errorf("lookup %s: %s", path.Dir(dpath), st)
+		}
+		s, st := m.entryStat(ctx, inode, &attr)
+		if st != 0 {
+			return fmt.Errorf("stat of snapshot %s: %s", name, st)
+		}
+		if st = m.checkQuota(ctx, s.space, s.files+s.dirs, attr.Uid, attr.Gid, parent); st != 0 {
+			return fmt.Errorf("restore snapshot %s: %s", name, st)
+		}
+		if _, st = m.clone(ctx, inode, &attr, parent, dstName, CloneModePreserveAttr, 0, nil); st != 0 {
+			return fmt.Errorf("restore snapshot %s to %s: %s", name, dpath, st)
+		}
+	default:
+		return fmt.Errorf("invalid snapshot command: %d", cmd)
+	}
+	return nil
+}
+
+// removeTree removes an entry and all the entries under it without checking the permission,
+// the nodes in snapshots can only be removed in this way.
+func (m *baseMeta) removeTree(ctx Context, parent Ino, name string, inode Ino, attr *Attr, concurrent chan int) syscall.Errno {
+	if attr.Typ != TypeDirectory {
+		return m.en.doUnlink(ctx, parent, name)
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+		return st
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var status syscall.Errno
+	for _, e := range entries {
+		if e.Attr.Typ != TypeDirectory {
+			if st := m.en.doUnlink(ctx, inode, string(e.Name)); st != 0 {
+				wg.Wait()
+				return st
+			}
+			continue
+		}
+		select {
+		case concurrent <- 1:
+			wg.Add(1)
+			go func(e *Entry) {
+				defer wg.Done()
+				if st := m.removeTree(ctx, inode, string(e.Name), e.Inode, e.Attr, concurrent); st != 0 {
+					mu.Lock()
+					status = st
+					mu.Unlock()
+				}
+				<-concurrent
+			}(e)
+		default:
+			if st := m.removeTree(ctx, inode, string(e.Name), e.Inode, e.Attr, concurrent); st != 0 {
+				wg.Wait()
+				return st
+			}
+		}
+	}
+	wg.Wait()
+	if status != 0 {
+		return status
+	}
+	st := m.en.doRmdir(ctx, parent, name)
+	if st == 0 {
+		m.updateDirQuota(ctx, parent, -align4K(0), -1)
+		m.updateOwnerQuota(attr.Uid, attr.Gid, -align4K(0), -1)
+		m.updateDirStat(ctx, parent, 0, -align4K(0), 0, -1)
+	}
+	return st
+}
@@ -20,21 +20,21 @@
 package meta
 
 import (
-	"bufio"
 	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
 	"runtime"
 	"sort"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/sirupsen/logrus"
 	"xorm.io/xorm"
@@ -95,12 +95,23 @@ type symlink struct {
 	Target string `xorm:"varchar(4096) notnull"`
 }
 
+type inlineData struct {
+	Inode Ino    `xorm:"pk"`
+	Data  []byte `xorm:"blob notnull"`
+}
+
 type xattr struct {
 	Inode Ino    `xorm:"unique(name) notnull"`
 	Name  string `xorm:"unique(name) notnull"`
 	Value []byte `xorm:"blob notnull"`
 }
 
+type facl struct {
+	Inode Ino    `xorm:"unique(facl) notnull"`
+	Type  uint8  `xorm:"unique(facl) notnull"`
+	Rule  []byte `xorm:"blob notnull"`
+}
+
 type flock struct {
 	Inode Ino    `xorm:"notnull unique(flock)"`
 	Sid   uint64 `xorm:"notnull unique(flock)"`
@@ -132,6 +143,86 @@ type delfile struct {
 	Expire int64  `xorm:"notnull"`
 }
 
+type dirQuota struct {
+	Inode      Ino   `xorm:"pk"`
+	MaxSpace   int64 `xorm:"notnull"`
+	MaxInodes  int64 `xorm:"notnull"`
+	UsedSpace  int64 `xorm:"notnull"`
+	UsedInodes int64 `xorm:"notnull"`
+}
+
+type dirStats struct {
+	Inode  Ino   `xorm:"pk"`
+	Length int64 `xorm:"notnull"`
+	Space  int64 `xorm:"notnull"`
+	Files  int64 `xorm:"notnull"`
+	Dirs   int64 `xorm:"notnull"`
+}
+
+type ownerQuota struct {
+	Qtype      uint8  `xorm:"unique(owner) notnull"`
+	Qid        uint32 `xorm:"unique(owner) notnull"`
+	MaxSpace   int64  `xorm:"notnull"`
+	MaxInodes  int64  `xorm:"notnull"`
+	UsedSpace  int64  `xorm:"notnull"`
+	UsedInodes int64  `xorm:"notnull"`
+}
+
+type changelog struct {
+	Id        uint64 `xorm:"pk"`
+	Time      int64  `xorm:"notnull"`
+	Op        uint8  `xorm:"notnull"`
+	Inode     Ino    `xorm:"notnull"`
+	Parent    Ino    `xorm:"notnull"`
+	Name      []byte `xorm:"varbinary(255) notnull"`
+	DstParent Ino    `xorm:"notnull"`
+	DstName   []byte `xorm:"varbinary(255) notnull"`
+}
+
+type invalidation struct {
+	Id   uint64 `xorm:"pk"`
+	Time int64  `xorm:"notnull"`
+	Data []byte `xorm:"blob notnull"`
+}
+
+type trashPath struct {
+	Inode  Ino    `xorm:"pk"`
+	Parent Ino    `xorm:"notnull"`
+	Path   []byte `xorm:"varbinary(4096) notnull"`
+}
+
+type pack struct {
+	Id   uint64 `xorm:"pk"`
+	Size uint32 `xorm:"notnull"`
+	Live int64  `xorm:"notnull"`
+}
+
+type packedSlice struct {
+	Chunkid uint64 `xorm:"pk"`
+	Pack    uint64 `xorm:"index notnull"`
+	Off     uint32 `xorm:"notnull"`
+	Len     uint32 `xorm:"notnull"`
+}
+
+type dedupBlock struct {
+	Hash    []byte `xorm:"pk varbinary(32)"`
+	Chunkid uint64 `xorm:"notnull"`
+	Indx    uint32 `xorm:"notnull"`
+	Size    uint32 `xorm:"notnull"`
+	Refs    uint32 `xorm:"notnull"`
+}
+
+type blockRef struct {
+	Chunkid uint64 `xorm:"pk"`
+	Indx    uint32 `xorm:"pk"`
+	Hash    []byte `xorm:"varbinary(32) notnull"`
+}
+
+type sliceTier struct {
+	Chunkid uint64 `xorm:"pk"`
+	Tier    uint8  `xorm:"notnull"`
+}
+
 type dbMeta struct {
 	baseMeta
 	db   *xorm.Engine
@@ -140,7 +231,9 @@ type dbMeta struct {
 type dbSnap struct {
 	node    map[Ino]*node
 	symlink map[Ino]*symlink
+	inline  map[Ino]*inlineData
 	xattr   map[Ino][]*xattr
+	facl    map[Ino][]*facl
 	edges   map[Ino][]*edge
 	chunk   map[string]*chunk
 }
@@ -228,8 +321,8 @@ func (m *dbMeta) Init(format Format, force bool) error {
 	if err := m.db.Sync2(new(edge)); err != nil && !strings.Contains(err.Error(), "Duplicate entry") {
 		logger.Fatalf("create table edge: %s", err)
 	}
-	if err := m.db.Sync2(new(node), new(symlink), new(xattr)); err != nil {
-		logger.Fatalf("create table node, symlink, xattr: %s", err)
+	if err := m.db.Sync2(new(node), new(symlink), new(xattr), new(facl)); err != nil {
+		logger.Fatalf("create table node, symlink, xattr, facl: %s", err)
 	}
 	if err := m.db.Sync2(new(chunk), new(chunkRef)); err != nil {
 		logger.Fatalf("create table chunk, chunk_ref: %s", err)
@@ -240,6 +333,18 @@ func (m *dbMeta) Init(format Format, force bool) error {
 	if err := m.db.Sync2(new(flock), new(plock)); err != nil {
 		logger.Fatalf("create table flock, plock: %s", err)
 	}
+	if err := m.db.Sync2(new(dirQuota), new(ownerQuota), new(dirStats)); err != nil {
+		logger.Fatalf("create table dir_quota, owner_quota, dir_stats: %s", err)
+	}
+	if err := m.db.Sync2(new(changelog), new(invalidation), new(trashPath), new(inlineData)); err != nil {
+		logger.Fatalf("create table changelog, invalidation, trash_path, inline_data: %s", err)
+	}
+	if err := m.db.Sync2(new(pack), new(packedSlice)); err != nil {
+		logger.Fatalf("create table pack, packed_slice: %s", err)
+	}
+	if err := m.db.Sync2(new(dedupBlock), new(blockRef), new(sliceTier)); err != nil {
+		logger.Fatalf("create table dedup_block, block_ref, slice_tier: %s", err)
+	}
 	if m.db.DriverName() == "mysql" {
 		m.updateCollate()
 	}
@@ -266,13 +371,31 @@ func (m *dbMeta) Init(format Format, force bool) error {
 			old.AccessKey = format.AccessKey
 			old.SecretKey = format.SecretKey
 			old.EncryptKey = format.EncryptKey
+			old.EncryptKeyVersion = format.EncryptKeyVersion
+			old.OldEncryptKeys = format.OldEncryptKeys
 			old.KeyEncrypted = format.KeyEncrypted
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.ChangelogDays = format.ChangelogDays
+			old.CacheInvalidation = format.CacheInvalidation
+			if format.EnableACL { // ACL can be enabled but not disabled
+				old.EnableACL = true
+			}
+			if format.InlineSize > 0 { // inline data can be resized but not disabled
+				old.InlineSize = format.InlineSize
+			}
+			if format.PackSize > 0 { // packing can be resized but not disabled
+				old.PackSize = format.PackSize
+			}
+			if format.Dedup { // deduplication can be enabled but not disabled
+				old.Dedup = true
+			}
 			old.MinClientVersion = format.MinClientVersion
 			old.MaxClientVersion = format.MaxClientVersion
-			if format != old {
+			old.Tiers = format.Tiers
+			old.Replica = format.Replica
+			if !reflect.DeepEqual(format, old) {
 				old.RemoveSecret()
 				format.RemoveSecret()
 				return fmt.Errorf("cannot update format from %+v to %+v", old, format)
@@ -325,16 +448,17 @@ func (m *dbMeta) Init(format Format, force bool) error {
 			{"totalInodes", 0},
 			{"nextCleanupSlices", 0},
 		}
-		return mustInsert(s, set, n, &cs)
+		return mustInsert(s, set, n, &cs, &dirStats{Inode: 1})
 	})
 }
 
 func (m *dbMeta) Reset() error {
 	return m.db.DropTables(&setting{}, &counter{},
-		&node{}, &edge{}, &symlink{}, &xattr{},
+		&node{}, &edge{}, &symlink{}, &xattr{}, &facl{},
 		&chunk{}, &chunkRef{},
 		&session{}, &sustained{}, &delfile{},
-		&flock{}, &plock{})
+		&flock{}, &plock{}, &dirQuota{}, &ownerQuota{}, &dirStats{}, &changelog{}, &invalidation{}, &trashPath{}, &inlineData{},
+		&pack{}, &packedSlice{}, &dedupBlock{}, &blockRef{}, &sliceTier{})
 }
 
 func (m *dbMeta) doLoad() ([]byte, error) {
@@ -353,6 +477,26 @@ func (m *dbMeta) doNewSession(sinfo []byte) error {
 	if err = m.db.Sync2(new(flock), new(plock)); err != nil {
 		return fmt.Errorf("update table flock, plock: %s", err)
 	}
+	// old volumes have no quota table
+	if err = m.db.Sync2(new(dirQuota), new(ownerQuota), new(dirStats)); err != nil {
+		return fmt.Errorf("update table dir_quota, dir_stats: %s", err)
+	}
+	// old volumes have no ACL table
+	if err = m.db.Sync2(new(facl)); err != nil {
+		return fmt.Errorf("update table facl: %s", err)
+	}
+	// old volumes have no change log or paths of trash
+	if err = m.db.Sync2(new(changelog), new(invalidation), new(trashPath), new(inlineData)); err != nil {
+		return fmt.Errorf("update table changelog, invalidation, trash_path, inline_data: %s", err)
+	}
+	// old volumes have no packs
+	if err = m.db.Sync2(new(pack), new(packedSlice)); err != nil {
+		return fmt.Errorf("update table pack, packed_slice: %s", err)
+	}
+	// old volumes have no shared blocks or tiers
+	if err = m.db.Sync2(new(dedupBlock), new(blockRef), new(sliceTier)); err != nil {
+		return fmt.Errorf("update table dedup_block, block_ref, slice_tier: %s", err)
+	}
 	if m.db.DriverName() == "mysql" {
 		m.updateCollate()
 	}
@@ -668,10 +812,14 @@ func clearSUGIDSQL(ctx Context, cur *node, set *Attr) {
 }
 
 func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	inode = m.checkRoot(inode)
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return errno(m.txn(func(s *xorm.Session) error {
+	var old Attr
+	err := m.txn(func(s *xorm.Session) error {
 		var cur = node{Inode: inode}
 		ok, err := s.Get(&cur)
 		if err != nil {
@@ -680,6 +828,7 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		if !ok {
 			return syscall.ENOENT
 		}
+		m.parseAttr(&cur, &old)
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -728,13 +877,23 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		if !changed {
 			return nil
 		}
+		if st := m.checkChownQuota(&old, attr); st != 0 {
+			return st
+		}
 		cur.Ctime = now
 		_, err = s.Cols("mode", "uid", "gid", "atime", "mtime", "ctime").Update(&cur, &node{Inode: inode})
 		if err == nil {
 			m.parseAttr(&cur, attr)
 		}
 		return err
-	}))
+	})
+	if err == nil {
+		m.chownQuota(&old, attr)
+		if *attr != old {
+			m.recordChange(&Change{Op: ChangeSetAttr, Inode: inode, Parent: attr.Parent})
+		}
+	}
+	return errno(err)
 }
 
 func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte) error {
@@ -755,6 +914,9 @@ func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte
 }
 
 func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := m.of.find(inode)
 	if f != nil {
@@ -762,7 +924,9 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		defer f.Unlock()
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	err := m.txn(func(s *xorm.Session) error {
 		var n = node{Inode: inode}
 		ok, err := s.Get(&n)
@@ -779,9 +943,29 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 			m.parseAttr(&n, attr)
 			return nil
 		}
+		newLength = int64(length) - int64(n.Length)
 		newSpace = align4K(length) - align4K(n.Length)
-		if newSpace > 0 && m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = n.Parent, n.Uid, n.Gid, n.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
+		}
+		if n.Flags&FlagInline != 0 && length < n.Length {
+			var d = inlineData{Inode: inode}
+			if _, err = s.Get(&d); err != nil {
+				return err
+			}
+			if uint64(len(d.Data)) > length {
+				d.Data = d.Data[:length]
+			}
+			if len(d.Data) > 0 {
+				_, err = s.Cols("data").Update(&d, &inlineData{Inode: inode})
+			} else {
+				n.Flags &^= FlagInline
+				_, err = s.Delete(&inlineData{Inode: inode})
+			}
+			if err != nil {
+				return err
+			}
 		}
 		var c chunk
 		var zeroChunks []uint32
@@ -826,7 +1010,7 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		now := time.Now().UnixNano() / 1e3
 		n.Mtime = now
 		n.Ctime = now
-		if _, err = s.Cols("length", "mtime", "ctime").Update(&n, &node{Inode: n.Inode}); err != nil {
+		if _, err = s.Cols("length", "mtime", "ctime", "flags").Update(&n, &node{Inode: n.Inode}); err != nil {
 			return err
 		}
 		m.parseAttr(&n, attr)
@@ -834,11 +1018,18 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeTruncate, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
 
 func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -861,7 +1052,9 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		defer f.Unlock()
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	err := m.txn(func(s *xorm.Session) error {
 		var n = node{Inode: inode}
 		ok, err := s.Get(&n)
@@ -877,6 +1070,9 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if n.Type != TypeFile {
 			return syscall.EPERM
 		}
+		if n.Flags&FlagInline != 0 {
+			return syscall.ENOTSUP
+		}
 		length := n.Length
 		if off+size > n.Length {
 			if mode&fallocKeepSize == 0 {
@@ -885,9 +1081,11 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		}
 
 		old := n.Length
+		newLength = int64(length) - int64(n.Length)
 		newSpace = align4K(length) - align4K(n.Length)
-		if newSpace > 0 && m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = n.Parent, n.Uid, n.Gid, n.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		now := time.Now().UnixNano() / 1e3
 		n.Length = length
@@ -919,6 +1117,10 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
@@ -977,6 +1179,16 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		var access, dflt *acl.Rule
+		if pn.Flags&FlagDefaultACL != 0 && _type != TypeSymlink {
+			def, err := m.getFacl(s, parent, acl.TypeDefault)
+			if err != nil {
+				return err
+			}
+			if def != nil {
+				n.Mode, n.Flags, access, dflt = inheritFacl(def, _type, mode)
+			}
+		}
 		var e = edge{Parent: parent, Name: name}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -1038,6 +1250,21 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 				return err
 			}
 		}
+		if _type == TypeDirectory && parent != TrashInode {
+			if err = mustInsert(s, &dirStats{Inode: ino}); err != nil {
+				return err
+			}
+		}
+		if access != nil {
+			if err = mustInsert(s, &facl{ino, acl.TypeAccess, access.Encode()}); err != nil {
+				return err
+			}
+		}
+		if dflt != nil {
+			if err = mustInsert(s, &facl{ino, acl.TypeDefault, dflt.Encode()}); err != nil {
+				return err
+			}
+		}
 		m.parseAttr(&n, attr)
 		return nil
 	})
@@ -1166,6 +1393,9 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 			if _, err := s.Delete(&xattr{Inode: e.Inode}); err != nil {
 				return err
 			}
+			if _, err := s.Delete(&facl{Inode: e.Inode}); err != nil {
+				return err
+			}
 		}
 		return err
 	})
@@ -1175,6 +1405,13 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		}
 		m.updateStats(newSpace, newInode)
 	}
+	if err == nil && n.Nlink == 0 {
+		m.updateOwnerQuota(n.Uid, n.Gid, -align4K(n.Length), -1)
+	}
+	if err == nil {
+		m.updateDirStat(ctx, parent, -int64(n.Length), -align4K(n.Length), -1, 0)
+		m.updateDirQuota(ctx, parent, -align4K(n.Length), -1) // every entry (hard link) is counted
+	}
 	return errno(err)
 }
 
@@ -1261,6 +1498,12 @@ func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 			if _, err := s.Delete(&xattr{Inode: e.Inode}); err != nil {
 				return err
 			}
+			if _, err := s.Delete(&facl{Inode: e.Inode}); err != nil {
+				return err
+			}
+			if _, err := s.Delete(&dirStats{Inode: e.Inode}); err != nil {
+				return err
+			}
 		}
 		if !isTrash(parent) {
 			_, err = s.Cols("nlink", "mtime", "ctime").Update(&pn, &node{Inode: pn.Inode})
@@ -1478,6 +1721,10 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 							if _, err := s.Delete(&symlink{Inode: dino}); err != nil {
 								return err
 							}
+						} else if de.Type == TypeDirectory {
+							if _, err := s.Delete(&dirStats{Inode: dino}); err != nil {
+								return err
+							}
 						}
 						if _, err := s.Delete(&node{Inode: dino}); err != nil {
 							return err
@@ -1487,6 +1734,9 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 					if _, err := s.Delete(&xattr{Inode: dino}); err != nil {
 						return err
 					}
+					if _, err := s.Delete(&facl{Inode: dino}); err != nil {
+						return err
+					}
 				}
 				if _, err := s.Delete(&edge{Parent: parentDst, Name: de.Name}); err != nil {
 					return err
@@ -1707,6 +1957,7 @@ func (m *dbMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 	}
 	if cs, ok := m.of.ReadChunk(inode, indx); ok {
 		*chunks = cs
+		m.touchAtime(ctx, inode, nil)
 		return 0
 	}
 	defer timeit(time.Now())
@@ -1724,10 +1975,14 @@ func (m *dbMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 	if !m.conf.ReadOnly && (len(c.Slices)/sliceBytes >= 5 || len(*chunks) >= 5) {
 		go m.compactChunk(inode, indx, false)
 	}
+	m.touchAtime(ctx, inode, nil)
 	return 0
 }
 
 func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := m.of.find(inode)
 	if f != nil {
@@ -1735,7 +1990,9 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		defer f.Unlock()
 	}
 	defer func() { m.of.InvalidateChunk(inode, indx) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	var needCompact bool
 	err := m.txn(func(s *xorm.Session) error {
 		var n = node{Inode: inode}
@@ -1751,11 +2008,13 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
 		if newleng > n.Length {
+			newLength = int64(newleng) - int64(n.Length)
 			newSpace = align4K(newleng) - align4K(n.Length)
 			n.Length = newleng
 		}
-		if m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = n.Parent, n.Uid, n.Gid, n.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		now := time.Now().UnixNano() / 1e3
 		n.Mtime = now
@@ -1779,7 +2038,14 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if err = mustInsert(s, chunkRef{slice.Chunkid, slice.Size, 1}); err != nil {
 			return err
 		}
-		_, err = s.Cols("length", "mtime", "ctime").Update(&n, &node{Inode: inode})
+		if n.Flags&FlagInline != 0 {
+			// the inline data is written into object storage by the client before this slice
+			n.Flags &^= FlagInline
+			if _, err = s.Delete(&inlineData{Inode: inode}); err != nil {
+				return err
+			}
+		}
+		_, err = s.Cols("length", "mtime", "ctime", "flags").Update(&n, &node{Inode: inode})
 		if err == nil {
 			needCompact = (len(ck.Slices)/sliceBytes)%100 == 99
 		}
@@ -1790,18 +2056,128 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			go m.compactChunk(inode, indx, false)
 		}
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
+	}
+	return errno(err)
+}
+
+func (m *dbMeta) ReadInline(ctx Context, inode Ino, attr *Attr, data *[]byte) syscall.Errno {
+	defer timeit(time.Now())
+	var n = node{Inode: inode}
+	var d = inlineData{Inode: inode}
+	err := m.txn(func(s *xorm.Session) error {
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if n.Flags&FlagInline == 0 {
+			return syscall.ENODATA
+		}
+		_, err = s.Get(&d)
+		return err
+	})
+	if err == nil {
+		m.parseAttr(&n, attr)
+		*data = d.Data
+	}
+	return errno(err)
+}
+
+func (m *dbMeta) WriteInline(ctx Context, inode Ino, off uint64, data []byte) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
+	if off+uint64(len(data)) > uint64(m.fmt.InlineSize) {
+		return syscall.EFBIG
+	}
+	defer timeit(time.Now())
+	f := m.of.find(inode)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+	}
+	defer func() { m.of.InvalidateChunk(inode, 0) }()
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
+	err := m.txn(func(s *xorm.Session) error {
+		var n = node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if n.Type != TypeFile {
+			return syscall.EPERM
+		}
+		var d = inlineData{Inode: inode}
+		if n.Flags&FlagInline != 0 {
+			if ok, err = s.Get(&d); err != nil {
+				return err
+			}
+		} else if n.Length > 0 {
+			return syscall.ENODATA
+		} else if ok, err = s.Where("Inode = ? and Indx = 0", inode).Exist(&chunk{}); err != nil {
+			return err
+		} else if ok {
+			return syscall.ENODATA
+		}
+		d.Data = writeInline(d.Data, off, data)
+		if newleng := off + uint64(len(data)); newleng > n.Length {
+			newLength = int64(newleng) - int64(n.Length)
+			newSpace = align4K(newleng) - align4K(n.Length)
+			n.Length = newleng
+		}
+		parent, uid, gid, nlink = n.Parent, n.Uid, n.Gid, n.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
+		}
+		now := time.Now().UnixNano() / 1e3
+		n.Mtime = now
+		n.Ctime = now
+		if ok {
+			_, err = s.Cols("data").Update(&d, &inlineData{Inode: inode})
+		} else {
+			n.Flags |= FlagInline
+			err = mustInsert(s, &d)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = s.Cols("length", "mtime", "ctime", "flags").Update(&n, &node{Inode: inode})
+		return err
+	})
+	if err == nil {
+		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
 
 func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if isSnapshot(fout) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := m.of.find(fout)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	defer func() { m.of.InvalidateChunk(fout, 0xFFFFFFFF) }()
 	err := m.txn(func(s *xorm.Session) error {
 		var nin, nout = node{Inode: fin}, node{Inode: fout}
@@ -1829,14 +2205,19 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if nout.Type != TypeFile {
 			return syscall.EINVAL
 		}
+		if nin.Flags&FlagInline != 0 || nout.Flags&FlagInline != 0 {
+			return syscall.ENOTSUP
+		}
 
 		newleng := offOut + size
 		if newleng > nout.Length {
+			newLength = int64(newleng) - int64(nout.Length)
 			newSpace = align4K(newleng) - align4K(nout.Length)
 			nout.Length = newleng
 		}
-		if m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = nout.Parent, nout.Uid, nout.Gid, nout.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		now := time.Now().UnixNano() / 1e3
 		nout.Mtime = now
@@ -1919,10 +2300,150 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: fout, Parent: parent})
+	}
+	return errno(err)
+}
+
+func (m *dbMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string, ino Ino, attr *Attr, cmode uint8, cumask uint16) syscall.Errno {
+	err := m.txn(func(s *xorm.Session) error {
+		var n, pn = node{Inode: srcIno}, node{Inode: parent}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		ok2, err2 := s.Get(&pn)
+		if err2 != nil {
+			return err2
+		}
+		if !ok || !ok2 {
+			return syscall.ENOENT
+		}
+		if pn.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		ok, err = s.Get(&edge{Parent: parent, Name: name})
+		if err != nil {
+			return err
+		}
+		if ok {
+			return syscall.EEXIST
+		}
+		var pattr Attr
+		m.parseAttr(&n, attr)
+		m.parseAttr(&pn, &pattr)
+		cloneAttr(ctx, attr, parent, &pattr, cmode, cumask)
+		n.Inode = ino
+		n.Parent = parent
+		n.Mode = attr.Mode
+		n.Uid = attr.Uid
+		n.Gid = attr.Gid
+		n.Nlink = attr.Nlink
+		n.Atime = attr.Atime*1e6 + int64(attr.Atimensec)/1e3
+		n.Mtime = attr.Mtime*1e6 + int64(attr.Mtimensec)/1e3
+		n.Ctime = attr.Ctime*1e6 + int64(attr.Ctimensec)/1e3
+		pn.Nlink = pattr.Nlink
+		pn.Mtime = pattr.Mtime*1e6 + int64(pattr.Mtimensec)/1e3
+		pn.Ctime = pattr.Ctime*1e6 + int64(pattr.Ctimensec)/1e3
+
+		if err = mustInsert(s, &edge{parent, name, ino, n.Type}, &n); err != nil {
+			return err
+		}
+		if _, err := s.Cols("nlink", "mtime", "ctime").Update(&pn, &node{Inode: parent}); err != nil {
+			return err
+		}
+		switch n.Type {
+		case TypeFile:
+			var cs []chunk
+			if err = s.Where("inode = ?", srcIno).Find(&cs); err != nil {
+				return err
+			}
+			for _, c := range cs {
+				if err = mustInsert(s, &chunk{ino, c.Indx, c.Slices}); err != nil {
+					return err
+				}
+				for _, sl := range readSliceBuf(c.Slices) {
+					if sl.chunkid > 0 {
+						if _, err := s.Exec("update jfs_chunk_ref set refs=refs+1 where chunkid = ? AND size = ?", sl.chunkid, sl.size); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if n.Flags&FlagInline != 0 {
+				var d = inlineData{Inode: srcIno}
+				if ok, err := s.Get(&d); err != nil {
+					return err
+				} else if ok {
+					if err = mustInsert(s, &inlineData{ino, d.Data}); err != nil {
+						return err
+					}
+				}
+			}
+		case TypeSymlink:
+			var l = symlink{Inode: srcIno}
+			if ok, err := s.Get(&l); err != nil {
+				return err
+			} else if ok {
+				if err = mustInsert(s, &symlink{ino, l.Target}); err != nil {
+					return err
+				}
+			}
+		case TypeDirectory:
+			if err = mustInsert(s, &dirStats{Inode: ino}); err != nil {
+				return err
+			}
+		}
+		var xs []xattr
+		if err = s.Where("inode = ?", srcIno).Find(&xs); err != nil {
+			return err
+		}
+		for _, x := range xs {
+			if err = mustInsert(s, &xattr{ino, x.Name, x.Value}); err != nil {
+				return err
+			}
+		}
+		var as []facl
+		if err = s.Where("inode = ?", srcIno).Find(&as); err != nil {
+			return err
+		}
+		for _, a := range as {
+			if err = mustInsert(s, &facl{ino, a.Type, a.Rule}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		m.updateStats(align4K(attr.Length), 1)
 	}
 	return errno(err)
 }
 
+func (m *dbMeta) doInitSnapshotRoot() error {
+	return m.txn(func(s *xorm.Session) error {
+		ok, err := s.Get(&node{Inode: SnapshotInode})
+		if err != nil || ok {
+			return err
+		}
+		now := time.Now().UnixNano() / 1000
+		return mustInsert(s, &node{
+			Inode:  SnapshotInode,
+			Type:   TypeDirectory,
+			Mode:   0555,
+			Atime:  now,
+			Mtime:  now,
+			Ctime:  now,
+			Nlink:  2,
+			Length: 4 << 10,
+			Parent: 1,
+		})
+	})
+}
+
 func (m *dbMeta) doFindDeletedFiles(ts int64, limit int) (map[Ino]uint64, error) {
 	var d delfile
 	rows, err := m.db.Where("expire < ?", ts).Limit(limit, 0).Rows(&d)
@@ -2015,6 +2536,7 @@ func (m *dbMeta) doDeleteFileData(inode Ino, length uint64) {
 			return
 		}
 	}
+	_, _ = m.db.Delete(&inlineData{Inode: inode})
 	_, _ = m.db.Delete(delfile{Inode: inode})
 }
 
@@ -2263,18 +2785,768 @@ func (m *dbMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errn
 	}))
 }
 
-func (m *dbMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
-	e := &DumpedEntry{}
-	return e, m.txn(func(s *xorm.Session) error {
-		n := &node{Inode: inode}
-		ok, err := m.db.Get(n)
-		if err != nil {
-			return err
-		}
-		attr := &Attr{Typ: typ, Nlink: 1}
-		if !ok {
-			logger.Warnf("The entry of the inode was not found. inode: %v", inode)
-		} else {
+func (m *dbMeta) getFacl(s *xorm.Session, inode Ino, aclType uint8) (*acl.Rule, error) {
+	var a = facl{Inode: inode, Type: aclType}
+	ok, err := s.Get(&a)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return acl.Decode(a.Rule)
+}
+
+func (m *dbMeta) doGetFacl(ctx Context, inode Ino, aclType uint8) (*acl.Rule, error) {
+	s := m.db.NewSession()
+	defer s.Close()
+	return m.getFacl(s, inode, aclType)
+}
+
+func (m *dbMeta) doSetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno {
+	return errno(m.txn(func(s *xorm.Session) error {
+		var n = node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		var attr Attr
+		m.parseAttr(&n, &attr)
+		stored, st := prepareFacl(ctx, &attr, aclType, rule)
+		if st != 0 {
+			return st
+		}
+		n.Mode = attr.Mode
+		n.Flags = attr.Flags
+		n.Ctime = attr.Ctime*1e6 + int64(attr.Ctimensec)/1e3
+		if _, err = s.Cols("flags", "mode", "ctime").Update(&n, &node{Inode: inode}); err != nil {
+			return err
+		}
+		if _, err = s.Delete(&facl{Inode: inode, Type: aclType}); err != nil {
+			return err
+		}
+		if stored != nil {
+			err = mustInsert(s, &facl{inode, aclType, stored.Encode()})
+		}
+		return err
+	}))
+}
+
+// dumpFacl fills the ACLs of a dumped entry with the rows of them.
+func (m *dbMeta) dumpFacl(inode Ino, rows []*facl, e *DumpedEntry) {
+	for _, a := range rows {
+		rule, err := acl.Decode(a.Rule)
+		if err != nil {
+			logger.Warnf("Corrupt ACL of inode %d: %s", inode, err)
+			continue
+		}
+		if a.Type == acl.TypeDefault {
+			e.DefaultACL = rule
+		} else {
+			e.AccessACL = rule
+		}
+	}
+}
+
+func (m *dbMeta) doGetQuota(qtype uint8, key uint64) (*Quota, error) {
+	if qtype == DirQuota {
+		q := dirQuota{Inode: Ino(key)}
+		ok, err := m.db.Get(&q)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return &Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes, UsedSpace: q.UsedSpace, UsedInodes: q.UsedInodes}, nil
+	}
+	var q ownerQuota
+	ok, err := m.db.Where("qtype=? AND qid=?", qtype, key).Get(&q)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes, UsedSpace: q.UsedSpace, UsedInodes: q.UsedInodes}, nil
+}
+
+func (m *dbMeta) doSetQuota(qtype uint8, key uint64, quota *Quota, usage bool) error {
+	cols := []string{"max_space", "max_inodes"}
+	if usage {
+		cols = append(cols, "used_space", "used_inodes")
+	}
+	return m.txn(func(s *xorm.Session) error {
+		if qtype == DirQuota {
+			q := dirQuota{
+				Inode:      Ino(key),
+				MaxSpace:   quota.MaxSpace,
+				MaxInodes:  quota.MaxInodes,
+				UsedSpace:  quota.UsedSpace,
+				UsedInodes: quota.UsedInodes,
+			}
+			ok, err := s.Get(&dirQuota{Inode: Ino(key)})
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return mustInsert(s, &q)
+			}
+			_, err = s.Cols(cols...).Update(&q, &dirQuota{Inode: Ino(key)})
+			return err
+		}
+		q := ownerQuota{
+			Qtype:      qtype,
+			Qid:        uint32(key),
+			MaxSpace:   quota.MaxSpace,
+			MaxInodes:  quota.MaxInodes,
+			UsedSpace:  quota.UsedSpace,
+			UsedInodes: quota.UsedInodes,
+		}
+		ok, err := s.Where("qtype=? AND qid=?", qtype, key).Get(&ownerQuota{})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return mustInsert(s, &q)
+		}
+		_, err = s.Cols(cols...).Where("qtype=? AND qid=?", qtype, key).Update(&q)
+		return err
+	})
+}
+
+func (m *dbMeta) doDelQuota(qtype uint8, key uint64) error {
+	return m.txn(func(s *xorm.Session) error {
+		var err error
+		if qtype == DirQuota {
+			_, err = s.Delete(&dirQuota{Inode: Ino(key)})
+		} else {
+			_, err = s.Where("qtype=? AND qid=?", qtype, key).Delete(&ownerQuota{})
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doLoadQuotas(qtype uint8) (map[uint64]*Quota, error) {
+	quotas := make(map[uint64]*Quota)
+	if qtype == DirQuota {
+		var rows []dirQuota
+		if err := m.db.Find(&rows); err != nil {
+			return nil, err
+		}
+		for _, q := range rows {
+			quotas[uint64(q.Inode)] = &Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes, UsedSpace: q.UsedSpace, UsedInodes: q.UsedInodes}
+		}
+		return quotas, nil
+	}
+	var rows []ownerQuota
+	if err := m.db.Where("qtype=?", qtype).Find(&rows); err != nil {
+		return nil, err
+	}
+	for _, q := range rows {
+		quotas[uint64(q.Qid)] = &Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes, UsedSpace: q.UsedSpace, UsedInodes: q.UsedInodes}
+	}
+	return quotas, nil
+}
+
+func (m *dbMeta) doFlushQuotas(qtype uint8, quotas map[uint64]*Quota) error {
+	return m.txn(func(s *xorm.Session) error {
+		var err error
+		for key, q := range quotas {
+			if qtype == DirQuota {
+				_, err = s.Exec("UPDATE jfs_dir_quota SET used_space=used_space+?, used_inodes=used_inodes+? WHERE inode=?", q.newSpace, q.newInodes, key)
+			} else {
+				_, err = s.Exec("UPDATE jfs_owner_quota SET used_space=used_space+?, used_inodes=used_inodes+? WHERE qtype=? AND qid=?", q.newSpace, q.newInodes, qtype, key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) doGetDirStat(inode Ino) (*dirStat, error) {
+	st := dirStats{Inode: inode}
+	ok, err := m.db.Get(&st)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &dirStat{st.Length, st.Space, st.Files, st.Dirs}, nil
+}
+
+func (m *dbMeta) doSetDirStats(stats map[Ino]*dirStat) error {
+	return m.txn(func(s *xorm.Session) error {
+		for inode, st := range stats {
+			row := dirStats{inode, st.length, st.space, st.files, st.dirs}
+			ok, err := s.Get(&dirStats{Inode: inode})
+			if err != nil {
+				return err
+			}
+			if ok {
+				_, err = s.Cols("length", "space", "files", "dirs").Update(&row, &dirStats{Inode: inode})
+			} else {
+				err = mustInsert(s, &row)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) doFlushDirStats(stats map[Ino]*dirStat) error {
+	return m.txn(func(s *xorm.Session) error {
+		for inode, st := range stats {
+			if _, err := s.Exec("UPDATE jfs_dir_stats SET length=length+?, space=space+?, files=files+?, dirs=dirs+? WHERE inode=?",
+				st.length, st.space, st.files, st.dirs, inode); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) doAppendChanges(changes []*Change) error {
+	return m.txn(func(s *xorm.Session) error {
+		var c = counter{Name: changeCounter}
+		ok, err := s.Get(&c)
+		if err != nil {
+			return err
+		}
+		rows := make([]interface{}, len(changes))
+		for i, ch := range changes {
+			ch.Id = uint64(c.Value) + uint64(i) + 1
+			rows[i] = &changelog{ch.Id, ch.Time, uint8(ch.Op), ch.Inode, ch.Parent, []byte(ch.Name), ch.DstParent, []byte(ch.DstName)}
+		}
+		c.Value += int64(len(changes))
+		if ok {
+			_, err = s.Cols("value").Update(&c, &counter{Name: changeCounter})
+		} else {
+			err = mustInsert(s, &c)
+		}
+		if err != nil {
+			return err
+		}
+		return mustInsert(s, rows...)
+	})
+}
+
+func (m *dbMeta) doReadChanges(from uint64, limit int) ([]*Change, error) {
+	var rows []changelog
+	if err := m.db.Where("id > ? AND id <= ?", from, from+uint64(limit)).Asc("id").Find(&rows); err != nil {
+		return nil, err
+	}
+	changes := make([]*Change, len(rows))
+	for i, r := range rows {
+		changes[i] = &Change{Id: r.Id, Time: r.Time, Op: ChangeOp(r.Op), Inode: r.Inode, Parent: r.Parent,
+			Name: string(r.Name), DstParent: r.DstParent, DstName: string(r.DstName)}
+	}
+	return changes, nil
+}
+
+func (m *dbMeta) doDeleteChanges(from, to uint64) error {
+	return m.txn(func(s *xorm.Session) error {
+		if _, err := s.Where("id > ? AND id <= ?", from, to).Delete(&changelog{}); err != nil {
+			return err
+		}
+		var c = counter{Name: trimmedChanges}
+		ok, err := s.Get(&c)
+		if err != nil {
+			return err
+		}
+		c.Value = int64(to)
+		if ok {
+			_, err = s.Cols("value").Update(&c, &counter{Name: trimmedChanges})
+		} else {
+			err = mustInsert(s, &c)
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doPublishInvalidations(msg []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		var c = counter{Name: invalidationCounter}
+		ok, err := s.Get(&c)
+		if err != nil {
+			return err
+		}
+		c.Value++
+		if ok {
+			_, err = s.Cols("value").Update(&c, &counter{Name: invalidationCounter})
+		} else {
+			err = mustInsert(s, &c)
+		}
+		if err != nil {
+			return err
+		}
+		return mustInsert(s, &invalidation{uint64(c.Value), time.Now().Unix(), msg})
+	})
+}
+
+func (m *dbMeta) doSubscribeInvalidations(handler func(msg []byte)) error {
+	last, err := m.getCounter(invalidationCounter)
+	if err != nil {
+		return err
+	}
+	for m.invalidationEnabled() {
+		time.Sleep(invalidationInterval)
+		var rows []invalidation
+		if err = m.db.Where("id > ?", last).Asc("id").Find(&rows); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			handler(r.Data)
+			last = int64(r.Id)
+		}
+		if ok, err := m.setIfSmall("lastCleanupInvalidations", time.Now().Unix(), int64(invalidationTTL.Seconds())); err != nil {
+			logger.Warnf("checking counter lastCleanupInvalidations: %s", err)
+		} else if ok {
+			edge := time.Now().Add(-invalidationTTL).Unix()
+			if _, err = m.db.Where("time < ?", edge).Delete(&invalidation{}); err != nil {
+				logger.Warnf("remove expired invalidations: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *dbMeta) doScanMeta(v *metaVisitor) error {
+	var n node
+	rows, err := m.db.Rows(&n)
+	if err != nil {
+		return err
+	}
+	var attr Attr
+	for rows.Next() {
+		if err = rows.Scan(&n); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("scan nodes: %s", err)
+		}
+		m.parseAttr(&n, &attr)
+		v.node(n.Inode, &attr)
+	}
+	_ = rows.Close()
+
+	var e edge
+	if rows, err = m.db.Rows(&e); err != nil {
+		return err
+	}
+	for rows.Next() {
+		if err = rows.Scan(&e); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("scan entries: %s", err)
+		}
+		v.edge(e.Parent, e.Name, e.Inode, e.Type)
+	}
+	_ = rows.Close()
+
+	var c chunk
+	if rows, err = m.db.Rows(&c); err != nil {
+		return err
+	}
+	for rows.Next() {
+		if err = rows.Scan(&c); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("scan chunks: %s", err)
+		}
+		v.chunk(c.Inode, c.Indx, readSliceBuf(c.Slices))
+	}
+	_ = rows.Close()
+
+	var ref chunkRef
+	if rows, err = m.db.Rows(&ref); err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&ref); err != nil {
+			return fmt.Errorf("scan slices: %s", err)
+		}
+		v.sliceRef(ref.Chunkid, ref.Size, int64(ref.Refs))
+	}
+	return nil
+}
+
+func (m *dbMeta) doSetEntry(parent Ino, name string, inode Ino, typ uint8) error {
+	return m.txn(func(s *xorm.Session) error {
+		if _, err := s.Delete(&edge{Parent: parent, Name: name}); err != nil {
+			return err
+		}
+		if inode == 0 {
+			return nil
+		}
+		return mustInsert(s, &edge{Parent: parent, Name: name, Inode: inode, Type: typ})
+	})
+}
+
+func (m *dbMeta) doSetNlink(inode Ino, nlink uint32, parent Ino) error {
+	return m.txn(func(s *xorm.Session) error {
+		cols := []string{"nlink"}
+		if parent > 0 {
+			cols = append(cols, "parent")
+		}
+		n, err := s.Cols(cols...).Update(&node{Nlink: nlink, Parent: parent}, &node{Inode: inode})
+		if err == nil && n == 0 {
+			err = syscall.ENOENT
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doAppendSlice(inode Ino, indx uint32, buf []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		return m.appendSlice(s, inode, indx, buf)
+	})
+}
+
+func (m *dbMeta) doSetSliceRefs(chunkid uint64, size uint32, refs int64) error {
+	return m.txn(func(s *xorm.Session) error {
+		n, err := s.Cols("size", "refs").Update(&chunkRef{Size: size, Refs: int(refs)}, &chunkRef{Chunkid: chunkid})
+		if err == nil && n == 0 {
+			err = mustInsert(s, &chunkRef{chunkid, size, int(refs)})
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doSetTrashPath(inode Ino, parent Ino, path string) error {
+	if path == "" {
+		_, err := m.db.Delete(&trashPath{Inode: inode})
+		return err
+	}
+	return m.txn(func(s *xorm.Session) error {
+		row := trashPath{inode, parent, []byte(path)}
+		n, err := s.Cols("parent", "path").Update(&row, &trashPath{Inode: inode})
+		if err == nil && n == 0 {
+			err = mustInsert(s, &row)
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doGetTrashPath(inode Ino) (Ino, string, error) {
+	row := trashPath{Inode: inode}
+	ok, err := m.db.Get(&row)
+	if err != nil || !ok {
+		return 0, "", err
+	}
+	return row.Parent, string(row.Path), nil
+}
+
+func (m *dbMeta) doFlushAtimes(atimes map[Ino]int64) error {
+	return m.txn(func(s *xorm.Session) error {
+		for inode, ts := range atimes {
+			atime := ts / 1e3 // in microseconds
+			if _, err := s.Cols("atime").Where("inode = ? AND atime < ?", inode, atime).Update(&node{Atime: atime}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) doAddPack(p *Pack, slices []PackedSlice) error {
+	return m.txn(func(s *xorm.Session) error {
+		rows := make([]interface{}, 0, len(slices)+1)
+		rows = append(rows, &pack{p.Id, p.Size, int64(p.Live)})
+		for _, ps := range slices {
+			rows = append(rows, &packedSlice{ps.Chunkid, ps.Pack, ps.Off, ps.Len})
+		}
+		return mustInsert(s, rows...)
+	})
+}
+
+func (m *dbMeta) doGetPacked(chunkid uint64, s *PackedSlice) syscall.Errno {
+	var ps = packedSlice{Chunkid: chunkid}
+	ok, err := m.db.Get(&ps)
+	if err != nil {
+		return errno(err)
+	}
+	if !ok {
+		return syscall.ENOENT
+	}
+	*s = PackedSlice{ps.Chunkid, ps.Pack, ps.Off, ps.Len}
+	return 0
+}
+
+func (m *dbMeta) doDeletePacked(chunkid uint64, size uint32) (uint64, error) {
+	var deleted uint64
+	err := m.txn(func(s *xorm.Session) error {
+		deleted = 0
+		var ps = packedSlice{Chunkid: chunkid}
+		ok, err := s.Get(&ps)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if _, err = s.Delete(&packedSlice{Chunkid: chunkid}); err != nil {
+			return err
+		}
+		if _, err = s.Delete(&chunkRef{Chunkid: chunkid}); err != nil {
+			return err
+		}
+		var p = pack{Id: ps.Pack}
+		if ok, err = s.Get(&p); err != nil || !ok {
+			return err
+		}
+		if p.Live <= int64(ps.Len) {
+			_, err = s.Delete(&pack{Id: p.Id})
+			deleted = p.Id
+		} else {
+			_, err = s.Cols("live").Update(&pack{Live: p.Live - int64(ps.Len)}, &pack{Id: p.Id})
+		}
+		return err
+	})
+	return deleted, err
+}
+
+func (m *dbMeta) doListPacks() ([]*Pack, error) {
+	var rows []pack
+	if err := m.db.Find(&rows); err != nil {
+		return nil, err
+	}
+	packs := make([]*Pack, 0, len(rows))
+	for _, p := range rows {
+		if p.Live < 0 {
+			p.Live = 0
+		}
+		packs = append(packs, &Pack{Id: p.Id, Size: p.Size, Live: uint32(p.Live)})
+	}
+	return packs, nil
+}
+
+func (m *dbMeta) doListPacked(fn func(s *PackedSlice)) error {
+	var ps packedSlice
+	rows, err := m.db.Rows(&ps)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&ps); err != nil {
+			return err
+		}
+		fn(&PackedSlice{ps.Chunkid, ps.Pack, ps.Off, ps.Len})
+	}
+	return nil
+}
+
+func (m *dbMeta) doRepack(old uint64, p *Pack, slices []PackedSlice) error {
+	return m.txn(func(s *xorm.Session) error {
+		p.Live = 0
+		for _, ps := range slices {
+			n, err := s.Cols("pack", "off", "len").Update(&packedSlice{Pack: ps.Pack, Off: ps.Off, Len: ps.Len}, &packedSlice{Chunkid: ps.Chunkid, Pack: old})
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				p.Live += ps.Len
+			}
+		}
+		if p.Live > 0 {
+			if err := mustInsert(s, &pack{p.Id, p.Size, int64(p.Live)}); err != nil {
+				return err
+			}
+		}
+		_, err := s.Delete(&pack{Id: old})
+		return err
+	})
+}
+
+func (m *dbMeta) doRefBlock(hash []byte, b *Block, owner *Block) syscall.Errno {
+	return errno(m.txn(func(s *xorm.Session) error {
+		var d dedupBlock
+		ok, err := s.Where("hash = ?", hash).Get(&d)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		*owner = Block{d.Chunkid, d.Indx, d.Size}
+		if _, err = s.Cols("refs").Where("hash = ?", hash).Update(&dedupBlock{Refs: d.Refs + 1}); err != nil {
+			return err
+		}
+		return mustInsert(s, &blockRef{b.Chunkid, b.Indx, hash})
+	}))
+}
+
+func (m *dbMeta) doAddBlock(hash []byte, b *Block) syscall.Errno {
+	return errno(m.txn(func(s *xorm.Session) error {
+		ok, err := s.Where("hash = ?", hash).Exist(&dedupBlock{})
+		if err != nil {
+			return err
+		}
+		if ok {
+			return syscall.EEXIST
+		}
+		return mustInsert(s, &dedupBlock{hash, b.Chunkid, b.Indx, b.Size, 1}, &blockRef{b.Chunkid, b.Indx, hash})
+	}))
+}
+
+func (m *dbMeta) doFindBlock(chunkid uint64, indx uint32, owner *Block) syscall.Errno {
+	var ref blockRef
+	ok, err := m.db.Where("chunkid = ? AND indx = ?", chunkid, indx).Get(&ref)
+	if err != nil {
+		return errno(err)
+	}
+	if !ok {
+		return syscall.ENOENT
+	}
+	var d dedupBlock
+	if ok, err = m.db.Where("hash = ?", ref.Hash).Get(&d); err != nil {
+		return errno(err)
+	}
+	if !ok {
+		return syscall.ENOENT
+	}
+	*owner = Block{d.Chunkid, d.Indx, d.Size}
+	return 0
+}
+
+func (m *dbMeta) doDerefSlice(chunkid uint64, size uint32, blocks []Block) ([]Block, error) {
+	var todel []Block
+	err := m.txn(func(s *xorm.Session) error {
+		var rows []blockRef
+		if err := s.Where("chunkid = ?", chunkid).Find(&rows); err != nil {
+			return err
+		}
+		found := make(map[uint32][]byte, len(rows))
+		for _, r := range rows {
+			found[r.Indx] = r.Hash
+		}
+		refs := make([][]byte, len(blocks))
+		owners := make(map[string]*Block)
+		counts := make(map[string]uint32)
+		for i, b := range blocks {
+			refs[i] = found[b.Indx]
+			h := refs[i]
+			if h == nil {
+				continue
+			}
+			if _, ok := owners[string(h)]; ok {
+				continue
+			}
+			var d dedupBlock
+			if ok, err := s.Where("hash = ?", h).Get(&d); err != nil {
+				return err
+			} else if ok {
+				owners[string(h)] = &Block{d.Chunkid, d.Indx, d.Size}
+				counts[string(h)] = d.Refs
+			}
+		}
+		todel = derefBlocks(blocks, refs, owners, counts)
+		for h := range owners {
+			var err error
+			if n, ok := counts[h]; ok {
+				_, err = s.Cols("refs").Where("hash = ?", []byte(h)).Update(&dedupBlock{Refs: n})
+			} else {
+				_, err = s.Where("hash = ?", []byte(h)).Delete(&dedupBlock{})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := s.Where("chunkid = ?", chunkid).Delete(&blockRef{}); err != nil {
+			return err
+		}
+		_, err := s.Delete(&chunkRef{Chunkid: chunkid})
+		return err
+	})
+	return todel, err
+}
+
+func (m *dbMeta) doListDedup(fn func(hash []byte, owner *Block, refs uint32)) error {
+	var d dedupBlock
+	rows, err := m.db.Rows(&d)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&d); err != nil {
+			return err
+		}
+		fn(d.Hash, &Block{d.Chunkid, d.Indx, d.Size}, d.Refs)
+	}
+	return nil
+}
+
+func (m *dbMeta) doListBlockRefs(fn func(b *Block, hash []byte)) error {
+	var r blockRef
+	rows, err := m.db.Rows(&r)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&r); err != nil {
+			return err
+		}
+		fn(&Block{Chunkid: r.Chunkid, Indx: r.Indx}, r.Hash)
+	}
+	return nil
+}
+
+func (m *dbMeta) doSetDedup(hash []byte, owner *Block, refs []Block) error {
+	return m.txn(func(s *xorm.Session) error {
+		rows := make([]interface{}, 0, len(refs)+1)
+		rows = append(rows, &dedupBlock{hash, owner.Chunkid, owner.Indx, owner.Size, uint32(len(refs))})
+		for _, b := range refs {
+			rows = append(rows, &blockRef{b.Chunkid, b.Indx, hash})
+		}
+		return mustInsert(s, rows...)
+	})
+}
+
+func (m *dbMeta) doSetSliceTier(chunkid uint64, tier uint8) error {
+	return m.txn(func(s *xorm.Session) error {
+		if tier == 0 {
+			_, err := s.Delete(&sliceTier{Chunkid: chunkid})
+			return err
+		}
+		ok, err := s.Exist(&sliceTier{Chunkid: chunkid})
+		if err != nil {
+			return err
+		}
+		if ok {
+			_, err = s.Cols("tier").Where("chunkid = ?", chunkid).Update(&sliceTier{Tier: tier})
+			return err
+		}
+		return mustInsert(s, &sliceTier{chunkid, tier})
+	})
+}
+
+func (m *dbMeta) doGetSliceTier(chunkid uint64) (uint8, error) {
+	t := sliceTier{Chunkid: chunkid}
+	if ok, err := m.db.Get(&t); err != nil || !ok {
+		return 0, err
+	}
+	return t.Tier, nil
+}
+
+func (m *dbMeta) doListSliceTiers(fn func(chunkid uint64, tier uint8)) error {
+	var tiers []sliceTier
+	if err := m.db.Find(&tiers); err != nil {
+		return err
+	}
+	for _, t := range tiers {
+		fn(t.Chunkid, t.Tier)
+	}
+	return nil
+}
+
+func (m *dbMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
+	e := &DumpedEntry{}
+	return e, m.txn(func(s *xorm.Session) error {
+		n := &node{Inode: inode}
+		ok, err := m.db.Get(n)
+		if err != nil {
+			return err
+		}
+		attr := &Attr{Typ: typ, Nlink: 1}
+		if !ok {
+			logger.Warnf("The entry of the inode was not found. inode: %v", inode)
+		} else {
 			m.parseAttr(n, attr)
 		}
 		e.Attr = dumpAttr(attr)
@@ -2292,6 +3564,13 @@ func (m *dbMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
 			sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
 			e.Xattrs = xattrs
 		}
+		if attr.Flags&(FlagAccessACL|FlagDefaultACL) != 0 {
+			var acls []*facl
+			if err = m.db.Find(&acls, &facl{Inode: inode}); err != nil {
+				return err
+			}
+			m.dumpFacl(inode, acls, e)
+		}
 
 		if attr.Typ == TypeFile {
 			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
@@ -2300,7 +3579,9 @@ func (m *dbMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
 					return err
 				}
 				if !ok {
-					logger.Warnf("no found chunk target for inode %d indx %d", inode, indx)
+					if attr.Flags&FlagInline == 0 {
+						logger.Warnf("no found chunk target for inode %d indx %d", inode, indx)
+					}
 					break
 				}
 				ss := readSliceBuf(c.Slices)
@@ -2310,6 +3591,13 @@ func (m *dbMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
 				}
 				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
 			}
+			if attr.Flags&FlagInline != 0 {
+				d := &inlineData{Inode: inode}
+				if _, err = m.db.Get(d); err != nil {
+					return err
+				}
+				e.Inline = d.Data
+			}
 		} else if attr.Typ == TypeSymlink {
 			l := &symlink{Inode: inode}
 			ok, err = m.db.Get(l)
@@ -2347,12 +3635,17 @@ func (m *dbMeta) dumpEntryFast(inode Ino, typ uint8) *DumpedEntry {
 		sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
 		e.Xattrs = xattrs
 	}
+	if attr.Flags&(FlagAccessACL|FlagDefaultACL) != 0 {
+		m.dumpFacl(inode, m.snap.facl[inode], e)
+	}
 
 	if attr.Typ == TypeFile {
 		for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
 			c, ok := m.snap.chunk[fmt.Sprintf("%d-%d", inode, indx)]
 			if !ok {
-				logger.Warnf("no found chunk target for inode %d indx %d", inode, indx)
+				if attr.Flags&FlagInline == 0 {
+					logger.Warnf("no found chunk target for inode %d indx %d", inode, indx)
+				}
 				break
 			}
 			ss := readSliceBuf(c.Slices)
@@ -2362,6 +3655,9 @@ func (m *dbMeta) dumpEntryFast(inode Ino, typ uint8) *DumpedEntry {
 			}
 			e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
 		}
+		if d, ok := m.snap.inline[inode]; ok && attr.Flags&FlagInline != 0 {
+			e.Inline = d.Data
+		}
 	} else if attr.Typ == TypeSymlink {
 		l, ok := m.snap.symlink[inode]
 		if !ok {
@@ -2373,12 +3669,7 @@ func (m *dbMeta) dumpEntryFast(inode Ino, typ uint8) *DumpedEntry {
 	return e
 }
 
-func (m *dbMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth int, showProgress func(totalIncr, currentIncr int64)) error {
-	bwWrite := func(s string) {
-		if _, err := bw.WriteString(s); err != nil {
-			panic(err)
-		}
-	}
+func (m *dbMeta) dumpDir(inode Ino, tree *DumpedEntry, dw dumpWriter, depth int, showProgress func(totalIncr, currentIncr int64)) error {
 	var edges []*edge
 	var err error
 	if m.snap != nil {
@@ -2392,12 +3683,12 @@ func (m *dbMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth i
 	if showProgress != nil {
 		showProgress(int64(len(edges)), 0)
 	}
-	if err := tree.writeJsonWithOutEntry(bw, depth); err != nil {
+	if err := dw.beginDir(tree, depth); err != nil {
 		return err
 	}
 	sort.Slice(edges, func(i, j int) bool { return edges[i].Name < edges[j].Name })
 
-	for idx, e := range edges {
+	for _, e := range edges {
 		var entry *DumpedEntry
 		if m.snap != nil {
 			entry = m.dumpEntryFast(e.Inode, e.Type)
@@ -2414,34 +3705,32 @@ func (m *dbMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth i
 
 		entry.Name = e.Name
 		if e.Type == TypeDirectory {
-			err = m.dumpDir(e.Inode, entry, bw, depth+2, showProgress)
+			err = m.dumpDir(e.Inode, entry, dw, depth+2, showProgress)
 		} else {
-			err = entry.writeJSON(bw, depth+2)
+			err = dw.writeEntry(entry, depth+2)
 		}
 		if err != nil {
 			return err
 		}
-		if idx != len(edges)-1 {
-			bwWrite(",")
-		}
 		if showProgress != nil {
 			showProgress(0, 1)
 		}
 	}
-	bwWrite(fmt.Sprintf("\n%s}\n%s}", strings.Repeat(jsonIndent, depth+1), strings.Repeat(jsonIndent, depth)))
-	return nil
+	return dw.endDir(depth)
 }
 
 func (m *dbMeta) makeSnap(bar *utils.Bar) error {
 	m.snap = &dbSnap{
 		node:    make(map[Ino]*node),
 		symlink: make(map[Ino]*symlink),
+		inline:  make(map[Ino]*inlineData),
 		xattr:   make(map[Ino][]*xattr),
+		facl:    make(map[Ino][]*facl),
 		edges:   make(map[Ino][]*edge),
 		chunk:   make(map[string]*chunk),
 	}
 
-	for _, s := range []interface{}{new(node), new(symlink), new(edge), new(xattr), new(chunk)} {
+	for _, s := range []interface{}{new(node), new(symlink), new(inlineData), new(edge), new(xattr), new(facl), new(chunk)} {
 		if count, err := m.db.Count(s); err == nil {
 			bar.IncrTotal(count)
 		} else {
@@ -2467,6 +3756,14 @@ func (m *dbMeta) makeSnap(bar *utils.Bar) error {
 	}); err != nil {
 		return err
 	}
+	if err := m.db.BufferSize(bufferSize).Iterate(new(inlineData), func(idx int, bean interface{}) error {
+		d := bean.(*inlineData)
+		m.snap.inline[d.Inode] = d
+		bar.Increment()
+		return nil
+	}); err != nil {
+		return err
+	}
 	if err := m.db.BufferSize(bufferSize).Iterate(new(edge), func(idx int, bean interface{}) error {
 		e := bean.(*edge)
 		m.snap.edges[e.Parent] = append(m.snap.edges[e.Parent], e)
@@ -2485,6 +3782,15 @@ func (m *dbMeta) makeSnap(bar *utils.Bar) error {
 		return err
 	}
 
+	if err := m.db.BufferSize(bufferSize).Iterate(new(facl), func(idx int, bean interface{}) error {
+		a := bean.(*facl)
+		m.snap.facl[a.Inode] = append(m.snap.facl[a.Inode], a)
+		bar.Increment()
+		return nil
+	}); err != nil {
+		return err
+	}
+
 	if err := m.db.BufferSize(bufferSize).Iterate(new(chunk), func(idx int, bean interface{}) error {
 		c := bean.(*chunk)
 		m.snap.chunk[fmt.Sprintf("%d-%d", c.Inode, c.Indx)] = c
@@ -2496,7 +3802,7 @@ func (m *dbMeta) makeSnap(bar *utils.Bar) error {
 	return nil
 }
 
-func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
+func (m *dbMeta) DumpMeta(w io.Writer, root Ino, format DumpFormat) (err error) {
 	defer func() {
 		if p := recover(); p != nil {
 			if e, ok := p.(error); ok {
@@ -2577,11 +3883,20 @@ func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		Sustained: sessions,
 		DelFiles:  dels,
 	}
+	if dm.Packs, err = m.dumpPacks(); err != nil {
+		return err
+	}
+	if dm.Dedup, err = m.dumpDedup(); err != nil {
+		return err
+	}
+	if dm.Tiers, err = m.dumpSliceTiers(); err != nil {
+		return err
+	}
 	if dm.Setting.SecretKey != "" {
 		dm.Setting.SecretKey = "removed"
 		logger.Warnf("Secret key is removed for the sake of safety")
 	}
-	bw, err := dm.writeJsonWithOutTree(w)
+	dw, err := newDumpWriter(w, &dm, format)
 	if err != nil {
 		return err
 	}
@@ -2597,239 +3912,229 @@ func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		bar.IncrTotal(totalIncr)
 		bar.IncrInt64(currentIncr)
 	}
-	if err = m.dumpDir(root, tree, bw, 1, showProgress); err != nil {
+	if err = m.dumpDir(root, tree, dw, 1, showProgress); err != nil {
 		return err
 	}
 	if trash != nil {
-		if _, err = bw.WriteString(","); err != nil {
-			return err
-		}
-		if err = m.dumpDir(TrashInode, trash, bw, 1, showProgress); err != nil {
+		if err = m.dumpDir(TrashInode, trash, dw, 1, showProgress); err != nil {
 			return err
 		}
 	}
-	if _, err = bw.WriteString("\n}\n"); err != nil {
+	if err = dw.finish(); err != nil {
 		return err
 	}
 	progress.Done()
 	m.snap = nil
-
-	return bw.Flush()
-}
-
-func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*chunkRef) error {
-	inode := e.Attr.Inode
-	logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
-	attr := e.Attr
-	n := &node{
-		Inode:  inode,
-		Type:   typeFromString(attr.Type),
-		Mode:   attr.Mode,
-		Uid:    attr.Uid,
-		Gid:    attr.Gid,
-		Atime:  attr.Atime*1e6 + int64(attr.Atimensec)/1e3,
-		Mtime:  attr.Mtime*1e6 + int64(attr.Atimensec)/1e3,
-		Ctime:  attr.Ctime*1e6 + int64(attr.Atimensec)/1e3,
-		Nlink:  attr.Nlink,
-		Rdev:   attr.Rdev,
-		Parent: e.Parent,
-	} // Length not set
-	var beans []interface{}
-	if n.Type == TypeFile {
-		n.Length = attr.Length
-		chunks := make([]*chunk, 0, len(e.Chunks))
-		for _, c := range e.Chunks {
-			if len(c.Slices) == 0 {
-				continue
-			}
-			slices := make([]byte, 0, sliceBytes*len(c.Slices))
-			for _, s := range c.Slices {
-				slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
-				m.Lock()
-				if refs[s.Chunkid] == nil {
-					refs[s.Chunkid] = &chunkRef{s.Chunkid, s.Size, 1}
-				} else {
-					refs[s.Chunkid].Refs++
-				}
-				m.Unlock()
-				if cs.NextChunk <= int64(s.Chunkid) {
-					cs.NextChunk = int64(s.Chunkid) + 1
-				}
-			}
-			chunks = append(chunks, &chunk{inode, c.Index, slices})
-		}
-		if len(chunks) > 0 {
-			beans = append(beans, chunks)
-		}
-	} else if n.Type == TypeDirectory {
-		n.Length = 4 << 10
-		if len(e.Entries) > 0 {
-			edges := make([]*edge, 0, len(e.Entries))
-			for _, c := range e.Entries {
-				edges = append(edges, &edge{
-					Parent: inode,
-					Name:   c.Name,
-					Inode:  c.Attr.Inode,
-					Type:   typeFromString(c.Attr.Type),
-				})
-			}
-			beans = append(beans, edges)
-		}
-	} else if n.Type == TypeSymlink {
-		n.Length = uint64(len(e.Symlink))
-		beans = append(beans, &symlink{inode, e.Symlink})
-	}
-	if inode > 1 && inode != TrashInode {
-		cs.UsedSpace += align4K(n.Length)
-		cs.UsedInodes += 1
-	}
-	if inode < TrashInode {
-		if cs.NextInode <= int64(inode) {
-			cs.NextInode = int64(inode) + 1
-		}
-	} else {
-		if cs.NextTrash < int64(inode)-TrashInode {
-			cs.NextTrash = int64(inode) - TrashInode
-		}
-	}
-
-	if len(e.Xattrs) > 0 {
-		xattrs := make([]*xattr, 0, len(e.Xattrs))
-		for _, x := range e.Xattrs {
-			xattrs = append(xattrs, &xattr{inode, x.Name, []byte(x.Value)})
-		}
-		beans = append(beans, xattrs)
-	}
-	beans = append(beans, n)
-	s := m.db.NewSession()
-	defer s.Close()
-	return mustInsert(s, beans...)
+	return nil
 }
 
-func (m *dbMeta) LoadMeta(r io.Reader) error {
+func (m *dbMeta) doLoadStart() (uint64, error) {
 	tables, err := m.db.DBMetas()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	c := counter{Name: loadedEntries}
 	if len(tables) > 0 {
-		return fmt.Errorf("Database %s is not empty", m.Name())
+		if ok, err := m.db.Get(&c); err != nil || !ok {
+			return 0, fmt.Errorf("Database %s is not empty", m.Name())
+		}
+		if ok, err := m.db.Get(&setting{Name: "format"}); err != nil || ok {
+			return 0, fmt.Errorf("Database %s is not empty", m.Name())
+		}
+		return uint64(c.Value), nil
 	}
 	if err = m.db.Sync2(new(setting), new(counter)); err != nil {
-		return fmt.Errorf("create table setting, counter: %s", err)
+		return 0, fmt.Errorf("create table setting, counter: %s", err)
 	}
-	if err = m.db.Sync2(new(node), new(edge), new(symlink), new(xattr)); err != nil {
-		return fmt.Errorf("create table node, edge, symlink, xattr: %s", err)
+	if err = m.db.Sync2(new(node), new(edge), new(symlink), new(xattr), new(facl)); err != nil {
+		return 0, fmt.Errorf("create table node, edge, symlink, xattr, facl: %s", err)
 	}
 	if err = m.db.Sync2(new(chunk), new(chunkRef)); err != nil {
-		return fmt.Errorf("create table chunk, chunk_ref: %s", err)
+		return 0, fmt.Errorf("create table chunk, chunk_ref: %s", err)
 	}
 	if err = m.db.Sync2(new(session), new(sustained), new(delfile)); err != nil {
-		return fmt.Errorf("create table session, sustaind, delfile: %s", err)
+		return 0, fmt.Errorf("create table session, sustaind, delfile: %s", err)
 	}
 	if err = m.db.Sync2(new(flock), new(plock)); err != nil {
-		return fmt.Errorf("create table flock, plock: %s", err)
+		return 0, fmt.Errorf("create table flock, plock: %s", err)
 	}
-
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err = dec.Decode(dm); err != nil {
-		return err
+	if err = m.db.Sync2(new(dirQuota), new(ownerQuota), new(dirStats)); err != nil {
+		return 0, fmt.Errorf("create table dir_quota, owner_quota, dir_stats: %s", err)
 	}
-	format, err := json.MarshalIndent(dm.Setting, "", "")
-	if err != nil {
-		return err
+	if err = m.db.Sync2(new(changelog), new(invalidation), new(trashPath), new(inlineData)); err != nil {
+		return 0, fmt.Errorf("create table changelog, invalidation, trash_path, inline_data: %s", err)
 	}
-
-	progress := utils.NewProgress(false, false)
-	bar := progress.AddCountBar("Collected entries", 1) // with root
-	showProgress := func(totalIncr, currentIncr int64) {
-		bar.IncrTotal(totalIncr)
-		bar.IncrInt64(currentIncr)
+	if err = m.db.Sync2(new(pack), new(packedSlice)); err != nil {
+		return 0, fmt.Errorf("create table pack, packed_slice: %s", err)
 	}
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, showProgress); err != nil {
-		return err
+	if err = m.db.Sync2(new(dedupBlock), new(blockRef), new(sliceTier)); err != nil {
+		return 0, fmt.Errorf("create table dedup_block, block_ref, slice_tier: %s", err)
 	}
-	if dm.Trash != nil {
-		bar.IncrTotal(1)
-		if err = collectEntry(dm.Trash, entries, showProgress); err != nil {
-			return err
+	return 0, m.txn(func(s *xorm.Session) error {
+		return mustInsert(s, &c)
+	})
+}
+
+// appendRows splits the rows into small batches to limit the number of variables in a statement.
+func appendRows(beans []interface{}, rows interface{}) []interface{} {
+	v := reflect.ValueOf(rows)
+	for i := 0; i < v.Len(); i += 50 {
+		j := i + 50
+		if j > v.Len() {
+			j = v.Len()
 		}
+		beans = append(beans, v.Slice(i, j).Interface())
 	}
-	bar.Done()
+	return beans
+}
 
-	counters := &DumpedCounters{
-		NextInode: 2,
-		NextChunk: 1,
-	}
-	refs := make(map[uint64]*chunkRef)
-	bar = progress.AddCountBar("Loaded entries", int64(len(entries)))
-	maxNum := 100
-	pool := make(chan struct{}, maxNum)
-	errCh := make(chan error, 100)
-	done := make(chan struct{}, 1)
-	var wg sync.WaitGroup
-	for _, entry := range entries {
-		select {
-		case err = <-errCh:
-			return err
-		default:
+func (m *dbMeta) doLoadEntries(b *loadBatch) error {
+	var nodes []*node
+	var edges []*edge
+	var chunks []*chunk
+	var symlinks []*symlink
+	var inlines []*inlineData
+	var xattrs []*xattr
+	var facls []*facl
+	for _, e := range b.entries {
+		inode := e.Attr.Inode
+		logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
+		attr := e.Attr
+		n := &node{
+			Inode:  inode,
+			Type:   typeFromString(attr.Type),
+			Mode:   attr.Mode,
+			Uid:    attr.Uid,
+			Gid:    attr.Gid,
+			Atime:  attr.Atime*1e6 + int64(attr.Atimensec)/1e3,
+			Mtime:  attr.Mtime*1e6 + int64(attr.Mtimensec)/1e3,
+			Ctime:  attr.Ctime*1e6 + int64(attr.Ctimensec)/1e3,
+			Nlink:  attr.Nlink,
+			Rdev:   attr.Rdev,
+			Parent: e.Parent,
+		} // Length not set
+		switch n.Type {
+		case TypeFile:
+			n.Length = attr.Length
+			for _, c := range e.Chunks {
+				if len(c.Slices) == 0 {
+					continue
+				}
+				slices := make([]byte, 0, sliceBytes*len(c.Slices))
+				for _, s := range c.Slices {
+					slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
+				}
+				chunks = append(chunks, &chunk{inode, c.Index, slices})
+			}
+			if len(e.Inline) > 0 {
+				inlines = append(inlines, &inlineData{inode, e.Inline})
+			}
+		case TypeDirectory:
+			n.Length = 4 << 10
+		case TypeSymlink:
+			n.Length = uint64(len(e.Symlink))
+			symlinks = append(symlinks, &symlink{inode, e.Symlink})
+		}
+		for _, x := range e.Xattrs {
+			xattrs = append(xattrs, &xattr{inode, x.Name, []byte(x.Value)})
 		}
-		pool <- struct{}{}
-		wg.Add(1)
-		go func(entry *DumpedEntry) {
-			defer func() {
-				bar.Increment()
-				wg.Done()
-				<-pool
-			}()
-			if err = m.loadEntry(entry, counters, refs); err != nil {
-				errCh <- err
+		if n.Flags = loadFacl(e); n.Flags != 0 {
+			if e.AccessACL != nil {
+				facls = append(facls, &facl{inode, acl.TypeAccess, e.AccessACL.Encode()})
+			}
+			if e.DefaultACL != nil {
+				facls = append(facls, &facl{inode, acl.TypeDefault, e.DefaultACL.Encode()})
 			}
-		}(entry)
+		}
+		if n.Type == TypeFile && len(e.Inline) > 0 {
+			n.Flags |= FlagInline
+		}
+		nodes = append(nodes, n)
+		if inode != 1 && inode != TrashInode {
+			edges = append(edges, &edge{Parent: e.Parent, Name: e.Name, Inode: inode, Type: n.Type})
+		}
+	}
+	for _, e := range b.links {
+		edges = append(edges, &edge{Parent: e.Parent, Name: e.Name, Inode: e.Attr.Inode, Type: TypeFile})
 	}
 
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+	return m.txn(func(s *xorm.Session) error {
+		var beans []interface{}
+		for _, rows := range []interface{}{nodes, edges, chunks, symlinks, inlines, xattrs, facls} {
+			beans = appendRows(beans, rows)
+		}
+		slices := make(map[loadedSlice]int64, len(b.slices))
+		ids := make([]uint64, 0, len(b.slices))
+		for k, v := range b.slices {
+			slices[k] = v
+			ids = append(ids, k.id)
+		}
+		var refs []*chunkRef
+		for i := 0; i < len(ids); i += 500 {
+			j := i + 500
+			if j > len(ids) {
+				j = len(ids)
+			}
+			var exist []chunkRef
+			if err := s.In("chunkid", ids[i:j]).Find(&exist); err != nil {
+				return err
+			}
+			for _, r := range exist {
+				k := loadedSlice{r.Chunkid, r.Size}
+				if _, ok := slices[k]; !ok {
+					continue
+				}
+				if _, err := s.Exec("update jfs_chunk_ref set refs=refs+? where chunkid = ? AND size = ?", slices[k], k.id, k.size); err != nil {
+					return err
+				}
+				delete(slices, k)
+			}
+		}
+		for k, v := range slices {
+			refs = append(refs, &chunkRef{k.id, k.size, int(v)})
+		}
+		beans = appendRows(beans, refs)
+		if err := mustInsert(s, beans...); err != nil {
+			return err
+		}
+		_, err := s.Cols("value").Update(&counter{Value: int64(b.loaded)}, &counter{Name: loadedEntries})
+		return err
+	})
+}
 
-	select {
-	case err = <-errCh:
+func (m *dbMeta) doLoadFinish(dm *DumpedMeta, cs *DumpedCounters, nlinks map[Ino]uint32) error {
+	format, err := json.MarshalIndent(dm.Setting, "", "")
+	if err != nil {
 		return err
-	case <-done:
-	}
-	progress.Done()
-	logger.Infof("Dumped counters: %+v", *dm.Counters)
-	logger.Infof("Loaded counters: %+v", *counters)
-
-	beans := make([]interface{}, 0, 4) // setting, counter, delfile, chunkRef
-	beans = append(beans, &setting{"format", string(format)})
-	cs := make([]*counter, 0, 7)
-	cs = append(cs, &counter{"usedSpace", counters.UsedSpace})
-	cs = append(cs, &counter{"totalInodes", counters.UsedInodes})
-	cs = append(cs, &counter{"nextInode", counters.NextInode})
-	cs = append(cs, &counter{"nextChunk", counters.NextChunk})
-	cs = append(cs, &counter{"nextSession", counters.NextSession})
-	cs = append(cs, &counter{"nextTrash", counters.NextTrash})
-	cs = append(cs, &counter{"nextCleanupSlices", 0})
-	beans = append(beans, cs)
-	if len(dm.DelFiles) > 0 {
-		dels := make([]*delfile, 0, len(dm.DelFiles))
-		for _, d := range dm.DelFiles {
-			dels = append(dels, &delfile{d.Inode, d.Length, d.Expire})
-		}
-		beans = append(beans, dels)
-	}
-	if len(refs) > 0 {
-		cks := make([]*chunkRef, 0, len(refs))
-		for _, v := range refs {
-			cks = append(cks, v)
-		}
-		beans = append(beans, cks)
 	}
-	s := m.db.NewSession()
-	defer s.Close()
-	return mustInsert(s, beans...)
+	return m.txn(func(s *xorm.Session) error {
+		for inode, n := range nlinks {
+			if _, err := s.Cols("nlink").Update(&node{Nlink: n}, &node{Inode: inode}); err != nil {
+				return err
+			}
+		}
+		if _, err := s.Delete(&counter{Name: loadedEntries}); err != nil {
+			return err
+		}
+		beans := make([]interface{}, 0, 3) // setting, counter, delfile
+		beans = append(beans, &setting{"format", string(format)})
+		counters := []*counter{
+			{"usedSpace", cs.UsedSpace},
+			{"totalInodes", cs.UsedInodes},
+			{"nextInode", cs.NextInode},
+			{"nextChunk", cs.NextChunk},
+			{"nextSession", cs.NextSession},
+			{"nextTrash", cs.NextTrash},
+			{"nextCleanupSlices", 0},
+		}
+		beans = append(beans, counters)
+		if len(dm.DelFiles) > 0 {
+			dels := make([]*delfile, 0, len(dm.DelFiles))
+			for _, d := range dm.DelFiles {
+				dels = append(dels, &delfile{d.Inode, d.Length, d.Expire})
+			}
+			beans = appendRows(beans, dels)
+		}
+		return mustInsert(s, beans...)
+	})
 }
@@ -0,0 +1,134 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"syscall"
+	"time"
+)
+
+// The data of a volume can be placed in additional storages (Format.Tiers) besides the primary one. The tier
+// of new data is chosen by the TierXattr of the file or its nearest ancestor directory, or the patterns of
+// tiers matching the name of a new file. The slices not in the primary storage are recorded by SetSliceTier
+// before they are used, and the records are removed together with the slices.
+
+// TierXattr is the extended attribute of files and directories to choose the tier (by name) of new data.
+const TierXattr = "user.juicefs.tier"
+
+// ValidTiers returns an error if the tiers can't be used by a volume.
+func ValidTiers(tiers []Tier) error {
+	ids := make(map[uint8]bool)
+	names := make(map[string]bool)
+	for _, t := range tiers {
+		if t.Id == 0 {
+			return fmt.Errorf("invalid id of tier %s: 0 is the primary storage", t.Name)
+		}
+		if t.Name == "" || t.Storage == "" || t.Bucket == "" {
+			return fmt.Errorf("name, storage and bucket of tier %d are required", t.Id)
+		}
+		if ids[t.Id] || names[t.Name] {
+			return fmt.Errorf("duplicated tier %d (%s)", t.Id, t.Name)
+		}
+		for _, p := range t.Patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q of tier %s: %s", p, t.Name, err)
+			}
+		}
+		ids[t.Id] = true
+		names[t.Name] = true
+	}
+	return nil
+}
+
+// FindTier returns the tier with the name, or nil if there is none.
+func (f *Format) FindTier(name string) *Tier {
+	for i := range f.Tiers {
+		if f.Tiers[i].Name == name {
+			return &f.Tiers[i]
+		}
+	}
+	return nil
+}
+
+// MatchTier returns the first tier with a pattern matching the name of file, or nil if there is none.
+func (f *Format) MatchTier(name string) *Tier {
+	for i := range f.Tiers {
+		for _, p := range f.Tiers[i].Patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return &f.Tiers[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (m *baseMeta) SetSliceTier(ctx Context, chunkid uint64, tier uint8) syscall.Errno {
+	defer timeit(time.Now())
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	return errno(m.en.doSetSliceTier(chunkid, tier))
+}
+
+func (m *baseMeta) GetSliceTier(ctx Context, chunkid uint64, tier *uint8) syscall.Errno {
+	if len(m.fmt.Tiers) == 0 {
+		*tier = 0
+		return 0
+	}
+	defer timeit(time.Now())
+	t, err := m.en.doGetSliceTier(chunkid)
+	if err != nil {
+		return errno(err)
+	}
+	*tier = t
+	return 0
+}
+
+func (m *baseMeta) ListSliceTiers(ctx Context, fn func(chunkid uint64, tier uint8)) syscall.Errno {
+	return errno(m.en.doListSliceTiers(fn))
+}
+
+// deleteSliceTier removes the tier of a deleted slice.
+func (m *baseMeta) deleteSliceTier(chunkid uint64) {
+	if len(m.fmt.Tiers) == 0 {
+		return
+	}
+	if err := m.en.doSetSliceTier(chunkid, 0); err != nil {
+		logger.Warnf("remove tier of slice %d: %s", chunkid, err)
+	}
+}
+
+// dumpSliceTiers returns the slices not in the primary storage.
+func (m *baseMeta) dumpSliceTiers() ([]*DumpedSliceTier, error) {
+	var tiers []*DumpedSliceTier
+	err := m.en.doListSliceTiers(func(chunkid uint64, tier uint8) {
+		tiers = append(tiers, &DumpedSliceTier{chunkid, tier})
+	})
+	return tiers, err
+}
+
+// loadSliceTiers records the tiers of dumped slices.
+func (m *baseMeta) loadSliceTiers(tiers []*DumpedSliceTier) error {
+	for _, t := range tiers {
+		if err := m.en.doSetSliceTier(t.Chunkid, t.Tier); err != nil {
+			return fmt.Errorf("load tier of slice %d: %s", t.Chunkid, err)
+		}
+	}
+	return nil
+}
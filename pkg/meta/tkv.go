@@ -17,7 +17,6 @@
 package meta
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
@@ -25,6 +24,7 @@ import (
 	"io"
 	"math"
 	"math/rand"
+	"reflect"
 	"runtime"
 	"sort"
 	"strings"
@@ -36,6 +36,7 @@ import (
 
 	"github.com/google/btree"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -162,14 +163,29 @@ All keys:
   AiiiiiiiiD...      dentry
   AiiiiiiiiCnnnn     file chunks
   AiiiiiiiiS         symlink target
+  AiiiiiiiiB         inline data
   AiiiiiiiiX...      extented attribute
+  AiiiiiiiiLt        ACL of type t
   Diiiiiiiillllllll  delete inodes
   Fiiiiiiii          Flocks
   Piiiiiiii          POSIX locks
   Kccccccccnnnn      slice refs
+  Lccccccccnnnn      slice refs while loading
   SHssssssss         session heartbeat
   SIssssssss         session info
   SSssssssssiiiiiiii sustained inode
+  QDiiiiiiii         directory quota
+  QUuuuu             user quota
+  QGgggg             group quota
+  Uiiiiiiii          directory statistics
+  Hcccccccc          change log
+  Ncccccccc          cache invalidations
+  Tiiiiiiii          paths of entries in trash
+  Jcccccccc          packed slices
+  Opppppppp          packs
+  Whhhhhhhh...       shared blocks (sha256 of the content)
+  Vccccccccnnnn      references to shared blocks
+  Gcccccccc          tiers of slices
 */
 
 func (m *kvMeta) inodeKey(inode Ino) []byte {
@@ -188,14 +204,42 @@ func (m *kvMeta) sliceKey(chunkid uint64, size uint32) []byte {
 	return m.fmtKey("K", chunkid, size)
 }
 
+func (m *kvMeta) packedKey(chunkid uint64) []byte {
+	return m.fmtKey("J", chunkid)
+}
+
+func (m *kvMeta) packKey(pack uint64) []byte {
+	return m.fmtKey("O", pack)
+}
+
+func (m *kvMeta) dedupKey(hash []byte) []byte {
+	return m.fmtKey("W", string(hash))
+}
+
+func (m *kvMeta) blockRefKey(chunkid uint64, indx uint32) []byte {
+	return m.fmtKey("V", chunkid, indx)
+}
+
+func (m *kvMeta) sliceTierKey(chunkid uint64) []byte {
+	return m.fmtKey("G", chunkid)
+}
+
 func (m *kvMeta) symKey(inode Ino) []byte {
 	return m.fmtKey("A", inode, "S")
 }
 
+func (m *kvMeta) inlineKey(inode Ino) []byte {
+	return m.fmtKey("A", inode, "B")
+}
+
 func (m *kvMeta) xattrKey(inode Ino, name string) []byte {
 	return m.fmtKey("A", inode, "X", name)
 }
 
+func (m *kvMeta) aclKey(inode Ino, aclType uint8) []byte {
+	return m.fmtKey("A", inode, "L", aclType)
+}
+
 func (m *kvMeta) flockKey(inode Ino) []byte {
 	return m.fmtKey("F", inode)
 }
@@ -224,6 +268,40 @@ func (m *kvMeta) sustainedKey(sid uint64, inode Ino) []byte {
 	return m.fmtKey("SS", sid, inode)
 }
 
+func (m *kvMeta) quotaPrefix(qtype uint8) string {
+	switch qtype {
+	case UserQuota:
+		return "QU"
+	case GroupQuota:
+		return "QG"
+	default:
+		return "QD"
+	}
+}
+
+func (m *kvMeta) quotaKey(qtype uint8, key uint64) []byte {
+	if qtype == DirQuota {
+		return m.fmtKey("QD", Ino(key))
+	}
+	return m.fmtKey(m.quotaPrefix(qtype), uint32(key))
+}
+
+func (m *kvMeta) dirStatKey(inode Ino) []byte {
+	return m.fmtKey("U", inode)
+}
+
+func (m *kvMeta) changeKey(id uint64) []byte {
+	return m.fmtKey("H", id)
+}
+
+func (m *kvMeta) invalidationKey(id uint64) []byte {
+	return m.fmtKey("N", id)
+}
+
+func (m *kvMeta) trashPathKey(inode Ino) []byte {
+	return m.fmtKey("T", inode)
+}
+
 func (m *kvMeta) encodeInode(ino Ino, buf []byte) {
 	binary.LittleEndian.PutUint64(buf, uint64(ino))
 }
@@ -335,13 +413,31 @@ func (m *kvMeta) Init(format Format, force bool) error {
 			old.AccessKey = format.AccessKey
 			old.SecretKey = format.SecretKey
 			old.EncryptKey = format.EncryptKey
+			old.EncryptKeyVersion = format.EncryptKeyVersion
+			old.OldEncryptKeys = format.OldEncryptKeys
 			old.KeyEncrypted = format.KeyEncrypted
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.ChangelogDays = format.ChangelogDays
+			old.CacheInvalidation = format.CacheInvalidation
+			if format.EnableACL { // ACL can be enabled but not disabled
+				old.EnableACL = true
+			}
+			if format.InlineSize > 0 { // inline data can be resized but not disabled
+				old.InlineSize = format.InlineSize
+			}
+			if format.PackSize > 0 { // packing can be resized but not disabled
+				old.PackSize = format.PackSize
+			}
+			if format.Dedup { // deduplication can be enabled but not disabled
+				old.Dedup = true
+			}
 			old.MinClientVersion = format.MinClientVersion
 			old.MaxClientVersion = format.MaxClientVersion
-			if format != old {
+			old.Tiers = format.Tiers
+			old.Replica = format.Replica
+			if !reflect.DeepEqual(format, old) {
 				old.RemoveSecret()
 				format.RemoveSecret()
 				return fmt.Errorf("cannot update format from %+v to %+v", old, format)
@@ -377,6 +473,7 @@ func (m *kvMeta) Init(format Format, force bool) error {
 		if body == nil || m.client.name() == "memkv" {
 			attr.Mode = 0777
 			tx.set(m.inodeKey(1), m.marshal(attr))
+			tx.set(m.dirStatKey(1), m.packDirStat(&dirStat{}))
 			tx.incrBy(m.counterKey("nextInode"), 2)
 			tx.incrBy(m.counterKey("nextChunk"), 1)
 		}
@@ -696,16 +793,21 @@ func (m *kvMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 }
 
 func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	inode = m.checkRoot(inode)
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return errno(m.txn(func(tx kvTxn) error {
+	var old Attr
+	err := m.txn(func(tx kvTxn) error {
 		var cur Attr
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
 			return syscall.ENOENT
 		}
 		m.parseAttr(a, &cur)
+		old = cur
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -758,15 +860,28 @@ func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			*attr = cur
 			return nil
 		}
+		if st := m.checkChownQuota(&old, &cur); st != 0 {
+			return st
+		}
 		cur.Ctime = now.Unix()
 		cur.Ctimensec = uint32(now.Nanosecond())
 		tx.set(m.inodeKey(inode), m.marshal(&cur))
 		*attr = cur
 		return nil
-	}))
+	})
+	if err == nil {
+		m.chownQuota(&old, attr)
+		if *attr != old {
+			m.recordChange(&Change{Op: ChangeSetAttr, Inode: inode, Parent: attr.Parent})
+		}
+	}
+	return errno(err)
 }
 
 func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := m.of.find(inode)
 	if f != nil {
@@ -774,7 +889,9 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		defer f.Unlock()
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	err := m.txn(func(tx kvTxn) error {
 		var t Attr
 		a := tx.get(m.inodeKey(inode))
@@ -791,9 +908,23 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 			}
 			return nil
 		}
+		newLength = int64(length) - int64(t.Length)
 		newSpace = align4K(length) - align4K(t.Length)
-		if newSpace > 0 && m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = t.Parent, t.Uid, t.Gid, t.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
+		}
+		if t.Flags&FlagInline != 0 && length < t.Length {
+			inline := tx.get(m.inlineKey(inode))
+			if uint64(len(inline)) > length {
+				inline = inline[:length]
+			}
+			if len(inline) > 0 {
+				tx.set(m.inlineKey(inode), inline)
+			} else {
+				t.Flags &^= FlagInline
+				tx.dels(m.inlineKey(inode))
+			}
 		}
 		var left, right = t.Length, length
 		if left > right {
@@ -828,11 +959,18 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeTruncate, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
 
 func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	if mode&fallocCollapesRange != 0 && mode != fallocCollapesRange {
 		return syscall.EINVAL
 	}
@@ -855,7 +993,9 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		defer f.Unlock()
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	err := m.txn(func(tx kvTxn) error {
 		var t Attr
 		a := tx.get(m.inodeKey(inode))
@@ -869,6 +1009,9 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if t.Typ != TypeFile {
 			return syscall.EPERM
 		}
+		if t.Flags&FlagInline != 0 {
+			return syscall.ENOTSUP
+		}
 		length := t.Length
 		if off+size > t.Length {
 			if mode&fallocKeepSize == 0 {
@@ -877,9 +1020,11 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		}
 
 		old := t.Length
+		newLength = int64(length) - int64(t.Length)
 		newSpace = align4K(length) - align4K(t.Length)
-		if newSpace > 0 && m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = t.Parent, t.Uid, t.Gid, t.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		t.Length = length
 		now := time.Now()
@@ -908,6 +1053,10 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
@@ -964,6 +1113,16 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		var access, dflt *acl.Rule
+		if pattr.Flags&FlagDefaultACL != 0 && _type != TypeSymlink {
+			def, err := m.getFacl(tx, parent, acl.TypeDefault)
+			if err != nil {
+				return err
+			}
+			if def != nil {
+				attr.Mode, attr.Flags, access, dflt = inheritFacl(def, _type, mode)
+			}
+		}
 
 		buf := tx.get(m.entryKey(parent, name))
 		var foundIno Ino
@@ -1019,6 +1178,15 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if _type == TypeSymlink {
 			tx.set(m.symKey(ino), []byte(path))
 		}
+		if _type == TypeDirectory && parent != TrashInode {
+			tx.set(m.dirStatKey(ino), m.packDirStat(&dirStat{}))
+		}
+		if access != nil {
+			tx.set(m.aclKey(ino, acl.TypeAccess), access.Encode())
+		}
+		if dflt != nil {
+			tx.set(m.aclKey(ino, acl.TypeDefault), dflt.Encode())
+		}
 		return nil
 	})
 	if err == nil {
@@ -1117,6 +1285,7 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 				newSpace, newInode = -align4K(0), -1
 			}
 			tx.dels(tx.scanKeys(m.xattrKey(inode, ""))...)
+			tx.dels(m.aclKey(inode, acl.TypeAccess), m.aclKey(inode, acl.TypeDefault))
 		}
 		return nil
 	})
@@ -1126,6 +1295,13 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		}
 		m.updateStats(newSpace, newInode)
 	}
+	if err == nil && attr.Nlink == 0 {
+		m.updateOwnerQuota(attr.Uid, attr.Gid, -align4K(attr.Length), -1)
+	}
+	if err == nil {
+		m.updateDirStat(ctx, parent, -int64(attr.Length), -align4K(attr.Length), -1, 0)
+		m.updateDirQuota(ctx, parent, -align4K(attr.Length), -1) // every entry (hard link) is counted
+	}
 	return errno(err)
 }
 
@@ -1191,8 +1367,9 @@ func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 			tx.set(m.inodeKey(inode), m.marshal(&attr))
 			tx.set(m.entryKey(trash, fmt.Sprintf("%d-%d-%s", parent, inode, name)), buf)
 		} else {
-			tx.dels(m.inodeKey(inode))
+			tx.dels(m.inodeKey(inode), m.dirStatKey(inode))
 			tx.dels(tx.scanKeys(m.xattrKey(inode, ""))...)
+			tx.dels(m.aclKey(inode, acl.TypeAccess), m.aclKey(inode, acl.TypeDefault))
 		}
 		return nil
 	})
@@ -1355,11 +1532,14 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 					} else {
 						if dtyp == TypeSymlink {
 							tx.dels(m.symKey(dino))
+						} else if dtyp == TypeDirectory {
+							tx.dels(m.dirStatKey(dino))
 						}
 						tx.dels(m.inodeKey(dino))
 						newSpace, newInode = -align4K(0), -1
 					}
 					tx.dels(tx.scanKeys(m.xattrKey(dino, ""))...)
+					tx.dels(m.aclKey(dino, acl.TypeAccess), m.aclKey(dino, acl.TypeDefault))
 				}
 			}
 		}
@@ -1521,6 +1701,7 @@ func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 	}
 	if cs, ok := m.of.ReadChunk(inode, indx); ok {
 		*chunks = cs
+		m.touchAtime(ctx, inode, nil)
 		return 0
 	}
 	defer timeit(time.Now())
@@ -1537,10 +1718,14 @@ func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 	if !m.conf.ReadOnly && (len(val)/sliceBytes >= 5 || len(*chunks) >= 5) {
 		go m.compactChunk(inode, indx, false)
 	}
+	m.touchAtime(ctx, inode, nil)
 	return 0
 }
 
 func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
 	f := m.of.find(inode)
 	if f != nil {
@@ -1548,7 +1733,9 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		defer f.Unlock()
 	}
 	defer func() { m.of.InvalidateChunk(inode, indx) }()
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	var needCompact bool
 	err := m.txn(func(tx kvTxn) error {
 		var attr Attr
@@ -1562,17 +1749,24 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
 		if newleng > attr.Length {
+			newLength = int64(newleng) - int64(attr.Length)
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = attr.Parent, attr.Uid, attr.Gid, attr.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
 		attr.Ctime = now.Unix()
 		attr.Ctimensec = uint32(now.Nanosecond())
+		if attr.Flags&FlagInline != 0 {
+			// the inline data is written into object storage by the client before this slice
+			attr.Flags &^= FlagInline
+			tx.dels(m.inlineKey(inode))
+		}
 		val := tx.append(m.chunkKey(inode, indx), marshalSlice(off, slice.Chunkid, slice.Size, slice.Off, slice.Len))
 		tx.set(m.inodeKey(inode), m.marshal(&attr))
 		needCompact = (len(val)/sliceBytes)%100 == 99
@@ -1583,13 +1777,106 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			go m.compactChunk(inode, indx, false)
 		}
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) ReadInline(ctx Context, inode Ino, attr *Attr, data *[]byte) syscall.Errno {
+	defer timeit(time.Now())
+	var a Attr
+	err := m.txn(func(tx kvTxn) error {
+		rs := tx.gets(m.inodeKey(inode), m.inlineKey(inode))
+		if rs[0] == nil {
+			return syscall.ENOENT
+		}
+		m.parseAttr(rs[0], &a)
+		if a.Flags&FlagInline == 0 {
+			return syscall.ENODATA
+		}
+		*data = rs[1]
+		return nil
+	})
+	if err == nil && attr != nil {
+		*attr = a
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) WriteInline(ctx Context, inode Ino, off uint64, data []byte) syscall.Errno {
+	if isSnapshot(inode) {
+		return syscall.EROFS
+	}
+	if off+uint64(len(data)) > uint64(m.fmt.InlineSize) {
+		return syscall.EFBIG
+	}
+	defer timeit(time.Now())
+	f := m.of.find(inode)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+	}
+	defer func() { m.of.InvalidateChunk(inode, 0) }()
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
+	err := m.txn(func(tx kvTxn) error {
+		var attr Attr
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		m.parseAttr(a, &attr)
+		if attr.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		var inline []byte
+		if attr.Flags&FlagInline != 0 {
+			inline = tx.get(m.inlineKey(inode))
+		} else if attr.Length > 0 || tx.exist(m.chunkKey(inode, 0)) {
+			return syscall.ENODATA
+		}
+		inline = writeInline(inline, off, data)
+		if newleng := off + uint64(len(data)); newleng > attr.Length {
+			newLength = int64(newleng) - int64(attr.Length)
+			newSpace = align4K(newleng) - align4K(attr.Length)
+			attr.Length = newleng
+		}
+		parent, uid, gid, nlink = attr.Parent, attr.Uid, attr.Gid, attr.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		attr.Flags |= FlagInline
+		tx.set(m.inlineKey(inode), inline)
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		return nil
+	})
+	if err == nil {
+		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: inode, Parent: parent})
 	}
 	return errno(err)
 }
 
 func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
+	if isSnapshot(fout) {
+		return syscall.EROFS
+	}
 	defer timeit(time.Now())
-	var newSpace int64
+	var newLength, newSpace int64
+	var parent Ino
+	var uid, gid, nlink uint32
 	f := m.of.find(fout)
 	if f != nil {
 		f.Lock()
@@ -1618,14 +1905,19 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if sattr.Flags&FlagInline != 0 || attr.Flags&FlagInline != 0 {
+			return syscall.ENOTSUP
+		}
 
 		newleng := offOut + size
 		if newleng > attr.Length {
+			newLength = int64(newleng) - int64(attr.Length)
 			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if m.checkQuota(newSpace, 0) {
-			return syscall.ENOSPC
+		parent, uid, gid, nlink = attr.Parent, attr.Uid, attr.Gid, attr.Nlink
+		if st := m.checkQuota(ctx, newSpace, 0, uid, gid, parent); st != 0 {
+			return st
 		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
@@ -1691,10 +1983,96 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.updateOwnerQuota(uid, gid, newSpace, 0)
+		m.updateDirStat(ctx, parent, newLength*int64(nlink), newSpace*int64(nlink), 0, 0)
+		m.recordChange(&Change{Op: ChangeWrite, Inode: fout, Parent: parent})
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) doCloneEntry(ctx Context, srcIno Ino, parent Ino, name string, ino Ino, attr *Attr, cmode uint8, cumask uint16) syscall.Errno {
+	err := m.txn(func(tx kvTxn) error {
+		rs := tx.gets(m.inodeKey(srcIno), m.inodeKey(parent))
+		if rs[0] == nil || rs[1] == nil {
+			return syscall.ENOENT
+		}
+		var pattr Attr
+		m.parseAttr(rs[0], attr)
+		m.parseAttr(rs[1], &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if tx.get(m.entryKey(parent, name)) != nil {
+			return syscall.EEXIST
+		}
+		cloneAttr(ctx, attr, parent, &pattr, cmode, cumask)
+
+		tx.set(m.entryKey(parent, name), m.packEntry(attr.Typ, ino))
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		tx.set(m.inodeKey(ino), m.marshal(attr))
+		switch attr.Typ {
+		case TypeFile:
+			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+				buf := tx.get(m.chunkKey(srcIno, indx))
+				if buf == nil {
+					continue
+				}
+				tx.set(m.chunkKey(ino, indx), buf)
+				for _, s := range readSliceBuf(buf) {
+					if s.chunkid > 0 {
+						tx.incrBy(m.sliceKey(s.chunkid, s.size), 1)
+					}
+				}
+			}
+			if attr.Flags&FlagInline != 0 {
+				if inline := tx.get(m.inlineKey(srcIno)); inline != nil {
+					tx.set(m.inlineKey(ino), inline)
+				}
+			}
+		case TypeSymlink:
+			if target := tx.get(m.symKey(srcIno)); target != nil {
+				tx.set(m.symKey(ino), target)
+			}
+		case TypeDirectory:
+			tx.set(m.dirStatKey(ino), m.packDirStat(&dirStat{}))
+		}
+		for k, v := range tx.scanValues(m.xattrKey(srcIno, ""), -1, nil) {
+			tx.set(m.xattrKey(ino, k[10:]), v) // "A" + inode + "X"
+		}
+		for _, t := range []uint8{acl.TypeAccess, acl.TypeDefault} {
+			if rule := tx.get(m.aclKey(srcIno, t)); rule != nil {
+				tx.set(m.aclKey(ino, t), rule)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		m.updateStats(align4K(attr.Length), 1)
 	}
 	return errno(err)
 }
 
+func (m *kvMeta) doInitSnapshotRoot() error {
+	return m.txn(func(tx kvTxn) error {
+		if tx.get(m.inodeKey(SnapshotInode)) != nil {
+			return nil
+		}
+		now := time.Now().Unix()
+		tx.set(m.inodeKey(SnapshotInode), m.marshal(&Attr{
+			Typ:    TypeDirectory,
+			Mode:   0555,
+			Atime:  now,
+			Mtime:  now,
+			Ctime:  now,
+			Nlink:  2,
+			Length: 4 << 10,
+			Parent: 1,
+		}))
+		return nil
+	})
+}
+
 func (m *kvMeta) doFindDeletedFiles(ts int64, limit int) (map[Ino]uint64, error) {
 	klen := 1 + 8 + 8
 	vals, err := m.scanValues(m.fmtKey("D"), limit, func(k, v []byte) bool {
@@ -1780,9 +2158,14 @@ func (m *kvMeta) doDeleteFileData(inode Ino, length uint64) {
 			return
 		}
 	}
-	_ = m.deleteKeys(m.delfileKey(inode, length))
+	_ = m.deleteKeys(m.inlineKey(inode), m.delfileKey(inode, length))
 }
 
+// maxCompactSlices limits the slices compacted in a transaction, which updates the reference counts of all of
+// them, so it fits in the limit of operations in a transaction of etcd (128 by default), the rest are compacted
+// in the next round.
+const maxCompactSlices = 100
+
 func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	if !force {
 		// avoid too many or duplicated compaction
@@ -1809,6 +2192,9 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	ss := readSliceBuf(buf)
 	skipped := skipSome(ss)
 	ss = ss[skipped:]
+	if len(ss) > maxCompactSlices {
+		ss = ss[:maxCompactSlices]
+	}
 	pos, size, chunks := compactChunk(ss)
 	if len(ss) < 2 || size == 0 {
 		return
@@ -1834,7 +2220,7 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 			return syscall.EINVAL
 		}
 
-		buf2 = append(append(buf2[:skipped*sliceBytes], marshalSlice(pos, chunkid, size, 0, size)...), buf2[len(buf):]...)
+		buf2 = append(append(buf2[:skipped*sliceBytes], marshalSlice(pos, chunkid, size, 0, size)...), buf2[(skipped+len(ss))*sliceBytes:]...)
 		tx.set(m.chunkKey(inode, indx), buf2)
 		// create the key to tracking it
 		tx.set(m.sliceKey(chunkid, size), make([]byte, 8))
@@ -1875,6 +2261,11 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	} else {
 		logger.Warnf("compact %d %d: %s", inode, indx, err)
 	}
+	if errno, ok := err.(syscall.Errno); force && (err == nil || ok && errno == syscall.EINVAL) {
+		// compact the rest (or try again) before returning, so the chunk is fully compacted once forced
+		m.compactChunk(inode, indx, force)
+		return
+	}
 	go func() {
 		// wait for the current compaction to finish
 		time.Sleep(time.Millisecond * 10)
@@ -1994,82 +2385,803 @@ func (m *kvMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errn
 	return errno(m.deleteKeys(m.xattrKey(inode, name)))
 }
 
-func (m *kvMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
-	e := &DumpedEntry{}
-	f := func(tx kvTxn) error {
+func (m *kvMeta) getFacl(tx kvTxn, inode Ino, aclType uint8) (*acl.Rule, error) {
+	buf := tx.get(m.aclKey(inode, aclType))
+	if buf == nil {
+		return nil, nil
+	}
+	return acl.Decode(buf)
+}
+
+func (m *kvMeta) doGetFacl(ctx Context, inode Ino, aclType uint8) (*acl.Rule, error) {
+	buf, err := m.get(m.aclKey(inode, aclType))
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return acl.Decode(buf)
+}
+
+func (m *kvMeta) doSetFacl(ctx Context, inode Ino, aclType uint8, rule *acl.Rule) syscall.Errno {
+	return errno(m.txn(func(tx kvTxn) error {
+		var attr Attr
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
-			logger.Warnf("inode %d not found", inode)
+			return syscall.ENOENT
 		}
-
-		attr := &Attr{Typ: typ, Nlink: 1}
-		m.parseAttr(a, attr)
-		e.Attr = dumpAttr(attr)
-		e.Attr.Inode = inode
-
-		vals := tx.scanValues(m.xattrKey(inode, ""), -1, nil)
-		if len(vals) > 0 {
-			xattrs := make([]*DumpedXattr, 0, len(vals))
-			for k, v := range vals {
-				xattrs = append(xattrs, &DumpedXattr{k[10:], string(v)}) // "A" + inode + "X"
-			}
-			sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
-			e.Xattrs = xattrs
+		m.parseAttr(a, &attr)
+		stored, st := prepareFacl(ctx, &attr, aclType, rule)
+		if st != 0 {
+			return st
 		}
-
-		if attr.Typ == TypeFile {
-			vals = tx.scanRange(m.chunkKey(inode, 0), m.chunkKey(inode, uint32(attr.Length/ChunkSize)+1))
-			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
-				v, ok := vals[string(m.chunkKey(inode, indx))]
-				if !ok {
-					continue
-				}
-				ss := readSliceBuf(v)
-				slices := make([]*DumpedSlice, 0, len(ss))
-				for _, s := range ss {
-					slices = append(slices, &DumpedSlice{Chunkid: s.chunkid, Pos: s.pos, Size: s.size, Off: s.off, Len: s.len})
-				}
-				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
-			}
-		} else if attr.Typ == TypeSymlink {
-			l := tx.get(m.symKey(inode))
-			if l == nil {
-				logger.Warnf("no link target for inode %d", inode)
-			}
-			e.Symlink = string(l)
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		if stored != nil {
+			tx.set(m.aclKey(inode, aclType), stored.Encode())
+		} else {
+			tx.dels(m.aclKey(inode, aclType))
 		}
 		return nil
+	}))
+}
+
+func (m *kvMeta) packQuota(q *Quota) []byte {
+	b := utils.NewBuffer(32)
+	b.Put64(uint64(q.MaxSpace))
+	b.Put64(uint64(q.MaxInodes))
+	b.Put64(uint64(q.UsedSpace))
+	b.Put64(uint64(q.UsedInodes))
+	return b.Bytes()
+}
+
+func (m *kvMeta) parseQuota(buf []byte) *Quota {
+	if len(buf) != 32 {
+		logger.Errorf("invalid quota value: %v", buf)
+		return &Quota{}
 	}
-	if m.snap != nil {
-		return e, m.snap.txn(f)
-	} else {
-		return e, m.txn(f)
+	b := utils.FromBuffer(buf)
+	return &Quota{
+		MaxSpace:   int64(b.Get64()),
+		MaxInodes:  int64(b.Get64()),
+		UsedSpace:  int64(b.Get64()),
+		UsedInodes: int64(b.Get64()),
 	}
 }
 
-func (m *kvMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth int, showProgress func(totalIncr, currentIncr int64)) error {
-	bwWrite := func(s string) {
-		if _, err := bw.WriteString(s); err != nil {
-			panic(err)
-		}
-	}
-	var vals map[string][]byte
-	var err error
-	if m.snap != nil {
-		err = m.snap.txn(func(tx kvTxn) error {
-			vals = tx.scanValues(m.entryKey(inode, ""), -1, nil)
-			return nil
-		})
-	} else {
-		vals, err = m.scanValues(m.entryKey(inode, ""), -1, nil)
+func (m *kvMeta) doGetQuota(qtype uint8, key uint64) (*Quota, error) {
+	buf, err := m.get(m.quotaKey(qtype, key))
+	if err != nil || buf == nil {
+		return nil, err
 	}
+	return m.parseQuota(buf), nil
+}
+
+func (m *kvMeta) doSetQuota(qtype uint8, key uint64, quota *Quota, usage bool) error {
+	return m.txn(func(tx kvTxn) error {
+		q := *quota
+		if buf := tx.get(m.quotaKey(qtype, key)); buf != nil && !usage {
+			old := m.parseQuota(buf)
+			q.UsedSpace, q.UsedInodes = old.UsedSpace, old.UsedInodes
+		}
+		tx.set(m.quotaKey(qtype, key), m.packQuota(&q))
+		return nil
+	})
+}
+
+func (m *kvMeta) doDelQuota(qtype uint8, key uint64) error {
+	return m.deleteKeys(m.quotaKey(qtype, key))
+}
+
+func (m *kvMeta) doLoadQuotas(qtype uint8) (map[uint64]*Quota, error) {
+	vals, err := m.scanValues(m.fmtKey(m.quotaPrefix(qtype)), -1, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if showProgress != nil {
+	quotas := make(map[uint64]*Quota, len(vals))
+	for k, v := range vals {
+		if qtype == DirQuota {
+			quotas[uint64(m.decodeInode([]byte(k[2:])))] = m.parseQuota(v)
+		} else {
+			quotas[uint64(utils.FromBuffer([]byte(k[2:])).Get32())] = m.parseQuota(v)
+		}
+	}
+	return quotas, nil
+}
+
+func (m *kvMeta) doFlushQuotas(qtype uint8, quotas map[uint64]*Quota) error {
+	return m.txn(func(tx kvTxn) error {
+		for key, q := range quotas {
+			buf := tx.get(m.quotaKey(qtype, key))
+			if buf == nil {
+				continue // removed
+			}
+			cur := m.parseQuota(buf)
+			cur.UsedSpace += q.newSpace
+			cur.UsedInodes += q.newInodes
+			tx.set(m.quotaKey(qtype, key), m.packQuota(cur))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) packDirStat(s *dirStat) []byte {
+	b := utils.NewBuffer(32)
+	b.Put64(uint64(s.length))
+	b.Put64(uint64(s.space))
+	b.Put64(uint64(s.files))
+	b.Put64(uint64(s.dirs))
+	return b.Bytes()
+}
+
+func (m *kvMeta) parseDirStat(buf []byte) *dirStat {
+	if len(buf) != 32 {
+		logger.Errorf("invalid directory statistics: %v", buf)
+		return &dirStat{}
+	}
+	b := utils.FromBuffer(buf)
+	return &dirStat{int64(b.Get64()), int64(b.Get64()), int64(b.Get64()), int64(b.Get64())}
+}
+
+func (m *kvMeta) doGetDirStat(inode Ino) (*dirStat, error) {
+	buf, err := m.get(m.dirStatKey(inode))
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return m.parseDirStat(buf), nil
+}
+
+func (m *kvMeta) doSetDirStats(stats map[Ino]*dirStat) error {
+	return m.txn(func(tx kvTxn) error {
+		for inode, s := range stats {
+			tx.set(m.dirStatKey(inode), m.packDirStat(s))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doFlushDirStats(stats map[Ino]*dirStat) error {
+	return m.txn(func(tx kvTxn) error {
+		for inode, s := range stats {
+			buf := tx.get(m.dirStatKey(inode))
+			if buf == nil {
+				continue // not maintained
+			}
+			cur := m.parseDirStat(buf)
+			cur.add(s)
+			tx.set(m.dirStatKey(inode), m.packDirStat(cur))
+		}
+		return nil
+	})
+}
+
+// the changes are written in small transactions, since some engines (etcd) limit the size of a transaction
+const kvChangeBatch = 100
+
+func (m *kvMeta) doAppendChanges(changes []*Change) error {
+	for len(changes) > 0 {
+		n := len(changes)
+		if n > kvChangeBatch {
+			n = kvChangeBatch
+		}
+		batch := changes[:n]
+		if err := m.txn(func(tx kvTxn) error {
+			last := uint64(tx.incrBy(m.counterKey(changeCounter), int64(n))) - uint64(n)
+			for i, c := range batch {
+				c.Id = last + uint64(i) + 1
+				tx.set(m.changeKey(c.Id), c.marshal())
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		changes = changes[n:]
+	}
+	return nil
+}
+
+func (m *kvMeta) doReadChanges(from uint64, limit int) ([]*Change, error) {
+	var vals map[string][]byte
+	err := m.client.txn(func(tx kvTxn) error {
+		vals = tx.scanRange(m.changeKey(from+1), m.changeKey(from+uint64(limit)+1))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]*Change, 0, len(vals))
+	for _, v := range vals {
+		c := &Change{}
+		if err = c.unmarshal(v); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Id < changes[j].Id })
+	return changes, nil
+}
+
+func (m *kvMeta) doDeleteChanges(from, to uint64) error {
+	for from < to {
+		end := from + kvChangeBatch
+		if end > to {
+			end = to
+		}
+		if err := m.txn(func(tx kvTxn) error {
+			keys := make([][]byte, 0, end-from)
+			for id := from + 1; id <= end; id++ {
+				keys = append(keys, m.changeKey(id))
+			}
+			tx.dels(keys...)
+			tx.set(m.counterKey(trimmedChanges), packCounter(int64(end)))
+			return nil
+		}); err != nil {
+			return err
+		}
+		from = end
+	}
+	return nil
+}
+
+func (m *kvMeta) doPublishInvalidations(msg []byte) error {
+	val := make([]byte, 8+len(msg)) // time + msg
+	binary.BigEndian.PutUint64(val, uint64(time.Now().Unix()))
+	copy(val[8:], msg)
+	return m.txn(func(tx kvTxn) error {
+		id := tx.incrBy(m.counterKey(invalidationCounter), 1)
+		tx.set(m.invalidationKey(uint64(id)), val)
+		return nil
+	})
+}
+
+func (m *kvMeta) doSubscribeInvalidations(handler func(msg []byte)) error {
+	last, err := m.getCounter(invalidationCounter)
+	if err != nil {
+		return err
+	}
+	for m.invalidationEnabled() {
+		time.Sleep(invalidationInterval)
+		cur, err := m.getCounter(invalidationCounter)
+		if err != nil {
+			return err
+		}
+		if cur > last {
+			var vals map[string][]byte
+			if err = m.client.txn(func(tx kvTxn) error {
+				vals = tx.scanRange(m.invalidationKey(uint64(last+1)), m.invalidationKey(uint64(cur+1)))
+				return nil
+			}); err != nil {
+				return err
+			}
+			keys := make([]string, 0, len(vals))
+			for k := range vals {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if v := vals[k]; len(v) >= 8 {
+					handler(v[8:])
+				}
+			}
+			last = cur
+		}
+		if ok, err := m.setIfSmall("lastCleanupInvalidations", time.Now().Unix(), int64(invalidationTTL.Seconds())); err != nil {
+			logger.Warnf("checking counter lastCleanupInvalidations: %s", err)
+		} else if ok {
+			m.cleanupInvalidations()
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) cleanupInvalidations() {
+	edge := uint64(time.Now().Add(-invalidationTTL).Unix())
+	vals, err := m.scanValues(m.fmtKey("N"), -1, func(k, v []byte) bool {
+		return len(v) < 8 || binary.BigEndian.Uint64(v) < edge
+	})
+	if err != nil {
+		logger.Warnf("scan invalidations: %s", err)
+		return
+	}
+	keys := make([][]byte, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, []byte(k))
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > kvChangeBatch {
+			n = kvChangeBatch
+		}
+		if err = m.deleteKeys(keys[:n]...); err != nil {
+			logger.Warnf("remove expired invalidations: %s", err)
+			return
+		}
+		keys = keys[n:]
+	}
+}
+
+func (m *kvMeta) doScanMeta(v *metaVisitor) error {
+	v.implicitRef = true
+	return m.client.txn(func(tx kvTxn) error {
+		// AiiiiiiiiI    inode attribute
+		// AiiiiiiiiD... dentry
+		// AiiiiiiiiCnnnn file chunks
+		tx.scan(m.fmtKey("A"), func(k, value []byte) {
+			if len(k) < 10 {
+				return
+			}
+			inode := m.decodeInode(k[1:9])
+			switch k[9] {
+			case 'I':
+				if len(k) == 10 {
+					var attr Attr
+					m.parseAttr(value, &attr)
+					v.node(inode, &attr)
+				}
+			case 'D':
+				typ, ino := m.parseEntry(value)
+				v.edge(inode, string(k[10:]), ino, typ)
+			case 'C':
+				if len(k) == 14 {
+					v.chunk(inode, binary.BigEndian.Uint32(k[10:]), readSliceBuf(value))
+				}
+			}
+		})
+		// Kccccccccnnnn slice refs
+		tx.scan(m.fmtKey("K"), func(k, value []byte) {
+			if len(k) == 1+8+4 && len(value) == 8 {
+				rb := utils.FromBuffer(k[1:])
+				v.sliceRef(rb.Get64(), rb.Get32(), parseCounter(value)+1)
+			}
+		})
+		return nil
+	})
+}
+
+func (m *kvMeta) doSetEntry(parent Ino, name string, inode Ino, typ uint8) error {
+	return m.txn(func(tx kvTxn) error {
+		if inode == 0 {
+			tx.dels(m.entryKey(parent, name))
+		} else {
+			tx.set(m.entryKey(parent, name), m.packEntry(typ, inode))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doSetNlink(inode Ino, nlink uint32, parent Ino) error {
+	return m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		var attr Attr
+		m.parseAttr(a, &attr)
+		attr.Nlink = nlink
+		if parent > 0 {
+			attr.Parent = parent
+		}
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		return nil
+	})
+}
+
+func (m *kvMeta) doAppendSlice(inode Ino, indx uint32, buf []byte) error {
+	return m.txn(func(tx kvTxn) error {
+		tx.append(m.chunkKey(inode, indx), buf)
+		return nil
+	})
+}
+
+func (m *kvMeta) doSetSliceRefs(chunkid uint64, size uint32, refs int64) error {
+	return m.txn(func(tx kvTxn) error {
+		if refs == 1 {
+			tx.dels(m.sliceKey(chunkid, size))
+		} else {
+			tx.set(m.sliceKey(chunkid, size), packCounter(refs-1))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doSetTrashPath(inode Ino, parent Ino, path string) error {
+	if path == "" {
+		return m.deleteKeys(m.trashPathKey(inode))
+	}
+	return m.txn(func(tx kvTxn) error {
+		tx.set(m.trashPathKey(inode), marshalTrashPath(parent, path))
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetTrashPath(inode Ino) (Ino, string, error) {
+	buf, err := m.get(m.trashPathKey(inode))
+	if err != nil || buf == nil {
+		return 0, "", err
+	}
+	parent, path := unmarshalTrashPath(buf)
+	return parent, path, nil
+}
+
+func (m *kvMeta) doFlushAtimes(atimes map[Ino]int64) error {
+	keys := make([][]byte, 0, len(atimes))
+	inodes := make([]Ino, 0, len(atimes))
+	for inode := range atimes {
+		keys = append(keys, m.inodeKey(inode))
+		inodes = append(inodes, inode)
+	}
+	return m.txn(func(tx kvTxn) error {
+		for i, buf := range tx.gets(keys...) {
+			if buf == nil {
+				continue
+			}
+			var attr Attr
+			m.parseAttr(buf, &attr)
+			ts := atimes[inodes[i]]
+			if unixNano(attr.Atime, attr.Atimensec) >= ts {
+				continue
+			}
+			attr.Atime, attr.Atimensec = ts/1e9, uint32(ts%1e9)
+			tx.set(keys[i], m.marshal(&attr))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) marshalPack(p *Pack) []byte {
+	b := utils.NewBuffer(8)
+	b.Put32(p.Size)
+	b.Put32(p.Live)
+	return b.Bytes()
+}
+
+func (m *kvMeta) parsePack(id uint64, buf []byte) *Pack {
+	rb := utils.ReadBuffer(buf)
+	return &Pack{Id: id, Size: rb.Get32(), Live: rb.Get32()}
+}
+
+func (m *kvMeta) doAddPack(pack *Pack, slices []PackedSlice) error {
+	return m.txn(func(tx kvTxn) error {
+		for i := range slices {
+			tx.set(m.packedKey(slices[i].Chunkid), marshalPacked(&slices[i]))
+		}
+		tx.set(m.packKey(pack.Id), m.marshalPack(pack))
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetPacked(chunkid uint64, s *PackedSlice) syscall.Errno {
+	buf, err := m.get(m.packedKey(chunkid))
+	if err != nil {
+		return errno(err)
+	}
+	if len(buf) != 16 {
+		return syscall.ENOENT
+	}
+	unmarshalPacked(chunkid, buf, s)
+	return 0
+}
+
+func (m *kvMeta) doDeletePacked(chunkid uint64, size uint32) (uint64, error) {
+	key := m.packedKey(chunkid)
+	var deleted uint64
+	err := m.txn(func(tx kvTxn) error {
+		deleted = 0
+		buf := tx.get(key)
+		if len(buf) != 16 {
+			return syscall.ENOENT
+		}
+		var s PackedSlice
+		unmarshalPacked(chunkid, buf, &s)
+		tx.dels(key, m.sliceKey(chunkid, size))
+		pkey := m.packKey(s.Pack)
+		pbuf := tx.get(pkey)
+		if len(pbuf) != 8 {
+			return nil
+		}
+		p := m.parsePack(s.Pack, pbuf)
+		if p.Live <= s.Len {
+			tx.dels(pkey)
+			deleted = s.Pack
+		} else {
+			p.Live -= s.Len
+			tx.set(pkey, m.marshalPack(p))
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (m *kvMeta) doListPacks() ([]*Pack, error) {
+	vals, err := m.scanValues(m.fmtKey("O"), -1, func(k, v []byte) bool {
+		return len(k) == 9 && len(v) == 8
+	})
+	if err != nil {
+		return nil, err
+	}
+	packs := make([]*Pack, 0, len(vals))
+	for k, v := range vals {
+		packs = append(packs, m.parsePack(binary.BigEndian.Uint64([]byte(k)[1:]), v))
+	}
+	return packs, nil
+}
+
+func (m *kvMeta) doListPacked(fn func(s *PackedSlice)) error {
+	vals, err := m.scanValues(m.fmtKey("J"), -1, func(k, v []byte) bool {
+		return len(k) == 9 && len(v) == 16
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range vals {
+		var s PackedSlice
+		unmarshalPacked(binary.BigEndian.Uint64([]byte(k)[1:]), v, &s)
+		fn(&s)
+	}
+	return nil
+}
+
+func (m *kvMeta) doRepack(old uint64, pack *Pack, slices []PackedSlice) error {
+	keys := make([][]byte, 0, len(slices))
+	for i := range slices {
+		keys = append(keys, m.packedKey(slices[i].Chunkid))
+	}
+	return m.txn(func(tx kvTxn) error {
+		pack.Live = 0
+		for i, buf := range tx.gets(keys...) {
+			var cur PackedSlice
+			if len(buf) == 16 {
+				unmarshalPacked(slices[i].Chunkid, buf, &cur)
+			}
+			if cur.Pack == old {
+				tx.set(keys[i], marshalPacked(&slices[i]))
+				pack.Live += slices[i].Len
+			}
+		}
+		if pack.Live > 0 {
+			tx.set(m.packKey(pack.Id), m.marshalPack(pack))
+		}
+		tx.dels(m.packKey(old))
+		return nil
+	})
+}
+
+func (m *kvMeta) doRefBlock(hash []byte, b *Block, owner *Block) syscall.Errno {
+	key := m.dedupKey(hash)
+	return errno(m.txn(func(tx kvTxn) error {
+		buf := tx.get(key)
+		if len(buf) != 20 {
+			return syscall.ENOENT
+		}
+		refs := unmarshalBlock(buf, owner)
+		tx.set(key, marshalBlock(owner, refs+1))
+		tx.set(m.blockRefKey(b.Chunkid, b.Indx), hash)
+		return nil
+	}))
+}
+
+func (m *kvMeta) doAddBlock(hash []byte, b *Block) syscall.Errno {
+	key := m.dedupKey(hash)
+	return errno(m.txn(func(tx kvTxn) error {
+		if tx.get(key) != nil {
+			return syscall.EEXIST
+		}
+		tx.set(key, marshalBlock(b, 1))
+		tx.set(m.blockRefKey(b.Chunkid, b.Indx), hash)
+		return nil
+	}))
+}
+
+func (m *kvMeta) doFindBlock(chunkid uint64, indx uint32, owner *Block) syscall.Errno {
+	hash, err := m.get(m.blockRefKey(chunkid, indx))
+	if err != nil {
+		return errno(err)
+	}
+	if hash == nil {
+		return syscall.ENOENT
+	}
+	buf, err := m.get(m.dedupKey(hash))
+	if err != nil {
+		return errno(err)
+	}
+	if len(buf) != 20 {
+		return syscall.ENOENT
+	}
+	unmarshalBlock(buf, owner)
+	return 0
+}
+
+func (m *kvMeta) doDerefSlice(chunkid uint64, size uint32, blocks []Block) ([]Block, error) {
+	keys := make([][]byte, 0, len(blocks))
+	for _, b := range blocks {
+		keys = append(keys, m.blockRefKey(b.Chunkid, b.Indx))
+	}
+	var todel []Block
+	err := m.txn(func(tx kvTxn) error {
+		var refs [][]byte
+		if len(keys) > 0 {
+			refs = tx.gets(keys...)
+		}
+		owners := make(map[string]*Block)
+		counts := make(map[string]uint32)
+		for _, h := range refs {
+			if h == nil {
+				continue
+			}
+			if _, ok := owners[string(h)]; ok {
+				continue
+			}
+			if buf := tx.get(m.dedupKey(h)); len(buf) == 20 {
+				var owner Block
+				counts[string(h)] = unmarshalBlock(buf, &owner)
+				owners[string(h)] = &owner
+			}
+		}
+		todel = derefBlocks(blocks, refs, owners, counts)
+		for h, owner := range owners {
+			if n, ok := counts[h]; ok {
+				tx.set(m.dedupKey([]byte(h)), marshalBlock(owner, n))
+			} else {
+				tx.dels(m.dedupKey([]byte(h)))
+			}
+		}
+		tx.dels(append(keys, m.sliceKey(chunkid, size))...)
+		return nil
+	})
+	return todel, err
+}
+
+func (m *kvMeta) doListDedup(fn func(hash []byte, owner *Block, refs uint32)) error {
+	vals, err := m.scanValues(m.fmtKey("W"), -1, func(k, v []byte) bool {
+		return len(k) == 33 && len(v) == 20
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range vals {
+		var owner Block
+		refs := unmarshalBlock(v, &owner)
+		fn([]byte(k)[1:], &owner, refs)
+	}
+	return nil
+}
+
+func (m *kvMeta) doListBlockRefs(fn func(b *Block, hash []byte)) error {
+	vals, err := m.scanValues(m.fmtKey("V"), -1, func(k, v []byte) bool {
+		return len(k) == 13
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range vals {
+		b := []byte(k)
+		fn(&Block{Chunkid: binary.BigEndian.Uint64(b[1:9]), Indx: binary.BigEndian.Uint32(b[9:])}, v)
+	}
+	return nil
+}
+
+func (m *kvMeta) doSetDedup(hash []byte, owner *Block, refs []Block) error {
+	return m.txn(func(tx kvTxn) error {
+		tx.set(m.dedupKey(hash), marshalBlock(owner, uint32(len(refs))))
+		for _, b := range refs {
+			tx.set(m.blockRefKey(b.Chunkid, b.Indx), hash)
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doSetSliceTier(chunkid uint64, tier uint8) error {
+	return m.txn(func(tx kvTxn) error {
+		if tier == 0 {
+			tx.dels(m.sliceTierKey(chunkid))
+		} else {
+			tx.set(m.sliceTierKey(chunkid), []byte{tier})
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doGetSliceTier(chunkid uint64) (uint8, error) {
+	buf, err := m.get(m.sliceTierKey(chunkid))
+	if err != nil || len(buf) != 1 {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (m *kvMeta) doListSliceTiers(fn func(chunkid uint64, tier uint8)) error {
+	vals, err := m.scanValues(m.fmtKey("G"), -1, func(k, v []byte) bool {
+		return len(k) == 9 && len(v) == 1
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range vals {
+		fn(binary.BigEndian.Uint64([]byte(k)[1:]), v[0])
+	}
+	return nil
+}
+
+func (m *kvMeta) dumpEntry(inode Ino, typ uint8) (*DumpedEntry, error) {
+	e := &DumpedEntry{}
+	f := func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			logger.Warnf("inode %d not found", inode)
+		}
+
+		attr := &Attr{Typ: typ, Nlink: 1}
+		m.parseAttr(a, attr)
+		e.Attr = dumpAttr(attr)
+		e.Attr.Inode = inode
+
+		vals := tx.scanValues(m.xattrKey(inode, ""), -1, nil)
+		if len(vals) > 0 {
+			xattrs := make([]*DumpedXattr, 0, len(vals))
+			for k, v := range vals {
+				xattrs = append(xattrs, &DumpedXattr{k[10:], string(v)}) // "A" + inode + "X"
+			}
+			sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+			e.Xattrs = xattrs
+		}
+		if attr.Flags&(FlagAccessACL|FlagDefaultACL) != 0 {
+			var err error
+			if e.AccessACL, err = m.getFacl(tx, inode, acl.TypeAccess); err != nil {
+				logger.Warnf("Corrupt ACL of inode %d: %s", inode, err)
+			}
+			if e.DefaultACL, err = m.getFacl(tx, inode, acl.TypeDefault); err != nil {
+				logger.Warnf("Corrupt ACL of inode %d: %s", inode, err)
+			}
+		}
+
+		if attr.Typ == TypeFile {
+			vals = tx.scanRange(m.chunkKey(inode, 0), m.chunkKey(inode, uint32(attr.Length/ChunkSize)+1))
+			for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+				v, ok := vals[string(m.chunkKey(inode, indx))]
+				if !ok {
+					continue
+				}
+				ss := readSliceBuf(v)
+				slices := make([]*DumpedSlice, 0, len(ss))
+				for _, s := range ss {
+					slices = append(slices, &DumpedSlice{Chunkid: s.chunkid, Pos: s.pos, Size: s.size, Off: s.off, Len: s.len})
+				}
+				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
+			}
+			if attr.Flags&FlagInline != 0 {
+				e.Inline = tx.get(m.inlineKey(inode))
+			}
+		} else if attr.Typ == TypeSymlink {
+			l := tx.get(m.symKey(inode))
+			if l == nil {
+				logger.Warnf("no link target for inode %d", inode)
+			}
+			e.Symlink = string(l)
+		}
+		return nil
+	}
+	if m.snap != nil {
+		return e, m.snap.txn(f)
+	} else {
+		return e, m.txn(f)
+	}
+}
+
+func (m *kvMeta) dumpDir(inode Ino, tree *DumpedEntry, dw dumpWriter, depth int, showProgress func(totalIncr, currentIncr int64)) error {
+	var vals map[string][]byte
+	var err error
+	if m.snap != nil {
+		err = m.snap.txn(func(tx kvTxn) error {
+			vals = tx.scanValues(m.entryKey(inode, ""), -1, nil)
+			return nil
+		})
+	} else {
+		vals, err = m.scanValues(m.entryKey(inode, ""), -1, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if showProgress != nil {
 		showProgress(int64(len(vals)), 0)
 	}
-	if err = tree.writeJsonWithOutEntry(bw, depth); err != nil {
+	if err = dw.beginDir(tree, depth); err != nil {
 		return err
 	}
 	var sortedName []string
@@ -2078,7 +3190,7 @@ func (m *kvMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth i
 	}
 	sort.Slice(sortedName, func(i, j int) bool { return sortedName[i][10:] < sortedName[j][10:] })
 
-	for idx, name := range sortedName {
+	for _, name := range sortedName {
 		typ, inode := m.parseEntry(vals[name])
 		var entry *DumpedEntry
 		entry, err = m.dumpEntry(inode, typ)
@@ -2087,25 +3199,21 @@ func (m *kvMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth i
 		}
 		entry.Name = name[10:]
 		if typ == TypeDirectory {
-			err = m.dumpDir(inode, entry, bw, depth+2, showProgress)
+			err = m.dumpDir(inode, entry, dw, depth+2, showProgress)
 		} else {
-			err = entry.writeJSON(bw, depth+2)
+			err = dw.writeEntry(entry, depth+2)
 		}
 		if err != nil {
 			return err
 		}
-		if idx != len(vals)-1 {
-			bwWrite(",")
-		}
 		if showProgress != nil {
 			showProgress(0, 1)
 		}
 	}
-	bwWrite(fmt.Sprintf("\n%s}\n%s}", strings.Repeat(jsonIndent, depth+1), strings.Repeat(jsonIndent, depth)))
-	return nil
+	return dw.endDir(depth)
 }
 
-func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
+func (m *kvMeta) DumpMeta(w io.Writer, root Ino, format DumpFormat) (err error) {
 	defer func() {
 		if p := recover(); p != nil {
 			if e, ok := p.(error); ok {
@@ -2235,11 +3343,20 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		Sustained: sessions,
 		DelFiles:  dels,
 	}
+	if dm.Packs, err = m.dumpPacks(); err != nil {
+		return err
+	}
+	if dm.Dedup, err = m.dumpDedup(); err != nil {
+		return err
+	}
+	if dm.Tiers, err = m.dumpSliceTiers(); err != nil {
+		return err
+	}
 	if dm.Setting.SecretKey != "" {
 		dm.Setting.SecretKey = "removed"
 		logger.Warnf("Secret key is removed for the sake of safety")
 	}
-	bw, err := dm.writeJsonWithOutTree(w)
+	dw, err := newDumpWriter(w, &dm, format)
 	if err != nil {
 		return err
 	}
@@ -2255,184 +3372,145 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		bar.IncrTotal(totalIncr)
 		bar.IncrInt64(currentIncr)
 	}
-	if err = m.dumpDir(root, tree, bw, 1, showProgress); err != nil {
+	if err = m.dumpDir(root, tree, dw, 1, showProgress); err != nil {
 		return err
 	}
 	if trash != nil {
-		if _, err = bw.WriteString(","); err != nil {
-			return err
-		}
-		if err = m.dumpDir(TrashInode, trash, bw, 1, showProgress); err != nil {
+		if err = m.dumpDir(TrashInode, trash, dw, 1, showProgress); err != nil {
 			return err
 		}
 	}
-	if _, err = bw.WriteString("\n}\n"); err != nil {
+	if err = dw.finish(); err != nil {
 		return err
 	}
 	progress.Done()
 	m.snap = nil
+	return nil
+}
 
-	return bw.Flush()
+func (m *kvMeta) doLoadStart() (uint64, error) {
+	var loaded uint64
+	err := m.txn(func(tx kvTxn) error {
+		if !tx.exist(m.fmtKey()) {
+			tx.set(m.counterKey(loadedEntries), packCounter(0))
+			return nil
+		}
+		buf := tx.get(m.counterKey(loadedEntries))
+		if buf == nil || tx.get(m.fmtKey("setting")) != nil {
+			return fmt.Errorf("Database %s is not empty", m.Name())
+		}
+		loaded = uint64(parseCounter(buf))
+		return nil
+	})
+	return loaded, err
 }
 
-func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]int64) error {
-	inode := e.Attr.Inode
-	logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
-	attr := loadAttr(e.Attr)
-	attr.Parent = e.Parent
+func (m *kvMeta) doLoadEntries(b *loadBatch) error {
 	return m.txn(func(tx kvTxn) error {
-		if attr.Typ == TypeFile {
-			attr.Length = e.Attr.Length
-			for _, c := range e.Chunks {
-				if len(c.Slices) == 0 {
-					continue
-				}
-				slices := make([]byte, 0, sliceBytes*len(c.Slices))
-				for _, s := range c.Slices {
-					slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
-					m.Lock()
-					refs[string(m.sliceKey(s.Chunkid, s.Size))]++
-					m.Unlock()
-					if cs.NextChunk <= int64(s.Chunkid) {
-						cs.NextChunk = int64(s.Chunkid) + 1
+		for _, e := range b.entries {
+			inode := e.Attr.Inode
+			logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
+			attr := loadAttr(e.Attr)
+			attr.Parent = e.Parent
+			switch attr.Typ {
+			case TypeFile:
+				attr.Length = e.Attr.Length
+				for _, c := range e.Chunks {
+					if len(c.Slices) == 0 {
+						continue
 					}
+					slices := make([]byte, 0, sliceBytes*len(c.Slices))
+					for _, s := range c.Slices {
+						slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
+					}
+					tx.set(m.chunkKey(inode, c.Index), slices)
+				}
+				if len(e.Inline) > 0 {
+					tx.set(m.inlineKey(inode), e.Inline)
 				}
-				tx.set(m.chunkKey(inode, c.Index), slices)
+			case TypeDirectory:
+				attr.Length = 4 << 10
+			case TypeSymlink:
+				attr.Length = uint64(len(e.Symlink))
+				tx.set(m.symKey(inode), []byte(e.Symlink))
 			}
-		} else if attr.Typ == TypeDirectory {
-			attr.Length = 4 << 10
-			for _, c := range e.Entries {
-				tx.set(m.entryKey(inode, c.Name), m.packEntry(typeFromString(c.Attr.Type), c.Attr.Inode))
+			for _, x := range e.Xattrs {
+				tx.set(m.xattrKey(inode, x.Name), []byte(x.Value))
 			}
-		} else if attr.Typ == TypeSymlink {
-			attr.Length = uint64(len(e.Symlink))
-			tx.set(m.symKey(inode), []byte(e.Symlink))
-		}
-		if inode > 1 && inode != TrashInode {
-			cs.UsedSpace += align4K(attr.Length)
-			cs.UsedInodes += 1
-		}
-		if inode < TrashInode {
-			if cs.NextInode <= int64(inode) {
-				cs.NextInode = int64(inode) + 1
+			attr.Flags = loadFacl(e)
+			if attr.Typ == TypeFile && len(e.Inline) > 0 {
+				attr.Flags |= FlagInline
 			}
-		} else {
-			if cs.NextTrash < int64(inode)-TrashInode {
-				cs.NextTrash = int64(inode) - TrashInode
+			if e.AccessACL != nil {
+				tx.set(m.aclKey(inode, acl.TypeAccess), e.AccessACL.Encode())
+			}
+			if e.DefaultACL != nil {
+				tx.set(m.aclKey(inode, acl.TypeDefault), e.DefaultACL.Encode())
+			}
+			tx.set(m.inodeKey(inode), m.marshal(attr))
+			if inode != 1 && inode != TrashInode {
+				tx.set(m.entryKey(e.Parent, e.Name), m.packEntry(attr.Typ, inode))
 			}
 		}
-
-		for _, x := range e.Xattrs {
-			tx.set(m.xattrKey(inode, x.Name), []byte(x.Value))
+		for _, e := range b.links {
+			tx.set(m.entryKey(e.Parent, e.Name), m.packEntry(TypeFile, e.Attr.Inode))
 		}
-		tx.set(m.inodeKey(inode), m.marshal(attr))
+		for k, v := range b.slices {
+			tx.incrBy(m.fmtKey("L", k.id, k.size), v)
+		}
+		tx.set(m.counterKey(loadedEntries), packCounter(int64(b.loaded)))
 		return nil
 	})
 }
 
-func (m *kvMeta) LoadMeta(r io.Reader) error {
-	var exist bool
-	err := m.txn(func(tx kvTxn) error {
-		exist = tx.exist(m.fmtKey())
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-	if exist {
-		return fmt.Errorf("Database %s is not empty", m.Name())
-	}
-
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err := dec.Decode(dm); err != nil {
-		return err
-	}
+func (m *kvMeta) doLoadFinish(dm *DumpedMeta, cs *DumpedCounters, nlinks map[Ino]uint32) error {
 	format, err := json.MarshalIndent(dm.Setting, "", "")
 	if err != nil {
 		return err
 	}
-
-	progress := utils.NewProgress(false, false)
-	bar := progress.AddCountBar("Collected entries", 1) // with root
-	showProgress := func(totalIncr, currentIncr int64) {
-		bar.IncrTotal(totalIncr)
-		bar.IncrInt64(currentIncr)
-	}
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, showProgress); err != nil {
-		return err
-	}
-	if dm.Trash != nil {
-		bar.IncrTotal(1)
-		if err = collectEntry(dm.Trash, entries, showProgress); err != nil {
+	// move the slice references, only the extra ones are kept
+	for done := false; !done; {
+		err = m.txn(func(tx kvTxn) error {
+			refs := tx.scanValues(m.fmtKey("L"), 1000, nil)
+			for k, v := range refs {
+				key := []byte(k)
+				if n := parseCounter(v); n > 1 {
+					tx.set(append([]byte("K"), key[1:]...), packCounter(n-1))
+				}
+				tx.dels(key)
+			}
+			done = len(refs) == 0
+			return nil
+		})
+		if err != nil {
 			return err
 		}
 	}
-	bar.Done()
-
-	counters := &DumpedCounters{
-		NextInode: 2,
-		NextChunk: 1,
-	}
-	refs := make(map[string]int64)
-	bar = progress.AddCountBar("Loaded entries", int64(len(entries)))
-	maxNum := 100
-	pool := make(chan struct{}, maxNum)
-	errCh := make(chan error, 100)
-	done := make(chan struct{}, 1)
-	var wg sync.WaitGroup
-	for _, entry := range entries {
-		select {
-		case err = <-errCh:
+	for inode, n := range nlinks {
+		err = m.txn(func(tx kvTxn) error {
+			var attr Attr
+			m.parseAttr(tx.get(m.inodeKey(inode)), &attr)
+			attr.Nlink = n
+			tx.set(m.inodeKey(inode), m.marshal(&attr))
+			return nil
+		})
+		if err != nil {
 			return err
-		default:
 		}
-		pool <- struct{}{}
-		wg.Add(1)
-		go func(entry *DumpedEntry) {
-			defer func() {
-				wg.Done()
-				bar.Increment()
-				<-pool
-			}()
-			if err = m.loadEntry(entry, counters, refs); err != nil {
-				errCh <- err
-			}
-		}(entry)
-	}
-
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case err = <-errCh:
-		return err
-	case <-done:
 	}
-	progress.Done()
-	logger.Infof("Dumped counters: %+v", *dm.Counters)
-	logger.Infof("Loaded counters: %+v", *counters)
 
 	return m.txn(func(tx kvTxn) error {
 		tx.set(m.fmtKey("setting"), format)
-		tx.set(m.counterKey(usedSpace), packCounter(counters.UsedSpace))
-		tx.set(m.counterKey(totalInodes), packCounter(counters.UsedInodes))
-		tx.set(m.counterKey("nextInode"), packCounter(counters.NextInode))
-		tx.set(m.counterKey("nextChunk"), packCounter(counters.NextChunk))
-		tx.set(m.counterKey("nextSession"), packCounter(counters.NextSession))
-		tx.set(m.counterKey("nextTrash"), packCounter(counters.NextTrash))
+		tx.set(m.counterKey(usedSpace), packCounter(cs.UsedSpace))
+		tx.set(m.counterKey(totalInodes), packCounter(cs.UsedInodes))
+		tx.set(m.counterKey("nextInode"), packCounter(cs.NextInode))
+		tx.set(m.counterKey("nextChunk"), packCounter(cs.NextChunk))
+		tx.set(m.counterKey("nextSession"), packCounter(cs.NextSession))
+		tx.set(m.counterKey("nextTrash"), packCounter(cs.NextTrash))
 		for _, d := range dm.DelFiles {
 			tx.set(m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire))
 		}
-		for k, v := range refs {
-			if v > 1 {
-				tx.set([]byte(k), packCounter(v-1))
-			}
-		}
+		tx.dels(m.counterKey(loadedEntries))
 		return nil
 	})
 }
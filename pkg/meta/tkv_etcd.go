@@ -0,0 +1,357 @@
+//go:build !noetcd
+// +build !noetcd
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+func init() {
+	Register("etcd", newKVMeta)
+	drivers["etcd"] = newEtcdClient
+}
+
+// etcd has no interactive transactions, so the reads in a transaction are served from a snapshot
+// (the revision of the first read), and the writes are buffered and committed in a single etcd
+// transaction, which succeeds only if none of the keys (or ranges) read has been changed since then.
+var errEtcdConflict = errors.New("etcd transaction conflict")
+
+// etcd limits the number of operations in a transaction (--max-txn-ops, 128 by default), the reads are
+// split into batches, but the writes can't be, so a transaction with more writes fails without retry.
+const etcdBatchSize = 128
+
+func newEtcdClient(addr string) (tkvClient, error) {
+	var user, passwd string
+	if p := strings.LastIndex(addr, "@"); p >= 0 {
+		user = addr[:p]
+		addr = addr[p+1:]
+		if p := strings.Index(user, ":"); p >= 0 {
+			passwd = user[p+1:]
+			user = user[:p]
+		}
+	}
+	var prefix string
+	if p := strings.Index(addr, "/"); p > 0 {
+		prefix = addr[p+1:]
+		addr = addr[:p]
+	}
+	var lvl = "warn" // etcd uses uber-zap logging, make it less verbose
+	if logger.IsLevelEnabled(logrus.DebugLevel) {
+		lvl = "info"
+	}
+	lc := zap.NewProductionConfig()
+	if err := lc.Level.UnmarshalText([]byte(lvl)); err != nil {
+		return nil, err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:         strings.Split(addr, ","),
+		Username:          user,
+		Password:          passwd,
+		DialTimeout:       time.Second * 5,
+		DialKeepAliveTime: time.Second * 30,
+		LogConfig:         &lc,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the requests are retried forever if etcd is not reachable, so check it in advance
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err = client.Get(ctx, prefix, clientv3.WithCountOnly()); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return withPrefix(&etcdClient{client}, append([]byte(prefix), 0xFD)), nil
+}
+
+type etcdTxn struct {
+	ctx      context.Context
+	kv       clientv3.KV
+	rev      int64             // the revision of snapshot, 0 before the first read
+	observed map[string]int64  // the mod revisions of keys read
+	ranges   [][2]string       // the ranges scanned
+	buffer   map[string][]byte // the pending writes, nil for deleted
+}
+
+func (tx *etcdTxn) withRev(opts ...clientv3.OpOption) []clientv3.OpOption {
+	if tx.rev > 0 {
+		opts = append(opts, clientv3.WithRev(tx.rev))
+	}
+	return opts
+}
+
+func (tx *etcdTxn) setRev(resp *clientv3.GetResponse) {
+	if tx.rev == 0 {
+		tx.rev = resp.Header.Revision
+	}
+}
+
+func (tx *etcdTxn) observe(key string, kvs []*mvccpb.KeyValue) []byte {
+	if len(kvs) == 0 {
+		tx.observed[key] = 0
+		return nil
+	}
+	tx.observed[key] = kvs[0].ModRevision
+	return kvs[0].Value
+}
+
+func (tx *etcdTxn) get(key []byte) []byte {
+	if v, ok := tx.buffer[string(key)]; ok {
+		return v
+	}
+	resp, err := tx.kv.Get(tx.ctx, string(key), tx.withRev()...)
+	if err != nil {
+		panic(err)
+	}
+	tx.setRev(resp)
+	return tx.observe(string(key), resp.Kvs)
+}
+
+func (tx *etcdTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	var idx []int
+	for i, key := range keys {
+		if v, ok := tx.buffer[string(key)]; ok {
+			values[i] = v
+		} else {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) > 0 && tx.rev == 0 {
+		i := idx[0]
+		values[i] = tx.get(keys[i])
+		idx = idx[1:]
+	}
+	for len(idx) > 0 {
+		n := len(idx)
+		if n > etcdBatchSize {
+			n = etcdBatchSize
+		}
+		ops := make([]clientv3.Op, n)
+		for j, i := range idx[:n] {
+			ops[j] = clientv3.OpGet(string(keys[i]), tx.withRev()...)
+		}
+		resp, err := tx.kv.Txn(tx.ctx).Then(ops...).Commit()
+		if err != nil {
+			panic(err)
+		}
+		for j, i := range idx[:n] {
+			values[i] = tx.observe(string(keys[i]), resp.Responses[j].GetResponseRange().Kvs)
+		}
+		idx = idx[n:]
+	}
+	return values
+}
+
+// scanRange0 returns all the keys in [begin, end) (with values unless keysOnly), including the pending writes.
+func (tx *etcdTxn) scanRange0(begin, end []byte, keysOnly bool) map[string][]byte {
+	opts := tx.withRev(clientv3.WithRange(string(end)))
+	if keysOnly {
+		opts = append(opts, clientv3.WithKeysOnly())
+	}
+	resp, err := tx.kv.Get(tx.ctx, string(begin), opts...)
+	if err != nil {
+		panic(err)
+	}
+	tx.setRev(resp)
+	tx.ranges = append(tx.ranges, [2]string{string(begin), string(end)})
+	ret := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		ret[string(kv.Key)] = kv.Value
+	}
+	for k, v := range tx.buffer {
+		if k >= string(begin) && k < string(end) {
+			if v == nil {
+				delete(ret, k)
+			} else {
+				ret[k] = v
+			}
+		}
+	}
+	return ret
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (tx *etcdTxn) scanRange(begin, end []byte) map[string][]byte {
+	return tx.scanRange0(begin, end, false)
+}
+
+func (tx *etcdTxn) scan(prefix []byte, handler func(key, value []byte)) {
+	r := tx.scanRange0(prefix, nextKey(prefix), false)
+	for _, k := range sortedKeys(r) {
+		handler([]byte(k), r[k])
+	}
+}
+
+func (tx *etcdTxn) scanKeys(prefix []byte) [][]byte {
+	r := tx.scanRange0(prefix, nextKey(prefix), true)
+	var ret [][]byte
+	for _, k := range sortedKeys(r) {
+		ret = append(ret, []byte(k))
+	}
+	return ret
+}
+
+func (tx *etcdTxn) scanValues(prefix []byte, limit int, filter func(k, v []byte) bool) map[string][]byte {
+	if limit == 0 {
+		return nil
+	}
+	r := tx.scanRange0(prefix, nextKey(prefix), false)
+	var ret = make(map[string][]byte)
+	for _, k := range sortedKeys(r) {
+		if filter == nil || filter([]byte(k), r[k]) {
+			ret[k] = r[k]
+			if limit > 0 {
+				if limit--; limit == 0 {
+					break
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func (tx *etcdTxn) exist(prefix []byte) bool {
+	return len(tx.scanRange0(prefix, nextKey(prefix), true)) > 0
+}
+
+func (tx *etcdTxn) set(key, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.buffer[string(key)] = value
+}
+
+func (tx *etcdTxn) append(key []byte, value []byte) []byte {
+	new := append(tx.get(key), value...)
+	tx.set(key, new)
+	return new
+}
+
+func (tx *etcdTxn) incrBy(key []byte, value int64) int64 {
+	buf := tx.get(key)
+	new := parseCounter(buf)
+	if value != 0 {
+		new += value
+		tx.set(key, packCounter(new))
+	}
+	return new
+}
+
+func (tx *etcdTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		tx.buffer[string(key)] = nil
+	}
+}
+
+func (tx *etcdTxn) commit() error {
+	if len(tx.buffer) == 0 {
+		return nil
+	}
+	var cmps []clientv3.Cmp
+	for k, rev := range tx.observed {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(k), "=", rev))
+	}
+	for _, r := range tx.ranges {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(r[0]), "<", tx.rev+1).WithRange(r[1]))
+	}
+	var ops = make([]clientv3.Op, 0, len(tx.buffer))
+	for k, v := range tx.buffer {
+		if v == nil {
+			ops = append(ops, clientv3.OpDelete(k))
+		} else {
+			ops = append(ops, clientv3.OpPut(k, string(v)))
+		}
+	}
+	resp, err := tx.kv.Txn(tx.ctx).If(cmps...).Then(ops...).Commit()
+	if errors.Is(err, rpctypes.ErrTooManyOps) {
+		// the writes can't be split into multiple transactions, and it will fail again if retried
+		return errors.Errorf("too many operations in a transaction (%d compares, %d writes), try to increase --max-txn-ops of etcd", len(cmps), len(ops))
+	}
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errEtcdConflict
+	}
+	return nil
+}
+
+type etcdClient struct {
+	client *clientv3.Client
+}
+
+func (c *etcdClient) name() string {
+	return "etcd"
+}
+
+func (c *etcdClient) shouldRetry(err error) bool {
+	return errors.Is(err, errEtcdConflict) || strings.Contains(err.Error(), "required revision has been compacted")
+}
+
+func (c *etcdClient) txn(f func(kvTxn) error) (err error) {
+	tx := &etcdTxn{
+		ctx:      context.Background(),
+		kv:       c.client.KV,
+		observed: make(map[string]int64),
+		buffer:   make(map[string][]byte),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(error)
+			if ok {
+				err = fe
+			} else {
+				err = errors.Errorf("etcd client txn func error: %v", r)
+			}
+		}
+	}()
+	if err = f(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (c *etcdClient) reset(prefix []byte) error {
+	_, err := c.client.Delete(context.Background(), string(prefix), clientv3.WithRange(string(nextKey(prefix))))
+	return err
+}
+
+func (c *etcdClient) close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,116 @@
+//go:build !noetcd
+// +build !noetcd
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//nolint:errcheck
+package meta
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// startEtcd starts an embedded etcd server, and returns the address of it.
+func startEtcd(t *testing.T, maxTxnOps uint) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.MaxTxnOps = maxTxnOps
+	cfg.Logger = "zap"
+	cfg.LogLevel = "error"
+	cfg.LogOutputs = []string{"stderr"}
+	curl, purl := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{curl}, []url.URL{curl}
+	cfg.LPUrls, cfg.APUrls = []url.URL{purl}, []url.URL{purl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start etcd: %s", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(time.Minute):
+		t.Fatalf("etcd is not ready in a minute")
+	}
+	return curl.Host
+}
+
+func TestEtcdClient(t *testing.T) {
+	m, err := newKVMeta("etcd", startEtcd(t, embed.DefaultMaxTxnOps)+"/jfs-unit-test", &Config{MaxDeletes: 1})
+	if err != nil || m.Name() != "etcd" {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+}
+
+func TestEtcd(t *testing.T) {
+	c, err := newEtcdClient(startEtcd(t, embed.DefaultMaxTxnOps) + "/jfs-unit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTKV(t, c)
+}
+
+func TestEtcdTxnLimit(t *testing.T) {
+	c, err := newEtcdClient(startEtcd(t, embed.DefaultMaxTxnOps) + "/jfs-unit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	write := func(n int) error {
+		return c.txn(func(tx kvTxn) error {
+			for i := 0; i < n; i++ {
+				tx.set([]byte(fmt.Sprintf("k%d_%04d", n, i)), []byte("v"))
+			}
+			return nil
+		})
+	}
+	if err = write(etcdBatchSize); err != nil {
+		t.Fatalf("write %d keys: %s", etcdBatchSize, err)
+	}
+	err = write(etcdBatchSize + 72)
+	if err == nil || !strings.Contains(err.Error(), "--max-txn-ops") {
+		t.Fatalf("write %d keys should fail with too many operations: %v", etcdBatchSize+72, err)
+	}
+	if c.shouldRetry(err) {
+		t.Fatalf("too many operations should not be retried: %s", err)
+	}
+	var keys [][]byte
+	c.txn(func(tx kvTxn) error {
+		keys = tx.scanKeys([]byte(fmt.Sprintf("k%d_", etcdBatchSize+72)))
+		return nil
+	})
+	if len(keys) > 0 {
+		t.Fatalf("%d keys are written by the failed transaction", len(keys))
+	}
+}
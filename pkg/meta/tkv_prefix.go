@@ -24,7 +24,8 @@ type prefixTxn struct {
 }
 
 func (tx *prefixTxn) realKey(key []byte) []byte {
-	return append(tx.prefix, key...)
+	// the prefix could have spare capacity, limit it to always get a new one
+	return append(tx.prefix[:len(tx.prefix):len(tx.prefix)], key...)
 }
 
 func (tx *prefixTxn) origKey(key []byte) []byte {
@@ -36,10 +37,11 @@ func (tx *prefixTxn) get(key []byte) []byte {
 }
 
 func (tx *prefixTxn) gets(keys ...[]byte) [][]byte {
+	realKeys := make([][]byte, len(keys)) // the keys could be used again by the caller
 	for i, key := range keys {
-		keys[i] = tx.realKey(key)
+		realKeys[i] = tx.realKey(key)
 	}
-	return tx.kvTxn.gets(keys...)
+	return tx.kvTxn.gets(realKeys...)
 }
 
 func (tx *prefixTxn) scanRange(begin_, end_ []byte) map[string][]byte {
@@ -94,10 +96,11 @@ func (tx *prefixTxn) incrBy(key []byte, value int64) int64 {
 }
 
 func (tx *prefixTxn) dels(keys ...[]byte) {
+	realKeys := make([][]byte, len(keys))
 	for i, key := range keys {
-		keys[i] = tx.realKey(key)
+		realKeys[i] = tx.realKey(key)
 	}
-	tx.kvTxn.dels(keys...)
+	tx.kvTxn.dels(realKeys...)
 }
 
 type prefixClient struct {
@@ -0,0 +1,373 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// The entries moved into trash are named as "{parent}-{inode}-{name}" under the sub-directory of the hour
+// when they are deleted, and the original paths are recorded by the inode, so they can be restored to where
+// they were even if the parent has been removed too. The paths of directories are resolved by reading their
+// parents, which are cached in memory, so a path may be stale if the directory is renamed by other clients.
+
+const (
+	trashHourFormat = "2006-01-02-15"
+	maxCachedDirs   = 100000
+)
+
+// TrashEntry is an entry in trash which can be restored.
+type TrashEntry struct {
+	Inode    Ino
+	Attr     Attr
+	Parent   Ino       // the original parent
+	Name     string    // the original name
+	Path     string    // the original path, empty if unknown
+	Trash    string    // the path in trash, relative to the trash directory
+	Time     time.Time // the hour when it was deleted
+	Restored string    // the path where it's restored to
+
+	trashDir Ino
+}
+
+type cachedDir struct {
+	parent Ino
+	name   string
+}
+
+func marshalTrashPath(parent Ino, p string) []byte {
+	w := utils.NewBuffer(uint32(8 + len(p)))
+	w.Put64(uint64(parent))
+	w.Put([]byte(p))
+	return w.Bytes()
+}
+
+func unmarshalTrashPath(buf []byte) (Ino, string) {
+	if len(buf) < 8 {
+		return 0, ""
+	}
+	rb := utils.ReadBuffer(buf)
+	return Ino(rb.Get64()), string(rb.Get(rb.Left()))
+}
+
+// parseTrashName returns the original parent and name of an entry in trash.
+func parseTrashName(name string) (Ino, Ino, string, bool) {
+	ps := strings.SplitN(name, "-", 3)
+	if len(ps) != 3 || ps[2] == "" {
+		return 0, 0, "", false
+	}
+	parent, err1 := strconv.ParseUint(ps[0], 10, 64)
+	inode, err2 := strconv.ParseUint(ps[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, "", false
+	}
+	return Ino(parent), Ino(inode), ps[2], true
+}
+
+// lookupDir returns the parent and name of a directory, the sibling directories are cached together.
+func (m *baseMeta) lookupDir(ctx Context, inode Ino) (*cachedDir, syscall.Errno) {
+	m.dirPathsMu.Lock()
+	d := m.dirPaths[inode]
+	m.dirPathsMu.Unlock()
+	if d != nil {
+		return d, 0
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return nil, st
+	}
+	if attr.Typ != TypeDirectory {
+		return nil, syscall.ENOTDIR
+	}
+	if isTrash(attr.Parent) || attr.Parent == SnapshotInode || isSnapshot(attr.Parent) {
+		return nil, syscall.ENOENT
+	}
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, attr.Parent, 0, &entries); st != 0 {
+		return nil, st
+	}
+	m.dirPathsMu.Lock()
+	defer m.dirPathsMu.Unlock()
+	if len(m.dirPaths) > maxCachedDirs {
+		m.dirPaths = make(map[Ino]*cachedDir)
+	}
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			m.dirPaths[e.Inode] = &cachedDir{attr.Parent, string(e.Name)}
+		}
+	}
+	if d = m.dirPaths[inode]; d == nil {
+		return nil, syscall.ENOENT
+	}
+	return d, 0
+}
+
+// dirPath returns the path of a directory in the volume, or ENOENT if it's in trash.
+func (m *baseMeta) dirPath(ctx Context, inode Ino) (string, syscall.Errno) {
+	var names []string
+	for i := 0; inode != 1; i++ {
+		if inode == 0 || isTrash(inode) || i > 1000 {
+			return "", syscall.ENOENT
+		}
+		d, st := m.lookupDir(ctx, inode)
+		if st != 0 {
+			return "", st
+		}
+		names = append(names, d.name)
+		inode = d.parent
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return "/" + strings.Join(names, "/"), 0
+}
+
+func (m *baseMeta) forgetDir(inode Ino) {
+	m.dirPathsMu.Lock()
+	if inode == 0 {
+		m.dirPaths = make(map[Ino]*cachedDir)
+	} else {
+		delete(m.dirPaths, inode)
+	}
+	m.dirPathsMu.Unlock()
+}
+
+// recordTrash records the original path of an entry moved into trash.
+func (m *baseMeta) recordTrash(ctx Context, parent Ino, name string, inode Ino) {
+	p, st := m.dirPath(ctx, parent)
+	if st != 0 {
+		logger.Debugf("path of directory %d: %s", parent, st)
+		return
+	}
+	if err := m.en.doSetTrashPath(inode, parent, path.Join(p, name)); err != nil {
+		logger.Warnf("record the path of %s in %d: %s", name, parent, err)
+	}
+}
+
+// matchTrash returns true if the pattern matches the path of an entry or any of its parents, or
+// the name of it if there is no "/" in the pattern.
+func matchTrash(pattern string, e *TrashEntry) bool {
+	if pattern == "" {
+		return true
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, e.Name)
+		return ok
+	}
+	pattern = path.Clean("/" + pattern)
+	for p := e.Path; p != "" && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// trashPath resolves the original path of an entry in trash, with the path of its parent which may be in trash too.
+func (m *baseMeta) trashPath(ctx Context, e *TrashEntry, entries map[Ino]*TrashEntry, depth int) string {
+	if e.Path != "" || depth > 1000 {
+		return e.Path
+	}
+	if p, st := m.dirPath(ctx, e.Parent); st == 0 {
+		e.Path = path.Join(p, e.Name)
+	} else if pe := entries[e.Parent]; pe != nil && pe != e {
+		if p := m.trashPath(ctx, pe, entries, depth+1); p != "" {
+			e.Path = path.Join(p, e.Name)
+		}
+	}
+	return e.Path
+}
+
+func (m *baseMeta) ListTrash(ctx Context, pattern string, since time.Time) ([]*TrashEntry, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+	}
+	var subs []*Entry
+	if st := m.en.doReaddir(ctx, TrashInode, 0, &subs); st != 0 {
+		if st == syscall.ENOENT {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("readdir trash: %s", st)
+	}
+	var all []*TrashEntry
+	byInode := make(map[Ino]*TrashEntry)
+	for _, sub := range subs {
+		ts, err := time.Parse(trashHourFormat, string(sub.Name))
+		if err != nil {
+			logger.Warnf("bad entry as a subTrash: %s", sub.Name)
+			continue
+		}
+		var entries []*Entry
+		if st := m.en.doReaddir(ctx, sub.Inode, 1, &entries); st != 0 {
+			return nil, fmt.Errorf("readdir subTrash %s: %s", sub.Name, st)
+		}
+		for _, se := range entries {
+			parent, inode, name, ok := parseTrashName(string(se.Name))
+			if !ok || inode != se.Inode {
+				logger.Warnf("bad entry in subTrash %s: %s", sub.Name, se.Name)
+				continue
+			}
+			e := &TrashEntry{Inode: se.Inode, Attr: *se.Attr, Parent: parent, Name: name,
+				Trash: path.Join(string(sub.Name), string(se.Name)), Time: ts, trashDir: sub.Inode}
+			rparent, rpath, err := m.en.doGetTrashPath(se.Inode)
+			if err != nil {
+				return nil, fmt.Errorf("get the path of %d: %s", se.Inode, err)
+			}
+			if rparent == parent && path.Base(rpath) == name { // may be recorded by another hard link
+				e.Path = rpath
+			}
+			all = append(all, e)
+			if se.Attr.Typ == TypeDirectory {
+				byInode[se.Inode] = e
+			}
+		}
+	}
+	var matched []*TrashEntry
+	for _, e := range all {
+		m.trashPath(ctx, e, byInode, 0)
+		if e.Time.Add(time.Hour).After(since) && matchTrash(pattern, e) {
+			matched = append(matched, e)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		return a.Time.Before(b.Time) || a.Time.Equal(b.Time) && a.Trash < b.Trash
+	})
+	return matched, nil
+}
+
+// mkdirAll creates the directory of dpath and all the missing parents, like `mkdir -p`.
+func (m *baseMeta) mkdirAll(ctx Context, dpath string) (Ino, syscall.Errno) {
+	var inode Ino = 1
+	var attr Attr
+	for _, name := range strings.Split(dpath, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		parent := inode
+		st := m.en.doLookup(ctx, parent, name, &inode, &attr)
+		if st == syscall.ENOENT {
+			if st = m.Mkdir(ctx, parent, name, 0755, 0, 0, &inode, &attr); st == syscall.EEXIST {
+				st = m.en.doLookup(ctx, parent, name, &inode, &attr)
+			}
+		}
+		if st != 0 {
+			return 0, st
+		}
+		if attr.Typ != TypeDirectory {
+			return 0, syscall.ENOTDIR
+		}
+	}
+	return inode, 0
+}
+
+// restoreTarget returns the directory to restore an entry into, and the path of it.
+func (m *baseMeta) restoreTarget(ctx Context, e *TrashEntry, dst Ino, dpath string, restored map[Ino]string) (Ino, string, error) {
+	if p, ok := restored[e.Parent]; ok {
+		return e.Parent, p, nil
+	}
+	if dst > 0 {
+		return dst, dpath, nil
+	}
+	if p, st := m.dirPath(ctx, e.Parent); st == 0 {
+		return e.Parent, p, nil
+	}
+	if e.Path == "" {
+		return 0, "", fmt.Errorf("the original location is unknown")
+	}
+	p := path.Dir(e.Path)
+	parent, st := m.mkdirAll(ctx, p)
+	if st != 0 {
+		return 0, "", fmt.Errorf("mkdir %s: %s", p, st)
+	}
+	return parent, p, nil
+}
+
+func (m *baseMeta) restoreEntry(ctx Context, e *TrashEntry, dst Ino, dpath string, restored map[Ino]string) error {
+	parent, p, err := m.restoreTarget(ctx, e, dst, dpath, restored)
+	if err != nil {
+		return err
+	}
+	name := e.Name
+	st := m.Rename(ctx, e.trashDir, path.Base(e.Trash), parent, name, RenameNoReplace, nil, nil)
+	if st == syscall.EEXIST {
+		name = fmt.Sprintf("%s.restored-%d", e.Name, e.Inode)
+		st = m.Rename(ctx, e.trashDir, path.Base(e.Trash), parent, name, RenameNoReplace, nil, nil)
+	}
+	if st != 0 {
+		return fmt.Errorf("rename into %s: %s", p, st)
+	}
+	if err = m.en.doSetTrashPath(e.Inode, 0, ""); err != nil {
+		logger.Warnf("remove the path of %d: %s", e.Inode, err)
+	}
+	e.Restored = path.Join(p, name)
+	return nil
+}
+
+// RestoreTrash restores the entries to their original locations, or into dst if it's not empty. The entries
+// under a restored directory are restored into it, and a suffix is added to the name if it's already used.
+func (m *baseMeta) RestoreTrash(ctx Context, entries []*TrashEntry, dst string) error {
+	if m.conf.ReadOnly {
+		return syscall.EROFS
+	}
+	var dstIno Ino
+	if dst != "" {
+		var st syscall.Errno
+		dst = path.Clean("/" + dst)
+		if dstIno, st = m.resolveDir(ctx, dst); st != 0 {
+			return fmt.Errorf("lookup %s: %s", dst, st)
+		}
+	}
+	// the directories are restored before the entries under them
+	pending := make(map[Ino]bool)
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			pending[e.Inode] = true
+		}
+	}
+	restored := make(map[Ino]string)
+	var failed int
+	for left := entries; len(left) > 0; {
+		var next []*TrashEntry
+		for _, e := range left {
+			if pending[e.Parent] && len(next) < len(left)-1 {
+				next = append(next, e)
+				continue
+			}
+			if err := m.restoreEntry(ctx, e, dstIno, dst, restored); err != nil {
+				logger.Warnf("restore %s: %s", e.Trash, err)
+				failed++
+			} else {
+				restored[e.Inode] = e.Restored
+			}
+			delete(pending, e.Inode)
+		}
+		left = next
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to restore %d entries", failed)
+	}
+	return nil
+}
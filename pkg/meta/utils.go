@@ -36,6 +36,28 @@ const (
 	allSessions  = "sessions"
 	sessionInfos = "sessionInfos"
 	sliceRefs    = "sliceRef"
+	loadingRefs  = "loadingRefs"
+
+	dirQuotaKey        = "dirQuota"
+	dirUsedSpaceKey    = "dirUsedSpace"
+	dirUsedInodesKey   = "dirUsedInodes"
+	userQuotaKey       = "userQuota"
+	userUsedSpaceKey   = "userUsedSpace"
+	userUsedInodesKey  = "userUsedInodes"
+	groupQuotaKey      = "groupQuota"
+	groupUsedSpaceKey  = "groupUsedSpace"
+	groupUsedInodesKey = "groupUsedInodes"
+
+	dirLengthKey = "dirLength"
+	dirSpaceKey  = "dirSpace"
+	dirFilesKey  = "dirFiles"
+	dirDirsKey   = "dirDirs"
+
+	changelogKey  = "changelog"
+	trashPathsKey = "trashPaths"
+	packsKey      = "packs"
+	packLiveKey   = "packLive"
+	sliceTiersKey = "sliceTiers"
 )
 
 const (
@@ -274,6 +296,11 @@ func GetSummary(r Meta, ctx Context, inode Ino, summary *Summary, recursive bool
 		return st
 	}
 	if attr.Typ == TypeDirectory {
+		if recursive && r.GetDirStat(ctx, inode, summary) == 0 {
+			summary.Dirs++
+			summary.Size += 4096
+			return 0
+		}
 		var entries []*Entry
 		if st := r.Readdir(ctx, inode, 1, &entries); st != 0 {
 			return st
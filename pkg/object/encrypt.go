@@ -29,7 +29,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Encryptor interface {
@@ -114,6 +117,119 @@ func (e *rsaEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
 	return rsa.DecryptOAEP(sha256.New(), rand.Reader, e.privKey, ciphertext, e.label)
 }
 
+// KeyRing is an Encryptor which encrypts with the current version of keys, and decrypts with any known
+// versions, so the keys can be rotated without re-encrypting the existing data.
+type KeyRing struct {
+	sync.RWMutex
+	current int
+	keys    map[int]Encryptor
+	reload  func(current int) (int, map[int]Encryptor, error)
+	checked time.Time
+	loading sync.Mutex // only one reload at a time
+}
+
+// NewKeyRing returns a KeyRing with the keys by version, the current one should be in them.
+func NewKeyRing(current int, keys map[int]Encryptor) *KeyRing {
+	return &KeyRing{current: current, keys: keys, checked: time.Now()}
+}
+
+// SetReload sets the function to load the keys rotated after the ring is created, it's called with the
+// current version periodically, and returns the keys only when the version is changed.
+func (r *KeyRing) SetReload(reload func(current int) (int, map[int]Encryptor, error)) {
+	r.Lock()
+	r.reload = reload
+	r.Unlock()
+}
+
+// Version returns the current version of keys.
+func (r *KeyRing) Version() int {
+	r.RLock()
+	defer r.RUnlock()
+	return r.current
+}
+
+// refresh reloads the keys if they are not checked in the interval, it waits for the ongoing reload.
+func (r *KeyRing) refresh(interval time.Duration) {
+	r.loading.Lock()
+	defer r.loading.Unlock()
+	r.Lock()
+	if r.reload == nil || time.Since(r.checked) < interval {
+		r.Unlock()
+		return
+	}
+	r.checked = time.Now()
+	reload, current := r.reload, r.current
+	r.Unlock()
+
+	version, keys, err := reload(current)
+	if err != nil {
+		logger.Warnf("Reload encrypt keys: %s", err)
+		return
+	}
+	if version == current || keys[version] == nil {
+		return
+	}
+	r.Lock()
+	r.current, r.keys = version, keys
+	r.Unlock()
+	logger.Infof("Encrypt key is rotated from version %d to %d", current, version)
+}
+
+// ordered returns the current key followed by the older ones.
+func (r *KeyRing) ordered() []Encryptor {
+	r.RLock()
+	defer r.RUnlock()
+	versions := make([]int, 0, len(r.keys))
+	for v := range r.keys {
+		if v != r.current {
+			versions = append(versions, v)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	keys := []Encryptor{r.keys[r.current]}
+	for _, v := range versions {
+		keys = append(keys, r.keys[v])
+	}
+	return keys
+}
+
+func (r *KeyRing) Encrypt(plaintext []byte) ([]byte, error) {
+	r.refresh(time.Minute)
+	return r.ordered()[0].Encrypt(plaintext)
+}
+
+func (r *KeyRing) decrypt(ciphertext []byte) (int, []byte, error) {
+	var err error
+	for i, k := range r.ordered() {
+		var plaintext []byte
+		if plaintext, err = k.Decrypt(ciphertext); err == nil {
+			return i, plaintext, nil
+		}
+	}
+	return 0, nil, err
+}
+
+func (r *KeyRing) Decrypt(ciphertext []byte) ([]byte, error) {
+	version := r.Version()
+	_, plaintext, err := r.decrypt(ciphertext)
+	if err != nil { // it may be encrypted with a key rotated recently
+		if r.refresh(time.Second); r.Version() != version {
+			_, plaintext, err = r.decrypt(ciphertext)
+		}
+	}
+	return plaintext, err
+}
+
+// Rewrap decrypts the ciphertext with an old key and encrypts it again with the current one, it returns
+// nil if it's encrypted with the current key already.
+func (r *KeyRing) Rewrap(ciphertext []byte) ([]byte, error) {
+	i, plaintext, err := r.decrypt(ciphertext)
+	if err != nil || i == 0 {
+		return nil, err
+	}
+	return r.ordered()[0].Encrypt(plaintext)
+}
+
 type aesEncryptor struct {
 	keyEncryptor Encryptor
 	keyLen       int
@@ -159,16 +275,28 @@ func (e *aesEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
 	return buf[:headerSize+len(ciphertext)], nil
 }
 
-func (e *aesEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+// parseHeader splits the ciphertext into the encrypted data key, the nonce and the encrypted data.
+func parseHeader(ciphertext []byte) (cipherkey, nonce, data []byte, err error) {
+	if len(ciphertext) < 3 {
+		return nil, nil, nil, fmt.Errorf("misformed ciphertext: %d bytes", len(ciphertext))
+	}
 	keyLen := int(ciphertext[0])<<8 + int(ciphertext[1])
 	nonceLen := int(ciphertext[2])
-	if 3+keyLen+nonceLen >= len(ciphertext) {
-		return nil, fmt.Errorf("misformed ciphertext: %d %d", keyLen, nonceLen)
+	if 3+keyLen+nonceLen > len(ciphertext) {
+		return nil, nil, nil, fmt.Errorf("misformed ciphertext: %d %d", keyLen, nonceLen)
 	}
 	ciphertext = ciphertext[3:]
-	cipherkey := ciphertext[:keyLen]
-	nonce := ciphertext[keyLen : keyLen+nonceLen]
-	ciphertext = ciphertext[keyLen+nonceLen:]
+	return ciphertext[:keyLen], ciphertext[keyLen : keyLen+nonceLen], ciphertext[keyLen+nonceLen:], nil
+}
+
+func (e *aesEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	cipherkey, nonce, ciphertext, err := parseHeader(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 {
+		return nil, fmt.Errorf("misformed ciphertext: no data")
+	}
 
 	key, err := e.keyEncryptor.Decrypt(cipherkey)
 	if err != nil {
@@ -224,6 +352,71 @@ func (e *encrypted) Get(key string, off, limit int64) (io.ReadCloser, error) {
 	return ioutil.NopCloser(bytes.NewBuffer(data)), nil
 }
 
+// KeyRingOf returns the KeyRing used by the encrypted object storage, or nil if it's not encrypted with one.
+func KeyRingOf(o ObjectStorage) *KeyRing {
+	if e, ok := o.(*encrypted); ok {
+		if a, ok := e.enc.(*aesEncryptor); ok {
+			if r, ok := a.keyEncryptor.(*KeyRing); ok {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// the header (the lengths, encrypted data key and nonce) is smaller than this with RSA keys up to 8192 bits
+const maxHeaderSize = 3 + 1024 + 255
+
+// Rewrap encrypts the data key of an object again with the current key of the ring, the data is not changed.
+// It returns false if the data key is encrypted with the current key already.
+//
+// The object is written back after it's read, so it could be brought back if it's deleted in between,
+// which would be cleaned as a leaked object by gc.
+func Rewrap(o ObjectStorage, key string) (bool, error) {
+	ring := KeyRingOf(o)
+	if ring == nil {
+		return false, fmt.Errorf("%s is not encrypted with a key ring", o)
+	}
+	e := o.(*encrypted)
+	r, err := e.ObjectStorage.Get(key, 0, maxHeaderSize)
+	if err != nil {
+		return false, err
+	}
+	header, err := ioutil.ReadAll(io.LimitReader(r, maxHeaderSize))
+	_ = r.Close()
+	if err != nil {
+		return false, err
+	}
+	cipherkey, _, _, err := parseHeader(header)
+	if err != nil {
+		return false, err
+	}
+	if cipherkey, err = ring.Rewrap(cipherkey); err != nil || cipherkey == nil {
+		return false, err
+	}
+
+	if r, err = e.ObjectStorage.Get(key, 0, -1); err != nil {
+		return false, err
+	}
+	ciphertext, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return false, err
+	}
+	_, nonce, data, err := parseHeader(ciphertext)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, 3+len(cipherkey)+len(nonce)+len(data))
+	buf[0] = byte(len(cipherkey) >> 8)
+	buf[1] = byte(len(cipherkey) & 0xFF)
+	buf[2] = byte(len(nonce))
+	copy(buf[3:], cipherkey)
+	copy(buf[3+len(cipherkey):], nonce)
+	copy(buf[3+len(cipherkey)+len(nonce):], data)
+	return true, e.ObjectStorage.Put(key, bytes.NewReader(buf))
+}
+
 func (e *encrypted) Put(key string, in io.Reader) error {
 	plain, err := ioutil.ReadAll(in)
 	if err != nil {
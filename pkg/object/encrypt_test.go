@@ -25,6 +25,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var testkey = GenerateRsaKeyPair()
@@ -153,3 +154,52 @@ func TestEncryptedStore(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestKeyRing(t *testing.T) {
+	s, _ := CreateStorage("mem", "", "", "")
+	k0, k1 := NewRSAEncryptor(testkey), NewRSAEncryptor(GenerateRsaKeyPair())
+	old := NewEncrypted(s, NewAESEncryptor(NewKeyRing(0, map[int]Encryptor{0: k0})))
+	if err := old.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("Put a: %s", err)
+	}
+	get := func(es ObjectStorage, key string) string {
+		r, err := es.Get(key, 0, -1)
+		if err != nil {
+			t.Fatalf("Get %s: %s", key, err)
+		}
+		d, _ := ioutil.ReadAll(r)
+		return string(d)
+	}
+
+	rotated := NewEncrypted(s, NewAESEncryptor(NewKeyRing(1, map[int]Encryptor{0: k0, 1: k1})))
+	if d := get(rotated, "a"); d != "hello" {
+		t.Fatalf("read with old key: %q", d)
+	}
+	_ = rotated.Put("b", bytes.NewReader([]byte("world")))
+	if done, err := Rewrap(rotated, "a"); err != nil || !done {
+		t.Fatalf("rewrap a: %t %s", done, err)
+	}
+	if done, err := Rewrap(rotated, "b"); err != nil || done {
+		t.Fatalf("rewrap b: %t %s", done, err)
+	}
+	current := NewEncrypted(s, NewAESEncryptor(NewKeyRing(1, map[int]Encryptor{1: k1})))
+	if d := get(current, "a"); d != "hello" {
+		t.Fatalf("read rewrapped: %q", d)
+	}
+	if _, err := Rewrap(NewEncrypted(s, NewAESEncryptor(k0)), "a"); err == nil {
+		t.Fatalf("rewrap without key ring should fail")
+	}
+
+	// the client started before rotation reloads the keys
+	ring := KeyRingOf(old)
+	ring.SetReload(func(current int) (int, map[int]Encryptor, error) {
+		return 1, map[int]Encryptor{0: k0, 1: k1}, nil
+	})
+	ring.checked = time.Now().Add(-time.Second * 2)
+	if d := get(old, "b"); d != "world" {
+		t.Fatalf("read with reloaded key: %q", d)
+	}
+	if ring.Version() != 1 {
+		t.Fatalf("version should be 1, but got %d", ring.Version())
+	}
+}
@@ -0,0 +1,434 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// An object is split into `data` shards and encoded with `parity` shards, which are stored with the same key
+// in different object storages. Each shard starts with a header containing the size of the object and the
+// checksum of the shard, the broken shards are treated as missing, and the object can be rebuilt from any
+// `data` shards. A write succeeds once more than half of the parity shards are written besides the data ones,
+// and the missing shards can be rebuilt by RepairShards.
+
+const shardHeaderSize = 12 // size of object (8 bytes) + crc32c of shard (4 bytes)
+
+var errBrokenShard = errors.New("broken shard")
+
+type erasure struct {
+	DefaultObjectStorage
+	stores []ObjectStorage
+	data   int
+	parity int
+	enc    reedsolomon.Encoder
+}
+
+func (e *erasure) String() string {
+	return fmt.Sprintf("ec%d+%d://%s", e.data, e.parity, e.stores[0])
+}
+
+func (e *erasure) Create() error {
+	for _, o := range e.stores {
+		if err := o.Create(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode splits the data into shards with headers.
+func (e *erasure) encode(data []byte) ([][]byte, error) {
+	shards := make([][]byte, len(e.stores))
+	if len(data) > 0 {
+		var err error
+		if shards, err = e.enc.Split(data); err != nil {
+			return nil, err
+		}
+		if err = e.enc.Encode(shards); err != nil {
+			return nil, err
+		}
+	}
+	for i, p := range shards {
+		shards[i] = newShard(int64(len(data)), p)
+	}
+	return shards, nil
+}
+
+func newShard(size int64, payload []byte) []byte {
+	buf := make([]byte, shardHeaderSize+len(payload))
+	binary.BigEndian.PutUint64(buf, uint64(size))
+	binary.BigEndian.PutUint32(buf[8:], crc32.Checksum(payload, crc32c))
+	copy(buf[shardHeaderSize:], payload)
+	return buf
+}
+
+// parseShard returns the size of object and the payload of the shard.
+func parseShard(buf []byte) (int64, []byte, error) {
+	if len(buf) < shardHeaderSize {
+		return 0, nil, errBrokenShard
+	}
+	size := int64(binary.BigEndian.Uint64(buf))
+	payload := buf[shardHeaderSize:]
+	if binary.BigEndian.Uint32(buf[8:]) != crc32.Checksum(payload, crc32c) {
+		return 0, nil, errBrokenShard
+	}
+	return size, payload, nil
+}
+
+func (e *erasure) getShard(i int, key string) (int64, []byte, error) {
+	in, err := e.stores[i].Get(key, 0, -1)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer in.Close()
+	buf, err := ioutil.ReadAll(in)
+	if err != nil {
+		return 0, nil, err
+	}
+	return parseShard(buf)
+}
+
+// getShards reads the data shards first, and the parity ones if some of them are missing, it returns the
+// shards (nil for missing ones) and the size of object.
+func (e *erasure) getShards(key string, all bool) ([][]byte, int64, error) {
+	shards := make([][]byte, len(e.stores))
+	sizes := make([]int64, len(e.stores))
+	errs := make([]error, len(e.stores))
+	fetch := func(from, to int) {
+		var wg sync.WaitGroup
+		for i := from; i < to; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				sizes[i], shards[i], errs[i] = e.getShard(i, key)
+			}(i)
+		}
+		wg.Wait()
+	}
+	if all {
+		fetch(0, len(e.stores))
+	} else {
+		fetch(0, e.data)
+		for i := 0; i < e.data; i++ {
+			if errs[i] != nil {
+				fetch(e.data, len(e.stores))
+				break
+			}
+		}
+	}
+
+	// the shards of different versions of the object could be mixed
+	votes := make(map[int64]int)
+	var size int64 = -1
+	for i, err := range errs {
+		if err == nil && shards[i] != nil {
+			votes[sizes[i]]++
+			if size < 0 || votes[sizes[i]] > votes[size] {
+				size = sizes[i]
+			}
+		}
+	}
+	var firstErr error
+	var found int
+	for i, err := range errs {
+		if err == nil && shards[i] != nil && sizes[i] != size {
+			err = errBrokenShard
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if err != errBrokenShard {
+				logger.Debugf("Get shard %d of %s from %s: %s", i, key, e.stores[i], err)
+			} else {
+				logger.Warnf("Shard %d of %s in %s is broken", i, key, e.stores[i])
+			}
+			shards[i] = nil
+		} else if shards[i] != nil {
+			found++
+		}
+	}
+	if found < e.data {
+		return nil, 0, fmt.Errorf("found %d shards of %s, at least %d are needed: %v", found, key, e.data, firstErr)
+	}
+	return shards, size, nil
+}
+
+func (e *erasure) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	shards, size, err := e.getShards(key, false)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if size > 0 {
+		if err = e.enc.ReconstructData(shards); err != nil {
+			return nil, fmt.Errorf("reconstruct %s: %s", key, err)
+		}
+		if err = e.enc.Join(&buf, shards, int(size)); err != nil {
+			return nil, err
+		}
+	}
+	data := buf.Bytes()
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	data = data[off:]
+	if limit > 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// quorum returns the number of shards to be written for a successful write.
+func (e *erasure) quorum() int {
+	return e.data + (e.parity+1)/2
+}
+
+func (e *erasure) Put(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	shards, err := e.encode(data)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(e.stores))
+	var wg sync.WaitGroup
+	for i := range e.stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = e.stores[i].Put(key, bytes.NewReader(shards[i]))
+		}(i)
+	}
+	wg.Wait()
+	var written int
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			written++
+		} else {
+			logger.Warnf("Put shard %d of %s into %s: %s", i, key, e.stores[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if written < e.quorum() {
+		return fmt.Errorf("only %d shards of %s are written: %s", written, key, firstErr)
+	}
+	return nil
+}
+
+func (e *erasure) Delete(key string) error {
+	var firstErr error
+	for i, s := range e.stores {
+		if err := s.Delete(key); err != nil {
+			logger.Warnf("Delete shard %d of %s from %s: %s", i, key, s, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (e *erasure) Head(key string) (Object, error) {
+	var firstErr error
+	for i, s := range e.stores {
+		o, err := s.Head(key)
+		if err == nil {
+			var in io.ReadCloser
+			if in, err = s.Get(key, 0, shardHeaderSize); err == nil {
+				var header [shardHeaderSize]byte
+				_, err = io.ReadFull(in, header[:])
+				_ = in.Close()
+				if err == nil {
+					return &obj{key, int64(binary.BigEndian.Uint64(header[:])), o.Mtime(), false}, nil
+				}
+			}
+		}
+		logger.Debugf("Head shard %d of %s from %s: %s", i, key, s, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// objectSize returns the maximum size of an object from the size of shards, which includes the padding.
+func (e *erasure) objectSize(o Object) Object {
+	if o.IsDir() || o.Size() < shardHeaderSize {
+		return o
+	}
+	return &obj{o.Key(), (o.Size() - shardHeaderSize) * int64(e.data), o.Mtime(), false}
+}
+
+// List returns the objects having any shard, the sizes of them include the padding.
+func (e *erasure) List(prefix, marker string, limit int64) ([]Object, error) {
+	objs := make(map[string]Object)
+	for _, s := range e.stores {
+		os, err := s.List(prefix, marker, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range os {
+			if _, ok := objs[o.Key()]; !ok {
+				objs[o.Key()] = e.objectSize(o)
+			}
+		}
+	}
+	keys := make([]string, 0, len(objs))
+	for k := range objs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if limit > 0 && int64(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+	result := make([]Object, len(keys))
+	for i, k := range keys {
+		result[i] = objs[k]
+	}
+	return result, nil
+}
+
+// ListAll returns the objects having any shard, the sizes of them include the padding.
+func (e *erasure) ListAll(prefix, marker string) (<-chan Object, error) {
+	heads := &nextObjects{make([]nextKey, 0)}
+	for i := range e.stores {
+		ch, err := ListAll(e.stores[i], prefix, marker)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %s", e.stores[i], err)
+		}
+		first := <-ch
+		if first != nil {
+			heads.Push(nextKey{first, ch})
+		}
+	}
+	heap.Init(heads)
+
+	out := make(chan Object, 1000)
+	go func() {
+		var last string
+		var sent bool
+		for heads.Len() > 0 {
+			n := heap.Pop(heads).(nextKey)
+			if !sent || n.o.Key() != last {
+				out <- e.objectSize(n.o)
+				last, sent = n.o.Key(), true
+			}
+			o := <-n.ch
+			if o != nil {
+				heap.Push(heads, nextKey{o, n.ch})
+			}
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+// RepairShards checks the shards of an object in the erasure-coded storage, and rebuilds the missing
+// or broken ones if repair is true. It returns the index of those shards.
+func RepairShards(s ObjectStorage, key string, repair bool) ([]int, error) {
+	for {
+		switch o := s.(type) {
+		case *withPrefix:
+			key = o.prefix + key
+			s = o.os
+			continue
+		case *erasure:
+			return o.repair(key, repair)
+		}
+		return nil, fmt.Errorf("%s is not erasure-coded", s)
+	}
+}
+
+func (e *erasure) repair(key string, repair bool) ([]int, error) {
+	shards, size, err := e.getShards(key, true)
+	if err != nil {
+		return nil, err
+	}
+	var missing []int
+	for i, p := range shards {
+		if p == nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 || !repair {
+		return missing, nil
+	}
+	if size > 0 {
+		if err = e.enc.Reconstruct(shards); err != nil {
+			return missing, fmt.Errorf("reconstruct %s: %s", key, err)
+		}
+	}
+	for _, i := range missing {
+		if err = e.stores[i].Put(key, bytes.NewReader(newShard(size, shards[i]))); err != nil {
+			return missing, fmt.Errorf("put shard %d of %s into %s: %s", i, key, e.stores[i], err)
+		}
+		logger.Infof("Rebuilt shard %d of %s in %s", i, key, e.stores[i])
+	}
+	return missing, nil
+}
+
+// NewErasure returns an object storage storing each object as `data` data shards and `parity` parity
+// shards in different object storages, which are separated by comma in endpoint or generated from it
+// by the index of shard (like sharding).
+func NewErasure(name, endpoint, ak, sk string, data, parity int) (ObjectStorage, error) {
+	if data <= 0 || parity <= 0 || data+parity > 256 {
+		return nil, fmt.Errorf("invalid erasure code: %d+%d", data, parity)
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := strings.Split(endpoint, ",")
+	if len(endpoints) == 1 {
+		endpoints = make([]string, data+parity)
+		for i := range endpoints {
+			endpoints[i] = fmt.Sprintf(endpoint, i)
+			if strings.HasSuffix(endpoints[i], "%!(EXTRA int=0)") {
+				return nil, fmt.Errorf("can not generate different endpoint using %s", endpoint)
+			}
+		}
+	} else if len(endpoints) != data+parity {
+		return nil, fmt.Errorf("%d endpoints are needed for erasure code %d+%d, but got %d", data+parity, data, parity, len(endpoints))
+	}
+	stores := make([]ObjectStorage, data+parity)
+	for i, ep := range endpoints {
+		stores[i], err = CreateStorage(name, ep, ak, sk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &erasure{stores: stores, data: data, parity: parity, enc: enc}, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErasure(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewErasure("file", filepath.Join(dir, "shard%d")+"/", "", "", 4, 2)
+	if err != nil {
+		t.Fatalf("create erasure: %s", err)
+	}
+	if err = s.Create(); err != nil {
+		t.Fatalf("create %s: %s", s, err)
+	}
+	if err = s.Put("empty", bytes.NewReader(nil)); err != nil {
+		t.Fatalf("put empty: %s", err)
+	}
+	if d, err := get(s, "empty", 0, -1); err != nil || d != "" {
+		t.Fatalf("get empty: %q %v", d, err)
+	}
+
+	e := s.(*erasure)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if err = s.Put("a", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put a: %s", err)
+	}
+	if o, err := s.Head("a"); err != nil || o.Size() != int64(len(data)) {
+		t.Fatalf("head a: %+v %v", o, err)
+	}
+	// lose one data shard and break one parity shard
+	_ = e.stores[1].Delete("a")
+	_ = e.stores[5].Put("a", bytes.NewReader([]byte("broken")))
+	if d, err := get(s, "a", 0, -1); err != nil || d != string(data) {
+		t.Fatalf("get a with 2 lost shards: %v", err)
+	}
+	if d, err := get(s, "a", 9995, 10); err != nil || d != "56789" {
+		t.Fatalf("get the tail of a: %q %v", d, err)
+	}
+	missing, err := RepairShards(WithPrefix(s, ""), "a", false)
+	if err != nil || fmt.Sprint(missing) != "[1 5]" {
+		t.Fatalf("check shards of a: %v %v", missing, err)
+	}
+	if missing, err = RepairShards(s, "a", true); err != nil || len(missing) != 2 {
+		t.Fatalf("repair shards of a: %v %v", missing, err)
+	}
+	if missing, err = RepairShards(s, "a", false); err != nil || len(missing) != 0 {
+		t.Fatalf("shards of a are not repaired: %v %v", missing, err)
+	}
+	for _, i := range []int{0, 2, 4} {
+		_ = e.stores[i].Delete("a")
+	}
+	if _, err = s.Get("a", 0, -1); err == nil {
+		t.Fatalf("get a with 3 lost shards should fail")
+	}
+	if objs, err := listAll(s, "a", "", 100); err != nil || len(objs) != 1 || objs[0].Key() != "a" {
+		t.Fatalf("list objects with some shards: %+v %v", objs, err)
+	}
+
+	// a write succeeds with one lost storage
+	_ = os.RemoveAll(filepath.Join(dir, "shard3"))
+	_ = os.WriteFile(filepath.Join(dir, "shard3"), nil, 0644)
+	if err = s.Put("b", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put b with a lost storage: %s", err)
+	}
+	_ = os.RemoveAll(filepath.Join(dir, "shard2"))
+	_ = os.WriteFile(filepath.Join(dir, "shard2"), nil, 0644)
+	if err = s.Put("c", bytes.NewReader(data)); err == nil {
+		t.Fatalf("put c with 2 lost storages should fail")
+	}
+
+	if _, err = NewErasure("file", filepath.Join(dir, "shard")+"/", "", "", 4, 2); err == nil {
+		t.Fatalf("endpoint without index should fail")
+	}
+	if _, err = NewErasure("file", dir+"/a/,"+dir+"/b/", "", "", 2, 1); err == nil {
+		t.Fatalf("3 endpoints are needed for 2+1")
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyProvider keeps the master key outside of JuiceFS, which wraps (encrypts) the data key of a volume,
+// so only the wrapped data key is stored in the metadata, and it's unwrapped by the clients when mounted.
+type KeyProvider interface {
+	String() string
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// NewKeyProvider creates a KeyProvider by its URI, which is one of:
+//
+//	file:///path/to/keystore      a local file keeping the master key (32 bytes encoded in base64)
+//	env://NAME                    a passphrase in the environment variable NAME
+//	vault://HOST:PORT/MOUNT/KEY   the transit engine of Vault (or a compatible one), the token is read
+//	                              from environment variable VAULT_TOKEN, use vault+http:// for HTTP
+func NewKeyProvider(uri string) (KeyProvider, error) {
+	p := strings.Index(uri, "://")
+	if p < 0 {
+		return nil, fmt.Errorf("invalid key provider: %s", uri)
+	}
+	switch scheme, addr := uri[:p], uri[p+3:]; scheme {
+	case "file":
+		return newFileKeystore(addr)
+	case "env":
+		if addr == "" {
+			return nil, fmt.Errorf("name of environment variable is required: %s", uri)
+		}
+		return &envPassphrase{addr}, nil
+	case "vault", "vault+http":
+		return newVaultTransit(scheme, addr)
+	default:
+		return nil, fmt.Errorf("unknown key provider: %s", scheme)
+	}
+}
+
+type gcmEncryptor struct {
+	aead cipher.AEAD
+}
+
+// NewGCMEncryptor returns an Encryptor using AES-GCM with the key, the nonce is put before the ciphertext.
+func NewGCMEncryptor(key []byte) (Encryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmEncryptor{aead}, nil
+}
+
+func (e *gcmEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plaintext)+e.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e *gcmEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, fmt.Errorf("misformed ciphertext: %d bytes", len(ciphertext))
+	}
+	return e.aead.Open(nil, ciphertext[:n], ciphertext[n:], nil)
+}
+
+type fileKeystore struct {
+	path string
+	enc  Encryptor
+}
+
+func newFileKeystore(p string) (KeyProvider, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("read keystore: %s", err)
+	}
+	if fi, err := os.Stat(p); err == nil && fi.Mode().Perm()&0077 != 0 {
+		logger.Warnf("Keystore %s is accessible by others (mode %s)", p, fi.Mode().Perm())
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decode master key in %s: %s", p, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key in %s should be 32 bytes, but got %d", p, len(key))
+	}
+	enc, err := NewGCMEncryptor(key)
+	if err != nil {
+		return nil, err
+	}
+	return &fileKeystore{p, enc}, nil
+}
+
+func (k *fileKeystore) String() string {
+	return "file://" + k.path
+}
+
+func (k *fileKeystore) WrapKey(key []byte) ([]byte, error) {
+	return k.enc.Encrypt(key)
+}
+
+func (k *fileKeystore) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return k.enc.Decrypt(wrapped)
+}
+
+type envPassphrase struct {
+	name string
+}
+
+const saltSize = 16
+
+func (e *envPassphrase) String() string {
+	return "env://" + e.name
+}
+
+// encryptor derives the master key from the passphrase and salt with scrypt.
+func (e *envPassphrase) encryptor(salt []byte) (Encryptor, error) {
+	passphrase := os.Getenv(e.name)
+	if passphrase == "" {
+		return nil, fmt.Errorf("environment variable %s is empty", e.name)
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return NewGCMEncryptor(key)
+}
+
+func (e *envPassphrase) WrapKey(key []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	enc, err := e.encryptor(salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := enc.Encrypt(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, wrapped...), nil
+}
+
+func (e *envPassphrase) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < saltSize {
+		return nil, fmt.Errorf("misformed wrapped key: %d bytes", len(wrapped))
+	}
+	enc, err := e.encryptor(wrapped[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	key, err := enc.Decrypt(wrapped[saltSize:])
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase in %s: %s", e.name, err)
+	}
+	return key, nil
+}
+
+type vaultTransit struct {
+	endpoint string // like https://HOST:PORT/v1/MOUNT
+	key      string
+}
+
+func newVaultTransit(scheme, addr string) (KeyProvider, error) {
+	parts := strings.SplitN(addr, "/", 2) // HOST:PORT and MOUNT/KEY
+	if len(parts) < 2 || strings.LastIndex(parts[1], "/") <= 0 || strings.HasSuffix(parts[1], "/") {
+		return nil, fmt.Errorf("mount and name of the key are required: %s", addr)
+	}
+	proto := "https"
+	if scheme == "vault+http" {
+		proto = "http"
+	}
+	p := strings.LastIndex(parts[1], "/")
+	return &vaultTransit{fmt.Sprintf("%s://%s/v1/%s", proto, parts[0], parts[1][:p]), parts[1][p+1:]}, nil
+}
+
+func (v *vaultTransit) String() string {
+	return v.endpoint + "/keys/" + v.key
+}
+
+// call posts the request to the operation of the key, and decodes the data in the response.
+func (v *vaultTransit) call(op string, req, resp interface{}) error {
+	body, _ := json.Marshal(req)
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/%s/%s", v.endpoint, op, url.PathEscape(v.key)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	res, err := httpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct{ Errors []string }
+		if json.Unmarshal(data, &e) == nil && len(e.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s", op, path.Base(r.URL.Path), strings.Join(e.Errors, "; "))
+		}
+		return fmt.Errorf("%s %s: status %d", op, path.Base(r.URL.Path), res.StatusCode)
+	}
+	var d struct{ Data json.RawMessage }
+	if err = json.Unmarshal(data, &d); err != nil {
+		return fmt.Errorf("decode response of %s: %s", op, err)
+	}
+	return json.Unmarshal(d.Data, resp)
+}
+
+func (v *vaultTransit) WrapKey(key []byte) ([]byte, error) {
+	var resp struct{ Ciphertext string }
+	err := v.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(resp.Ciphertext), nil
+}
+
+func (v *vaultTransit) UnwrapKey(wrapped []byte) ([]byte, error) {
+	var resp struct{ Plaintext string }
+	if err := v.call("decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,171 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testKeyProvider(t *testing.T, p KeyProvider) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := p.WrapKey(key)
+	if err != nil {
+		t.Fatalf("%s: wrap key: %s", p, err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Fatalf("%s: key is not wrapped: %q", p, wrapped)
+	}
+	unwrapped, err := p.UnwrapKey(wrapped)
+	if err != nil {
+		t.Fatalf("%s: unwrap key: %s", p, err)
+	}
+	if !bytes.Equal(key, unwrapped) {
+		t.Fatalf("%s: unwrapped key %q != %q", p, unwrapped, key)
+	}
+	if _, err = p.UnwrapKey(append([]byte("x"), wrapped...)); err == nil {
+		t.Fatalf("%s: unwrap broken key should fail", p)
+	}
+}
+
+func TestFileKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore")
+	if _, err := NewKeyProvider("file://" + path); err == nil {
+		t.Fatalf("keystore should not exist")
+	}
+	_ = ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600)
+	if _, err := NewKeyProvider("file://" + path); err == nil {
+		t.Fatalf("short master key should be rejected")
+	}
+	_ = ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))+"\n"), 0600)
+	p, err := NewKeyProvider("file://" + path)
+	if err != nil {
+		t.Fatalf("keystore: %s", err)
+	}
+	testKeyProvider(t, p)
+}
+
+func TestEnvPassphrase(t *testing.T) {
+	if _, err := NewKeyProvider("env://"); err == nil {
+		t.Fatalf("name of environment variable is required")
+	}
+	p, _ := NewKeyProvider("env://JFS_TEST_PASSPHRASE")
+	os.Setenv("JFS_TEST_PASSPHRASE", "")
+	if _, err := p.WrapKey([]byte("key")); err == nil {
+		t.Fatalf("empty passphrase should be rejected")
+	}
+	os.Setenv("JFS_TEST_PASSPHRASE", "secret")
+	defer os.Unsetenv("JFS_TEST_PASSPHRASE")
+	testKeyProvider(t, p)
+
+	wrapped, _ := p.WrapKey([]byte("key"))
+	os.Setenv("JFS_TEST_PASSPHRASE", "wrong")
+	if _, err := p.UnwrapKey(wrapped); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("unwrap with wrong passphrase: %v", err)
+	}
+}
+
+// transitStub is a stub of the transit engine of Vault.
+type transitStub struct {
+	sync.Mutex
+	token string
+	keys  map[string][]byte
+}
+
+func (s *transitStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(code int, v interface{}) {
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	if r.Header.Get("X-Vault-Token") != s.token {
+		reply(http.StatusForbidden, map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+	var req map[string]string
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	s.Lock()
+	defer s.Unlock()
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/jfs":
+		plaintext, _ := base64.StdEncoding.DecodeString(req["plaintext"])
+		ciphertext := fmt.Sprintf("vault:v1:%d", len(s.keys))
+		s.keys[ciphertext] = plaintext
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]string{"ciphertext": ciphertext}})
+	case "/v1/transit/decrypt/jfs":
+		plaintext, ok := s.keys[req["ciphertext"]]
+		if !ok {
+			reply(http.StatusBadRequest, map[string][]string{"errors": {"invalid ciphertext"}})
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}})
+	default:
+		reply(http.StatusNotFound, map[string][]string{"errors": {}})
+	}
+}
+
+func TestVaultTransit(t *testing.T) {
+	srv := httptest.NewServer(&transitStub{token: "root", keys: make(map[string][]byte)})
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	if _, err := NewKeyProvider("vault+http://" + addr + "/jfs"); err == nil {
+		t.Fatalf("mount of transit is required")
+	}
+
+	os.Setenv("VAULT_TOKEN", "root")
+	defer os.Unsetenv("VAULT_TOKEN")
+	p, err := NewKeyProvider("vault+http://" + addr + "/transit/jfs")
+	if err != nil {
+		t.Fatalf("vault transit: %s", err)
+	}
+	testKeyProvider(t, p)
+
+	os.Setenv("VAULT_TOKEN", "bad")
+	if _, err = p.WrapKey([]byte("key")); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("wrap with bad token: %v", err)
+	}
+	p, _ = NewKeyProvider("vault+http://" + addr + "/transit/other")
+	if _, err = p.WrapKey([]byte("key")); err == nil {
+		t.Fatalf("wrap with unknown key should fail")
+	}
+}
+
+func TestGCMEncryptedStore(t *testing.T) {
+	s, _ := CreateStorage("mem", "", "", "")
+	kc, err := NewGCMEncryptor(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatalf("gcm encryptor: %s", err)
+	}
+	es := NewEncrypted(s, NewAESEncryptor(kc))
+	_ = es.Put("a", bytes.NewReader([]byte("hello")))
+	r, err := es.Get("a", 0, -1)
+	if err != nil {
+		t.Fatalf("Get a: %s", err)
+	}
+	if d, _ := ioutil.ReadAll(r); string(d) != "hello" {
+		t.Fatalf("read %q", d)
+	}
+}
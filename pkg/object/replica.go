@@ -0,0 +1,128 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+type replicated struct {
+	ObjectStorage
+	replica ObjectStorage
+	timeout time.Duration
+}
+
+// NewReplicated returns an object storage that writes all the objects into both the primary storage and
+// the replica, and reads them from the replica when the primary one fails or doesn't respond in time
+// (0 means no timeout). The multipart uploads and listings only go to the primary storage.
+func NewReplicated(primary, replica ObjectStorage, timeout time.Duration) ObjectStorage {
+	return &replicated{primary, replica, timeout}
+}
+
+func (r *replicated) String() string {
+	return fmt.Sprintf("%s(replica: %s)", r.ObjectStorage, r.replica)
+}
+
+func (r *replicated) Create() error {
+	if err := r.ObjectStorage.Create(); err != nil {
+		return err
+	}
+	return r.replica.Create()
+}
+
+type getResult struct {
+	in  io.ReadCloser
+	err error
+}
+
+// getPrimary reads the object from the primary storage, or gives up after the timeout.
+func (r *replicated) getPrimary(key string, off, limit int64) (io.ReadCloser, error) {
+	if r.timeout <= 0 {
+		return r.ObjectStorage.Get(key, off, limit)
+	}
+	done := make(chan getResult, 1)
+	go func() {
+		in, err := r.ObjectStorage.Get(key, off, limit)
+		done <- getResult{in, err}
+	}()
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.in, res.err
+	case <-timer.C:
+		go func() {
+			if res := <-done; res.in != nil {
+				_ = res.in.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timeout after %s", r.timeout)
+	}
+}
+
+func (r *replicated) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	in, err := r.getPrimary(key, off, limit)
+	if err == nil {
+		return in, nil
+	}
+	in, rerr := r.replica.Get(key, off, limit)
+	if rerr != nil {
+		return nil, err
+	}
+	logger.Warnf("Read %s from replica %s: %s", key, r.replica, err)
+	return in, nil
+}
+
+func (r *replicated) Head(key string) (Object, error) {
+	o, err := r.ObjectStorage.Head(key)
+	if err == nil {
+		return o, nil
+	}
+	if o, rerr := r.replica.Head(key); rerr == nil {
+		return o, nil
+	}
+	return nil, err
+}
+
+func (r *replicated) Put(key string, in io.Reader) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.replica.Put(key, bytes.NewReader(data))
+	}()
+	err = r.ObjectStorage.Put(key, bytes.NewReader(data))
+	if rerr := <-done; rerr != nil && err == nil {
+		err = fmt.Errorf("replica: %s", rerr)
+	}
+	return err
+}
+
+func (r *replicated) Delete(key string) error {
+	if err := r.replica.Delete(key); err != nil {
+		logger.Warnf("Delete %s from replica %s: %s", key, r.replica, err) // it will be found by fsck
+	}
+	return r.ObjectStorage.Delete(key)
+}
+
+var _ ObjectStorage = &replicated{}
@@ -0,0 +1,88 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type slowStore struct {
+	ObjectStorage
+	delay time.Duration
+}
+
+func (s *slowStore) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	time.Sleep(s.delay)
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+type readOnlyStore struct {
+	ObjectStorage
+}
+
+func (s *readOnlyStore) Put(key string, in io.Reader) error {
+	return errors.New("read only")
+}
+
+func TestReplicated(t *testing.T) {
+	primary, _ := newMem("", "", "")
+	replica, _ := newMem("", "", "")
+	testStorage(t, NewReplicated(primary, replica, 0))
+
+	s := NewReplicated(primary, replica, time.Millisecond*100)
+	if err := s.Put("a", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("put a: %s", err)
+	}
+	for _, o := range []ObjectStorage{primary, replica} {
+		if d, err := get(o, "a", 0, -1); err != nil || d != "hello" {
+			t.Fatalf("get a from %s: %q %v", o, d, err)
+		}
+	}
+	_ = primary.Delete("a")
+	if d, err := get(s, "a", 1, 3); err != nil || d != "ell" {
+		t.Fatalf("get a from replica: %q %v", d, err)
+	}
+	if _, err := s.Head("a"); err != nil {
+		t.Fatalf("head a from replica: %s", err)
+	}
+
+	_ = primary.Put("a", bytes.NewReader([]byte("world")))
+	slow := NewReplicated(&slowStore{primary, time.Second}, replica, time.Millisecond*100)
+	start := time.Now()
+	if d, err := get(slow, "a", 0, -1); err != nil || d != "hello" {
+		t.Fatalf("get a from replica after timeout: %q %v", d, err)
+	}
+	if used := time.Since(start); used > time.Millisecond*500 {
+		t.Fatalf("get a from replica took %s", used)
+	}
+
+	if err := s.Delete("a"); err != nil {
+		t.Fatalf("delete a: %s", err)
+	}
+	if _, err := s.Get("a", 0, -1); err == nil {
+		t.Fatalf("a should be deleted from both storages")
+	}
+
+	broken := NewReplicated(primary, &readOnlyStore{replica}, 0)
+	if err := broken.Put("b", bytes.NewReader([]byte("hello"))); err == nil {
+		t.Fatalf("put b should fail when the replica is broken")
+	}
+}
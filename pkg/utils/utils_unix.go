@@ -34,3 +34,9 @@ func GetFileInode(path string) (uint64, error) {
 	}
 	return 0, nil
 }
+
+func GetUmask() int {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return umask
+}
@@ -36,3 +36,7 @@ func GetFileInode(path string) (uint64, error) {
 	}
 	return uint64(data.FileIndexHigh)<<32 + uint64(data.FileIndexLow), nil
 }
+
+func GetUmask() int {
+	return 0
+}
@@ -28,7 +28,7 @@ var (
 	revisionDate = "$Format:%as$"
 	ver          = Semver{
 		major:      1,
-		minor:      0,
+		minor:      1,
 		patch:      0,
 		preRelease: "dev",
 		build:      fmt.Sprintf("%s.%s", revisionDate, revision),
@@ -56,25 +56,30 @@ func Compare(vs string) (int, error) {
 	if v == nil {
 		return 1, fmt.Errorf("invalid version string: %s", vs)
 	}
+	return ver.Compare(v), nil
+}
+
+// Compare returns -1, 0 or 1 if the version is lower than, equal to or higher than v.
+func (s *Semver) Compare(v *Semver) int {
 	var less bool
-	if ver.major != v.major {
-		less = ver.major < v.major
-	} else if ver.minor != v.minor {
-		less = ver.minor < v.minor
-	} else if ver.patch != v.patch {
-		less = ver.patch < v.patch
-	} else if ver.preRelease != v.preRelease {
-		less = ver.preRelease < v.preRelease
-		if ver.preRelease == "" || v.preRelease == "" {
+	if s.major != v.major {
+		less = s.major < v.major
+	} else if s.minor != v.minor {
+		less = s.minor < v.minor
+	} else if s.patch != v.patch {
+		less = s.patch < v.patch
+	} else if s.preRelease != v.preRelease {
+		less = s.preRelease < v.preRelease
+		if s.preRelease == "" || v.preRelease == "" {
 			less = !less
 		}
 	} else {
-		return 0, nil
+		return 0
 	}
 	if less {
-		return -1, nil
+		return -1
 	} else {
-		return 1, nil
+		return 1
 	}
 }
 
@@ -21,6 +21,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
@@ -30,7 +31,7 @@ import (
 )
 
 // Backup metadata periodically in the object storage
-func Backup(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
+func Backup(m meta.Meta, blob object.ObjectStorage, interval time.Duration, format meta.DumpFormat) {
 	ctx := meta.Background
 	key := "lastBackup"
 	for {
@@ -63,7 +64,7 @@ func Backup(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
 			}
 			go cleanupBackups(blob, now)
 			logger.Debugf("backup metadata started")
-			if err = backup(m, blob, now); err == nil {
+			if err = backup(m, blob, now, format); err == nil {
 				logger.Infof("backup metadata succeed, used %s", time.Since(now))
 			} else {
 				logger.Warnf("backup metadata failed: %s", err)
@@ -72,8 +73,16 @@ func Backup(m meta.Meta, blob object.ObjectStorage, interval time.Duration) {
 	}
 }
 
-func backup(m meta.Meta, blob object.ObjectStorage, now time.Time) error {
-	name := "dump-" + now.UTC().Format("2006-01-02-150405") + ".json.gz"
+// backupSuffixes are the suffixes of backups in JSON (compressed by gzip) and binary formats.
+var backupSuffixes = []string{".json.gz", ".bin"}
+
+func backup(m meta.Meta, blob object.ObjectStorage, now time.Time, format meta.DumpFormat) error {
+	name := "dump-" + now.UTC().Format("2006-01-02-150405")
+	if format == meta.DumpJSON {
+		name += backupSuffixes[0]
+	} else {
+		name += backupSuffixes[1]
+	}
 	fpath := "/tmp/juicefs-meta-" + name
 	fp, err := os.OpenFile(fpath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0444)
 	if err != nil {
@@ -81,9 +90,13 @@ func backup(m meta.Meta, blob object.ObjectStorage, now time.Time) error {
 	}
 	defer os.Remove(fpath)
 	defer fp.Close()
-	zw := gzip.NewWriter(fp)
-	err = m.DumpMeta(zw, 0) // force dump the whole tree
-	_ = zw.Close()
+	if format == meta.DumpJSON {
+		zw := gzip.NewWriter(fp)
+		err = m.DumpMeta(zw, 0, format) // force dump the whole tree
+		_ = zw.Close()
+	} else {
+		err = m.DumpMeta(fp, 0, format)
+	}
 	if err != nil {
 		return err
 	}
@@ -115,6 +128,15 @@ func cleanupBackups(blob object.ObjectStorage, now time.Time) {
 	}
 }
 
+func validBackupName(name string) bool {
+	for _, suffix := range backupSuffixes {
+		if len(name) == 22+len(suffix) && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 // Cleanup policy:
 // 1. keep all backups within 2 days
 // 2. keep one backup each day within 2 weeks
@@ -139,7 +161,7 @@ func rotate(objs []string, now time.Time) []string {
 	var toDel, within []string
 	sort.Strings(objs)
 	for i := len(objs) - 1; i >= 0; i-- {
-		if len(objs[i]) != 30 { // len("dump-2006-01-02-150405.json.gz")
+		if !validBackupName(objs[i]) { // dump-2006-01-02-150405.json.gz or dump-2006-01-02-150405.bin
 			logger.Warnf("bad object for metadata backup %s: length %d", objs[i], len(objs[i]))
 			continue
 		}
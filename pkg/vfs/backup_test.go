@@ -20,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
 	osync "github.com/juicedata/juicefs/pkg/sync"
 )
@@ -69,7 +70,7 @@ func TestRotate(t *testing.T) {
 
 func TestBackup(t *testing.T) {
 	v, blob := createTestVFS()
-	go Backup(v.Meta, blob, time.Millisecond*100)
+	go Backup(v.Meta, blob, time.Millisecond*100, meta.DumpJSON)
 	time.Sleep(time.Millisecond * 100)
 
 	blob = object.WithPrefix(blob, "meta/")
@@ -63,6 +63,7 @@ func Compact(conf chunk.Config, store chunk.ChunkStore, slices []meta.Slice, chu
 	logger.Debugf("compact %d slices (%d bytes) to chunk %d", len(slices), size, chunkid)
 
 	writer := store.NewWriter(chunkid)
+	writer.SetTier(sliceTier(store, slices))
 
 	var pos int
 	for i, s := range slices {
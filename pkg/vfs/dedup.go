@@ -0,0 +1,69 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+type dedupIndex struct {
+	m meta.Meta
+}
+
+// NewDedupIndex returns a DedupIndex which records the shared blocks in the meta engine.
+func NewDedupIndex(m meta.Meta) chunk.DedupIndex {
+	return &dedupIndex{m}
+}
+
+func (d *dedupIndex) RefBlock(hash []byte, b chunk.Block) (*chunk.Block, error) {
+	var owner meta.Block
+	st := d.m.RefBlock(meta.Background, hash, &meta.Block{Chunkid: b.Chunkid, Indx: b.Indx, Size: b.Size}, &owner)
+	if st == syscall.ENOENT {
+		return nil, nil
+	} else if st != 0 {
+		return nil, st
+	}
+	return &chunk.Block{Chunkid: owner.Chunkid, Indx: owner.Indx, Size: owner.Size}, nil
+}
+
+func (d *dedupIndex) AddBlock(hash []byte, b chunk.Block) error {
+	if st := d.m.AddBlock(meta.Background, hash, &meta.Block{Chunkid: b.Chunkid, Indx: b.Indx, Size: b.Size}); st != 0 {
+		return st
+	}
+	return nil
+}
+
+func (d *dedupIndex) FindBlock(chunkid uint64, indx uint32) (*chunk.Block, error) {
+	var owner meta.Block
+	st := d.m.FindBlock(meta.Background, chunkid, indx, &owner)
+	if st == syscall.ENOENT {
+		return nil, nil
+	} else if st != 0 {
+		return nil, st
+	}
+	return &chunk.Block{Chunkid: owner.Chunkid, Indx: owner.Indx, Size: owner.Size}, nil
+}
+
+func (d *dedupIndex) DerefSlice(chunkid uint64, size uint32) error {
+	if st := d.m.DerefSlice(meta.Background, chunkid, size); st != 0 {
+		return st
+	}
+	return nil
+}
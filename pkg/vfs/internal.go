@@ -18,6 +18,7 @@ package vfs
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
@@ -38,6 +39,7 @@ const (
 	statsInode      = minInternalNode + 3
 	configInode     = minInternalNode + 4
 	trashInode      = meta.TrashInode
+	snapshotInode   = meta.SnapshotInode
 )
 
 type internalNode struct {
@@ -52,6 +54,7 @@ var internalNodes = []*internalNode{
 	{statsInode, ".stats", &Attr{Mode: 0444}},
 	{configInode, ".config", &Attr{Mode: 0400}},
 	{trashInode, meta.TrashName, &Attr{Mode: 0555}},
+	{snapshotInode, meta.SnapshotName, &Attr{Mode: 0555}},
 }
 
 func init() {
@@ -59,7 +62,7 @@ func init() {
 	gid := uint32(os.Getgid())
 	now := time.Now().Unix()
 	for _, v := range internalNodes {
-		if v.inode == trashInode {
+		if v.inode == trashInode || v.inode == snapshotInode {
 			v.attr.Typ = meta.TypeDirectory
 			v.attr.Nlink = 2
 		} else {
@@ -156,6 +159,19 @@ func collectMetrics(registry *prometheus.Registry) []byte {
 	return w.Bytes()
 }
 
+// sharedBytes returns the bytes of a slice stored in the blocks of other slices.
+func (v *VFS) sharedBytes(ctx Context, chunkid uint64, size uint32) uint64 {
+	var shared uint64
+	bsize := uint32(v.Conf.Chunk.BlockSize)
+	for indx := uint32(0); indx*bsize < size; indx++ {
+		var owner meta.Block
+		if v.Meta.FindBlock(ctx, chunkid, indx, &owner) == 0 && (owner.Chunkid != chunkid || owner.Indx != indx) {
+			shared += uint64(owner.Size)
+		}
+	}
+	return shared
+}
+
 func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte {
 	switch cmd {
 	case meta.Rmr:
@@ -185,15 +201,29 @@ func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte
 		fmt.Fprintf(w, " length:\t%d\n", summary.Length)
 		fmt.Fprintf(w, " size:\t%d\n", summary.Size)
 
+		dedup := v.Conf.Format.Dedup
 		if summary.Files == 1 && summary.Dirs == 0 {
+			var shared uint64
 			fmt.Fprintf(w, " chunks:\n")
 			for indx := uint64(0); indx*meta.ChunkSize < summary.Length; indx++ {
 				var cs []meta.Slice
 				_ = v.Meta.Read(ctx, inode, uint32(indx), &cs)
 				for _, c := range cs {
 					fmt.Fprintf(w, "\t%d:\t%d\t%d\t%d\t%d\n", indx, c.Chunkid, c.Size, c.Off, c.Len)
+					if dedup && c.Chunkid > 0 {
+						shared += v.sharedBytes(ctx, c.Chunkid, c.Size)
+					}
 				}
 			}
+			if dedup {
+				fmt.Fprintf(w, " shared:\t%d\n", shared)
+			}
+		} else if dedup && inode == rootID {
+			var st meta.DedupStat
+			if r := meta.GetDedupStat(v.Meta, ctx, &st); r == 0 {
+				fmt.Fprintf(w, " unique blocks:\t%d (%d bytes)\n", st.Blocks, st.Size)
+				fmt.Fprintf(w, " dedup ratio:\t%.2f\n", st.Ratio())
+			}
 		}
 		wb.Put32(uint32(w.Len()))
 		return append(wb.Bytes(), w.Bytes()...)
@@ -207,6 +237,45 @@ func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte
 			go v.fillCache(paths, int(concurrent))
 		}
 		return []byte{uint8(0)}
+	case meta.Clone:
+		srcIno := Ino(r.Get64())
+		dstParent := Ino(r.Get64())
+		dstName := string(r.Get(int(r.Get8())))
+		cmode := r.Get8()
+		cumask := r.Get16()
+		r := v.Meta.Clone(ctx, srcIno, dstParent, dstName, cmode, cumask, nil, nil)
+		return []byte{uint8(r)}
+	case meta.Watch:
+		inode := Ino(r.Get64())
+		cursor := r.Get64()
+		latest := r.Get8()
+		limit := int(r.Get32())
+		timeout := time.Millisecond * time.Duration(r.Get32())
+		var w = bytes.NewBuffer(nil)
+		st := v.Meta.Access(ctx, inode, MODE_MASK_R, nil)
+		if st == 0 && latest != 0 {
+			var err error
+			if cursor, err = v.Meta.LastChange(ctx); err != nil {
+				logger.Warnf("get the last change: %s", err)
+				st = syscall.EIO
+			}
+		}
+		if st == 0 {
+			watcher := v.watchers.Get(v.Meta, inode, cursor)
+			var changes []*meta.Change
+			changes, st = watcher.Next(ctx, limit, timeout)
+			v.watchers.Put(inode, watcher)
+			cursor = watcher.Cursor()
+			enc := json.NewEncoder(w)
+			for _, c := range changes {
+				_ = enc.Encode(c)
+			}
+		}
+		wb := utils.NewBuffer(4 + 1 + 8)
+		wb.Put32(uint32(1 + 8 + w.Len()))
+		wb.Put8(uint8(st))
+		wb.Put64(cursor)
+		return append(wb.Bytes(), w.Bytes()...)
 	default:
 		logger.Warnf("unknown message type: %d", cmd)
 		return []byte{uint8(syscall.EINVAL & 0xff)}
@@ -0,0 +1,80 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// KernelCache invalidates the caches in kernel, it's implemented by the FUSE server.
+type KernelCache interface {
+	// InvalidateEntry invalidates the cached entry name under parent.
+	InvalidateEntry(parent Ino, name string) syscall.Errno
+	// InvalidateInode invalidates the cached attributes of an inode, and the cached data in [off, off+length)
+	// if off >= 0 (to the end if length <= 0).
+	InvalidateInode(inode Ino, off, length int64) syscall.Errno
+}
+
+// SetKernelCache sets the kernel caches to be invalidated when other clients change the files.
+func (v *VFS) SetKernelCache(kc KernelCache) {
+	v.kernelCache.Store(kc)
+}
+
+// invalidateCache drops the caches of a change made by other clients.
+func (v *VFS) invalidateCache(c *meta.Change) {
+	switch c.Op {
+	case meta.ChangeWrite, meta.ChangeTruncate:
+		if len(v.findAllHandles(c.Inode)) > 0 {
+			var attr Attr
+			if st := v.Meta.GetAttr(meta.Background, c.Inode, &attr); st == 0 {
+				v.UpdateLength(c.Inode, &attr)
+				v.reader.Invalidate(c.Inode, 0, attr.Length)
+			}
+		}
+		v.invalidateInode(c.Inode, 0, 0)
+	case meta.ChangeSetAttr, meta.ChangeSetXattr, meta.ChangeRemoveXattr:
+		v.invalidateInode(c.Inode, -1, 0)
+	default: // the changes of entries
+		v.invalidateEntry(c.Parent, c.Name)
+		v.invalidateInode(c.Parent, -1, 0)
+		if c.DstParent > 0 {
+			v.invalidateEntry(c.DstParent, c.DstName)
+			v.invalidateInode(c.DstParent, -1, 0)
+		}
+		if c.Inode > 0 {
+			v.invalidateInode(c.Inode, -1, 0) // nlink and ctime
+		}
+	}
+}
+
+func (v *VFS) invalidateEntry(parent Ino, name string) {
+	if kc, ok := v.kernelCache.Load().(KernelCache); ok {
+		if st := kc.InvalidateEntry(parent, name); st != 0 && st != syscall.ENOENT {
+			logger.Debugf("invalidate entry %s of %d: %s", name, parent, st)
+		}
+	}
+}
+
+func (v *VFS) invalidateInode(inode Ino, off, length int64) {
+	if kc, ok := v.kernelCache.Load().(KernelCache); ok {
+		if st := kc.InvalidateInode(inode, off, length); st != 0 && st != syscall.ENOENT {
+			logger.Debugf("invalidate inode %d: %s", inode, st)
+		}
+	}
+}
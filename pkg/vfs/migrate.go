@@ -0,0 +1,300 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// The data of existing files is moved between tiers slice by slice. A slice is copied into the target tier
+// before its record is updated, then it's removed from the source tier, so the readers failed to find it
+// in the source tier will retry with the new location. The slices deleted during the copy are checked after
+// recording the new location, and the copies of them are removed. An interrupted migration can be resumed by
+// running it again, the slices already in the target tier are skipped. The packed slices and the ones with
+// shared blocks are kept in the primary storage.
+
+var errSliceDeleted = errors.New("slice is deleted")
+
+// MigrateConfig contains the options of a migration.
+type MigrateConfig struct {
+	To        uint8         // the target tier
+	OlderThan time.Duration // only the files not modified for this long are migrated (0 means all)
+	Threads   int
+	DryRun    bool
+}
+
+// MigrateStat is the statistics of a migration.
+type MigrateStat struct {
+	Files   int64 // number of files scanned
+	Slices  int64 // number of slices migrated
+	Bytes   int64 // bytes of slices migrated
+	Skipped int64 // number of slices can't be migrated
+	Failed  int64 // number of slices failed to migrate
+}
+
+func (s *MigrateStat) String() string {
+	return fmt.Sprintf("scanned %d files, migrated %d slices (%d bytes), skipped %d slices, failed %d slices",
+		atomic.LoadInt64(&s.Files), atomic.LoadInt64(&s.Slices), atomic.LoadInt64(&s.Bytes),
+		atomic.LoadInt64(&s.Skipped), atomic.LoadInt64(&s.Failed))
+}
+
+type Migrator struct {
+	MigrateStat
+	OnScan    func()           // called after a file is scanned
+	OnMigrate func(size int64) // called after a slice is migrated
+
+	m         meta.Meta
+	store     chunk.ChunkStore
+	conf      MigrateConfig
+	blockSize int
+	before    int64
+
+	sync.Mutex
+	visited map[uint64]bool
+}
+
+// NewMigrator returns a Migrator which moves the data of files into the target tier.
+func NewMigrator(m meta.Meta, store chunk.ChunkStore, blockSize int, conf MigrateConfig) *Migrator {
+	if conf.Threads <= 0 {
+		conf.Threads = 1
+	}
+	return &Migrator{
+		m:         m,
+		store:     store,
+		conf:      conf,
+		blockSize: blockSize,
+		visited:   make(map[uint64]bool),
+	}
+}
+
+// Run migrates the files under the path (within the volume).
+func (mg *Migrator) Run(path string) error {
+	var inode Ino
+	var attr Attr
+	if st := mg.resolve(path, &inode, &attr); st != 0 {
+		return fmt.Errorf("resolve %s: %s", path, st)
+	}
+	mg.before = time.Now().Add(-mg.conf.OlderThan).Unix()
+	todo := make(chan *meta.Entry, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < mg.conf.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range todo {
+				mg.migrateFile(e.Inode, e.Attr)
+			}
+		}()
+	}
+	if attr.Typ == meta.TypeDirectory {
+		mg.walk(inode, todo)
+	} else if attr.Typ == meta.TypeFile {
+		todo <- &meta.Entry{Inode: inode, Attr: &attr}
+	}
+	close(todo)
+	wg.Wait()
+	if n := atomic.LoadInt64(&mg.Failed); n > 0 {
+		return fmt.Errorf("%d slices failed to migrate", n)
+	}
+	return nil
+}
+
+func (mg *Migrator) resolve(path string, inode *Ino, attr *Attr) syscall.Errno {
+	*inode = rootID
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if st := mg.m.Lookup(meta.Background, *inode, name, inode, attr); st != 0 {
+			return st
+		}
+	}
+	if *inode == rootID {
+		return mg.m.GetAttr(meta.Background, *inode, attr)
+	}
+	return 0
+}
+
+func (mg *Migrator) walk(inode Ino, todo chan *meta.Entry) {
+	pending := []Ino{inode}
+	for len(pending) > 0 {
+		inode = pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		var entries []*meta.Entry
+		if st := mg.m.Readdir(meta.Background, inode, 1, &entries); st != 0 {
+			logger.Warnf("readdir %d: %s", inode, st)
+			continue
+		}
+		for _, e := range entries {
+			name := string(e.Name)
+			if name == "." || name == ".." {
+				continue
+			}
+			if e.Attr.Typ == meta.TypeDirectory {
+				pending = append(pending, e.Inode)
+			} else if e.Attr.Typ == meta.TypeFile {
+				todo <- e
+			}
+		}
+	}
+}
+
+func (mg *Migrator) migrateFile(inode Ino, attr *Attr) {
+	atomic.AddInt64(&mg.Files, 1)
+	if mg.OnScan != nil {
+		defer mg.OnScan()
+	}
+	if mg.conf.OlderThan > 0 && attr.Mtime >= mg.before {
+		return
+	}
+	for indx := uint64(0); indx*meta.ChunkSize < attr.Length; indx++ {
+		var slices []meta.Slice
+		if st := mg.m.Read(meta.Background, inode, uint32(indx), &slices); st != 0 {
+			logger.Warnf("read slices of inode %d index %d: %s", inode, indx, st)
+			atomic.AddInt64(&mg.Failed, 1)
+			return
+		}
+		for _, s := range slices {
+			if s.Chunkid == 0 || !mg.visit(s.Chunkid) {
+				continue
+			}
+			if err := mg.migrateSlice(inode, uint32(indx), s.Chunkid, s.Size); err != nil {
+				logger.Warnf("migrate slice %d of inode %d: %s", s.Chunkid, inode, err)
+				atomic.AddInt64(&mg.Failed, 1)
+			}
+		}
+	}
+}
+
+// visit returns false if the slice was visited before.
+func (mg *Migrator) visit(chunkid uint64) bool {
+	mg.Lock()
+	defer mg.Unlock()
+	if mg.visited[chunkid] {
+		return false
+	}
+	mg.visited[chunkid] = true
+	return true
+}
+
+// movable returns false if the slice is packed or has shared blocks.
+func (mg *Migrator) movable(chunkid uint64, size uint32) bool {
+	ctx := meta.Background
+	var ps meta.PackedSlice
+	if mg.m.GetPacked(ctx, chunkid, &ps) == 0 {
+		return false
+	}
+	var b meta.Block
+	for indx := uint32(0); int(indx)*mg.blockSize < int(size); indx++ {
+		if mg.m.FindBlock(ctx, chunkid, indx, &b) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (mg *Migrator) migrateSlice(inode Ino, indx uint32, chunkid uint64, size uint32) error {
+	from, err := mg.store.SliceTier(chunkid)
+	if err != nil {
+		return err
+	}
+	if from == mg.conf.To {
+		return nil
+	}
+	if from == 0 && !mg.movable(chunkid, size) {
+		atomic.AddInt64(&mg.Skipped, 1)
+		return nil
+	}
+	if mg.conf.DryRun {
+		logger.Debugf("slice %d (%d bytes) will be migrated from tier %d into %d", chunkid, size, from, mg.conf.To)
+	} else if err = MigrateSlice(mg.m, mg.store, inode, indx, chunkid, size, from, mg.conf.To); err == errSliceDeleted {
+		atomic.AddInt64(&mg.Skipped, 1)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	atomic.AddInt64(&mg.Slices, 1)
+	atomic.AddInt64(&mg.Bytes, int64(size))
+	if mg.OnMigrate != nil {
+		mg.OnMigrate(int64(size))
+	}
+	return nil
+}
+
+// MigrateSlice moves a slice of the chunk (indx) of a file from one tier into another.
+func MigrateSlice(m meta.Meta, store chunk.ChunkStore, inode Ino, indx uint32, chunkid uint64, size uint32, from, to uint8) error {
+	if err := store.CopySlice(chunkid, int(size), from, to); err != nil {
+		return err
+	}
+	if st := m.SetSliceTier(meta.Background, chunkid, to); st != 0 {
+		_ = store.RemoveSlice(chunkid, int(size), to)
+		return fmt.Errorf("set tier of slice %d: %s", chunkid, st)
+	}
+	// the slice could be deleted (from the source tier) before its tier is updated
+	if used, err := sliceUsed(m, inode, indx, chunkid); err != nil {
+		logger.Warnf("check slice %d of inode %d: %s", chunkid, inode, err)
+	} else if !used {
+		logger.Debugf("slice %d is deleted during migration, remove it from tier %d", chunkid, to)
+		_ = m.SetSliceTier(meta.Background, chunkid, from)
+		_ = store.RemoveSlice(chunkid, int(size), to)
+		return errSliceDeleted
+	}
+	logger.Debugf("migrated slice %d (%d bytes) from tier %d into %d", chunkid, size, from, to)
+	if err := store.RemoveSlice(chunkid, int(size), from); err != nil {
+		logger.Warnf("remove slice %d from tier %d: %s", chunkid, from, err) // it's leaked
+	}
+	return nil
+}
+
+// sliceUsed returns false if the slice is not used by the chunk of the file anymore.
+func sliceUsed(m meta.Meta, inode Ino, indx uint32, chunkid uint64) (bool, error) {
+	var slices []meta.Slice
+	if st := m.Read(meta.Background, inode, indx, &slices); st == syscall.ENOENT {
+		return false, nil
+	} else if st != 0 {
+		return false, st
+	}
+	for _, s := range slices {
+		if s.Chunkid == chunkid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MigrateTiers migrates the files in the volume every hour, it's used by the clients in background.
+func MigrateTiers(m meta.Meta, store chunk.ChunkStore, blockSize int, conf MigrateConfig) {
+	for {
+		utils.SleepWithJitter(time.Hour)
+		mg := NewMigrator(m, store, blockSize, conf)
+		start := time.Now()
+		if err := mg.Run("/"); err != nil {
+			logger.Warnf("migrate files into tier %d: %s", conf.To, err)
+		}
+		logger.Infof("migrate files into tier %d: %s in %s", conf.To, &mg.MigrateStat, time.Since(start))
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+type packIndex struct {
+	m meta.Meta
+}
+
+// NewPackIndex returns a PackIndex which records the packed slices in the meta engine.
+func NewPackIndex(m meta.Meta) chunk.PackIndex {
+	return &packIndex{m}
+}
+
+func (p *packIndex) NewPack() (uint64, error) {
+	var id uint64
+	if st := p.m.NewChunk(meta.Background, &id); st != 0 {
+		return 0, st
+	}
+	return id, nil
+}
+
+func (p *packIndex) AddPack(pack uint64, size uint32, slices []chunk.PackedSlice) error {
+	ps := make([]meta.PackedSlice, len(slices))
+	for i, s := range slices {
+		ps[i] = meta.PackedSlice{Chunkid: s.Chunkid, Off: s.Off, Len: s.Len}
+	}
+	if st := p.m.AddPack(meta.Background, &meta.Pack{Id: pack, Size: size}, ps); st != 0 {
+		return st
+	}
+	return nil
+}
+
+func (p *packIndex) FindPacked(chunkid uint64) (*chunk.PackedSlice, error) {
+	var s meta.PackedSlice
+	st := p.m.GetPacked(meta.Background, chunkid, &s)
+	if st == syscall.ENOENT {
+		return nil, nil
+	} else if st != 0 {
+		return nil, st
+	}
+	return &chunk.PackedSlice{Chunkid: s.Chunkid, Pack: s.Pack, Off: s.Off, Len: s.Len}, nil
+}
+
+// Repack writes the live slices of the old pack into a new one, and updates the locations of them.
+func Repack(store chunk.ChunkStore, old uint64, slices []meta.PackedSlice, pack *meta.Pack) error {
+	cs := make([]chunk.PackedSlice, len(slices))
+	for i, s := range slices {
+		cs[i] = chunk.PackedSlice{Chunkid: s.Chunkid, Pack: s.Pack, Off: s.Off, Len: s.Len}
+	}
+	size, err := store.Repack(old, cs, pack.Id)
+	if err != nil {
+		return err
+	}
+	logger.Debugf("repack %d slices from pack %d into %d (%d bytes)", len(slices), old, pack.Id, size)
+	pack.Size = size
+	for i, s := range cs {
+		slices[i].Pack, slices[i].Off = s.Pack, s.Off
+	}
+	return nil
+}
@@ -202,9 +202,17 @@ func (s *sliceReader) run() {
 
 	p := s.page.Slice(0, int(need))
 	defer p.Release()
-	var n int
+	n := -1
 	ctx := context.TODO()
-	n = f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize)
+	if indx == 0 && need > 0 && !hasData(chunks) {
+		if n = f.r.readInline(inode, p, s.block.off); n < 0 {
+			// the file could be promoted after the chunks were read
+			err = f.r.m.Read(meta.Background, inode, indx, &chunks)
+		}
+	}
+	if n < 0 && err == 0 {
+		n = f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize)
+	}
 
 	f.Lock()
 	if s.state != BUSY || f.shouldStop() {
@@ -806,6 +814,34 @@ func (r *dataReader) readSlice(ctx context.Context, s *meta.Slice, page *chunk.P
 	return nil
 }
 
+// hasData returns true if any of the slices has data in object storage.
+func hasData(chunks []meta.Slice) bool {
+	for _, s := range chunks {
+		if s.Chunkid > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// readInline reads the data of a file stored inline in meta engine, it returns -1 if the file is not inline.
+func (r *dataReader) readInline(inode Ino, page *chunk.Page, off uint64) int {
+	var attr meta.Attr
+	var data []byte
+	if r.m.ReadInline(meta.Background, inode, &attr, &data) != 0 {
+		return -1
+	}
+	buf := page.Data
+	var n int
+	if off < uint64(len(data)) {
+		n = copy(buf, data[off:])
+	}
+	for ; n < len(buf); n++ {
+		buf[n] = 0
+	}
+	return n
+}
+
 func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) int {
 	if len(chunks) > 16 {
 		return r.readManyChunks(ctx, page, chunks, offset)
@@ -0,0 +1,304 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// A scrub reads all the blocks used by files from the object storage, so the lost objects and the ones
+// failed to be decrypted, decompressed or verified are found. The store used by it should not have any
+// cache. A slice shared by multiple files is read only once, but all of them are reported if it's damaged.
+// The files are scrubbed in the order of inode, the progress is saved into the checkpoint after
+// every batch of files, so an interrupted scrub can be resumed from there.
+
+const scrubBatch = 1000 // number of files scrubbed between checkpoints
+
+// ScrubConfig contains the options of a scrub.
+type ScrubConfig struct {
+	Threads    int
+	Checkpoint string // the file to save the progress (empty means no checkpoint)
+}
+
+// ScrubStat is the statistics of a scrub.
+type ScrubStat struct {
+	Files   int64 // number of files scrubbed
+	Slices  int64 // number of slices scrubbed
+	Bytes   int64 // bytes of slices scrubbed
+	Damaged int64 // number of damaged slices
+}
+
+func (s *ScrubStat) String() string {
+	return fmt.Sprintf("scrubbed %d files, %d slices (%d bytes), found %d damaged slices",
+		atomic.LoadInt64(&s.Files), atomic.LoadInt64(&s.Slices), atomic.LoadInt64(&s.Bytes),
+		atomic.LoadInt64(&s.Damaged))
+}
+
+type scrubCheckpoint struct {
+	Inode   Ino // the files with smaller inodes are scrubbed
+	Stat    ScrubStat
+	Damaged map[Ino]string
+}
+
+type Scrubber struct {
+	ScrubStat
+	OnSlice func(size int64) // called after a slice is scrubbed
+
+	m         meta.Meta
+	store     chunk.ChunkStore
+	conf      ScrubConfig
+	blockSize int
+
+	sync.Mutex
+	visited map[uint64]*scrubbedSlice
+	damaged map[Ino]string
+}
+
+// scrubbedSlice is the result of reading a slice, which is shared by all the files referring to it.
+type scrubbedSlice struct {
+	done chan struct{}
+	err  error
+}
+
+// NewScrubber returns a Scrubber which reads all the data of a volume from the store.
+func NewScrubber(m meta.Meta, store chunk.ChunkStore, blockSize int, conf ScrubConfig) *Scrubber {
+	if conf.Threads <= 0 {
+		conf.Threads = 1
+	}
+	return &Scrubber{
+		m:         m,
+		store:     store,
+		conf:      conf,
+		blockSize: blockSize,
+		visited:   make(map[uint64]*scrubbedSlice),
+		damaged:   make(map[Ino]string),
+	}
+}
+
+// DamagedFiles returns the paths of damaged files (or the errors of finding them) by inode.
+func (sc *Scrubber) DamagedFiles() map[Ino]string {
+	sc.Lock()
+	defer sc.Unlock()
+	damaged := make(map[Ino]string, len(sc.damaged))
+	for inode, p := range sc.damaged {
+		damaged[inode] = p
+	}
+	return damaged
+}
+
+func (sc *Scrubber) loadCheckpoint() (Ino, error) {
+	if sc.conf.Checkpoint == "" {
+		return 0, nil
+	}
+	data, err := ioutil.ReadFile(sc.conf.Checkpoint)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var cp scrubCheckpoint
+	if err = json.Unmarshal(data, &cp); err != nil {
+		return 0, fmt.Errorf("parse checkpoint %s: %s", sc.conf.Checkpoint, err)
+	}
+	sc.ScrubStat = cp.Stat
+	for inode, p := range cp.Damaged {
+		sc.damaged[inode] = p
+	}
+	logger.Infof("Resume scrubbing from inode %d: %s", cp.Inode, &sc.ScrubStat)
+	return cp.Inode, nil
+}
+
+func (sc *Scrubber) saveCheckpoint(inode Ino) {
+	if sc.conf.Checkpoint == "" {
+		return
+	}
+	cp := scrubCheckpoint{Inode: inode, Damaged: sc.DamagedFiles()}
+	cp.Stat = ScrubStat{
+		Files:   atomic.LoadInt64(&sc.Files),
+		Slices:  atomic.LoadInt64(&sc.Slices),
+		Bytes:   atomic.LoadInt64(&sc.Bytes),
+		Damaged: atomic.LoadInt64(&sc.Damaged),
+	}
+	data, _ := json.Marshal(&cp)
+	tmp := sc.conf.Checkpoint + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, sc.conf.Checkpoint)
+	}
+	if err != nil {
+		logger.Warnf("save checkpoint %s: %s", sc.conf.Checkpoint, err)
+	}
+}
+
+type scrubTask struct {
+	inode Ino
+	slice meta.Slice
+}
+
+// Run scrubs all the files in the volume, the checkpoint is removed once it's finished.
+func (sc *Scrubber) Run() error {
+	start, err := sc.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	slices := make(map[Ino][]meta.Slice)
+	if st := sc.m.ListSlices(meta.Background, slices, false, nil); st != 0 {
+		return fmt.Errorf("list slices: %s", st)
+	}
+	inodes := make([]Ino, 0, len(slices))
+	for inode := range slices {
+		if inode > start {
+			inodes = append(inodes, inode)
+		}
+	}
+	sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+
+	for len(inodes) > 0 {
+		batch := inodes
+		if len(batch) > scrubBatch {
+			batch = batch[:scrubBatch]
+		}
+		inodes = inodes[len(batch):]
+		todo := make(chan scrubTask, 1000)
+		var wg sync.WaitGroup
+		for i := 0; i < sc.conf.Threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for t := range todo {
+					sc.scrubSlice(t.inode, &t.slice)
+				}
+			}()
+		}
+		for _, inode := range batch {
+			for _, s := range slices[inode] {
+				todo <- scrubTask{inode, s}
+			}
+			delete(slices, inode)
+		}
+		close(todo)
+		wg.Wait()
+		atomic.AddInt64(&sc.Files, int64(len(batch)))
+		sc.saveCheckpoint(batch[len(batch)-1])
+	}
+	if sc.conf.Checkpoint != "" {
+		_ = os.Remove(sc.conf.Checkpoint)
+	}
+	if n := atomic.LoadInt64(&sc.Damaged); n > 0 {
+		return fmt.Errorf("%d slices are damaged", n)
+	}
+	return nil
+}
+
+// visit returns the result of the slice, and true if it's not visited before, then the caller should read it
+// and set the result.
+func (sc *Scrubber) visit(chunkid uint64) (*scrubbedSlice, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+	if r, ok := sc.visited[chunkid]; ok {
+		return r, false
+	}
+	r := &scrubbedSlice{done: make(chan struct{})}
+	sc.visited[chunkid] = r
+	return r, true
+}
+
+// scrubSlice reads the slice once no matter how many files refer to it, but all of them are recorded as
+// damaged if it's damaged.
+func (sc *Scrubber) scrubSlice(inode Ino, s *meta.Slice) {
+	if s.Chunkid == 0 {
+		return
+	}
+	r, first := sc.visit(s.Chunkid)
+	if first {
+		r.err = sc.readSlice(s.Chunkid, int(s.Size))
+		close(r.done)
+		if r.err != nil {
+			atomic.AddInt64(&sc.Damaged, 1)
+		}
+		atomic.AddInt64(&sc.Slices, 1)
+		atomic.AddInt64(&sc.Bytes, int64(s.Size))
+		if sc.OnSlice != nil {
+			sc.OnSlice(int64(s.Size))
+		}
+	} else {
+		<-r.done
+	}
+	if r.err == nil {
+		return
+	}
+	sc.Lock()
+	p, ok := sc.damaged[inode]
+	sc.Unlock()
+	if !ok {
+		var st syscall.Errno
+		if p, st = meta.GetPath(sc.m, meta.Background, inode); st != 0 {
+			p = fmt.Sprintf("inode %d: %s", inode, st)
+		}
+		sc.Lock()
+		sc.damaged[inode] = p
+		sc.Unlock()
+	}
+	logger.Errorf("Slice %d (%d bytes) of file %s is damaged: %s", s.Chunkid, s.Size, p, r.err)
+}
+
+// readSlice reads all the blocks of a slice.
+func (sc *Scrubber) readSlice(chunkid uint64, size int) error {
+	r := sc.store.NewReader(chunkid, size)
+	for off := 0; off < size; off += sc.blockSize {
+		l := utils.Min(sc.blockSize, size-off)
+		page := chunk.NewOffPage(l)
+		n, err := r.ReadAt(context.Background(), page, off)
+		page.Release()
+		if err == nil && n < l {
+			err = fmt.Errorf("short read at %d: %d < %d", off, n, l)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScrubVolume scrubs the volume again and again, it's used by the clients in background.
+func ScrubVolume(m meta.Meta, store chunk.ChunkStore, blockSize int, conf ScrubConfig) {
+	for {
+		utils.SleepWithJitter(time.Hour)
+		sc := NewScrubber(m, store, blockSize, conf)
+		start := time.Now()
+		if err := sc.Run(); err != nil {
+			logger.Warnf("scrub the volume: %s", err)
+			for inode, p := range sc.DamagedFiles() {
+				logger.Warnf("damaged file (inode %d): %s", inode, p)
+			}
+		}
+		logger.Infof("scrub the volume: %s in %s", &sc.ScrubStat, time.Since(start))
+	}
+}
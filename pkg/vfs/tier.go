@@ -0,0 +1,101 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+type tierIndex struct {
+	m meta.Meta
+}
+
+// NewTierIndex returns a TierIndex which records the tiers of slices in the meta engine.
+func NewTierIndex(m meta.Meta) chunk.TierIndex {
+	return &tierIndex{m}
+}
+
+func (t *tierIndex) SetTier(chunkid uint64, tier uint8) error {
+	if st := t.m.SetSliceTier(meta.Background, chunkid, tier); st != 0 {
+		return st
+	}
+	return nil
+}
+
+func (t *tierIndex) FindTier(chunkid uint64) (uint8, error) {
+	var tier uint8
+	if st := t.m.GetSliceTier(meta.Background, chunkid, &tier); st != 0 {
+		return 0, st
+	}
+	return tier, nil
+}
+
+// tierOf returns the tier of new data written into a file, which is chosen by the TierXattr of the file or
+// the nearest ancestor directory having one. A name not in the tiers chooses the primary storage.
+func tierOf(m meta.Meta, format *meta.Format, inode Ino) uint8 {
+	if format == nil || len(format.Tiers) == 0 {
+		return 0
+	}
+	for inode > 0 {
+		var value []byte
+		if st := m.GetXattr(meta.Background, inode, meta.TierXattr, &value); st == 0 {
+			if t := format.FindTier(string(value)); t != nil {
+				return t.Id
+			}
+			return 0
+		}
+		if inode == rootID {
+			break
+		}
+		var attr Attr
+		if st := m.GetAttr(meta.Background, inode, &attr); st != 0 {
+			break
+		}
+		inode = attr.Parent // 0 for hard links
+	}
+	return 0
+}
+
+// placeByName sets the tier of a new file if its name matches the patterns of a tier.
+func (v *VFS) placeByName(ctx Context, inode Ino, name string) {
+	if v.Conf.Format == nil || len(v.Conf.Format.Tiers) == 0 {
+		return
+	}
+	if t := v.Conf.Format.MatchTier(name); t != nil {
+		if st := v.Meta.SetXattr(ctx, inode, meta.TierXattr, []byte(t.Name), 0); st != 0 {
+			logger.Warnf("set tier of %s (inode %d) to %s: %s", name, inode, t.Name, st)
+		}
+	}
+}
+
+// sliceTier returns the tier shared by all the slices, or 0 if they are in different tiers.
+func sliceTier(store chunk.ChunkStore, slices []meta.Slice) uint8 {
+	var tier uint8
+	var found bool
+	for _, s := range slices {
+		if s.Chunkid == 0 {
+			continue
+		}
+		t, err := store.SliceTier(s.Chunkid)
+		if err != nil || found && t != tier {
+			return 0
+		}
+		tier, found = t, true
+	}
+	return tier
+}
@@ -20,9 +20,11 @@ import (
 	"encoding/json"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/utils"
@@ -49,6 +51,7 @@ type Config struct {
 	DirEntryTimeout time.Duration
 	EntryTimeout    time.Duration
 	BackupMeta      time.Duration
+	BackupFormat    string `json:",omitempty"`
 	FastResolve     bool   `json:",omitempty"`
 	AccessLog       string `json:",omitempty"`
 	HideInternal    bool
@@ -150,6 +153,9 @@ func (v *VFS) Mknod(ctx Context, parent Ino, name string, mode uint16, cumask ui
 	var attr = &Attr{}
 	err = v.Meta.Mknod(ctx, parent, name, _type, mode&07777, cumask, rdev, "", &inode, attr)
 	if err == 0 {
+		if _type == meta.TypeFile {
+			v.placeByName(ctx, inode, name)
+		}
 		entry = &meta.Entry{Inode: inode, Attr: attr}
 	}
 	return
@@ -359,6 +365,7 @@ func (v *VFS) Create(ctx Context, parent Ino, name string, mode uint16, cumask u
 		err = syscall.EACCES
 	}
 	if err == 0 {
+		v.placeByName(ctx, inode, name)
 		v.UpdateLength(inode, attr)
 		fh = v.newFileHandle(inode, attr.Length, flags)
 		entry = &meta.Entry{Inode: inode, Attr: attr}
@@ -634,6 +641,9 @@ func (v *VFS) Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh
 	defer h.removeOp(ctx)
 
 	err = v.Meta.Fallocate(ctx, ino, mode, uint64(off), uint64(length))
+	if err == syscall.ENOTSUP && v.writer.Promote(ctx, ino) == 0 {
+		err = v.Meta.Fallocate(ctx, ino, mode, uint64(off), uint64(length))
+	}
 	return
 }
 
@@ -700,6 +710,9 @@ func (v *VFS) CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut
 		return
 	}
 	err = v.Meta.CopyFileRange(ctx, nodeIn, offIn, nodeOut, offOut, size, flags, &copied)
+	if err == syscall.ENOTSUP && v.writer.Promote(ctx, nodeIn) == 0 && v.writer.Promote(ctx, nodeOut) == 0 {
+		err = v.Meta.CopyFileRange(ctx, nodeIn, offIn, nodeOut, offOut, size, flags, &copied)
+	}
 	if err == 0 {
 		v.reader.Invalidate(nodeOut, offOut, size)
 	}
@@ -773,6 +786,17 @@ const (
 	xattrMaxSize = 65536
 )
 
+// aclType returns the type of ACL stored in the extended attribute, or 0 if it's not an ACL.
+func aclType(name string) uint8 {
+	switch name {
+	case acl.XattrAccess:
+		return acl.TypeAccess
+	case acl.XattrDefault:
+		return acl.TypeDefault
+	}
+	return 0
+}
+
 func (v *VFS) SetXattr(ctx Context, ino Ino, name string, value []byte, flags uint32) (err syscall.Errno) {
 	defer func() { logit(ctx, "setxattr (%d,%s,%d,%d): %s", ino, name, len(value), flags, strerr(err)) }()
 	if IsSpecialNode(ino) {
@@ -799,8 +823,18 @@ func (v *VFS) SetXattr(ctx Context, ino Ino, name string, value []byte, flags ui
 		err = syscall.EINVAL
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
-		err = syscall.ENOTSUP
+	if t := aclType(name); t != 0 {
+		if !v.Conf.Format.EnableACL {
+			err = syscall.ENOTSUP
+			return
+		}
+		rule, e := acl.DecodeXattr(value)
+		if e != nil {
+			logger.Debugf("invalid ACL %s of inode %d: %s", name, ino, e)
+			err = syscall.EINVAL
+			return
+		}
+		err = v.Meta.SetFacl(ctx, ino, t, rule)
 		return
 	}
 	err = v.Meta.SetXattr(ctx, ino, name, value, flags)
@@ -826,11 +860,18 @@ func (v *VFS) GetXattr(ctx Context, ino Ino, name string, size uint32) (value []
 		err = syscall.EINVAL
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
-		err = syscall.ENOTSUP
-		return
+	if t := aclType(name); t != 0 {
+		if !v.Conf.Format.EnableACL {
+			err = syscall.ENOTSUP
+			return
+		}
+		var rule acl.Rule
+		if err = v.Meta.GetFacl(ctx, ino, t, &rule); err == 0 {
+			value = rule.EncodeXattr()
+		}
+	} else {
+		err = v.Meta.GetXattr(ctx, ino, name, &value)
 	}
-	err = v.Meta.GetXattr(ctx, ino, name, &value)
 	if size > 0 && len(value) > int(size) {
 		err = syscall.ERANGE
 	}
@@ -856,9 +897,6 @@ func (v *VFS) RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno)
 		err = syscall.EPERM
 		return
 	}
-	if name == "system.posix_acl_access" || name == "system.posix_acl_default" {
-		return syscall.ENOTSUP
-	}
 	if len(name) > xattrMaxName {
 		if runtime.GOOS == "darwin" {
 			err = syscall.EPERM
@@ -871,6 +909,17 @@ func (v *VFS) RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno)
 		err = syscall.EINVAL
 		return
 	}
+	if t := aclType(name); t != 0 {
+		if !v.Conf.Format.EnableACL {
+			err = syscall.ENOTSUP
+			return
+		}
+		var rule acl.Rule
+		if err = v.Meta.GetFacl(ctx, ino, t, &rule); err == 0 {
+			err = v.Meta.SetFacl(ctx, ino, t, nil)
+		}
+		return
+	}
 	err = v.Meta.RemoveXattr(ctx, ino, name)
 	return
 }
@@ -888,6 +937,9 @@ type VFS struct {
 	hanleM  sync.Mutex
 	nextfh  uint64
 
+	watchers    meta.WatcherPool
+	kernelCache atomic.Value // KernelCache
+
 	handlersGause  prometheus.GaugeFunc
 	usedBufferSize prometheus.GaugeFunc
 	storeCacheSize prometheus.GaugeFunc
@@ -912,6 +964,10 @@ func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore, registerer promet
 	if conf.Meta.Subdir != "" { // don't show trash directory
 		internalNodes = internalNodes[:len(internalNodes)-1]
 	}
+	m.OnMsg(meta.InvalidateCache, func(args ...interface{}) error {
+		v.invalidateCache(args[0].(*meta.Change))
+		return nil
+	})
 
 	initVFSMetrics(v, writer, registerer)
 	return v
@@ -17,9 +17,12 @@
 package vfs
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"syscall"
@@ -27,6 +30,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
@@ -432,6 +436,372 @@ func TestVFSXattrs(t *testing.T) {
 	}
 }
 
+func TestVFSACL(t *testing.T) {
+	v, _ := createTestVFS()
+	format, _ := v.Meta.Load(false)
+	format.EnableACL = true
+	v.Conf.Format.EnableACL = true
+	ctx := NewLogContext(meta.Background)
+	fe, e := v.Mkdir(ctx, 1, "acls", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir acls: %s", e)
+	}
+	if _, e := v.GetXattr(ctx, fe.Inode, acl.XattrAccess, 0); e != meta.ENOATTR {
+		t.Fatalf("getxattr access ACL: %s", e)
+	}
+	rule := &acl.Rule{Owner: 7, Group: 5, Mask: 5, Other: 0, NamedUsers: acl.Entries{{Id: 1000, Perm: 7}}}
+	if e := v.SetXattr(ctx, fe.Inode, acl.XattrAccess, rule.EncodeXattr(), 0); e != 0 {
+		t.Fatalf("setxattr access ACL: %s", e)
+	}
+	if value, e := v.GetXattr(ctx, fe.Inode, acl.XattrAccess, 0); e != 0 || !reflect.DeepEqual(value, rule.EncodeXattr()) {
+		t.Fatalf("getxattr access ACL: %v %s", value, e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, acl.XattrDefault, rule.EncodeXattr(), 0); e != 0 {
+		t.Fatalf("setxattr default ACL: %s", e)
+	}
+	if e := v.SetXattr(ctx, fe.Inode, acl.XattrDefault, []byte("invalid"), 0); e != syscall.EINVAL {
+		t.Fatalf("setxattr invalid ACL: %s", e)
+	}
+	entry, e := v.GetAttr(ctx, fe.Inode, 0)
+	if e != 0 || entry.Attr.Mode&0777 != 0750 {
+		t.Fatalf("getattr: %s", e)
+	}
+	fe2, e := v.Mkdir(ctx, fe.Inode, "sub", 0777, 022)
+	if e != 0 {
+		t.Fatalf("mkdir sub: %s", e)
+	}
+	if fe2.Attr.Mode&0777 != 0750 {
+		t.Fatalf("mode of sub: %o", fe2.Attr.Mode)
+	}
+	if value, e := v.GetXattr(ctx, fe2.Inode, acl.XattrDefault, 0); e != 0 || !reflect.DeepEqual(value, rule.EncodeXattr()) {
+		t.Fatalf("getxattr default ACL of sub: %v %s", value, e)
+	}
+	if e := v.RemoveXattr(ctx, fe.Inode, acl.XattrAccess); e != 0 {
+		t.Fatalf("removexattr access ACL: %s", e)
+	}
+	if e := v.RemoveXattr(ctx, fe.Inode, acl.XattrAccess); e != meta.ENOATTR {
+		t.Fatalf("removexattr access ACL again: %s", e)
+	}
+	if _, e := v.GetXattr(ctx, fe.Inode, acl.XattrAccess, 0); e != meta.ENOATTR {
+		t.Fatalf("getxattr removed access ACL: %s", e)
+	}
+}
+
+func TestVFSInline(t *testing.T) {
+	v, _ := createTestVFS()
+	format, _ := v.Meta.Load(false)
+	format.InlineSize = 128
+	v.Conf.Format.InlineSize = 128
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "inline", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create inline: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, []byte("hello"), 10, fh); e != 0 {
+		t.Fatalf("write inline: %s", e)
+	}
+	var attr meta.Attr
+	var data []byte
+	if e = v.Meta.ReadInline(ctx, fe.Inode, &attr, &data); e != 0 || string(data) != "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00hello" {
+		t.Fatalf("read inline data %q: %s", data, e)
+	}
+	var buf = make([]byte, 300)
+	if n, e := v.Read(ctx, fe.Inode, buf, 8, fh); e != 0 || string(buf[:n]) != "\x00\x00hello" {
+		t.Fatalf("read inline file: %q %s", buf[:n], e)
+	}
+	if e = v.Write(ctx, fe.Inode, bytes.Repeat([]byte("a"), 200), 100, fh); e != 0 {
+		t.Fatalf("write beyond inline size: %s", e)
+	}
+	if e = v.Meta.ReadInline(ctx, fe.Inode, &attr, &data); e != syscall.ENODATA {
+		t.Fatalf("read inline data after promoted: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush: %s", e)
+	}
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || n != 300 || string(buf[10:15]) != "hello" || string(buf[100:300]) != string(bytes.Repeat([]byte("a"), 200)) {
+		t.Fatalf("read promoted file: %d %s", n, e)
+	}
+
+	fe2, fh2, e := v.Create(ctx, 1, "inline2", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create inline2: %s", e)
+	}
+	if e = v.Write(ctx, fe2.Inode, []byte("world"), 0, fh2); e != 0 {
+		t.Fatalf("write inline2: %s", e)
+	}
+	if e = v.Fallocate(ctx, fe2.Inode, 0, 0, 1<<20, fh2); e != 0 {
+		t.Fatalf("fallocate inline2: %s", e)
+	}
+	if e = v.Meta.ReadInline(ctx, fe2.Inode, &attr, &data); e != syscall.ENODATA {
+		t.Fatalf("read inline data after fallocate: %s", e)
+	}
+	if e = v.Meta.GetAttr(ctx, fe2.Inode, &attr); e != 0 || attr.Length != 1<<20 {
+		t.Fatalf("getattr after fallocate: length %d: %s", attr.Length, e)
+	}
+	if n, e := v.Read(ctx, fe2.Inode, buf[:5], 0, fh2); e != 0 || string(buf[:n]) != "world" {
+		t.Fatalf("read inline2 after fallocate: %q %s", buf[:n], e)
+	}
+}
+
+func TestVFSPack(t *testing.T) {
+	v, blob := createTestVFS()
+	format, _ := v.Meta.Load(false)
+	format.PackSize = 64
+	v.Conf.Format.PackSize = 64
+	newVFS := func() *VFS {
+		conf := *v.Conf.Chunk
+		conf.PackSize = 64 << 10
+		conf.CacheSize = 0
+		store := chunk.NewCachedStore(blob, conf, nil)
+		store.SetPackIndex(NewPackIndex(v.Meta))
+		return NewVFS(v.Conf, v.Meta, store, nil, nil)
+	}
+	v = newVFS()
+	ctx := NewLogContext(meta.Background)
+	var inodes []Ino
+	for i := 0; i < 5; i++ {
+		fe, fh, e := v.Create(ctx, 1, fmt.Sprintf("pack%d", i), 0644, 0, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("create pack%d: %s", i, e)
+		}
+		if e = v.Write(ctx, fe.Inode, bytes.Repeat([]byte{byte('a' + i)}, 1000*(i+1)), 0, fh); e != 0 {
+			t.Fatalf("write pack%d: %s", i, e)
+		}
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush pack%d: %s", i, e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+		inodes = append(inodes, fe.Inode)
+	}
+	if objs, err := blob.List("chunks/", "", 100); err != nil || len(objs) != 0 {
+		t.Fatalf("expect no chunk object, but got %d: %v", len(objs), err)
+	}
+	if objs, err := blob.List("packs/", "", 100); err != nil || len(objs) == 0 {
+		t.Fatalf("expect some packs, but got %d: %v", len(objs), err)
+	}
+
+	v = newVFS() // without cache
+	for i, inode := range inodes {
+		fe, fh, e := v.Open(ctx, inode, syscall.O_RDONLY)
+		if e != 0 {
+			t.Fatalf("open pack%d: %s", i, e)
+		}
+		buf := make([]byte, 10000)
+		if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || !bytes.Equal(buf[:n], bytes.Repeat([]byte{byte('a' + i)}, 1000*(i+1))) {
+			t.Fatalf("read pack%d: %d %s", i, n, e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+}
+
+func TestVFSTier(t *testing.T) {
+	v, blob := createTestVFS()
+	tiers := []meta.Tier{{Id: 2, Name: "cold", Storage: "mem", Patterns: []string{"*.log"}}}
+	format, _ := v.Meta.Load(false)
+	format.Tiers = tiers
+	v.Conf.Format.Tiers = tiers
+	cold, _ := object.CreateStorage("mem", "", "", "")
+	conf := *v.Conf.Chunk
+	conf.CacheSize = 0
+	store := chunk.NewCachedStore(blob, conf, nil)
+	store.SetTiers(NewTierIndex(v.Meta), func(tier uint8) (object.ObjectStorage, error) {
+		return cold, nil
+	})
+	v = NewVFS(v.Conf, v.Meta, store, nil, nil)
+	ctx := NewLogContext(meta.Background)
+
+	de, e := v.Mkdir(ctx, 1, "archive", 0755, 0)
+	if e != 0 {
+		t.Fatalf("mkdir archive: %s", e)
+	}
+	if e = v.SetXattr(ctx, de.Inode, meta.TierXattr, []byte("cold"), 0); e != 0 {
+		t.Fatalf("set tier of archive: %s", e)
+	}
+	files := []struct {
+		parent Ino
+		name   string
+		tier   uint8
+	}{{1, "a.txt", 0}, {1, "b.log", 2}, {de.Inode, "c.txt", 2}}
+	for _, f := range files {
+		fe, fh, e := v.Create(ctx, f.parent, f.name, 0644, 0, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("create %s: %s", f.name, e)
+		}
+		if e = v.Write(ctx, fe.Inode, []byte(f.name), 0, fh); e != 0 {
+			t.Fatalf("write %s: %s", f.name, e)
+		}
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush %s: %s", f.name, e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+		var slices []meta.Slice
+		if e = v.Meta.Read(ctx, fe.Inode, 0, &slices); e != 0 || len(slices) != 1 {
+			t.Fatalf("read slices of %s: %+v %s", f.name, slices, e)
+		}
+		if tier, err := store.SliceTier(slices[0].Chunkid); err != nil || tier != f.tier {
+			t.Fatalf("tier of %s: %d %v, expect %d", f.name, tier, err, f.tier)
+		}
+
+		fe, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+		if e != 0 {
+			t.Fatalf("open %s: %s", f.name, e)
+		}
+		buf := make([]byte, 100)
+		if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || string(buf[:n]) != f.name {
+			t.Fatalf("read %s: %q %s", f.name, buf[:n], e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+	if objs, err := blob.List("chunks/", "", 100); err != nil || len(objs) != 1 {
+		t.Fatalf("expect 1 object in the primary storage, but got %d: %v", len(objs), err)
+	}
+	if objs, err := cold.List("chunks/", "", 100); err != nil || len(objs) != 2 {
+		t.Fatalf("expect 2 objects in tier cold, but got %d: %v", len(objs), err)
+	}
+
+	mg := NewMigrator(v.Meta, store, conf.BlockSize, MigrateConfig{To: 2, Threads: 2})
+	if err := mg.Run("/"); err != nil || mg.Files != 3 || mg.Slices != 1 {
+		t.Fatalf("migrate into cold: %s %s", &mg.MigrateStat, err)
+	}
+	mg = NewMigrator(v.Meta, store, conf.BlockSize, MigrateConfig{To: 0, Threads: 2})
+	if err := mg.Run("/archive"); err != nil || mg.Files != 1 || mg.Slices != 1 {
+		t.Fatalf("migrate archive into primary: %s %s", &mg.MigrateStat, err)
+	}
+	if objs, err := blob.List("chunks/", "", 100); err != nil || len(objs) != 1 {
+		t.Fatalf("expect 1 object in the primary storage, but got %d: %v", len(objs), err)
+	}
+	if objs, err := cold.List("chunks/", "", 100); err != nil || len(objs) != 2 {
+		t.Fatalf("expect 2 objects in tier cold, but got %d: %v", len(objs), err)
+	}
+	for _, f := range []struct {
+		parent Ino
+		name   string
+	}{{1, "a.txt"}, {de.Inode, "c.txt"}} {
+		fe, e := v.Lookup(ctx, f.parent, f.name)
+		if e != 0 {
+			t.Fatalf("lookup %s: %s", f.name, e)
+		}
+		fe, fh, e := v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+		if e != 0 {
+			t.Fatalf("open %s: %s", f.name, e)
+		}
+		buf := make([]byte, 100)
+		if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || string(buf[:n]) != f.name {
+			t.Fatalf("read %s after migration: %q %s", f.name, buf[:n], e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+
+	// the copy of a slice deleted during migration is removed
+	fe, fh, e := v.Create(ctx, 1, "d.txt", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create d.txt: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, []byte("d.txt"), 0, fh); e != 0 {
+		t.Fatalf("write d.txt: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush d.txt: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	var slices []meta.Slice
+	if e = v.Meta.Read(ctx, fe.Inode, 0, &slices); e != 0 || len(slices) != 1 {
+		t.Fatalf("read slices of d.txt: %+v %s", slices, e)
+	}
+	hooked := &hookedStore{ChunkStore: store, afterCopy: func() {
+		if e := v.Truncate(ctx, fe.Inode, 0, 0, nil); e != 0 {
+			t.Fatalf("truncate d.txt: %s", e)
+		}
+	}}
+	if err := MigrateSlice(v.Meta, hooked, fe.Inode, 0, slices[0].Chunkid, slices[0].Size, 0, 2); err != errSliceDeleted {
+		t.Fatalf("migrate deleted slice: %v", err)
+	}
+	if tier, err := store.SliceTier(slices[0].Chunkid); err != nil || tier != 0 {
+		t.Fatalf("tier of deleted slice: %d %v", tier, err)
+	}
+	if objs, err := cold.List("chunks/", "", 100); err != nil || len(objs) != 2 {
+		t.Fatalf("expect 2 objects in tier cold, but got %d: %v", len(objs), err)
+	}
+}
+
+type hookedStore struct {
+	chunk.ChunkStore
+	afterCopy func()
+}
+
+func (s *hookedStore) CopySlice(chunkid uint64, length int, from, to uint8) error {
+	err := s.ChunkStore.CopySlice(chunkid, length, from, to)
+	s.afterCopy()
+	return err
+}
+
+func TestVFSScrub(t *testing.T) {
+	v, blob := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	var inodes []Ino
+	for _, name := range []string{"a", "b"} {
+		fe, fh, e := v.Create(ctx, 1, name, 0644, 0, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("create %s: %s", name, e)
+		}
+		if e = v.Write(ctx, fe.Inode, bytes.Repeat([]byte(name), 1000), 0, fh); e != 0 {
+			t.Fatalf("write %s: %s", name, e)
+		}
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush %s: %s", name, e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+		inodes = append(inodes, fe.Inode)
+	}
+	conf := *v.Conf.Chunk
+	conf.CacheSize = 0
+	store := chunk.NewCachedStore(blob, conf, nil)
+	checkpoint := filepath.Join(t.TempDir(), "scrub.json")
+	sc := NewScrubber(v.Meta, store, conf.BlockSize, ScrubConfig{Threads: 2, Checkpoint: checkpoint})
+	if err := sc.Run(); err != nil || sc.Files != 2 || sc.Slices != 2 || sc.Bytes != 2000 {
+		t.Fatalf("scrub: %s %s", &sc.ScrubStat, err)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint should be removed: %v", err)
+	}
+
+	// c shares the slice of a
+	fe, fh, e := v.Create(ctx, 1, "c", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create c: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	var copied uint64
+	if e = v.Meta.CopyFileRange(ctx, inodes[0], 0, fe.Inode, 0, 1000, 0, &copied); e != 0 || copied != 1000 {
+		t.Fatalf("copy a to c: %d %s", copied, e)
+	}
+	inodes = append(inodes, fe.Inode)
+
+	var slices []meta.Slice
+	if e := v.Meta.Read(ctx, inodes[0], 0, &slices); e != 0 || len(slices) != 1 {
+		t.Fatalf("read slices of a: %+v %s", slices, e)
+	}
+	id := slices[0].Chunkid
+	_ = blob.Put(fmt.Sprintf("chunks/%d/%d/%d_0_1000", id/1000/1000, id/1000, id), bytes.NewReader([]byte("broken")))
+	sc = NewScrubber(v.Meta, store, conf.BlockSize, ScrubConfig{Threads: 2})
+	if err := sc.Run(); err == nil || sc.Files != 3 || sc.Slices != 2 || sc.Damaged != 1 {
+		t.Fatalf("scrub with damaged files: %s %v", &sc.ScrubStat, err)
+	}
+	if damaged := sc.DamagedFiles(); len(damaged) != 2 || damaged[inodes[0]] != "/a" || damaged[inodes[2]] != "/c" {
+		t.Fatalf("damaged files: %+v", damaged)
+	}
+
+	// resume from the checkpoint
+	_ = os.WriteFile(checkpoint, []byte(fmt.Sprintf(`{"Inode":%d}`, inodes[0])), 0644)
+	sc = NewScrubber(v.Meta, store, conf.BlockSize, ScrubConfig{Threads: 2, Checkpoint: checkpoint})
+	if err := sc.Run(); err == nil || sc.Files != 2 || sc.Slices != 2 || sc.Damaged != 1 {
+		t.Fatalf("scrub from checkpoint: %s %v", &sc.ScrubStat, err)
+	}
+	if damaged := sc.DamagedFiles(); len(damaged) != 1 || damaged[inodes[2]] != "/c" {
+		t.Fatalf("damaged files after resumed: %+v", damaged)
+	}
+}
+
 type accessCase struct {
 	uid  uint32
 	gid  uint32
@@ -45,6 +45,8 @@ type DataWriter interface {
 	Flush(ctx meta.Context, inode Ino) syscall.Errno
 	GetLength(inode Ino) uint64
 	Truncate(inode Ino, length uint64)
+	// Promote writes the data of a file stored inline in meta engine into object storage.
+	Promote(ctx meta.Context, inode Ino) syscall.Errno
 }
 
 type sliceWriter struct {
@@ -204,7 +206,7 @@ func (c *chunkWriter) commitThread() {
 
 		f.Lock()
 		if err != 0 {
-			if err != syscall.ENOENT && err != syscall.ENOSPC {
+			if err != syscall.ENOENT && err != syscall.ENOSPC && err != syscall.EDQUOT {
 				logger.Warnf("write inode:%d error: %s", f.inode, err)
 				err = syscall.EIO
 			}
@@ -222,6 +224,8 @@ type fileWriter struct {
 
 	inode        Ino
 	length       uint64
+	inline       int8  // 1: the data is stored inline, -1: it's not, 0: unknown
+	tier         int16 // tier of new data, -1: unknown
 	err          syscall.Errno
 	flushwaiting uint16
 	writewaiting uint16
@@ -262,6 +266,10 @@ func (f *fileWriter) writeChunk(ctx meta.Context, indx uint32, off uint32, data
 			notify:  utils.NewCond(&f.Mutex),
 			started: time.Now(),
 		}
+		if f.tier < 0 {
+			f.tier = int16(tierOf(f.w.m, f.w.format, f.inode))
+		}
+		s.writer.SetTier(uint8(f.tier))
 		c.slices = append(c.slices, s)
 		if len(c.slices) == 1 {
 			f.w.Lock()
@@ -287,7 +295,85 @@ func (w *dataWriter) usedBufferSize() int64 {
 	return utils.AllocMemory() - w.store.UsedMemory()
 }
 
+// protected by file
+func (f *fileWriter) tryInline(ctx meta.Context, off uint64, data []byte) syscall.Errno {
+	if f.inline < 0 {
+		return syscall.ENOTSUP
+	}
+	end := off + uint64(len(data))
+	if end > f.w.inlineSize() || len(f.chunks) > 0 {
+		if f.inline == 0 && f.length == 0 {
+			f.inline = -1 // an empty file has no inline data
+			return syscall.ENOTSUP
+		}
+		return syscall.EFBIG
+	}
+	st := f.w.m.WriteInline(ctx, f.inode, off, data)
+	switch st {
+	case 0:
+		f.inline = 1
+		if end > f.length {
+			f.length = end
+		}
+	case syscall.ENODATA:
+		f.inline = -1
+		st = syscall.ENOTSUP
+	}
+	return st
+}
+
+// writeInline writes the data into meta engine if the file is stored inline (or empty), or promotes
+// the file if the data does not fit. It returns ENOTSUP if the data should be written into chunks.
+func (f *fileWriter) writeInline(ctx meta.Context, off uint64, data []byte) syscall.Errno {
+	f.Lock()
+	st := f.tryInline(ctx, off, data)
+	f.Unlock()
+	switch st {
+	case 0:
+		f.w.reader.Invalidate(f.inode, off, uint64(len(data)))
+	case syscall.EFBIG:
+		if st = f.promote(ctx); st == 0 {
+			st = syscall.ENOTSUP
+		}
+	}
+	return st
+}
+
+// promote writes the inline data into object storage, which is removed from meta engine once the slice
+// is committed. The slice is flushed before any new data, so the file is readable all the time.
+func (f *fileWriter) promote(ctx meta.Context) syscall.Errno {
+	var attr meta.Attr
+	var data []byte
+	st := f.w.m.ReadInline(ctx, f.inode, &attr, &data)
+	if st == syscall.ENODATA {
+		f.Lock()
+		f.inline = -1
+		f.Unlock()
+		return 0
+	} else if st != 0 {
+		return st
+	}
+	f.Lock()
+	f.inline = -1
+	if attr.Length > f.length {
+		f.length = attr.Length
+	}
+	if len(data) > 0 {
+		st = f.writeChunk(ctx, 0, 0, data)
+	}
+	f.Unlock()
+	if st != 0 {
+		return st
+	}
+	return f.Flush(ctx)
+}
+
 func (f *fileWriter) Write(ctx meta.Context, off uint64, data []byte) syscall.Errno {
+	if f.w.inlineSize() > 0 && len(data) > 0 {
+		if st := f.writeInline(ctx, off, data); st != syscall.ENOTSUP {
+			return st
+		}
+	}
 	for {
 		if f.totalSlices() < 1000 {
 			break
@@ -411,6 +497,7 @@ func (f *fileWriter) Truncate(length uint64) {
 type dataWriter struct {
 	sync.Mutex
 	m          meta.Meta
+	format     *meta.Format
 	store      chunk.ChunkStore
 	reader     DataReader
 	blockSize  int
@@ -422,6 +509,7 @@ type dataWriter struct {
 func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore, reader DataReader) DataWriter {
 	w := &dataWriter{
 		m:          m,
+		format:     conf.Format,
 		store:      store,
 		reader:     reader,
 		blockSize:  conf.Chunk.BlockSize,
@@ -433,6 +521,13 @@ func NewDataWriter(conf *Config, m meta.Meta, store chunk.ChunkStore, reader Dat
 	return w
 }
 
+func (w *dataWriter) inlineSize() uint64 {
+	if w.format == nil {
+		return 0
+	}
+	return uint64(w.format.InlineSize)
+}
+
 func (w *dataWriter) flushAll() {
 	for {
 		w.Lock()
@@ -472,6 +567,7 @@ func (w *dataWriter) Open(inode Ino, len uint64) FileWriter {
 			w:      w,
 			inode:  inode,
 			length: len,
+			tier:   -1,
 			chunks: make(map[uint32]*chunkWriter),
 		}
 		f.flushcond = utils.NewCond(f)
@@ -513,6 +609,12 @@ func (w *dataWriter) GetLength(inode Ino) uint64 {
 	return 0
 }
 
+func (w *dataWriter) Promote(ctx meta.Context, inode Ino) syscall.Errno {
+	f := w.Open(inode, 0).(*fileWriter)
+	defer w.free(f)
+	return f.promote(ctx)
+}
+
 func (w *dataWriter) Truncate(inode Ino, len uint64) {
 	f := w.find(inode)
 	if f != nil {
@@ -42,6 +42,7 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/juicedata/juicefs/pkg/acl"
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/fs"
 	"github.com/juicedata/juicefs/pkg/meta"
@@ -84,6 +85,7 @@ const (
 	ENOTEMPTY = -0x27
 	ENODATA   = -0x3d
 	ENOTSUP   = -0x5f
+	EDQUOT    = -0x7a
 )
 
 func errno(err error) int {
@@ -125,6 +127,8 @@ func errno(err error) int {
 		return ENODATA
 	case syscall.ENOTSUP:
 		return ENOTSUP
+	case syscall.EDQUOT:
+		return EDQUOT
 	default:
 		logger.Warnf("unknown errno %d: %s", eno, err)
 		return -int(eno)
@@ -295,7 +299,9 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 	}
 	var blob object.ObjectStorage
 	var err error
-	if format.Shards > 1 {
+	if format.ParityShards > 0 {
+		blob, err = object.NewErasure(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.DataShards, format.ParityShards)
+	} else if format.Shards > 1 {
 		blob, err = object.NewSharded(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey, format.Shards)
 	} else {
 		blob, err = object.CreateStorage(strings.ToLower(format.Storage), format.Bucket, format.AccessKey, format.SecretKey)
@@ -303,7 +309,33 @@ func createStorage(format meta.Format) (object.ObjectStorage, error) {
 	if err != nil {
 		return nil, err
 	}
-	return object.WithPrefix(blob, format.Name+"/"), nil
+	blob = object.WithPrefix(blob, format.Name+"/")
+	if r := format.Replica; r != nil {
+		format.Storage, format.Bucket, format.AccessKey, format.SecretKey = r.Storage, r.Bucket, r.AccessKey, r.SecretKey
+		format.Shards, format.DataShards, format.ParityShards = 0, 0, 0
+		format.Replica = nil
+		replica, err := createStorage(format)
+		if err != nil {
+			return nil, fmt.Errorf("replica: %s", err)
+		}
+		blob = object.NewReplicated(blob, replica, time.Second*10)
+	}
+	return blob, nil
+}
+
+func createTierStorage(format meta.Format, tier uint8) (object.ObjectStorage, error) {
+	if err := format.Decrypt(); err != nil {
+		return nil, fmt.Errorf("format decrypt: %s", err)
+	}
+	for _, t := range format.Tiers {
+		if t.Id == tier {
+			format.Storage, format.Bucket, format.AccessKey, format.SecretKey = t.Storage, t.Bucket, t.AccessKey, t.SecretKey
+			format.Shards, format.DataShards, format.ParityShards = 0, 0, 0
+			format.Replica = nil
+			return createStorage(format)
+		}
+	}
+	return nil, fmt.Errorf("tier %d is not found", tier)
 }
 
 //export jfs_init
@@ -426,6 +458,9 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			PutTimeout:     time.Second * time.Duration(jConf.PutTimeout),
 			BufferSize:     jConf.MemorySize << 20,
 			Readahead:      jConf.Readahead << 20,
+			PackSize:       format.PackSize << 10,
+			Dedup:          format.Dedup,
+			Checksum:       format.BlockChecksum,
 		}
 		if chunkConf.CacheDir != "memory" {
 			ds := utils.SplitDir(chunkConf.CacheDir)
@@ -445,6 +480,24 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			chunkid := args[1].(uint64)
 			return vfs.Compact(chunkConf, store, slices, chunkid)
 		})
+		m.OnMsg(meta.DeletePack, func(args ...interface{}) error {
+			return store.RemovePack(args[0].(uint64))
+		})
+		m.OnMsg(meta.CompactPack, func(args ...interface{}) error {
+			return vfs.Repack(store, args[0].(uint64), args[1].([]meta.PackedSlice), args[2].(*meta.Pack))
+		})
+		m.OnMsg(meta.DeleteBlock, func(args ...interface{}) error {
+			return store.RemoveBlock(args[0].(uint64), args[1].(uint32), args[2].(uint32))
+		})
+		store.SetPackIndex(vfs.NewPackIndex(m))
+		store.SetDedupIndex(vfs.NewDedupIndex(m))
+		store.SetTiers(vfs.NewTierIndex(m), func(tier uint8) (object.ObjectStorage, error) {
+			format, err := m.Load(false)
+			if err != nil {
+				return nil, err
+			}
+			return createTierStorage(*format, tier)
+		})
 		err = m.NewSession()
 		if err != nil {
 			logger.Fatalf("new session: %s", err)
@@ -462,7 +515,7 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 			BackupMeta:      time.Second * time.Duration(jConf.BackupMeta),
 		}
 		if !jConf.ReadOnly && !jConf.NoBGJob && conf.BackupMeta > 0 {
-			go vfs.Backup(m, blob, conf.BackupMeta)
+			go vfs.Backup(m, blob, conf.BackupMeta, meta.DumpJSON)
 		}
 		if !jConf.NoUsageReport {
 			go usage.ReportUsage(m, "java-sdk "+version.Version())
@@ -744,6 +797,123 @@ func jfs_removeXattr(pid int, h uintptr, path *C.char, name *C.char) int {
 	return errno(w.RemoveXattr(w.withPid(pid), C.GoString(path), C.GoString(name)))
 }
 
+// ACL entries are exchanged as text, e.g. "user::rwx,user:alice:r-x,group::r--,mask::r-x,other::---"
+func formatPerm(perm uint16) string {
+	b := []byte("---")
+	if perm&4 != 0 {
+		b[0] = 'r'
+	}
+	if perm&2 != 0 {
+		b[1] = 'w'
+	}
+	if perm&1 != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+func parsePerm(s string) (uint16, bool) {
+	if len(s) != 3 {
+		return 0, false
+	}
+	var perm uint16
+	for i, c := range s {
+		switch {
+		case c == '-':
+		case c == rune("rwx"[i]):
+			perm |= 4 >> i
+		default:
+			return 0, false
+		}
+	}
+	return perm, true
+}
+
+func (w *wrapper) formatACL(rule *acl.Rule) string {
+	entries := []string{"user::" + formatPerm(rule.Owner)}
+	for _, e := range rule.NamedUsers {
+		entries = append(entries, "user:"+w.uid2name(e.Id)+":"+formatPerm(e.Perm))
+	}
+	entries = append(entries, "group::"+formatPerm(rule.Group))
+	for _, e := range rule.NamedGroups {
+		entries = append(entries, "group:"+w.gid2name(e.Id)+":"+formatPerm(e.Perm))
+	}
+	if rule.Mask != acl.None {
+		entries = append(entries, "mask::"+formatPerm(rule.Mask))
+	}
+	entries = append(entries, "other::"+formatPerm(rule.Other))
+	return strings.Join(entries, ",")
+}
+
+func (w *wrapper) parseACL(spec string) (*acl.Rule, bool) {
+	rule := &acl.Rule{Owner: acl.None, Group: acl.None, Mask: acl.None, Other: acl.None}
+	for _, entry := range strings.Split(spec, ",") {
+		ps := strings.Split(entry, ":")
+		if len(ps) != 3 {
+			return nil, false
+		}
+		perm, ok := parsePerm(ps[2])
+		if !ok {
+			return nil, false
+		}
+		switch {
+		case ps[0] == "user" && ps[1] == "":
+			rule.Owner = perm
+		case ps[0] == "user":
+			rule.NamedUsers = append(rule.NamedUsers, acl.Entry{Id: w.lookupUid(ps[1]), Perm: perm})
+		case ps[0] == "group" && ps[1] == "":
+			rule.Group = perm
+		case ps[0] == "group":
+			rule.NamedGroups = append(rule.NamedGroups, acl.Entry{Id: w.lookupGid(ps[1]), Perm: perm})
+		case ps[0] == "mask" && ps[1] == "":
+			rule.Mask = perm
+		case ps[0] == "other" && ps[1] == "":
+			rule.Other = perm
+		default:
+			return nil, false
+		}
+	}
+	if rule.Owner == acl.None || rule.Group == acl.None || rule.Other == acl.None {
+		return nil, false
+	}
+	return rule, true
+}
+
+//export jfs_setfacl
+func jfs_setfacl(pid int, h uintptr, path *C.char, aclType int, spec *C.char) int {
+	w := F(h)
+	if w == nil {
+		return EINVAL
+	}
+	var rule *acl.Rule
+	if s := C.GoString(spec); s != "" {
+		var ok bool
+		if rule, ok = w.parseACL(s); !ok {
+			return EINVAL
+		}
+	}
+	return errno(w.SetFacl(w.withPid(pid), C.GoString(path), uint8(aclType), rule))
+}
+
+//export jfs_getfacl
+func jfs_getfacl(pid int, h uintptr, path *C.char, aclType int, buf uintptr, bufsize int) int {
+	w := F(h)
+	if w == nil {
+		return EINVAL
+	}
+	var rule acl.Rule
+	err := w.GetFacl(w.withPid(pid), C.GoString(path), uint8(aclType), &rule)
+	if err != 0 {
+		return errno(err)
+	}
+	spec := w.formatACL(&rule)
+	if len(spec) >= bufsize {
+		return bufsize
+	}
+	copy(toBuf(buf, bufsize), spec)
+	return len(spec)
+}
+
 //export jfs_symlink
 func jfs_symlink(pid int, h uintptr, target *C.char, link *C.char) int {
 	w := F(h)
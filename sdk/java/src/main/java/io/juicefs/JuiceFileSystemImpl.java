@@ -32,6 +32,10 @@ import org.apache.hadoop.classification.InterfaceStability;
 import org.apache.hadoop.conf.Configuration;
 import org.apache.hadoop.fs.FileSystem;
 import org.apache.hadoop.fs.*;
+import org.apache.hadoop.fs.permission.AclEntry;
+import org.apache.hadoop.fs.permission.AclEntryScope;
+import org.apache.hadoop.fs.permission.AclEntryType;
+import org.apache.hadoop.fs.permission.AclStatus;
 import org.apache.hadoop.fs.permission.FsAction;
 import org.apache.hadoop.fs.permission.FsPermission;
 import org.apache.hadoop.io.DataOutputBuffer;
@@ -160,6 +164,10 @@ public class JuiceFileSystemImpl extends FileSystem {
     int jfs_listXattr(long pid, long h, String path, Pointer buf, int size);
 
     int jfs_removeXattr(long pid, long h, String path, String name);
+
+    int jfs_setfacl(long pid, long h, String path, int aclType, String spec);
+
+    int jfs_getfacl(long pid, long h, String path, int aclType, Pointer buf, int size);
   }
 
   static int EPERM = -0x01;
@@ -176,6 +184,7 @@ public class JuiceFileSystemImpl extends FileSystem {
   static int ENODATA = -0x3d;
   static int ENOATTR = -0x5d;
   static int ENOTSUP = -0x5f;
+  static int EDQUOT = -0x7a;
 
   static int MODE_MASK_R = 4;
   static int MODE_MASK_W = 2;
@@ -213,6 +222,8 @@ public class JuiceFileSystemImpl extends FileSystem {
       return new PathOperationException(p.toString());
     } else if (errno == ENOSPACE) {
       return new IOException("No space");
+    } else if (errno == EDQUOT) {
+      return new IOException("Quota exceeded");
     } else if (errno == EROFS) {
       return new IOException("Read-only Filesystem");
     } else if (errno == EIO) {
@@ -1598,4 +1609,208 @@ public class JuiceFileSystemImpl extends FileSystem {
     if (r < 0)
       throw error(r, path);
   }
+
+  static int ACL_TYPE_ACCESS = 1;
+  static int ACL_TYPE_DEFAULT = 2;
+
+  private static int aclType(AclEntryScope scope) {
+    return scope == AclEntryScope.ACCESS ? ACL_TYPE_ACCESS : ACL_TYPE_DEFAULT;
+  }
+
+  private static String aclKey(AclEntry e) {
+    return e.getScope() + ":" + e.getType() + ":" + (e.getName() == null ? "" : e.getName());
+  }
+
+  private static AclEntry aclEntry(AclEntryScope scope, AclEntryType type, String name, FsAction perm) {
+    return new AclEntry.Builder().setScope(scope).setType(type).setName(name).setPermission(perm).build();
+  }
+
+  // returns the entries of an ACL, or an empty list if it's not set (or minimal)
+  private List<AclEntry> getAcl(Path path, AclEntryScope scope) throws IOException {
+    Pointer buf;
+    int bufsize = 1024;
+    int r;
+    do {
+      bufsize *= 2;
+      buf = Memory.allocate(Runtime.getRuntime(lib), bufsize);
+      r = lib.jfs_getfacl(Thread.currentThread().getId(), handle, normalizePath(path), aclType(scope), buf, bufsize);
+    } while (r == bufsize);
+    List<AclEntry> entries = new ArrayList<AclEntry>();
+    if (r == ENOATTR || r == ENODATA)
+      return entries;
+    if (r < 0)
+      throw error(r, path);
+    byte[] value = new byte[r];
+    buf.get(0, value, 0, r);
+    for (AclEntry e : AclEntry.parseAclSpec(new String(value), true)) {
+      entries.add(aclEntry(scope, e.getType(), e.getName(), e.getPermission()));
+    }
+    return entries;
+  }
+
+  // returns the entries of both access and default ACL, the access one is built from permission if not set
+  private Map<String, AclEntry> getFullAcl(Path path) throws IOException {
+    Map<String, AclEntry> acl = new LinkedHashMap<String, AclEntry>();
+    List<AclEntry> access = getAcl(path, AclEntryScope.ACCESS);
+    if (access.isEmpty()) {
+      FsPermission perm = getFileStatus(path).getPermission();
+      access.add(aclEntry(AclEntryScope.ACCESS, AclEntryType.USER, null, perm.getUserAction()));
+      access.add(aclEntry(AclEntryScope.ACCESS, AclEntryType.GROUP, null, perm.getGroupAction()));
+      access.add(aclEntry(AclEntryScope.ACCESS, AclEntryType.OTHER, null, perm.getOtherAction()));
+    }
+    for (AclEntry e : access) {
+      acl.put(aclKey(e), e);
+    }
+    for (AclEntry e : getAcl(path, AclEntryScope.DEFAULT)) {
+      acl.put(aclKey(e), e);
+    }
+    return acl;
+  }
+
+  // stores the ACL of the scope, missing entries of a default ACL are copied from the access one,
+  // the mask is calculated from the group class if it's not specified.
+  private void putAcl(Path path, AclEntryScope scope, Collection<AclEntry> entries, boolean calcMask) throws IOException {
+    String spec = "";
+    if (!entries.isEmpty()) {
+      Map<AclEntryType, FsAction> base = new HashMap<AclEntryType, FsAction>();
+      List<AclEntry> named = new ArrayList<AclEntry>();
+      for (AclEntry e : entries) {
+        if (e.getName() == null) {
+          base.put(e.getType(), e.getPermission());
+        } else {
+          named.add(e);
+        }
+      }
+      if (scope == AclEntryScope.DEFAULT) {
+        for (AclEntry e : getFullAcl(path).values()) {
+          if (e.getScope() == AclEntryScope.ACCESS && e.getName() == null && e.getType() != AclEntryType.MASK
+                  && !base.containsKey(e.getType())) {
+            base.put(e.getType(), e.getPermission());
+          }
+        }
+      }
+      if (!base.containsKey(AclEntryType.USER) || !base.containsKey(AclEntryType.GROUP)
+              || !base.containsKey(AclEntryType.OTHER)) {
+        throw new HadoopIllegalArgumentException("Invalid ACL: the user, group and other entries are required.");
+      }
+      if (named.isEmpty()) {
+        base.remove(AclEntryType.MASK);
+      } else if (calcMask || !base.containsKey(AclEntryType.MASK)) {
+        FsAction mask = base.get(AclEntryType.GROUP);
+        for (AclEntry e : named) {
+          mask = mask.or(e.getPermission());
+        }
+        base.put(AclEntryType.MASK, mask);
+      }
+      List<String> parts = new ArrayList<String>();
+      for (AclEntryType t : new AclEntryType[]{AclEntryType.USER, AclEntryType.GROUP, AclEntryType.MASK, AclEntryType.OTHER}) {
+        if (base.containsKey(t)) {
+          parts.add(t.toString().toLowerCase() + "::" + base.get(t).SYMBOL);
+        }
+      }
+      for (AclEntry e : named) {
+        if (e.getType() != AclEntryType.USER && e.getType() != AclEntryType.GROUP) {
+          throw new HadoopIllegalArgumentException("Invalid ACL: only user and group entries can be named.");
+        }
+        parts.add(e.getType().toString().toLowerCase() + ":" + e.getName() + ":" + e.getPermission().SYMBOL);
+      }
+      spec = String.join(",", parts);
+    }
+    int r = lib.jfs_setfacl(Thread.currentThread().getId(), handle, normalizePath(path), aclType(scope), spec);
+    if (r < 0)
+      throw error(r, path);
+  }
+
+  // stores the ACLs of scopes mentioned in aclSpec
+  private void putFullAcl(Path path, Collection<AclEntry> acl, List<AclEntry> aclSpec) throws IOException {
+    for (AclEntryScope scope : new AclEntryScope[]{AclEntryScope.ACCESS, AclEntryScope.DEFAULT}) {
+      boolean touched = false, calcMask = true;
+      for (AclEntry e : aclSpec) {
+        if (e.getScope() == scope) {
+          touched = true;
+          if (e.getType() == AclEntryType.MASK) {
+            calcMask = false;
+          }
+        }
+      }
+      if (touched) {
+        List<AclEntry> entries = new ArrayList<AclEntry>();
+        for (AclEntry e : acl) {
+          if (e.getScope() == scope) {
+            entries.add(e);
+          }
+        }
+        putAcl(path, scope, entries, calcMask);
+      }
+    }
+  }
+
+  @Override
+  public void setAcl(Path path, List<AclEntry> aclSpec) throws IOException {
+    Map<String, AclEntry> acl = getFullAcl(path);
+    Iterator<AclEntry> it = acl.values().iterator();
+    while (it.hasNext()) {
+      AclEntryScope scope = it.next().getScope();
+      for (AclEntry e : aclSpec) {
+        if (e.getScope() == scope) {
+          it.remove();
+          break;
+        }
+      }
+    }
+    for (AclEntry e : aclSpec) {
+      acl.put(aclKey(e), e);
+    }
+    putFullAcl(path, acl.values(), aclSpec);
+  }
+
+  @Override
+  public void modifyAclEntries(Path path, List<AclEntry> aclSpec) throws IOException {
+    Map<String, AclEntry> acl = getFullAcl(path);
+    for (AclEntry e : aclSpec) {
+      acl.put(aclKey(e), e);
+    }
+    putFullAcl(path, acl.values(), aclSpec);
+  }
+
+  @Override
+  public void removeAclEntries(Path path, List<AclEntry> aclSpec) throws IOException {
+    Map<String, AclEntry> acl = getFullAcl(path);
+    for (AclEntry e : aclSpec) {
+      acl.remove(aclKey(e));
+    }
+    putFullAcl(path, acl.values(), aclSpec);
+  }
+
+  @Override
+  public void removeDefaultAcl(Path path) throws IOException {
+    putAcl(path, AclEntryScope.DEFAULT, Collections.<AclEntry>emptyList(), true);
+  }
+
+  @Override
+  public void removeAcl(Path path) throws IOException {
+    List<AclEntry> minimal = new ArrayList<AclEntry>();
+    for (AclEntry e : getFullAcl(path).values()) {
+      if (e.getScope() == AclEntryScope.ACCESS && e.getName() == null && e.getType() != AclEntryType.MASK) {
+        minimal.add(e);
+      }
+    }
+    putAcl(path, AclEntryScope.ACCESS, minimal, true);
+    removeDefaultAcl(path);
+  }
+
+  @Override
+  public AclStatus getAclStatus(Path path) throws IOException {
+    FileStatus st = getFileStatus(path);
+    List<AclEntry> entries = new ArrayList<AclEntry>();
+    for (AclEntry e : getAcl(path, AclEntryScope.ACCESS)) {
+      if (e.getName() != null || e.getType() == AclEntryType.GROUP) {
+        entries.add(e);
+      }
+    }
+    entries.addAll(getAcl(path, AclEntryScope.DEFAULT));
+    return new AclStatus.Builder().owner(st.getOwner()).group(st.getGroup())
+            .stickyBit(st.getPermission().getStickyBit()).setPermission(st.getPermission())
+            .addEntries(entries).build();
+  }
 }
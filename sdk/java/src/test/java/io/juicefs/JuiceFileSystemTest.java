@@ -22,6 +22,8 @@ import org.apache.commons.io.IOUtils;
 import org.apache.flink.runtime.fs.hdfs.HadoopRecoverableWriter;
 import org.apache.hadoop.conf.Configuration;
 import org.apache.hadoop.fs.*;
+import org.apache.hadoop.fs.permission.AclEntry;
+import org.apache.hadoop.fs.permission.AclStatus;
 import org.apache.hadoop.fs.permission.FsAction;
 import org.apache.hadoop.fs.permission.FsPermission;
 import org.apache.hadoop.io.MD5Hash;
@@ -476,6 +478,37 @@ public class JuiceFileSystemTest extends TestCase {
     assertEquals(0, names.size());
   }
 
+  public void testAcl() throws IOException {
+    Path p = new Path("/test-acl");
+    fs.delete(p, true);
+    fs.mkdirs(p, new FsPermission((short) 0750));
+    List<AclEntry> spec = AclEntry.parseAclSpec("user:nobody:r-x,default:group:nogroup:rwx", true);
+    try {
+      fs.modifyAclEntries(p, spec);
+    } catch (PathOperationException e) {
+      return; // ACL is not enabled in this volume
+    }
+    AclStatus st = fs.getAclStatus(p);
+    assertEquals(AclEntry.parseAclSpec("user:nobody:r-x,group::r-x,default:user::rwx,default:group::r-x," +
+            "default:group:nogroup:rwx,default:mask::rwx,default:other::---", true), st.getEntries());
+    assertEquals(0750, fs.getFileStatus(p).getPermission().toShort());
+
+    Path f = new Path(p, "f");
+    fs.create(f).close();
+    st = fs.getAclStatus(f);
+    assertEquals(AclEntry.parseAclSpec("group::r-x,group:nogroup:rwx", true), st.getEntries());
+
+    fs.setPermission(p, new FsPermission((short) 0700));
+    st = fs.getAclStatus(p);
+    assertEquals(AclEntry.parseAclSpec("user:nobody:r-x,group::r-x", true), st.getEntries().subList(0, 2));
+    assertEquals(0700, fs.getFileStatus(p).getPermission().toShort());
+
+    fs.removeAclEntries(p, AclEntry.parseAclSpec("user:nobody", false));
+    fs.removeDefaultAcl(p);
+    assertEquals(0, fs.getAclStatus(p).getEntries().size());
+    fs.delete(p, true);
+  }
+
   public void testAppend() throws Exception {
     Path f = new Path("/tmp/testappend");
     fs.delete(f);